@@ -18,6 +18,7 @@ package badger
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"io"
 	"log"
@@ -46,7 +47,8 @@ func writeTo(entry *protos.KVPair, w io.Writer) error {
 // later invocation to generate an incremental dump, of entries that have been
 // added/modified since the last invocation of DB.Backup()
 //
-// This can be used to backup the data in a database at a given point in time.
+// This can be used to backup the data in a database at a given point in time. The expired entries
+// are not dumped, the expiry time of the other entries is kept.
 func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
 	var tsNew uint64
 	err := db.View(func(txn *Txn) error {
@@ -55,23 +57,39 @@ func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
+		var expiredKey []byte
 		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
-			if item.Version() < since {
-				// Ignore versions less than given timestamp
+			if expiredKey != nil && bytes.Equal(item.Key(), expiredKey) {
+				// The older versions are hidden by the expired version.
 				continue
 			}
-			val, err := item.Value()
-			if err != nil {
-				log.Printf("Key [%x]. Error while fetching value [%v]\n", item.Key(), err)
+			if item.meta&bitDelete == 0 && item.IsDeleted() {
+				// Skip the expired version and the older versions, they are not visible anyway.
+				expiredKey = y.Copy(item.Key())
+				continue
+			}
+			if item.Version() < since {
+				// Ignore versions less than given timestamp
 				continue
 			}
-
 			entry := &protos.KVPair{
-				Key:      y.Copy(item.Key()),
-				Value:    y.Copy(val),
-				UserMeta: item.UserMeta(),
-				Version:  item.Version(),
+				Key:       y.Copy(item.Key()),
+				UserMeta:  item.UserMeta(),
+				Version:   item.Version(),
+				ExpiresAt: item.ExpiresAt(),
+			}
+			if item.IsDeleted() {
+				// Keep the delete tombstones, so the older versions are not visible after restore.
+				entry.Meta = uint32(bitDelete | item.AppMeta())
+			} else {
+				val, err := item.Value()
+				if err != nil {
+					log.Printf("Key [%x]. Error while fetching value [%v]\n", item.Key(), err)
+					continue
+				}
+				entry.Value = y.Copy(val)
+				entry.Meta = uint32(item.AppMeta())
 			}
 
 			// Write entries to disk
@@ -137,11 +155,17 @@ func (db *DB) Load(r io.Reader) error {
 		if err = e.Unmarshal(unmarshalBuf[:sz]); err != nil {
 			return err
 		}
-		entries = append(entries, &Entry{
-			Key:      y.KeyWithTs(e.Key, e.Version),
-			Value:    e.Value,
-			UserMeta: e.UserMeta,
-		})
+		entry := &Entry{
+			Key:       y.KeyWithTs(e.Key, e.Version),
+			Value:     e.Value,
+			UserMeta:  e.UserMeta,
+			ExpiresAt: e.ExpiresAt,
+			meta:      byte(e.Meta) & (bitDelete | AppMetaMask),
+		}
+		if entry.ExpiresAt != 0 {
+			entry.meta |= bitExpiresAt
+		}
+		entries = append(entries, entry)
 		// Update nextCommit, memtable stores this timestamp in badger head
 		// when flushed.
 		if e.Version >= db.orc.commitTs() {
@@ -24,7 +24,9 @@ import (
 	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/pingcap/badger/y"
 	"github.com/stretchr/testify/require"
 )
 
@@ -247,3 +249,78 @@ func Test_BackupRestore(t *testing.T) {
 	require.NoError(t, db3.Close())
 
 }
+
+func TestBackupDeleted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(filepath.Join(dir, "src")))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.Set([]byte("a"), []byte("1")))
+		return txn.Set([]byte("b"), []byte("1"))
+	}))
+	var full bytes.Buffer
+	since, err := db.Backup(&full, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.Delete([]byte("a")))
+		return txn.Set([]byte("c"), []byte("2"))
+	}))
+	var incremental bytes.Buffer
+	_, err = db.Backup(&incremental, since+1)
+	require.NoError(t, err)
+
+	db2, err := Open(getTestOptions(filepath.Join(dir, "dst")))
+	require.NoError(t, err)
+	defer db2.Close()
+	require.NoError(t, db2.Load(&full))
+	require.NoError(t, db2.Load(&incremental))
+	require.NoError(t, db2.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte("a"))
+		require.Equal(t, ErrKeyNotFound, err)
+		for _, key := range []string{"b", "c"} {
+			_, err = txn.Get([]byte(key))
+			require.NoError(t, err)
+		}
+		return nil
+	}))
+}
+
+func TestBackupTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(filepath.Join(dir, "src")))
+	require.NoError(t, err)
+	defer db.Close()
+
+	txnSet(t, db, []byte("expired"), []byte("old"), 0)
+	ttl := (&Entry{Key: y.KeyWithTs([]byte("ttl"), 0), Value: []byte("1")}).WithTTL(time.Hour)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.SetEntry(ttl))
+		expired := &Entry{Key: y.KeyWithTs([]byte("expired"), 0), Value: []byte("new"),
+			ExpiresAt: uint64(time.Now().Unix()) - 1}
+		return txn.SetEntry(expired)
+	}))
+	var buf bytes.Buffer
+	_, err = db.Backup(&buf, 0)
+	require.NoError(t, err)
+
+	db2, err := Open(getTestOptions(filepath.Join(dir, "dst")))
+	require.NoError(t, err)
+	defer db2.Close()
+	require.NoError(t, db2.Load(&buf))
+	require.NoError(t, db2.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("ttl"))
+		require.NoError(t, err)
+		require.Equal(t, ttl.ExpiresAt, item.ExpiresAt())
+		require.Equal(t, []byte("1"), getItemValue(t, item))
+		_, err = txn.Get([]byte("expired"))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+}
@@ -1,8 +1,10 @@
 package badger
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"math"
 	"os"
@@ -18,13 +20,16 @@ import (
 	"github.com/ncw/directio"
 	"github.com/pingcap/badger/epoch"
 	"github.com/pingcap/badger/fileutil"
+	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
-	"github.com/pingcap/log"
 	"go.uber.org/zap"
 )
 
-const blobFileSuffix = ".blob"
+const (
+	blobFileSuffix        = ".blob"
+	blobChangeLogFilename = "blob_change.log"
+)
 
 type blobPointer struct {
 	logicalAddr
@@ -56,6 +61,18 @@ entry:
 
 discard info:
 	/ logicalAddr(8) ... / totalDiscard(4) / discardInfoLength(4) /
+
+encrypted blob file:
+	The blobEncryptedFlag is set in addrMappingLength, the data key ID follows it.
+	/ addrMappingLength(4) / keyID(8) / addrMappingEntry(12) ... / entry ... /
+
+encrypted entry, value len includes the iv but the length in blob pointer doesn't:
+	/ value len(4) / iv(16) / encrypted value /
+
+checksummed blob file:
+	The blobChecksumFlag is set in addrMappingLength, every entry is followed by the CRC32 of the
+	stored value, the value len doesn't include it.
+	/ value len(4) / value(value len) / crc(4) /
 */
 type blobFile struct {
 	path           string
@@ -65,9 +82,12 @@ type blobFile struct {
 	mappingSize    uint32
 	mmap           []byte
 	mappingEntries []mappingEntry
+	dataKey        *options.DataKey
+	checksum       bool
 
 	// only accessed by gcHandler
 	totalDiscard uint32
+	punchedSize  uint32
 }
 
 func (bf *blobFile) getID() uint32 {
@@ -77,14 +97,35 @@ func (bf *blobFile) getID() uint32 {
 	return bf.fid
 }
 
-func (bf *blobFile) loadOffsetMap() error {
-	var headBuf [4]byte
-	_, err := bf.fd.ReadAt(headBuf[:], 0)
+const (
+	blobEncryptedFlag       uint32 = 1 << 31
+	blobChecksumFlag        uint32 = 1 << 30
+	blobEncryptedHeaderSize        = 12
+	blobChecksumSize               = 4
+)
+
+func (bf *blobFile) loadOffsetMap(registry options.KeyRegistry) error {
+	var headBuf [blobEncryptedHeaderSize]byte
+	_, err := bf.fd.ReadAt(headBuf[:4], 0)
 	if err != nil {
 		return err
 	}
-	bf.mappingSize = binary.LittleEndian.Uint32(headBuf[:])
-	if bf.mappingSize == 0 {
+	head := binary.LittleEndian.Uint32(headBuf[:])
+	bf.mappingSize = head &^ (blobEncryptedFlag | blobChecksumFlag)
+	bf.checksum = head&blobChecksumFlag != 0
+	mappingStart := uint32(4)
+	if head&blobEncryptedFlag != 0 {
+		if _, err = bf.fd.ReadAt(headBuf[4:], 4); err != nil {
+			return err
+		}
+		if bf.dataKey, err = registry.DataKey(binary.LittleEndian.Uint64(headBuf[4:])); err != nil {
+			return errors.Wrapf(err, "Unable to get the data key of blob file: %q", bf.path)
+		}
+		mappingStart = blobEncryptedHeaderSize
+	}
+	if bf.mappingSize <= mappingStart {
+		// The files written by flush have no address mapping.
+		bf.mappingSize = mappingStart
 		return nil
 	}
 	bf.mmap, err = y.Mmap(bf.fd, false, int64(bf.mappingSize))
@@ -92,9 +133,110 @@ func (bf *blobFile) loadOffsetMap() error {
 		return err
 	}
 	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&bf.mappingEntries))
-	hdr.Len = int(bf.mappingSize-4) / 12
+	hdr.Len = int(bf.mappingSize-mappingStart) / 12
 	hdr.Cap = hdr.Len
-	hdr.Data = uintptr(unsafe.Pointer(&bf.mmap[4]))
+	hdr.Data = uintptr(unsafe.Pointer(&bf.mmap[mappingStart]))
+	return nil
+}
+
+// blobHeader returns the header of a checksummed blob file with the address mapping length, the
+// file is encrypted if dataKey is not nil.
+func blobHeader(mappingSize uint32, dataKey *options.DataKey) []byte {
+	if dataKey == nil {
+		buf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(buf, mappingSize|blobChecksumFlag)
+		return buf
+	}
+	buf := make([]byte, blobEncryptedHeaderSize)
+	binary.LittleEndian.PutUint32(buf, mappingSize|blobEncryptedFlag|blobChecksumFlag)
+	binary.LittleEndian.PutUint64(buf[4:], dataKey.ID)
+	return buf
+}
+
+// storedLength returns the length of the value stored in the file.
+func (bf *blobFile) storedLength(bp blobPointer) uint32 {
+	if bf.dataKey != nil {
+		return bp.length + y.IVSize
+	}
+	return bp.length
+}
+
+// checksumSize returns the size of the checksum following every entry.
+func (bf *blobFile) checksumSize() uint32 {
+	if bf.checksum {
+		return blobChecksumSize
+	}
+	return 0
+}
+
+// verifyChecksum verifies the stored value at physicalOffset followed by its checksum.
+func (bf *blobFile) verifyChecksum(stored []byte, physicalOffset uint32) error {
+	n := len(stored) - blobChecksumSize
+	if crc32.Checksum(stored[:n], y.CastagnoliCrcTable) != binary.LittleEndian.Uint32(stored[n:]) {
+		return &ValueCorruptionError{Path: bf.path, Offset: physicalOffset}
+	}
+	return nil
+}
+
+// decryptValue decrypts the value read from the file into s, it returns the value as is if the
+// file is not encrypted.
+func (bf *blobFile) decryptValue(val []byte, s *y.Slice) ([]byte, error) {
+	if bf.dataKey == nil {
+		return val, nil
+	}
+	buf := s.Resize(len(val) - y.IVSize)
+	return buf, y.XORBlock(buf, val[y.IVSize:], bf.dataKey.Key, val[:y.IVSize])
+}
+
+// reclaimableDiscard returns the size of the discarded data still taking space in the file.
+func (bf *blobFile) reclaimableDiscard() uint32 {
+	return bf.totalDiscard - bf.punchedSize
+}
+
+// blobHoleAlignment is the alignment of the holes punched in the blob files, the space of a
+// partial file system block is not reclaimed.
+const blobHoleAlignment = 4096
+
+// discardedHoles returns the holes to punch over the discarded values, the holes are within the
+// values so the entries can still be iterated. It returns nil if there is no aligned range.
+func (bf *blobFile) discardedHoles(ptrs []blobPointer) *blobHoles {
+	holes := &blobHoles{path: bf.path}
+	for _, ptr := range ptrs {
+		physicalOff := bf.getPhysicalOffset(ptr.logicalAddr)
+		end := physicalOff + bf.storedLength(ptr) + bf.checksumSize()
+		start := (physicalOff + blobHoleAlignment - 1) / blobHoleAlignment * blobHoleAlignment
+		end = end / blobHoleAlignment * blobHoleAlignment
+		if end > start {
+			holes.ranges = append(holes.ranges, [2]int64{int64(start), int64(end - start)})
+			holes.size += end - start
+		}
+	}
+	if len(holes.ranges) == 0 {
+		return nil
+	}
+	return holes
+}
+
+// blobHoles are the ranges of a blob file to punch holes in, the holes are punched when they are
+// deleted as a resource so no reader is reading the discarded values.
+type blobHoles struct {
+	path   string
+	ranges [][2]int64
+	size   uint32
+}
+
+func (bh *blobHoles) Delete() error {
+	f, err := os.OpenFile(bh.path, os.O_WRONLY, 0666)
+	if err != nil {
+		// The file may have been removed by GC or DropAll.
+		return err
+	}
+	defer f.Close()
+	for _, r := range bh.ranges {
+		if err = fileutil.PunchHole(f, r[0], r[1]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -108,11 +250,30 @@ func (bf *blobFile) loadDiscards() error {
 	return nil
 }
 
-func (bf *blobFile) read(bp blobPointer, s *y.Slice) (buf []byte, err error) {
-	physicalOff := int64(bf.getPhysicalOffset(bp.logicalAddr))
-	buf = s.Resize(int(bp.length))
-	_, err = bf.fd.ReadAt(buf, physicalOff) // skip the 4 bytes length.
-	return buf, err
+// read reads the value of bp, the checksum of the value is verified if verify is true and the file
+// is checksummed.
+func (bf *blobFile) read(bp blobPointer, s *y.Slice, verify bool) (buf []byte, err error) {
+	physicalOff := bf.getPhysicalOffset(bp.logicalAddr)
+	length := bf.storedLength(bp)
+	buf = s.Resize(int(length + bf.checksumSize()))
+	_, err = bf.fd.ReadAt(buf, int64(physicalOff)) // skip the 4 bytes length.
+	if err != nil {
+		return buf, err
+	}
+	if verify && bf.checksum {
+		if err = bf.verifyChecksum(buf, physicalOff); err != nil {
+			return nil, err
+		}
+	}
+	buf = buf[:length]
+	if bf.dataKey == nil {
+		return buf, nil
+	}
+	// Decrypt the value to the start of the slice like the unencrypted value.
+	var iv [y.IVSize]byte
+	copy(iv[:], buf)
+	val := buf[:copy(buf, buf[y.IVSize:])]
+	return val, y.XORBlock(val, val, bf.dataKey.Key, iv[:])
 }
 
 func (bf *blobFile) getPhysicalOffset(addr logicalAddr) uint32 {
@@ -135,31 +296,53 @@ func (bf *blobFile) Delete() error {
 }
 
 type blobFileBuilder struct {
-	fid    uint32
-	file   *os.File
-	writer *fileutil.DirectWriter
+	fid        uint32
+	file       *os.File
+	writer     *fileutil.DirectWriter
+	dataKey    *options.DataKey
+	encryptBuf []byte
 }
 
-func newBlobFileBuilder(fid uint32, dir string, writeBufferSize int) (*blobFileBuilder, error) {
+// newBlobFileBuilder creates a blob file builder, the values are encrypted if dataKey is not nil.
+func newBlobFileBuilder(fid uint32, dir string, writeBufferSize int, dataKey *options.DataKey) (*blobFileBuilder, error) {
 	fileName := newBlobFileName(fid, dir)
 	file, err := directio.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
 		return nil, err
 	}
 	writer := fileutil.NewDirectWriter(file, writeBufferSize, nil)
-	// Write 4 bytes 0 header.
-	err = writer.Append(make([]byte, 4))
+	// The files written by flush have no address mapping.
+	mappingSize := uint32(0)
+	if dataKey != nil {
+		mappingSize = blobEncryptedHeaderSize
+	}
+	err = writer.Append(blobHeader(mappingSize, dataKey))
 	if err != nil {
 		return nil, err
 	}
 	return &blobFileBuilder{
-		fid:    uint32(fid),
-		file:   file,
-		writer: writer,
+		fid:     uint32(fid),
+		file:    file,
+		writer:  writer,
+		dataKey: dataKey,
 	}, nil
 }
 
 func (bfb *blobFileBuilder) append(value []byte) (bp []byte, err error) {
+	valueLen := uint32(len(value))
+	if bfb.dataKey != nil {
+		var iv []byte
+		if iv, err = y.GenerateIV(); err != nil {
+			return
+		}
+		bfb.encryptBuf = append(bfb.encryptBuf[:0], iv...)
+		bfb.encryptBuf = append(bfb.encryptBuf, value...)
+		encrypted := bfb.encryptBuf[y.IVSize:]
+		if err = y.XORBlock(encrypted, encrypted, bfb.dataKey.Key, iv); err != nil {
+			return
+		}
+		value = bfb.encryptBuf
+	}
 	var lenBuf [4]byte
 	binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(value)))
 	err = bfb.writer.Append(lenBuf[:])
@@ -171,10 +354,16 @@ func (bfb *blobFileBuilder) append(value []byte) (bp []byte, err error) {
 	if err != nil {
 		return
 	}
+	var crcBuf [blobChecksumSize]byte
+	binary.LittleEndian.PutUint32(crcBuf[:], crc32.Checksum(value, y.CastagnoliCrcTable))
+	err = bfb.writer.Append(crcBuf[:])
+	if err != nil {
+		return
+	}
 	bp = make([]byte, 12)
 	binary.LittleEndian.PutUint32(bp, bfb.fid)
 	binary.LittleEndian.PutUint32(bp[4:], offset)
-	binary.LittleEndian.PutUint32(bp[8:], uint32(len(value)))
+	binary.LittleEndian.PutUint32(bp[8:], valueLen)
 	return
 }
 
@@ -189,7 +378,17 @@ func (bfb *blobFileBuilder) finish() (*blobFile, error) {
 		return nil, err
 	}
 	_ = bfb.file.Close()
-	return newBlobFile(bfb.file.Name(), bfb.fid, uint32(bfb.writer.Offset()))
+	bf, err := newBlobFile(bfb.file.Name(), bfb.fid, uint32(bfb.writer.Offset()))
+	if err != nil {
+		return nil, err
+	}
+	bf.mappingSize = 4
+	bf.checksum = true
+	if bfb.dataKey != nil {
+		bf.mappingSize = blobEncryptedHeaderSize
+		bf.dataKey = bfb.dataKey
+	}
+	return bf, nil
 }
 
 func newBlobFile(path string, fid, fileSize uint32) (*blobFile, error) {
@@ -220,7 +419,8 @@ type blobManager struct {
 	changeLog         *os.File
 	dirPath           string
 	kv                *DB
-	discardCh         chan<- *DiscardStats
+	discardCh         chan *DiscardStats
+	gcCh              chan *blobGCTask
 	maxFileID         uint32
 }
 
@@ -258,7 +458,7 @@ func (bm *blobManager) Open(kv *DB, opt Options) error {
 		if err != nil {
 			return err
 		}
-		err = blobFile.loadOffsetMap()
+		err = blobFile.loadOffsetMap(kv.keyRegistry)
 		if err != nil {
 			return err
 		}
@@ -273,11 +473,18 @@ func (bm *blobManager) Open(kv *DB, opt Options) error {
 			return errors.Errorf("File %d not found", to)
 		}
 	}
-	discardCh := make(chan *DiscardStats, 1024)
-	bm.discardCh = discardCh
+	bm.discardCh = make(chan *DiscardStats, 1024)
+	bm.gcCh = make(chan *blobGCTask)
+	bm.startGCHandler()
+	return nil
+}
+
+// startGCHandler starts the GC handler with the current state of blob files.
+func (bm *blobManager) startGCHandler() {
 	gcHandler := &blobGCHandler{
 		bm:                bm,
-		discardCh:         discardCh,
+		discardCh:         bm.discardCh,
+		gcCh:              bm.gcCh,
 		gcCandidate:       map[*blobFile]struct{}{},
 		physicalCache:     make(map[uint32]*blobFile, len(bm.physicalFiles)),
 		logicalToPhysical: map[uint32]uint32{},
@@ -288,9 +495,26 @@ func (bm *blobManager) Open(kv *DB, opt Options) error {
 	for k, v := range bm.physicalFiles {
 		gcHandler.physicalCache[k] = v
 	}
-	kv.closers.blobManager = y.NewCloser(1)
-	go gcHandler.run(kv.closers.blobManager)
-	return nil
+	bm.kv.closers.blobManager = y.NewCloser(1)
+	go gcHandler.run(bm.kv.closers.blobManager)
+}
+
+// dropAll deletes all the blob files, it must be called when the GC handler is stopped.
+func (bm *blobManager) dropAll(guard *epoch.Guard) error {
+	bm.filesLock.RLock()
+	files := make([]*blobFile, 0, len(bm.physicalFiles))
+	for _, file := range bm.physicalFiles {
+		files = append(files, file)
+	}
+	logicalFiles := make(map[uint32]struct{}, len(bm.logicalToPhysical))
+	for fid := range bm.logicalToPhysical {
+		logicalFiles[fid] = struct{}{}
+	}
+	bm.filesLock.RUnlock()
+	if len(files) == 0 {
+		return nil
+	}
+	return bm.addGCFile(files, nil, logicalFiles, guard)
 }
 
 func (bm *blobManager) allocFileID() uint32 {
@@ -304,7 +528,8 @@ func (bm *blobManager) read(ptr []byte, s *y.Slice, cache map[uint32]*blobCache)
 	if !ok {
 		bf := bm.getFile(bp.fid)
 		bc = &blobCache{
-			file: bf,
+			file:   bf,
+			verify: bm.kv.opt.VerifyValueChecksum && bf.checksum,
 		}
 		cache[bf.fid] = bc
 	}
@@ -322,17 +547,22 @@ func (bm *blobManager) getFile(fid uint32) *blobFile {
 		}
 	}
 	if file == nil {
-		log.Error("failed to get file", zap.Uint32("id", fid))
+		bm.kv.opt.Logger.Error("failed to get file", zap.Uint32("id", fid))
 	}
 	bm.filesLock.RUnlock()
 	return file
 }
 
 func (bm *blobManager) addFile(file *blobFile) error {
+	// The directory entry of the file must be durable before it is recorded in the change log.
+	err := syncDir(bm.dirPath)
+	if err != nil {
+		return err
+	}
 	buf := make([]byte, 8)
 	binary.LittleEndian.PutUint32(buf, file.fid)
 	binary.LittleEndian.PutUint32(buf[4:], file.fid)
-	_, err := bm.changeLog.Write(buf)
+	_, err = bm.changeLog.Write(buf)
 	if err != nil {
 		return err
 	}
@@ -346,12 +576,28 @@ func (bm *blobManager) addFile(file *blobFile) error {
 	return nil
 }
 
+// size returns the size of the live blob files, the files replaced by GC are excluded.
+func (bm *blobManager) size() int64 {
+	bm.filesLock.RLock()
+	defer bm.filesLock.RUnlock()
+	var size int64
+	for _, bf := range bm.physicalFiles {
+		size += int64(bf.fileSize)
+	}
+	return size
+}
+
 func (bm *blobManager) addGCFile(oldFiles []*blobFile, newFile *blobFile, logicalFiles map[uint32]struct{}, guard *epoch.Guard) error {
 	oldFids := make([]uint32, len(oldFiles))
 	for i, v := range oldFiles {
 		oldFids[i] = v.fid
 	}
-	log.Info("addGCFile", zap.Uint32s("old files", oldFids), zap.Uint32("new file id", newFile.getID()), zap.String("logical files", fmt.Sprintf("%v", logicalFiles)))
+	bm.kv.opt.Logger.Info("addGCFile", zap.Uint32s("old files", oldFids), zap.Uint32("new file id", newFile.getID()), zap.String("logical files", fmt.Sprintf("%v", logicalFiles)))
+	if newFile != nil {
+		if err := syncDir(bm.dirPath); err != nil {
+			return err
+		}
+	}
 	buf := make([]byte, len(oldFiles)*8)
 	for i, oldFile := range oldFiles {
 		offset := i * 8
@@ -395,7 +641,7 @@ type fidNode struct {
 }
 
 func (bm *blobManager) loadChangeLogs() (validFids map[uint32]struct{}, err error) {
-	changeLogFileName := filepath.Join(bm.dirPath, "blob_change.log")
+	changeLogFileName := filepath.Join(bm.dirPath, blobChangeLogFilename)
 	data, err := ioutil.ReadFile(changeLogFileName)
 	if err != nil && !os.IsNotExist(err) {
 		return nil, err
@@ -451,9 +697,55 @@ func getToFid(logicalMap map[uint32]uint32, toFid uint32) uint32 {
 	}
 }
 
+// BlobGCStats is the result of a blob GC. The rewritten values keep their logical addresses in the
+// address mapping of the new file, so the GC doesn't write any keys to the LSM tree.
+type BlobGCStats struct {
+	// FilesInspected is the number of the blob files whose discards are checked.
+	FilesInspected int
+	// FilesRewritten is the number of the blob files replaced by the rewritten files.
+	FilesRewritten int
+	// EntriesRewritten is the number of the live values copied to the rewritten files.
+	EntriesRewritten int
+	// BytesReclaimed is the size of the replaced files minus the size of the rewritten files.
+	BytesReclaimed int64
+}
+
+type blobGCTask struct {
+	ctx          context.Context
+	discardRatio float64
+	done         chan struct{}
+	stats        BlobGCStats
+	err          error
+}
+
+// RunBlobGC rewrites the blob files with at least discardRatio of the data discarded, in addition
+// to the automatic GC. It returns ErrNoRewrite if no file is rewritten. The GC stops between the
+// files once ctx is done, the stats cover the files rewritten before that.
+func (db *DB) RunBlobGC(ctx context.Context, discardRatio float64) (BlobGCStats, error) {
+	if discardRatio <= 0 || discardRatio >= 1 {
+		return BlobGCStats{}, ErrInvalidRequest
+	}
+	if db.opt.ReadOnly {
+		return BlobGCStats{}, ErrRejected
+	}
+	task := &blobGCTask{ctx: ctx, discardRatio: discardRatio, done: make(chan struct{})}
+	// Close signals the writes closer before it stops the GC handler, the blob manager closer is
+	// not selected as it is replaced by DropAll.
+	select {
+	case db.blobManger.gcCh <- task:
+	case <-ctx.Done():
+		return BlobGCStats{}, ctx.Err()
+	case <-db.closers.writes.HasBeenClosed():
+		return BlobGCStats{}, ErrDBClosed
+	}
+	<-task.done
+	return task.stats, task.err
+}
+
 type blobGCHandler struct {
 	bm                *blobManager
 	discardCh         <-chan *DiscardStats
+	gcCh              <-chan *blobGCTask
 	physicalCache     map[uint32]*blobFile
 	logicalToPhysical map[uint32]uint32
 
@@ -464,14 +756,21 @@ type blobGCHandler struct {
 
 func (h *blobGCHandler) run(c *y.Closer) {
 	defer c.Done()
+	// The persisted discards may already exceed the target space amplification.
+	if err := h.doGCIfNeeded(); err != nil {
+		h.bm.kv.opt.Logger.Error("blob gc on start", zap.Error(err))
+	}
 	for {
 		select {
 		case discardInfo := <-h.discardCh:
 			h.handleDiscardInfo(discardInfo)
 			err := h.doGCIfNeeded()
 			if err != nil {
-				log.Error("handle discardInfo", zap.Error(err))
+				h.bm.kv.opt.Logger.Error("handle discardInfo", zap.Error(err))
 			}
+		case task := <-h.gcCh:
+			task.stats, task.err = h.runGC(task.ctx, task.discardRatio)
+			close(task.done)
 		case <-c.HasBeenClosed():
 			return
 		}
@@ -479,6 +778,8 @@ func (h *blobGCHandler) run(c *y.Closer) {
 }
 
 func (h *blobGCHandler) handleDiscardInfo(discardStats *DiscardStats) {
+	guard := h.bm.kv.resourceMgr.Acquire()
+	defer guard.Done()
 	physicalDiscards := make(map[uint32][]blobPointer)
 	for _, ptr := range discardStats.ptrs {
 		physicalFid := h.getLogicalToPhysical(ptr.fid)
@@ -486,9 +787,9 @@ func (h *blobGCHandler) handleDiscardInfo(discardStats *DiscardStats) {
 		physicalDiscards[physicalFid] = append(ptrs, ptr)
 	}
 	for physicalFid, ptrs := range physicalDiscards {
-		err := h.writeDiscardToFile(physicalFid, ptrs)
+		err := h.writeDiscardToFile(physicalFid, ptrs, guard)
 		if err != nil {
-			log.Error("handleDiscardInfo", zap.Uint32("physicalFid", physicalFid), zap.Error(err))
+			h.bm.kv.opt.Logger.Error("handleDiscardInfo", zap.Uint32("physicalFid", physicalFid), zap.Error(err))
 			continue
 		}
 	}
@@ -513,8 +814,12 @@ func (h *blobGCHandler) getLogicalToPhysical(logicalFid uint32) uint32 {
 	return physicalFid
 }
 
-func (h *blobGCHandler) writeDiscardToFile(physicalFid uint32, ptrs []blobPointer) error {
+func (h *blobGCHandler) writeDiscardToFile(physicalFid uint32, ptrs []blobPointer, guard *epoch.Guard) error {
 	file := h.getPhysicalFile(physicalFid)
+	if file == nil {
+		// The file has been dropped by DropAll.
+		return nil
+	}
 	discardInfo := make([]byte, uint32(len(ptrs)*8+8))
 	totalDiscard := file.totalDiscard + uint32(len(discardInfo))
 	for i, ptr := range ptrs {
@@ -530,10 +835,16 @@ func (h *blobGCHandler) writeDiscardToFile(physicalFid uint32, ptrs []blobPointe
 	}
 	file.totalDiscard = totalDiscard
 	file.fileSize += uint32(len(discardInfo))
-	if file.totalDiscard > file.fileSize/2 {
+	if h.bm.kv.opt.BlobGCPunchHoles {
+		if holes := file.discardedHoles(ptrs); holes != nil {
+			file.punchedSize += holes.size
+			guard.Delete([]epoch.Resource{holes})
+		}
+	}
+	if file.reclaimableDiscard() > (file.fileSize-file.punchedSize)/2 {
 		h.gcCandidate[file] = struct{}{}
 		h.candidateValidSize += file.fileSize - file.mappingSize - file.totalDiscard
-		h.candidateDiscardSize += uint64(file.totalDiscard)
+		h.candidateDiscardSize += uint64(file.reclaimableDiscard())
 	}
 	return nil
 }
@@ -548,6 +859,82 @@ func (h *blobGCHandler) doGCIfNeeded() error {
 	guard := h.bm.kv.resourceMgr.Acquire()
 	defer guard.Done()
 
+	oldFiles := h.pickFilesBySpaceAmp()
+	if len(oldFiles) == 0 {
+		oldFiles = h.pickCandidates()
+	}
+	if len(oldFiles) == 0 {
+		return nil
+	}
+	_, err := h.rewriteFiles(context.Background(), oldFiles, guard)
+	return err
+}
+
+// runGC rewrites the files with at least discardRatio of the data discarded until there is no
+// such file or ctx is done.
+func (h *blobGCHandler) runGC(ctx context.Context, discardRatio float64) (BlobGCStats, error) {
+	guard := h.bm.kv.resourceMgr.Acquire()
+	defer guard.Done()
+
+	var stats BlobGCStats
+	inspected := map[uint32]struct{}{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		oldFiles := h.pickFilesByDiscardRatio(discardRatio, inspected)
+		stats.FilesInspected = len(inspected)
+		if len(oldFiles) == 0 {
+			break
+		}
+		batchStats, err := h.rewriteFiles(ctx, oldFiles, guard)
+		stats.FilesRewritten += batchStats.FilesRewritten
+		stats.EntriesRewritten += batchStats.EntriesRewritten
+		stats.BytesReclaimed += batchStats.BytesReclaimed
+		if err != nil {
+			return stats, err
+		}
+	}
+	if stats.FilesRewritten == 0 {
+		return stats, ErrNoRewrite
+	}
+	return stats, nil
+}
+
+// pickFilesByDiscardRatio returns the files with at least discardRatio of the data discarded, the
+// inspected files are added to inspected.
+func (h *blobGCHandler) pickFilesByDiscardRatio(discardRatio float64, inspected map[uint32]struct{}) []*blobFile {
+	h.bm.filesLock.RLock()
+	var files []*blobFile
+	for fid, file := range h.bm.physicalFiles {
+		inspected[fid] = struct{}{}
+		discard := file.reclaimableDiscard()
+		if discard > 0 && float64(discard) >= discardRatio*float64(file.fileSize-file.punchedSize) {
+			files = append(files, file)
+		}
+	}
+	h.bm.filesLock.RUnlock()
+	sortByDiscardRatio(files)
+	var oldFiles []*blobFile
+	var totalValidSize uint32
+	for _, file := range files {
+		if len(oldFiles) > 0 && file.dataKey != oldFiles[0].dataKey {
+			continue
+		}
+		validSize := file.fileSize - file.mappingSize - file.totalDiscard
+		if len(oldFiles) > 0 && totalValidSize+validSize > maxCandidateValidSize {
+			break
+		}
+		totalValidSize += validSize
+		oldFiles = append(oldFiles, file)
+		delete(h.gcCandidate, file)
+	}
+	return oldFiles
+}
+
+// pickCandidates returns the files with more than half of the data discarded once the candidates
+// are large enough to be rewritten.
+func (h *blobGCHandler) pickCandidates() []*blobFile {
 	if len(h.gcCandidate) == 0 {
 		return nil
 	}
@@ -556,7 +943,14 @@ func (h *blobGCHandler) doGCIfNeeded() error {
 	}
 	var oldFiles []*blobFile
 	var totalValidSize uint32
+	var dataKey *options.DataKey
 	for candidate := range h.gcCandidate {
+		if len(oldFiles) > 0 && candidate.dataKey != dataKey {
+			// The encrypted values are copied as is, so only the files with the same data key
+			// can be merged.
+			continue
+		}
+		dataKey = candidate.dataKey
 		validSize := candidate.fileSize - candidate.mappingSize - candidate.totalDiscard
 		if totalValidSize+validSize > maxCandidateValidSize {
 			break
@@ -565,80 +959,165 @@ func (h *blobGCHandler) doGCIfNeeded() error {
 		oldFiles = append(oldFiles, candidate)
 		delete(h.gcCandidate, candidate)
 	}
+	return oldFiles
+}
+
+// pickFilesBySpaceAmp returns the files to rewrite if the space amplification of the blob files,
+// the ratio of their size to the size of the live values, exceeds Options.BlobGCSpaceAmp. The
+// files with the highest ratio of discarded data are picked until the space amplification is
+// expected to drop to the target.
+func (h *blobGCHandler) pickFilesBySpaceAmp() []*blobFile {
+	target := h.bm.kv.opt.BlobGCSpaceAmp
+	if target <= 1 {
+		return nil
+	}
+	h.bm.filesLock.RLock()
+	files := make([]*blobFile, 0, len(h.bm.physicalFiles))
+	for _, file := range h.bm.physicalFiles {
+		files = append(files, file)
+	}
+	h.bm.filesLock.RUnlock()
+	var totalSize, discardSize uint64
+	for _, file := range files {
+		totalSize += uint64(file.fileSize - file.punchedSize)
+		discardSize += uint64(file.reclaimableDiscard())
+	}
+	if !exceedsSpaceAmp(totalSize, discardSize, target) {
+		return nil
+	}
+	sortByDiscardRatio(files)
+	var oldFiles []*blobFile
+	var totalValidSize uint32
+	for _, file := range files {
+		if file.reclaimableDiscard() == 0 {
+			break
+		}
+		if len(oldFiles) > 0 && file.dataKey != oldFiles[0].dataKey {
+			continue
+		}
+		validSize := file.fileSize - file.mappingSize - file.totalDiscard
+		if len(oldFiles) > 0 && totalValidSize+validSize > maxCandidateValidSize {
+			break
+		}
+		totalValidSize += validSize
+		oldFiles = append(oldFiles, file)
+		delete(h.gcCandidate, file)
+		totalSize -= uint64(file.reclaimableDiscard())
+		discardSize -= uint64(file.reclaimableDiscard())
+		if !exceedsSpaceAmp(totalSize, discardSize, target) {
+			break
+		}
+	}
+	return oldFiles
+}
+
+func exceedsSpaceAmp(totalSize, discardSize uint64, target float64) bool {
+	return totalSize > 0 && float64(totalSize) > target*float64(totalSize-discardSize)
+}
+
+// sortByDiscardRatio sorts the files by the ratio of the reclaimable discarded data in descending
+// order.
+func sortByDiscardRatio(files []*blobFile) {
+	sort.Slice(files, func(i, j int) bool {
+		return uint64(files[i].reclaimableDiscard())*uint64(files[j].fileSize-files[j].punchedSize) >
+			uint64(files[j].reclaimableDiscard())*uint64(files[i].fileSize-files[i].punchedSize)
+	})
+}
+
+// rewriteFiles writes the valid entries of the old files into a new file and replaces them. The
+// files are not changed if ctx is done before the new file is written.
+func (h *blobGCHandler) rewriteFiles(ctx context.Context, oldFiles []*blobFile, guard *epoch.Guard) (BlobGCStats, error) {
+	dataKey := oldFiles[0].dataKey
 	var validEntries []validEntry
 	for _, blobFile := range oldFiles {
+		if err := ctx.Err(); err != nil {
+			return BlobGCStats{}, err
+		}
 		blobBytes, err := ioutil.ReadFile(blobFile.path)
 		if err != nil {
-			return err
+			return BlobGCStats{}, err
+		}
+		validEntries, err = h.extractValidEntries(validEntries, blobFile, blobBytes)
+		if err != nil {
+			return BlobGCStats{}, err
 		}
-		validEntries = h.extractValidEntries(validEntries, blobFile, blobBytes)
 	}
 	if len(validEntries) == 0 {
 		for _, oldFile := range oldFiles {
 			delete(h.physicalCache, oldFile.fid)
 		}
-		return h.bm.addGCFile(oldFiles, nil, nil, guard)
+		if err := h.bm.addGCFile(oldFiles, nil, nil, guard); err != nil {
+			return BlobGCStats{}, err
+		}
+		return h.updateGCMetrics(oldFiles, nil, 0), nil
 	}
 	sort.Slice(validEntries, func(i, j int) bool {
 		return validEntries[i].logicalAddr.Less(validEntries[j].logicalAddr)
 	})
 	newFid := h.bm.allocFileID()
-	fileName := newBlobFileName(newFid, h.bm.kv.opt.Dir)
+	fileName := newBlobFileName(newFid, h.bm.dirPath)
 	file, err := directio.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
-		return err
+		return BlobGCStats{}, err
 	}
 	writer := fileutil.NewDirectWriter(file, 1024*1024, nil)
 	// 4 bytes addrMapping length
 	mappingSize := 4 + uint32(len(validEntries))*12
-	lenBuf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(lenBuf, mappingSize)
-	err = writer.Append(lenBuf)
+	if dataKey != nil {
+		mappingSize += blobEncryptedHeaderSize - 4
+	}
+	err = writer.Append(blobHeader(mappingSize, dataKey))
 	if err != nil {
-		return err
+		return BlobGCStats{}, err
 	}
 	mappingEntryBuf := make([]byte, 12)
-	newOffset := 4 + uint32(len(validEntries))*12 + 4
+	newOffset := mappingSize + 4
 	logicalFids := make(map[uint32]struct{})
 	for _, entry := range validEntries {
 		logicalFids[entry.fid] = struct{}{}
 		binary.LittleEndian.PutUint32(mappingEntryBuf, entry.fid)
 		binary.LittleEndian.PutUint32(mappingEntryBuf[4:], entry.offset)
 		binary.LittleEndian.PutUint32(mappingEntryBuf[8:], newOffset)
-		newOffset += uint32(len(entry.value)) + 4
+		newOffset += uint32(len(entry.value)) + 4 + blobChecksumSize
 		err = writer.Append(mappingEntryBuf)
 		if err != nil {
-			return err
+			return BlobGCStats{}, err
 		}
 	}
+	lenBuf := make([]byte, 4)
 	for _, entry := range validEntries {
 		binary.LittleEndian.PutUint32(lenBuf, uint32(len(entry.value)))
 		err = writer.Append(lenBuf)
 		if err != nil {
-			return err
+			return BlobGCStats{}, err
 		}
 		err = writer.Append(entry.value)
 		if err != nil {
-			return err
+			return BlobGCStats{}, err
+		}
+		binary.LittleEndian.PutUint32(lenBuf, crc32.Checksum(entry.value, y.CastagnoliCrcTable))
+		err = writer.Append(lenBuf)
+		if err != nil {
+			return BlobGCStats{}, err
 		}
 	}
 	// 4 bytes 0 discard length
 	err = writer.Append(make([]byte, 4))
 	if err != nil {
-		return err
+		return BlobGCStats{}, err
 	}
 	err = writer.Finish()
 	if err != nil {
-		return err
+		return BlobGCStats{}, err
 	}
 	file.Close()
 	blobFile, err := newBlobFile(file.Name(), newFid, uint32(writer.Offset()))
 	if err != nil {
-		return err
+		return BlobGCStats{}, err
 	}
-	err = blobFile.loadOffsetMap()
+	err = blobFile.loadOffsetMap(h.bm.kv.keyRegistry)
 	if err != nil {
-		return err
+		return BlobGCStats{}, err
 	}
 	h.physicalCache[newFid] = blobFile
 	for _, oldFile := range oldFiles {
@@ -647,7 +1126,33 @@ func (h *blobGCHandler) doGCIfNeeded() error {
 	for logicalFid := range logicalFids {
 		h.logicalToPhysical[logicalFid] = newFid
 	}
-	return h.bm.addGCFile(oldFiles, blobFile, logicalFids, guard)
+	if err = h.bm.addGCFile(oldFiles, blobFile, logicalFids, guard); err != nil {
+		return BlobGCStats{}, err
+	}
+	return h.updateGCMetrics(oldFiles, blobFile, len(validEntries)), nil
+}
+
+// updateGCMetrics records the old files rewritten into the new file and returns the stats of the
+// rewrite, newFile is nil if all the values in the old files are discarded.
+func (h *blobGCHandler) updateGCMetrics(oldFiles []*blobFile, newFile *blobFile, entries int) BlobGCStats {
+	var reclaimed int64
+	for _, oldFile := range oldFiles {
+		reclaimed += int64(oldFile.fileSize - oldFile.punchedSize)
+	}
+	if newFile != nil {
+		reclaimed -= int64(newFile.fileSize)
+	}
+	if reclaimed < 0 {
+		reclaimed = 0
+	}
+	metrics := h.bm.kv.metrics
+	metrics.NumBlobGCFiles.Add(float64(len(oldFiles)))
+	metrics.NumBlobGCBytes.Add(float64(reclaimed))
+	return BlobGCStats{
+		FilesRewritten:   len(oldFiles),
+		EntriesRewritten: entries,
+		BytesReclaimed:   reclaimed,
+	}
 }
 
 type logicalAddr struct {
@@ -667,22 +1172,30 @@ type validEntry struct {
 	value []byte
 }
 
-func (h *blobGCHandler) extractValidEntries(validEntries []validEntry, file *blobFile, blobBytes []byte) []validEntry {
+// extractValidEntries appends the entries of the file which are not discarded to validEntries, the
+// checksums of the entries are verified if Options.VerifyValueChecksum is true.
+func (h *blobGCHandler) extractValidEntries(validEntries []validEntry, file *blobFile, blobBytes []byte) ([]validEntry, error) {
 	physicalToLogical := make(map[uint32]logicalAddr, len(file.mappingEntries))
 	for _, mappingEntry := range file.mappingEntries {
 		physicalToLogical[mappingEntry.physicalOffset] = mappingEntry.logicalAddr
 	}
 	discardedPhysicalOffsets, endOff := h.buildDiscardPhysicalOffsets(file, blobBytes)
+	verify := h.bm.kv.opt.VerifyValueChecksum && file.checksum
 	cursor := file.mappingSize
 	for cursor < endOff {
 		valLen := binary.LittleEndian.Uint32(blobBytes[cursor:])
 		cursor += 4
 		physicalOff := cursor
-		cursor += valLen
+		cursor += valLen + file.checksumSize()
 		_, isDiscarded := discardedPhysicalOffsets[physicalOff]
 		if isDiscarded {
 			continue
 		}
+		if verify {
+			if err := file.verifyChecksum(blobBytes[physicalOff:cursor], physicalOff); err != nil {
+				return nil, err
+			}
+		}
 		var logical logicalAddr
 		if len(file.mappingEntries) == 0 {
 			logical.fid = file.fid
@@ -695,7 +1208,7 @@ func (h *blobGCHandler) extractValidEntries(validEntries []validEntry, file *blo
 			logicalAddr: logical,
 		})
 	}
-	return validEntries
+	return validEntries, nil
 }
 
 func (h *blobGCHandler) buildDiscardPhysicalOffsets(file *blobFile, blobBytes []byte) (discards map[uint32]struct{}, endOff uint32) {
@@ -721,6 +1234,7 @@ func (h *blobGCHandler) buildDiscardPhysicalOffsets(file *blobFile, blobBytes []
 
 type blobCache struct {
 	file         *blobFile
+	verify       bool
 	cacheData    []byte
 	cacheOffset  uint32
 	lastPhysical uint32
@@ -732,12 +1246,14 @@ func (bc *blobCache) read(bp blobPointer, slice *y.Slice) ([]byte, error) {
 	physicalOffset := bc.file.getPhysicalOffset(bp.logicalAddr)
 	lastPhysical := bc.lastPhysical
 	bc.lastPhysical = physicalOffset
-	if lastPhysical == 0 || bp.length > cacheSize {
-		return bc.file.read(bp, slice)
+	length := bc.file.storedLength(bp)
+	entryLen := length + bc.file.checksumSize()
+	if lastPhysical == 0 || entryLen > cacheSize {
+		return bc.file.read(bp, slice, bc.verify)
 	}
-	if physicalOffset >= bc.cacheOffset && physicalOffset+bp.length < bc.cacheOffset+uint32(len(bc.cacheData)) {
+	if physicalOffset >= bc.cacheOffset && physicalOffset+entryLen < bc.cacheOffset+uint32(len(bc.cacheData)) {
 		off := physicalOffset - bc.cacheOffset
-		return bc.cacheData[off : off+bp.length], nil
+		return bc.readCached(bc.cacheData[off:off+entryLen], physicalOffset, length, slice)
 	}
 	if bc.cacheData == nil {
 		bc.cacheData = make([]byte, cacheSize)
@@ -751,5 +1267,15 @@ func (bc *blobCache) read(bp blobPointer, slice *y.Slice) ([]byte, error) {
 		return nil, err
 	}
 	bc.cacheOffset = physicalOffset
-	return bc.cacheData[:bp.length], nil
+	return bc.readCached(bc.cacheData[:entryLen], physicalOffset, length, slice)
+}
+
+// readCached returns the value of the cached entry, the value is stored in the first length bytes.
+func (bc *blobCache) readCached(entry []byte, physicalOffset, length uint32, slice *y.Slice) ([]byte, error) {
+	if bc.verify {
+		if err := bc.file.verifyChecksum(entry, physicalOffset); err != nil {
+			return nil, err
+		}
+	}
+	return bc.file.decryptValue(entry[:length], slice)
 }
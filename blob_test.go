@@ -1,12 +1,17 @@
 package badger
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/pingcap/badger/y"
 	"github.com/stretchr/testify/require"
 )
 
@@ -108,3 +113,325 @@ func validateValue(t *testing.T, db *DB, expectedMap map[string]string) {
 	})
 	require.Nil(t, err)
 }
+
+func TestBlobGCSpaceAmp(t *testing.T) {
+	newFile := func(fid, size, discard uint32) *blobFile {
+		return &blobFile{fid: fid, fileSize: size, mappingSize: 16, totalDiscard: discard}
+	}
+	files := map[uint32]*blobFile{
+		1: newFile(1, 1000, 100),
+		2: newFile(2, 1000, 900),
+		3: newFile(3, 1000, 600),
+		4: newFile(4, 1000, 0),
+	}
+	opts := DefaultOptions
+	h := &blobGCHandler{
+		bm:          &blobManager{physicalFiles: files, kv: &DB{opt: opts}},
+		gcCandidate: map[*blobFile]struct{}{files[2]: {}},
+	}
+	getFids := func(files []*blobFile) []uint32 {
+		fids := make([]uint32, 0, len(files))
+		for _, file := range files {
+			fids = append(fids, file.fid)
+		}
+		return fids
+	}
+
+	// The space amplification is 4000 / 2400, below the target.
+	h.bm.kv.opt.BlobGCSpaceAmp = 2
+	require.Empty(t, h.pickFilesBySpaceAmp())
+
+	// Rewriting file 2 brings the space amplification to 3100 / 2400.
+	h.bm.kv.opt.BlobGCSpaceAmp = 1.5
+	require.Equal(t, []uint32{2}, getFids(h.pickFilesBySpaceAmp()))
+	require.Empty(t, h.gcCandidate)
+
+	// Files 2 and 3 have to be rewritten to reach 2500 / 2400.
+	h.bm.kv.opt.BlobGCSpaceAmp = 1.1
+	require.Equal(t, []uint32{2, 3}, getFids(h.pickFilesBySpaceAmp()))
+
+	// Files without discards are never rewritten.
+	h.bm.kv.opt.BlobGCSpaceAmp = 1.01
+	require.Equal(t, []uint32{2, 3, 1}, getFids(h.pickFilesBySpaceAmp()))
+
+	h.bm.kv.opt.BlobGCSpaceAmp = 0
+	require.Empty(t, h.pickFilesBySpaceAmp())
+}
+
+func TestRunBlobGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 20
+	opts.BlobGCSpaceAmp = 0
+	opts.ManagedTxns = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	_, err = db.RunBlobGC(context.Background(), 0)
+	require.Equal(t, ErrInvalidRequest, err)
+	_, err = db.RunBlobGC(context.Background(), 0.5)
+	require.Equal(t, ErrNoRewrite, err)
+
+	expectedMap := make(map[string]string)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			val := make([]byte, 128)
+			_, _ = rand.Read(val)
+			expectedMap[string(key)] = fmt.Sprintf("%x", val)
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.SetEntry(&Entry{Key: y.KeyWithTs(key, uint64(round+1)), Value: val})
+			}))
+		}
+		db.flushMemTable().Wait()
+	}
+	// The compaction discards the values of the first round.
+	db.UpdateSafeTs(2)
+	require.NoError(t, db.CompactRange([]byte("key"), []byte("key999"), CompactRangeOptions{BottomLevel: true}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.RunBlobGC(ctx, 0.5)
+	require.Equal(t, context.Canceled, err)
+
+	var stats BlobGCStats
+	for i := 0; i < 100; i++ {
+		// The discards are handled asynchronously.
+		stats, err = db.RunBlobGC(context.Background(), 0.5)
+		if err != ErrNoRewrite {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	// The rewritten file is inspected after the two flushed files.
+	require.Equal(t, 3, stats.FilesInspected)
+	require.Equal(t, 1, stats.FilesRewritten)
+	require.True(t, stats.EntriesRewritten < 100)
+	require.True(t, stats.BytesReclaimed > 0)
+	validateValue(t, db, expectedMap)
+
+	// The requests issued after Close are not blocked.
+	require.NoError(t, db.Close())
+	_, err = db.RunBlobGC(context.Background(), 0.5)
+	require.Equal(t, ErrDBClosed, err)
+}
+
+func TestBlobValueDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	valueDir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(valueDir)
+	opts := getTestOptions(dir)
+	opts.ValueDir = valueDir
+	opts.ValueThreshold = 20
+	opts.BlobGCSpaceAmp = 0
+	opts.ManagedTxns = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	expectedMap := make(map[string]string)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			val := make([]byte, 128)
+			_, _ = rand.Read(val)
+			expectedMap[string(key)] = fmt.Sprintf("%x", val)
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.SetEntry(&Entry{Key: y.KeyWithTs(key, uint64(round+1)), Value: val})
+			}))
+		}
+		db.flushMemTable().Wait()
+	}
+	db.UpdateSafeTs(2)
+	require.NoError(t, db.CompactRange([]byte("key"), []byte("key999"), CompactRangeOptions{BottomLevel: true}))
+	for i := 0; i < 100; i++ {
+		if _, err = db.RunBlobGC(context.Background(), 0.5); err != ErrNoRewrite {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	countBlobFiles := func(dir string) int {
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+blobFileSuffix))
+		require.NoError(t, err)
+		return len(matches)
+	}
+	require.Zero(t, countBlobFiles(dir))
+	require.NotZero(t, countBlobFiles(valueDir))
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	validateValue(t, db, expectedMap)
+}
+
+func TestBlobChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 20
+	opts.VerifyValueChecksum = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	val := bytes.Repeat([]byte("a"), 128)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("key"), val)
+	}))
+	db.flushMemTable().Wait()
+	getValue := func() ([]byte, error) {
+		var v []byte
+		err := db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key"))
+			if err != nil {
+				return err
+			}
+			v, err = item.Value()
+			return err
+		})
+		return v, err
+	}
+	v, err := getValue()
+	require.NoError(t, err)
+	require.Equal(t, val, v)
+	require.NoError(t, db.Close())
+
+	// Corrupt the value in the blob file.
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+blobFileSuffix))
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	data, err := ioutil.ReadFile(matches[0])
+	require.NoError(t, err)
+	off := bytes.Index(data, val)
+	require.True(t, off > 0)
+	data[off+10] = 'b'
+	require.NoError(t, ioutil.WriteFile(matches[0], data, 0666))
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	_, err = getValue()
+	require.Equal(t, &ValueCorruptionError{Path: matches[0], Offset: uint32(off)}, err)
+	require.NoError(t, db.Close())
+
+	opts.VerifyValueChecksum = false
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	v, err = getValue()
+	require.NoError(t, err)
+	require.Equal(t, data[off:off+len(val)], v)
+}
+
+func TestBlobPunchHoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 20
+	opts.BlobGCSpaceAmp = 0
+	opts.BlobGCPunchHoles = true
+	opts.ManagedTxns = true
+	opts.MaxMemTableSize = 1 << 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	expectedMap := make(map[string]string)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			val := make([]byte, 16<<10)
+			_, _ = rand.Read(val)
+			expectedMap[string(key)] = fmt.Sprintf("%x", val)
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.SetEntry(&Entry{Key: y.KeyWithTs(key, uint64(round+1)), Value: val})
+			}))
+		}
+		db.flushMemTable().Wait()
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+blobFileSuffix))
+	require.NoError(t, err)
+	require.Len(t, matches, 2)
+	// The values of the first round are discarded by the compaction.
+	db.UpdateSafeTs(2)
+	require.NoError(t, db.CompactRange([]byte("key"), []byte("key999"), CompactRangeOptions{BottomLevel: true}))
+
+	countHoles := func() int {
+		data, err := ioutil.ReadFile(matches[0])
+		require.NoError(t, err)
+		zeros := make([]byte, blobHoleAlignment)
+		var holes int
+		for off := 0; off+blobHoleAlignment <= len(data); off += blobHoleAlignment {
+			if bytes.Equal(data[off:off+blobHoleAlignment], zeros) {
+				holes++
+			}
+		}
+		return holes
+	}
+	var holes int
+	for i := 0; i < 100 && holes == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		holes = countHoles()
+	}
+	// Every value covers at least 3 aligned blocks.
+	require.True(t, holes >= 30)
+	validateValue(t, db, expectedMap)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	validateValue(t, db, expectedMap)
+}
+
+func TestValuePlacement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	small, large := []byte("small"), bytes.Repeat([]byte("l"), 100)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		if err := txn.SetEntry((&Entry{Key: y.KeyWithTs([]byte("small-blob"), 0), Value: small}).WithValueInBlob()); err != nil {
+			return err
+		}
+		if err := txn.SetEntry((&Entry{Key: y.KeyWithTs([]byte("large-inline"), 0), Value: large}).WithValueInline()); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("small"), small); err != nil {
+			return err
+		}
+		return txn.Set([]byte("large"), large)
+	}))
+	db.flushMemTable().Wait()
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for _, c := range []struct {
+			key    string
+			val    []byte
+			inBlob bool
+		}{
+			{"small-blob", small, true},
+			{"large-inline", large, false},
+			{"small", small, false},
+			{"large", large, true},
+		} {
+			item, err := txn.Get([]byte(c.key))
+			require.NoError(t, err)
+			require.Equal(t, c.inBlob, item.meta&bitValuePointer != 0, c.key)
+			require.Zero(t, item.meta&bitValuePlacement, c.key)
+			require.Equal(t, c.val, getItemValue(t, item), c.key)
+		}
+		return nil
+	}))
+}
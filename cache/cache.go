@@ -202,6 +202,7 @@ func (c *Cache) GetOrCompute(key uint64, f func() (interface{}, int64, error)) (
 	for {
 		i := c.store.GetOrNew(key)
 		if v := i.value.Load(); v != nil {
+			c.Metrics.add(hit, key, 1)
 			return v, nil
 		}
 		if v, err, ok := c.compute(i, f); ok {
@@ -219,9 +220,11 @@ func (c *Cache) compute(i *item, f func() (interface{}, int64, error)) (interfac
 
 	// Double check.
 	if v := i.value.Load(); v != nil {
+		c.Metrics.add(hit, i.key, 1)
 		return v, nil, true
 	}
 
+	c.Metrics.add(miss, i.key, 1)
 	v, cost, err := f()
 	if err != nil {
 		return nil, err, true
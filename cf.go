@@ -0,0 +1,123 @@
+package badger
+
+import (
+	"github.com/pingcap/badger/y"
+)
+
+// CF identifies a column family, an independent keyspace hosted by the DB. All the column families
+// share the value log, the write path and the caches of the DB, the keys of a column family are
+// stored in the LSM tree under a reserved prefix, so each column family occupies a contiguous key
+// range and the keys of different column families never conflict.
+//
+// The DefaultCF is the keyspace accessed by the methods without the CF suffix, like Txn.Set.
+// The keys of the other column families are invisible to the iterators of the DefaultCF.
+type CF byte
+
+// DefaultCF is the column family accessed by Txn.Set, Txn.Get and Txn.NewIterator.
+const DefaultCF CF = 0
+
+// cfKeyPrefix is prepended to the keys of the non-default column families, followed by the CF id.
+var cfKeyPrefix = []byte("!badger!cf")
+
+// prefixLen returns the length of the prefix prepended to the keys of the column family.
+func (cf CF) prefixLen() int {
+	if cf == DefaultCF {
+		return 0
+	}
+	return len(cfKeyPrefix) + 1
+}
+
+// encodeKey returns the key stored in the LSM tree for the key of the column family.
+func (cf CF) encodeKey(key []byte) []byte {
+	if cf == DefaultCF {
+		return key
+	}
+	buf := make([]byte, 0, cf.prefixLen()+len(key))
+	buf = append(buf, cfKeyPrefix...)
+	buf = append(buf, byte(cf))
+	return append(buf, key...)
+}
+
+// enableCF records the column families feature before the keys of cf are written by the txn.
+func (txn *Txn) enableCF(cf CF) error {
+	if cf == DefaultCF || !txn.update {
+		return nil
+	}
+	return txn.db.enableFeature(featureColumnFamilies)
+}
+
+// SetCF adds a key-value pair to the column family cf. It follows the same logic as Set.
+func (txn *Txn) SetCF(cf CF, key, val []byte) error {
+	if txn.db.IsManaged() {
+		return ErrManagedTxn
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if err := txn.enableCF(cf); err != nil {
+		return err
+	}
+	e := &Entry{
+		Key:   y.KeyWithTs(cf.encodeKey(key), 0),
+		Value: val,
+	}
+	return txn.SetEntry(e)
+}
+
+// SetEntryCF adds the entry to the column family cf. It follows the same logic as SetEntry, the
+// key of e is replaced by the key stored in the LSM tree.
+func (txn *Txn) SetEntryCF(cf CF, e *Entry) error {
+	if e.Key.IsEmpty() {
+		return ErrEmptyKey
+	}
+	if err := txn.enableCF(cf); err != nil {
+		return err
+	}
+	e.Key.UserKey = cf.encodeKey(e.Key.UserKey)
+	return txn.SetEntry(e)
+}
+
+// DeleteCF deletes a key from the column family cf. It follows the same logic as Delete.
+func (txn *Txn) DeleteCF(cf CF, key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if err := txn.enableCF(cf); err != nil {
+		return err
+	}
+	return txn.Delete(cf.encodeKey(key))
+}
+
+// GetCF looks for key in the column family cf. It follows the same logic as Get.
+func (txn *Txn) GetCF(cf CF, key []byte) (*Item, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	item, err := txn.Get(cf.encodeKey(key))
+	if err != nil {
+		return nil, err
+	}
+	item.cfPrefixLen = cf.prefixLen()
+	return item, nil
+}
+
+// NewIteratorCF returns an iterator over the column family cf. The keys passed to the iterator and
+// the keys of the items are the keys of the column family, the StartKey, EndKey and Prefix in opt
+// are relative to the column family as well.
+func (txn *Txn) NewIteratorCF(cf CF, opt IteratorOptions) *Iterator {
+	if cf == DefaultCF {
+		return txn.NewIterator(opt)
+	}
+	if !opt.StartKey.IsEmpty() {
+		opt.StartKey.UserKey = cf.encodeKey(opt.StartKey.UserKey)
+	}
+	if !opt.EndKey.IsEmpty() {
+		opt.EndKey.UserKey = cf.encodeKey(opt.EndKey.UserKey)
+	}
+	opt.Prefix = cf.encodeKey(opt.Prefix)
+	opt.internalAccess = true
+	it := txn.NewIterator(opt)
+	it.cfPrefix = opt.Prefix[:cf.prefixLen()]
+	it.itBuf.cfPrefixLen = len(it.cfPrefix)
+	return it
+}
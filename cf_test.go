@@ -0,0 +1,88 @@
+package badger
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestColumnFamily(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		const (
+			lockCF  CF = 1
+			writeCF CF = 2
+		)
+		cfs := []CF{DefaultCF, lockCF, writeCF}
+		key := func(i int) []byte {
+			return []byte(fmt.Sprintf("key%03d", i))
+		}
+		val := func(cf CF, i int) []byte {
+			return []byte(fmt.Sprintf("cf%d-val%03d", cf, i))
+		}
+		n := 100
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				for _, cf := range cfs {
+					require.NoError(t, txn.SetCF(cf, key(i), val(cf, i)))
+				}
+			}
+			// The pending writes are visible to the reads of the same column family.
+			item, err := txn.GetCF(lockCF, key(1))
+			require.NoError(t, err)
+			require.Equal(t, key(1), item.Key())
+			require.Equal(t, val(lockCF, 1), getItemValue(t, item))
+			return nil
+		}))
+		// An older badger must not open the DB as it would read the keys of the column families.
+		format, err := checkFormat(db.opt.Dir, Options{ReadOnly: true})
+		require.NoError(t, err)
+		require.Contains(t, format.Features, featureColumnFamilies)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.DeleteCF(lockCF, key(0))
+		}))
+		db.flushMemTable().Wait()
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for _, cf := range cfs {
+				for i := 0; i < n; i++ {
+					item, err := txn.GetCF(cf, key(i))
+					if cf == lockCF && i == 0 {
+						require.Equal(t, ErrKeyNotFound, err)
+						continue
+					}
+					require.NoError(t, err)
+					require.Equal(t, key(i), item.Key())
+					require.Equal(t, val(cf, i), getItemValue(t, item))
+				}
+
+				start := 0
+				if cf == lockCF {
+					start = 1
+				}
+				it := txn.NewIteratorCF(cf, DefaultIteratorOptions)
+				i := start
+				for it.Rewind(); it.Valid(); it.Next() {
+					require.Equal(t, key(i), it.Item().Key())
+					require.Equal(t, val(cf, i), getItemValue(t, it.Item()))
+					i++
+				}
+				require.Equal(t, n, i)
+				it.Seek(key(50))
+				require.True(t, it.Valid())
+				require.Equal(t, key(50), it.Item().Key())
+				it.Close()
+
+				it = txn.NewIteratorCF(cf, IteratorOptions{Reverse: true, Prefix: []byte("key01")})
+				i = 19
+				for it.Rewind(); it.Valid(); it.Next() {
+					require.Equal(t, key(i), it.Item().Key())
+					i--
+				}
+				require.Equal(t, 9, i)
+				it.Close()
+			}
+			return nil
+		}))
+	})
+}
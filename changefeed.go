@@ -0,0 +1,115 @@
+package badger
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const defaultResolvedTsInterval = time.Second
+
+// ChangeEvent is delivered by DB.Changefeed.
+type ChangeEvent struct {
+	// KVs are the committed entries not delivered before whose commit ts is not greater than
+	// ResolvedTs, sorted by commit ts.
+	KVs []*KV
+	// ResolvedTs is the watermark of the commits, no entry committed at or before it is delivered
+	// after the event.
+	ResolvedTs uint64
+}
+
+// ChangefeedOptions are the options of DB.Changefeed.
+type ChangefeedOptions struct {
+	// Prefixes are the prefixes of the keys delivered, an empty prefix matches all the keys.
+	Prefixes [][]byte
+	// ResolvedTsInterval is the interval of the events delivered to advance the resolved ts when no
+	// entry is committed, it is one second if it is zero.
+	ResolvedTsInterval time.Duration
+}
+
+// Changefeed invokes cb with the committed entries whose keys match any of the prefixes in commit
+// ts order, along with the resolved ts watermark, after the entries are written. The entries
+// committed after the resolved ts are buffered until the resolved ts passes their commit ts, so an
+// entry committed at or before the resolved ts of an event is never delivered after the event.
+//
+// The resolved ts is the read ts of the DB if the DB is not managed, as the transactions are
+// written in commit ts order. The commit ts of a managed DB is chosen by the caller, so the resolved
+// ts is advanced by ManagedDB.AdvanceResolvedTs. The entries loaded by DB.Load have a zero commit ts
+// and are delivered in the next event.
+//
+// Changefeed blocks until ctx is done or the DB is closed, the entries committed before Changefeed
+// is called are not delivered. If cb returns an error, Changefeed stops and returns the error. If
+// the entries not taken by Changefeed exceed 64MB, ErrSubscriberTooSlow is returned.
+func (db *DB) Changefeed(ctx context.Context, opts ChangefeedOptions, cb func(ev *ChangeEvent) error) error {
+	if len(opts.Prefixes) == 0 {
+		return ErrInvalidRequest
+	}
+	interval := opts.ResolvedTsInterval
+	if interval == 0 {
+		interval = defaultResolvedTsInterval
+	}
+	id, s := db.publisher.subscribe(opts.Prefixes)
+	defer db.publisher.unsubscribe(id)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var (
+		buffered       []*KV
+		lastResolvedTs uint64
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-db.publisher.closed:
+			return nil
+		case <-s.notify:
+		case <-ticker.C:
+		}
+		// The resolved ts is loaded before the pending entries are taken, the entries committed at
+		// or before it have been published by then.
+		resolvedTs := db.resolvedTs()
+		kvs, err := s.take()
+		if err != nil {
+			return err
+		}
+		buffered = append(buffered, kvs...)
+		sort.SliceStable(buffered, func(i, j int) bool {
+			return buffered[i].CommitTs < buffered[j].CommitTs
+		})
+		n := sort.Search(len(buffered), func(i int) bool {
+			return buffered[i].CommitTs > resolvedTs
+		})
+		if n == 0 && resolvedTs <= lastResolvedTs {
+			continue
+		}
+		ev := &ChangeEvent{KVs: buffered[:n:n], ResolvedTs: resolvedTs}
+		buffered = buffered[n:]
+		if resolvedTs > lastResolvedTs {
+			lastResolvedTs = resolvedTs
+		}
+		if err := cb(ev); err != nil {
+			return err
+		}
+	}
+}
+
+func (db *DB) resolvedTs() uint64 {
+	if db.IsManaged() {
+		return atomic.LoadUint64(&db.publisher.resolvedTs)
+	}
+	return db.orc.readTs()
+}
+
+// AdvanceResolvedTs advances the resolved ts of the changefeeds to ts. The caller must make sure
+// every transaction committed at or before ts has returned from CommitAt, and no transaction will
+// be committed at or before ts after the call. A ts not greater than the current resolved ts is
+// ignored.
+func (db *ManagedDB) AdvanceResolvedTs(ts uint64) {
+	for {
+		old := atomic.LoadUint64(&db.publisher.resolvedTs)
+		if ts <= old || atomic.CompareAndSwapUint64(&db.publisher.resolvedTs, old, ts) {
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package badger
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pingcap/badger/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangefeedManaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := OpenManaged(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+
+	events := make(chan *ChangeEvent, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		opts := ChangefeedOptions{Prefixes: [][]byte{[]byte("k")}, ResolvedTsInterval: 10 * time.Millisecond}
+		done <- db.Changefeed(ctx, opts, func(ev *ChangeEvent) error {
+			events <- ev
+			return nil
+		})
+	}()
+	for db.publisher.subscriberCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	commit := func(key string, commitTs uint64) {
+		txn := db.NewTransactionAt(commitTs-1, true)
+		require.NoError(t, txn.SetEntry(&Entry{Key: y.KeyWithTs([]byte(key), commitTs), Value: []byte("v")}))
+		require.NoError(t, txn.CommitAt(commitTs))
+	}
+	// The commits are out of the commit ts order.
+	commit("k3", 30)
+	commit("k1", 10)
+	commit("x", 15)
+	commit("k2", 20)
+
+	// next returns the next event delivering entries or advancing the resolved ts to ts.
+	next := func(ts uint64) *ChangeEvent {
+		for {
+			select {
+			case ev := <-events:
+				if len(ev.KVs) > 0 || ev.ResolvedTs >= ts {
+					return ev
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event delivered")
+			}
+		}
+	}
+	db.AdvanceResolvedTs(25)
+	ev := next(25)
+	require.Equal(t, uint64(25), ev.ResolvedTs)
+	require.Len(t, ev.KVs, 2)
+	require.Equal(t, "k1", string(ev.KVs[0].Key))
+	require.Equal(t, uint64(10), ev.KVs[0].CommitTs)
+	require.Equal(t, "k2", string(ev.KVs[1].Key))
+
+	db.AdvanceResolvedTs(20)
+	db.AdvanceResolvedTs(30)
+	ev = next(30)
+	require.Equal(t, uint64(30), ev.ResolvedTs)
+	require.Len(t, ev.KVs, 1)
+	require.Equal(t, "k3", string(ev.KVs[0].Key))
+	cancel()
+	require.Equal(t, context.Canceled, <-done)
+}
+
+func TestChangefeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	events := make(chan *ChangeEvent, 100)
+	done := make(chan error)
+	go func() {
+		opts := ChangefeedOptions{Prefixes: [][]byte{nil}}
+		done <- db.Changefeed(context.Background(), opts, func(ev *ChangeEvent) error {
+			events <- ev
+			return nil
+		})
+	}()
+	for db.publisher.subscriberCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte{byte(i)}, []byte("v"))
+		}))
+	}
+	var (
+		kvs        []*KV
+		resolvedTs uint64
+	)
+	for len(kvs) < 100 {
+		select {
+		case ev := <-events:
+			require.True(t, ev.ResolvedTs >= resolvedTs)
+			for _, kv := range ev.KVs {
+				require.True(t, kv.CommitTs > resolvedTs && kv.CommitTs <= ev.ResolvedTs)
+			}
+			resolvedTs = ev.ResolvedTs
+			kvs = append(kvs, ev.KVs...)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event delivered")
+		}
+	}
+	for i, kv := range kvs {
+		require.Equal(t, []byte{byte(i)}, kv.Key)
+		require.Equal(t, kv.Version, kv.CommitTs)
+	}
+	require.NoError(t, db.Close())
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,238 @@
+package badger
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pingcap/badger/epoch"
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+)
+
+type checkpointTask struct {
+	sync.WaitGroup
+	dir string
+	// flush asks the writer to flush the mutable memtable, flushWG is set to wait for the flush.
+	flush   bool
+	flushWG *sync.WaitGroup
+
+	guard    *epoch.Guard
+	manifest Manifest
+	// curVlog is the value log file being written, only the first curVlogLen bytes are
+	// included in the checkpoint.
+	curVlog    *os.File
+	curVlogFid uint32
+	curVlogLen uint32
+	err        error
+}
+
+// Checkpoint creates an openable snapshot of the DB in dir, which must not exist.
+// The memtable is flushed first, then SST files and value log files are hard linked into dir and a
+// manifest snapshot is written, so dir must be on the same file system as the DB. The value log
+// file being written is copied up to the checkpoint. The blob files are copied, because the
+// discards are appended to them and the discards of the DB don't apply to the checkpoint.
+// Writes are not blocked while the checkpoint is being created, the writes after the snapshot is
+// taken are not included.
+func (db *DB) Checkpoint(dir string) error {
+	if db.volatileMode || db.opt.ColdStorage != nil {
+		return ErrInvalidRequest
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return errors.Errorf("checkpoint dir %s already exists", dir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Flush the memtable so the checkpoint doesn't need to replay a lot of value log on open.
+	task := &checkpointTask{flush: true}
+	task.Add(1)
+	db.checkpointCh <- task
+	task.Wait()
+	if task.err != nil {
+		return task.err
+	}
+	if task.flushWG != nil {
+		task.flushWG.Wait()
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	task = &checkpointTask{dir: dir}
+	task.Add(1)
+	db.checkpointCh <- task
+	task.Wait()
+	err := task.err
+	if err == nil {
+		err = db.finishCheckpoint(task)
+	}
+	if task.curVlog != nil {
+		task.curVlog.Close()
+	}
+	if task.guard != nil {
+		task.guard.Done()
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+// prepareCheckpoint runs in the vlog writer, so the vlog files are not written or deleted while
+// the DB state is captured.
+func (w *writeWorker) prepareCheckpoint(task *checkpointTask) {
+	defer task.Done()
+	if task.flush {
+		w.orc.writeLock.Lock()
+		reqs := w.pollWriteCh(make([]*request, len(w.writeCh)))
+		w.orc.writeLock.Unlock()
+		if task.err = w.writeVLog(reqs); task.err != nil {
+			return
+		}
+		if !w.mtbls.Load().(*memTables).getMutable().Empty() {
+			task.flushWG = w.flushMemTable()
+		}
+		return
+	}
+
+	// The guard is acquired before the manifest is captured, so the tables and blob files
+	// in the snapshot will not be deleted until the checkpoint is done.
+	task.guard = w.resourceMgr.Acquire()
+	mf := w.manifest
+	mf.appendLock.Lock()
+	task.manifest = mf.manifest.clone()
+	task.manifest.Head = mf.manifest.Head
+	mf.appendLock.Unlock()
+
+	var headFid uint32
+	if task.manifest.Head != nil {
+		headFid = task.manifest.Head.LogID
+	}
+	maxPtr := w.vlog.getMaxPtr()
+	curFid := uint32(maxPtr >> 32)
+	for _, lf := range w.vlog.files {
+		if lf.fid < headFid {
+			continue
+		}
+		if lf.fid == curFid {
+			if task.curVlog, task.err = os.Open(lf.path); task.err != nil {
+				return
+			}
+			task.curVlogFid = curFid
+			task.curVlogLen = uint32(maxPtr)
+			continue
+		}
+		if task.err = os.Link(lf.path, vlogFilePath(task.dir, lf.fid)); task.err != nil {
+			return
+		}
+	}
+}
+
+func (db *DB) finishCheckpoint(task *checkpointTask) error {
+	dir := task.dir
+	if task.curVlog != nil {
+		if err := copyFilePrefix(task.curVlog, vlogFilePath(dir, task.curVlogFid), int64(task.curVlogLen)); err != nil {
+			return err
+		}
+	}
+	for id := range task.manifest.Tables {
+		filename := sstable.NewFilename(id, db.opt.Dir)
+		if err := os.Link(filename, sstable.NewFilename(id, dir)); err != nil {
+			return err
+		}
+		if err := os.Link(sstable.IndexFilename(filename), sstable.IndexFilename(sstable.NewFilename(id, dir))); err != nil {
+			return err
+		}
+	}
+	if err := db.checkpointBlobFiles(dir); err != nil {
+		return err
+	}
+	fp, _, err := helpRewrite(dir, &task.manifest)
+	if err != nil {
+		return err
+	}
+	if err = fp.Close(); err != nil {
+		return err
+	}
+	for _, name := range []string{FormatFilename, KeyRegistryFilename} {
+		data, err := ioutil.ReadFile(filepath.Join(db.opt.Dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0666); err != nil {
+				return err
+			}
+		}
+	}
+	return syncDir(dir)
+}
+
+// checkpointBlobFiles copies the blob change log and the blob files it refers to.
+// It must be called after the manifest is captured, blob files are added to the change log
+// before the tables that refer to them are added to the manifest.
+func (db *DB) checkpointBlobFiles(dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(db.opt.ValueDir, blobChangeLogFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	// The change log may be appended concurrently, ignore the incomplete record.
+	data = data[:len(data)/8*8]
+	validFids := new(blobManager).buildLogicalToPhysical(data)
+	for fid := range validFids {
+		if err = copyBlobFile(newBlobFileName(fid, db.opt.ValueDir), newBlobFileName(fid, dir)); err != nil {
+			return err
+		}
+	}
+	fp, err := y.OpenTruncFile(filepath.Join(dir, blobChangeLogFilename), false)
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// copyBlobFile copies the blob file up to its current size, the discards appended to it
+// concurrently are not copied.
+func copyBlobFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	return copyFilePrefix(in, dst, fi.Size())
+}
+
+func copyFilePrefix(in *os.File, dst string, n int64) error {
+	out, err := y.OpenTruncFile(dst, false)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, io.NewSectionReader(in, 0, n)); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
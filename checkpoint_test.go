@@ -0,0 +1,95 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	val := func(i int, gen string) []byte { return []byte(fmt.Sprintf("%s-value-%05d-%064d", gen, i, i)) }
+	for i := 0; i < 2000; i++ {
+		txnSet(t, db, key(i), val(i, "old"), 0)
+	}
+
+	cpDir := filepath.Join(dir, "checkpoint")
+	require.NoError(t, db.Checkpoint(cpDir))
+	require.Error(t, db.Checkpoint(cpDir))
+
+	// Writes after the checkpoint should not be visible in the checkpoint.
+	for i := 0; i < 2000; i++ {
+		txnSet(t, db, key(i), val(i, "new"), 0)
+	}
+	txnSet(t, db, key(2000), val(2000, "new"), 0)
+	require.NoError(t, db.Close())
+
+	cp, err := Open(getTestOptions(cpDir))
+	require.NoError(t, err)
+	defer cp.Close()
+	require.NoError(t, cp.View(func(txn *Txn) error {
+		for i := 0; i < 2000; i++ {
+			item, err := txn.Get(key(i))
+			require.NoError(t, err)
+			require.Equal(t, val(i, "old"), getItemValue(t, item))
+		}
+		_, err := txn.Get(key(2000))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+}
+
+func TestCheckpointBlobFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value-%064d", i)), 0)
+	}
+	cpDir := filepath.Join(dir, "checkpoint")
+	require.NoError(t, db.Checkpoint(cpDir))
+
+	// The discards appended to the blob files of the DB must not change the checkpoint.
+	matches, err := filepath.Glob(filepath.Join(cpDir, "*"+blobFileSuffix))
+	require.NoError(t, err)
+	require.NotEmpty(t, matches)
+	for _, cpFile := range matches {
+		cpInfo, err := os.Stat(cpFile)
+		require.NoError(t, err)
+		info, err := os.Stat(filepath.Join(opts.ValueDir, filepath.Base(cpFile)))
+		require.NoError(t, err)
+		require.False(t, os.SameFile(info, cpInfo))
+	}
+}
@@ -0,0 +1,257 @@
+package badger
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"golang.org/x/time/rate"
+)
+
+// Corruption is a corrupted range of a file found by DB.VerifyChecksum.
+type Corruption struct {
+	Path string
+	// Offset is the offset of the corrupted block or entry in the file.
+	Offset int64
+	Err    error
+}
+
+// ChecksumReport is the result of DB.VerifyChecksum.
+type ChecksumReport struct {
+	Tables        int
+	ValueLogFiles int
+	BlobFiles     int
+	BytesVerified int64
+	Corruptions   []Corruption
+}
+
+var errCorruptedEntry = errors.New("corrupted entry")
+
+// VerifyChecksum reads every block of the SST files and every entry of the sealed value log files
+// and the blob files, and reports the ones which don't match their checksums. The reads are
+// throttled by Options.VerifyChecksumRate. The tables built and the blob files written before the
+// checksums were introduced are verified by decoding their blocks and entries. The value log file
+// being written is not verified. An error is returned if ctx is done or a file can't be read, the
+// corruptions found so far are still in the report.
+func (db *DB) VerifyChecksum(ctx context.Context) (*ChecksumReport, error) {
+	var limiter *rate.Limiter
+	if db.opt.VerifyChecksumRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(db.opt.VerifyChecksumRate), db.opt.VerifyChecksumRate)
+	}
+	// The files deleted by compaction and blob GC are kept until the guard is done.
+	guard := db.resourceMgr.Acquire()
+	defer guard.Done()
+
+	report := new(ChecksumReport)
+	if err := db.verifyTables(ctx, limiter, report); err != nil {
+		return report, err
+	}
+	if err := db.verifyValueLog(ctx, limiter, report); err != nil {
+		return report, err
+	}
+	return report, db.verifyBlobFiles(ctx, limiter, report)
+}
+
+func (db *DB) verifyTables(ctx context.Context, limiter *rate.Limiter, report *ChecksumReport) error {
+	var tables []*sstable.Table
+	for _, l := range db.lc.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			if sst, ok := t.(*sstable.Table); ok {
+				tables = append(tables, sst)
+			}
+		}
+		l.RUnlock()
+	}
+	for _, t := range tables {
+		err := t.VerifyChecksum(ctx, limiter)
+		if blkErr, ok := err.(*sstable.CorruptBlockError); ok {
+			report.Corruptions = append(report.Corruptions, Corruption{Path: t.Filename(), Offset: blkErr.Offset, Err: err})
+		} else if err != nil {
+			return err
+		}
+		report.Tables++
+		report.BytesVerified += t.Size()
+	}
+	return nil
+}
+
+func (db *DB) verifyValueLog(ctx context.Context, limiter *rate.Limiter, report *ChecksumReport) error {
+	activeFid := db.vlog.maxFid()
+	files, err := ioutil.ReadDir(db.opt.ValueDir)
+	if err != nil {
+		return err
+	}
+	var fids []uint32
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".vlog") {
+			continue
+		}
+		fid, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".vlog"), 10, 32)
+		if err != nil || uint32(fid) >= activeFid {
+			continue
+		}
+		fids = append(fids, uint32(fid))
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	for _, fid := range fids {
+		lf := &logFile{path: vlogFilePath(db.opt.ValueDir, fid), fid: fid}
+		if err = lf.openReadOnly(); err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				// The file has been removed by DropAll.
+				continue
+			}
+			return err
+		}
+		err = db.verifyLogFile(ctx, limiter, lf, report)
+		lf.fd.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyLogFile verifies a sealed value log file, so the entries must end at the end of the file.
+func (db *DB) verifyLogFile(ctx context.Context, limiter *rate.Limiter, lf *logFile, report *ChecksumReport) error {
+	if err := lf.readHeader(db.keyRegistry); err != nil {
+		return err
+	}
+	if _, err := lf.fd.Seek(int64(lf.headerSize()), io.SeekStart); err != nil {
+		return err
+	}
+	read := &safeRead{
+		k:            make([]byte, 10),
+		v:            make([]byte, 10),
+		lf:           lf,
+		recordOffset: lf.headerSize(),
+	}
+	reader := bufio.NewReader(lf.fd)
+	for read.recordOffset < lf.size {
+		e, err := read.Entry(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errTruncate {
+			report.Corruptions = append(report.Corruptions, Corruption{
+				Path: lf.path, Offset: int64(read.recordOffset), Err: errCorruptedEntry,
+			})
+			break
+		} else if err != nil {
+			return err
+		}
+		size := uint32(e.encodedSize())
+		if err = y.WaitRateLimiter(ctx, limiter, int(size)); err != nil {
+			return err
+		}
+		read.recordOffset += size
+	}
+	report.ValueLogFiles++
+	report.BytesVerified += int64(lf.size)
+	return nil
+}
+
+func (db *DB) verifyBlobFiles(ctx context.Context, limiter *rate.Limiter, report *ChecksumReport) error {
+	bm := &db.blobManger
+	bm.filesLock.RLock()
+	files := make([]*blobFile, 0, len(bm.physicalFiles))
+	for _, file := range bm.physicalFiles {
+		files = append(files, file)
+	}
+	bm.filesLock.RUnlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].fid < files[j].fid })
+	for _, file := range files {
+		fi, err := os.Stat(file.path)
+		if err != nil {
+			return err
+		}
+		if err = y.WaitRateLimiter(ctx, limiter, int(fi.Size())); err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(file.path)
+		if err != nil {
+			return err
+		}
+		report.Corruptions = append(report.Corruptions, file.verifyEntries(data)...)
+		report.BlobFiles++
+		report.BytesVerified += int64(len(data))
+	}
+	return nil
+}
+
+// verifyEntries verifies the checksums of the entries in data which are not discarded, the
+// discarded values may have been punched out. The entries are only checked to be well formed if
+// the file has no checksums.
+func (bf *blobFile) verifyEntries(data []byte) []Corruption {
+	discards, endOff, err := bf.readDiscards(data)
+	if err != nil {
+		return []Corruption{{Path: bf.path, Offset: int64(endOff), Err: err}}
+	}
+	physicalToLogical := make(map[uint32]logicalAddr, len(bf.mappingEntries))
+	for _, entry := range bf.mappingEntries {
+		physicalToLogical[entry.physicalOffset] = entry.logicalAddr
+	}
+	var corruptions []Corruption
+	// The entries are followed by a zero length.
+	entriesEnd := endOff - 4
+	cursor := bf.mappingSize
+	for cursor < entriesEnd {
+		entryOff := cursor
+		if cursor+4 > entriesEnd {
+			return append(corruptions, Corruption{Path: bf.path, Offset: int64(entryOff), Err: errCorruptedEntry})
+		}
+		valLen := binary.LittleEndian.Uint32(data[cursor:])
+		physicalOff := cursor + 4
+		cursor = physicalOff + valLen + bf.checksumSize()
+		if cursor > entriesEnd || cursor < physicalOff {
+			return append(corruptions, Corruption{Path: bf.path, Offset: int64(entryOff), Err: errCorruptedEntry})
+		}
+		if !bf.checksum {
+			continue
+		}
+		logical := logicalAddr{fid: bf.fid, offset: physicalOff}
+		if len(bf.mappingEntries) != 0 {
+			logical = physicalToLogical[physicalOff]
+		}
+		if _, ok := discards[logical]; ok {
+			continue
+		}
+		if err := bf.verifyChecksum(data[physicalOff:cursor], physicalOff); err != nil {
+			corruptions = append(corruptions, Corruption{Path: bf.path, Offset: int64(physicalOff), Err: err})
+		}
+	}
+	return corruptions
+}
+
+// readDiscards reads the discard records at the end of data, endOff is the end of the entries.
+func (bf *blobFile) readDiscards(data []byte) (discards map[logicalAddr]struct{}, endOff uint32, err error) {
+	discards = make(map[logicalAddr]struct{})
+	endOff = uint32(len(data))
+	for {
+		if endOff < bf.mappingSize+4 {
+			return nil, endOff, errors.New("corrupted discard records")
+		}
+		discardLength := binary.LittleEndian.Uint32(data[endOff-4:])
+		if discardLength == 0 {
+			return discards, endOff, nil
+		}
+		if discardLength < 8 || discardLength%8 != 0 || discardLength > endOff-bf.mappingSize {
+			return nil, endOff, errors.New("corrupted discard records")
+		}
+		discardAddrs := data[endOff-discardLength : endOff-8]
+		endOff -= discardLength
+		for i := 0; i < len(discardAddrs); i += 8 {
+			addr := logicalAddr{
+				fid:    binary.LittleEndian.Uint32(discardAddrs[i:]),
+				offset: binary.LittleEndian.Uint32(discardAddrs[i+4:]),
+			}
+			discards[addr] = struct{}{}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package badger
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 20
+	opts.ValueLogMaxEntries = 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("%0128d", i)))
+		}))
+	}
+	db.flushMemTable().Wait()
+
+	report, err := db.VerifyChecksum(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, report.Corruptions)
+	require.Equal(t, 1, report.Tables)
+	require.Equal(t, 1, report.BlobFiles)
+	require.True(t, report.ValueLogFiles > 0)
+	require.True(t, report.BytesVerified > 0)
+
+	corrupt := func(path string, off int64) {
+		f, err := os.OpenFile(path, os.O_RDWR, 0666)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{0xff, 0xff}, off)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	tables := db.Tables()
+	require.Len(t, tables, 1)
+	tablePath := sstable.NewFilename(tables[0].ID, dir)
+	corrupt(tablePath, 10)
+
+	blobPaths, err := filepath.Glob(filepath.Join(dir, "*"+blobFileSuffix))
+	require.NoError(t, err)
+	require.Len(t, blobPaths, 1)
+	data, err := ioutil.ReadFile(blobPaths[0])
+	require.NoError(t, err)
+	valOff := bytes.Index(data, []byte(fmt.Sprintf("%0128d", 50)))
+	require.True(t, valOff > 0)
+	corrupt(blobPaths[0], int64(valOff)+10)
+
+	vlogPath := vlogFilePath(dir, 0)
+	corrupt(vlogPath, 100)
+
+	report, err = db.VerifyChecksum(context.Background())
+	require.NoError(t, err)
+	require.Len(t, report.Corruptions, 3)
+	require.Equal(t, tablePath, report.Corruptions[0].Path)
+	require.Equal(t, int64(0), report.Corruptions[0].Offset)
+	require.IsType(t, &sstable.CorruptBlockError{}, report.Corruptions[0].Err)
+	require.Equal(t, vlogPath, report.Corruptions[1].Path)
+	require.True(t, report.Corruptions[1].Offset <= 100)
+	require.Equal(t, Corruption{
+		Path:   blobPaths[0],
+		Offset: int64(valOff),
+		Err:    &ValueCorruptionError{Path: blobPaths[0], Offset: uint32(valOff)},
+	}, report.Corruptions[2])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.VerifyChecksum(ctx)
+	require.Equal(t, context.Canceled, err)
+}
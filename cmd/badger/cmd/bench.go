@@ -0,0 +1,238 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/badger"
+	"github.com/spf13/cobra"
+)
+
+var (
+	benchKeys        int
+	benchValueSize   int
+	benchConcurrency int
+	benchDuration    time.Duration
+	benchBatchSize   int
+	benchScanLength  int
+	benchSyncWrites  bool
+)
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Benchmark the DB with the Txn and Iterator APIs.",
+	Long: `Benchmark the DB with the Txn and Iterator APIs and report the throughput and the latency
+percentiles. Run "bench load" first to write the keys read by "bench readrandom" and "bench scan".`,
+}
+
+var benchLoadCmd = &cobra.Command{
+	Use:   "load",
+	Short: "Write the keys in random order, --batch keys per transaction.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runBench(false, benchLoad)
+	},
+}
+
+var benchReadRandomCmd = &cobra.Command{
+	Use:   "readrandom",
+	Short: "Get random keys, one key per transaction.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runBench(true, benchReadRandom)
+	},
+}
+
+var benchScanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "Seek to random keys and iterate --scan-length keys.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runBench(true, benchScan)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(benchCmd)
+	benchCmd.AddCommand(benchLoadCmd, benchReadRandomCmd, benchScanCmd)
+	flags := benchCmd.PersistentFlags()
+	flags.IntVar(&benchKeys, "keys", 1000000, "The number of keys.")
+	flags.IntVar(&benchValueSize, "value-size", 128, "The size of the values written by load.")
+	flags.IntVar(&benchConcurrency, "concurrency", 16, "The number of concurrent workers.")
+	flags.DurationVar(&benchDuration, "duration", time.Minute,
+		"The duration of the benchmark, load stops early when all the keys are written.")
+	flags.IntVar(&benchBatchSize, "batch", 100, "The number of keys written by a transaction of load.")
+	flags.IntVar(&benchScanLength, "scan-length", 100, "The number of keys iterated by a scan.")
+	flags.BoolVar(&benchSyncWrites, "sync", false, "Sync the value log on every write of load.")
+}
+
+// errBenchDone is returned by a benchOp when there is no more work to do.
+var errBenchDone = errors.New("bench done")
+
+// benchOp runs an operation of the worker and returns the number of keys and bytes it accessed.
+type benchOp func(db *badger.DB, w *benchWorker) (keys, bytes int, err error)
+
+type benchWorker struct {
+	rnd *rand.Rand
+	// next is the index of the next key of load, shared by the workers.
+	next      *int64
+	perm      []int
+	value     []byte
+	latencies []time.Duration
+}
+
+func runBench(readOnly bool, op benchOp) error {
+	opts := badger.DefaultOptions
+	opts.Dir = sstDir
+	opts.ValueDir = vlogDir
+	opts.ReadOnly = readOnly
+	opts.SyncWrites = benchSyncWrites
+	db, err := badger.Open(opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var next int64
+	perm := rand.Perm(benchKeys)
+	value := make([]byte, benchValueSize)
+	rand.Read(value)
+	workers := make([]*benchWorker, benchConcurrency)
+	errs := make([]error, benchConcurrency)
+	var totalKeys, totalBytes int64
+	deadline := time.Now().Add(benchDuration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range workers {
+		w := &benchWorker{
+			rnd:   rand.New(rand.NewSource(time.Now().UnixNano() + int64(i))),
+			next:  &next,
+			perm:  perm,
+			value: value,
+		}
+		workers[i] = w
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				opStart := time.Now()
+				keys, n, err := op(db, w)
+				if err == errBenchDone {
+					return
+				} else if err != nil {
+					errs[i] = err
+					return
+				}
+				w.latencies = append(w.latencies, time.Since(opStart))
+				atomic.AddInt64(&totalKeys, int64(keys))
+				atomic.AddInt64(&totalBytes, int64(n))
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	var latencies []time.Duration
+	for _, w := range workers {
+		latencies = append(latencies, w.latencies...)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	secs := elapsed.Seconds()
+	fmt.Printf("Elapsed: %s, ops: %d, keys: %d, bytes: %s\n", elapsed.Round(time.Millisecond),
+		len(latencies), totalKeys, bytes(totalBytes))
+	fmt.Printf("Throughput: %.0f ops/s, %.0f keys/s, %s/s\n", float64(len(latencies))/secs,
+		float64(totalKeys)/secs, bytes(int64(float64(totalBytes)/secs)))
+	if len(latencies) > 0 {
+		percentile := func(p float64) time.Duration {
+			return latencies[int(p*float64(len(latencies)-1))]
+		}
+		fmt.Printf("Latency: p50 %s, p95 %s, p99 %s, p999 %s, max %s\n", percentile(0.5),
+			percentile(0.95), percentile(0.99), percentile(0.999), latencies[len(latencies)-1])
+	}
+	return nil
+}
+
+func benchKey(i int) []byte {
+	return []byte(fmt.Sprintf("bench%016d", i))
+}
+
+func benchLoad(db *badger.DB, w *benchWorker) (int, int, error) {
+	end := int(atomic.AddInt64(w.next, int64(benchBatchSize)))
+	start := end - benchBatchSize
+	if start >= benchKeys {
+		return 0, 0, errBenchDone
+	}
+	if end > benchKeys {
+		end = benchKeys
+	}
+	var n int
+	err := db.Update(func(txn *badger.Txn) error {
+		for _, i := range w.perm[start:end] {
+			key := benchKey(i)
+			if err := txn.Set(key, w.value); err != nil {
+				return err
+			}
+			n += len(key) + len(w.value)
+		}
+		return nil
+	})
+	return end - start, n, err
+}
+
+func benchReadRandom(db *badger.DB, w *benchWorker) (int, int, error) {
+	var n int
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(benchKey(w.rnd.Intn(benchKeys)))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		val, err := item.Value()
+		n = len(item.Key()) + len(val)
+		return err
+	})
+	return 1, n, err
+}
+
+func benchScan(db *badger.DB, w *benchWorker) (int, int, error) {
+	var keys, n int
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(benchKey(w.rnd.Intn(benchKeys))); it.Valid() && keys < benchScanLength; it.Next() {
+			item := it.Item()
+			val, err := item.Value()
+			if err != nil {
+				return err
+			}
+			keys++
+			n += len(item.Key()) + len(val)
+		}
+		return nil
+	})
+	return keys, n, err
+}
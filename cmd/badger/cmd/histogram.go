@@ -0,0 +1,82 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/pingcap/badger"
+	"github.com/spf13/cobra"
+)
+
+var histogramPrefix string
+
+var histogramCmd = &cobra.Command{
+	Use:   "histogram",
+	Short: "Print the distributions of the key and value sizes.",
+	Long: `Open the DB read-only, scan the keys with the prefix in every level and print the
+distributions of the key and value sizes in power of two buckets. The values in blob files are
+counted by their actual size. Use it to choose ValueThreshold and the block size.`,
+	RunE: doHistogram,
+}
+
+func init() {
+	RootCmd.AddCommand(histogramCmd)
+	histogramCmd.Flags().StringVar(&histogramPrefix, "prefix", "", "Only scan the keys with the prefix.")
+}
+
+func doHistogram(cmd *cobra.Command, args []string) error {
+	opts := badger.DefaultOptions
+	opts.Dir = sstDir
+	opts.ValueDir = vlogDir
+	opts.ReadOnly = true
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	levels, err := db.Histogram([]byte(histogramPrefix))
+	if err != nil {
+		return err
+	}
+	for _, l := range levels {
+		if l.KeySizes.Count == 0 {
+			continue
+		}
+		fmt.Printf("\n[Level %d]\n", l.Level)
+		printHistogram("Key sizes", &l.KeySizes)
+		printHistogram("Value sizes", &l.ValueSizes)
+	}
+	return nil
+}
+
+func printHistogram(name string, h *badger.SizeHistogram) {
+	fmt.Printf("%s: count %d, min %d, max %d, mean %.1f, p50 %d, p99 %d\n", name, h.Count, h.Min,
+		h.Max, h.Mean(), h.Percentile(0.5), h.Percentile(0.99))
+	for i, count := range h.Counts {
+		if count == 0 {
+			continue
+		}
+		low := 0
+		if i > 0 {
+			low = 1 << uint(i-1)
+		}
+		fmt.Printf("  [%8d, %8d) %10d %6.2f%%\n", low, 1<<uint(i), count, float64(count)*100/float64(h.Count))
+	}
+}
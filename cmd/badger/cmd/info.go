@@ -37,8 +37,10 @@ var infoCmd = &cobra.Command{
 	Long: `
 This command prints information about the badger key-value store.  It reads MANIFEST and prints its
 info. It also prints info about missing/extra files, and general information about the value log
-files (which are not referenced by the manifest).  Use this tool to report any issues about Badger
-to the Dgraph team.
+files (which are not referenced by the manifest).  Then it opens the DB read-only and prints the
+layout of the levels, the global ts, the value log head and the tables.  The FORMAT file is printed
+as the fingerprint of the on-disk options.  Use this tool to report any issues about Badger to the
+Dgraph team.
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		err := printInfo(sstDir, vlogDir)
@@ -79,10 +81,20 @@ func tableInfo(dir, valueDir string) error {
 	}
 	defer db.Close()
 
+	fmt.Print("\n[Levels]\n")
+	for _, l := range db.Levels() {
+		fmt.Printf("Level %d: %4d tables, size %8s, target %8s, score %.2f, stale %8s\n", l.Level,
+			l.NumTables, bytes(l.Size), bytes(l.TargetSize), l.Score, bytes(l.StaleSize))
+	}
+	fmt.Printf("Global ts: %d\n", db.MaxCommitTs())
+	vlogOff := db.GetVLogOffset()
+	fmt.Printf("Value log head: %d:%d\n", vlogOff>>32, uint32(vlogOff))
+	fmt.Println()
+
 	tables := db.Tables()
 	for _, t := range tables {
-		fmt.Printf("SSTable [L%d, %03d] [%20X -> %20X]\n",
-			t.Level, t.ID, t.Left, t.Right)
+		fmt.Printf("SSTable [L%d, %03d] [%20X -> %20X] size %s, keys %d, SuRF %v\n",
+			t.Level, t.ID, t.Left, t.Right, bytes(t.Size), t.KeyCount, t.HasSuRF)
 	}
 	return nil
 }
@@ -141,6 +153,24 @@ func printInfo(dir, valueDir string) error {
 		fmt.Printf("%s [MISSING]\n", manifestInfo.Name())
 	}
 
+	if formatInfo, ok := fileinfoByName[badger.FormatFilename]; ok {
+		fileinfoMarked[badger.FormatFilename] = true
+		fmt.Printf("[%25s] %-12s %6s FO\n", dur(baseTime, formatInfo.ModTime()),
+			formatInfo.Name(), bytes(formatInfo.Size()))
+	}
+
+	var format []byte
+	if _, ok := fileinfoByName[badger.FormatFilename]; ok {
+		if format, err = ioutil.ReadFile(filepath.Join(dir, badger.FormatFilename)); err != nil {
+			return err
+		}
+	}
+	if keyRegistryInfo, ok := fileinfoByName[badger.KeyRegistryFilename]; ok {
+		fileinfoMarked[badger.KeyRegistryFilename] = true
+		fmt.Printf("[%25s] %-12s %6s KR\n", dur(baseTime, keyRegistryInfo.ModTime()),
+			keyRegistryInfo.Name(), bytes(keyRegistryInfo.Size()))
+	}
+
 	numMissing := 0
 	numEmpty := 0
 
@@ -160,6 +190,7 @@ func printInfo(dir, valueDir string) error {
 			file, ok := fileinfoByName[tableFile]
 			if ok {
 				fileinfoMarked[tableFile] = true
+				fileinfoMarked[sstable.IndexFilename(tableFile)] = true
 				emptyString := ""
 				fileSize := file.Size()
 				if fileSize == 0 {
@@ -189,8 +220,16 @@ func printInfo(dir, valueDir string) error {
 	valueDirExtras := []os.FileInfo{}
 
 	valueLogSize := int64(0)
+	blobSize := int64(0)
 	// fmt.Print("\n[Value Log]\n")
 	for _, file := range valueDirFileinfos {
+		if strings.HasSuffix(file.Name(), ".blob") || file.Name() == "blob_change.log" {
+			blobSize += file.Size()
+			fmt.Printf("[%25s] %-12s %6s BL\n", dur(baseTime, file.ModTime()), file.Name(),
+				bytes(file.Size()))
+			fileinfoMarked[file.Name()] = true
+			continue
+		}
 		if !strings.HasSuffix(file.Name(), ".vlog") {
 			if valueDir != dir {
 				valueDirExtras = append(valueDirExtras, file)
@@ -243,6 +282,15 @@ func printInfo(dir, valueDir string) error {
 
 	fmt.Printf("Total index size: %8s\n", bytes(totalIndexSize))
 	fmt.Printf("Value log size: %10s\n", bytes(valueLogSize))
+	fmt.Printf("Blob file size: %10s\n", bytes(blobSize))
+	fmt.Printf("Manifest changes: %d creations, %d deletions\n", manifest.Creations, manifest.Deletions)
+	if manifest.Head != nil {
+		fmt.Printf("Manifest head: version %d, value log %d:%d\n", manifest.Head.Version,
+			manifest.Head.LogID, manifest.Head.LogOffset)
+	}
+	if format != nil {
+		fmt.Printf("Format: %s\n", strings.TrimSpace(string(format)))
+	}
 	fmt.Println()
 	totalExtra := numExtra + numValueDirExtra
 	if totalExtra == 0 && numMissing == 0 && numEmpty == 0 && !manifestTruncated {
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/pingcap/badger"
+	"github.com/spf13/cobra"
+)
+
+var repairEncryptionKey string
+
+var repairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Repair the files partially written by a crash.",
+	Long: `Repair the files partially written by a crash, so the DB can be opened.
+
+The MANIFEST is truncated at its last valid record. The tables which can't be
+opened or fail the checksum verification are removed from the MANIFEST, which
+is then rewritten. The last value log file is truncated at its last valid
+entry. The DB must not be open while it is repaired, the lost data is logged.`,
+	RunE: doRepair,
+}
+
+func init() {
+	RootCmd.AddCommand(repairCmd)
+	repairCmd.Flags().StringVar(&repairEncryptionKey, "encryption-key", "",
+		"The hex encoded master key if the DB is encrypted.")
+}
+
+func doRepair(cmd *cobra.Command, args []string) error {
+	opts := badger.DefaultOptions
+	opts.Dir = sstDir
+	opts.ValueDir = vlogDir
+	if repairEncryptionKey != "" {
+		key, err := hex.DecodeString(repairEncryptionKey)
+		if err != nil {
+			return err
+		}
+		opts.EncryptionKey = key
+	}
+	report, err := badger.Repair(opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed tables: %v\n", report.RemovedTables)
+	fmt.Printf("Quarantined tables: %v\n", report.QuarantinedTables)
+	if report.TruncatedValueLog != "" {
+		fmt.Printf("Truncated %d bytes of value log %s\n", report.TruncatedBytes, report.TruncatedValueLog)
+	}
+	return nil
+}
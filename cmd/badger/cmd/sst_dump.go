@@ -0,0 +1,86 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pingcap/badger/options"
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/spf13/cobra"
+)
+
+var sstDumpCmd = &cobra.Command{
+	Use:   "sst-dump [files]",
+	Short: "Dump the layout and statistics of SST files.",
+	Long: `Dump the layout, index, key ranges and versions of SST files.
+
+If no file is given, every SST file in the LSM tree directory is dumped. The
+files are opened read-only without the DB, so a corrupted or unexpectedly large
+SST can be inspected directly.`,
+	RunE: doSSTDump,
+}
+
+func init() {
+	RootCmd.AddCommand(sstDumpCmd)
+}
+
+func doSSTDump(cmd *cobra.Command, args []string) error {
+	files := args
+	if len(files) == 0 {
+		var err error
+		if files, err = filepath.Glob(filepath.Join(sstDir, "*.sst")); err != nil {
+			return err
+		}
+		sort.Strings(files)
+	}
+	for _, file := range files {
+		cfg, err := openSSTConfig(file)
+		if err != nil {
+			return err
+		}
+		if err = sstable.Dump(os.Stdout, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func openSSTConfig(filename string) (*sstable.OpenTableConfig, error) {
+	id, ok := sstable.ParseFileID(filename)
+	if !ok {
+		return nil, fmt.Errorf("Invalid filename: %s", filename)
+	}
+	fd, err := sstable.OpenLocalFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	indexFd, err := sstable.OpenLocalFile(sstable.IndexFilename(filename))
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return &sstable.OpenTableConfig{
+		File:        fd,
+		IndexFile:   indexFd,
+		ID:          id,
+		LoadingMode: options.FileIO,
+	}, nil
+}
@@ -0,0 +1,312 @@
+package badger
+
+import (
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pingcap/badger/cache"
+	"github.com/pingcap/badger/epoch"
+	"github.com/pingcap/badger/options"
+	"github.com/pingcap/badger/table"
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/badger/y"
+	"go.uber.org/zap"
+)
+
+const (
+	// coldChunkSize is the size of the chunks the offloaded tables are read from the cold storage
+	// and cached in, larger than a block to save the requests to the object storage.
+	coldChunkSize = 1 << 20
+	// coldCheckInterval is the interval of checking the bottom level for the tables to offload.
+	coldCheckInterval = time.Minute
+)
+
+// coldFile is the data file of a table offloaded to the cold storage. An empty local data file is
+// left as a stub, so the table files in the directory still match the manifest and the table is
+// opened from the cold storage on open.
+type coldFile struct {
+	storage options.ObjectStorage
+	cache   *cache.Cache
+	id      uint64
+	stub    string
+	object  string
+	size    int64
+}
+
+func (f *coldFile) ReadAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if end > f.size {
+		end = f.size
+	}
+	var n int
+	for pos := off; pos < end; pos = off + int64(n) {
+		chunk, err := f.chunk(pos / coldChunkSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:end-off], chunk[pos%coldChunkSize:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// chunk reads the chunk at idx from the cache or the cold storage.
+func (f *coldFile) chunk(idx int64) ([]byte, error) {
+	read := func() (interface{}, int64, error) {
+		start := idx * coldChunkSize
+		size := f.size - start
+		if size > coldChunkSize {
+			size = coldChunkSize
+		}
+		data := make([]byte, size)
+		if _, err := f.storage.ReadAt(f.object, data, start); err != nil {
+			return nil, 0, y.Wrapf(err, "failed to read %s at offset %d", f.object, start)
+		}
+		return data, size, nil
+	}
+	if f.cache == nil {
+		data, _, err := read()
+		if err != nil {
+			return nil, err
+		}
+		return data.([]byte), nil
+	}
+	data, err := f.cache.GetOrCompute(f.chunkCacheKey(idx), read)
+	if err != nil {
+		return nil, err
+	}
+	return data.([]byte), nil
+}
+
+func (f *coldFile) chunkCacheKey(idx int64) uint64 {
+	y.Assert(f.id < math.MaxUint32)
+	return f.id<<32 | uint64(idx)
+}
+
+func (f *coldFile) Name() string { return f.stub }
+
+func (f *coldFile) Size() (int64, error) { return f.size, nil }
+
+func (f *coldFile) Sync() error { return nil }
+
+func (f *coldFile) Close() error { return nil }
+
+// Delete removes the object and the stub.
+func (f *coldFile) Delete() error {
+	if err := f.storage.Delete(f.object); err != nil {
+		return err
+	}
+	if f.cache != nil {
+		for idx := int64(0); idx*coldChunkSize < f.size; idx++ {
+			f.cache.Del(f.chunkCacheKey(idx))
+		}
+	}
+	return os.Remove(f.stub)
+}
+
+// openColdTable opens the table whose data file is offloaded to the cold storage.
+func (db *DB) openColdTable(filename string) (*sstable.Table, error) {
+	id, ok := sstable.ParseFileID(filename)
+	if !ok {
+		return nil, ErrInvalidRequest
+	}
+	object := sstable.IDToFilename(id)
+	size, err := db.opt.ColdStorage.Size(object)
+	if err != nil {
+		return nil, y.Wrapf(err, "failed to get the size of %s", object)
+	}
+	indexFd, err := sstable.OpenLocalFile(sstable.IndexFilename(filename))
+	if err != nil {
+		return nil, err
+	}
+	tbl, err := sstable.OpenTableWithConfig(sstable.OpenTableConfig{
+		File: &coldFile{
+			storage: db.opt.ColdStorage,
+			cache:   db.coldCache,
+			id:      id,
+			stub:    filename,
+			object:  object,
+			size:    size,
+		},
+		IndexFile:   indexFd,
+		ID:          id,
+		LoadingMode: db.opt.TableLoadingMode,
+		BlockCache:  db.blockCache,
+		IndexCache:  db.indexCache,
+		KeyRegistry: db.keyRegistry,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if db.compressedCache != nil {
+		tbl.SetCompressedBlockCache(db.compressedCache)
+	}
+	tbl.SetVerifyBlockChecksum(db.opt.TableBuilderOptions.VerifyBlockChecksum)
+	return tbl, nil
+}
+
+func (db *DB) runOffloadColdTables(c *y.Closer) {
+	defer c.Done()
+	ticker := time.NewTicker(coldCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := db.offloadColdTables(c); err != nil {
+				db.opt.Logger.Warn("failed to offload cold tables", zap.Error(err))
+			}
+		case <-c.HasBeenClosed():
+			return
+		}
+	}
+}
+
+// OffloadColdTables offloads the data files of the bottom level tables which haven't changed for
+// ColdTableAge and are not smaller than ColdTableMinSize to ColdStorage, and returns the number of
+// tables offloaded. It is run periodically in the background if ColdStorage is set. The tables are
+// uploaded one by one, a table being compacted is skipped. The table being offloaded is still read
+// from the local data file until it is replaced by the table opened from the cold storage, the
+// local data file is replaced with an empty stub after the upload, so a crash leaves the table
+// either on the local disk or in the cold storage.
+func (db *DB) OffloadColdTables() (int, error) {
+	if db.opt.ColdStorage == nil || db.opt.ReadOnly {
+		return 0, ErrInvalidRequest
+	}
+	return db.offloadColdTables(nil)
+}
+
+func (db *DB) offloadColdTables(c *y.Closer) (int, error) {
+	l := db.lc.levels[len(db.lc.levels)-1]
+	l.RLock()
+	tables := append([]table.Table{}, l.tables...)
+	l.RUnlock()
+	var cnt int
+	for _, t := range tables {
+		if c != nil {
+			select {
+			case <-c.HasBeenClosed():
+				return cnt, nil
+			default:
+			}
+		}
+		sst := t.(*sstable.Table)
+		fi, err := os.Stat(sst.Filename())
+		if err != nil {
+			return cnt, err
+		}
+		if fi.Size() == 0 || fi.Size() < db.opt.ColdTableMinSize || time.Since(fi.ModTime()) < db.opt.ColdTableAge {
+			continue
+		}
+		offloaded, err := db.offloadTable(l, sst)
+		if err != nil {
+			return cnt, err
+		}
+		if offloaded {
+			cnt++
+		}
+	}
+	return cnt, nil
+}
+
+// offloadTable uploads the data file of the table to the cold storage and replaces the table in
+// the level with the table opened from the cold storage. It returns false if the table is being
+// compacted or is not in the level.
+func (db *DB) offloadTable(l *levelHandler, t *sstable.Table) (bool, error) {
+	kr := keyRange{left: t.Smallest(), right: t.Biggest()}
+	if !db.lc.cstatus.addToLevel(l.level, kr) {
+		return false, nil
+	}
+	defer db.lc.cstatus.removeFromLevel(l.level, kr)
+	l.Lock()
+	var found bool
+	for _, tbl := range l.tables {
+		if tbl == table.Table(t) {
+			found = true
+			break
+		}
+	}
+	if !found || t.IsCompacting() {
+		l.Unlock()
+		return false, nil
+	}
+	// Marked as compacting, the table is not deleted by DeleteFilesInRange during the upload.
+	t.MarkCompacting(true)
+	l.Unlock()
+	defer t.MarkCompacting(false)
+
+	filename := t.Filename()
+	object := sstable.IDToFilename(t.ID())
+	if err := uploadTable(db.opt.ColdStorage, filename, object); err != nil {
+		return false, err
+	}
+	if err := replaceWithStub(filename); err != nil {
+		db.opt.ColdStorage.Delete(object)
+		return false, err
+	}
+	// The stub is in place, the object is the only copy of the data and must be kept.
+	if err := syncDir(filepath.Dir(filename)); err != nil {
+		return false, err
+	}
+	cold, err := db.openColdTable(filename)
+	if err != nil {
+		// The table is still read from the data file which is opened, it is opened from the cold
+		// storage after the DB is reopened.
+		return false, err
+	}
+	if !l.replaceTable(t, cold) {
+		cold.Close()
+		return false, nil
+	}
+	guard := db.resourceMgr.Acquire()
+	guard.Delete([]epoch.Resource{offloadedTable{t}})
+	guard.Done()
+	db.opt.Logger.Info("offloaded table to the cold storage", zap.Uint64("id", t.ID()),
+		zap.Int64("size", t.Size()))
+	return true, nil
+}
+
+func uploadTable(storage options.ObjectStorage, filename, object string) error {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	if err = storage.Put(object, fd, fi.Size()); err != nil {
+		return y.Wrapf(err, "failed to upload %s", filename)
+	}
+	return nil
+}
+
+// replaceWithStub replaces the data file with an empty file by a rename, as the data file may be
+// linked to an ingested external file. The data file is intact if it returns an error, the caller
+// syncs the directory.
+func replaceWithStub(filename string) error {
+	stubFilename := filename + ".stub"
+	fd, err := y.OpenTruncFile(stubFilename, true)
+	if err != nil {
+		return err
+	}
+	if err = fd.Close(); err != nil {
+		return err
+	}
+	return os.Rename(stubFilename, filename)
+}
+
+// offloadedTable closes the table replaced by the table opened from the cold storage once it is
+// not read.
+type offloadedTable struct {
+	t *sstable.Table
+}
+
+func (o offloadedTable) Delete() error {
+	return o.t.Close()
+}
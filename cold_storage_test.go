@@ -0,0 +1,149 @@
+package badger
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pingcap/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type memObjectStorage struct {
+	sync.Mutex
+	objects map[string][]byte
+}
+
+func (s *memObjectStorage) Put(name string, r io.Reader, size int64) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return errors.Errorf("read %d bytes, expected %d", len(data), size)
+	}
+	s.Lock()
+	s.objects[name] = data
+	s.Unlock()
+	return nil
+}
+
+func (s *memObjectStorage) ReadAt(name string, p []byte, off int64) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return 0, errors.Errorf("object %s not found", name)
+	}
+	if off+int64(len(p)) > int64(len(data)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return copy(p, data[off:]), nil
+}
+
+func (s *memObjectStorage) Size(name string) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return 0, errors.Errorf("object %s not found", name)
+	}
+	return int64(len(data)), nil
+}
+
+func (s *memObjectStorage) Delete(name string) error {
+	s.Lock()
+	delete(s.objects, name)
+	s.Unlock()
+	return nil
+}
+
+func (s *memObjectStorage) numObjects() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.objects)
+}
+
+func TestColdStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	storage := &memObjectStorage{objects: map[string][]byte{}}
+	opts := getTestOptions(dir)
+	opts.ColdStorage = storage
+	opts.ColdTableAge = 0
+	opts.ColdCacheSize = 4 << 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%05d", i))
+	}
+	write := func(val string) {
+		for i := 0; i < 5000; i += 500 {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for j := i; j < i+500; j++ {
+					require.NoError(t, txn.Set(key(j), []byte(fmt.Sprintf("%s%d", val, j))))
+				}
+				return nil
+			}))
+		}
+		db.flushMemTable().Wait()
+		require.NoError(t, db.CompactRange(key(0), key(5000), CompactRangeOptions{BottomLevel: true}))
+	}
+	validate := func(val string) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 5000; i++ {
+				item, err := txn.Get(key(i))
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("%s%d", val, i), string(getItemValue(t, item)))
+			}
+			return nil
+		}))
+	}
+	write("old")
+
+	cnt, err := db.OffloadColdTables()
+	require.NoError(t, err)
+	bottom := db.Levels()[len(db.Levels())-1]
+	require.True(t, cnt > 1)
+	require.Equal(t, bottom.NumTables, cnt)
+	require.Equal(t, cnt, storage.numObjects())
+	for name := range storage.objects {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Zero(t, fi.Size())
+	}
+	validate("old")
+	cnt, err = db.OffloadColdTables()
+	require.NoError(t, err)
+	require.Zero(t, cnt)
+	require.Equal(t, ErrInvalidRequest, db.Checkpoint(filepath.Join(dir, "checkpoint")))
+	require.NoError(t, db.Close())
+
+	noColdOpts := getTestOptions(dir)
+	_, err = Open(noColdOpts)
+	require.Error(t, err)
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	validate("old")
+	// The offloaded tables are deleted from the cold storage after they are compacted, or on open
+	// if the DB is closed before they are deleted.
+	write("new")
+	validate("new")
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.Zero(t, storage.numObjects())
+	require.NoError(t, db.Close())
+
+	db, err = Open(noColdOpts)
+	require.NoError(t, err)
+	validate("new")
+	require.NoError(t, db.Close())
+}
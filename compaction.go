@@ -126,6 +126,22 @@ func (lcs *levelCompactStatus) remove(dst keyRange) bool {
 type compactStatus struct {
 	sync.RWMutex
 	levels []*levelCompactStatus
+	// finished is closed and replaced whenever a compaction finishes.
+	finished chan struct{}
+}
+
+// compactionFinished returns a channel which is closed when the next compaction finishes. It must
+// be called before the state the caller waits on is checked, so a compaction finishing in between
+// is not missed.
+func (cs *compactStatus) compactionFinished() <-chan struct{} {
+	cs.RLock()
+	defer cs.RUnlock()
+	return cs.finished
+}
+
+func (cs *compactStatus) notifyFinished() {
+	close(cs.finished)
+	cs.finished = make(chan struct{})
 }
 
 func (cs *compactStatus) overlapsWith(level int, this keyRange) bool {
@@ -142,6 +158,48 @@ func (cs *compactStatus) deltaSize(l int) int64 {
 	return cs.levels[l].deltaSize
 }
 
+// addToAllLevels adds the range to every level if it doesn't overlap with any running compaction,
+// so no compaction touches the tables in the range until it is removed.
+func (cs *compactStatus) addToAllLevels(kr keyRange) bool {
+	cs.Lock()
+	defer cs.Unlock()
+	for _, l := range cs.levels {
+		if l.overlapsWith(kr) {
+			return false
+		}
+	}
+	for _, l := range cs.levels {
+		l.ranges = append(l.ranges, kr)
+	}
+	return true
+}
+
+func (cs *compactStatus) removeFromAllLevels(kr keyRange) {
+	cs.Lock()
+	defer cs.Unlock()
+	for _, l := range cs.levels {
+		l.remove(kr)
+	}
+	cs.notifyFinished()
+}
+
+// addToLevel adds the range to the level if it doesn't overlap with any running compaction.
+func (cs *compactStatus) addToLevel(level int, kr keyRange) bool {
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.levels[level].overlapsWith(kr) {
+		return false
+	}
+	cs.levels[level].ranges = append(cs.levels[level].ranges, kr)
+	return true
+}
+
+func (cs *compactStatus) removeFromLevel(level int, kr keyRange) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.levels[level].remove(kr)
+}
+
 type thisAndNextLevelRLocked struct{}
 
 // compareAndAdd will check whether we can run this CompactDef. That it doesn't overlap with any
@@ -166,7 +224,7 @@ func (cs *compactStatus) compareAndAdd(_ thisAndNextLevelRLocked, cd *CompactDef
 	// running parallel compactions for the same level.
 	// NOTE: We can directly call thisLevel.totalSize, because we already have acquire a read lock
 	// over this and the next level.
-	if thisHandler.totalSize-thisLevel.deltaSize < thisHandler.maxTotalSize {
+	if !cd.isManual && thisHandler.totalSize-thisLevel.deltaSize < thisHandler.getMaxTotalSize() {
 		return false
 	}
 
@@ -201,6 +259,7 @@ func (cs *compactStatus) delete(cd *CompactDef) {
 		fmt.Printf("Next Level:\n%s\n", nextLevel.debug())
 		log.Fatal("keyRange not found")
 	}
+	cs.notifyFinished()
 }
 
 func (cs *compactStatus) isCompacting(level int, tables ...table.Table) bool {
@@ -234,6 +293,9 @@ type CompactDef struct {
 	InMemory    bool
 
 	splitHints []y.Key
+	// isManual is set for compactions requested by DB.CompactRange, they don't require the level
+	// to exceed its size limit.
+	isManual bool
 
 	thisRange keyRange
 	nextRange keyRange
@@ -347,7 +409,7 @@ func (cd *CompactDef) fillTablesL0(cs *compactStatus, thisLevel, nextLevel *leve
 
 const maxCompactionExpandSize = 1 << 30 // 1GB
 
-func (cd *CompactDef) fillTables(cs *compactStatus, thisLevel, nextLevel *levelHandler) bool {
+func (cd *CompactDef) fillTables(cs *compactStatus, thisLevel, nextLevel *levelHandler, picker CompactionPicker) bool {
 	cd.lockLevels(thisLevel, nextLevel)
 	defer cd.unlockLevels(thisLevel, nextLevel)
 
@@ -359,8 +421,8 @@ func (cd *CompactDef) fillTables(cs *compactStatus, thisLevel, nextLevel *levelH
 	next := make([]table.Table, len(nextLevel.tables))
 	copy(next, nextLevel.tables)
 
-	// First pick one table has max topSize/bottomSize ratio.
-	var candidateRatio float64
+	// First pick one table has max score.
+	var candidateScore, candidateRatio float64
 	for i, t := range this {
 		if cs.isCompacting(thisLevel.level, t) {
 			continue
@@ -369,10 +431,11 @@ func (cd *CompactDef) fillTables(cs *compactStatus, thisLevel, nextLevel *levelH
 		if cs.isCompacting(nextLevel.level, next[left:right]...) {
 			continue
 		}
-		botSize := sumTableSize(next[left:right])
-		ratio := calcRatio(t.Size(), botSize)
-		if ratio > candidateRatio {
-			candidateRatio = ratio
+		score := picker.Score(thisLevel.level, t, next[left:right])
+		if len(cd.Top) == 0 || score > candidateScore {
+			botSize := sumTableSize(next[left:right])
+			candidateScore = score
+			candidateRatio = calcRatio(t.Size(), botSize)
 			cd.topLeftIdx = i
 			cd.topRightIdx = i + 1
 			cd.Top = this[cd.topLeftIdx:cd.topRightIdx:cd.topRightIdx]
@@ -457,6 +520,67 @@ func (cd *CompactDef) fillTables(cs *compactStatus, thisLevel, nextLevel *levelH
 	return cs.compareAndAdd(thisAndNextLevelRLocked{}, cd, thisLevel)
 }
 
+// fillTablesInRange picks all the tables of this level overlapping with kr and their overlapping
+// tables in the next level. It returns true without picking any table if there is nothing to
+// compact in this level.
+func (cd *CompactDef) fillTablesInRange(cs *compactStatus, thisLevel, nextLevel *levelHandler, kr keyRange) bool {
+	thisLevel.RLock()
+	left, right := 0, len(thisLevel.tables)
+	if thisLevel.level > 0 {
+		left, right = thisLevel.overlappingTables(levelHandlerRLocked{}, kr)
+	} else {
+		// Level 0 tables overlap with each other, all of them are compacted together if any
+		// one overlaps with the range.
+		var overlap bool
+		for _, t := range thisLevel.tables {
+			if kr.overlapsWith(getKeyRange([]table.Table{t})) {
+				overlap = true
+				break
+			}
+		}
+		if !overlap {
+			right = 0
+		}
+	}
+	thisLevel.RUnlock()
+	if left >= right {
+		return true
+	}
+	if thisLevel.level == 0 {
+		return cd.fillTablesL0(cs, thisLevel, nextLevel)
+	}
+
+	cd.lockLevels(thisLevel, nextLevel)
+	defer cd.unlockLevels(thisLevel, nextLevel)
+
+	// The tables may have changed while the lock was released.
+	left, right = thisLevel.overlappingTables(levelHandlerRLocked{}, kr)
+	if left >= right {
+		return true
+	}
+	cd.Top = make([]table.Table, right-left)
+	copy(cd.Top, thisLevel.tables[left:right])
+	cd.topLeftIdx, cd.topRightIdx = left, right
+	cd.topSize = sumTableSize(cd.Top)
+	cd.thisRange = getKeyRange(cd.Top)
+
+	left, right = nextLevel.overlappingTables(levelHandlerRLocked{}, cd.thisRange)
+	bots := make([]table.Table, right-left)
+	copy(bots, nextLevel.tables[left:right])
+	cd.botLeftIdx, cd.botRightIdx = left, right
+	cd.botSize = sumTableSize(bots)
+	if len(bots) > 0 {
+		cd.nextRange = getKeyRange(bots)
+	} else {
+		cd.nextRange = cd.thisRange
+	}
+	cd.fillBottomTables(bots)
+	for _, t := range cd.SkippedTbls {
+		cd.botSize -= t.Size()
+	}
+	return cs.compareAndAdd(thisAndNextLevelRLocked{}, cd, thisLevel)
+}
+
 func (cd *CompactDef) lockLevels(this, next *levelHandler) {
 	this.RLock()
 	next.RLock()
@@ -475,13 +599,18 @@ func (cd *CompactDef) buildIterator() y.Iterator {
 	// Create iterators across all the tables involved first.
 	var iters []y.Iterator
 	if cd.Level == 0 {
-		iters = appendIteratorsReversed(iters, cd.Top, false)
+		iters = appendIteratorsReversed(iters, cd.Top, false, 0)
 	} else {
 		iters = []y.Iterator{table.NewConcatIterator(cd.Top, false)}
 	}
 
 	// Next level has level>=1 and we can use ConcatIterator as key ranges do not overlap.
 	iters = append(iters, table.NewConcatIterator(cd.Bot, false))
+	if cd.Opt.DirectIO {
+		for _, it := range iters {
+			it.(*table.ConcatIterator).SetDirectIO()
+		}
+	}
 	it := table.NewMergeIterator(iters, false)
 
 	it.Rewind()
@@ -677,7 +806,7 @@ func (c *CompactionServer) handleConn(conn net.Conn) error {
 	cd := new(CompactDef)
 	cd.HasOverlap = req.Overlap
 	for i, result := range recvFiles {
-		t, err := sstable.OpenInMemoryTable(result.FileData, result.IndexData)
+		t, err := sstable.OpenInMemoryTable(result.FileData, result.IndexData, nil)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,65 @@
+package badger
+
+import (
+	"github.com/pingcap/badger/table"
+)
+
+// CompactionPicker chooses where a compaction of a level starts. Every table in the level which
+// is not being compacted is scored with the tables in the next level overlapping with it, the
+// compaction starts from the table with the highest score and is expanded to the adjacent tables
+// as long as the ratio of the level size to the next level size increases.
+type CompactionPicker interface {
+	// Score returns the score of compacting top in the level into the overlapping tables bottoms.
+	Score(level int, top table.Table, bottoms []table.Table) float64
+}
+
+var (
+	// PickByScore picks the table with the highest ratio of its size to the size of the overlapping
+	// tables, so a compaction rewrites the least data in the next level. It is the default.
+	PickByScore CompactionPicker = scorePicker{}
+	// PickByOldestData picks the table with the oldest newest version, so the old data is pushed
+	// down first while the recent data stays in the upper levels.
+	PickByOldestData CompactionPicker = oldestDataPicker{}
+	// PickByTombstoneDensity picks the table with the highest ratio of deletes to entries, so the
+	// space of the deleted keys is reclaimed first.
+	PickByTombstoneDensity CompactionPicker = tombstoneDensityPicker{}
+	// PickBySmallestOverlap picks the table with the smallest size of overlapping tables in the
+	// next level regardless of its own size.
+	PickBySmallestOverlap CompactionPicker = smallestOverlapPicker{}
+)
+
+type scorePicker struct{}
+
+func (scorePicker) Score(level int, top table.Table, bottoms []table.Table) float64 {
+	return calcRatio(top.Size(), sumTableSize(bottoms))
+}
+
+type oldestDataPicker struct{}
+
+func (oldestDataPicker) Score(level int, top table.Table, bottoms []table.Table) float64 {
+	stats := entryStats(top)
+	return 1 / (float64(stats.MaxVersion) + 1)
+}
+
+type tombstoneDensityPicker struct{}
+
+func (tombstoneDensityPicker) Score(level int, top table.Table, bottoms []table.Table) float64 {
+	stats := entryStats(top)
+	if stats.NumEntries == 0 {
+		return 0
+	}
+	return float64(stats.NumDeletes) / float64(stats.NumEntries)
+}
+
+type smallestOverlapPicker struct{}
+
+func (smallestOverlapPicker) Score(level int, top table.Table, bottoms []table.Table) float64 {
+	return 1 / (float64(sumTableSize(bottoms)) + 1)
+}
+
+func entryStats(t table.Table) table.EntryStats {
+	if st, ok := t.(table.EntryStatsTable); ok {
+		return st.EntryStats()
+	}
+	return table.EntryStats{}
+}
@@ -0,0 +1,77 @@
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pingcap/badger/options"
+	"github.com/pingcap/badger/table"
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/badger/y"
+	"github.com/stretchr/testify/require"
+)
+
+func buildPickerTestTable(t *testing.T, dir, prefix string, n int, version uint64, deletes int) table.Table {
+	filename := sstable.NewFilename(uint64(len(prefix))<<32|version, dir)
+	f, err := y.OpenSyncedFile(filename, false)
+	require.NoError(t, err)
+	opts := DefaultOptions.TableBuilderOptions
+	b := sstable.NewTableBuilder(f, nil, 1, opts)
+	for i := 0; i < n; i++ {
+		v := y.ValueStruct{Value: make([]byte, 100)}
+		if i < deletes {
+			v = y.ValueStruct{Meta: bitDelete}
+		}
+		require.NoError(t, b.Add(y.KeyWithTs([]byte(fmt.Sprintf("%s%05d", prefix, i)), version), v))
+	}
+	_, err = b.Finish()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	tbl, err := sstable.OpenTable(filename, options.FileIO, nil, nil, nil)
+	require.NoError(t, err)
+	return tbl
+}
+
+func TestCompactionPickers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// large is big and new, old is the oldest, tombstones has the most deletes.
+	large := buildPickerTestTable(t, dir, "a", 2000, 30, 0)
+	old := buildPickerTestTable(t, dir, "bb", 500, 10, 0)
+	tombstones := buildPickerTestTable(t, dir, "ccc", 500, 20, 400)
+	small := buildPickerTestTable(t, dir, "dddd", 100, 40, 0)
+	defer func() {
+		for _, tbl := range []table.Table{large, old, tombstones, small} {
+			tbl.Delete()
+		}
+	}()
+
+	stats := tombstones.(table.EntryStatsTable).EntryStats()
+	require.Equal(t, table.EntryStats{NumEntries: 500, NumKeys: 500, NumDeletes: 400, MinVersion: 20, MaxVersion: 20}, stats)
+
+	overlaps := map[table.Table][]table.Table{
+		large:      {old},
+		old:        {large},
+		tombstones: {large},
+		small:      {tombstones},
+	}
+	pick := func(picker CompactionPicker) table.Table {
+		var best table.Table
+		var bestScore float64
+		for _, tbl := range []table.Table{large, old, tombstones, small} {
+			score := picker.Score(1, tbl, overlaps[tbl])
+			if best == nil || score > bestScore {
+				best, bestScore = tbl, score
+			}
+		}
+		return best
+	}
+	require.Equal(t, large, pick(PickByScore))
+	require.Equal(t, old, pick(PickByOldestData))
+	require.Equal(t, tombstones, pick(PickByTombstoneDensity))
+	require.Equal(t, small, pick(PickBySmallestOverlap))
+}
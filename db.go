@@ -18,6 +18,7 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"math"
 	"os"
@@ -40,6 +41,7 @@ import (
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 	"golang.org/x/time/rate"
 )
@@ -51,6 +53,8 @@ var (
 type closers struct {
 	updateSize      *y.Closer
 	compactors      *y.Closer
+	coldStorage     *y.Closer
+	iteratorLeaks   *y.Closer
 	resourceManager *y.Closer
 	blobManager     *y.Closer
 	memtable        *y.Closer
@@ -76,6 +80,10 @@ type DB struct {
 	flushChan chan *flushTask // For flushing memtables.
 	ingestCh  chan *ingestTask
 
+	// checkpointCh and dropAllCh send tasks to the vlog writer, which owns the vlog files.
+	checkpointCh chan *checkpointTask
+	dropAllCh    chan *dropAllTask
+
 	// mem table buffer to avoid expensive allocating big chunk of memory
 	memTableCh chan *memtable.Table
 
@@ -86,15 +94,32 @@ type DB struct {
 
 	blockCache *cache.Cache
 	indexCache *cache.Cache
-
-	metrics      *y.MetricsSet
-	lsmSize      int64
-	vlogSize     int64
+	// compressedCache is the second tier of blockCache which caches the compressed blocks.
+	compressedCache *cache.Cache
+	// coldCache caches the chunks of the tables offloaded to the cold storage.
+	coldCache *cache.Cache
+
+	// valueThreshold is nil if the value threshold is not dynamic.
+	valueThreshold *valueThreshold
+
+	metrics     *y.MetricsSet
+	writeStalls writeStallCounters
+	// cacheGauges are registered to MetricsRegistry for the DB.
+	cacheGauges  []prometheus.Collector
 	volatileMode bool
 
-	blobManger blobManager
+	blobManger  blobManager
+	keyRegistry *keyRegistry
 
 	resourceMgr *epoch.ResourceManager
+
+	publisher *publisher
+	// iterTracker is nil if Options.IteratorLeakTimeout is not set.
+	iterTracker *iteratorTracker
+
+	// formatLock protects format, which is rewritten when a feature is used for the first time.
+	formatLock sync.Mutex
+	format     *dbFormat
 }
 
 type memTables struct {
@@ -131,16 +156,15 @@ func replayFunction(out *DB) func(Entry) error {
 	toLSM := func(nk y.Key, vs y.ValueStruct) {
 		e := memtable.Entry{Key: nk.UserKey, Value: vs}
 		mTbls := out.mtbls.Load().(*memTables)
-		if out.ensureRoomForWrite(mTbls.getMutable(), e.EstimateSize()) == out.opt.MaxMemTableSize {
-			mTbls = out.mtbls.Load().(*memTables)
-		}
+		out.ensureRoomForWrite(mTbls.getMutable(), e.EstimateSize())
+		mTbls = out.mtbls.Load().(*memTables)
 		mTbls.getMutable().PutToSkl(nk.UserKey, vs)
 	}
 
 	first := true
 	return func(e Entry) error { // Function for replaying.
 		if first {
-			log.Info("replay wal", zap.Stringer("first key", e.Key))
+			out.opt.Logger.Info("replay wal", zap.Stringer("first key", e.Key))
 		}
 		first = false
 
@@ -154,10 +178,11 @@ func replayFunction(out *DB) func(Entry) error {
 		copy(nv, e.Value)
 
 		v := y.ValueStruct{
-			Value:    nv,
-			Meta:     e.meta,
-			UserMeta: e.UserMeta,
-			Version:  nk.Version,
+			Value:     nv,
+			Meta:      e.meta,
+			UserMeta:  e.UserMeta,
+			ExpiresAt: e.ExpiresAt,
+			Version:   nk.Version,
 		}
 
 		if e.meta&bitFinTxn > 0 {
@@ -202,14 +227,29 @@ func replayFunction(out *DB) func(Entry) error {
 func Open(opt Options) (db *DB, err error) {
 	opt.maxBatchSize = (15 * opt.MaxMemTableSize) / 100
 	opt.maxBatchCount = opt.maxBatchSize / int64(memtable.MaxNodeSize)
+	if opt.Logger == nil {
+		opt.Logger = options.NopLogger
+	}
 
+	if opt.DisableValueLog {
+		opt.ValueThreshold = 0
+	}
 	if opt.ValueThreshold > math.MaxUint16-16 {
 		return nil, ErrValueThreshold
 	}
+	if opt.DynamicValueThreshold && (opt.MaxValueThreshold < opt.ValueThreshold || opt.MaxValueThreshold > math.MaxUint16-16) {
+		return nil, ErrValueThreshold
+	}
 
 	if opt.ReadOnly {
 		// Can't truncate if the DB is read only.
 		opt.Truncate = false
+		if opt.RepairManifest {
+			return nil, errors.New("the manifest can't be repaired if the DB is read only")
+		}
+	}
+	if opt.ValueDir == "" {
+		opt.ValueDir = opt.Dir
 	}
 
 	for _, path := range []string{opt.Dir, opt.ValueDir} {
@@ -260,7 +300,28 @@ func Open(opt Options) (db *DB, err error) {
 	if !(opt.ValueLogFileSize <= 2<<30 && opt.ValueLogFileSize >= 1<<20) {
 		return nil, ErrValueLogSize
 	}
-	manifestFile, manifest, err := openOrCreateManifestFile(opt.Dir, opt.ReadOnly)
+	format, err := checkFormat(opt.Dir, opt)
+	if err != nil {
+		return nil, err
+	}
+	if len(opt.EncryptionKey) > 0 && opt.RemoteCompactionAddr != "" {
+		return nil, errors.New("remote compaction is not supported with encryption")
+	}
+	if err = validateIndexes(opt.Indexes); err != nil {
+		return nil, err
+	}
+	if opt.ColdStorage != nil && (opt.MaxBlockCacheSize == 0 || opt.TableLoadingMode == options.MemoryMap ||
+		opt.RemoteCompactionAddr != "") {
+		return nil, errors.New("cold storage needs the block cache, it is not supported with memory mapped " +
+			"tables or remote compaction")
+	}
+	kr, err := openKeyRegistry(opt.Dir, opt.EncryptionKey, opt.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	opt.TableBuilderOptions.KeyRegistry = kr
+	manifestFile, manifest, err := openOrCreateManifestFile(opt.Dir, opt.ReadOnly, opt.RepairManifest,
+		opt.RecoveryMode == options.Strict && !opt.RepairManifest, opt.Logger)
 	if err != nil {
 		return nil, err
 	}
@@ -276,7 +337,7 @@ func Open(opt Options) (db *DB, err error) {
 		commits:    make(map[uint64]uint64),
 	}
 
-	var blkCache, idxCache *cache.Cache
+	var blkCache, idxCache, compressedCache *cache.Cache
 	if opt.MaxBlockCacheSize != 0 {
 		var err error
 		blkCache, err = cache.NewCache(&cache.Config{
@@ -285,48 +346,87 @@ func Open(opt Options) (db *DB, err error) {
 			MaxCost:     opt.MaxBlockCacheSize,
 			BufferItems: 64,
 			OnEvict:     sstable.OnEvict,
+			Metrics:     opt.EnableCacheMetrics || opt.MetricsRegistry != nil,
 		})
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to create block cache")
 		}
-
+	}
+	if opt.MaxCompressedBlockCacheSize != 0 && blkCache != nil {
+		var err error
+		compressedCache, err = cache.NewCache(&cache.Config{
+			// The compressed blocks are smaller than the blocks, x4 for the compression ratio.
+			NumCounters: opt.MaxCompressedBlockCacheSize / int64(opt.TableBuilderOptions.BlockSize) * 40,
+			MaxCost:     opt.MaxCompressedBlockCacheSize,
+			BufferItems: 64,
+			Metrics:     opt.EnableCacheMetrics || opt.MetricsRegistry != nil,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create compressed block cache")
+		}
+	}
+	var coldCache *cache.Cache
+	if opt.ColdStorage != nil && opt.ColdCacheSize != 0 {
+		var err error
+		coldCache, err = cache.NewCache(&cache.Config{
+			NumCounters: opt.ColdCacheSize / coldChunkSize * 10,
+			MaxCost:     opt.ColdCacheSize,
+			BufferItems: 64,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create cold cache")
+		}
+	}
+	if opt.MaxIndexCacheSize != 0 {
 		indexSizeHint := float64(opt.TableBuilderOptions.MaxTableSize) / 6.0
+		var err error
 		idxCache, err = cache.NewCache(&cache.Config{
 			NumCounters: int64(float64(opt.MaxIndexCacheSize) / indexSizeHint * 10),
 			MaxCost:     opt.MaxIndexCacheSize,
 			BufferItems: 64,
+			Metrics:     opt.EnableCacheMetrics || opt.MetricsRegistry != nil,
 		})
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to create index cache")
 		}
 	}
 	db = &DB{
-		flushChan:     make(chan *flushTask, opt.NumMemtables),
-		writeCh:       make(chan *request, kvWriteChCapacity),
-		memTableCh:    make(chan *memtable.Table, 1),
-		ingestCh:      make(chan *ingestTask),
-		opt:           opt,
-		manifest:      manifestFile,
-		dirLockGuard:  dirLockGuard,
-		valueDirGuard: valueDirLockGuard,
-		orc:           orc,
-		metrics:       y.NewMetricSet(opt.Dir),
-		blockCache:    blkCache,
-		indexCache:    idxCache,
-		volatileMode:  opt.VolatileMode,
+		flushChan:       make(chan *flushTask, opt.NumMemtables),
+		writeCh:         make(chan *request, kvWriteChCapacity),
+		memTableCh:      make(chan *memtable.Table, 1),
+		ingestCh:        make(chan *ingestTask),
+		checkpointCh:    make(chan *checkpointTask),
+		dropAllCh:       make(chan *dropAllTask),
+		opt:             opt,
+		manifest:        manifestFile,
+		dirLockGuard:    dirLockGuard,
+		valueDirGuard:   valueDirLockGuard,
+		orc:             orc,
+		metrics:         y.NewMetricSet(opt.Dir),
+		blockCache:      blkCache,
+		indexCache:      idxCache,
+		compressedCache: compressedCache,
+		coldCache:       coldCache,
+		volatileMode:    opt.VolatileMode,
+		publisher:       newPublisher(),
+		safeTsTracker:   safeTsTracker{discardTs: math.MaxUint64},
+		keyRegistry:     kr,
+		valueThreshold:  newValueThreshold(opt),
+		iterTracker:     newIteratorTracker(opt.IteratorLeakTimeout),
+		format:          format,
 	}
 	db.vlog.metrics = db.metrics
+	if opt.MetricsRegistry != nil {
+		if err := db.registerMetrics(); err != nil {
+			return nil, err
+		}
+	}
 
 	rateLimit := opt.TableBuilderOptions.BytesPerSecond
 	if rateLimit > 0 {
 		db.limiter = rate.NewLimiter(rate.Limit(rateLimit), rateLimit)
 	}
 
-	// Calculate initial size.
-	db.calculateSize()
-	db.closers.updateSize = y.NewCloser(1)
-	go db.updateSize(db.closers.updateSize)
-
 	db.closers.resourceManager = y.NewCloser(0)
 	db.resourceMgr = epoch.NewResourceManager(db.closers.resourceManager, &db.safeTsTracker)
 
@@ -340,7 +440,7 @@ func Open(opt Options) (db *DB, err error) {
 		lc := db.closers.memtable
 		for {
 			select {
-			case db.memTableCh <- memtable.New(arenaSize(db.opt), db.lc.reserveFileID()):
+			case db.memTableCh <- db.newMemTable():
 			case <-lc.HasBeenClosed():
 				lc.Done()
 				return
@@ -353,18 +453,50 @@ func Open(opt Options) (db *DB, err error) {
 		return nil, err
 	}
 
+	if db.lc.recoveredTables > 0 {
+		// The recovered tables in level 0 may hold older versions than the tables in the other
+		// levels, the versions are ordered again by compacting all of them to the bottom level.
+		db.opt.Logger.Warn("compact the recovered tables", zap.Int("count", db.lc.recoveredTables))
+		if err = db.lc.compactRange(infRange, true); err != nil {
+			return nil, err
+		}
+	}
+
 	if !opt.ReadOnly {
 		db.closers.compactors = y.NewCloser(1)
 		db.lc.startCompact(db.closers.compactors)
 
+		if opt.ColdStorage != nil {
+			db.closers.coldStorage = y.NewCloser(1)
+			go db.runOffloadColdTables(db.closers.coldStorage)
+		}
+
 		db.closers.memtable.AddRunning(1)
 		go db.runFlushMemTable(db.closers.memtable) // Need levels controller to be up.
 	}
+	if db.iterTracker != nil {
+		db.closers.iteratorLeaks = y.NewCloser(1)
+		go db.runIteratorLeakCheck(db.closers.iteratorLeaks)
+	}
 
-	if err = db.vlog.Open(db, opt); err != nil {
-		return nil, err
+	// The value log is opened with DisableValueLog only to replay the files left by the DB.
+	hasVlog := !opt.DisableValueLog
+	if opt.DisableValueLog {
+		if hasVlog, err = hasValueLogFiles(opt.ValueDir); err != nil {
+			return nil, err
+		}
+	}
+	if hasVlog {
+		if err = db.vlog.Open(db, opt); err != nil {
+			return nil, err
+		}
 	}
 
+	// Calculate initial size.
+	db.calculateSize()
+	db.closers.updateSize = y.NewCloser(1)
+	go db.updateSize(db.closers.updateSize)
+
 	var logOff logOffset
 	head := manifest.Head
 	if head != nil {
@@ -382,8 +514,10 @@ func Open(opt Options) (db *DB, err error) {
 
 	replayCloser := startWriteWorker(db)
 
-	if err = db.vlog.Replay(logOff, replayFunction(db)); err != nil {
-		return db, err
+	if hasVlog {
+		if err = db.vlog.Replay(logOff, replayFunction(db)); err != nil {
+			return db, err
+		}
 	}
 
 	replayCloser.SignalAndWait() // Wait for replay to be applied first.
@@ -391,6 +525,11 @@ func Open(opt Options) (db *DB, err error) {
 	db.orc.Lock()
 	db.orc.nextCommit = db.orc.curRead + 1
 	db.orc.Unlock()
+	if hasVlog && opt.DisableValueLog && !opt.ReadOnly {
+		if err = db.removeValueLog(); err != nil {
+			return db, err
+		}
+	}
 
 	db.writeCh = make(chan *request, kvWriteChCapacity)
 	db.closers.writes = startWriteWorker(db)
@@ -406,52 +545,26 @@ func Open(opt Options) (db *DB, err error) {
 // This function is designed to reclaim space quickly.
 // If you want to ensure no future transaction can read keys in range,
 // considering iterate and delete the remained keys, or using compaction filter to cleanup them asynchronously.
-func (db *DB) DeleteFilesInRange(start, end []byte) {
-	var (
-		changes   []*protos.ManifestChange
-		pruneTbls []table.Table
-		startKey  = y.KeyWithTs(start, math.MaxUint64)
-		endKey    = y.KeyWithTs(end, 0)
-		guard     = db.resourceMgr.Acquire()
-	)
-
-	for level, lc := range db.lc.levels {
-		lc.Lock()
-		left, right := 0, len(lc.tables)
-		if lc.level > 0 {
-			left, right = getTablesInRange(lc.tables, startKey, endKey)
-		}
-		if left >= right {
-			lc.Unlock()
-			continue
-		}
-
-		newTables := lc.tables[:left]
-		for _, tbl := range lc.tables[left:right] {
-			if !isRangeCoversTable(startKey, endKey, tbl) || tbl.IsCompacting() {
-				newTables = append(newTables, tbl)
-				continue
-			}
-			pruneTbls = append(pruneTbls, tbl)
-			changes = append(changes, newDeleteChange(tbl.ID()))
-		}
-		newTables = append(newTables, lc.tables[right:]...)
-		for i := len(newTables); i < len(lc.tables); i++ {
-			lc.tables[i] = nil
-		}
-		assertTablesOrder(level, newTables, nil)
-		lc.tables = newTables
-		lc.Unlock()
+// The tables are removed by one manifest change set while the levels are locked, so either all of
+// them or none of them are removed if the manifest can't be written. The tables being compacted
+// are not deleted.
+func (db *DB) DeleteFilesInRange(start, end []byte) error {
+	guard := db.resourceMgr.Acquire()
+	defer guard.Done()
+	pruneTbls, err := db.lc.deleteTablesInRange(y.KeyWithTs(start, math.MaxUint64), y.KeyWithTs(end, 0))
+	if err != nil {
+		return err
 	}
 
-	db.manifest.addChanges(changes, nil)
 	var discardStats DiscardStats
 	deletes := make([]epoch.Resource, len(pruneTbls))
 	for i, tbl := range pruneTbls {
 		it := tbl.NewIterator(false)
 		// TODO: use rate limiter to avoid burst IO.
+		var vs y.ValueStruct
 		for it.Rewind(); it.Valid(); y.NextAllVersion(it) {
-			discardStats.collect(it.Value())
+			it.FillValue(&vs)
+			discardStats.collect(vs)
 		}
 		deletes[i] = tbl
 		it.Close()
@@ -460,7 +573,33 @@ func (db *DB) DeleteFilesInRange(start, end []byte) {
 		db.blobManger.discardCh <- &discardStats
 	}
 	guard.Delete(deletes)
-	guard.Done()
+	return nil
+}
+
+// CompactRangeOptions controls the manual compaction run by DB.CompactRange.
+type CompactRangeOptions struct {
+	// BottomLevel compacts the range all the way down to the bottom level. Otherwise the range is
+	// compacted down to the lowest level that has tables overlapping with it.
+	BottomLevel bool
+}
+
+// CompactRange compacts the tables overlapping with the key range [start, end] level by level,
+// so the space of deleted and overwritten entries in the range is reclaimed without waiting for
+// the automatic compactions. Entries that are still in the memtables are not compacted.
+func (db *DB) CompactRange(start, end []byte, opts CompactRangeOptions) error {
+	kr := keyRange{
+		left:  y.KeyWithTs(start, math.MaxUint64),
+		right: y.KeyWithTs(end, 0),
+	}
+	return db.lc.compactRange(kr, opts.BottomLevel)
+}
+
+// Flatten compacts the tables of every level down to the bottom level, so only the bottom level
+// has tables and the reads don't need to merge the levels. The tables of a level are compacted by
+// at most workers goroutines. It repeats until the other levels are empty, so the writes should be
+// stopped while it runs. Entries that are still in the memtables are not compacted.
+func (db *DB) Flatten(workers int) error {
+	return db.lc.flatten(workers)
 }
 
 func isRangeCoversTable(start, end y.Key, t table.Table) bool {
@@ -474,6 +613,13 @@ func (db *DB) NewExternalTableBuilder(f *os.File, compression options.Compressio
 	return sstable.NewExternalTableBuilder(f, limiter, db.opt.TableBuilderOptions, compression)
 }
 
+// NewSplitExternalTableBuilder returns a new sst builder which splits the output into multiple
+// tables of at most maxTableSize bytes, newFile is called to create the file of every table.
+func (db *DB) NewSplitExternalTableBuilder(newFile func() (*os.File, error), maxTableSize int64,
+	compression options.CompressionType, limiter *rate.Limiter) *sstable.SplitBuilder {
+	return sstable.NewSplitExternalTableBuilder(newFile, maxTableSize, limiter, db.opt.TableBuilderOptions, compression)
+}
+
 // ErrExternalTableOverlap returned by IngestExternalFiles when files overlaps.
 var ErrExternalTableOverlap = errors.New("keys of external tables has overlap")
 
@@ -481,15 +627,26 @@ type ExternalTableSpec struct {
 	Filename string
 }
 
+// IngestOptions controls how IngestExternalFiles attaches the external tables to the DB.
+type IngestOptions struct {
+	// CopyFiles copies the external files into the DB directory instead of hard linking them,
+	// it is required if the files are on a different file system.
+	CopyFiles bool
+	// MoveFiles removes the external files after they are successfully ingested.
+	MoveFiles bool
+}
+
 // IngestExternalFiles ingest external constructed tables into DB.
+// The tables are assigned new IDs and each table is placed at the lowest level it doesn't overlap.
 // Note: insure there is no concurrent write overlap with tables to be ingested.
-func (db *DB) IngestExternalFiles(files []ExternalTableSpec) (int, error) {
-	tbls, err := db.prepareExternalFiles(files)
+func (db *DB) IngestExternalFiles(files []ExternalTableSpec, opts IngestOptions) (int, error) {
+	tbls, err := db.prepareExternalFiles(files, opts)
 	if err != nil {
 		return 0, err
 	}
 
 	if err := db.checkExternalTables(tbls); err != nil {
+		deleteTables(tbls)
 		return 0, err
 	}
 
@@ -497,31 +654,88 @@ func (db *DB) IngestExternalFiles(files []ExternalTableSpec) (int, error) {
 	task.Add(1)
 	db.ingestCh <- task
 	task.Wait()
+	if task.err == nil && opts.MoveFiles {
+		if err := removeExternalFiles(files); err != nil {
+			return task.cnt, err
+		}
+	}
 	return task.cnt, task.err
 }
 
-func (db *DB) prepareExternalFiles(specs []ExternalTableSpec) ([]table.Table, error) {
-	tbls := make([]table.Table, len(specs))
-	for i, spec := range specs {
-		id := db.lc.reserveFileID()
-		filename := sstable.NewFilename(id, db.opt.Dir)
+// removeExternalFiles removes the external tables and their index files.
+func removeExternalFiles(files []ExternalTableSpec) error {
+	for _, spec := range files {
+		if err := os.Remove(spec.Filename); err != nil {
+			return err
+		}
+		if err := os.Remove(sstable.IndexFilename(spec.Filename)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		err := os.Link(spec.Filename, filename)
-		if err != nil {
-			return nil, err
+// ErrExternalTableOutOfRange is returned by ReplaceRange when the keys of an external table are not
+// in the range.
+var ErrExternalTableOutOfRange = errors.New("keys of external table are out of the range")
+
+// ReplaceRange deletes all the data in [start, end) and ingests the external tables in one manifest
+// change set, so after a crash either the old data or the ingested data is in the range, and a read
+// sees one of them but never a mix. The keys of the tables must be in the range. The memtables with
+// keys in the range are flushed first and the tables partially in the range are rewritten, the
+// ingested tables are placed at the bottom level. It can be used to apply a snapshot of a range
+// exported by DB.ExportRange.
+// Note: ensure there is no concurrent write into the range.
+func (db *DB) ReplaceRange(start, end []byte, files []ExternalTableSpec, opts IngestOptions) (int, error) {
+	if bytes.Compare(start, end) >= 0 {
+		return 0, ErrInvalidRequest
+	}
+	tbls, err := db.prepareExternalFiles(files, opts)
+	if err != nil {
+		return 0, err
+	}
+	if err = db.checkExternalTables(tbls); err == nil {
+		for _, t := range tbls {
+			if bytes.Compare(t.Smallest().UserKey, start) < 0 || bytes.Compare(t.Biggest().UserKey, end) >= 0 {
+				err = ErrExternalTableOutOfRange
+				break
+			}
 		}
+	}
+	if err != nil {
+		deleteTables(tbls)
+		return 0, err
+	}
 
-		err = os.Link(sstable.IndexFilename(spec.Filename), sstable.IndexFilename(filename))
-		if err != nil {
-			return nil, err
+	task := &ingestTask{tbls: tbls, replace: true, start: start, end: end}
+	task.Add(1)
+	db.ingestCh <- task
+	task.Wait()
+	if task.err != nil {
+		deleteTables(tbls)
+		return 0, task.err
+	}
+	if opts.MoveFiles {
+		if err := removeExternalFiles(files); err != nil {
+			return task.cnt, err
 		}
+	}
+	return task.cnt, nil
+}
 
-		tbl, err := sstable.OpenTable(filename, db.blockCache, db.indexCache)
+func (db *DB) prepareExternalFiles(specs []ExternalTableSpec, opts IngestOptions) ([]table.Table, error) {
+	tbls := make([]table.Table, 0, len(specs))
+	for _, spec := range specs {
+		id := db.lc.reserveFileID()
+		filename := sstable.NewFilename(id, db.opt.Dir)
+
+		tbl, err := db.importExternalFile(spec.Filename, filename, opts)
 		if err != nil {
+			deleteTables(tbls)
 			return nil, err
 		}
 
-		tbls[i] = tbl
+		tbls = append(tbls, tbl)
 	}
 
 	sort.Slice(tbls, func(i, j int) bool {
@@ -531,6 +745,78 @@ func (db *DB) prepareExternalFiles(specs []ExternalTableSpec) ([]table.Table, er
 	return tbls, syncDir(db.lc.kv.opt.Dir)
 }
 
+// importExternalFile links or copies the external table and its index file to filename and opens it.
+func (db *DB) importExternalFile(src, filename string, opts IngestOptions) (*sstable.Table, error) {
+	importFile := os.Link
+	if opts.CopyFiles {
+		importFile = copyFile
+	}
+	if err := importFile(src, filename); err != nil {
+		return nil, err
+	}
+	if err := importFile(sstable.IndexFilename(src), sstable.IndexFilename(filename)); err != nil {
+		os.Remove(filename)
+		return nil, err
+	}
+	tbl, err := db.openTable(filename)
+	if err != nil {
+		os.Remove(filename)
+		os.Remove(sstable.IndexFilename(filename))
+		return nil, err
+	}
+	return tbl, nil
+}
+
+// openTable opens the table file with the caches and the key registry of the DB.
+func (db *DB) openTable(filename string) (*sstable.Table, error) {
+	if fi, err := os.Stat(filename); err == nil && fi.Size() == 0 {
+		// An empty data file is the stub of a table offloaded to the cold storage.
+		if db.opt.ColdStorage == nil {
+			return nil, errors.Errorf("table %s is offloaded to the cold storage which is not set", filename)
+		}
+		return db.openColdTable(filename)
+	}
+	tbl, err := sstable.OpenTable(filename, db.opt.TableLoadingMode, db.blockCache, db.indexCache, db.keyRegistry)
+	if err != nil {
+		return nil, err
+	}
+	if db.compressedCache != nil {
+		tbl.SetCompressedBlockCache(db.compressedCache)
+	}
+	tbl.SetVerifyBlockChecksum(db.opt.TableBuilderOptions.VerifyBlockChecksum)
+	return tbl, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := y.OpenTruncFile(dst, false)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// deleteTables removes the tables that failed to be ingested.
+func deleteTables(tbls []table.Table) {
+	for _, t := range tbls {
+		if err := t.Delete(); err != nil {
+			log.Error("failed to delete table", zap.Uint64("id", t.ID()), zap.Error(err))
+		}
+	}
+}
+
 func (db *DB) checkExternalTables(tbls []table.Table) error {
 	keys := make([][]byte, 0, len(tbls)*2)
 	for _, t := range tbls {
@@ -552,14 +838,68 @@ func (db *DB) checkExternalTables(tbls []table.Table) error {
 	return nil
 }
 
-// CacheMetrics returns the metrics for the underlying cache.
-func (db *DB) CacheMetrics() *cache.Metrics {
-	// Do not enable ristretto metrics in badger until issue
+// CacheMetrics are the metrics of the block cache and the index cache. A metrics is nil if the
+// cache is disabled or the metrics are not collected.
+type CacheMetrics struct {
+	BlockCache           *cache.Metrics
+	IndexCache           *cache.Metrics
+	CompressedBlockCache *cache.Metrics
+}
+
+// CacheMetrics returns the metrics of the block cache and the index cache, they are only collected
+// if EnableCacheMetrics or MetricsRegistry is set.
+func (db *DB) CacheMetrics() CacheMetrics {
+	// Do not enable ristretto metrics in badger by default until issue
 	// https://github.com/dgraph-io/ristretto/issues/92 is resolved.
-	// return db.blockCache.Metrics()
+	var m CacheMetrics
+	if db.blockCache != nil {
+		m.BlockCache = db.blockCache.Metrics
+	}
+	if db.indexCache != nil {
+		m.IndexCache = db.indexCache.Metrics
+	}
+	if db.compressedCache != nil {
+		m.CompressedBlockCache = db.compressedCache.Metrics
+	}
+	return m
+}
+
+// registerMetrics registers the metrics to MetricsRegistry. The hit ratio gauges of the caches
+// belong to the DB, they are unregistered when the DB is closed.
+func (db *DB) registerMetrics() error {
+	r := db.opt.MetricsRegistry
+	if err := y.RegisterMetrics(r); err != nil {
+		return err
+	}
+	caches := []struct {
+		name  string
+		cache *cache.Cache
+	}{{"block", db.blockCache}, {"index", db.indexCache}, {"compressed_block", db.compressedCache}}
+	for _, c := range caches {
+		if c.cache == nil {
+			continue
+		}
+		gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   "badger",
+			Name:        "cache_hit_ratio",
+			ConstLabels: prometheus.Labels{"path": db.opt.Dir, "cache": c.name},
+		}, c.cache.Metrics.Ratio)
+		if err := r.Register(gauge); err != nil {
+			db.unregisterMetrics()
+			return err
+		}
+		db.cacheGauges = append(db.cacheGauges, gauge)
+	}
 	return nil
 }
 
+func (db *DB) unregisterMetrics() {
+	for _, gauge := range db.cacheGauges {
+		db.opt.MetricsRegistry.Unregister(gauge)
+	}
+	db.cacheGauges = nil
+}
+
 // Close closes a DB. It's crucial to call it to ensure all the pending updates
 // make their way to disk. Calling DB.Close() multiple times is not safe and would
 // cause panic.
@@ -568,6 +908,7 @@ func (db *DB) Close() (err error) {
 
 	// Stop writes next.
 	db.closers.writes.SignalAndWait()
+	db.publisher.close()
 
 	// Now close the value log.
 	if vlogErr := db.vlog.Close(); err == nil {
@@ -595,6 +936,12 @@ func (db *DB) Close() (err error) {
 		db.closers.compactors.SignalAndWait()
 		log.Info("Compaction finished")
 	}
+	if db.closers.coldStorage != nil {
+		db.closers.coldStorage.SignalAndWait()
+	}
+	if db.closers.iteratorLeaks != nil {
+		db.closers.iteratorLeaks.SignalAndWait()
+	}
 	if db.opt.CompactL0WhenClose && !db.volatileMode {
 		// Force Compact L0
 		// We don't need to care about cstatus since no parallel compaction is running.
@@ -603,10 +950,10 @@ func (db *DB) Close() (err error) {
 		defer guard.Done()
 		if cd.fillTablesL0(&db.lc.cstatus, db.lc.levels[0], db.lc.levels[1]) {
 			if err := db.lc.runCompactDef(cd, guard); err != nil {
-				log.Info("LOG Compact FAILED", zap.Stringer("compact def", cd), zap.Error(err))
+				db.opt.Logger.Info("LOG Compact FAILED", zap.Stringer("compact def", cd), zap.Error(err))
 			}
 		} else {
-			log.Info("fillTables failed for level zero. No compaction required")
+			db.opt.Logger.Info("fillTables failed for level zero. No compaction required")
 		}
 	}
 
@@ -624,9 +971,19 @@ func (db *DB) Close() (err error) {
 	}
 	log.Info("Waiting for closer")
 	db.closers.updateSize.SignalAndWait()
+	db.unregisterMetrics()
 	if db.blockCache != nil {
 		db.blockCache.Close()
 	}
+	if db.indexCache != nil {
+		db.indexCache.Close()
+	}
+	if db.compressedCache != nil {
+		db.compressedCache.Close()
+	}
+	if db.coldCache != nil {
+		db.coldCache.Close()
+	}
 
 	if db.dirLockGuard != nil {
 		if guardErr := db.dirLockGuard.release(); err == nil {
@@ -690,7 +1047,17 @@ func (db *DB) getMemTables() []*memtable.Table {
 // tables and find the max version among them.  To maintain this invariant, we also need to ensure
 // that all versions of a key are always present in the same table from level 1, because compaction
 // can push any table down.
-func (db *DB) get(key y.Key) y.ValueStruct {
+func (db *DB) get(ctx context.Context, key y.Key) y.ValueStruct {
+	if vs := db.getInMemTables(ctx, key); vs.Valid() {
+		return vs
+	}
+	keyHash := farm.Fingerprint64(key.UserKey)
+	return db.lc.get(ctx, key, keyHash)
+}
+
+func (db *DB) getInMemTables(ctx context.Context, key y.Key) y.ValueStruct {
+	_, span := db.startSpan(ctx, "badger.memtable_get")
+	defer span.End()
 	tables := db.getMemTables() // Lock should be released.
 
 	db.metrics.NumGets.Inc()
@@ -701,11 +1068,12 @@ func (db *DB) get(key y.Key) y.ValueStruct {
 			log.Error("search table meets error", zap.Error(err))
 		}
 		if vs.Valid() {
+			span.SetAttribute("found", true)
 			return vs
 		}
 	}
-	keyHash := farm.Fingerprint64(key.UserKey)
-	return db.lc.get(key, keyHash)
+	span.SetAttribute("found", false)
+	return y.ValueStruct{}
 }
 
 func (db *DB) multiGet(pairs []keyValuePair) {
@@ -757,9 +1125,16 @@ var requestPool = sync.Pool{
 
 func (db *DB) sendToWriteCh(entries []*Entry) (*request, error) {
 	var count, size int64
+	var hasTTL bool
 	for _, e := range entries {
 		size += int64(e.estimateSize())
 		count++
+		hasTTL = hasTTL || e.ExpiresAt != 0
+	}
+	if hasTTL {
+		if err := db.enableFeature(featureTTL); err != nil {
+			return nil, err
+		}
 	}
 
 	// We can only service one request because we need each txn to be stored in a contigous section.
@@ -808,14 +1183,24 @@ func (db *DB) batchSetAsync(entries []*Entry, f func(error)) error {
 	return nil
 }
 
-// ensureRoomForWrite is always called serially.
+// ensureRoomForWrite is always called serially. It flushes the memtable if it can't hold minSize
+// more bytes, the caller should load the mutable memtable again after it.
 func (db *DB) ensureRoomForWrite(mt *memtable.Table, minSize int64) int64 {
-	free := db.opt.MaxMemTableSize - mt.Size()
-	if free >= minSize {
+	if free := db.memTableFree(mt); free >= minSize {
 		return free
 	}
 	_ = db.flushMemTable()
-	return db.opt.MaxMemTableSize
+	return db.memTableFree(db.mtbls.Load().(*memTables).getMutable())
+}
+
+// memTableFree returns the number of bytes which can still be put into the memtable, it is full
+// once the fullest shard is full.
+func (db *DB) memTableFree(mt *memtable.Table) int64 {
+	free := db.opt.MaxMemTableSize - mt.Size()
+	if shardFree := mt.ShardFree(); shardFree < free {
+		free = shardFree
+	}
+	return free
 }
 
 func (db *DB) flushMemTable() *sync.WaitGroup {
@@ -823,17 +1208,49 @@ func (db *DB) flushMemTable() *sync.WaitGroup {
 	newTbls := newMemTables(<-db.memTableCh, mTbls)
 	db.mtbls.Store(newTbls)
 	ft := newFlushTask(mTbls.getMutable(), db.logOff)
-	db.flushChan <- ft
-	log.Info("flushing memtable", zap.Int64("memtable size", mTbls.getMutable().Size()), zap.Int("size of flushChan", len(db.flushChan)))
+	select {
+	case db.flushChan <- ft:
+	default:
+		// All the memtables are waiting to be flushed.
+		end := db.beginWriteStall(options.StallByMemTables)
+		db.flushChan <- ft
+		end()
+	}
+	db.opt.Logger.Info("flushing memtable", zap.Int64("memtable size", mTbls.getMutable().Size()), zap.Int("size of flushChan", len(db.flushChan)))
 
 	// New memtable is empty. We certainly have room.
 	return &ft.wg
 }
 
+func (db *DB) newMemTable() *memtable.Table {
+	return memtable.NewSharded(arenaSize(db.opt), db.opt.NumMemTableShards, db.opt.MemTableType, db.lc.reserveFileID())
+}
+
 func arenaSize(opt Options) int64 {
 	return opt.MaxMemTableSize + opt.maxBatchCount*int64(memtable.MaxNodeSize)
 }
 
+// getValueThreshold returns the size above which the values are stored in the blob files, values
+// are never stored in the blob files if it is 0.
+func (db *DB) getValueThreshold() int {
+	if db.valueThreshold != nil {
+		return db.valueThreshold.get()
+	}
+	return db.opt.ValueThreshold
+}
+
+// isBlobValue returns true if the value is stored in a blob file. The placement set by the entry
+// overrides the value threshold.
+func (db *DB) isBlobValue(vs y.ValueStruct, valueThreshold int) bool {
+	switch {
+	case vs.Meta&bitValueInline != 0:
+		return false
+	case vs.Meta&bitValueInBlob != 0:
+		return len(vs.Value) > 0 && !db.opt.DisableValueLog
+	}
+	return valueThreshold > 0 && len(vs.Value) > valueThreshold
+}
+
 // WriteLevel0Table flushes memtable. It drops deleteValues.
 func (db *DB) writeLevel0Table(s *memtable.Table, f *os.File) error {
 	iter := s.NewIterator(false)
@@ -843,13 +1260,20 @@ func (db *DB) writeLevel0Table(s *memtable.Table, f *os.File) error {
 		numWrite, bytesWrite int
 		err                  error
 	)
-	b := sstable.NewTableBuilder(f, db.limiter, 0, db.opt.TableBuilderOptions)
+	b := sstable.NewTableBuilder(f, db.lc.limiters[0], 0, db.opt.TableBuilderOptions)
 	defer b.Close()
 
+	if db.valueThreshold != nil {
+		db.valueThreshold.update()
+	}
+	valueThreshold := db.getValueThreshold()
+	var value y.ValueStruct
 	for iter.Rewind(); iter.Valid(); y.NextAllVersion(iter) {
 		key := iter.Key()
-		value := iter.Value()
-		if db.opt.ValueThreshold > 0 && len(value.Value) > db.opt.ValueThreshold {
+		iter.FillValue(&value)
+		isBlob := db.isBlobValue(value, valueThreshold)
+		value.Meta &^= bitValuePlacement
+		if isBlob {
 			if bb == nil {
 				if bb, err = db.newBlobFileBuilder(); err != nil {
 					return y.Wrap(err)
@@ -883,7 +1307,7 @@ func (db *DB) writeLevel0Table(s *memtable.Table, f *os.File) error {
 		if err1 != nil {
 			return err1
 		}
-		log.Info("build L0 blob", zap.Uint32("id", bf.fid), zap.Uint32("size", bf.fileSize))
+		db.opt.Logger.Info("build L0 blob", zap.Uint32("id", bf.fid), zap.Uint32("size", bf.fileSize))
 		err1 = db.blobManger.addFile(bf)
 		if err1 != nil {
 			return err1
@@ -893,7 +1317,8 @@ func (db *DB) writeLevel0Table(s *memtable.Table, f *os.File) error {
 }
 
 func (db *DB) newBlobFileBuilder() (*blobFileBuilder, error) {
-	return newBlobFileBuilder(db.blobManger.allocFileID(), db.opt.Dir, db.opt.TableBuilderOptions.WriteBufferSize)
+	return newBlobFileBuilder(db.blobManger.allocFileID(), db.opt.ValueDir, db.opt.TableBuilderOptions.WriteBufferSize,
+		db.keyRegistry.LatestDataKey())
 }
 
 type flushTask struct {
@@ -928,41 +1353,10 @@ func (db *DB) runFlushMemTable(c *y.Closer) error {
 				LogOffset: ft.off.offset,
 			}
 			// Store badger head even if vptr is zero, need it for readTs
-			log.Info("flush memtable storing offset", zap.Uint32("fid", ft.off.fid), zap.Uint32("offset", ft.off.offset))
+			db.opt.Logger.Info("flush memtable storing offset", zap.Uint32("fid", ft.off.fid), zap.Uint32("offset", ft.off.offset))
 		}
 
-		fileID := ft.mt.ID()
-		filename := sstable.NewFilename(fileID, db.opt.Dir)
-		fd, err := directio.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
-		if err != nil {
-			log.Error("error while writing to level 0", zap.Error(err))
-			return y.Wrap(err)
-		}
-
-		// Don't block just to sync the directory entry.
-		dirSyncCh := make(chan error)
-		go func() { dirSyncCh <- syncDir(db.opt.Dir) }()
-
-		err = db.writeLevel0Table(ft.mt, fd)
-		dirSyncErr := <-dirSyncCh
-		if err != nil {
-			log.Error("error while writing to level 0", zap.Error(err))
-			return err
-		}
-		if dirSyncErr != nil {
-			log.Error("error while syncing level directory", zap.Error(dirSyncErr))
-			return err
-		}
-		atomic.StoreUint32(&db.syncedFid, ft.off.fid)
-		fd.Close()
-		tbl, err := sstable.OpenTable(filename, db.blockCache, db.indexCache)
-		if err != nil {
-			log.Info("error while opening table", zap.Error(err))
-			return err
-		}
-		err = db.lc.addLevel0Table(tbl, headInfo)
-		if err != nil {
-			log.Error("error while syncing level directory", zap.Error(err))
+		if err := db.flushToLevel0(ft, headInfo); err != nil {
 			return err
 		}
 		mTbls := db.mtbls.Load().(*memTables)
@@ -980,6 +1374,65 @@ func (db *DB) runFlushMemTable(c *y.Closer) error {
 	return nil
 }
 
+// flushSyncDir syncs the directory of a flushed table, tests replace it to inject failures.
+var flushSyncDir = syncDir
+
+// flushToLevel0 writes the memtable of the flush task into a level 0 table, the CompactionListener
+// is notified of the flush.
+func (db *DB) flushToLevel0(ft *flushTask, headInfo *protos.HeadInfo) (err error) {
+	timeStart := time.Now()
+	fileID := ft.mt.ID()
+	var tbl table.Table
+	if listener := db.opt.CompactionListener; listener != nil {
+		info := &options.FlushJobInfo{TableID: fileID}
+		listener.OnFlushBegin(info)
+		defer func() {
+			if err == nil {
+				info.BytesWritten = tbl.Size()
+			}
+			info.Duration = time.Since(timeStart)
+			info.Err = err
+			listener.OnFlushCompleted(info)
+		}()
+	}
+
+	filename := sstable.NewFilename(fileID, db.opt.Dir)
+	fd, err := directio.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		db.opt.Logger.Error("error while writing to level 0", zap.Error(err))
+		return y.Wrap(err)
+	}
+
+	// Don't block just to sync the directory entry.
+	dirSyncCh := make(chan error)
+	go func() { dirSyncCh <- flushSyncDir(db.opt.Dir) }()
+
+	err = db.writeLevel0Table(ft.mt, fd)
+	dirSyncErr := <-dirSyncCh
+	if err != nil {
+		db.opt.Logger.Error("error while writing to level 0", zap.Error(err))
+		return err
+	}
+	if dirSyncErr != nil {
+		db.opt.Logger.Error("error while syncing level directory", zap.Error(dirSyncErr))
+		fd.Close()
+		return dirSyncErr
+	}
+	atomic.StoreUint32(&db.syncedFid, ft.off.fid)
+	fd.Close()
+	tbl, err = db.openTable(filename)
+	if err != nil {
+		db.opt.Logger.Info("error while opening table", zap.Error(err))
+		return err
+	}
+	err = db.lc.addLevel0Table(tbl, headInfo)
+	if err != nil {
+		db.opt.Logger.Error("error while syncing level directory", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
 func exists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -991,36 +1444,9 @@ func exists(path string) (bool, error) {
 	return true, err
 }
 
-// This function does a filewalk, calculates the size of vlog and sst files and stores it in
-// y.LSMSize and y.VlogSize.
+// calculateSize updates the size metrics of the lsm and value log files.
 func (db *DB) calculateSize() {
-	totalSize := func(dir string) (int64, int64) {
-		var lsmSize, vlogSize int64
-		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			ext := filepath.Ext(path)
-			if ext == ".sst" {
-				lsmSize += info.Size()
-			} else if ext == ".vlog" {
-				vlogSize += info.Size()
-			}
-			return nil
-		})
-		if err != nil {
-			log.Info("error while calculating total size of directory", zap.String("path", dir))
-		}
-		return lsmSize, vlogSize
-	}
-
-	lsmSize, vlogSize := totalSize(db.opt.Dir)
-	// If valueDir is different from dir, we'd have to do another walk.
-	if db.opt.ValueDir != db.opt.Dir {
-		_, vlogSize = totalSize(db.opt.ValueDir)
-	}
-	atomic.StoreInt64(&db.lsmSize, lsmSize)
-	atomic.StoreInt64(&db.vlogSize, vlogSize)
+	lsmSize, vlogSize := db.Size()
 	db.metrics.LSMSize.Set(float64(lsmSize))
 	db.metrics.VlogSize.Set(float64(vlogSize))
 }
@@ -1042,22 +1468,63 @@ func (db *DB) updateSize(c *y.Closer) {
 }
 
 // Size returns the size of lsm and value log files in bytes. It can be used to decide how often to
-// call RunValueLogGC.
+// call RunValueLogGC. The sizes are computed from the live tables, value log files and blob files,
+// the obsolete files waiting to be deleted are excluded. The blob files are counted in the value
+// log size.
 func (db *DB) Size() (lsm int64, vlog int64) {
-	return atomic.LoadInt64(&db.lsmSize), atomic.LoadInt64(&db.vlogSize)
+	return db.lc.size(), db.vlog.size() + db.blobManger.size()
 }
 
+// Levels returns the info of every level from level 0 to the bottom level.
+func (db *DB) Levels() []LevelInfo {
+	return db.lc.getLevelInfo()
+}
+
+// Tables returns the info of all the tables ordered by level and ID.
 func (db *DB) Tables() []TableInfo {
 	return db.lc.getTableInfo()
 }
 
+// SuRFStats returns the size of the SuRF indexes in every level, the index of every table is loaded.
+func (db *DB) SuRFStats() ([]LevelSuRFStats, error) {
+	return db.lc.getSuRFStats()
+}
+
+// KeySplits returns the sorted keys which split the data with the prefix into ranges of about
+// targetSize bytes, the first range starts at the prefix and the last one ends after the data. The
+// sizes are estimated from the table boundaries and the block index in the same way as the lsm
+// size of DB.Size, the memtables are not counted. It returns nil if the data is smaller than
+// targetSize.
+func (db *DB) KeySplits(prefix []byte, targetSize int64) [][]byte {
+	return db.lc.keySplits(prefix, targetSize)
+}
+
+// EstimateRange estimates the size and the number of keys of the data in [start, end) from the
+// block index of the tables without reading the data blocks, a nil end means the range has no upper
+// bound. The size is in the same unit as the
+// lsm size of DB.Size, the keys count the distinct keys of every level so a key may be counted
+// more than once. The memtables are not counted.
+func (db *DB) EstimateRange(start, end []byte) (size, keys uint64) {
+	return db.lc.estimateRange(start, end)
+}
+
 func (db *DB) GetVLogOffset() uint64 {
 	return db.vlog.getMaxPtr()
 }
 
+// MaxCommitTs returns the largest commit ts recovered from the manifest and the value log on open,
+// or committed since then. The commits of a managed DB don't update it.
+func (db *DB) MaxCommitTs() uint64 {
+	return atomic.LoadUint64(&db.orc.curRead)
+}
+
 // IterateVLog iterates VLog for external replay, this function should be called only when there is no
 // concurrent write operation on the DB.
+// Nothing is iterated if DisableValueLog is set.
 func (db *DB) IterateVLog(offset uint64, fn func(e Entry)) error {
+	if len(db.vlog.files) == 0 {
+		return nil
+	}
 	startFid := uint32(offset >> 32)
 	vOffset := uint32(offset)
 	for fid := startFid; fid <= db.vlog.maxFid(); fid++ {
@@ -1074,7 +1541,7 @@ func (db *DB) IterateVLog(offset uint64, fn func(e Entry)) error {
 			}
 			return nil
 		})
-		if err != nil {
+		if err != nil && err != errTruncate {
 			return err
 		}
 		if fid == db.vlog.maxFid() {
@@ -1091,6 +1558,23 @@ func (db *DB) getCompactSafeTs() uint64 {
 	return atomic.LoadUint64(&db.safeTsTracker.safeTs)
 }
 
+// SetDiscardTs sets the ts at or before which the compactions drop all but the newest version of a
+// key, the newest version is dropped too if it is a delete marker and the key doesn't exist in the
+// lower levels. The versions are dropped when the tables are compacted, CompactRange can be used to
+// drop them sooner.
+//
+// If the DB is managed, it is the same as UpdateSafeTs. Otherwise the versions older than the read
+// ts of every running transaction are dropped by default, SetDiscardTs bounds it to ts, so the
+// versions visible at ts are retained for DB.NewTransactionAt. It should be called right after the
+// DB is opened, the versions already dropped are not restored if ts is lowered.
+func (db *DB) SetDiscardTs(ts uint64) {
+	if db.IsManaged() {
+		db.UpdateSafeTs(ts)
+		return
+	}
+	atomic.StoreUint64(&db.safeTsTracker.discardTs, ts)
+}
+
 // UpdateSafeTs is used for Managed DB, during compaction old version smaller than the safe ts will be discarded.
 // If this is not called, all old versions are kept.
 func (db *DB) UpdateSafeTs(ts uint64) {
@@ -1112,26 +1596,62 @@ func (db *DB) IsManaged() bool {
 
 type safeTsTracker struct {
 	safeTs uint64
+	// discardTs bounds the safe ts of the DB which is not managed, it is set by DB.SetDiscardTs.
+	discardTs uint64
 
 	maxInactive uint64
 	minActive   uint64
+
+	// numActive and oldestStart describe the active guards of the inspection in progress.
+	numActive   int
+	oldestStart time.Time
+	// stats are the stats of the active guards of the last inspection.
+	stats activeTxnStats
+
+	// mu is held while the guards are inspected.
+	mu sync.Mutex
+}
+
+// guardPayload is the payload of the guards of the transactions and the snapshots of the DB which
+// is not managed, it is inspected by safeTsTracker.
+type guardPayload struct {
+	readTs    uint64
+	startTime time.Time
+}
+
+func newGuardPayload(readTs uint64) guardPayload {
+	return guardPayload{readTs: readTs, startTime: time.Now()}
+}
+
+type activeTxnStats struct {
+	num          int
+	oldestReadTs uint64
+	oldestStart  time.Time
 }
 
 func (t *safeTsTracker) Begin() {
+	t.mu.Lock()
 	// t.maxInactive = 0
 	t.minActive = math.MaxUint64
+	t.numActive = 0
+	t.oldestStart = time.Time{}
 }
 
 func (t *safeTsTracker) Inspect(payload interface{}, isActive bool) {
-	ts, ok := payload.(uint64)
+	p, ok := payload.(guardPayload)
 	if !ok {
 		return
 	}
+	ts := p.readTs
 
 	if isActive {
 		if ts < t.minActive {
 			t.minActive = ts
 		}
+		t.numActive++
+		if t.oldestStart.IsZero() || p.startTime.Before(t.oldestStart) {
+			t.oldestStart = p.startTime
+		}
 	} else {
 		if ts > t.maxInactive {
 			t.maxInactive = ts
@@ -1146,8 +1666,22 @@ func (t *safeTsTracker) End() {
 	} else {
 		safe = t.minActive - 1
 	}
+	if discardTs := atomic.LoadUint64(&t.discardTs); safe > discardTs {
+		safe = discardTs
+	}
 
 	if safe > atomic.LoadUint64(&t.safeTs) {
 		atomic.StoreUint64(&t.safeTs, safe)
 	}
+	t.stats = activeTxnStats{num: t.numActive, oldestStart: t.oldestStart}
+	if t.numActive > 0 {
+		t.stats.oldestReadTs = t.minActive
+	}
+	t.mu.Unlock()
+}
+
+func (t *safeTsTracker) lastStats() activeTxnStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
 }
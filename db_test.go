@@ -18,6 +18,7 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -29,13 +30,19 @@ import (
 	"regexp"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/table/sstable"
 	"github.com/pingcap/badger/y"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/time/rate"
 )
 
 var mmap = flag.Bool("vlog_mmap", true, "Specify if value log must be memory-mapped")
@@ -370,7 +377,7 @@ func TestGetMore(t *testing.T) {
 			got := string(getItemValue(t, item))
 			if expectedValue != got {
 
-				vs := db.get(y.KeyWithTs(k, math.MaxUint64))
+				vs := db.get(context.Background(), y.KeyWithTs(k, math.MaxUint64))
 				fmt.Printf("wanted=%q Item: %s\n", k, item)
 				fmt.Printf("on re-run, got version: %+v\n", vs)
 
@@ -558,6 +565,52 @@ func TestIterate2Basic(t *testing.T) {
 	})
 }
 
+func TestIteratePrefix(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for _, prefix := range []string{"a", "b", "b\xff", "c"} {
+			for i := 0; i < 1000; i++ {
+				txnSet(t, db, []byte(fmt.Sprintf("%s%04d", prefix, i)), []byte("val"), 0)
+			}
+		}
+
+		count := func(prefix string, reverse bool) (n int) {
+			txn := db.NewTransaction(false)
+			defer txn.Discard()
+			it := txn.NewIterator(IteratorOptions{Prefix: []byte(prefix), Reverse: reverse})
+			defer it.Close()
+			var last []byte
+			for it.Rewind(); it.Valid(); it.Next() {
+				key := it.Item().KeyCopy(nil)
+				require.True(t, bytes.HasPrefix(key, []byte(prefix)))
+				if last != nil {
+					require.Equal(t, reverse, bytes.Compare(key, last) < 0)
+				}
+				last = key
+				n++
+			}
+			return
+		}
+		for _, reverse := range []bool{false, true} {
+			require.Equal(t, 1000, count("a", reverse))
+			require.Equal(t, 2000, count("b", reverse))
+			require.Equal(t, 1000, count("b\xff", reverse))
+			require.Equal(t, 100, count("c00", reverse))
+			require.Equal(t, 0, count("d", reverse))
+		}
+	})
+}
+
+func TestIteratorOptionsPrefix(t *testing.T) {
+	require.Equal(t, []byte("ac"), prefixEnd([]byte("ab")))
+	require.Equal(t, []byte("b"), prefixEnd([]byte("a\xff\xff")))
+	require.Nil(t, prefixEnd([]byte("\xff")))
+
+	opts := IteratorOptions{Prefix: []byte("key"), StartKey: y.KeyWithTs([]byte("key1"), 0)}
+	opts.narrowToPrefix()
+	require.Equal(t, "key1", string(opts.StartKey.UserKey))
+	require.Equal(t, "kez", string(opts.EndKey.UserKey))
+}
+
 func TestLoad(t *testing.T) {
 	testLoad := func(t *testing.T, opt Options) {
 		dir, err := ioutil.TempDir("", "badger-test")
@@ -1222,6 +1275,156 @@ func TestCompactionFilter(t *testing.T) {
 	// require.True(t, dropAppearOldCount > 0)
 }
 
+type rewriteFilter struct{}
+
+func (f *rewriteFilter) Filter(key, val, userMeta []byte) Decision {
+	return DecisionKeep
+}
+
+func (f *rewriteFilter) Guards() []Guard { return nil }
+
+func (f *rewriteFilter) Rewrite(key, val, userMeta []byte) []byte {
+	if bytes.Equal(userMeta, []byte{1}) {
+		return append([]byte("rewritten-"), val...)
+	}
+	return nil
+}
+
+func TestCompactionValueRewriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.ValueThreshold = 64
+	opts.CompactionFilterFactory = func(targetLevel int, smallest, biggest []byte) CompactionFilter {
+		return &rewriteFilter{}
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	n := 100
+	err = db.Update(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			if err := txn.SetWithMetaSlice(key, key, []byte{byte(i % 2)}); err != nil {
+				return err
+			}
+		}
+		// The values in the blob files are not rewritten.
+		return txn.SetWithMetaSlice([]byte("key999"), bytes.Repeat([]byte("b"), 128), []byte{1})
+	})
+	require.NoError(t, err)
+	db.flushMemTable().Wait()
+	// Only the versions below the safe ts are filtered.
+	var version uint64
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("key000"))
+		if err == nil {
+			version = item.Version()
+		}
+		return err
+	}))
+	for db.getCompactSafeTs() < version {
+		db.View(func(txn *Txn) error { return nil })
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, db.CompactRange([]byte("key000"), []byte("key999"), CompactRangeOptions{}))
+
+	err = db.View(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			item, err := txn.Get(key)
+			require.NoError(t, err)
+			expected := string(key)
+			if i%2 == 1 {
+				expected = "rewritten-" + expected
+			}
+			require.Equal(t, expected, string(getItemValue(t, item)))
+		}
+		item, err := txn.Get([]byte("key999"))
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat([]byte("b"), 128), getItemValue(t, item))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestEntryTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer func() { db.Close() }()
+
+	expired := &Entry{Key: y.KeyWithTs([]byte("expired"), 0), Value: []byte("v1"), ExpiresAt: 1}
+	live := (&Entry{Key: y.KeyWithTs([]byte("live"), 0), Value: []byte("v2")}).WithTTL(time.Hour)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.SetEntry(expired))
+		require.NoError(t, txn.SetEntry(live))
+		_, err := txn.Get([]byte("expired"))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+
+	check := func() {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("expired"))
+			require.Equal(t, ErrKeyNotFound, err)
+			item, err := txn.Get([]byte("live"))
+			require.NoError(t, err)
+			require.Equal(t, live.ExpiresAt, item.ExpiresAt())
+			require.False(t, item.IsDeleted())
+
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			var keys []string
+			for it.Rewind(); it.Valid(); it.Next() {
+				keys = append(keys, string(it.Item().Key()))
+			}
+			require.Equal(t, []string{"live"}, keys)
+			return nil
+		}))
+	}
+	check()
+
+	// The expired entry is dropped by compaction.
+	db.flushMemTable().Wait()
+	var version uint64
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("live"))
+		if err == nil {
+			version = item.Version()
+		}
+		return err
+	}))
+	for db.getCompactSafeTs() < version {
+		db.View(func(txn *Txn) error { return nil })
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, db.CompactRange([]byte("a"), []byte("z"), CompactRangeOptions{BottomLevel: true}))
+	require.NoError(t, db.View(func(txn *Txn) error {
+		opt := DefaultIteratorOptions
+		opt.AllVersions = true
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.Equal(t, "live", string(it.Item().Key()))
+		}
+		return nil
+	}))
+	check()
+
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	check()
+}
+
 func (f *testFilter) Guards() []Guard {
 	return []Guard{
 		{
@@ -1437,7 +1640,7 @@ func TestIngestSimple(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	cnt, err := db.IngestExternalFiles([]ExternalTableSpec{{f.Name()}})
+	cnt, err := db.IngestExternalFiles([]ExternalTableSpec{{f.Name()}}, IngestOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, cnt)
 
@@ -1451,6 +1654,44 @@ func TestIngestSimple(t *testing.T) {
 	}
 }
 
+func TestIngestCopyAndMove(t *testing.T) {
+	var ingestKeys [][]byte
+	for i := 0; i < 1000; i++ {
+		ingestKeys = append(ingestKeys, []byte(fmt.Sprintf("key%04d", i)))
+	}
+	f := buildSst(t, ingestKeys, ingestKeys)
+	defer os.Remove(f.Name())
+
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+
+	cnt, err := db.IngestExternalFiles([]ExternalTableSpec{{f.Name()}}, IngestOptions{CopyFiles: true, MoveFiles: true})
+	require.NoError(t, err)
+	require.Equal(t, 1, cnt)
+	_, err = os.Stat(f.Name())
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(sstable.IndexFilename(f.Name()))
+	require.True(t, os.IsNotExist(err))
+
+	txn := db.NewTransaction(false)
+	defer txn.Discard()
+	for _, k := range ingestKeys {
+		item, err := txn.Get(k)
+		require.NoError(t, err)
+		v, err := item.Value()
+		require.NoError(t, err)
+		require.Equal(t, k, v)
+	}
+
+	// The external file has been moved into the DB.
+	_, err = db.IngestExternalFiles([]ExternalTableSpec{{f.Name()}}, IngestOptions{CopyFiles: true})
+	require.Error(t, err)
+}
+
 func TestIngestOverwrite(t *testing.T) {
 	var ingestKeys, ingestVals [][]byte
 	for i := 0; i < 1000; i++ {
@@ -1484,7 +1725,7 @@ func TestIngestOverwrite(t *testing.T) {
 		require.NoError(t, err)
 	}
 
-	cnt, err := db.IngestExternalFiles([]ExternalTableSpec{{f.Name()}})
+	cnt, err := db.IngestExternalFiles([]ExternalTableSpec{{f.Name()}}, IngestOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 1, cnt)
 
@@ -1555,7 +1796,7 @@ func TestIngestWhileWrite(t *testing.T) {
 			Filename: files[i].Name(),
 		}
 	}
-	cnt, err := db.IngestExternalFiles(specs)
+	cnt, err := db.IngestExternalFiles(specs, IngestOptions{})
 	require.NoError(t, err)
 	require.Equal(t, len(files), cnt)
 	close(stop)
@@ -1641,7 +1882,7 @@ func TestIngestSplit(t *testing.T) {
 			Filename: files[i].Name(),
 		}
 	}
-	cnt, err := db.IngestExternalFiles(specs)
+	cnt, err := db.IngestExternalFiles(specs, IngestOptions{})
 	require.NoError(t, err)
 	require.Equal(t, 3, cnt)
 
@@ -1679,7 +1920,7 @@ func TestDeleteRange(t *testing.T) {
 		require.NoError(t, txn.Commit())
 		require.NoError(t, db.validate())
 
-		db.DeleteFilesInRange(data(0), data(n/2))
+		require.NoError(t, db.DeleteFilesInRange(data(0), data(n/2)))
 
 		// wait for compaction.
 		time.Sleep(2 * time.Second)
@@ -1696,6 +1937,167 @@ func TestDeleteRange(t *testing.T) {
 	})
 }
 
+func TestDeleteFilesInRangeReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.CompactL0WhenClose = false
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 100; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("%s%03d", prefix, i)), []byte("v"), 0)
+		}
+		db.flushMemTable().Wait()
+	}
+	require.Len(t, db.Tables(), 3)
+	l0Size := db.Levels()[0].Size
+
+	require.NoError(t, db.DeleteFilesInRange([]byte("b"), []byte("c")))
+	require.Len(t, db.Tables(), 2)
+	l0 := db.Levels()[0]
+	require.Equal(t, 2, l0.NumTables)
+	require.True(t, l0.Size > 0 && l0.Size < l0Size)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Len(t, db.Tables(), 2)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte("b050"))
+		require.Equal(t, ErrKeyNotFound, err)
+		_, err = txn.Get([]byte("a050"))
+		require.NoError(t, err)
+		_, err = txn.Get([]byte("c050"))
+		require.NoError(t, err)
+		return nil
+	}))
+}
+
+func TestReplaceRange(t *testing.T) {
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%04d", i))
+	}
+	var ingestKeys, ingestVals [][]byte
+	for i := 1000; i < 2000; i += 2 {
+		ingestKeys = append(ingestKeys, key(i))
+		ingestVals = append(ingestVals, []byte("new"))
+	}
+	f := buildSst(t, ingestKeys, ingestVals)
+	defer os.Remove(f.Name())
+	outOfRange := buildSst(t, [][]byte{key(999), key(1000)}, [][]byte{[]byte("new"), []byte("new")})
+	defer os.Remove(outOfRange.Name())
+
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	write := func(start, end, step int, val string) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := start; i < end; i += step {
+				require.NoError(t, txn.Set(key(i), []byte(val)))
+			}
+			return nil
+		}))
+	}
+	// The range has data in the bottom level, in level 0 and in the memtable.
+	write(0, 3000, 1, "old")
+	db.flushMemTable().Wait()
+	require.NoError(t, db.CompactRange(key(0), key(3000), CompactRangeOptions{BottomLevel: true}))
+	write(0, 3000, 3, "mid")
+	db.flushMemTable().Wait()
+	write(1500, 1510, 1, "mid")
+
+	_, err = db.ReplaceRange(key(1000), key(2000), []ExternalTableSpec{{outOfRange.Name()}}, IngestOptions{})
+	require.Equal(t, ErrExternalTableOutOfRange, err)
+	cnt, err := db.ReplaceRange(key(1000), key(2000), []ExternalTableSpec{{f.Name()}}, IngestOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, cnt)
+
+	validate := func() {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 3000; i++ {
+				item, err := txn.Get(key(i))
+				if i >= 1000 && i < 2000 && i%2 == 1 {
+					require.Equal(t, ErrKeyNotFound, err, "%d", i)
+					continue
+				}
+				require.NoError(t, err, "%d", i)
+				expected := "old"
+				if i >= 1000 && i < 2000 {
+					expected = "new"
+				} else if i%3 == 0 {
+					expected = "mid"
+				}
+				require.Equal(t, expected, string(getItemValue(t, item)), "%d", i)
+			}
+			return nil
+		}))
+	}
+	validate()
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	validate()
+}
+
+func TestDropAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueLogFileSize = 1 << 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	data := func(i int) []byte {
+		return []byte(fmt.Sprintf("%06d", i))
+	}
+	n := 20000
+	txn := db.NewTransaction(true)
+	for i := 0; i < n; i++ {
+		require.NoError(t, txn.Set(data(i), make([]byte, 128)))
+	}
+	require.NoError(t, txn.Commit())
+	db.flushMemTable().Wait()
+	txnSet(t, db, data(n), make([]byte, 128), 0)
+
+	require.NotZero(t, atomic.LoadInt64(&db.vlog.sealedSize))
+	require.NoError(t, db.DropAll())
+	for _, info := range db.Tables() {
+		t.Fatalf("table %d is not dropped", info.ID)
+	}
+	require.Zero(t, atomic.LoadInt64(&db.vlog.sealedSize))
+	txnSet(t, db, data(n+1), []byte("new"), 0)
+	check := func() {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i <= n; i++ {
+				_, err := txn.Get(data(i))
+				require.Equal(t, ErrKeyNotFound, err)
+			}
+			item, err := txn.Get(data(n + 1))
+			require.NoError(t, err)
+			require.Equal(t, []byte("new"), getItemValue(t, item))
+			return nil
+		}))
+	}
+	check()
+
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	check()
+}
+
 func ExampleOpen() {
 	dir, err := ioutil.TempDir("", "badger")
 	if err != nil {
@@ -1865,3 +2267,943 @@ func TestRemoteCompaction(t *testing.T) {
 		return nil
 	})
 }
+
+func TestCompactRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.NumLevelZeroTables = 10
+	opts.NumLevelZeroTablesStall = 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	n := 100
+	for round := 0; round < 2; round++ {
+		err = db.Update(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprintf("key%03d", i))
+				if err := txn.Set(key, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		db.flushMemTable().Wait()
+	}
+	checkLevels := func(level int) {
+		tables := db.Tables()
+		require.NotEmpty(t, tables)
+		for _, tbl := range tables {
+			require.Equal(t, level, tbl.Level)
+		}
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			item, err := txn.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, key, getItemValue(t, item))
+		}
+	}
+	checkLevels(0)
+
+	// Without BottomLevel, the range is compacted down to level 1 as no lower level has data.
+	require.NoError(t, db.CompactRange([]byte("key000"), []byte("key999"), CompactRangeOptions{}))
+	checkLevels(1)
+
+	require.NoError(t, db.CompactRange([]byte("key000"), []byte("key999"), CompactRangeOptions{BottomLevel: true}))
+	checkLevels(opts.TableBuilderOptions.MaxLevels - 1)
+
+	// A range without any table is a no-op.
+	require.NoError(t, db.CompactRange([]byte("x"), []byte("z"), CompactRangeOptions{BottomLevel: true}))
+	checkLevels(opts.TableBuilderOptions.MaxLevels - 1)
+}
+
+func TestCompactRangeWaitsForCompactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%03d", i)), []byte("value"), 0)
+	}
+	db.flushMemTable().Wait()
+
+	// A running compaction conflicting with the range holds the manual compaction until it finishes.
+	require.True(t, db.lc.cstatus.addToAllLevels(infRange))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- db.CompactRange([]byte("key000"), []byte("key999"), CompactRangeOptions{})
+	}()
+	select {
+	case err = <-errCh:
+		t.Fatalf("CompactRange returned %v before the conflicting compaction finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	db.lc.cstatus.removeFromAllLevels(infRange)
+	require.NoError(t, <-errCh)
+	for _, tbl := range db.Tables() {
+		require.Equal(t, 1, tbl.Level)
+	}
+
+	// The waiting manual compaction returns when the compactors are closed.
+	compactors := db.closers.compactors
+	db.closers.compactors = y.NewCloser(0)
+	require.True(t, db.lc.cstatus.addToAllLevels(infRange))
+	go func() {
+		errCh <- db.CompactRange([]byte("key000"), []byte("key999"), CompactRangeOptions{BottomLevel: true})
+	}()
+	db.closers.compactors.Signal()
+	require.Equal(t, ErrDBClosed, <-errCh)
+	db.lc.cstatus.removeFromAllLevels(infRange)
+	db.closers.compactors = compactors
+}
+
+func TestFlatten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.TableBuilderOptions.MaxTableSize = 4 << 10
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	n := 1000
+	write := func(round int) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				key := []byte(fmt.Sprintf("key%04d", i))
+				if err := txn.Set(key, []byte(fmt.Sprintf("%d-%d", i, round))); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		db.flushMemTable().Wait()
+	}
+	// The overlapping tables are merged into small tables in level 1.
+	write(0)
+	write(0)
+	require.NoError(t, db.CompactRange([]byte("key"), []byte("key9999"), CompactRangeOptions{}))
+	write(1)
+	levels := db.Levels()
+	require.True(t, levels[0].NumTables > 0)
+	require.True(t, levels[1].NumTables > 1)
+
+	require.NoError(t, db.Flatten(4))
+	bottom := opts.TableBuilderOptions.MaxLevels - 1
+	for _, tbl := range db.Tables() {
+		require.Equal(t, bottom, tbl.Level)
+	}
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%04d", i)))
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("%d-1", i), string(getItemValue(t, item)))
+		}
+		return nil
+	}))
+}
+
+func TestKeySplits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.TableBuilderOptions.BlockSize = 4 << 10
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	n := 5000
+	for _, prefix := range []string{"a", "b"} {
+		for i := 0; i < n; i += 500 {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for j := i; j < i+500; j++ {
+					val := make([]byte, 100)
+					rand.Read(val)
+					if err := txn.Set([]byte(fmt.Sprintf("%s%05d", prefix, j)), val); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+	}
+	db.flushMemTable().Wait()
+	lsmSize, _ := db.Size()
+	require.True(t, lsmSize > 0)
+
+	splits := db.KeySplits([]byte("a"), lsmSize/8)
+	require.True(t, len(splits) >= 2 && len(splits) <= 5, "%d splits", len(splits))
+	for i, key := range splits {
+		require.True(t, bytes.HasPrefix(key, []byte("a")))
+		if i > 0 {
+			require.True(t, bytes.Compare(splits[i-1], key) < 0)
+		}
+	}
+	require.True(t, len(db.KeySplits(nil, lsmSize/8)) > len(splits))
+	require.Nil(t, db.KeySplits([]byte("a"), lsmSize))
+	require.Nil(t, db.KeySplits([]byte("c"), 1))
+}
+
+func TestEstimateRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.TableBuilderOptions.BlockSize = 1 << 10
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	sw := db.NewStreamWriter()
+	require.NoError(t, sw.Prepare())
+	n := 10000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		require.NoError(t, sw.Write([]*Entry{{Key: y.KeyWithTs(key, 1), Value: key}}))
+	}
+	require.NoError(t, sw.Flush())
+	lsmSize, _ := db.Size()
+
+	// The sizes of the blocks are rounded down when they are scaled to the file size.
+	size, keys := db.EstimateRange(nil, nil)
+	require.InDelta(t, lsmSize, size, float64(lsmSize)/100)
+	require.Equal(t, uint64(n), keys)
+
+	size, keys = db.EstimateRange([]byte("key02500"), []byte("key07500"))
+	require.InDelta(t, lsmSize/2, size, float64(lsmSize)/10)
+	require.InDelta(t, n/2, keys, float64(n)/10)
+
+	size, keys = db.EstimateRange([]byte("x"), nil)
+	require.Zero(t, size)
+	require.Zero(t, keys)
+}
+
+func TestSuRFStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.TableBuilderOptions.SuRFStartLevel = opts.TableBuilderOptions.MaxLevels - 1
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	sw := db.NewStreamWriter()
+	require.NoError(t, sw.Prepare())
+	n := 5000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		require.NoError(t, sw.Write([]*Entry{{Key: y.KeyWithTs(key, 1), Value: key}}))
+	}
+	require.NoError(t, sw.Flush())
+
+	stats, err := db.SuRFStats()
+	require.NoError(t, err)
+	require.Len(t, stats, opts.TableBuilderOptions.MaxLevels)
+	bottom := stats[len(stats)-1]
+	require.Equal(t, len(db.Tables()), bottom.NumTables)
+	require.Equal(t, n, bottom.NumKeys)
+	require.True(t, bottom.MarshalSize > 0)
+	require.True(t, bottom.MemSize > 0)
+	for _, s := range stats[:len(stats)-1] {
+		require.Equal(t, 0, s.NumTables)
+	}
+}
+
+func TestIndexCacheWithoutBlockCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.MaxBlockCacheSize = 0
+	opts.MaxIndexCacheSize = 1 << 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Nil(t, db.blockCache)
+	require.NotNil(t, db.indexCache)
+
+	sw := db.NewStreamWriter()
+	require.NoError(t, sw.Prepare())
+	n := 5000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		require.NoError(t, sw.Write([]*Entry{{Key: y.KeyWithTs(key, 1), Value: key}}))
+	}
+	require.NoError(t, sw.Flush())
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key%05d", i))
+			item, err := txn.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, key, getItemValue(t, item))
+		}
+		return nil
+	}))
+}
+
+func TestLevelRateLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.TableBuilderOptions.BytesPerSecond = 64 << 20
+	opts.TableBuilderOptions.LevelRateLimits = []int{0, -1, 16 << 20}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	limiters := db.lc.limiters
+	require.Len(t, limiters, opts.TableBuilderOptions.MaxLevels)
+	require.NotNil(t, db.limiter)
+	require.True(t, limiters[0] == db.limiter)
+	require.Nil(t, limiters[1])
+	require.Equal(t, rate.Limit(16<<20), limiters[2].Limit())
+	require.True(t, limiters[2].Burst() >= opts.TableBuilderOptions.WriteBufferSize)
+	for _, l := range limiters[3:] {
+		require.True(t, l == db.limiter)
+	}
+
+	for i := 0; i < 1000; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), make([]byte, 256), 0)
+	}
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte("key00500"))
+		return err
+	}))
+}
+
+func TestDynamicLevelSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DynamicLevelSize = true
+	opts.ValueThreshold = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	sw := db.NewStreamWriter()
+	require.NoError(t, sw.Prepare())
+	for i := 0; i < 6000; i++ {
+		val := make([]byte, 256)
+		rand.Read(val)
+		e := &Entry{Key: y.KeyWithTs([]byte(fmt.Sprintf("key%05d", i)), 1), Value: val}
+		require.NoError(t, sw.Write([]*Entry{e}))
+	}
+	require.NoError(t, sw.Flush())
+	db.lc.updateLevelTargets()
+
+	levels := db.lc.levels
+	bottom := len(levels) - 1
+	require.Equal(t, int64(math.MaxInt64), levels[bottom].getMaxTotalSize())
+	bottomSize := levels[bottom].getTotalSize()
+	require.True(t, bottomSize/10 > opts.LevelOneSize)
+	require.Equal(t, bottomSize/10, levels[bottom-1].getMaxTotalSize())
+	for _, l := range levels[1 : bottom-1] {
+		require.Equal(t, opts.LevelOneSize, l.getMaxTotalSize())
+	}
+}
+
+type testCompactionListener struct {
+	sync.Mutex
+	compactions []options.CompactionJobInfo
+	flushes     []options.FlushJobInfo
+	running     int
+}
+
+func (l *testCompactionListener) OnCompactionBegin(info *options.CompactionJobInfo) {
+	l.Lock()
+	defer l.Unlock()
+	l.running++
+}
+
+func (l *testCompactionListener) OnCompactionCompleted(info *options.CompactionJobInfo) {
+	l.Lock()
+	defer l.Unlock()
+	l.running--
+	l.compactions = append(l.compactions, *info)
+}
+
+func (l *testCompactionListener) OnFlushBegin(info *options.FlushJobInfo) {
+	l.Lock()
+	defer l.Unlock()
+	l.running++
+}
+
+func (l *testCompactionListener) OnFlushCompleted(info *options.FlushJobInfo) {
+	l.Lock()
+	defer l.Unlock()
+	l.running--
+	l.flushes = append(l.flushes, *info)
+}
+
+func TestCompactionListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	listener := new(testCompactionListener)
+	opts := getTestOptions(dir)
+	opts.CompactionListener = listener
+	opts.ValueThreshold = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	for i := 0; i < 10000; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), make([]byte, 100), 0)
+	}
+	require.NoError(t, db.Close())
+
+	listener.Lock()
+	defer listener.Unlock()
+	require.Equal(t, 0, listener.running)
+	require.NotEmpty(t, listener.flushes)
+	for _, info := range listener.flushes {
+		require.NoError(t, info.Err)
+		require.True(t, info.BytesWritten > 0)
+		require.True(t, info.Duration > 0)
+	}
+	require.NotEmpty(t, listener.compactions)
+	for _, info := range listener.compactions {
+		require.NoError(t, info.Err)
+		require.NotEmpty(t, info.InputTables)
+		require.True(t, info.Duration > 0)
+		if info.MoveDown {
+			require.Equal(t, info.InputTables, info.OutputTables)
+			require.Zero(t, info.BytesRead)
+		} else {
+			require.True(t, info.BytesRead > 0)
+			require.True(t, info.BytesWritten > 0)
+		}
+	}
+}
+
+func TestFlushDirSyncError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	listener := new(testCompactionListener)
+	opts := getTestOptions(dir)
+	opts.CompactionListener = listener
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	syncErr := fmt.Errorf("injected sync error")
+	flushSyncDir = func(string) error { return syncErr }
+	defer func() { flushSyncDir = syncDir }()
+
+	txnSet(t, db, []byte("key"), []byte("value"), 0)
+	db.flushMemTable()
+	require.Eventually(t, func() bool {
+		listener.Lock()
+		defer listener.Unlock()
+		return len(listener.flushes) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	listener.Lock()
+	require.Equal(t, syncErr, listener.flushes[0].Err)
+	require.Zero(t, listener.flushes[0].BytesWritten)
+	listener.Unlock()
+	require.Empty(t, db.lc.levels[0].tables)
+	require.NoError(t, db.Close())
+}
+
+func TestLevels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 0
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	sw := db.NewStreamWriter()
+	require.NoError(t, sw.Prepare())
+	n := 2000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		require.NoError(t, sw.Write([]*Entry{
+			{Key: y.KeyWithTs(key, 2), Value: make([]byte, 100)},
+			{Key: y.KeyWithTs(key, 1), Value: make([]byte, 100)},
+		}))
+	}
+	require.NoError(t, sw.Flush())
+
+	levels := db.Levels()
+	require.Len(t, levels, opts.TableBuilderOptions.MaxLevels)
+	for i, info := range levels[:len(levels)-1] {
+		require.Equal(t, i, info.Level)
+		require.Zero(t, info.NumTables)
+		require.Zero(t, info.Size)
+		require.Zero(t, info.Score)
+		require.Nil(t, info.Smallest)
+		require.Nil(t, info.Biggest)
+	}
+	bottom := levels[len(levels)-1]
+	require.True(t, bottom.NumTables > 0)
+	require.True(t, bottom.Size > 0)
+	require.Equal(t, float64(bottom.Size)/float64(bottom.TargetSize), bottom.Score)
+	require.Equal(t, []byte("key00000"), bottom.Smallest)
+	require.Equal(t, []byte(fmt.Sprintf("key%05d", n-1)), bottom.Biggest)
+	// Half of the entries are old versions.
+	require.InDelta(t, bottom.Size/2, bottom.StaleSize, float64(bottom.Size)/10)
+}
+
+func TestTablesInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 0
+	opts.TableBuilderOptions.SuRFStartLevel = opts.TableBuilderOptions.MaxLevels - 1
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	sw := db.NewStreamWriter()
+	require.NoError(t, sw.Prepare())
+	n := 3000
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key%05d", i))
+		require.NoError(t, sw.Write([]*Entry{
+			{Key: y.KeyWithTs(key, 2), Value: make([]byte, 100)},
+			{Key: y.KeyWithTs(key, 1), Value: make([]byte, 100)},
+		}))
+	}
+	require.NoError(t, sw.Flush())
+	txnSet(t, db, []byte("key"), []byte("value"), 0)
+	db.flushMemTable().Wait()
+
+	tables := db.Tables()
+	require.True(t, len(tables) > 2)
+	var keyCount uint64
+	for _, info := range tables {
+		require.Equal(t, info.Level >= opts.TableBuilderOptions.SuRFStartLevel, info.HasSuRF)
+		filename := sstable.NewFilename(info.ID, dir)
+		dataStat, err := os.Stat(filename)
+		require.NoError(t, err)
+		indexStat, err := os.Stat(sstable.IndexFilename(filename))
+		require.NoError(t, err)
+		require.Equal(t, dataStat.Size()+indexStat.Size(), info.Size)
+		keyCount += info.KeyCount
+	}
+	require.Equal(t, uint64(n+1), keyCount)
+}
+
+func TestDBSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+
+	lsm, vlog := db.Size()
+	require.Zero(t, lsm)
+	n := 2000
+	for i := 0; i < n; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), make([]byte, 100), 0)
+	}
+	db.flushMemTable().Wait()
+
+	var tablesSize int64
+	for _, info := range db.Tables() {
+		tablesSize += info.Size
+	}
+	lsm, vlog = db.Size()
+	require.True(t, lsm > 0)
+	require.Equal(t, tablesSize, lsm)
+	// The values are written to the value log and the blob files.
+	require.True(t, vlog > int64(2*n*100))
+
+	require.NoError(t, db.DropAll())
+	lsm, _ = db.Size()
+	require.Zero(t, lsm)
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	registry := prometheus.NewRegistry()
+	opts := getTestOptions(dir)
+	opts.MetricsRegistry = registry
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	gather := func() map[string]*dto.MetricFamily {
+		families, err := registry.Gather()
+		require.NoError(t, err)
+		result := make(map[string]*dto.MetricFamily)
+		for _, f := range families {
+			result[f.GetName()] = f
+		}
+		return result
+	}
+	for i := 0; i < 100; i++ {
+		txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), []byte("value"), 0)
+	}
+	db.flushMemTable().Wait()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+			return err
+		}))
+	}
+	families := gather()
+	for _, name := range []string{"badger_num_gets", "badger_num_puts", "badger_write_stall_seconds", "badger_cache_hit_ratio"} {
+		require.Contains(t, families, name)
+	}
+	blockMetrics := db.CacheMetrics().BlockCache
+	require.NotNil(t, blockMetrics)
+	require.True(t, blockMetrics.Hits()+blockMetrics.Misses() > 0)
+
+	// Another DB can share the registry.
+	dir2, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir2)
+	opts2 := getTestOptions(dir2)
+	opts2.MetricsRegistry = registry
+	db2, err := Open(opts2)
+	require.NoError(t, err)
+	// Both DBs have a block cache and an index cache.
+	require.Len(t, gather()["badger_cache_hit_ratio"].GetMetric(), 4)
+	require.NoError(t, db2.Close())
+
+	// The cache gauges are unregistered when the DB is closed.
+	require.Len(t, gather()["badger_cache_hit_ratio"].GetMetric(), 2)
+	require.NoError(t, db.Close())
+	require.NotContains(t, gather(), "badger_cache_hit_ratio")
+}
+
+func TestLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	core, logs := observer.New(zap.DebugLevel)
+	opts := getTestOptions(dir)
+	opts.Logger = zap.New(core)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	txn := db.NewTransaction(true)
+	require.NoError(t, txn.Set([]byte("key"), []byte("value")))
+	require.NoError(t, txn.Commit())
+	db.flushMemTable().Wait()
+	flushLogs := logs.FilterMessage("flushing memtable").All()
+	require.NotEmpty(t, flushLogs)
+	require.Contains(t, flushLogs[0].ContextMap(), "memtable size")
+	require.NoError(t, db.Close())
+
+	// The logs are discarded without a logger.
+	opts.Logger = nil
+	db, err = Open(opts)
+	require.NoError(t, err)
+	n := logs.Len()
+	txn = db.NewTransaction(true)
+	require.NoError(t, txn.Set([]byte("key"), []byte("value")))
+	require.NoError(t, txn.Commit())
+	db.flushMemTable().Wait()
+	require.NoError(t, db.Close())
+	require.Equal(t, n, logs.Len())
+}
+
+func TestCacheMetrics(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		m := db.CacheMetrics()
+		require.Nil(t, m.BlockCache)
+		require.Nil(t, m.IndexCache)
+		require.Nil(t, m.CompressedBlockCache)
+	})
+
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.EnableCacheMetrics = true
+	opts.MaxCompressedBlockCacheSize = 1 << 20
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		for i := 0; i < 100; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), []byte("value"), 0)
+		}
+		db.flushMemTable().Wait()
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.View(func(txn *Txn) error {
+				_, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+				return err
+			}))
+		}
+		m := db.CacheMetrics()
+		require.NotNil(t, m.BlockCache)
+		require.NotNil(t, m.IndexCache)
+		require.True(t, m.BlockCache.Hits()+m.BlockCache.Misses() > 0)
+		require.True(t, m.IndexCache.Hits()+m.IndexCache.Misses() > 0)
+		require.NotNil(t, m.CompressedBlockCache)
+		require.True(t, m.CompressedBlockCache.Misses() > 0)
+	})
+}
+
+func TestCollectWriteReqs(t *testing.T) {
+	opt := DefaultOptions
+	w := &writeWorker{DB: &DB{opt: opt, writeCh: make(chan *request, 10)}}
+	newReqs := func(n int) {
+		for i := 0; i < n; i++ {
+			w.writeCh <- new(request)
+		}
+	}
+
+	// Without the delay only the queued requests are taken.
+	newReqs(5)
+	require.Len(t, w.collectWriteReqs(new(request)), 6)
+	require.Len(t, w.collectWriteReqs(new(request)), 1)
+
+	w.opt.MaxCommitBatchSize = 3
+	newReqs(5)
+	require.Len(t, w.collectWriteReqs(new(request)), 3)
+	require.Len(t, w.collectWriteReqs(new(request)), 3)
+	require.Len(t, w.collectWriteReqs(new(request)), 2)
+
+	// The batch is closed once it is full.
+	w.opt.MaxCommitDelay = time.Hour
+	go newReqs(2)
+	require.Len(t, w.collectWriteReqs(new(request)), 3)
+
+	// Or the delay is reached.
+	w.opt.MaxCommitDelay = 10 * time.Millisecond
+	newReqs(1)
+	start := time.Now()
+	require.Len(t, w.collectWriteReqs(new(request)), 2)
+	require.True(t, time.Since(start) >= w.opt.MaxCommitDelay)
+}
+
+func TestMemTableShards(t *testing.T) {
+	testMemTableOptions(t, 4, options.SkipList)
+}
+
+func TestARTMemTable(t *testing.T) {
+	testMemTableOptions(t, 1, options.ART)
+	testMemTableOptions(t, 4, options.ART)
+}
+
+func testMemTableOptions(t *testing.T, numShards int, memTableType options.MemTableType) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.NumMemTableShards = numShards
+	opt.MemTableType = memTableType
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 500; i++ {
+				require.NoError(t, db.Update(func(txn *Txn) error {
+					return txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%d-%d", i, round)))
+				}))
+			}
+		}
+		check := func() {
+			require.NoError(t, db.View(func(txn *Txn) error {
+				it := txn.NewIterator(DefaultIteratorOptions)
+				defer it.Close()
+				var n int
+				for it.Rewind(); it.Valid(); it.Next() {
+					require.Equal(t, fmt.Sprintf("key%03d", n), string(it.Item().Key()))
+					require.Equal(t, fmt.Sprintf("val%d-1", n), string(getItemValue(t, it.Item())))
+					n++
+				}
+				require.Equal(t, 500, n)
+				return nil
+			}))
+		}
+		check()
+		db.flushMemTable().Wait()
+		check()
+	})
+}
+
+// blockingFlushListener blocks the flusher until release is closed.
+type blockingFlushListener struct {
+	testCompactionListener
+	release chan struct{}
+}
+
+func (l *blockingFlushListener) OnFlushBegin(info *options.FlushJobInfo) {
+	<-l.release
+}
+
+func TestWriteStall(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	listener := &blockingFlushListener{release: make(chan struct{})}
+	stalled := make(chan options.WriteStallReason, 1)
+	var mu sync.Mutex
+	var events []bool
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 0
+	opts.MaxMemTableSize = 16 << 10
+	opts.NumMemtables = 1
+	opts.CompactionListener = listener
+	opts.OnWriteStall = func(s bool, reason options.WriteStallReason) {
+		mu.Lock()
+		events = append(events, s)
+		mu.Unlock()
+		if s {
+			select {
+			case stalled <- reason:
+			default:
+			}
+		}
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), make([]byte, 100), 0)
+		}
+	}()
+	// The first memtable is blocked in the flusher and the second one fills the flush channel.
+	require.Equal(t, options.StallByMemTables, <-stalled)
+	close(listener.release)
+	<-done
+	require.NoError(t, db.Close())
+
+	stats := db.WriteStallStats()
+	require.True(t, stats.Counts[options.StallByMemTables] > 0)
+	require.True(t, stats.Durations[options.StallByMemTables] > 0)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 2*int(stats.Counts[options.StallByMemTables]), len(events))
+	for i, s := range events {
+		require.Equal(t, i%2 == 0, s)
+	}
+}
+
+func TestPendingCompactionBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.MaxPendingCompactionBytes = 1
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		lc := db.lc
+		require.Zero(t, lc.pendingCompactionBytes())
+		l := lc.levels[1]
+		maxTotalSize := l.getMaxTotalSize()
+		setTotalSize := func(size int64) {
+			l.Lock()
+			l.totalSize = size
+			l.Unlock()
+		}
+		atomic.StoreInt64(&l.maxTotalSize, 0)
+		setTotalSize(10)
+		require.Equal(t, int64(10), lc.pendingCompactionBytes())
+		kr := keyRange{left: y.KeyWithTs([]byte("a"), math.MaxUint64), right: y.KeyWithTs([]byte("b"), 0)}
+		require.True(t, lc.cstatus.addToLevel(1, kr))
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			setTotalSize(0)
+			// The pending bytes are checked again when a compaction finishes.
+			lc.cstatus.removeFromAllLevels(kr)
+		}()
+		lc.waitPendingCompactions()
+		stats := db.WriteStallStats()
+		require.Equal(t, int64(1), stats.Counts[options.StallByPendingCompactionBytes])
+		require.True(t, stats.Durations[options.StallByPendingCompactionBytes] >= 50*time.Millisecond)
+
+		// The stall ends when the compactors are closed.
+		compactors := db.closers.compactors
+		db.closers.compactors = y.NewCloser(0)
+		setTotalSize(10)
+		db.closers.compactors.Signal()
+		lc.waitPendingCompactions()
+		require.Equal(t, int64(2), db.WriteStallStats().Counts[options.StallByPendingCompactionBytes])
+		db.closers.compactors = compactors
+		setTotalSize(0)
+		atomic.StoreInt64(&l.maxTotalSize, maxTotalSize)
+	})
+}
+
+func TestDisableValueLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	countVlogFiles := func() int {
+		files, err := filepath.Glob(filepath.Join(dir, "*.vlog"))
+		require.NoError(t, err)
+		return len(files)
+	}
+	check := func(db *DB, n int) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("key%05d", i)))
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("val%d", i)), getItemValue(t, item))
+			}
+			return nil
+		}))
+	}
+	write := func(db *DB, start, end int) {
+		for i := start; i < end; i++ {
+			txnSet(t, db, []byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("val%d", i)), 0)
+		}
+	}
+
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	write(db, 0, 100)
+	require.NoError(t, db.Close())
+	require.NotZero(t, countVlogFiles())
+
+	// The value log files are replayed and removed.
+	opts.DisableValueLog = true
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.Zero(t, countVlogFiles())
+	check(db, 100)
+	write(db, 100, 200)
+	require.Zero(t, countVlogFiles())
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	check(db, 200)
+	require.NoError(t, db.Close())
+	require.Zero(t, countVlogFiles())
+
+	opts.DisableValueLog = false
+	db, err = Open(opts)
+	require.NoError(t, err)
+	check(db, 200)
+	require.NoError(t, db.Close())
+
+	opts.DisableValueLog = true
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.DropAll())
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte("key00000"))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+	write(db, 0, 10)
+	check(db, 10)
+	require.NoError(t, db.Close())
+}
@@ -0,0 +1,101 @@
+package badger
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/badger/protos"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/log"
+)
+
+type dropAllTask struct {
+	sync.WaitGroup
+	err error
+}
+
+// DropAll drops all the data stored in the DB while keeping it open. The memtables are discarded,
+// all the tables and blob files are deleted and the value log is truncated.
+// Writes are blocked until DropAll returns, writes issued concurrently with DropAll may or may not
+// be dropped. Iterators and transactions opened before DropAll still see the dropped data.
+func (db *DB) DropAll() error {
+	if db.opt.ReadOnly {
+		return ErrInvalidRequest
+	}
+	task := new(dropAllTask)
+	task.Add(1)
+	db.dropAllCh <- task
+	task.Wait()
+	return task.err
+}
+
+// dropAll runs in the vlog writer, so no write can be applied while the data is dropped.
+func (w *writeWorker) dropAll(task *dropAllTask) {
+	defer task.Done()
+	log.Info("DropAll called, blocking writes")
+
+	// Wait for the requests in the pipeline to be written to the memtable.
+	req := new(request)
+	req.Wg.Add(1)
+	if task.err = w.writeVLog([]*request{req}); task.err != nil {
+		return
+	}
+	if task.err = req.Wait(); task.err != nil {
+		return
+	}
+
+	// The flusher may be stalled by L0, so we wait for the immutable memtables to be flushed
+	// before stopping the compactors.
+	mTbls := w.mtbls.Load().(*memTables)
+	for atomic.LoadUint32(&mTbls.length) > 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.mtbls.Store(newMemTables(<-w.memTableCh, &memTables{}))
+
+	w.closers.compactors.SignalAndWait()
+	w.closers.blobManager.SignalAndWait()
+	defer func() {
+		w.closers.compactors = y.NewCloser(1)
+		w.lc.startCompact(w.closers.compactors)
+		w.blobManger.startGCHandler()
+	}()
+
+	guard := w.resourceMgr.Acquire()
+	defer guard.Done()
+
+	// Switch to a new vlog file, the manifest head is moved to it so the old files are never
+	// replayed after the tables are deleted.
+	var newFid uint32
+	oldFiles := w.vlog.files
+	if !w.opt.DisableValueLog {
+		newFid = w.vlog.maxFid() + 1
+		if task.err = w.vlog.createVlogFile(newFid); task.err != nil {
+			return
+		}
+		oldFiles = w.vlog.files[:len(w.vlog.files)-1]
+	}
+	head := &protos.HeadInfo{
+		Version: w.orc.commitTs(),
+		LogID:   newFid,
+	}
+	if task.err = w.lc.dropAll(head, guard); task.err != nil {
+		return
+	}
+	w.logOff = logOffset{fid: newFid}
+	atomic.StoreUint32(&w.syncedFid, newFid)
+	for _, lf := range oldFiles {
+		if task.err = w.vlog.deleteLogFile(lf); task.err != nil {
+			return
+		}
+	}
+	w.vlog.files = w.vlog.files[len(oldFiles):]
+	// Only the new current file is left.
+	atomic.StoreInt64(&w.vlog.sealedSize, 0)
+	if task.err = syncDir(w.vlog.dirPath); task.err != nil {
+		return
+	}
+
+	task.err = w.blobManger.dropAll(guard)
+	log.Info("DropAll done")
+}
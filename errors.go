@@ -18,6 +18,7 @@ package badger
 
 import (
 	"encoding/hex"
+	"fmt"
 
 	"github.com/pingcap/errors"
 )
@@ -93,10 +94,52 @@ var (
 	// corrupt data to allow Badger to run properly.
 	ErrTruncateNeeded = errors.New("Value log truncate required to run DB. This might result in data loss.")
 
-	// ErrTruncateNeeded is returned when UserMate size exceed 255.
+	// ErrUserMetaTooLarge is returned when the UserMeta of an entry is longer than 255 bytes.
 	ErrUserMetaTooLarge = errors.New("UserMate size exceed 255.")
+
+	// ErrConcurrentTxn is returned when Options.DetectConcurrentUse is set and a transaction is
+	// used by multiple goroutines at the same time.
+	ErrConcurrentTxn = errors.New("Transaction is being used concurrently by another goroutine")
+
+	// ErrConcurrentIterator is returned when Options.DetectConcurrentUse is set and an iterator is
+	// used by multiple goroutines at the same time.
+	ErrConcurrentIterator = errors.New("Iterator is being used concurrently by another goroutine")
+
+	// ErrInvalidEncryptionKey is returned if the length of the encryption key is not 16, 24 or 32.
+	ErrInvalidEncryptionKey = errors.New("Encryption key's length should be either 16, 24, or 32 bytes")
+
+	// ErrEncryptionKeyMismatch is returned when the encryption key doesn't match the key used to
+	// encrypt the DB, or the encrypted DB is opened without the encryption key.
+	ErrEncryptionKeyMismatch = errors.New("Encryption key mismatch")
+
+	// ErrSnapshotClosed is returned if a closed snapshot is used.
+	ErrSnapshotClosed = errors.New("Snapshot has been closed")
+
+	// ErrSubscriberTooSlow is returned by DB.Subscribe and DB.Changefeed if the callback falls too
+	// far behind the commits.
+	ErrSubscriberTooSlow = errors.New("Subscriber is too slow to keep up with the commits")
+
+	// ErrDBClosed is returned by the background requests issued to a closed DB.
+	ErrDBClosed = errors.New("DB has been closed")
+
+	// ErrReadTsTooOld is returned by DB.NewTransactionAt if the versions visible at the read ts
+	// may have been discarded by the compaction.
+	ErrReadTsTooOld = errors.New("Read ts is older than the safe ts of the compaction")
 )
 
+// ValueCorruptionError is returned when the checksum of a value read from a blob file doesn't match
+// the value.
+type ValueCorruptionError struct {
+	// Path is the path of the blob file.
+	Path string
+	// Offset is the offset of the value in the blob file.
+	Offset uint32
+}
+
+func (e *ValueCorruptionError) Error() string {
+	return fmt.Sprintf("checksum mismatch of the value at offset %d in blob file %s", e.Offset, e.Path)
+}
+
 // Key length can't be more than uint16, as determined by table::header.
 const maxKeySize = 1<<16 - 8 // 8 bytes are for storing timestamp
 
@@ -0,0 +1,162 @@
+package badger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+)
+
+// ExportManifestFilename is the name of the file written by DB.ExportRange to describe the tables.
+const ExportManifestFilename = "EXPORT"
+
+const exportManifestRewriteFilename = "EXPORT-REWRITE"
+
+// ExportManifest describes the external tables written by DB.ExportRange.
+type ExportManifest struct {
+	Start []byte `json:"start"`
+	End   []byte `json:"end"`
+	// ReadTs is the read timestamp of the snapshot the tables are exported from.
+	ReadTs uint64 `json:"read_ts"`
+	// Managed is true if the keys keep their versions, the tables must be ingested into a managed
+	// DB. Otherwise the keys are assigned a new version on ingest.
+	Managed bool `json:"managed"`
+	// Files are the names of the tables relative to the export dir, in key order.
+	Files []string `json:"files"`
+	Keys  int      `json:"keys"`
+}
+
+// TableSpecs returns the specs of the exported tables in dir to be passed to IngestExternalFiles.
+func (m *ExportManifest) TableSpecs(dir string) []ExternalTableSpec {
+	specs := make([]ExternalTableSpec, 0, len(m.Files))
+	for _, name := range m.Files {
+		specs = append(specs, ExternalTableSpec{Filename: filepath.Join(dir, name)})
+	}
+	return specs
+}
+
+// ReadExportManifest reads the manifest of the tables exported to dir by DB.ExportRange.
+func ReadExportManifest(dir string) (*ExportManifest, error) {
+	path := filepath.Join(dir, ExportManifestFilename)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := new(ExportManifest)
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, y.Wrapf(err, "failed to parse %s", path)
+	}
+	return m, nil
+}
+
+// ExportRange writes the latest version of the keys in [start, end) of a snapshot to external
+// tables in dir, a nil end means the range has no upper bound. The deleted keys are skipped and the
+// values are read from the value log and the blob files, so the tables don't depend on the files of
+// this DB. The tables are split by MaxTableSize and compressed with the compression of the bottom
+// level. The manifest is written last, so the export is complete if the manifest exists. The tables
+// can be ingested into another DB by passing the TableSpecs of the manifest read by
+// ReadExportManifest to IngestExternalFiles. The dir must not exist, it is removed if the export
+// fails.
+func (db *DB) ExportRange(start, end []byte, dir string) (*ExportManifest, error) {
+	if _, err := os.Stat(dir); err == nil {
+		return nil, errors.Errorf("export dir %s already exists", dir)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	m, err := db.exportRange(start, end, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return m, nil
+}
+
+func (db *DB) exportRange(start, end []byte, dir string) (*ExportManifest, error) {
+	snap := db.NewSnapshot()
+	defer snap.Close()
+	m := &ExportManifest{Start: start, End: end, ReadTs: snap.ReadTs(), Managed: db.IsManaged()}
+
+	compressions := db.opt.TableBuilderOptions.CompressionPerLevel
+	var fileID uint64
+	b := db.NewSplitExternalTableBuilder(func() (*os.File, error) {
+		fileID++
+		return y.OpenSyncedFile(sstable.NewFilename(fileID, dir), false)
+	}, db.opt.TableBuilderOptions.MaxTableSize, compressions[len(compressions)-1], nil)
+	if m.Managed {
+		b.SetIsManaged()
+	}
+
+	opts := DefaultIteratorOptions
+	opts.StartKey = y.KeyWithTs(start, math.MaxUint64)
+	if end != nil {
+		opts.EndKey = y.KeyWithTs(end, math.MaxUint64)
+	}
+	it := snap.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(start); it.Valid(); it.Next() {
+		item := it.Item()
+		if end != nil && bytes.Compare(item.Key(), end) >= 0 {
+			break
+		}
+		val, err := item.Value()
+		if err != nil {
+			return nil, err
+		}
+		var version uint64
+		if m.Managed {
+			version = item.Version()
+		}
+		err = b.Add(y.KeyWithTs(item.Key(), version), y.ValueStruct{Value: val, Meta: item.AppMeta(), UserMeta: item.UserMeta()})
+		if err != nil {
+			return nil, err
+		}
+		m.Keys++
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	results, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+	for _, result := range results {
+		m.Files = append(m.Files, filepath.Base(result.FileName))
+	}
+	return m, writeExportManifest(dir, m)
+}
+
+func writeExportManifest(dir string, m *ExportManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	rewritePath := filepath.Join(dir, exportManifestRewriteFilename)
+	fp, err := y.OpenTruncFile(rewritePath, false)
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(rewritePath, filepath.Join(dir, ExportManifestFilename)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
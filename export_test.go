@@ -0,0 +1,99 @@
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(filepath.Join(dir, "src"))
+	opts.ValueThreshold = 1000
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%05d", i))
+	}
+	val := func(i int) []byte {
+		// Every 10th value is stored out of the LSM tree.
+		if i%10 == 0 {
+			return bytes.Repeat(key(i), 200)
+		}
+		return append([]byte("val"), key(i)...)
+	}
+	for i := 0; i < 5000; i += 100 {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for j := i; j < i+100; j++ {
+				require.NoError(t, txn.SetWithMetaSlice(key(j), []byte("old"), []byte{1}))
+			}
+			return nil
+		}))
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for j := i; j < i+100; j++ {
+				if j%7 == 0 {
+					require.NoError(t, txn.Delete(key(j)))
+				} else {
+					require.NoError(t, txn.SetWithMetaSlice(key(j), val(j), []byte{2}))
+				}
+			}
+			return nil
+		}))
+	}
+
+	exportDir := filepath.Join(dir, "export")
+	m, err := db.ExportRange(key(1000), key(4000), exportDir)
+	require.NoError(t, err)
+	var expected int
+	for i := 1000; i < 4000; i++ {
+		if i%7 != 0 {
+			expected++
+		}
+	}
+	require.Equal(t, expected, m.Keys)
+	require.True(t, len(m.Files) > 1)
+	_, err = db.ExportRange(key(1000), key(4000), exportDir)
+	require.Error(t, err)
+
+	m, err = ReadExportManifest(exportDir)
+	require.NoError(t, err)
+	require.Equal(t, key(1000), m.Start)
+	require.Equal(t, key(4000), m.End)
+	require.False(t, m.Managed)
+
+	dst, err := Open(getTestOptions(filepath.Join(dir, "dst")))
+	require.NoError(t, err)
+	defer dst.Close()
+	cnt, err := dst.IngestExternalFiles(m.TableSpecs(exportDir), IngestOptions{})
+	require.NoError(t, err)
+	require.Equal(t, len(m.Files), cnt)
+
+	require.NoError(t, dst.View(func(txn *Txn) error {
+		var n int
+		i := 1000
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			for i%7 == 0 {
+				i++
+			}
+			item := it.Item()
+			require.Equal(t, key(i), item.Key())
+			require.Equal(t, val(i), getItemValue(t, item))
+			require.Equal(t, []byte{2}, item.UserMeta())
+			i++
+			n++
+		}
+		require.Equal(t, expected, n)
+		return nil
+	}))
+}
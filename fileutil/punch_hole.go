@@ -0,0 +1,19 @@
+package fileutil
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrPunchHoleNotSupported is returned by PunchHole if the platform or the file system doesn't
+// support punching holes.
+var ErrPunchHoleNotSupported = errors.New("punch hole is not supported")
+
+// PunchHole deallocates the space of the range [offset, offset+size) of f without changing the
+// file size, the range reads as zeros afterwards.
+func PunchHole(f *os.File, offset, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	return punchHole(f, offset, size)
+}
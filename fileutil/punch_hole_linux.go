@@ -0,0 +1,17 @@
+// +build linux
+
+package fileutil
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func punchHole(f *os.File, offset, size int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, size)
+	if errno, ok := err.(unix.Errno); ok && errno == unix.EOPNOTSUPP {
+		return ErrPunchHoleNotSupported
+	}
+	return err
+}
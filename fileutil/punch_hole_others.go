@@ -0,0 +1,9 @@
+// +build !linux
+
+package fileutil
+
+import "os"
+
+func punchHole(f *os.File, offset, size int64) error {
+	return ErrPunchHoleNotSupported
+}
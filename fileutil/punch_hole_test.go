@@ -0,0 +1,32 @@
+package fileutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPunchHole(t *testing.T) {
+	f, err := ioutil.TempFile("", "punch_hole")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	data := bytes.Repeat([]byte{1}, 16<<10)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+
+	err = PunchHole(f, 4<<10, 8<<10)
+	if err == ErrPunchHoleNotSupported {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	got, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Len(t, got, len(data))
+	require.Equal(t, data[:4<<10], got[:4<<10])
+	require.Equal(t, make([]byte, 8<<10), got[4<<10:12<<10])
+	require.Equal(t, data[12<<10:], got[12<<10:])
+}
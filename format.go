@@ -0,0 +1,254 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pingcap/badger/y"
+)
+
+const (
+	// FormatFilename is the filename of the file recording the on-disk format of a DB directory.
+	FormatFilename        = "FORMAT"
+	formatRewriteFilename = "FORMAT-REWRITE"
+
+	// The format versions of the table and value log files written by this version of badger.
+	// The manifest format version is magicVersion.
+	tableFormatVersion    = 1
+	valueLogFormatVersion = 1
+
+	// featureBlobChecksum is set when the blob files have the checksums of the values.
+	featureBlobChecksum = "blob-checksum"
+	// featureTableFooter is set when the index files of the tables end with the footer.
+	featureTableFooter = "table-footer"
+	// featureColdStorage is set when the data files of the tables may be offloaded to the cold
+	// storage, leaving empty data files.
+	featureColdStorage = "cold-storage"
+	// featureColumnFamilies is set when the keys of the column families other than the DefaultCF
+	// are written.
+	featureColumnFamilies = "column-families"
+	// featureEncryption is set when the tables, the value log and the blob files are encrypted.
+	featureEncryption = "encryption"
+	// featureKeyRestart is set when the keys in the table blocks are stored after the prefix shared
+	// with the previous key.
+	featureKeyRestart = "key-restart"
+	// featurePartitionedIndex is set when the block indexes of the large tables are split into
+	// partitions.
+	featurePartitionedIndex = "partitioned-index"
+	// featureTTL is set when the entries with an expiry time are written, they have bitExpiresAt
+	// set and the expiry time encoded in the value log and the tables.
+	featureTTL = "ttl"
+	// featureVarintValue is set when the versions and the lengths in the values of the tables are
+	// encoded as varints.
+	featureVarintValue = "varint-value"
+)
+
+// knownFeatures contains the optional on-disk features this version of badger can read.
+var knownFeatures = map[string]struct{}{
+	featureBlobChecksum:     {},
+	featureTableFooter:      {},
+	featureKeyRestart:       {},
+	featureColdStorage:      {},
+	featureColumnFamilies:   {},
+	featureEncryption:       {},
+	featurePartitionedIndex: {},
+	featureTTL:              {},
+	featureVarintValue:      {},
+}
+
+// dbFormat describes the on-disk format of a DB directory and the optional features in use.
+type dbFormat struct {
+	Generation uint64   `json:"generation"`
+	Table      uint32   `json:"table"`
+	ValueLog   uint32   `json:"vlog"`
+	Manifest   uint32   `json:"manifest"`
+	Features   []string `json:"features,omitempty"`
+}
+
+// FormatError is returned by Open when the DB directory was written in a format that is not
+// compatible with this version of badger.
+type FormatError struct {
+	// Component is one of "table", "vlog", "manifest" or "feature".
+	Component string
+	Version   uint32
+	Supported uint32
+	// Feature is the unsupported feature name if Component is "feature".
+	Feature string
+}
+
+func (e *FormatError) Error() string {
+	if e.Component == "feature" {
+		return fmt.Sprintf("DB uses feature %q which is not supported by this version of badger, "+
+			"needs upgrade", e.Feature)
+	}
+	if e.Version > e.Supported {
+		return fmt.Sprintf("%s format version %d is newer than supported version %d, "+
+			"badger needs upgrade to open this DB", e.Component, e.Version, e.Supported)
+	}
+	return fmt.Sprintf("%s format version %d is older than supported version %d, "+
+		"DB needs upgrade or badger needs downgrade to open it", e.Component, e.Version, e.Supported)
+}
+
+func currentFormat(opt Options) dbFormat {
+	return dbFormat{
+		Table:    tableFormatVersion,
+		ValueLog: valueLogFormatVersion,
+		Manifest: magicVersion,
+		Features: enabledFeatures(opt),
+	}
+}
+
+// enabledFeatures returns the optional on-disk features used by the options, sorted by name.
+func enabledFeatures(opt Options) []string {
+	// The blob files are always written with the checksums and the tables with the footers.
+	features := []string{featureBlobChecksum}
+	if opt.ColdStorage != nil {
+		features = append(features, featureColdStorage)
+	}
+	if len(opt.EncryptionKey) > 0 {
+		features = append(features, featureEncryption)
+	}
+	if opt.TableBuilderOptions.RestartInterval > 1 {
+		features = append(features, featureKeyRestart)
+	}
+	if opt.TableBuilderOptions.IndexPartitionSize > 0 {
+		features = append(features, featurePartitionedIndex)
+	}
+	features = append(features, featureTableFooter)
+	if opt.TableBuilderOptions.VarintValue {
+		features = append(features, featureVarintValue)
+	}
+	return features
+}
+
+// check returns a FormatError if the format on disk can not be read by this version of badger.
+func (f *dbFormat) check() error {
+	versions := []struct {
+		component string
+		version   uint32
+		supported uint32
+	}{
+		{"table", f.Table, tableFormatVersion},
+		{"vlog", f.ValueLog, valueLogFormatVersion},
+		{"manifest", f.Manifest, magicVersion},
+	}
+	for _, v := range versions {
+		if v.version != v.supported {
+			return &FormatError{Component: v.component, Version: v.version, Supported: v.supported}
+		}
+	}
+	for _, feature := range f.Features {
+		if _, ok := knownFeatures[feature]; !ok {
+			return &FormatError{Component: "feature", Feature: feature}
+		}
+	}
+	return nil
+}
+
+// addFeatures merges features into the sorted feature list of the format.
+func (f *dbFormat) addFeatures(features []string) {
+	for _, feature := range features {
+		idx := sort.SearchStrings(f.Features, feature)
+		if idx < len(f.Features) && f.Features[idx] == feature {
+			continue
+		}
+		f.Features = append(f.Features, "")
+		copy(f.Features[idx+1:], f.Features[idx:])
+		f.Features[idx] = feature
+	}
+}
+
+// checkFormat verifies the format file in dir against this version of badger. If the format file
+// doesn't exist, it is created with the current format, databases created before the format file
+// was introduced share the same format versions. Every successful open for write bumps the
+// generation of the directory.
+func checkFormat(dir string, opt Options) (*dbFormat, error) {
+	path := filepath.Join(dir, FormatFilename)
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	format := currentFormat(opt)
+	if err == nil {
+		format = dbFormat{}
+		if err = json.Unmarshal(data, &format); err != nil {
+			return nil, y.Wrapf(err, "failed to parse %s", path)
+		}
+		if err = format.check(); err != nil {
+			return nil, err
+		}
+		format.addFeatures(enabledFeatures(opt))
+	}
+	if opt.ReadOnly {
+		return &format, nil
+	}
+	format.Generation++
+	return &format, writeFormat(dir, &format)
+}
+
+// enableFeature records the feature in the format file of the DB if it is not recorded yet, it must
+// be called before the data using the feature is written.
+func (db *DB) enableFeature(feature string) error {
+	db.formatLock.Lock()
+	defer db.formatLock.Unlock()
+	idx := sort.SearchStrings(db.format.Features, feature)
+	if idx < len(db.format.Features) && db.format.Features[idx] == feature {
+		return nil
+	}
+	format := *db.format
+	format.Features = append([]string(nil), db.format.Features...)
+	format.addFeatures([]string{feature})
+	if err := writeFormat(db.opt.Dir, &format); err != nil {
+		return err
+	}
+	db.format = &format
+	return nil
+}
+
+func writeFormat(dir string, format *dbFormat) error {
+	data, err := json.Marshal(format)
+	if err != nil {
+		return err
+	}
+	rewritePath := filepath.Join(dir, formatRewriteFilename)
+	fp, err := y.OpenTruncFile(rewritePath, false)
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	// In Windows the files should be closed before doing a Rename.
+	if err = fp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(rewritePath, filepath.Join(dir, FormatFilename)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
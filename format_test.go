@@ -0,0 +1,117 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pingcap/badger/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatGeneration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+
+	for i := 1; i <= 3; i++ {
+		db, err := Open(opt)
+		require.NoError(t, err)
+		require.NoError(t, db.Close())
+		format, err := checkFormat(dir, Options{ReadOnly: true})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), format.Generation)
+	}
+}
+
+func TestFormatIncompatible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+
+	format := currentFormat(opt)
+	format.Table = tableFormatVersion + 1
+	require.NoError(t, writeFormat(dir, &format))
+	_, err = Open(opt)
+	require.Equal(t, &FormatError{Component: "table", Version: tableFormatVersion + 1, Supported: tableFormatVersion}, err)
+	require.Contains(t, err.Error(), "badger needs upgrade")
+
+	format = currentFormat(opt)
+	format.Manifest = magicVersion - 1
+	require.NoError(t, writeFormat(dir, &format))
+	_, err = Open(opt)
+	require.Equal(t, &FormatError{Component: "manifest", Version: magicVersion - 1, Supported: magicVersion}, err)
+	require.Contains(t, err.Error(), "DB needs upgrade")
+
+	format = currentFormat(opt)
+	format.addFeatures([]string{"unknown-feature"})
+	require.NoError(t, writeFormat(dir, &format))
+	_, err = Open(opt)
+	require.Equal(t, &FormatError{Component: "feature", Feature: "unknown-feature"}, err)
+}
+
+func TestFormatFeatures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.EncryptionKey = bytes.Repeat([]byte{7}, 32)
+	opt.TableBuilderOptions.IndexPartitionSize = 4 << 10
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	format, err := checkFormat(dir, Options{ReadOnly: true})
+	require.NoError(t, err)
+	require.Contains(t, format.Features, featureEncryption)
+	require.Contains(t, format.Features, featurePartitionedIndex)
+	require.True(t, sort.StringsAreSorted(format.Features))
+}
+
+func TestFormatTTLFeature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	txnSet(t, db, []byte("key"), []byte("val"), 0)
+	format, err := checkFormat(dir, Options{ReadOnly: true})
+	require.NoError(t, err)
+	require.NotContains(t, format.Features, featureTTL)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.SetEntry((&Entry{Key: y.KeyWithTs([]byte("ttl"), 0), Value: []byte("val")}).WithTTL(time.Hour))
+	}))
+	require.NoError(t, db.Close())
+	format, err = checkFormat(dir, Options{ReadOnly: true})
+	require.NoError(t, err)
+	require.Contains(t, format.Features, featureTTL)
+
+	// A version of badger which can't read the expiry time refuses to open the DB.
+	delete(knownFeatures, featureTTL)
+	defer func() { knownFeatures[featureTTL] = struct{}{} }()
+	_, err = Open(opt)
+	require.Equal(t, &FormatError{Component: "feature", Feature: featureTTL}, err)
+}
@@ -0,0 +1,131 @@
+package badger
+
+import (
+	"bytes"
+	"math/bits"
+
+	"github.com/pingcap/badger/table"
+	"github.com/pingcap/badger/y"
+)
+
+// SizeHistogram is the distribution of sizes in power of two buckets, Counts[i] counts the sizes
+// in [1<<(i-1), 1<<i), Counts[0] counts the zero sizes.
+type SizeHistogram struct {
+	Counts []uint64
+	Count  uint64
+	Sum    uint64
+	Min    int
+	Max    int
+}
+
+func (h *SizeHistogram) add(size int) {
+	idx := bits.Len(uint(size))
+	if idx >= len(h.Counts) {
+		h.Counts = append(h.Counts, make([]uint64, idx+1-len(h.Counts))...)
+	}
+	h.Counts[idx]++
+	if h.Count == 0 || size < h.Min {
+		h.Min = size
+	}
+	if size > h.Max {
+		h.Max = size
+	}
+	h.Count++
+	h.Sum += uint64(size)
+}
+
+// Mean returns the average size, it is 0 if the histogram is empty.
+func (h *SizeHistogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return float64(h.Sum) / float64(h.Count)
+}
+
+// Percentile returns the upper bound of the bucket which covers the percentile p in [0, 1] of the
+// sizes.
+func (h *SizeHistogram) Percentile(p float64) int {
+	target := uint64(p * float64(h.Count))
+	var covered uint64
+	for i, count := range h.Counts {
+		covered += count
+		if covered >= target && covered > 0 {
+			if 1<<uint(i)-1 > h.Max {
+				return h.Max
+			}
+			return 1<<uint(i) - 1
+		}
+	}
+	return h.Max
+}
+
+// LevelHistogram is the distribution of the key and value sizes in a level of the LSM tree.
+type LevelHistogram struct {
+	Level int
+	// KeySizes counts the user keys of every version, including the deletes.
+	KeySizes SizeHistogram
+	// ValueSizes counts the values which are not deleted, the size of a value in a blob file is
+	// its actual size instead of the size of the blob pointer.
+	ValueSizes SizeHistogram
+}
+
+// Histogram scans the entries which have the prefix in the tables of every level and returns the
+// distributions of their key and value sizes. The memtables are not scanned. It can be used to
+// choose ValueThreshold and the block size.
+func (db *DB) Histogram(prefix []byte) ([]LevelHistogram, error) {
+	guard := db.resourceMgr.Acquire()
+	defer guard.Done()
+	result := make([]LevelHistogram, len(db.lc.levels))
+	for i, l := range db.lc.levels {
+		result[i].Level = l.level
+		l.RLock()
+		tables := append([]table.Table{}, l.tables...)
+		l.RUnlock()
+		for _, t := range tables {
+			smallest := t.Smallest().UserKey
+			if bytes.Compare(t.Biggest().UserKey, prefix) < 0 ||
+				(bytes.Compare(smallest, prefix) > 0 && !bytes.HasPrefix(smallest, prefix)) {
+				continue
+			}
+			if err := addTableHistogram(t, prefix, &result[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func addTableHistogram(t table.Table, prefix []byte, h *LevelHistogram) error {
+	it := t.NewIterator(false)
+	defer it.Close()
+	var vs y.ValueStruct
+	for it.Seek(prefix); it.Valid(); it.Next() {
+		if !bytes.HasPrefix(it.Key().UserKey, prefix) {
+			break
+		}
+		for {
+			h.KeySizes.add(len(it.Key().UserKey))
+			it.FillValue(&vs)
+			if vs.Meta&bitDelete == 0 {
+				h.ValueSizes.add(valueSize(vs))
+			}
+			if !it.NextVersion() {
+				break
+			}
+		}
+	}
+	if errIt, ok := it.(interface{ Error() error }); ok {
+		return errIt.Error()
+	}
+	return nil
+}
+
+// valueSize returns the size of the value, the value may be a blob pointer.
+func valueSize(vs y.ValueStruct) int {
+	if vs.Meta&bitValuePointer > 0 {
+		var bp blobPointer
+		bp.decode(vs.Value)
+		return int(bp.length)
+	}
+	return len(vs.Value)
+}
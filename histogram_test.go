@@ -0,0 +1,61 @@
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.ValueThreshold = 100
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			if err := txn.Set([]byte(fmt.Sprintf("a%03d", i)), make([]byte, 10)); err != nil {
+				return err
+			}
+			return txn.Set([]byte(fmt.Sprintf("b%07d", i)), make([]byte, 1000))
+		}))
+	}
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Delete([]byte("a000"))
+	}))
+	db.flushMemTable().Wait()
+
+	levels, err := db.Histogram([]byte("a"))
+	require.NoError(t, err)
+	require.Len(t, levels, opts.TableBuilderOptions.MaxLevels)
+	h := levels[0]
+	require.Equal(t, uint64(101), h.KeySizes.Count)
+	require.Equal(t, 4, h.KeySizes.Min)
+	require.Equal(t, 4, h.KeySizes.Max)
+	require.Equal(t, uint64(100), h.ValueSizes.Count)
+	require.Equal(t, uint64(100), h.ValueSizes.Counts[4])
+	require.Equal(t, 10, h.ValueSizes.Percentile(0.5))
+
+	// The values in the blob file are counted by their actual size.
+	levels, err = db.Histogram([]byte("b"))
+	require.NoError(t, err)
+	h = levels[0]
+	require.Equal(t, uint64(100), h.KeySizes.Count)
+	require.Equal(t, 8.0, h.KeySizes.Mean())
+	require.Equal(t, uint64(100), h.ValueSizes.Count)
+	require.Equal(t, 1000, h.ValueSizes.Min)
+	require.Equal(t, 1000, h.ValueSizes.Percentile(0.99))
+
+	levels, err = db.Histogram(nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(201), levels[0].KeySizes.Count)
+	levels, err = db.Histogram([]byte("c"))
+	require.NoError(t, err)
+	require.Zero(t, levels[0].KeySizes.Count)
+}
@@ -0,0 +1,183 @@
+package badger
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+)
+
+// Index is a secondary index of the keys in the DefaultCF, registered by Options.Indexes. The index
+// entries are written by the transaction writing the key, so they are always consistent with the
+// keys. The keys beginning with '!' are not indexed.
+type Index struct {
+	// Name identifies the index, the index entries are stored under a reserved prefix followed by
+	// the name, so it must not be changed once the entries are written. It must not contain a
+	// zero byte.
+	Name string
+	// Extract returns the index values of the key and value, nil if the key is not indexed. It is
+	// also called with the old value of the key to delete the index entries of the old value, so it
+	// must return the same index values for the same key and value.
+	Extract func(key, value []byte) [][]byte
+}
+
+// indexKeyPrefix is prepended to the index entries, followed by the index name.
+var indexKeyPrefix = []byte("!badger!index")
+
+// valuePrefix returns the prefix of the index entries of the index value, the value is escaped
+// so the index entries are sorted by the index value and then by the key.
+func (idx *Index) valuePrefix(value []byte) []byte {
+	buf := make([]byte, 0, len(indexKeyPrefix)+len(idx.Name)+len(value)+4)
+	buf = append(buf, indexKeyPrefix...)
+	buf = append(buf, idx.Name...)
+	buf = append(buf, 0)
+	for _, b := range value {
+		buf = append(buf, b)
+		if b == 0 {
+			buf = append(buf, 0xff)
+		}
+	}
+	return append(buf, 0, 1)
+}
+
+func validateIndexes(indexes []Index) error {
+	names := make(map[string]struct{}, len(indexes))
+	for _, idx := range indexes {
+		if idx.Name == "" || idx.Extract == nil || bytes.IndexByte([]byte(idx.Name), 0) >= 0 {
+			return errors.Errorf("invalid index %q, the name must be non-empty without a zero byte "+
+				"and the extract function must be set", idx.Name)
+		}
+		if _, ok := names[idx.Name]; ok {
+			return errors.Errorf("duplicated index %q", idx.Name)
+		}
+		names[idx.Name] = struct{}{}
+	}
+	return nil
+}
+
+// updateIndexes adds the index entries written for e to the transaction, the index entries of the
+// old value which are not the index entries of the new value are deleted. The old value is read by
+// the transaction, so a concurrent write of the key conflicts.
+func (txn *Txn) updateIndexes(e *Entry) error {
+	key := e.Key.UserKey
+	if len(txn.db.opt.Indexes) == 0 || key[0] == '!' {
+		return nil
+	}
+	var oldValue []byte
+	item, err := txn.get(context.Background(), key)
+	if err == nil {
+		if oldValue, err = item.Value(); err != nil {
+			return err
+		}
+	} else if err != ErrKeyNotFound {
+		return err
+	}
+	deleted := isDeletedOrExpired(e.meta, e.ExpiresAt)
+	var entries []*Entry
+	for i := range txn.db.opt.Indexes {
+		idx := &txn.db.opt.Indexes[i]
+		var oldValues, newValues [][]byte
+		if item != nil {
+			oldValues = idx.Extract(key, oldValue)
+		}
+		if !deleted {
+			newValues = idx.Extract(key, e.Value)
+		}
+		for _, v := range oldValues {
+			if !containsValue(newValues, v) {
+				entries = append(entries, &Entry{
+					Key:  y.KeyWithTs(append(idx.valuePrefix(v), key...), e.Key.Version),
+					meta: bitDelete,
+				})
+			}
+		}
+		// The index entries are rewritten even if the value is unchanged, as the TTL may change.
+		for _, v := range newValues {
+			entries = append(entries, &Entry{
+				Key:       y.KeyWithTs(append(idx.valuePrefix(v), key...), e.Key.Version),
+				ExpiresAt: e.ExpiresAt,
+			})
+		}
+	}
+	for _, ie := range entries {
+		if ie.Key.Len() > maxKeySize {
+			return exceedsMaxKeySizeError(ie.Key.UserKey)
+		}
+		if err = txn.checkSize(ie); err != nil {
+			return err
+		}
+	}
+	for _, ie := range entries {
+		txn.addWrite(ie)
+	}
+	return nil
+}
+
+func containsValue(values [][]byte, v []byte) bool {
+	for _, val := range values {
+		if bytes.Equal(val, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexIterator iterates over the keys whose index values of an index equal a value, in key order.
+type IndexIterator struct {
+	txn    *Txn
+	it     *Iterator
+	prefix []byte
+}
+
+// NewIndexIterator returns an iterator over the keys indexed by value in the index of the name, it
+// returns ErrInvalidRequest if the index is not in Options.Indexes. The writes of the transaction
+// are visible to the iterator. It must be closed like an Iterator.
+func (txn *Txn) NewIndexIterator(name string, value []byte) (*IndexIterator, error) {
+	for i := range txn.db.opt.Indexes {
+		idx := &txn.db.opt.Indexes[i]
+		if idx.Name != name {
+			continue
+		}
+		opts := DefaultIteratorOptions
+		opts.Prefix = idx.valuePrefix(value)
+		opts.internalAccess = true
+		return &IndexIterator{txn: txn, it: txn.NewIterator(opts), prefix: opts.Prefix}, nil
+	}
+	return nil, ErrInvalidRequest
+}
+
+// Rewind positions the iterator at the smallest key.
+func (it *IndexIterator) Rewind() {
+	it.it.Rewind()
+}
+
+// Seek positions the iterator at the smallest key not less than key.
+func (it *IndexIterator) Seek(key []byte) {
+	it.it.Seek(append(append([]byte{}, it.prefix...), key...))
+}
+
+// Valid returns false when the iteration is done.
+func (it *IndexIterator) Valid() bool {
+	return it.it.Valid()
+}
+
+// Next advances the iterator to the next key.
+func (it *IndexIterator) Next() {
+	it.it.Next()
+}
+
+// Key returns the key indexed by the value, it is only valid until Next is called.
+func (it *IndexIterator) Key() []byte {
+	return it.it.Item().Key()[len(it.prefix):]
+}
+
+// Item returns the item of the current key read by the transaction.
+func (it *IndexIterator) Item() (*Item, error) {
+	return it.txn.Get(y.Copy(it.Key()))
+}
+
+// Close closes the iterator.
+func (it *IndexIterator) Close() {
+	it.it.Close()
+}
@@ -0,0 +1,103 @@
+package badger
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	// The values are "city:name", indexed by the city.
+	opts.Indexes = []Index{{Name: "city", Extract: func(key, value []byte) [][]byte {
+		if i := bytes.IndexByte(value, ':'); i > 0 {
+			return [][]byte{value[:i]}
+		}
+		return nil
+	}}}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	lookup := func(txn *Txn, city string) []string {
+		it, err := txn.NewIndexIterator("city", []byte(city))
+		require.NoError(t, err)
+		defer it.Close()
+		var keys []string
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		return keys
+	}
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.Set([]byte("u3"), []byte("paris:c")))
+		require.NoError(t, txn.Set([]byte("u1"), []byte("paris:a")))
+		require.NoError(t, txn.Set([]byte("u2"), []byte("pari\x00s:b")))
+		require.NoError(t, txn.Set([]byte("u4"), []byte("unknown")))
+		// The index entries written by the transaction are visible to it.
+		require.Equal(t, []string{"u1", "u3"}, lookup(txn, "paris"))
+		return nil
+	}))
+	require.NoError(t, db.View(func(txn *Txn) error {
+		require.Equal(t, []string{"u1", "u3"}, lookup(txn, "paris"))
+		require.Equal(t, []string{"u2"}, lookup(txn, "pari\x00s"))
+		require.Empty(t, lookup(txn, "pari"))
+		it, err := txn.NewIndexIterator("city", []byte("paris"))
+		require.NoError(t, err)
+		defer it.Close()
+		it.Seek([]byte("u2"))
+		require.True(t, it.Valid())
+		item, err := it.Item()
+		require.NoError(t, err)
+		require.Equal(t, []byte("paris:c"), getItemValue(t, item))
+		// The index entries are invisible to the iterators.
+		iter := txn.NewIterator(DefaultIteratorOptions)
+		defer iter.Close()
+		var n int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			n++
+		}
+		require.Equal(t, 4, n)
+		return nil
+	}))
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.Set([]byte("u1"), []byte("rome:a")))
+		require.NoError(t, txn.Set([]byte("u1"), []byte("oslo:a")))
+		return txn.Delete([]byte("u3"))
+	}))
+	require.NoError(t, db.View(func(txn *Txn) error {
+		require.Empty(t, lookup(txn, "paris"))
+		require.Empty(t, lookup(txn, "rome"))
+		require.Equal(t, []string{"u1"}, lookup(txn, "oslo"))
+		_, err := txn.NewIndexIterator("name", nil)
+		require.Equal(t, ErrInvalidRequest, err)
+		return nil
+	}))
+
+	// The transactions writing the same key conflict, as the old value is read to update the index.
+	txn1 := db.NewTransaction(true)
+	txn2 := db.NewTransaction(true)
+	require.NoError(t, txn1.Set([]byte("u1"), []byte("rome:a")))
+	require.NoError(t, txn2.Set([]byte("u1"), []byte("paris:a")))
+	require.NoError(t, txn1.Commit())
+	require.Equal(t, ErrConflict, txn2.Commit())
+	require.NoError(t, db.View(func(txn *Txn) error {
+		require.Empty(t, lookup(txn, "oslo"))
+		require.Equal(t, []string{"u1"}, lookup(txn, "rome"))
+		return nil
+	}))
+
+	opts.Dir = dir + "-dup"
+	opts.ValueDir = opts.Dir
+	defer os.RemoveAll(opts.Dir)
+	opts.Indexes = append(opts.Indexes, opts.Indexes[0])
+	_, err = Open(opts)
+	require.EqualError(t, err, `duplicated index "city"`)
+}
@@ -18,10 +18,12 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math"
 	"sort"
 	"sync/atomic"
+	"time"
 
 	"github.com/dgryski/go-farm"
 	"github.com/pingcap/badger/table"
@@ -32,15 +34,23 @@ import (
 // Item is returned during iteration. Both the Key() and Value() output is only valid until
 // iterator.Next() is called.
 type Item struct {
-	err      error
-	db       *DB
-	key      y.Key
-	vptr     []byte
-	meta     byte // We need to store meta to know about bitValuePointer.
-	userMeta []byte
-	slice    *y.Slice
-	next     *Item
-	txn      *Txn
+	err       error
+	db        *DB
+	key       y.Key
+	vptr      []byte
+	meta      byte // We need to store meta to know about bitValuePointer.
+	userMeta  []byte
+	expiresAt uint64
+	slice     *y.Slice
+	next      *Item
+	txn       *Txn
+	// ctx carries the span the value read is traced under, it is nil for the items of iterators.
+	ctx context.Context
+	// arena backs the copies of KeyCopy and ValueCopy with a nil dst if set.
+	arena *y.Arena
+
+	// cfPrefixLen is the length of the column family prefix of the key.
+	cfPrefixLen int
 }
 
 // String returns a string representation of Item
@@ -53,14 +63,17 @@ func (item *Item) String() string {
 // Key is only valid as long as item is valid, or transaction is valid.  If you need to use it
 // outside its validity, please use KeyCopy
 func (item *Item) Key() []byte {
-	return item.key.UserKey
+	return item.key.UserKey[item.cfPrefixLen:]
 }
 
 // KeyCopy returns a copy of the key of the item, writing it to dst slice.
 // If nil is passed, or capacity of dst isn't sufficient, a new slice would be allocated and
-// returned.
+// returned. If nil is passed and IteratorOptions.Arena is set, the copy is allocated from the arena.
 func (item *Item) KeyCopy(dst []byte) []byte {
-	return y.SafeCopy(dst, item.key.UserKey)
+	if dst == nil && item.arena != nil {
+		return item.arena.Copy(item.Key())
+	}
+	return y.SafeCopy(dst, item.Key())
 }
 
 // Version returns the commit timestamp of the item.
@@ -91,6 +104,11 @@ func (item *Item) Value() ([]byte, error) {
 		if item.txn.blobCache == nil {
 			item.txn.blobCache = map[uint32]*blobCache{}
 		}
+		if item.ctx != nil && item.db.opt.Tracer != nil {
+			_, span := item.db.opt.Tracer.Start(item.ctx, "badger.value_read")
+			defer span.End()
+			span.SetAttribute("size", item.ValueSize())
+		}
 		return item.db.blobManger.read(item.vptr, item.slice, item.txn.blobCache)
 	}
 	return item.vptr, nil
@@ -109,6 +127,7 @@ func (item *Item) ValueSize() int {
 // ValueCopy returns a copy of the value of the item from the value log, writing it to dst slice.
 // If nil is passed, or capacity of dst isn't sufficient, a new slice would be allocated and
 // returned. Tip: It might make sense to reuse the returned slice as dst argument for the next call.
+// If nil is passed and IteratorOptions.Arena is set, the copy is allocated from the arena.
 //
 // This function is useful in long running iterate/update transactions to avoid a write deadlock.
 // See Github issue: https://github.com/pingcap/badger/issues/315
@@ -117,6 +136,9 @@ func (item *Item) ValueCopy(dst []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if dst == nil && item.arena != nil {
+		return item.arena.Copy(buf), nil
+	}
 	return y.SafeCopy(dst, buf), nil
 }
 
@@ -128,9 +150,14 @@ func (item *Item) hasValue() bool {
 	return true
 }
 
+// AppMeta returns the application bits of the meta set by Entry.WithAppMeta, see AppMetaMask.
+func (item *Item) AppMeta() byte {
+	return item.meta & AppMetaMask
+}
+
 // IsDeleted returns true if item contains deleted or expired value.
 func (item *Item) IsDeleted() bool {
-	return isDeleted(item.meta)
+	return isDeletedOrExpired(item.meta, item.expiresAt)
 }
 
 // EstimatedSize returns approximate size of the key-value pair.
@@ -145,12 +172,17 @@ func (item *Item) EstimatedSize() int64 {
 	return int64(item.key.Len() + len(item.vptr))
 }
 
-// UserMeta returns the userMeta set by the user. Typically, this byte, optionally set by the user
-// is used to interpret the value.
+// UserMeta returns the userMeta set by the user, up to 255 bytes stored along with the value.
+// Typically, it is used to interpret the value, e.g. the schema version the value is encoded with.
 func (item *Item) UserMeta() []byte {
 	return item.userMeta
 }
 
+// ExpiresAt returns the unix time in seconds when the item expires, 0 means it never expires.
+func (item *Item) ExpiresAt() uint64 {
+	return item.expiresAt
+}
+
 // IteratorOptions is used to set options when iterating over Badger key-value
 // stores.
 //
@@ -160,15 +192,69 @@ func (item *Item) UserMeta() []byte {
 type IteratorOptions struct {
 	Reverse     bool // Direction of iteration. False is forward, true is backward.
 	AllVersions bool // Fetch all valid versions of the same key.
+	// MaxVersions limits the versions of a key fetched by AllVersions to the newest MaxVersions
+	// versions, the iterator moves to the next key after them. Zero means no limit.
+	MaxVersions int
+	// SinceTs skips the versions not newer than it, so an incremental scan only reads the keys
+	// changed after it. A key whose newest visible version is not newer than SinceTs is skipped, and
+	// the tables whose entries are all not newer than SinceTs are not read.
+	SinceTs uint64
 
 	// StartKey and EndKey are used to prune non-overlapping table iterators.
 	// They are not boundary limits, the EndKey is exclusive.
 	StartKey y.Key
 	EndKey   y.Key
 
+	// Prefix limits the iteration to the keys with the prefix, the iterator is not valid once
+	// it reaches a key without the prefix. Tables whose index proves they have no keys with the
+	// prefix are skipped.
+	Prefix []byte
+
+	// ReadaheadBlocks is the number of blocks prefetched into the block cache on a background
+	// goroutine when a table iterator crosses a block boundary, it speeds up sequential scans over
+	// the data not in the cache. It takes effect only if the block cache is enabled.
+	ReadaheadBlocks int
+
+	// MetaFilter is called with the application bits of the meta of the versions, see AppMetaMask,
+	// the versions it returns false for are skipped before their values are read. A key whose newest
+	// visible version is skipped is skipped as a whole unless AllVersions is set.
+	MetaFilter func(meta byte) bool
+
+	// Arena backs the copies returned by Item.KeyCopy and Item.ValueCopy with a nil dst, so the
+	// copies of many items cost few allocations. The copies are valid until the Arena is reset, it
+	// can be reused by the following iterators after Reset but not by concurrent iterators.
+	Arena *y.Arena
+
 	internalAccess bool // Used to allow internal access to badger keys.
 }
 
+// narrowToPrefix shrinks the StartKey and EndKey to the key range covered by the Prefix.
+func (opts *IteratorOptions) narrowToPrefix() {
+	if opts.StartKey.IsEmpty() || bytes.Compare(opts.StartKey.UserKey, opts.Prefix) < 0 {
+		opts.StartKey = y.KeyWithTs(opts.Prefix, math.MaxUint64)
+	}
+	end := prefixEnd(opts.Prefix)
+	if end == nil {
+		return
+	}
+	if opts.EndKey.IsEmpty() || bytes.Compare(opts.EndKey.UserKey, end) > 0 {
+		opts.EndKey = y.KeyWithTs(end, math.MaxUint64)
+	}
+}
+
+// prefixEnd returns the smallest key which is greater than all the keys with the prefix.
+// nil is returned if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := y.Copy(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
 func (opts *IteratorOptions) hasRange() bool {
 	return !opts.StartKey.IsEmpty() && !opts.EndKey.IsEmpty()
 }
@@ -209,6 +295,9 @@ func (opts *IteratorOptions) OverlapMemTable(t *memtable.Table) bool {
 }
 
 func (opts *IteratorOptions) OverlapTable(t table.Table) bool {
+	if opts.SinceTs > 0 && !tableChangedSince(t, opts.SinceTs) {
+		return false
+	}
 	if !opts.hasRange() {
 		return true
 	}
@@ -220,7 +309,16 @@ func (opts *IteratorOptions) OverlapTables(tables []table.Table) []table.Table {
 		return nil
 	}
 	if !opts.hasRange() {
-		return tables
+		if opts.SinceTs == 0 {
+			return tables
+		}
+		overlapTables := make([]table.Table, 0, len(tables))
+		for _, t := range tables {
+			if opts.OverlapTable(t) {
+				overlapTables = append(overlapTables, t)
+			}
+		}
+		return overlapTables
 	}
 	startIdx := sort.Search(len(tables), func(i int) bool {
 		t := tables[i]
@@ -244,6 +342,18 @@ func (opts *IteratorOptions) OverlapTables(tables []table.Table) []table.Table {
 	return overlapTables
 }
 
+// tableChangedSince returns false if the stats of the table prove its entries are all not newer than
+// ts.
+func tableChangedSince(t table.Table, ts uint64) bool {
+	st, ok := t.(table.EntryStatsTable)
+	if !ok {
+		return true
+	}
+	stats := st.EntryStats()
+	// The stats are zero if the table was built before they were recorded.
+	return stats.NumEntries == 0 || stats.MaxVersion > ts
+}
+
 // DefaultIteratorOptions contains default options when iterating over Badger key-value stores.
 var DefaultIteratorOptions = IteratorOptions{
 	Reverse:     false,
@@ -256,19 +366,35 @@ type Iterator struct {
 	txn    *Txn
 	readTs uint64
 
-	opt   IteratorOptions
-	item  *Item
-	itBuf Item
-	vs    y.ValueStruct
+	opt IteratorOptions
+	// cfPrefix is prepended to the keys passed to the iterator of a column family.
+	cfPrefix []byte
+	item     *Item
+	itBuf    Item
+	vs       y.ValueStruct
+	err      error
+	// key is the only key of the iterator returned by Txn.NewKeyIterator.
+	key []byte
+	// numVersions is the number of versions of the current key fetched by AllVersions.
+	numVersions int
 
 	closed bool
+	// inUse is only maintained when Options.DetectConcurrentUse is set.
+	inUse int32
 }
 
 // NewIterator returns a new iterator. Depending upon the options, either only keys, or both
 // key-value pairs would be fetched. The keys are returned in lexicographically sorted order.
 // Avoid long running iterations in update transactions.
+//
+// The iterator can be created in one goroutine and used in another, as long as it is not used by
+// multiple goroutines at the same time.
 func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 	atomic.AddInt32(&txn.numIterators, 1)
+	if err := txn.acquire(); err != nil {
+		return &Iterator{iitr: &table.EmptyIterator{}, txn: txn, opt: opt, err: err}
+	}
+	defer txn.release()
 
 	tables := txn.db.getMemTables()
 	if !opt.StartKey.IsEmpty() {
@@ -277,6 +403,9 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 	if !opt.EndKey.IsEmpty() {
 		opt.EndKey.Version = math.MaxUint64
 	}
+	if len(opt.Prefix) > 0 {
+		opt.narrowToPrefix()
+	}
 	var iters []y.Iterator
 	if itr := txn.newPendingWritesIterator(opt.Reverse); opt.OverlapPending(itr) {
 		iters = append(iters, itr)
@@ -296,27 +425,132 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 	res.itBuf.db = txn.db
 	res.itBuf.txn = txn
 	res.itBuf.slice = new(y.Slice)
+	res.itBuf.arena = opt.Arena
+	txn.db.iterTracker.add(res)
+	return res
+}
+
+// NewKeyIterator returns an iterator over the versions of the key visible to the transaction, from
+// the newest to the oldest, including the deleted and expired versions like AllVersions. Only the
+// tables whose filters may contain the key are read, so it is cheaper than an iterator with the key
+// as the prefix, which reads every table overlapping the prefix. The StartKey, EndKey and Prefix in
+// opt are replaced by the key, Reverse is not supported.
+func (txn *Txn) NewKeyIterator(key []byte, opt IteratorOptions) *Iterator {
+	atomic.AddInt32(&txn.numIterators, 1)
+	if len(key) == 0 {
+		return &Iterator{iitr: &table.EmptyIterator{}, txn: txn, opt: opt, err: ErrEmptyKey}
+	}
+	if err := txn.acquire(); err != nil {
+		return &Iterator{iitr: &table.EmptyIterator{}, txn: txn, opt: opt, err: err}
+	}
+	defer txn.release()
+
+	key = y.Copy(key)
+	opt.Reverse = false
+	opt.AllVersions = true
+	opt.Prefix = key
+	opt.StartKey = y.KeyWithTs(key, math.MaxUint64)
+	opt.EndKey = y.KeyWithTs(append(y.Copy(key), 0), math.MaxUint64)
+	var iters []y.Iterator
+	if txn.update {
+		if e, ok := txn.pendingWrites[string(key)]; ok {
+			iters = append(iters, &pendingWritesIterator{readTs: txn.readTs, entries: []*Entry{e}})
+		}
+	}
+	for _, t := range txn.db.getMemTables() {
+		if opt.OverlapMemTable(t) {
+			iters = append(iters, t.NewIterator(false))
+		}
+	}
+	iters = txn.db.lc.appendKeyIterators(iters, key, false)
+	res := &Iterator{
+		txn:    txn,
+		iitr:   table.NewMergeIterator(iters, false),
+		opt:    opt,
+		readTs: txn.readTs,
+		key:    key,
+	}
+	res.itBuf.db = txn.db
+	res.itBuf.txn = txn
+	res.itBuf.slice = new(y.Slice)
+	res.itBuf.arena = opt.Arena
+	txn.db.iterTracker.add(res)
 	return res
 }
 
 // Item returns pointer to the current key-value pair.
 // This item is only valid until it.Next() gets called.
+// If a concurrent use of the update transaction is detected, the read is not tracked and the error
+// is returned by Err, the iterator becomes invalid on the next move.
 func (it *Iterator) Item() *Item {
 	tx := it.txn
 	if tx.update {
+		if err := tx.acquire(); err != nil {
+			it.err = err
+			return it.item
+		}
 		// Track reads if this is an update txn.
-		tx.reads = append(tx.reads, farm.Fingerprint64(it.item.Key()))
+		tx.reads = append(tx.reads, farm.Fingerprint64(it.item.key.UserKey))
+		tx.release()
 	}
 	return it.item
 }
 
-// Valid returns false when iteration is done.
-func (it *Iterator) Valid() bool { return it.item != nil }
+// Valid returns false when iteration is done, or the current key is not prefixed by the
+// IteratorOptions.Prefix.
+func (it *Iterator) Valid() bool {
+	if it.key != nil {
+		return it.item != nil && bytes.Equal(it.item.key.UserKey, it.key)
+	}
+	return it.item != nil && bytes.HasPrefix(it.item.key.UserKey, it.opt.Prefix)
+}
+
+// Err returns the error encountered during iteration or by Item, if any. It is only set when
+// Options.DetectConcurrentUse is enabled and a concurrent use of the iterator or its
+// transaction has been detected.
+func (it *Iterator) Err() error { return it.err }
+
+// acquire marks the iterator as being used by the calling goroutine. If another goroutine is
+// using it, ErrConcurrentIterator is recorded and false is returned. The iterator of an update
+// txn reads the pending writes, so the txn is acquired too and ErrConcurrentTxn is recorded if
+// the txn is in use.
+func (it *Iterator) acquire() bool {
+	if it.err != nil {
+		it.item = nil
+		return false
+	}
+	if !it.txn.db.opt.DetectConcurrentUse {
+		return true
+	}
+	if !atomic.CompareAndSwapInt32(&it.inUse, 0, 1) {
+		it.err = ErrConcurrentIterator
+		it.item = nil
+		return false
+	}
+	if it.txn.update {
+		if err := it.txn.acquire(); err != nil {
+			atomic.StoreInt32(&it.inUse, 0)
+			it.err = err
+			it.item = nil
+			return false
+		}
+	}
+	return true
+}
+
+func (it *Iterator) release() {
+	if it.txn.db.opt.DetectConcurrentUse {
+		if it.txn.update {
+			it.txn.release()
+		}
+		atomic.StoreInt32(&it.inUse, 0)
+	}
+}
 
 // ValidForPrefix returns false when iteration is done
 // or when the current key is not prefixed by the specified prefix.
 func (it *Iterator) ValidForPrefix(prefix []byte) bool {
-	return it.item != nil && bytes.HasPrefix(it.item.key.UserKey, prefix)
+	return it.item != nil && bytes.HasPrefix(it.item.Key(), prefix) && bytes.HasPrefix(it.item.key.UserKey, it.cfPrefix)
 }
 
 // Close would close the iterator. It is important to call this when you're done with iteration.
@@ -326,14 +560,20 @@ func (it *Iterator) Close() {
 	}
 	it.closed = true
 	it.iitr.Close()
+	it.txn.db.iterTracker.remove(it)
 	atomic.AddInt32(&it.txn.numIterators, -1)
 }
 
 // Next would advance the iterator by one. Always check it.Valid() after a Next()
 // to ensure you have access to a valid it.Item().
 func (it *Iterator) Next() {
-	if it.opt.AllVersions && it.Valid() && it.iitr.NextVersion() {
-		it.updateItem()
+	if !it.acquire() {
+		return
+	}
+	defer it.release()
+	if it.opt.AllVersions && it.Valid() && (it.opt.MaxVersions <= 0 || it.numVersions < it.opt.MaxVersions) &&
+		it.nextVersion() {
+		it.numVersions++
 		return
 	}
 	it.iitr.Next()
@@ -341,12 +581,32 @@ func (it *Iterator) Next() {
 	return
 }
 
+// nextVersion moves to the next older version of the current key which is newer than SinceTs and
+// passes the MetaFilter, it returns false if there is no such version.
+func (it *Iterator) nextVersion() bool {
+	for it.iitr.NextVersion() {
+		if it.opt.SinceTs > 0 && it.iitr.Key().Version <= it.opt.SinceTs {
+			return false
+		}
+		it.updateItem()
+		if it.metaMatched() {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *Iterator) metaMatched() bool {
+	return it.opt.MetaFilter == nil || it.opt.MetaFilter(it.vs.Meta&AppMetaMask)
+}
+
 func (it *Iterator) updateItem() {
 	it.iitr.FillValue(&it.vs)
 	item := &it.itBuf
 	item.key = it.iitr.Key()
 	item.meta = it.vs.Meta
 	item.userMeta = it.vs.UserMeta
+	item.expiresAt = it.vs.ExpiresAt
 	item.vptr = it.vs.Value
 	it.item = item
 }
@@ -365,11 +625,21 @@ func (it *Iterator) parseItem() {
 				continue
 			}
 		}
+		if it.opt.SinceTs > 0 && iitr.Key().Version <= it.opt.SinceTs {
+			// The older versions are not newer than SinceTs either.
+			iitr.Next()
+			continue
+		}
 		it.updateItem()
-		if !it.opt.AllVersions && isDeleted(it.vs.Meta) {
+		if !it.opt.AllVersions && isDeletedOrExpired(it.vs.Meta, it.vs.ExpiresAt) {
+			iitr.Next()
+			continue
+		}
+		if !it.metaMatched() && (!it.opt.AllVersions || !it.nextVersion()) {
 			iitr.Next()
 			continue
 		}
+		it.numVersions = 1
 		return
 	}
 	it.item = nil
@@ -379,18 +649,39 @@ func isDeleted(meta byte) bool {
 	return meta&bitDelete > 0
 }
 
+func isDeletedOrExpired(meta byte, expiresAt uint64) bool {
+	if meta&bitDelete > 0 {
+		return true
+	}
+	if expiresAt == 0 {
+		return false
+	}
+	return expiresAt <= uint64(time.Now().Unix())
+}
+
 // Seek would seek to the provided key if present. If absent, it would seek to the next smallest key
 // greater than provided if iterating in the forward direction. Behavior would be reversed is
 // iterating backwards.
 func (it *Iterator) Seek(key []byte) {
+	if !it.acquire() {
+		return
+	}
+	defer it.release()
+	if len(it.cfPrefix) > 0 {
+		if len(key) == 0 {
+			it.rewind()
+			return
+		}
+		key = append(append(make([]byte, 0, len(it.cfPrefix)+len(key)), it.cfPrefix...), key...)
+	}
 	if !it.opt.Reverse {
 		it.iitr.Seek(key)
 	} else {
 		if len(key) == 0 {
-			it.iitr.Rewind()
-		} else {
-			it.iitr.Seek(key)
+			it.rewind()
+			return
 		}
+		it.iitr.Seek(key)
 	}
 	it.parseItem()
 }
@@ -399,8 +690,37 @@ func (it *Iterator) Seek(key []byte) {
 // smallest key if iterating forward, and largest if iterating backward. It does not keep track of
 // whether the cursor started with a Seek().
 func (it *Iterator) Rewind() {
-	it.iitr.Rewind()
+	if !it.acquire() {
+		return
+	}
+	defer it.release()
+	it.rewind()
+}
+
+func (it *Iterator) rewind() {
+	if len(it.opt.Prefix) == 0 {
+		it.iitr.Rewind()
+		it.parseItem()
+		return
+	}
+	if !it.opt.Reverse {
+		it.iitr.Seek(it.opt.Prefix)
+		it.parseItem()
+		return
+	}
+	end := prefixEnd(it.opt.Prefix)
+	if end == nil {
+		it.iitr.Rewind()
+		it.parseItem()
+		return
+	}
+	// The reversed seek stops at the largest key <= end, skip it if it is the end key itself.
+	it.iitr.Seek(end)
 	it.parseItem()
+	if it.item != nil && bytes.Equal(it.item.key.UserKey, end) {
+		it.iitr.Next()
+		it.parseItem()
+	}
 }
 
 func (it *Iterator) SetAllVersions(allVersions bool) {
@@ -0,0 +1,111 @@
+package badger
+
+import (
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pingcap/badger/y"
+	"go.uber.org/zap"
+)
+
+// LeakedIterator describes an iterator not closed for longer than Options.IteratorLeakTimeout.
+type LeakedIterator struct {
+	// Age is the time since the iterator was created.
+	Age time.Duration
+	// Stack is the stack trace of the goroutine which created the iterator.
+	Stack string
+}
+
+// iteratorTracker tracks the open iterators when Options.IteratorLeakTimeout is set.
+type iteratorTracker struct {
+	timeout time.Duration
+
+	mu   sync.Mutex
+	open map[*Iterator]*openIterator
+}
+
+type openIterator struct {
+	created  time.Time
+	stack    []byte
+	reported bool
+}
+
+func newIteratorTracker(timeout time.Duration) *iteratorTracker {
+	if timeout <= 0 {
+		return nil
+	}
+	return &iteratorTracker{timeout: timeout, open: map[*Iterator]*openIterator{}}
+}
+
+// add records the stack trace of the iterator being created, it does nothing if the tracker is nil.
+func (t *iteratorTracker) add(it *Iterator) {
+	if t == nil {
+		return
+	}
+	oi := &openIterator{created: time.Now(), stack: debug.Stack()}
+	t.mu.Lock()
+	t.open[it] = oi
+	t.mu.Unlock()
+}
+
+func (t *iteratorTracker) remove(it *Iterator) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.open, it)
+	t.mu.Unlock()
+}
+
+// leaked returns the iterators open for longer than the timeout, the oldest first. If unreported
+// is true, only the iterators not returned by the previous calls with unreported set are returned.
+func (t *iteratorTracker) leaked(unreported bool) []LeakedIterator {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	var leaks []LeakedIterator
+	t.mu.Lock()
+	for _, oi := range t.open {
+		age := now.Sub(oi.created)
+		if age < t.timeout || (unreported && oi.reported) {
+			continue
+		}
+		if unreported {
+			oi.reported = true
+		}
+		leaks = append(leaks, LeakedIterator{Age: age, Stack: string(oi.stack)})
+	}
+	t.mu.Unlock()
+	sort.Slice(leaks, func(i, j int) bool {
+		return leaks[i].Age > leaks[j].Age
+	})
+	return leaks
+}
+
+// LeakedIterators returns the iterators not closed for longer than Options.IteratorLeakTimeout,
+// the oldest first. It returns nil if IteratorLeakTimeout is not set.
+func (db *DB) LeakedIterators() []LeakedIterator {
+	return db.iterTracker.leaked(false)
+}
+
+// runIteratorLeakCheck logs the leaked iterators once every IteratorLeakTimeout, an iterator is
+// only logged once.
+func (db *DB) runIteratorLeakCheck(c *y.Closer) {
+	defer c.Done()
+	ticker := time.NewTicker(db.iterTracker.timeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, leak := range db.iterTracker.leaked(true) {
+				db.opt.Logger.Warn("iterator not closed", zap.Duration("age", leak.Age),
+					zap.String("stack", leak.Stack))
+			}
+		case <-c.HasBeenClosed():
+			return
+		}
+	}
+}
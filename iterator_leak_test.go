@@ -0,0 +1,49 @@
+package badger
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestIteratorLeak(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	core, logs := observer.New(zap.WarnLevel)
+	opts := getTestOptions(dir)
+	opts.Logger = zap.New(core)
+	opts.IteratorLeakTimeout = 50 * time.Millisecond
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	txn := db.NewTransaction(false)
+	leaked := txn.NewIterator(DefaultIteratorOptions)
+	txn.NewIterator(DefaultIteratorOptions).Close()
+	keyIt := txn.NewKeyIterator([]byte("key"), DefaultIteratorOptions)
+	keyIt.Close()
+	require.Empty(t, db.LeakedIterators())
+
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("iterator not closed").Len() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	leaks := db.LeakedIterators()
+	require.Len(t, leaks, 1)
+	require.True(t, leaks[0].Age >= opts.IteratorLeakTimeout)
+	require.Contains(t, leaks[0].Stack, "TestIteratorLeak")
+	entry := logs.FilterMessage("iterator not closed").All()[0]
+	require.Contains(t, entry.ContextMap()["stack"], "TestIteratorLeak")
+
+	// A leaked iterator is only logged once.
+	time.Sleep(3 * opts.IteratorLeakTimeout)
+	require.Equal(t, 1, logs.FilterMessage("iterator not closed").Len())
+	leaked.Close()
+	require.Empty(t, db.LeakedIterators())
+	txn.Discard()
+	require.NoError(t, db.Close())
+}
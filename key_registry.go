@@ -0,0 +1,256 @@
+package badger
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pingcap/badger/options"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// KeyRegistryFilename is the file storing the data keys encrypted by the master key.
+	KeyRegistryFilename        = "KEYREGISTRY"
+	keyRegistryRewriteFilename = "KEYREGISTRY-REWRITE"
+)
+
+// sanityText is encrypted by the master key and stored in the key registry, so a wrong master key
+// can be detected on open.
+var sanityText = []byte("Hello Badger")
+
+/*
+data format of key registry file:
+
+	/ iv(16) / encrypted sanityText / dataKey ... /
+
+dataKey:
+
+	/ length(4) / crc32(4) / keyID(8) / iv(16) / encrypted key /
+*/
+type keyRegistry struct {
+	sync.RWMutex
+	dir       string
+	masterKey []byte
+	dataKeys  map[uint64]*options.DataKey
+	latest    *options.DataKey
+}
+
+func validEncryptionKey(key []byte) bool {
+	switch len(key) {
+	case 16, 24, 32:
+		return true
+	}
+	return false
+}
+
+// openKeyRegistry loads the data keys from the key registry in dir. If the registry doesn't exist
+// and masterKey is set, a new registry is created with a new data key. Encryption is disabled if
+// masterKey is empty, and it's an error to open an encrypted DB without the master key.
+func openKeyRegistry(dir string, masterKey []byte, readOnly bool) (*keyRegistry, error) {
+	if len(masterKey) > 0 && !validEncryptionKey(masterKey) {
+		return nil, ErrInvalidEncryptionKey
+	}
+	kr := &keyRegistry{
+		dir:       dir,
+		masterKey: masterKey,
+		dataKeys:  map[uint64]*options.DataKey{},
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, KeyRegistryFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(masterKey) == 0 || readOnly {
+			return kr, nil
+		}
+		if _, err = kr.newDataKey(len(masterKey)); err != nil {
+			return nil, err
+		}
+		return kr, kr.write(masterKey)
+	}
+	if len(masterKey) == 0 {
+		return nil, ErrEncryptionKeyMismatch
+	}
+	if err = kr.decode(data); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+func (kr *keyRegistry) decode(data []byte) error {
+	if len(data) < y.IVSize+len(sanityText) {
+		return errors.New("key registry is corrupted")
+	}
+	sanity := make([]byte, len(sanityText))
+	if err := y.XORBlock(sanity, data[y.IVSize:y.IVSize+len(sanityText)], kr.masterKey, data[:y.IVSize]); err != nil {
+		return err
+	}
+	if !bytes.Equal(sanity, sanityText) {
+		return ErrEncryptionKeyMismatch
+	}
+	data = data[y.IVSize+len(sanityText):]
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return errors.New("key registry is corrupted")
+		}
+		length := binary.BigEndian.Uint32(data)
+		checksum := binary.BigEndian.Uint32(data[4:])
+		data = data[8:]
+		if uint32(len(data)) < length || length < 8+y.IVSize {
+			return errors.New("key registry is corrupted")
+		}
+		record := data[:length]
+		data = data[length:]
+		if crc32.Checksum(record, y.CastagnoliCrcTable) != checksum {
+			return errors.New("key registry checksum mismatch")
+		}
+		dk := &options.DataKey{
+			ID:  binary.BigEndian.Uint64(record),
+			Key: make([]byte, len(record)-8-y.IVSize),
+		}
+		if err := y.XORBlock(dk.Key, record[8+y.IVSize:], kr.masterKey, record[8:8+y.IVSize]); err != nil {
+			return err
+		}
+		kr.dataKeys[dk.ID] = dk
+		if kr.latest == nil || dk.ID > kr.latest.ID {
+			kr.latest = dk
+		}
+	}
+	return nil
+}
+
+// newDataKey generates a data key of size bytes, it becomes the latest data key.
+func (kr *keyRegistry) newDataKey(size int) (*options.DataKey, error) {
+	dk := &options.DataKey{
+		ID:  1,
+		Key: make([]byte, size),
+	}
+	if kr.latest != nil {
+		dk.ID = kr.latest.ID + 1
+	}
+	if _, err := rand.Read(dk.Key); err != nil {
+		return nil, err
+	}
+	kr.dataKeys[dk.ID] = dk
+	kr.latest = dk
+	return dk, nil
+}
+
+// write rewrites the key registry with the data keys encrypted by masterKey.
+func (kr *keyRegistry) write(masterKey []byte) error {
+	iv, err := y.GenerateIV()
+	if err != nil {
+		return err
+	}
+	buf := append(iv, sanityText...)
+	if err = y.XORBlock(buf[y.IVSize:], buf[y.IVSize:], masterKey, iv); err != nil {
+		return err
+	}
+	for id := uint64(1); id <= kr.latest.ID; id++ {
+		dk, ok := kr.dataKeys[id]
+		if !ok {
+			continue
+		}
+		if iv, err = y.GenerateIV(); err != nil {
+			return err
+		}
+		record := make([]byte, 8, 8+y.IVSize+len(dk.Key))
+		binary.BigEndian.PutUint64(record, dk.ID)
+		record = append(record, iv...)
+		record = append(record, dk.Key...)
+		if err = y.XORBlock(record[8+y.IVSize:], record[8+y.IVSize:], masterKey, iv); err != nil {
+			return err
+		}
+		var lenCrcBuf [8]byte
+		binary.BigEndian.PutUint32(lenCrcBuf[:], uint32(len(record)))
+		binary.BigEndian.PutUint32(lenCrcBuf[4:], crc32.Checksum(record, y.CastagnoliCrcTable))
+		buf = append(buf, lenCrcBuf[:]...)
+		buf = append(buf, record...)
+	}
+
+	rewritePath := filepath.Join(kr.dir, keyRegistryRewriteFilename)
+	fp, err := y.OpenTruncFile(rewritePath, false)
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Write(buf); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(rewritePath, filepath.Join(kr.dir, KeyRegistryFilename)); err != nil {
+		return err
+	}
+	return syncDir(kr.dir)
+}
+
+// RotateEncryptionKey replaces the master key with newKey, the DB must be opened with newKey
+// after it returns. A new data key is generated to encrypt the new files, the existing files are
+// not rewritten, they are decrypted by the old data keys which are encrypted by newKey.
+// If the DB is not encrypted, the files created after the rotation are encrypted.
+func (db *DB) RotateEncryptionKey(newKey []byte) error {
+	if db.opt.ReadOnly || db.opt.RemoteCompactionAddr != "" {
+		return ErrInvalidRequest
+	}
+	if !validEncryptionKey(newKey) {
+		return ErrInvalidEncryptionKey
+	}
+	if err := db.keyRegistry.rotate(newKey); err != nil {
+		return err
+	}
+	log.Info("encryption key rotated", zap.Uint64("data key", db.keyRegistry.LatestDataKey().ID))
+	return nil
+}
+
+// rotate replaces the master key with newKey and generates a new data key for the new data.
+// The old data keys are kept in the registry encrypted by newKey, so the existing data can still
+// be decrypted.
+func (kr *keyRegistry) rotate(newKey []byte) error {
+	kr.Lock()
+	defer kr.Unlock()
+	oldLatest := kr.latest
+	dk, err := kr.newDataKey(len(newKey))
+	if err != nil {
+		return err
+	}
+	if err = kr.write(newKey); err != nil {
+		delete(kr.dataKeys, dk.ID)
+		kr.latest = oldLatest
+		return err
+	}
+	kr.masterKey = newKey
+	return nil
+}
+
+// LatestDataKey implements options.KeyRegistry.
+func (kr *keyRegistry) LatestDataKey() *options.DataKey {
+	kr.RLock()
+	defer kr.RUnlock()
+	return kr.latest
+}
+
+// DataKey implements options.KeyRegistry.
+func (kr *keyRegistry) DataKey(id uint64) (*options.DataKey, error) {
+	kr.RLock()
+	defer kr.RUnlock()
+	dk, ok := kr.dataKeys[id]
+	if !ok {
+		return nil, errors.Errorf("data key %d not found, the DB may be opened without the encryption key", id)
+	}
+	return dk, nil
+}
@@ -0,0 +1,138 @@
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.EncryptionKey = bytes.Repeat([]byte{7}, 32)
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("secret-key-%06d", i))
+	}
+	// The even values are stored in blob files, the odd values are stored in the tables.
+	val := func(i int) []byte {
+		if i%2 == 0 {
+			return []byte(fmt.Sprintf("secret-value-%0100d", i))
+		}
+		return []byte(fmt.Sprintf("secret-value-%d", i))
+	}
+	n := 5000
+	for i := 0; i < n; i += 100 {
+		txn := db.NewTransaction(true)
+		for j := i; j < i+100; j++ {
+			require.NoError(t, txn.SetWithMetaSlice(key(j), val(j), []byte("secret")))
+		}
+		require.NoError(t, txn.Commit())
+	}
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				item, err := txn.Get(key(i))
+				require.NoError(t, err)
+				require.Equal(t, val(i), getItemValue(t, item))
+				require.Equal(t, []byte("secret"), item.UserMeta())
+			}
+			return nil
+		}))
+	}
+	check(db)
+	require.NoError(t, db.Close())
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var hasBlob bool
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(data, []byte("secret")), file.Name())
+		if filepath.Ext(file.Name()) == blobFileSuffix {
+			hasBlob = true
+		}
+	}
+	require.True(t, hasBlob)
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+
+	opts.EncryptionKey = bytes.Repeat([]byte{8}, 32)
+	_, err = Open(opts)
+	require.Equal(t, ErrEncryptionKeyMismatch, err)
+	opts.EncryptionKey = nil
+	_, err = Open(opts)
+	require.Equal(t, ErrEncryptionKeyMismatch, err)
+	opts.EncryptionKey = []byte("short")
+	_, err = Open(opts)
+	require.Equal(t, ErrInvalidEncryptionKey, err)
+}
+
+func TestRotateEncryptionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	oldKey := bytes.Repeat([]byte{7}, 16)
+	opts.EncryptionKey = oldKey
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%06d", i))
+	}
+	val := func(i int) []byte {
+		return []byte(fmt.Sprintf("%0100d", i))
+	}
+	write := func(start, end int) {
+		for i := start; i < end; i += 100 {
+			txn := db.NewTransaction(true)
+			for j := i; j < i+100; j++ {
+				require.NoError(t, txn.Set(key(j), val(j)))
+			}
+			require.NoError(t, txn.Commit())
+		}
+		db.flushMemTable().Wait()
+	}
+	n := 2000
+	write(0, n)
+
+	require.Equal(t, ErrInvalidEncryptionKey, db.RotateEncryptionKey([]byte("short")))
+	newKey := bytes.Repeat([]byte{9}, 32)
+	require.NoError(t, db.RotateEncryptionKey(newKey))
+	require.EqualValues(t, 2, db.keyRegistry.LatestDataKey().ID)
+	require.Len(t, db.keyRegistry.LatestDataKey().Key, 32)
+	write(n, 2*n)
+	require.NoError(t, db.Close())
+
+	opts.EncryptionKey = oldKey
+	_, err = Open(opts)
+	require.Equal(t, ErrEncryptionKeyMismatch, err)
+
+	opts.EncryptionKey = newKey
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Len(t, db.keyRegistry.dataKeys, 2)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < 2*n; i++ {
+			item, err := txn.Get(key(i))
+			require.NoError(t, err)
+			require.Equal(t, val(i), getItemValue(t, item))
+		}
+		return nil
+	}))
+}
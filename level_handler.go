@@ -17,10 +17,13 @@
 package badger
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pingcap/badger/epoch"
 	"github.com/pingcap/badger/table"
@@ -40,12 +43,15 @@ type levelHandler struct {
 	tables    []table.Table
 	totalSize int64
 
-	// The following are initialized once and const.
-	level        int
-	strLevel     string
+	// maxTotalSize is the target size of the level, it is updated atomically if the target sizes
+	// are dynamic.
 	maxTotalSize int64
-	db           *DB
-	metrics      *y.LevelMetricsSet
+
+	// The following are initialized once and const.
+	level    int
+	strLevel string
+	db       *DB
+	metrics  *y.LevelMetricsSet
 }
 
 func (s *levelHandler) getTotalSize() int64 {
@@ -54,6 +60,10 @@ func (s *levelHandler) getTotalSize() int64 {
 	return s.totalSize
 }
 
+func (s *levelHandler) getMaxTotalSize() int64 {
+	return atomic.LoadInt64(&s.maxTotalSize)
+}
+
 // initTables replaces s.tables with given tables. This is done during loading.
 func (s *levelHandler) initTables(tables []table.Table) {
 	s.Lock()
@@ -143,6 +153,23 @@ func sortTables(tables []table.Table) {
 	})
 }
 
+// replaceTable replaces the table with a table of the same ID and key range, it returns false if the
+// table is not in the level.
+func (s *levelHandler) replaceTable(old, new table.Table) bool {
+	s.Lock()
+	defer s.Unlock()
+	for i, t := range s.tables {
+		if t == old {
+			// Make a copy as iterators might be keeping a slice of tables.
+			tables := append([]table.Table{}, s.tables...)
+			tables[i] = new
+			s.tables = tables
+			return true
+		}
+	}
+	return false
+}
+
 // replaceTables will replace tables[left:right] with newTables. Note this EXCLUDES tables[right].
 // You must call decr() to delete the old tables _after_ writing the update to the manifest.
 func (s *levelHandler) replaceTables(newTables []table.Table, cd *CompactDef, guard *epoch.Guard) {
@@ -309,14 +336,18 @@ func (s *levelHandler) getLevelNTable(key y.Key) table.Table {
 }
 
 // get returns value for a given key or the key after that. If not found, return nil.
-func (s *levelHandler) get(key y.Key, keyHash uint64) y.ValueStruct {
+func (s *levelHandler) get(ctx context.Context, key y.Key, keyHash uint64) y.ValueStruct {
+	ctx, span := s.db.startSpan(ctx, "badger.level_get")
+	defer span.End()
+	span.SetAttribute("level", s.level)
 	tables := s.getTablesForKey(key)
-	return s.getInTables(key, keyHash, tables)
+	span.SetAttribute("tables", len(tables))
+	return s.getInTables(ctx, key, keyHash, tables)
 }
 
-func (s *levelHandler) getInTables(key y.Key, keyHash uint64, tables []table.Table) y.ValueStruct {
+func (s *levelHandler) getInTables(ctx context.Context, key y.Key, keyHash uint64, tables []table.Table) y.ValueStruct {
 	for _, table := range tables {
-		result := s.getInTable(key, keyHash, table)
+		result := s.getInTable(ctx, key, keyHash, table)
 		if result.Valid() {
 			return result
 		}
@@ -324,10 +355,16 @@ func (s *levelHandler) getInTables(key y.Key, keyHash uint64, tables []table.Tab
 	return y.ValueStruct{}
 }
 
-func (s *levelHandler) getInTable(key y.Key, keyHash uint64, table table.Table) y.ValueStruct {
+func (s *levelHandler) getInTable(ctx context.Context, key y.Key, keyHash uint64, t table.Table) y.ValueStruct {
 	s.metrics.NumLSMGets.Inc()
+	var result y.ValueStruct
+	var err error
 	// TODO: error handling here
-	result, err := table.Get(key, keyHash)
+	if tg, ok := t.(table.TracedGetter); ok && s.db.opt.Tracer != nil {
+		result, err = tg.GetTraced(ctx, s.db.opt.Tracer, key, keyHash)
+	} else {
+		result, err = t.Get(key, keyHash)
+	}
 	if err != nil {
 		log.Error("get data in table failed", zap.Error(err))
 	}
@@ -347,7 +384,9 @@ func (s *levelHandler) multiGet(pairs []keyValuePair) {
 }
 
 func (s *levelHandler) multiGetLevel0(pairs []keyValuePair, tables []table.Table) {
+	var batch []*keyValuePair
 	for _, table := range tables {
+		batch = batch[:0]
 		for i := range pairs {
 			pair := &pairs[i]
 			if pair.found {
@@ -356,35 +395,62 @@ func (s *levelHandler) multiGetLevel0(pairs []keyValuePair, tables []table.Table
 			if pair.key.Compare(table.Smallest()) < 0 || pair.key.Compare(table.Biggest()) > 0 {
 				continue
 			}
-			for {
-				val := s.getInTable(pair.key, pair.hash, table)
-				if val.Valid() {
-					pair.val = val
-					pair.found = true
-				}
-				break
-			}
+			batch = append(batch, pair)
 		}
+		s.multiGetInTable(batch, table)
 	}
 }
 
 func (s *levelHandler) multiGetLevelN(pairs []keyValuePair, tables []table.Table) {
+	var batch []*keyValuePair
+	var batchTable table.Table
 	for i := range pairs {
 		pair := &pairs[i]
-		if pair.found {
+		if pair.found || tables[i] == nil {
 			continue
 		}
-		table := tables[i]
-		if table == nil {
-			continue
+		if tables[i] != batchTable {
+			s.multiGetInTable(batch, batchTable)
+			batch, batchTable = batch[:0], tables[i]
 		}
-		for {
-			val := s.getInTable(pair.key, pair.hash, table)
-			if val.Valid() {
+		batch = append(batch, pair)
+	}
+	s.multiGetInTable(batch, batchTable)
+}
+
+// multiGetInTable looks up the pairs sorted by key in the table. The lookups are batched if the
+// table implements table.MultiGetter, so the keys in the same block share the block load.
+func (s *levelHandler) multiGetInTable(pairs []*keyValuePair, t table.Table) {
+	if len(pairs) == 0 {
+		return
+	}
+	mg, ok := t.(table.MultiGetter)
+	if !ok || len(pairs) == 1 {
+		for _, pair := range pairs {
+			if val := s.getInTable(context.Background(), pair.key, pair.hash, t); val.Valid() {
 				pair.val = val
 				pair.found = true
 			}
-			break
+		}
+		return
+	}
+	keys := make([]y.Key, len(pairs))
+	hashes := make([]uint64, len(pairs))
+	vals := make([]y.ValueStruct, len(pairs))
+	for i, pair := range pairs {
+		keys[i] = pair.key
+		hashes[i] = pair.hash
+	}
+	s.metrics.NumLSMGets.Add(float64(len(pairs)))
+	if err := mg.MultiGet(keys, hashes, vals); err != nil {
+		log.Error("multi get data in table failed", zap.Error(err))
+	}
+	for i, pair := range pairs {
+		if vals[i].Valid() {
+			pair.val = vals[i]
+			pair.found = true
+		} else {
+			s.metrics.NumLSMBloomFalsePositive.Inc()
 		}
 	}
 }
@@ -404,13 +470,40 @@ func (s *levelHandler) appendIterators(iters []y.Iterator, opts *IteratorOptions
 				overlapTables = append(overlapTables, t)
 			}
 		}
-		return appendIteratorsReversed(iters, overlapTables, opts.Reverse)
+		return appendIteratorsReversed(iters, overlapTables, opts.Reverse, opts.ReadaheadBlocks)
 	}
 	overlapTables := opts.OverlapTables(s.tables)
 	if len(overlapTables) == 0 {
 		return iters
 	}
-	return append(iters, table.NewConcatIterator(overlapTables, opts.Reverse))
+	it := table.NewConcatIterator(overlapTables, opts.Reverse)
+	it.SetReadahead(opts.ReadaheadBlocks)
+	return append(iters, it)
+}
+
+// appendKeyIterators appends the iterators of the tables which may contain the versions of the key.
+func (s *levelHandler) appendKeyIterators(iters []y.Iterator, key []byte, keyHash uint64, reversed bool) []y.Iterator {
+	s.RLock()
+	defer s.RUnlock()
+
+	start, end := y.KeyWithTs(key, math.MaxUint64), y.KeyWithTs(key, 0)
+	var tables []table.Table
+	if s.level == 0 {
+		tables = s.getLevel0Tables()
+	} else {
+		left, right := getTablesInRange(s.tables, start, end)
+		tables = s.tables[left:right]
+	}
+	for _, t := range tables {
+		if !t.HasOverlap(start, end, true) {
+			continue
+		}
+		if kf, ok := t.(table.KeyFilter); ok && !kf.MayContainKey(key, keyHash) {
+			continue
+		}
+		iters = append(iters, table.NewConcatIterator([]table.Table{t}, reversed))
+	}
+	return iters
 }
 
 type levelHandlerRLocked struct{}
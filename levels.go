@@ -18,11 +18,17 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dgryski/go-farm"
 	"github.com/ncw/directio"
 	"github.com/pingcap/badger/epoch"
 	"github.com/pingcap/badger/options"
@@ -31,8 +37,8 @@ import (
 	"github.com/pingcap/badger/table/sstable"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
-	"github.com/pingcap/log"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 )
 
 type levelsController struct {
@@ -45,7 +51,13 @@ type levelsController struct {
 
 	cstatus compactStatus
 
+	// limiters throttle the writes to every level, see options.LevelRateLimits.
+	limiters []*rate.Limiter
+
 	opt options.TableBuilderOptions
+
+	// recoveredTables is the number of the tables added to level 0 by repairManifest.
+	recoveredTables int
 }
 
 var (
@@ -57,9 +69,10 @@ var (
 // referenced by the manifest.  idMap is a set of table file id's that were read from the directory
 // listing.
 func revertToManifest(kv *DB, mf *Manifest, idMap map[uint64]struct{}) error {
-	// 1. Check all files in manifest exist.
+	// 1. Check all files in manifest exist, the missing tables are skipped by newLevelsController if
+	// RecoveryMode is SkipCorruptTables.
 	for id := range mf.Tables {
-		if _, ok := idMap[id]; !ok {
+		if _, ok := idMap[id]; !ok && kv.opt.RecoveryMode != options.SkipCorruptTables {
 			return fmt.Errorf("file does not exist for table %d", id)
 		}
 	}
@@ -67,17 +80,62 @@ func revertToManifest(kv *DB, mf *Manifest, idMap map[uint64]struct{}) error {
 	// 2. Delete files that shouldn't exist.
 	for id := range idMap {
 		if _, ok := mf.Tables[id]; !ok {
-			log.Info("table file not referenced in MANIFEST", zap.Uint64("id", id))
+			kv.opt.Logger.Info("table file not referenced in MANIFEST", zap.Uint64("id", id))
 			filename := sstable.NewFilename(id, kv.opt.Dir)
 			if err := os.Remove(filename); err != nil {
 				return y.Wrapf(err, "While removing table %d", id)
 			}
+			// The table may be offloaded, the deletion is lost if the DB is closed before the
+			// table is deleted.
+			if kv.opt.ColdStorage != nil {
+				if err := kv.opt.ColdStorage.Delete(sstable.IDToFilename(id)); err != nil {
+					return y.Wrapf(err, "While removing table %d from the cold storage", id)
+				}
+			}
 		}
 	}
 
 	return nil
 }
 
+// repairManifest is used instead of revertToManifest if RepairManifest is set. The tables whose files
+// are missing are removed from the manifest, and the table files not referenced by the manifest
+// are added to level 0 in the order of their IDs, or removed if they can't be opened.
+func repairManifest(kv *DB, mf *Manifest, idMap map[uint64]struct{}) (recovered int, err error) {
+	var changes []*protos.ManifestChange
+	for id := range mf.Tables {
+		if _, ok := idMap[id]; !ok {
+			kv.opt.Logger.Warn("remove the missing table from MANIFEST", zap.Uint64("id", id))
+			changes = append(changes, newDeleteChange(id))
+		}
+	}
+	for id := range idMap {
+		if _, ok := mf.Tables[id]; ok {
+			continue
+		}
+		filename := sstable.NewFilename(id, kv.opt.Dir)
+		t, err := kv.openTable(filename)
+		if err != nil {
+			kv.opt.Logger.Warn("remove the corrupt table not referenced in MANIFEST", zap.Uint64("id", id), zap.Error(err))
+			if err = os.Remove(filename); err != nil {
+				return 0, y.Wrapf(err, "While removing table %d", id)
+			}
+			continue
+		}
+		_ = t.Close()
+		kv.opt.Logger.Warn("add the table not referenced in MANIFEST to level 0", zap.Uint64("id", id))
+		changes = append(changes, newCreateChange(id, 0))
+		recovered++
+	}
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	if err = kv.manifest.addChanges(changes, nil); err != nil {
+		return 0, err
+	}
+	return recovered, applyChangeSet(mf, &protos.ManifestChangeSet{Changes: changes})
+}
+
 func newLevelsController(kv *DB, mf *Manifest, mgr *epoch.ResourceManager, opt options.TableBuilderOptions) (*levelsController, error) {
 	y.Assert(kv.opt.NumLevelZeroTablesStall > kv.opt.NumLevelZeroTables)
 	s := &levelsController{
@@ -87,6 +145,7 @@ func newLevelsController(kv *DB, mf *Manifest, mgr *epoch.ResourceManager, opt o
 		resourceMgr: mgr,
 	}
 	s.cstatus.levels = make([]*levelCompactStatus, kv.opt.TableBuilderOptions.MaxLevels)
+	s.cstatus.finished = make(chan struct{})
 
 	for i := 0; i < kv.opt.TableBuilderOptions.MaxLevels; i++ {
 		s.levels[i] = newLevelHandler(kv, i)
@@ -100,23 +159,45 @@ func newLevelsController(kv *DB, mf *Manifest, mgr *epoch.ResourceManager, opt o
 		}
 		s.cstatus.levels[i] = new(levelCompactStatus)
 	}
+	s.initLimiters()
 
 	// Compare manifest against directory, check for existent/non-existent files, and remove.
-	if err := revertToManifest(kv, mf, getIDMap(kv.opt.Dir)); err != nil {
+	if kv.opt.RepairManifest {
+		var err error
+		if s.recoveredTables, err = repairManifest(kv, mf, getIDMap(kv.opt.Dir)); err != nil {
+			return nil, err
+		}
+	} else if err := revertToManifest(kv, mf, getIDMap(kv.opt.Dir)); err != nil {
 		return nil, err
 	}
 
 	// Some files may be deleted. Let's reload.
 	tables := make([][]table.Table, kv.opt.TableBuilderOptions.MaxLevels)
 	var maxFileID uint64
+	var skipped []*protos.ManifestChange
 	for fileID, tableManifest := range mf.Tables {
 		fname := sstable.NewFilename(fileID, kv.opt.Dir)
 		var flags uint32 = y.Sync
 		if kv.opt.ReadOnly {
 			flags |= y.ReadOnly
 		}
+		if fileID > maxFileID {
+			maxFileID = fileID
+		}
 
-		t, err := sstable.OpenTable(fname, kv.blockCache, kv.indexCache)
+		t, err := kv.openTable(fname)
+		if err != nil && kv.opt.RecoveryMode == options.SkipCorruptTables {
+			kv.opt.Logger.Warn("skip the corrupt table, the data in it is lost", zap.Uint64("id", fileID),
+				zap.Uint8("level", tableManifest.Level), zap.Error(err))
+			if !kv.opt.ReadOnly {
+				if err = quarantineTable(kv.opt.Dir, fileID); err != nil {
+					closeAllTables(tables)
+					return nil, err
+				}
+			}
+			skipped = append(skipped, newDeleteChange(fileID))
+			continue
+		}
 		if err != nil {
 			closeAllTables(tables)
 			return nil, errors.Wrapf(err, "Opening table: %q", fname)
@@ -124,9 +205,15 @@ func newLevelsController(kv *DB, mf *Manifest, mgr *epoch.ResourceManager, opt o
 
 		level := tableManifest.Level
 		tables[level] = append(tables[level], t)
-
-		if fileID > maxFileID {
-			maxFileID = fileID
+	}
+	if len(skipped) > 0 && !kv.opt.ReadOnly {
+		err := kv.manifest.addChanges(skipped, nil)
+		if err == nil {
+			err = applyChangeSet(mf, &protos.ManifestChangeSet{Changes: skipped})
+		}
+		if err != nil {
+			closeAllTables(tables)
+			return nil, err
 		}
 	}
 	s.nextFileID = maxFileID + 1
@@ -139,6 +226,7 @@ func newLevelsController(kv *DB, mf *Manifest, mgr *epoch.ResourceManager, opt o
 		_ = s.cleanupLevels()
 		return nil, errors.Wrap(err, "Level validation")
 	}
+	s.updateLevelTargets()
 
 	// Sync directory (because we have at least removed some files, or previously created the
 	// manifest file).
@@ -150,6 +238,27 @@ func newLevelsController(kv *DB, mf *Manifest, mgr *epoch.ResourceManager, opt o
 	return s, nil
 }
 
+// quarantineDir is the directory in Dir where the files of the corrupt tables are moved to if
+// RecoveryMode is SkipCorruptTables.
+const quarantineDir = "quarantine"
+
+// quarantineTable moves the files of a table into the quarantine directory, so they are kept for
+// inspection but not opened again.
+func quarantineTable(dir string, id uint64) error {
+	qdir := filepath.Join(dir, quarantineDir)
+	if err := os.MkdirAll(qdir, 0700); err != nil {
+		return err
+	}
+	fname := sstable.NewFilename(id, dir)
+	for _, name := range []string{fname, sstable.IndexFilename(fname)} {
+		err := os.Rename(name, filepath.Join(qdir, filepath.Base(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 // Closes the tables, for cleanup in newLevelsController.  (We Close() instead of using DecrRef()
 // because that would delete the underlying files.)  We ignore errors, which is OK because tables
 // are read-only.
@@ -228,7 +337,28 @@ func (lc *levelsController) isL0Compactable() bool {
 // which are currently being compacted so that we treat them as already having started being
 // compacted (because they have been, yet their size is already counted in getTotalSize).
 func (l *levelHandler) isCompactable(deltaSize int64) bool {
-	return l.getTotalSize() >= l.maxTotalSize+deltaSize
+	return l.getTotalSize() >= l.getMaxTotalSize()+deltaSize
+}
+
+// updateLevelTargets derives the target sizes of the levels from the size of the bottom level if
+// DynamicLevelSize is enabled, so every level holds about 1/LevelSizeMultiplier of the data in the
+// level below it however large the DB grows. The targets are never smaller than LevelOneSize.
+func (lc *levelsController) updateLevelTargets() {
+	if !lc.kv.opt.DynamicLevelSize {
+		return
+	}
+	multiplier := int64(lc.opt.LevelSizeMultiplier)
+	bottom := len(lc.levels) - 1
+	// The bottom level is never compacted.
+	atomic.StoreInt64(&lc.levels[bottom].maxTotalSize, math.MaxInt64)
+	target := lc.levels[bottom].getTotalSize()
+	for i := bottom - 1; i >= 1; i-- {
+		target /= multiplier
+		if target < lc.kv.opt.LevelOneSize {
+			target = lc.kv.opt.LevelOneSize
+		}
+		atomic.StoreInt64(&lc.levels[i].maxTotalSize, target)
+	}
 }
 
 type compactionPriority struct {
@@ -242,6 +372,8 @@ func (lc *levelsController) pickCompactLevels() (prios []compactionPriority) {
 	// This function must use identical criteria for guaranteeing compaction's progress that
 	// addLevel0Table uses.
 
+	lc.updateLevelTargets()
+
 	// cstatus is checked to see if level 0's tables are already being compacted
 	if !lc.cstatus.overlapsWith(0, infRange) && lc.isL0Compactable() {
 		pri := compactionPriority{
@@ -260,7 +392,7 @@ func (lc *levelsController) pickCompactLevels() (prios []compactionPriority) {
 		if l.isCompactable(deltaSize) {
 			pri := compactionPriority{
 				level: levelNum,
-				score: float64(l.getTotalSize()-deltaSize) / float64(l.maxTotalSize),
+				score: float64(l.getTotalSize()-deltaSize) / float64(l.getMaxTotalSize()),
 			}
 			prios = append(prios, pri)
 		}
@@ -372,7 +504,27 @@ func (lc *levelsController) prepareCompactionDef(cd *CompactDef) {
 	cd.Opt = lc.opt
 	cd.Dir = lc.kv.opt.Dir
 	cd.AllocIDFunc = lc.reserveFileID
-	cd.Limiter = lc.kv.limiter
+	cd.Limiter = lc.limiters[cd.Level+1]
+}
+
+func (lc *levelsController) initLimiters() {
+	lc.limiters = make([]*rate.Limiter, lc.opt.MaxLevels)
+	for i := range lc.limiters {
+		lc.limiters[i] = lc.kv.limiter
+		if i >= len(lc.opt.LevelRateLimits) {
+			continue
+		}
+		if limit := lc.opt.LevelRateLimits[i]; limit > 0 {
+			// The writer waits for a whole write buffer at once, so the burst must hold it.
+			burst := limit
+			if burst < lc.opt.WriteBufferSize {
+				burst = lc.opt.WriteBufferSize
+			}
+			lc.limiters[i] = rate.NewLimiter(rate.Limit(limit), burst)
+		} else if limit < 0 {
+			lc.limiters[i] = nil
+		}
+	}
 }
 
 func (lc *levelsController) getCompactor(cd *CompactDef) compactor {
@@ -412,9 +564,12 @@ func CompactTables(cd *CompactDef, stats *y.CompactionStats, discardStats *Disca
 
 	skippedTbls := cd.SkippedTbls
 	splitHints := cd.splitHints
+	rewriter, _ := cd.Filter.(CompactionValueRewriter)
 
 	var lastKey, skipKey y.Key
 	var builder *sstable.Builder
+	// vs is filled by the iterator in place, so the value is not copied at every iterator layer.
+	var vs y.ValueStruct
 	for it.Valid() {
 		var fd *os.File
 		if !cd.InMemory {
@@ -435,7 +590,7 @@ func CompactTables(cd *CompactDef, stats *y.CompactionStats, discardStats *Disca
 		guard := searchGuard(it.Key().UserKey, cd.Guards)
 		for ; it.Valid(); y.NextAllVersion(it) {
 			stats.KeysRead++
-			vs := it.Value()
+			it.FillValue(&vs)
 			key := it.Key()
 			kvSize := int(vs.EncodedSize()) + key.Len()
 			stats.BytesRead += kvSize
@@ -485,6 +640,13 @@ func CompactTables(cd *CompactDef, stats *y.CompactionStats, discardStats *Disca
 					if !cd.HasOverlap {
 						continue
 					}
+				} else if isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+					// The expired value is converted to a deletion marker the same way.
+					discardStats.collect(vs)
+					if cd.HasOverlap {
+						builder.Add(key, y.ValueStruct{Meta: bitDelete})
+					}
+					continue
 				} else if cd.Filter != nil {
 					switch cd.Filter.Filter(key.UserKey, vs.Value, vs.UserMeta) {
 					case DecisionMarkTombstone:
@@ -498,6 +660,15 @@ func CompactTables(cd *CompactDef, stats *y.CompactionStats, discardStats *Disca
 						discardStats.collect(vs)
 						continue
 					case DecisionKeep:
+						// The value in a blob file is a pointer, it is not rewritten.
+						if rewriter == nil || vs.Meta&bitValuePointer != 0 {
+							break
+						}
+						if newVal := rewriter.Rewrite(key.UserKey, vs.Value, vs.UserMeta); newVal != nil {
+							discardStats.collect(vs)
+							vs.Value = newVal
+							kvSize = int(vs.EncodedSize()) + key.Len()
+						}
 					}
 				}
 			}
@@ -521,7 +692,7 @@ func CompactTables(cd *CompactDef, stats *y.CompactionStats, discardStats *Disca
 func (lc *levelsController) openTables(buildResults []*sstable.BuildResult) (newTables []table.Table, err error) {
 	for _, result := range buildResults {
 		var tbl table.Table
-		tbl, err = sstable.OpenTable(result.FileName, lc.kv.blockCache, lc.kv.indexCache)
+		tbl, err = lc.kv.openTable(result.FileName)
 		if err != nil {
 			return
 		}
@@ -532,7 +703,7 @@ func (lc *levelsController) openTables(buildResults []*sstable.BuildResult) (new
 	// background operation.
 	err = syncDir(lc.kv.opt.Dir)
 	if err != nil {
-		log.Error("compact sync dir error", zap.Error(err))
+		lc.kv.opt.Logger.Error("compact sync dir error", zap.Error(err))
 		return
 	}
 	sortTables(newTables)
@@ -543,7 +714,7 @@ func (lc *levelsController) handleStats(nexLevel int, stats *y.CompactionStats,
 	stats.KeysDiscard = int(discardStats.numSkips)
 	stats.BytesDiscard = int(discardStats.skippedBytes)
 	lc.levels[nexLevel].metrics.UpdateCompactionStats(stats)
-	log.Info("compact send discard stats", zap.Stringer("stats", discardStats))
+	lc.kv.opt.Logger.Info("compact send discard stats", zap.Stringer("stats", discardStats))
 	if len(discardStats.ptrs) > 0 {
 		lc.kv.blobManger.discardCh <- discardStats
 	}
@@ -564,6 +735,23 @@ func buildChangeSet(cd *CompactDef, newTables []table.Table) protos.ManifestChan
 	return protos.ManifestChangeSet{Changes: changes}
 }
 
+// newCompactionJobInfo describes the compaction for the CompactionListener.
+func newCompactionJobInfo(cd *CompactDef) *options.CompactionJobInfo {
+	info := &options.CompactionJobInfo{
+		Level:    cd.Level,
+		MoveDown: cd.moveDown(),
+	}
+	for _, tbls := range [][]table.Table{cd.Top, cd.Bot} {
+		for _, t := range tbls {
+			info.InputTables = append(info.InputTables, t.ID())
+		}
+	}
+	if !info.MoveDown {
+		info.BytesRead = sumTableSize(cd.Top) + sumTableSize(cd.Bot)
+	}
+	return info
+}
+
 func sumTableSize(tables []table.Table) int64 {
 	var size int64
 	for _, t := range tables {
@@ -579,7 +767,7 @@ func calcRatio(topSize, botSize int64) float64 {
 	return float64(topSize) / float64(botSize)
 }
 
-func (lc *levelsController) runCompactDef(cd *CompactDef, guard *epoch.Guard) error {
+func (lc *levelsController) runCompactDef(cd *CompactDef, guard *epoch.Guard) (err error) {
 	timeStart := time.Now()
 
 	thisLevel := lc.levels[cd.Level]
@@ -595,6 +783,21 @@ func (lc *levelsController) runCompactDef(cd *CompactDef, guard *epoch.Guard) er
 			tbl.MarkCompacting(false)
 		}
 	}()
+	if listener := lc.kv.opt.CompactionListener; listener != nil {
+		info := newCompactionJobInfo(cd)
+		listener.OnCompactionBegin(info)
+		defer func() {
+			for _, t := range newTables {
+				info.OutputTables = append(info.OutputTables, t.ID())
+			}
+			if !cd.moveDown() {
+				info.BytesWritten = sumTableSize(newTables)
+			}
+			info.Duration = time.Since(timeStart)
+			info.Err = err
+			listener.OnCompactionCompleted(info)
+		}()
+	}
 
 	if cd.moveDown() {
 		// skip level 0, since it may has many table overlap with each other
@@ -625,7 +828,7 @@ func (lc *levelsController) runCompactDef(cd *CompactDef, guard *epoch.Guard) er
 	// Note: For level 0, while doCompact is running, it is possible that new tables are added.
 	// However, the tables are added only to the end, so it is ok to just delete the first table.
 
-	log.Info("compaction done",
+	lc.kv.opt.Logger.Info("compaction done",
 		zap.Stringer("def", cd), zap.Int("deleted", len(cd.Top)+len(cd.Bot)), zap.Int("added", len(newTables)),
 		zap.Duration("duration", time.Since(timeStart)))
 	return nil
@@ -642,36 +845,482 @@ func (lc *levelsController) doCompact(p compactionPriority, guard *epoch.Guard)
 	thisLevel := lc.levels[cd.Level]
 	nextLevel := lc.levels[cd.Level+1]
 
-	log.Info("start compaction", zap.Int("level", p.level), zap.Float64("score", p.score))
+	lc.kv.opt.Logger.Info("start compaction", zap.Int("level", p.level), zap.Float64("score", p.score))
 
 	// While picking tables to be compacted, both levels' tables are expected to
 	// remain unchanged.
 	if l == 0 {
 		if !cd.fillTablesL0(&lc.cstatus, thisLevel, nextLevel) {
-			log.Info("build compaction fill tables failed", zap.Int("level", l))
+			lc.kv.opt.Logger.Info("build compaction fill tables failed", zap.Int("level", l))
 			return false, nil
 		}
 	} else {
-		if !cd.fillTables(&lc.cstatus, thisLevel, nextLevel) {
-			log.Info("build compaction fill tables failed", zap.Int("level", l))
+		picker := lc.kv.opt.CompactionPicker
+		if picker == nil {
+			picker = PickByScore
+		}
+		if !cd.fillTables(&lc.cstatus, thisLevel, nextLevel, picker) {
+			lc.kv.opt.Logger.Info("build compaction fill tables failed", zap.Int("level", l))
 			return false, nil
 		}
 	}
 	lc.setHasOverlapTable(cd)
 	defer lc.cstatus.delete(cd) // Remove the ranges from compaction status.
 
-	log.Info("running compaction", zap.Stringer("def", cd))
+	lc.kv.opt.Logger.Info("running compaction", zap.Stringer("def", cd))
 	if err := lc.runCompactDef(cd, guard); err != nil {
 		// This compaction couldn't be done successfully.
-		log.Info("compact failed", zap.Stringer("def", cd), zap.Error(err))
+		lc.kv.opt.Logger.Info("compact failed", zap.Stringer("def", cd), zap.Error(err))
 		return false, err
 	}
 
-	log.Info("compaction done", zap.Int("level", cd.Level))
+	lc.kv.opt.Logger.Info("compaction done", zap.Int("level", cd.Level))
 	return true, nil
 }
 
+// compactRange compacts the tables overlapping with kr level by level. If bottomLevel is false, the
+// range is compacted down to the lowest level that has tables overlapping with it.
+func (lc *levelsController) compactRange(kr keyRange, bottomLevel bool) error {
+	lastLevel := len(lc.levels) - 1
+	if !bottomLevel {
+		for ; lastLevel > 1; lastLevel-- {
+			lh := lc.levels[lastLevel]
+			lh.RLock()
+			left, right := lh.overlappingTables(levelHandlerRLocked{}, kr)
+			lh.RUnlock()
+			if left < right {
+				break
+			}
+		}
+	}
+	for level := 0; level < lastLevel; level++ {
+		if err := lc.compactRangeInLevel(level, kr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactRangeInLevel compacts the tables of the level overlapping with kr to the next level. It
+// waits for the running compactions that conflict with it, and returns ErrDBClosed if the
+// compactors are closed while it waits.
+func (lc *levelsController) compactRangeInLevel(level int, kr keyRange) error {
+	for {
+		finished := lc.cstatus.compactionFinished()
+		cd := &CompactDef{
+			Level:    level,
+			isManual: true,
+		}
+		if cd.fillTablesInRange(&lc.cstatus, lc.levels[level], lc.levels[level+1], kr) {
+			if len(cd.Top) == 0 {
+				return nil
+			}
+			lc.setHasOverlapTable(cd)
+			lc.kv.opt.Logger.Info("running manual compaction", zap.Stringer("def", cd))
+			guard := lc.resourceMgr.Acquire()
+			err := lc.runCompactDef(cd, guard)
+			guard.Done()
+			lc.cstatus.delete(cd)
+			return err
+		}
+		if !lc.waitCompactionFinished(finished) {
+			return ErrDBClosed
+		}
+	}
+}
+
+// waitCompactionFinished waits until the finished channel returned by compactStatus.compactionFinished
+// is closed. It returns false if the compactors are closed first.
+func (lc *levelsController) waitCompactionFinished(finished <-chan struct{}) bool {
+	var closed <-chan struct{}
+	if c := lc.kv.closers.compactors; c != nil {
+		closed = c.HasBeenClosed()
+	}
+	select {
+	case <-finished:
+		return true
+	case <-closed:
+		return false
+	}
+}
+
+// flatten compacts the tables of every level down to the bottom level until only the bottom level
+// has tables. The tables of a level are split into at most workers ranges which are compacted
+// concurrently.
+func (lc *levelsController) flatten(workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	bottom := len(lc.levels) - 1
+	for {
+		flat := true
+		for level := 0; level < bottom; level++ {
+			lh := lc.levels[level]
+			lh.RLock()
+			tables := append([]table.Table{}, lh.tables...)
+			lh.RUnlock()
+			if len(tables) == 0 {
+				continue
+			}
+			flat = false
+			if err := lc.compactRangesInLevel(level, splitKeyRanges(level, tables, workers)); err != nil {
+				return err
+			}
+		}
+		if flat {
+			return nil
+		}
+	}
+}
+
+// splitKeyRanges splits the sorted tables of a level into at most n key ranges, the tables of level
+// 0 overlap with each other so they are in one range.
+func splitKeyRanges(level int, tables []table.Table, n int) []keyRange {
+	if level == 0 || n == 1 {
+		return []keyRange{getKeyRange(tables)}
+	}
+	size := (len(tables) + n - 1) / n
+	ranges := make([]keyRange, 0, n)
+	for i := 0; i < len(tables); i += size {
+		end := i + size
+		if end > len(tables) {
+			end = len(tables)
+		}
+		ranges = append(ranges, getKeyRange(tables[i:end]))
+	}
+	return ranges
+}
+
+// compactRangesInLevel compacts the tables of the level overlapping with the ranges concurrently.
+func (lc *levelsController) compactRangesInLevel(level int, ranges []keyRange) error {
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, kr := range ranges {
+		wg.Add(1)
+		go func(i int, kr keyRange) {
+			defer wg.Done()
+			errs[i] = lc.compactRangeInLevel(level, kr)
+		}(i, kr)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTablesInRange removes the tables covered by [start, end) which are not being compacted from
+// the levels and returns them. The levels are locked while the deletions are written to the
+// manifest, so the levels are unchanged if the manifest can't be written.
+func (lc *levelsController) deleteTablesInRange(start, end y.Key) ([]table.Table, error) {
+	for _, l := range lc.levels {
+		l.Lock()
+		defer l.Unlock()
+	}
+	var (
+		changes   []*protos.ManifestChange
+		pruneTbls []table.Table
+		newLevels = make([][]table.Table, len(lc.levels))
+	)
+	for level, l := range lc.levels {
+		left, right := 0, len(l.tables)
+		if l.level > 0 {
+			left, right = getTablesInRange(l.tables, start, end)
+		}
+		if left >= right {
+			continue
+		}
+		// Make a copy as iterators might be keeping a slice of tables.
+		newTables := append([]table.Table{}, l.tables[:left]...)
+		for _, tbl := range l.tables[left:right] {
+			if !isRangeCoversTable(start, end, tbl) || tbl.IsCompacting() {
+				newTables = append(newTables, tbl)
+				continue
+			}
+			pruneTbls = append(pruneTbls, tbl)
+			changes = append(changes, newDeleteChange(tbl.ID()))
+		}
+		if len(newTables) < right {
+			newLevels[level] = append(newTables, l.tables[right:]...)
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	if err := lc.kv.manifest.addChanges(changes, nil); err != nil {
+		return nil, err
+	}
+	for level, newTables := range newLevels {
+		if newTables == nil {
+			continue
+		}
+		l := lc.levels[level]
+		assertTablesOrder(level, newTables, nil)
+		l.tables = newTables
+		l.totalSize = 0
+		for _, tbl := range newTables {
+			l.totalSize += tbl.Size()
+		}
+	}
+	return pruneTbls, nil
+}
+
+// replaceRange deletes all the data in [start, end) and adds the tables to the bottom level in one
+// manifest change set, the tables must be sorted and in the range. The memtables must not have keys
+// in the range. The level 0 tables with keys in the range are compacted to level 1 first, the
+// tables partially in the range are rewritten without the keys in the range. The range is held in
+// the compaction status of every level until the tables are replaced, and the levels are locked
+// together while they are updated, so a read sees either the old data or the new data.
+func (lc *levelsController) replaceRange(start, end []byte, tbls []table.Table) error {
+	kr := keyRange{left: y.KeyWithTs(start, math.MaxUint64), right: y.KeyWithTs(end, 0)}
+	for {
+		if lc.level0HasKeysInRange(start, end) {
+			if err := lc.compactRangeInLevel(0, kr); err != nil {
+				return err
+			}
+		}
+		if !lc.cstatus.addToAllLevels(kr) {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		// A flush may have added a level 0 table before the range was added.
+		if !lc.level0HasKeysInRange(start, end) {
+			break
+		}
+		lc.cstatus.removeFromAllLevels(kr)
+	}
+	defer lc.cstatus.removeFromAllLevels(kr)
+
+	guard := lc.resourceMgr.Acquire()
+	defer guard.Done()
+	var (
+		changes      []*protos.ManifestChange
+		deletes      = make(map[uint64]struct{})
+		oldTables    []epoch.Resource
+		rewritten    []table.Table
+		newLevels    = make([][]table.Table, len(lc.levels))
+		discardStats DiscardStats
+	)
+	for level := 1; level < len(lc.levels); level++ {
+		l := lc.levels[level]
+		l.RLock()
+		left, right := l.overlappingTables(levelHandlerRLocked{}, kr)
+		overlapping := append([]table.Table{}, l.tables[left:right]...)
+		l.RUnlock()
+		for _, t := range overlapping {
+			newTables, err := lc.rewriteTableOutsideRange(t, level, start, end, &discardStats)
+			if err != nil {
+				deleteTables(rewritten)
+				return err
+			}
+			for _, nt := range newTables {
+				changes = append(changes, newCreateChange(nt.ID(), level))
+			}
+			rewritten = append(rewritten, newTables...)
+			newLevels[level] = append(newLevels[level], newTables...)
+			changes = append(changes, newDeleteChange(t.ID()))
+			deletes[t.ID()] = struct{}{}
+			oldTables = append(oldTables, t)
+		}
+	}
+	bottom := len(lc.levels) - 1
+	for _, t := range tbls {
+		changes = append(changes, newCreateChange(t.ID(), bottom))
+	}
+	newLevels[bottom] = append(newLevels[bottom], tbls...)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	for _, l := range lc.levels {
+		l.Lock()
+		defer l.Unlock()
+	}
+	if err := lc.kv.manifest.addChanges(changes, nil); err != nil {
+		// The ingested tables are deleted by the caller.
+		deleteTables(rewritten)
+		return err
+	}
+	for level, l := range lc.levels {
+		// Make a copy as iterators might be keeping a slice of tables.
+		newTables := make([]table.Table, 0, len(l.tables)+len(newLevels[level]))
+		for _, t := range l.tables {
+			if _, ok := deletes[t.ID()]; !ok {
+				newTables = append(newTables, t)
+			}
+		}
+		if len(newTables) == len(l.tables) && len(newLevels[level]) == 0 {
+			continue
+		}
+		newTables = append(newTables, newLevels[level]...)
+		sortTables(newTables)
+		assertTablesOrder(level, newTables, nil)
+		l.tables = newTables
+		l.totalSize = 0
+		for _, t := range newTables {
+			l.totalSize += t.Size()
+		}
+	}
+	if len(discardStats.ptrs) > 0 {
+		lc.kv.blobManger.discardCh <- &discardStats
+	}
+	guard.Delete(oldTables)
+	return nil
+}
+
+// level0HasKeysInRange returns true if any level 0 table has keys in [start, end).
+func (lc *levelsController) level0HasKeysInRange(start, end []byte) bool {
+	l := lc.levels[0]
+	l.RLock()
+	tables := append([]table.Table{}, l.tables...)
+	l.RUnlock()
+	for _, t := range tables {
+		it := t.NewIterator(false)
+		it.Seek(start)
+		inRange := it.Valid() && bytes.Compare(it.Key().UserKey, end) < 0
+		it.Close()
+		if inRange {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteTableOutsideRange builds the entries of the table before start and the entries from end
+// into at most two tables of the level, the values of the entries in [start, end) are collected to
+// the discard stats.
+func (lc *levelsController) rewriteTableOutsideRange(t table.Table, level int, start, end []byte,
+	discardStats *DiscardStats) (newTables []table.Table, err error) {
+	var (
+		results []*sstable.BuildResult
+		builder *sstable.Builder
+		fd      *os.File
+	)
+	finish := func() error {
+		if builder == nil || builder.Empty() {
+			return nil
+		}
+		result, err := builder.Finish()
+		if err != nil {
+			return err
+		}
+		fd.Close()
+		fd = nil
+		results = append(results, result)
+		return nil
+	}
+	defer func() {
+		if fd != nil {
+			fd.Close()
+			os.Remove(fd.Name())
+		}
+		if err != nil {
+			for _, result := range results {
+				os.Remove(result.FileName)
+				os.Remove(sstable.IndexFilename(result.FileName))
+			}
+		}
+	}()
+	it := t.NewIterator(false)
+	defer it.Close()
+	afterRange := false
+	var vs y.ValueStruct
+	for it.Rewind(); it.Valid(); y.NextAllVersion(it) {
+		key := it.Key()
+		it.FillValue(&vs)
+		if bytes.Compare(key.UserKey, start) >= 0 && bytes.Compare(key.UserKey, end) < 0 {
+			discardStats.collect(vs)
+			continue
+		}
+		if !afterRange && bytes.Compare(key.UserKey, end) >= 0 {
+			// The entries after the range go to another table so the range is left empty.
+			afterRange = true
+			if err = finish(); err != nil {
+				return nil, err
+			}
+		}
+		if fd == nil {
+			filename := sstable.NewFilename(lc.reserveFileID(), lc.kv.opt.Dir)
+			if fd, err = directio.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666); err != nil {
+				return nil, err
+			}
+			if builder == nil {
+				builder = sstable.NewTableBuilder(fd, lc.limiters[level], level, lc.opt)
+			} else {
+				builder.Reset(fd)
+			}
+		}
+		if err = builder.Add(key, vs); err != nil {
+			return nil, err
+		}
+	}
+	if err = finish(); err != nil {
+		return nil, err
+	}
+	return lc.openTables(results)
+}
+
+// dropAll removes all the tables from the levels and records the deletions with the head in the
+// manifest, it must be called when the compactors are stopped.
+func (lc *levelsController) dropAll(head *protos.HeadInfo, guard *epoch.Guard) error {
+	var (
+		changes []*protos.ManifestChange
+		dels    []epoch.Resource
+	)
+	for _, l := range lc.levels {
+		l.Lock()
+		for _, t := range l.tables {
+			changes = append(changes, newDeleteChange(t.ID()))
+			dels = append(dels, t)
+		}
+		l.tables = nil
+		l.totalSize = 0
+		l.Unlock()
+	}
+	if err := lc.kv.manifest.addChanges(changes, head); err != nil {
+		return err
+	}
+	guard.Delete(dels)
+	return nil
+}
+
+// pendingCompactionBytes estimates the bytes to compact to bring the levels under their target
+// sizes. The bottom level is never compacted so it's not counted.
+func (lc *levelsController) pendingCompactionBytes() int64 {
+	var pending int64
+	for i := 1; i < len(lc.levels)-1; i++ {
+		l := lc.levels[i]
+		if over := l.getTotalSize() - l.getMaxTotalSize(); over > 0 {
+			pending += over
+		}
+	}
+	return pending
+}
+
+// waitPendingCompactions stalls the flush while the pending compaction bytes exceed
+// MaxPendingCompactionBytes, the bytes are checked again whenever a compaction finishes. The stall
+// ends if the compactors are closed.
+func (lc *levelsController) waitPendingCompactions() {
+	limit := lc.kv.opt.MaxPendingCompactionBytes
+	if limit <= 0 || lc.pendingCompactionBytes() <= limit {
+		return
+	}
+	lc.kv.opt.Logger.Warn("stalled by pending compaction bytes", zap.Int64("pending", lc.pendingCompactionBytes()))
+	endStall := lc.kv.beginWriteStall(options.StallByPendingCompactionBytes)
+	for {
+		finished := lc.cstatus.compactionFinished()
+		if lc.pendingCompactionBytes() <= limit || !lc.waitCompactionFinished(finished) {
+			break
+		}
+	}
+	endStall()
+}
+
 func (lc *levelsController) addLevel0Table(t table.Table, head *protos.HeadInfo) error {
+	lc.waitPendingCompactions()
+
 	// We update the manifest _before_ the table becomes part of a levelHandler, because at that
 	// point it could get used in some compaction.  This ensures the manifest file gets updated in
 	// the proper order. (That means this update happens before that of some compaction which
@@ -687,16 +1336,17 @@ func (lc *levelsController) addLevel0Table(t table.Table, head *protos.HeadInfo)
 		// Stall. Make sure all levels are healthy before we unstall.
 		var timeStart time.Time
 		{
-			log.Warn("STALLED STALLED STALLED", zap.Duration("duration", time.Since(lastUnstalled)))
+			lc.kv.opt.Logger.Warn("STALLED STALLED STALLED", zap.Duration("duration", time.Since(lastUnstalled)))
 			for i := 0; i < lc.kv.opt.TableBuilderOptions.MaxLevels; i++ {
 				lc.cstatus.RLock()
 				status := lc.cstatus.levels[i].debug()
 				lc.cstatus.RUnlock()
-				log.Warn("dump level status", zap.Int("level", i), zap.String("status", status),
+				lc.kv.opt.Logger.Warn("dump level status", zap.Int("level", i), zap.String("status", status),
 					zap.Int64("size", lc.levels[i].getTotalSize()))
 			}
 			timeStart = time.Now()
 		}
+		endStall := lc.kv.beginWriteStall(options.StallByLevel0Tables)
 		// Before we unstall, we need to make sure that level 0 is healthy. Otherwise, we
 		// will very quickly fill up level 0 again.
 		for i := 0; ; i++ {
@@ -709,11 +1359,13 @@ func (lc *levelsController) addLevel0Table(t table.Table, head *protos.HeadInfo)
 			time.Sleep(10 * time.Millisecond)
 			if i%100 == 0 {
 				prios := lc.pickCompactLevels()
-				log.S().Warnf("waiting to add level 0 table, %+v", prios)
+				lc.kv.opt.Logger.Warn("waiting to add level 0 table", zap.String("priorities", fmt.Sprintf("%+v", prios)))
 				i = 0
 			}
 		}
-		log.Info("UNSTALLED UNSTALLED UNSTALLED UNSTALLED UNSTALLED UNSTALLED", zap.Duration("duration", time.Since(timeStart)))
+		stallDuration := time.Since(timeStart)
+		endStall()
+		lc.kv.opt.Logger.Info("UNSTALLED UNSTALLED UNSTALLED UNSTALLED UNSTALLED UNSTALLED", zap.Duration("duration", stallDuration))
 		lastUnstalled = time.Now()
 	}
 
@@ -726,7 +1378,7 @@ func (s *levelsController) close() error {
 }
 
 // get returns the found value if any. If not found, we return nil.
-func (s *levelsController) get(key y.Key, keyHash uint64) y.ValueStruct {
+func (s *levelsController) get(ctx context.Context, key y.Key, keyHash uint64) y.ValueStruct {
 	// It's important that we iterate the levels from 0 on upward.  The reason is, if we iterated
 	// in opposite order, or in parallel (naively calling all the h.RLock() in some order) we could
 	// read level L's tables post-compaction and level L+1's tables pre-compaction.  (If we do
@@ -735,7 +1387,7 @@ func (s *levelsController) get(key y.Key, keyHash uint64) y.ValueStruct {
 	start := time.Now()
 	defer s.kv.metrics.LSMGetDuration.Observe(time.Since(start).Seconds())
 	for _, h := range s.levels {
-		vs := h.get(key, keyHash) // Calls h.RLock() and h.RUnlock().
+		vs := h.get(ctx, key, keyHash) // Calls h.RLock() and h.RUnlock().
 		if vs.Valid() {
 			return vs
 		}
@@ -751,10 +1403,12 @@ func (s *levelsController) multiGet(pairs []keyValuePair) {
 	s.kv.metrics.LSMMultiGetDuration.Observe(time.Since(start).Seconds())
 }
 
-func appendIteratorsReversed(out []y.Iterator, th []table.Table, reversed bool) []y.Iterator {
+func appendIteratorsReversed(out []y.Iterator, th []table.Table, reversed bool, readahead int) []y.Iterator {
 	for i := len(th) - 1; i >= 0; i-- {
 		// This will increment the reference of the table handler.
-		out = append(out, table.NewConcatIterator(th[i:i+1], reversed))
+		it := table.NewConcatIterator(th[i:i+1], reversed)
+		it.SetReadahead(readahead)
+		out = append(out, it)
 	}
 	return out
 }
@@ -771,24 +1425,49 @@ func (s *levelsController) appendIterators(
 	return iters
 }
 
+// appendKeyIterators appends the iterators of the tables which may contain the versions of the key,
+// the tables whose filters prove they don't contain the key are skipped.
+func (s *levelsController) appendKeyIterators(iters []y.Iterator, key []byte, reversed bool) []y.Iterator {
+	keyHash := farm.Fingerprint64(key)
+	for _, level := range s.levels {
+		iters = level.appendKeyIterators(iters, key, keyHash, reversed)
+	}
+	return iters
+}
+
+// TableInfo describes a table in the LSM tree.
 type TableInfo struct {
 	ID    uint64
 	Level int
+	// Left and Right are the smallest and the biggest key in the table.
 	Left  []byte
 	Right []byte
+	// KeyCount is the estimated number of distinct keys, it is 0 if the table doesn't record the
+	// stats of its entries.
+	KeyCount uint64
+	HasSuRF  bool
+	// Size is the on-disk size of the table including its index file.
+	Size int64
 }
 
 func (lc *levelsController) getTableInfo() (result []TableInfo) {
 	for _, l := range lc.levels {
+		l.RLock()
 		for _, t := range l.tables {
 			info := TableInfo{
-				ID:    t.ID(),
-				Level: l.level,
-				Left:  t.Smallest().UserKey,
-				Right: t.Biggest().UserKey,
+				ID:       t.ID(),
+				Level:    l.level,
+				Left:     t.Smallest().UserKey,
+				Right:    t.Biggest().UserKey,
+				KeyCount: entryStats(t).NumKeys,
+				Size:     tableFileSize(t),
+			}
+			if sst, ok := t.(*sstable.Table); ok {
+				info.HasSuRF = sst.HasSuRF()
 			}
 			result = append(result, info)
 		}
+		l.RUnlock()
 	}
 	sort.Slice(result, func(i, j int) bool {
 		if result[i].Level != result[j].Level {
@@ -798,3 +1477,226 @@ func (lc *levelsController) getTableInfo() (result []TableInfo) {
 	})
 	return
 }
+
+// size returns the on-disk size of the live tables, the tables waiting to be deleted are excluded.
+func (lc *levelsController) size() int64 {
+	var size int64
+	for _, l := range lc.levels {
+		l.RLock()
+		for _, t := range l.tables {
+			size += tableFileSize(t)
+		}
+		l.RUnlock()
+	}
+	return size
+}
+
+// tableFileSize returns the size of the table file and its index file.
+func tableFileSize(t table.Table) int64 {
+	size := t.Size()
+	if sst, ok := t.(*sstable.Table); ok {
+		size += sst.IndexSize()
+	}
+	return size
+}
+
+// LevelInfo describes a level of the LSM tree.
+type LevelInfo struct {
+	Level     int
+	NumTables int
+	// Size is the total size of the tables, TargetSize is the size above which the level is
+	// compacted.
+	Size       int64
+	TargetSize int64
+	// Score is the priority of compacting the level, the level needs compaction if it is not less
+	// than 1.
+	Score float64
+	// Smallest and Biggest are the key range of the level, they are nil if the level is empty.
+	Smallest []byte
+	Biggest  []byte
+	// StaleSize is the estimated size of the old versions and the deletes in the level, which
+	// may be discarded by compactions.
+	StaleSize int64
+}
+
+func (lc *levelsController) getLevelInfo() []LevelInfo {
+	result := make([]LevelInfo, len(lc.levels))
+	for i, l := range lc.levels {
+		info := &result[i]
+		info.Level = l.level
+		info.TargetSize = l.getMaxTotalSize()
+		l.RLock()
+		info.NumTables = len(l.tables)
+		info.Size = l.totalSize
+		for _, t := range l.tables {
+			if info.Smallest == nil || bytes.Compare(t.Smallest().UserKey, info.Smallest) < 0 {
+				info.Smallest = t.Smallest().UserKey
+			}
+			if info.Biggest == nil || bytes.Compare(t.Biggest().UserKey, info.Biggest) > 0 {
+				info.Biggest = t.Biggest().UserKey
+			}
+			info.StaleSize += estimateStaleSize(t)
+		}
+		l.RUnlock()
+		if l.level == 0 {
+			info.Score = float64(info.NumTables) / float64(lc.kv.opt.NumLevelZeroTables)
+		} else {
+			info.Score = float64(info.Size) / float64(info.TargetSize)
+		}
+	}
+	return result
+}
+
+// estimateStaleSize estimates the size of the old versions and the deletes in the table by their
+// proportion of the entries.
+func estimateStaleSize(t table.Table) int64 {
+	stats := entryStats(t)
+	if stats.NumEntries == 0 {
+		return 0
+	}
+	stale := stats.NumEntries - stats.NumKeys + stats.NumDeletes
+	if stale > stats.NumEntries {
+		stale = stats.NumEntries
+	}
+	return int64(float64(t.Size()) * float64(stale) / float64(stats.NumEntries))
+}
+
+// LevelSuRFStats is the sum of the SuRF stats of the tables in a level.
+type LevelSuRFStats struct {
+	Level       int
+	NumTables   int
+	MarshalSize int64
+	MemSize     int64
+	NumKeys     int
+}
+
+func (lc *levelsController) getSuRFStats() ([]LevelSuRFStats, error) {
+	guard := lc.kv.resourceMgr.Acquire()
+	defer guard.Done()
+	result := make([]LevelSuRFStats, len(lc.levels))
+	for i, l := range lc.levels {
+		result[i].Level = l.level
+		l.RLock()
+		tables := append([]table.Table{}, l.tables...)
+		l.RUnlock()
+		for _, t := range tables {
+			sst, ok := t.(*sstable.Table)
+			if !ok {
+				continue
+			}
+			stats, err := sst.SuRFStats()
+			if err != nil {
+				return nil, err
+			}
+			if stats == nil {
+				continue
+			}
+			result[i].NumTables++
+			result[i].MarshalSize += stats.MarshalSize
+			result[i].MemSize += stats.MemSize
+			result[i].NumKeys += stats.NumKeys
+		}
+	}
+	return result, nil
+}
+
+// sampleTable returns the block samples of the table scaled to the size of the table file and its
+// index file. A table whose index can't be loaded is sampled as one block.
+func (lc *levelsController) sampleTable(t table.Table) []sstable.BlockSample {
+	var samples []sstable.BlockSample
+	if sst, ok := t.(*sstable.Table); ok {
+		var err error
+		if samples, err = sst.BlockSamples(); err != nil {
+			lc.kv.opt.Logger.Warn("sample table blocks failed", zap.Uint64("id", t.ID()), zap.Error(err))
+			samples = nil
+		}
+	}
+	fileSize := tableFileSize(t)
+	if len(samples) == 0 {
+		return []sstable.BlockSample{{Key: t.Smallest().UserKey, Size: fileSize}}
+	}
+	var blocksSize int64
+	for _, sample := range samples {
+		blocksSize += sample.Size
+	}
+	if blocksSize == 0 {
+		return samples
+	}
+	for i := range samples {
+		samples[i].Size = samples[i].Size * fileSize / blocksSize
+	}
+	return samples
+}
+
+// estimateRange estimates the size and the number of keys of the tables in [start, end) from the
+// block samples of the tables, the blocks are not read. A nil end is unbounded.
+func (lc *levelsController) estimateRange(start, end []byte) (size, keys uint64) {
+	guard := lc.kv.resourceMgr.Acquire()
+	defer guard.Done()
+	for _, l := range lc.levels {
+		l.RLock()
+		tables := append([]table.Table{}, l.tables...)
+		l.RUnlock()
+		for _, t := range tables {
+			if bytes.Compare(t.Biggest().UserKey, start) < 0 || (end != nil && bytes.Compare(t.Smallest().UserKey, end) >= 0) {
+				continue
+			}
+			samples := lc.sampleTable(t)
+			var tblSize, overlapSize int64
+			for i, sample := range samples {
+				tblSize += sample.Size
+				// The block i covers the keys in [samples[i].Key, samples[i+1].Key).
+				if end != nil && bytes.Compare(sample.Key, end) >= 0 {
+					continue
+				}
+				if i+1 < len(samples) && bytes.Compare(samples[i+1].Key, start) <= 0 {
+					continue
+				}
+				overlapSize += sample.Size
+			}
+			size += uint64(overlapSize)
+			if st, ok := t.(table.EntryStatsTable); ok && tblSize > 0 {
+				keys += uint64(float64(st.EntryStats().NumKeys) * float64(overlapSize) / float64(tblSize))
+			}
+		}
+	}
+	return size, keys
+}
+
+// keySplits returns the keys which split the data with the prefix into ranges of about targetSize
+// bytes. The sizes are sampled from the blocks of the tables.
+func (lc *levelsController) keySplits(prefix []byte, targetSize int64) [][]byte {
+	guard := lc.kv.resourceMgr.Acquire()
+	defer guard.Done()
+	var samples []sstable.BlockSample
+	for _, l := range lc.levels {
+		l.RLock()
+		tables := append([]table.Table{}, l.tables...)
+		l.RUnlock()
+		for _, t := range tables {
+			smallest := t.Smallest().UserKey
+			if bytes.Compare(t.Biggest().UserKey, prefix) < 0 ||
+				(bytes.Compare(smallest, prefix) > 0 && !bytes.HasPrefix(smallest, prefix)) {
+				continue
+			}
+			for _, sample := range lc.sampleTable(t) {
+				if bytes.HasPrefix(sample.Key, prefix) {
+					samples = append(samples, sample)
+				}
+			}
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return bytes.Compare(samples[i].Key, samples[j].Key) < 0
+	})
+	var splits [][]byte
+	var size int64
+	for _, sample := range samples {
+		if size >= targetSize && (len(splits) == 0 || bytes.Compare(sample.Key, splits[len(splits)-1]) > 0) {
+			splits = append(splits, y.Copy(sample.Key))
+			size = 0
+		}
+		size += sample.Size
+	}
+	return splits
+}
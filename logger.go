@@ -0,0 +1,30 @@
+package badger
+
+import (
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// globalLogger routes the logs to the global logger of github.com/pingcap/log, which is looked up
+// on every call so it can be replaced after the DB is opened.
+type globalLogger struct{}
+
+func (globalLogger) logger() *zap.Logger {
+	return log.L().WithOptions(zap.AddCallerSkip(1))
+}
+
+func (l globalLogger) Debug(msg string, fields ...zap.Field) {
+	l.logger().Debug(msg, fields...)
+}
+
+func (l globalLogger) Info(msg string, fields ...zap.Field) {
+	l.logger().Info(msg, fields...)
+}
+
+func (l globalLogger) Warn(msg string, fields ...zap.Field) {
+	l.logger().Warn(msg, fields...)
+}
+
+func (l globalLogger) Error(msg string, fields ...zap.Field) {
+	l.logger().Error(msg, fields...)
+}
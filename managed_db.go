@@ -60,7 +60,9 @@ func (db *ManagedDB) NewTransactionAt(readTs uint64, update bool) *Txn {
 }
 
 // CommitAt commits the transaction, following the same logic as Commit(), but
-// at the given commit timestamp. This will panic if not used with ManagedDB.
+// at the given commit timestamp. The keys written without a version, by Delete or by
+// SetEntry with a zero version, are committed with the commit timestamp as their version. It returns ErrManagedTxn if
+// not used with ManagedDB.
 //
 // This is only useful for databases built on Top of Badger (like Dgraph), and
 // can be ignored by most users.
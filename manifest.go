@@ -31,6 +31,7 @@ import (
 	"github.com/pingcap/badger/protos"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
+	"go.uber.org/zap"
 )
 
 // Manifest represents the contents of the MANIFEST file in a Badger store.
@@ -108,7 +109,7 @@ func (m *Manifest) asChanges() []*protos.ManifestChange {
 }
 
 func (m *Manifest) clone() Manifest {
-	changeSet := protos.ManifestChangeSet{Changes: m.asChanges()}
+	changeSet := protos.ManifestChangeSet{Changes: m.asChanges(), Head: m.Head}
 	ret := createManifest()
 	y.Check(applyChangeSet(&ret, &changeSet))
 	return ret
@@ -116,11 +117,15 @@ func (m *Manifest) clone() Manifest {
 
 // openOrCreateManifestFile opens a Badger manifest file if it exists, or creates on if
 // one doesn’t.
-func openOrCreateManifestFile(dir string, readOnly bool) (ret *manifestFile, result Manifest, err error) {
-	return helpOpenOrCreateManifestFile(dir, readOnly, manifestDeletionsRewriteThreshold)
+// If repair is true, the manifest is truncated at the first record which can't be decoded or applied
+// instead of failing, and a manifest with a bad magic is replaced by an empty one.
+// If strict is true, it fails instead of truncating a corrupt tail. The repairs are logged by logger.
+func openOrCreateManifestFile(dir string, readOnly, repair, strict bool, logger options.Logger) (ret *manifestFile, result Manifest, err error) {
+	return helpOpenOrCreateManifestFile(dir, readOnly, repair, strict, logger, manifestDeletionsRewriteThreshold)
 }
 
-func helpOpenOrCreateManifestFile(dir string, readOnly bool, deletionsThreshold int) (ret *manifestFile, result Manifest, err error) {
+func helpOpenOrCreateManifestFile(dir string, readOnly, repair, strict bool, logger options.Logger,
+	deletionsThreshold int) (ret *manifestFile, result Manifest, err error) {
 	path := filepath.Join(dir, ManifestFilename)
 	var flags uint32
 	if readOnly {
@@ -149,11 +154,30 @@ func helpOpenOrCreateManifestFile(dir string, readOnly bool, deletionsThreshold
 		return mf, m, nil
 	}
 
-	manifest, truncOffset, err := ReplayManifestFile(fp)
+	manifest, truncOffset, err := replayManifestFile(fp, repair, -1)
+	if err == errBadMagic && repair {
+		logger.Warn("replace the MANIFEST with bad magic", zap.String("dir", dir))
+		_ = fp.Close()
+		manifest = createManifest()
+		if fp, _, err = helpRewrite(dir, &manifest); err != nil {
+			return nil, Manifest{}, err
+		}
+		truncOffset, err = fp.Seek(0, io.SeekEnd)
+	}
 	if err != nil {
 		_ = fp.Close()
 		return nil, Manifest{}, err
 	}
+	if fi, err := fp.Stat(); err == nil && fi.Size() > truncOffset {
+		if strict {
+			_ = fp.Close()
+			return nil, Manifest{}, fmt.Errorf("MANIFEST has a corrupt record at offset %d", truncOffset)
+		}
+		if !readOnly {
+			logger.Warn("truncate the MANIFEST at the first corrupt record", zap.Int64("offset", truncOffset),
+				zap.Int64("lost bytes", fi.Size()-truncOffset))
+		}
+	}
 
 	if !readOnly {
 		// Truncate file so we don't have a half-written entry at the end.
@@ -330,7 +354,24 @@ var (
 // truncated at that point before further appends are made (if there is a partial entry after
 // that).  In normal conditions, truncOffset is the file size.
 func ReplayManifestFile(fp *os.File) (ret Manifest, truncOffset int64, err error) {
-	r := countingReader{wrapped: bufio.NewReader(fp)}
+	return replayManifestFile(fp, false, -1)
+}
+
+// replayManifestFile replays the records before limit if it is not negative. If repair is true, the
+// replay stops at the first record which can't be decoded or applied instead of failing.
+func replayManifestFile(fp *os.File, repair bool, limit int64) (ret Manifest, truncOffset int64, err error) {
+	if _, err = fp.Seek(0, io.SeekStart); err != nil {
+		return Manifest{}, 0, err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		return Manifest{}, 0, err
+	}
+	size := fi.Size()
+	if limit >= 0 && limit < size {
+		size = limit
+	}
+	r := countingReader{wrapped: bufio.NewReader(io.LimitReader(fp, size))}
 
 	var magicBuf [8]byte
 	if _, err := io.ReadFull(&r, magicBuf[:]); err != nil {
@@ -358,6 +399,10 @@ func ReplayManifestFile(fp *os.File) (ret Manifest, truncOffset int64, err error
 			return Manifest{}, 0, err
 		}
 		length := binary.BigEndian.Uint32(lenCrcBuf[0:4])
+		if int64(length) > size-r.count {
+			// The length of a torn record may be garbage.
+			break
+		}
 		var buf = make([]byte, length)
 		if _, err := io.ReadFull(&r, buf); err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
@@ -371,10 +416,17 @@ func ReplayManifestFile(fp *os.File) (ret Manifest, truncOffset int64, err error
 
 		var changeSet protos.ManifestChangeSet
 		if err := changeSet.Unmarshal(buf); err != nil {
+			if repair {
+				break
+			}
 			return Manifest{}, 0, err
 		}
 
 		if err := applyChangeSet(&build, &changeSet); err != nil {
+			if repair {
+				// The change set may be applied partially, replay the records before it again.
+				return replayManifestFile(fp, repair, offset)
+			}
 			return Manifest{}, 0, err
 		}
 	}
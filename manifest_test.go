@@ -17,6 +17,7 @@
 package badger
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -32,6 +33,8 @@ import (
 	"github.com/pingcap/badger/table/sstable"
 	"github.com/pingcap/badger/y"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func testCache() *cache.Cache {
@@ -185,7 +188,7 @@ func TestOverlappingKeyRangeError(t *testing.T) {
 	lh0 := newLevelHandler(kv, 0)
 	lh1 := newLevelHandler(kv, 1)
 	f := buildTestTable(t, "k", 2)
-	t1, err := sstable.OpenTable(f.Name(), blkCache, idxCache)
+	t1, err := sstable.OpenTable(f.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer t1.Delete()
 
@@ -210,7 +213,7 @@ func TestOverlappingKeyRangeError(t *testing.T) {
 	lc.runCompactDef(cd, g)
 
 	f = buildTestTable(t, "l", 2)
-	t2, err := sstable.OpenTable(f.Name(), blkCache, idxCache)
+	t2, err := sstable.OpenTable(f.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer t2.Delete()
 	done = lh0.tryAddLevel0Table(t2)
@@ -228,7 +231,7 @@ func TestManifestRewrite(t *testing.T) {
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 	deletionsThreshold := 10
-	mf, m, err := helpOpenOrCreateManifestFile(dir, false, deletionsThreshold)
+	mf, m, err := helpOpenOrCreateManifestFile(dir, false, false, false, options.NopLogger, deletionsThreshold)
 	defer func() {
 		if mf != nil {
 			mf.close()
@@ -270,7 +273,7 @@ func TestManifestRewrite(t *testing.T) {
 	err = mf.close()
 	require.NoError(t, err)
 	mf = nil
-	mf, m, err = helpOpenOrCreateManifestFile(dir, false, deletionsThreshold)
+	mf, m, err = helpOpenOrCreateManifestFile(dir, false, false, false, options.NopLogger, deletionsThreshold)
 	require.NoError(t, err)
 	require.Equal(t, map[uint64]tableManifest{
 		uint64(deletionsThreshold * 3): {Level: 0},
@@ -278,3 +281,127 @@ func TestManifestRewrite(t *testing.T) {
 	require.NotNil(t, m.Head)
 	require.Equal(t, *m.Head, *head)
 }
+
+func TestManifestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	kv, err := Open(opt)
+	require.NoError(t, err)
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 100; i++ {
+			txnSet(t, kv, []byte(key("key", i)), []byte(fmt.Sprintf("%d-%d", i, round)), 0)
+		}
+		kv.flushMemTable().Wait()
+		if round%2 == 0 {
+			require.NoError(t, kv.CompactRange([]byte("key"), []byte("key9999"), CompactRangeOptions{BottomLevel: true}))
+		}
+	}
+	require.NoError(t, kv.Close())
+
+	check := func() {
+		kv, err := Open(opt)
+		require.NoError(t, err)
+		defer kv.Close()
+		require.NoError(t, kv.View(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				item, err := txn.Get([]byte(key("key", i)))
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("%d-3", i), string(getItemValue(t, item)))
+			}
+			return nil
+		}))
+	}
+	path := filepath.Join(dir, ManifestFilename)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	// Corrupt the third record.
+	off := 8
+	for i := 0; i < 2; i++ {
+		off += 8 + int(binary.BigEndian.Uint32(data[off:]))
+	}
+	data[off+8] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0666))
+	opt.RepairManifest = true
+	check()
+	opt.RepairManifest = false
+	check()
+
+	data, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[0] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0666))
+	core, logs := observer.New(zap.WarnLevel)
+	opt.Logger = zap.New(core)
+	opt.RepairManifest = true
+	check()
+	require.Equal(t, 1, logs.FilterMessage("replace the MANIFEST with bad magic").Len())
+}
+
+func TestRecoveryMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.DoNotCompact = true
+	opt.CompactL0WhenClose = false
+	kv, err := Open(opt)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		txnSet(t, kv, []byte(key("key", i)), []byte(fmt.Sprintf("%d", i)), 0)
+	}
+	kv.flushMemTable().Wait()
+	tables := kv.Tables()
+	require.Len(t, tables, 1)
+	corruptID := tables[0].ID
+	for i := 100; i < 200; i++ {
+		txnSet(t, kv, []byte(key("key", i)), []byte(fmt.Sprintf("%d", i)), 0)
+	}
+	kv.flushMemTable().Wait()
+	require.NoError(t, kv.Close())
+
+	// Garbage at the end of the MANIFEST.
+	path := filepath.Join(dir, ManifestFilename)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	opt.RecoveryMode = options.Strict
+	_, err = Open(opt)
+	require.Error(t, err)
+	core, logs := observer.New(zap.WarnLevel)
+	opt.Logger = zap.New(core)
+	opt.RecoveryMode = options.TolerateTail
+	kv, err = Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, kv.Close())
+	require.Equal(t, 1, logs.FilterMessage("truncate the MANIFEST at the first corrupt record").Len())
+
+	// A corrupt table is quarantined.
+	fname := sstable.NewFilename(corruptID, dir)
+	require.NoError(t, os.Remove(sstable.IndexFilename(fname)))
+	_, err = Open(opt)
+	require.Error(t, err)
+	opt.RecoveryMode = options.SkipCorruptTables
+	kv, err = Open(opt)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, quarantineDir, filepath.Base(fname)))
+	require.NoError(t, err)
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte(key("key", 50)))
+		require.Equal(t, ErrKeyNotFound, err)
+		item, err := txn.Get([]byte(key("key", 150)))
+		require.NoError(t, err)
+		require.Equal(t, "150", string(getItemValue(t, item)))
+		return nil
+	}))
+	require.NoError(t, kv.Close())
+
+	// The table has been removed from the MANIFEST.
+	opt.RecoveryMode = options.Strict
+	kv, err = Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, kv.Close())
+}
@@ -17,6 +17,8 @@
 package badger
 
 import (
+	"time"
+
 	"github.com/pingcap/badger/options"
 )
 
@@ -33,8 +35,9 @@ type Options struct {
 	// -------------------
 	// Directory to store the data in. Should exist and be writable.
 	Dir string
-	// Directory to store the value log in. Can be the same as Dir. Should
-	// exist and be writable.
+	// Directory to store the value log, the blob files and the blob change log in. Can be the
+	// same as Dir, or on another device so the SSTs stay on a fast disk while the values live on
+	// a large cheap one. Defaults to Dir if empty.
 	ValueDir string
 
 	// 2. Frequently modified flags
@@ -42,6 +45,13 @@ type Options struct {
 	// Sync all writes to disk. Setting this to true would slow down data
 	// loading significantly.
 	SyncWrites bool
+	// The commits arriving together are appended to the value log and
+	// synced as a batch. MaxCommitDelay is how long the first commit of a
+	// batch waits for more commits, the commits don't wait if it is 0.
+	// MaxCommitBatchSize is the max number of commits in a batch, 0 means
+	// unlimited.
+	MaxCommitDelay     time.Duration
+	MaxCommitBatchSize int
 
 	// 3. Flags that user might want to review
 	// ----------------------------------------
@@ -50,8 +60,36 @@ type Options struct {
 	// If value size >= this threshold, only store value offsets in tree.
 	// If set to 0, all values are stored in SST.
 	ValueThreshold int
+	// DisableValueLog stores all the values in the LSM tree and writes no
+	// value log, ValueThreshold is ignored. The writes which are not
+	// flushed to the level 0 tables are lost on a crash, they are flushed
+	// by Close. The value log files left by the DB opened without it are
+	// replayed and removed on Open.
+	DisableValueLog bool
+	// DynamicValueThreshold adjusts the value threshold to the sizes of the written values, so
+	// ValueSizePercentile of the values stay in the LSM tree. The threshold is kept between
+	// ValueThreshold and MaxValueThreshold, it is disabled if ValueThreshold is 0.
+	DynamicValueThreshold bool
+	MaxValueThreshold     int
+	ValueSizePercentile   float64
+	// VerifyValueChecksum verifies the checksums of the values read from the blob files, a
+	// *ValueCorruptionError is returned on a mismatch. The blob files written before the checksums
+	// were introduced are not verified.
+	VerifyValueChecksum bool
+	// VerifyChecksumRate is the bytes per second read by DB.VerifyChecksum, the reads are not
+	// throttled if it is not positive.
+	VerifyChecksumRate int
 	// Maximum number of tables to keep in memory, before stalling.
 	NumMemtables int
+	// NumMemTableShards shards a memtable by the key hash into this many
+	// skiplists, so the writes are applied to them in parallel. A shard
+	// reserves an arena of 1.5 times its share of the memtable size, so
+	// a sharded memtable takes 1.5 times the memory of a single skiplist,
+	// and the memtable is flushed once any shard is full. With many
+	// shards an uneven key distribution flushes smaller memtables.
+	NumMemTableShards int
+	// MemTableType is the index of the memtable entries.
+	MemTableType options.MemTableType
 	// The following affect how we handle LSM tree L0.
 	// Maximum number of Level 0 tables before we start compacting.
 	NumLevelZeroTables int
@@ -60,11 +98,37 @@ type Options struct {
 	// compacted away.
 	NumLevelZeroTablesStall int
 
+	// MaxPendingCompactionBytes stalls the flushes, and so the writes, while
+	// the levels exceed their target sizes by more than this many bytes in
+	// total. It is disabled if it is 0.
+	MaxPendingCompactionBytes int64
+
+	// OnWriteStall is called with stalled true when the writes stall and
+	// with stalled false when they resume. It's called on the write path,
+	// so it must not block.
+	OnWriteStall func(stalled bool, reason options.WriteStallReason)
+
+	// TableLoadingMode specifies how the blocks of the tables are read.
+	TableLoadingMode options.TableLoadingMode
+
 	MaxBlockCacheSize int64
+	// MaxCompressedBlockCacheSize is the capacity of the second tier of the block cache, which
+	// caches the compressed blocks so a block evicted from the block cache is decompressed from
+	// memory instead of read from the disk. It is disabled if it is 0 or the block cache is
+	// disabled.
+	MaxCompressedBlockCacheSize int64
+	// MaxIndexCacheSize is the capacity of the cache shared by the table indexes, the indexes are
+	// charged by their memory size. The index of every table is kept in memory until the table is
+	// closed if it is 0.
 	MaxIndexCacheSize int64
 
 	// Maximum total size for L1.
 	LevelOneSize int64
+	// DynamicLevelSize derives the target sizes of the levels from the size of the bottom level
+	// instead of growing them from LevelOneSize, so the data in the upper levels is kept around
+	// 1/LevelSizeMultiplier of the level below even if the DB is small. LevelOneSize is the
+	// minimum target size of a level.
+	DynamicLevelSize bool
 
 	// Size of single value log file.
 	ValueLogFileSize int64
@@ -76,6 +140,18 @@ type Options struct {
 	// Max number of value log files to keep before safely remove.
 	ValueLogMaxNumFiles int
 
+	// BlobGCSpaceAmp is the target space amplification of the blob files, the ratio of their size
+	// to the size of the live values in them. The blob GC rewrites the files with the most
+	// discarded values whenever it is exceeded, the discards persisted in the files are counted on
+	// open. It is disabled if it is not greater than 1, the files with more than half of the
+	// values discarded are still rewritten.
+	BlobGCSpaceAmp float64
+
+	// BlobGCPunchHoles punches holes over the discarded values in the blob files, so the space of
+	// the large values is reclaimed without rewriting the files. The discarded space freed by the
+	// holes is not counted by the blob GC, it is counted again after the DB is reopened.
+	BlobGCPunchHoles bool
+
 	// Number of compaction workers to run concurrently.
 	NumCompactors int
 
@@ -83,11 +159,34 @@ type Options struct {
 	// A managed transaction can only set values by SetEntry with a non-zero version key.
 	ManagedTxns bool
 
+	// RepairManifest opens the DB even if the MANIFEST is corrupt. The
+	// MANIFEST is truncated at the first record which can't be decoded or
+	// applied, the tables whose files are missing are removed from it and
+	// the table files it doesn't refer to are added to level 0, then all the
+	// tables are compacted to the bottom level so the versions of the keys
+	// are ordered again. The lost records and tables are logged.
+	RepairManifest bool
+
+	// RecoveryMode controls whether Open fails, truncates the corrupt tail
+	// or quarantines the corrupt tables after a crash.
+	RecoveryMode options.RecoveryMode
+
 	// 4. Flags for testing purposes
 	// ------------------------------
 	VolatileMode bool
 	DoNotCompact bool // Stops LSM tree from compactions.
 
+	// Detect a Txn or Iterator being used by multiple goroutines at the
+	// same time, and fail the call with ErrConcurrentTxn or
+	// ErrConcurrentIterator instead of corrupting their state.
+	DetectConcurrentUse bool
+
+	// IteratorLeakTimeout makes the DB track the stack traces of the calls creating the iterators,
+	// an iterator not closed for longer than it is logged as a warning once with the stack trace,
+	// and returned by DB.LeakedIterators. The leaked iterators pin the memtables and the files. A
+	// stack trace is taken per iterator, so it is meant for debugging. Zero disables the tracking.
+	IteratorLeakTimeout time.Duration
+
 	maxBatchCount int64 // max entries in batch
 	maxBatchSize  int64 // max batch size in bytes
 
@@ -106,9 +205,68 @@ type Options struct {
 
 	CompactionFilterFactory func(targetLevel int, smallest, biggest []byte) CompactionFilter
 
+	// EnableCacheMetrics collects the hits, misses and costs of the block cache and the index
+	// cache returned by DB.CacheMetrics, they are also collected if MetricsRegistry is set.
+	EnableCacheMetrics bool
+
+	// MetricsRegistry is the registry the metrics are registered to besides the default registry,
+	// the hit ratio of the caches is only collected if it is set.
+	MetricsRegistry options.MetricsRegistry
+
+	// CompactionListener is notified of the compaction and flush jobs if it is not nil.
+	CompactionListener options.CompactionListener
+
+	// CommitHook is called with the entries of every committed transaction and its commit ts after
+	// they are written and before the commit returns, so the writes can be replicated. It is called
+	// serially in commit order on the write path, a slow hook slows down the writes. The entries are
+	// durable when it is called if SyncWrites is set. The entries loaded by DB.Load are passed with
+	// commit ts 0, the entries replayed from the value log on open are not passed. The entries must
+	// be copied if they are retained after it returns.
+	CommitHook func(entries []Entry, commitTs uint64)
+
+	// UpdateRetries is the number of times DB.Update retries the function on ErrConflict, the
+	// default of 0 disables the retries. A retry is delayed by a random duration up to
+	// UpdateRetryBackoff, which is doubled on every retry and capped at maxUpdateRetryBackoff.
+	UpdateRetries      int
+	UpdateRetryBackoff time.Duration
+
+	// Indexes are the secondary indexes maintained by the transactions, they are looked up by
+	// Txn.NewIndexIterator. The keys written before an index is added are not indexed.
+	Indexes []Index
+
+	// Logger receives the logs of the compaction, the blob GC and the recovery, they are discarded
+	// if it is nil. DefaultOptions routes them to the global logger of github.com/pingcap/log.
+	Logger options.Logger
+
+	// Tracer traces the memtable lookups, the table probes of every level, the block loads, the
+	// value reads and the commits if it is not nil. The spans are the children of the span in the
+	// context passed to Txn.GetContext and Txn.CommitContext.
+	Tracer options.Tracer
+
+	// CompactionPicker chooses the tables to compact in a level, PickByScore is used if it is nil.
+	CompactionPicker CompactionPicker
+
 	CompactL0WhenClose bool
 
 	RemoteCompactionAddr string
+
+	// ColdStorage offloads the data files of the bottom level tables which haven't changed for
+	// ColdTableAge and are not smaller than ColdTableMinSize to the object storage, it is disabled
+	// if it is nil. The index files stay on the local disk and an empty data file is left as a stub,
+	// the offloaded data is read in chunks cached in memory up to ColdCacheSize bytes. It needs the
+	// block cache, and it is not supported with memory mapped tables, remote compaction or
+	// Checkpoint.
+	ColdStorage      options.ObjectStorage
+	ColdTableAge     time.Duration
+	ColdTableMinSize int64
+	ColdCacheSize    int64
+
+	// EncryptionKey is the master key to encrypt the data at rest, it must be 16, 24 or 32 bytes
+	// to select AES-128, AES-192 or AES-256. The tables, value log and blob files are encrypted
+	// with a data key, which is stored in the key registry encrypted by the master key.
+	// Existing data of an unencrypted DB is encrypted when it is rewritten. Remote compaction is
+	// not supported with encryption. The key can be changed by DB.RotateEncryptionKey.
+	EncryptionKey []byte
 }
 
 // CompactionFilter is an interface that user can implement to remove certain keys.
@@ -122,6 +280,14 @@ type CompactionFilter interface {
 	Guards() []Guard
 }
 
+// CompactionValueRewriter can be implemented by a CompactionFilter to rewrite the values of the
+// kvs it keeps, so the values can be updated during compaction without a separate scan.
+type CompactionValueRewriter interface {
+	// Rewrite is invoked for every kv the filter decides to keep, except the kvs whose values are
+	// stored in the blob files. It returns the new value, or nil if the value should be unchanged.
+	Rewrite(key, val, userMeta []byte) []byte
+}
+
 // Guard specifies when to finish a SST file during compaction. The rule is the following:
 // 1. The key must match the Prefix of the Guard, otherwise the SST should finish.
 // 2. If the key up to MatchLen is the different than the previous key and MinSize is reached, the SST should finish.
@@ -153,14 +319,24 @@ var DefaultOptions = Options{
 	NumLevelZeroTables:      5,
 	NumLevelZeroTablesStall: 10,
 	NumMemtables:            5,
+	NumMemTableShards:       1,
 	SyncWrites:              true,
 	ValueLogFileSize:        256 << 20,
 	ValueLogMaxEntries:      1000000,
 	ValueLogMaxNumFiles:     1,
+	BlobGCSpaceAmp:          2,
 	ValueThreshold:          32,
+	MaxValueThreshold:       4 << 10,
+	ValueSizePercentile:     0.9,
+	VerifyChecksumRate:      64 << 20,
 	Truncate:                false,
+	TableLoadingMode:        options.FileIO,
 	MaxBlockCacheSize:       1 << 30,
 	MaxIndexCacheSize:       1 << 30,
+	Logger:                  globalLogger{},
+	ColdTableAge:            24 * time.Hour,
+	ColdCacheSize:           256 << 20,
+	UpdateRetryBackoff:      time.Millisecond,
 	TableBuilderOptions: options.TableBuilderOptions{
 		MaxTableSize:        8 << 20,
 		SuRFStartLevel:      8,
@@ -18,13 +18,20 @@ package options
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"time"
 
 	"github.com/golang/snappy"
 	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
 	"github.com/pingcap/badger/buffer"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 )
 
 // CompressionType specifies how a block should be compressed.
@@ -37,8 +44,24 @@ const (
 	Snappy CompressionType = 1
 	// ZSTD mode indicates that a block is compressed using ZSTD algorithm.
 	ZSTD CompressionType = 2
+	// LZ4 mode indicates that a block is compressed using LZ4 algorithm.
+	LZ4 CompressionType = 3
 )
 
+func (c CompressionType) String() string {
+	switch c {
+	case None:
+		return "None"
+	case Snappy:
+		return "Snappy"
+	case ZSTD:
+		return "ZSTD"
+	case LZ4:
+		return "LZ4"
+	}
+	return fmt.Sprintf("Unknown(%d)", uint32(c))
+}
+
 func (c CompressionType) Compress(w io.Writer, data []byte) error {
 	switch c {
 	case None:
@@ -60,6 +83,16 @@ func (c CompressionType) Compress(w io.Writer, data []byte) error {
 			return err
 		}
 		return e.Close()
+	case LZ4:
+		// The compressed block is prefixed by the length of the uncompressed data.
+		dst := buffer.GetBuffer(4 + lz4.CompressBlockBound(len(data)))
+		binary.LittleEndian.PutUint32(dst, uint32(len(data)))
+		n, err := lz4.CompressBlock(data, dst[4:], nil)
+		if err == nil {
+			_, err = w.Write(dst[:4+n])
+		}
+		buffer.PutBuffer(dst)
+		return err
 	}
 	return errors.New("Unsupported compression type")
 }
@@ -89,10 +122,33 @@ func (c CompressionType) Decompress(data []byte) ([]byte, error) {
 		}
 		defer r.Close()
 		return ioutil.ReadAll(r)
+	case LZ4:
+		defer buffer.PutBuffer(data)
+		if len(data) < 4 {
+			return nil, errors.New("LZ4 block is too short")
+		}
+		// The length is read from the disk, it is bounded by the size of the compressed block to
+		// avoid allocating a huge buffer for a corrupted block.
+		length := uint64(binary.LittleEndian.Uint32(data))
+		if length > lz4MaxCompressionRatio*uint64(len(data)-4) {
+			return nil, fmt.Errorf("LZ4 block decompressed length %d exceeds the limit of the %d bytes block",
+				length, len(data))
+		}
+		dst := buffer.GetBuffer(int(length))
+		n, err := lz4.UncompressBlock(data[4:], dst)
+		if err != nil {
+			buffer.PutBuffer(dst)
+			return nil, err
+		}
+		return dst[:n], nil
 	}
 	return nil, errors.New("Unsupported compression type")
 }
 
+// lz4MaxCompressionRatio is the max ratio of the decompressed size to the compressed size of an
+// LZ4 block, every byte of the match length extension encodes at most 255 bytes.
+const lz4MaxCompressionRatio = 255
+
 func compress(in []byte) ([]byte, error) {
 	w, err := zstd.NewWriter(nil)
 	if err != nil {
@@ -101,6 +157,103 @@ func compress(in []byte) ([]byte, error) {
 	return w.EncodeAll(in, make([]byte, 0, len(in))), nil
 }
 
+// TableLoadingMode specifies how the blocks of a table are read.
+type TableLoadingMode int
+
+const (
+	// FileIO reads the blocks with read syscalls and caches them in the block cache.
+	FileIO TableLoadingMode = iota
+	// MemoryMap maps the table files into memory, the uncompressed blocks are served from the
+	// mapped region directly without the block cache.
+	MemoryMap
+)
+
+// MemTableType specifies the index of the memtable entries.
+type MemTableType int
+
+const (
+	// SkipList indexes the entries with a lock-free skiplist in an arena.
+	SkipList MemTableType = iota
+	// ART indexes the entries with an adaptive radix tree, the lookups of short keys chase fewer
+	// pointers than the skiplist.
+	ART
+)
+
+// WriteStallReason is the cause of a write stall.
+type WriteStallReason int
+
+const (
+	// StallByMemTables stalls the writes when NumMemtables memtables are waiting to be flushed.
+	StallByMemTables WriteStallReason = iota
+	// StallByLevel0Tables stalls the flushes when level 0 has NumLevelZeroTablesStall tables.
+	StallByLevel0Tables
+	// StallByPendingCompactionBytes stalls the flushes when the levels exceed their target sizes
+	// by more than MaxPendingCompactionBytes in total.
+	StallByPendingCompactionBytes
+	// NumWriteStallReasons is the number of the write stall reasons.
+	NumWriteStallReasons
+)
+
+func (r WriteStallReason) String() string {
+	switch r {
+	case StallByMemTables:
+		return "memtables"
+	case StallByLevel0Tables:
+		return "level0_tables"
+	case StallByPendingCompactionBytes:
+		return "pending_compaction_bytes"
+	}
+	return fmt.Sprintf("Unknown(%d)", int(r))
+}
+
+// RecoveryMode specifies how Open handles the files corrupted by a crash.
+type RecoveryMode int
+
+const (
+	// TolerateTail truncates the value log and the MANIFEST at the first corrupt entry and logs the
+	// offset, the entries after it are lost. It fails if a table can't be opened. It is the default.
+	TolerateTail RecoveryMode = iota
+	// Strict fails if the value log or the MANIFEST has a corrupt entry.
+	Strict
+	// SkipCorruptTables tolerates the corrupt tails like TolerateTail, and the tables which are
+	// missing or can't be opened are removed from the MANIFEST and their files are moved to the
+	// quarantine directory, the data in them is lost.
+	SkipCorruptTables
+)
+
+func (m RecoveryMode) String() string {
+	switch m {
+	case TolerateTail:
+		return "TolerateTail"
+	case Strict:
+		return "Strict"
+	case SkipCorruptTables:
+		return "SkipCorruptTables"
+	}
+	return fmt.Sprintf("Unknown(%d)", int(m))
+}
+
+// FilterPolicy specifies the filter built for the tables in the levels above SuRFStartLevel.
+type FilterPolicy uint32
+
+const (
+	// BloomFilter builds a standard bloom filter.
+	BloomFilter FilterPolicy = 0
+	// BlockedBloomFilter builds a bloom filter whose probes for a key are all in one cache line,
+	// the lookup is faster but the false positive rate is a little higher with the same size.
+	BlockedBloomFilter FilterPolicy = 1
+)
+
+func (p FilterPolicy) String() string {
+	switch p {
+	case BloomFilter:
+		return "BloomFilter"
+	case BlockedBloomFilter:
+		return "BlockedBloomFilter"
+	}
+	return fmt.Sprintf("Unknown(%d)", uint32(p))
+}
+
 type TableBuilderOptions struct {
 	HashUtilRatio       float32
 	WriteBufferSize     int
@@ -113,6 +266,76 @@ type TableBuilderOptions struct {
 	SuRFStartLevel      int
 	SuRFOptions         SuRFOptions
 	MaxTableSize        int64
+	// FilterPolicy is the filter used by the levels above SuRFStartLevel for point lookups, the
+	// levels from SuRFStartLevel use SuRF.
+	FilterPolicy FilterPolicy
+	// IndexPartitionSize splits the block index of a table into partitions of about this size if
+	// the index is larger than it, the partitions are loaded on demand. 0 disables partitioning.
+	IndexPartitionSize int
+	// LevelRateLimits is the write rate limit in bytes per second of the compactions to every level,
+	// the limit of level 0 applies to the memtable flushes. A level uses the limit set by
+	// BytesPerSecond if its limit is 0 or not set, and it is not limited if its limit is negative.
+	LevelRateLimits []int
+	// DirectIO makes the compactions read the input tables with O_DIRECT bypassing the block cache
+	// and the OS page cache, and the index files are written with O_DIRECT like the data files.
+	DirectIO bool
+	// TablePropertiesCollectorFactory creates a collector for every table built, the collected
+	// properties are stored in the table and can be read back by Table.Properties.
+	TablePropertiesCollectorFactory func() TablePropertiesCollector
+	// KeyRegistry provides the data keys to encrypt the tables, the tables are not encrypted if
+	// it is nil or it has no data key.
+	KeyRegistry KeyRegistry
+	// RestartInterval is the number of keys between the restart points of a block. A key at a
+	// restart point is stored after the common prefix of the block, the other keys are stored after
+	// the prefix shared with the previous key. A larger interval saves space for long keys sharing
+	// prefixes, at the cost of decoding up to RestartInterval-1 keys to position an iterator. 0 or 1
+	// stores every key after the common prefix of the block only.
+	RestartInterval int
+	// VarintValue encodes the versions and the lengths in the values of the tables as varints,
+	// which saves about 8 bytes per entry. The tables written without it are still readable.
+	VarintValue bool
+	// VerifyBlockChecksum verifies the crc32c checksum of every block read from a table file before
+	// it is decoded and cached, so a corrupted block is returned as an error instead of being
+	// decoded. The checksums are always written, the verification costs CPU on every block load.
+	VerifyBlockChecksum bool
+}
+
+// DataKey is the key used to encrypt the data files, the files store the ID to find the key.
+type DataKey struct {
+	ID  uint64
+	Key []byte
+}
+
+// KeyRegistry manages the data keys used to encrypt the data files.
+type KeyRegistry interface {
+	// LatestDataKey returns the key to encrypt new data with, it returns nil if encryption is
+	// disabled.
+	LatestDataKey() *DataKey
+
+	// DataKey returns the key with the ID to decrypt the data.
+	DataKey(id uint64) (*DataKey, error)
+}
+
+// ObjectStorage is an S3-compatible object storage the cold tables are offloaded to.
+type ObjectStorage interface {
+	// Put uploads the object of size bytes read from r, the object is durable when it returns.
+	Put(name string, r io.Reader, size int64) error
+	// ReadAt reads len(p) bytes of the object from off like a ranged GET, it returns an error if
+	// fewer bytes are read.
+	ReadAt(name string, p []byte, off int64) (int, error)
+	// Size returns the size of the object.
+	Size(name string) (int64, error)
+	// Delete removes the object, it doesn't return an error if the object doesn't exist.
+	Delete(name string) error
+}
+
+// TablePropertiesCollector collects user defined properties of a table while it is being built.
+type TablePropertiesCollector interface {
+	// Add is called for every entry added to the table, including the old versions of a key.
+	Add(key []byte, version uint64, meta byte, userMeta, value []byte)
+
+	// Finish returns the properties to be stored in the table.
+	Finish() map[string][]byte
 }
 
 type SuRFOptions struct {
@@ -124,3 +347,71 @@ type SuRFOptions struct {
 type ValueLogWriterOptions struct {
 	WriteBufferSize int
 }
+
+// MetricsRegistry registers the prometheus metrics of the DB.
+type MetricsRegistry = prometheus.Registerer
+
+// Logger is a structured logger with levelled methods, *zap.Logger implements it.
+type Logger interface {
+	Debug(msg string, fields ...zap.Field)
+	Info(msg string, fields ...zap.Field)
+	Warn(msg string, fields ...zap.Field)
+	Error(msg string, fields ...zap.Field)
+}
+
+// NopLogger discards all the logs.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, fields ...zap.Field) {}
+func (nopLogger) Info(msg string, fields ...zap.Field)  {}
+func (nopLogger) Warn(msg string, fields ...zap.Field)  {}
+func (nopLogger) Error(msg string, fields ...zap.Field) {}
+
+// Tracer starts the spans of the stages of the reads and the commits, it can be backed by an
+// OpenTelemetry tracer.
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx, the returned context carries the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a stage of a traced read or commit.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+// CompactionJobInfo describes a compaction job.
+type CompactionJobInfo struct {
+	// Level is the level compacted, the output tables are in the next level.
+	Level int
+	// MoveDown is true if the input tables are moved to the next level without being rewritten.
+	MoveDown     bool
+	InputTables  []uint64
+	OutputTables []uint64
+	// BytesRead is the size of the input tables, BytesWritten is the size of the output tables.
+	BytesRead    int64
+	BytesWritten int64
+	// Duration and Err are set when the job is completed.
+	Duration time.Duration
+	Err      error
+}
+
+// FlushJobInfo describes a job flushing a memtable into a level 0 table.
+type FlushJobInfo struct {
+	TableID      uint64
+	BytesWritten int64
+	// Duration and Err are set when the job is completed.
+	Duration time.Duration
+	Err      error
+}
+
+// CompactionListener is notified of the compaction and flush jobs. The callbacks are called
+// synchronously by the jobs, so they must not block.
+type CompactionListener interface {
+	OnCompactionBegin(info *CompactionJobInfo)
+	OnCompactionCompleted(info *CompactionJobInfo)
+	OnFlushBegin(info *FlushJobInfo)
+	OnFlushCompleted(info *FlushJobInfo)
+}
@@ -2,11 +2,13 @@ package options
 
 import (
 	"bytes"
+	"encoding/binary"
+	"math"
 	"testing"
 )
 
 func TestCompressionType(t *testing.T) {
-	types := []CompressionType{None, Snappy, ZSTD}
+	types := []CompressionType{None, Snappy, ZSTD, LZ4}
 	data := make([]byte, 64)
 	for i := 0; i < len(data); i++ {
 		data[i] = byte(49)
@@ -27,3 +29,15 @@ func TestCompressionType(t *testing.T) {
 		}
 	}
 }
+
+func TestLZ4DecompressCorruptLength(t *testing.T) {
+	w := bytes.NewBuffer(nil)
+	if err := LZ4.Compress(w, bytes.Repeat([]byte{1}, 64)); err != nil {
+		t.Fatal(err)
+	}
+	data := w.Bytes()
+	binary.LittleEndian.PutUint32(data, math.MaxUint32)
+	if _, err := LZ4.Decompress(data); err == nil {
+		t.Error("Decompress should fail on a corrupted length")
+	}
+}
@@ -27,6 +27,8 @@ type KVPair struct {
 	Value                []byte   `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
 	UserMeta             []byte   `protobuf:"bytes,3,opt,name=userMeta,proto3" json:"userMeta,omitempty"`
 	Version              uint64   `protobuf:"varint,4,opt,name=version,proto3" json:"version,omitempty"`
+	Meta                 uint32   `protobuf:"varint,5,opt,name=meta,proto3" json:"meta,omitempty"`
+	ExpiresAt            uint64   `protobuf:"varint,6,opt,name=expires_at,json=expiresAt,proto3" json:"expires_at,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -93,6 +95,20 @@ func (m *KVPair) GetVersion() uint64 {
 	return 0
 }
 
+func (m *KVPair) GetMeta() uint32 {
+	if m != nil {
+		return m.Meta
+	}
+	return 0
+}
+
+func (m *KVPair) GetExpiresAt() uint64 {
+	if m != nil {
+		return m.ExpiresAt
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*KVPair)(nil), "protos.KVPair")
 }
@@ -100,16 +116,19 @@ func init() {
 func init() { proto.RegisterFile("backup.proto", fileDescriptor_65240d19de191688) }
 
 var fileDescriptor_65240d19de191688 = []byte{
-	// 144 bytes of a gzipped FileDescriptorProto
+	// 179 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x49, 0x4a, 0x4c, 0xce,
-	0x2e, 0x2d, 0xd0, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x03, 0x53, 0xc5, 0x4a, 0x69, 0x5c,
-	0x6c, 0xde, 0x61, 0x01, 0x89, 0x99, 0x45, 0x42, 0x02, 0x5c, 0xcc, 0xd9, 0xa9, 0x95, 0x12, 0x8c,
-	0x0a, 0x8c, 0x1a, 0x3c, 0x41, 0x20, 0xa6, 0x90, 0x08, 0x17, 0x6b, 0x59, 0x62, 0x4e, 0x69, 0xaa,
-	0x04, 0x13, 0x58, 0x0c, 0xc2, 0x11, 0x92, 0xe2, 0xe2, 0x28, 0x2d, 0x4e, 0x2d, 0xf2, 0x4d, 0x2d,
-	0x49, 0x94, 0x60, 0x06, 0x4b, 0xc0, 0xf9, 0x42, 0x12, 0x5c, 0xec, 0x65, 0xa9, 0x45, 0xc5, 0x99,
-	0xf9, 0x79, 0x12, 0x2c, 0x0a, 0x8c, 0x1a, 0x2c, 0x41, 0x30, 0xae, 0x93, 0xc0, 0x89, 0x47, 0x72,
-	0x8c, 0x17, 0x1e, 0xc9, 0x31, 0x3e, 0x78, 0x24, 0xc7, 0x38, 0xe3, 0xb1, 0x1c, 0x43, 0x12, 0xc4,
-	0x05, 0xc6, 0x80, 0x00, 0x00, 0x00, 0xff, 0xff, 0xe0, 0xb7, 0xcb, 0x72, 0x98, 0x00, 0x00, 0x00,
+	0x2e, 0x2d, 0xd0, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x03, 0x53, 0xc5, 0x4a, 0x33, 0x19,
+	0xb9, 0xd8, 0xbc, 0xc3, 0x02, 0x12, 0x33, 0x8b, 0x84, 0x04, 0xb8, 0x98, 0xb3, 0x53, 0x2b, 0x25,
+	0x18, 0x15, 0x18, 0x35, 0x78, 0x82, 0x40, 0x4c, 0x21, 0x11, 0x2e, 0xd6, 0xb2, 0xc4, 0x9c, 0xd2,
+	0x54, 0x09, 0x26, 0xb0, 0x18, 0x84, 0x23, 0x24, 0xc5, 0xc5, 0x51, 0x5a, 0x9c, 0x5a, 0xe4, 0x9b,
+	0x5a, 0x92, 0x28, 0xc1, 0x0c, 0x96, 0x80, 0xf3, 0x85, 0x24, 0xb8, 0xd8, 0xcb, 0x52, 0x8b, 0x8a,
+	0x33, 0xf3, 0xf3, 0x24, 0x58, 0x14, 0x18, 0x35, 0x58, 0x82, 0x60, 0x5c, 0x21, 0x21, 0x2e, 0x96,
+	0x5c, 0x90, 0x0e, 0x56, 0x05, 0x46, 0x0d, 0xde, 0x20, 0x30, 0x5b, 0x48, 0x96, 0x8b, 0x2b, 0xb5,
+	0xa2, 0x20, 0xb3, 0x28, 0xb5, 0x38, 0x3e, 0xb1, 0x44, 0x82, 0x0d, 0xac, 0x81, 0x13, 0x2a, 0xe2,
+	0x58, 0xe2, 0x24, 0x70, 0xe2, 0x91, 0x1c, 0xe3, 0x85, 0x47, 0x72, 0x8c, 0x0f, 0x1e, 0xc9, 0x31,
+	0xce, 0x78, 0x2c, 0xc7, 0x90, 0x04, 0x71, 0xb5, 0x31, 0x60, 0x00, 0xd3, 0x3e, 0x4a, 0x3d, 0xcc,
+	0x00, 0x00, 0x00,
 }
 
 func (m *KVPair) Marshal() (dAtA []byte, err error) {
@@ -136,6 +155,16 @@ func (m *KVPair) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.ExpiresAt != 0 {
+		i = encodeVarintBackup(dAtA, i, uint64(m.ExpiresAt))
+		i--
+		dAtA[i] = 0x30
+	}
+	if m.Meta != 0 {
+		i = encodeVarintBackup(dAtA, i, uint64(m.Meta))
+		i--
+		dAtA[i] = 0x28
+	}
 	if m.Version != 0 {
 		i = encodeVarintBackup(dAtA, i, uint64(m.Version))
 		i--
@@ -197,6 +226,12 @@ func (m *KVPair) Size() (n int) {
 	if m.Version != 0 {
 		n += 1 + sovBackup(uint64(m.Version))
 	}
+	if m.Meta != 0 {
+		n += 1 + sovBackup(uint64(m.Meta))
+	}
+	if m.ExpiresAt != 0 {
+		n += 1 + sovBackup(uint64(m.ExpiresAt))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -359,6 +394,44 @@ func (m *KVPair) Unmarshal(dAtA []byte) error {
 					break
 				}
 			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Meta", wireType)
+			}
+			m.Meta = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowBackup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Meta |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ExpiresAt", wireType)
+			}
+			m.ExpiresAt = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowBackup
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ExpiresAt |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipBackup(dAtA[iNdEx:])
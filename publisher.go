@@ -0,0 +1,236 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pingcap/badger/y"
+)
+
+// KV is a committed entry delivered to the subscribers of DB.Subscribe.
+type KV struct {
+	Key      []byte
+	Value    []byte
+	UserMeta []byte
+	Version  uint64
+	// CommitTs is the commit ts of the transaction, it is zero for the entries loaded by DB.Load.
+	CommitTs uint64
+	// Deleted is set if the entry is a delete tombstone.
+	Deleted bool
+}
+
+// maxSubscriberPendingSize bounds the size of the entries queued for a subscriber, a subscriber
+// falling behind by more than it is dropped.
+const maxSubscriberPendingSize = 64 << 20
+
+type subscriber struct {
+	prefixes [][]byte
+
+	mu          sync.Mutex
+	pending     []*KV
+	pendingSize int64
+	// err is set when the subscriber is dropped by the publisher.
+	err    error
+	notify chan struct{}
+}
+
+// take returns the entries queued for the subscriber, or the error the subscriber is dropped with.
+func (s *subscriber) take() ([]*KV, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kvs := s.pending
+	s.pending = nil
+	s.pendingSize = 0
+	return kvs, s.err
+}
+
+func (s *subscriber) match(key []byte) bool {
+	for _, prefix := range s.prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// publisher delivers the entries written to the LSM tree to the subscribers.
+type publisher struct {
+	// resolvedTs is set by ManagedDB.AdvanceResolvedTs, it must be at the top for the alignment of
+	// the atomic access.
+	resolvedTs uint64
+
+	sync.Mutex
+	numSubscribers int32
+	nextID         uint64
+	subscribers    map[uint64]*subscriber
+	maxPendingSize int64
+	closed         chan struct{}
+}
+
+func newPublisher() *publisher {
+	return &publisher{
+		subscribers:    make(map[uint64]*subscriber),
+		maxPendingSize: maxSubscriberPendingSize,
+		closed:         make(chan struct{}),
+	}
+}
+
+func (p *publisher) subscribe(prefixes [][]byte) (uint64, *subscriber) {
+	s := &subscriber{
+		prefixes: prefixes,
+		notify:   make(chan struct{}, 1),
+	}
+	p.Lock()
+	defer p.Unlock()
+	id := p.nextID
+	p.nextID++
+	p.subscribers[id] = s
+	atomic.AddInt32(&p.numSubscribers, 1)
+	return id, s
+}
+
+func (p *publisher) subscriberCount() int {
+	return int(atomic.LoadInt32(&p.numSubscribers))
+}
+
+func (p *publisher) unsubscribe(id uint64) {
+	p.Lock()
+	defer p.Unlock()
+	p.remove(id)
+}
+
+// remove must be called with the lock held, the subscriber may have been dropped already.
+func (p *publisher) remove(id uint64) {
+	if _, ok := p.subscribers[id]; ok {
+		delete(p.subscribers, id)
+		atomic.AddInt32(&p.numSubscribers, -1)
+	}
+}
+
+// publish is called by the LSM writer after the entries of reqs are written. It never blocks on
+// slow subscribers, the entries are queued until the subscriber takes them. A subscriber whose
+// queued entries exceed maxPendingSize is dropped with ErrSubscriberTooSlow.
+func (p *publisher) publish(reqs []*request) {
+	if p.subscriberCount() == 0 {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	for id, s := range p.subscribers {
+		var (
+			kvs  []*KV
+			size int64
+		)
+		for _, req := range reqs {
+			commitTs := requestCommitTs(req)
+			for _, e := range req.Entries {
+				if e.meta&bitFinTxn != 0 || !s.match(e.Key.UserKey) {
+					continue
+				}
+				kvs = append(kvs, &KV{
+					Key:      y.Copy(e.Key.UserKey),
+					Value:    y.Copy(e.Value),
+					UserMeta: y.Copy(e.UserMeta),
+					Version:  e.Key.Version,
+					CommitTs: commitTs,
+					Deleted:  e.meta&bitDelete != 0,
+				})
+				size += int64(len(e.Key.UserKey) + len(e.Value) + len(e.UserMeta))
+			}
+		}
+		if len(kvs) == 0 {
+			continue
+		}
+		s.mu.Lock()
+		if s.pendingSize+size > p.maxPendingSize {
+			s.pending = nil
+			s.pendingSize = 0
+			s.err = ErrSubscriberTooSlow
+			p.remove(id)
+		} else {
+			s.pending = append(s.pending, kvs...)
+			s.pendingSize += size
+		}
+		s.mu.Unlock()
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// requestCommitTs returns the version of the entry marking the end of the transaction, which is
+// the commit ts, or zero if the request is not a transaction.
+func requestCommitTs(req *request) uint64 {
+	if n := len(req.Entries); n > 0 && req.Entries[n-1].meta&bitFinTxn != 0 {
+		return req.Entries[n-1].Key.Version
+	}
+	return 0
+}
+
+// callCommitHook calls the hook with the entries of every request, the entry marking the end of a
+// transaction is excluded.
+func callCommitHook(hook func(entries []Entry, commitTs uint64), reqs []*request) {
+	for _, req := range reqs {
+		entries := make([]Entry, 0, len(req.Entries))
+		for _, e := range req.Entries {
+			if e.meta&bitFinTxn == 0 {
+				entries = append(entries, *e)
+			}
+		}
+		if len(entries) > 0 {
+			hook(entries, requestCommitTs(req))
+		}
+	}
+}
+
+func (p *publisher) close() {
+	close(p.closed)
+}
+
+// Subscribe invokes cb with the committed entries whose keys match any of the prefixes, in commit
+// order, after the entries are written. An empty prefix matches all the keys. Subscribe blocks
+// until ctx is done or the DB is closed, the entries committed before Subscribe is called are not
+// delivered. If cb returns an error, Subscribe stops and returns the error. If cb falls behind by
+// more than 64MB of entries, the subscriber is dropped and ErrSubscriberTooSlow is returned.
+func (db *DB) Subscribe(ctx context.Context, prefixes [][]byte, cb func(kvs []*KV) error) error {
+	if len(prefixes) == 0 {
+		return ErrInvalidRequest
+	}
+	id, s := db.publisher.subscribe(prefixes)
+	defer db.publisher.unsubscribe(id)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-db.publisher.closed:
+			return nil
+		case <-s.notify:
+			kvs, err := s.take()
+			if err != nil {
+				return err
+			}
+			if err := cb(kvs); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+
+	var (
+		mu  sync.Mutex
+		got []*KV
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- db.Subscribe(ctx, [][]byte{[]byte("a"), []byte("c")}, func(kvs []*KV) error {
+			mu.Lock()
+			got = append(got, kvs...)
+			mu.Unlock()
+			return nil
+		})
+	}()
+	// Wait for the subscriber to be registered.
+	for db.publisher.subscriberCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.Set([]byte("a1"), []byte("v1")))
+		require.NoError(t, txn.Set([]byte("b1"), []byte("v2")))
+		return txn.Set([]byte("c1"), []byte("v3"))
+	}))
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Delete([]byte("a1"))
+	}))
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.Equal(t, context.Canceled, <-done)
+
+	require.Equal(t, "a1", string(got[0].Key))
+	require.Equal(t, "v1", string(got[0].Value))
+	require.False(t, got[0].Deleted)
+	require.Equal(t, "c1", string(got[1].Key))
+	require.Equal(t, "a1", string(got[2].Key))
+	require.True(t, got[2].Deleted)
+	require.True(t, got[2].Version > got[0].Version)
+	require.Equal(t, 0, db.publisher.subscriberCount())
+}
+
+func TestSubscribeTooSlow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+	db.publisher.Lock()
+	db.publisher.maxPendingSize = 100
+	db.publisher.Unlock()
+
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- db.Subscribe(context.Background(), [][]byte{nil}, func(kvs []*KV) error {
+			close(blocked)
+			<-release
+			return nil
+		})
+	}()
+	for db.publisher.subscriberCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	txnSet(t, db, []byte("key"), []byte("value"), 0)
+	<-blocked
+	// The entries are queued while cb is blocked until the subscriber is dropped.
+	for i := 0; i < 10; i++ {
+		txnSet(t, db, []byte("key"), make([]byte, 20), 0)
+	}
+	require.Equal(t, 0, db.publisher.subscriberCount())
+	close(release)
+	require.Equal(t, ErrSubscriberTooSlow, <-done)
+}
+
+func TestCommitHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	type commit struct {
+		entries  []Entry
+		commitTs uint64
+	}
+	var commits []commit
+	opts := getTestOptions(dir)
+	opts.CommitHook = func(entries []Entry, commitTs uint64) {
+		// It is called serially, before the commit returns.
+		commits = append(commits, commit{entries, commitTs})
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.Set([]byte("a"), []byte("v1")))
+		return txn.Set([]byte("b"), []byte("v2"))
+	}))
+	require.Len(t, commits, 1)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Delete([]byte("a"))
+	}))
+	require.Len(t, commits, 2)
+
+	first, second := commits[0], commits[1]
+	require.Len(t, first.entries, 2)
+	require.Equal(t, "a", string(first.entries[0].Key.UserKey))
+	require.Equal(t, "v1", string(first.entries[0].Value))
+	require.Equal(t, first.commitTs, first.entries[0].Key.Version)
+	require.False(t, first.entries[0].IsDeleted())
+	require.Equal(t, "b", string(first.entries[1].Key.UserKey))
+	require.Len(t, second.entries, 1)
+	require.True(t, second.entries[0].IsDeleted())
+	require.True(t, second.commitTs > first.commitTs)
+}
@@ -0,0 +1,226 @@
+package badger
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/badger/fileutil"
+	"github.com/pingcap/badger/options"
+	"github.com/pingcap/badger/protos"
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/errors"
+	"go.uber.org/zap"
+)
+
+// RepairReport describes the changes made by Repair.
+type RepairReport struct {
+	// RemovedTables are the newest tables partially written by a crash, their files are deleted.
+	RemovedTables []uint64
+	// QuarantinedTables are the other tables removed from the manifest because their files are
+	// missing or corrupted, their files are moved to the quarantine directory in Dir.
+	QuarantinedTables []uint64
+	// TruncatedValueLog is the value log file truncated at its last valid entry, it is empty if
+	// the value log is intact.
+	TruncatedValueLog string
+	TruncatedBytes    int64
+}
+
+// Repair fixes the files partially written by a crash so the DB in opt.Dir can be opened. It must
+// be called when the DB is not open. The manifest is truncated at its last valid record, the
+// tables which can't be opened or fail the checksum verification are removed from the manifest
+// and the manifest is rewritten, and the last value log file is truncated at its last valid entry.
+// Only the newest table is deleted if it is partial or not referenced by the manifest, the files
+// of the other corrupt tables are quarantined. The data in the removed tables and the truncated
+// entries is lost, it is logged by opt.Logger.
+func Repair(opt Options) (*RepairReport, error) {
+	if opt.Logger == nil {
+		opt.Logger = options.NopLogger
+	}
+	if opt.ValueDir == "" {
+		opt.ValueDir = opt.Dir
+	}
+	dirLockGuard, err := acquireDirectoryLock(opt.Dir, lockFile, false)
+	if err != nil {
+		return nil, err
+	}
+	defer dirLockGuard.release()
+	absDir, err := filepath.Abs(opt.Dir)
+	if err != nil {
+		return nil, err
+	}
+	absValueDir, err := filepath.Abs(opt.ValueDir)
+	if err != nil {
+		return nil, err
+	}
+	if absValueDir != absDir {
+		valueDirLockGuard, err := acquireDirectoryLock(opt.ValueDir, lockFile, false)
+		if err != nil {
+			return nil, err
+		}
+		defer valueDirLockGuard.release()
+	}
+	kr, err := openKeyRegistry(opt.Dir, opt.EncryptionKey, true)
+	if err != nil {
+		return nil, err
+	}
+	report := new(RepairReport)
+	if err = repairTables(opt, kr, report); err != nil {
+		return report, err
+	}
+	return report, repairValueLog(opt, kr, report)
+}
+
+func repairTables(opt Options, kr *keyRegistry, report *RepairReport) error {
+	mf, manifest, err := openOrCreateManifestFile(opt.Dir, false, true, false, opt.Logger)
+	if err != nil {
+		return err
+	}
+	defer mf.close()
+	ids := make([]uint64, 0, len(manifest.Tables))
+	for id := range manifest.Tables {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	// Only the newest table can be partially written by a crash, it is removed. The other corrupt
+	// tables are quarantined so their files are kept for inspection.
+	var newest uint64
+	found := len(ids) > 0
+	if found {
+		newest = ids[len(ids)-1]
+	}
+	for id := range getIDMap(opt.Dir) {
+		if !found || id > newest {
+			newest = id
+		}
+		found = true
+	}
+	if _, ok := manifest.Tables[newest]; !ok && found {
+		opt.Logger.Warn("remove the newest table not referenced in MANIFEST", zap.Uint64("id", newest))
+		if err = removeTableFiles(opt.Dir, newest); err != nil {
+			return err
+		}
+		report.RemovedTables = append(report.RemovedTables, newest)
+	}
+	var changes []*protos.ManifestChange
+	for _, id := range ids {
+		filename := sstable.NewFilename(id, opt.Dir)
+		t, err := sstable.OpenTable(filename, options.FileIO, nil, nil, kr)
+		if err == nil {
+			err = t.VerifyChecksum(context.Background(), nil)
+			_ = t.Close()
+		}
+		if err == nil {
+			continue
+		}
+		if id == newest {
+			opt.Logger.Warn("remove the partial table from MANIFEST", zap.Uint64("id", id), zap.Error(err))
+			if err = removeTableFiles(opt.Dir, id); err != nil {
+				return err
+			}
+			report.RemovedTables = append(report.RemovedTables, id)
+		} else {
+			opt.Logger.Warn("quarantine the corrupt table", zap.Uint64("id", id), zap.Error(err))
+			if err = quarantineTable(opt.Dir, id); err != nil {
+				return err
+			}
+			report.QuarantinedTables = append(report.QuarantinedTables, id)
+		}
+		changes = append(changes, newDeleteChange(id))
+	}
+	if len(changes) > 0 {
+		if err = mf.addChanges(changes, nil); err != nil {
+			return err
+		}
+	}
+	// The manifest is rewritten so the records after the removed tables are compacted.
+	mf.appendLock.Lock()
+	defer mf.appendLock.Unlock()
+	if err = mf.rewrite(); err != nil {
+		return err
+	}
+	return syncDir(opt.Dir)
+}
+
+func removeTableFiles(dir string, id uint64) error {
+	filename := sstable.NewFilename(id, dir)
+	for _, name := range []string{filename, sstable.IndexFilename(filename)} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func repairValueLog(opt Options, kr *keyRegistry, report *RepairReport) error {
+	files, err := ioutil.ReadDir(opt.ValueDir)
+	if err != nil {
+		return err
+	}
+	var maxFid uint32
+	found := false
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".vlog") {
+			continue
+		}
+		fid, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".vlog"), 10, 32)
+		if err != nil {
+			return errors.Wrapf(err, "Error while parsing value log id for file: %q", file.Name())
+		}
+		if !found || uint32(fid) > maxFid {
+			maxFid = uint32(fid)
+		}
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	lf := &logFile{path: vlogFilePath(opt.ValueDir, maxFid), fid: maxFid}
+	if lf.fd, err = os.OpenFile(lf.path, os.O_RDWR, 0666); err != nil {
+		return err
+	}
+	defer lf.fd.Close()
+	if err = lf.readHeader(kr); err != nil {
+		return err
+	}
+	fi, err := lf.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = lf.fd.Seek(int64(lf.headerSize()), io.SeekStart); err != nil {
+		return err
+	}
+	read := &safeRead{
+		k:            make([]byte, 10),
+		v:            make([]byte, 10),
+		lf:           lf,
+		recordOffset: lf.headerSize(),
+	}
+	reader := bufio.NewReader(lf.fd)
+	for {
+		e, err := read.Entry(reader)
+		if err == io.EOF {
+			// The rest of the file is preallocated.
+			return nil
+		} else if err == io.ErrUnexpectedEOF || err == errTruncate {
+			break
+		} else if err != nil {
+			return err
+		}
+		read.recordOffset += uint32(e.encodedSize())
+	}
+	report.TruncatedValueLog = lf.path
+	report.TruncatedBytes = fi.Size() - int64(read.recordOffset)
+	opt.Logger.Warn("truncate the value log at the last valid entry", zap.String("path", lf.path),
+		zap.Uint32("offset", read.recordOffset), zap.Int64("truncated bytes", report.TruncatedBytes))
+	if err = lf.fd.Truncate(int64(read.recordOffset)); err != nil {
+		return err
+	}
+	return fileutil.Fsync(lf.fd)
+}
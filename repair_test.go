@@ -0,0 +1,90 @@
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DoNotCompact = true
+	opts.CompactL0WhenClose = false
+	db, err := Open(opts)
+	require.NoError(t, err)
+	set := func(start, end int) {
+		for i := start; i < end; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%03d", i)))
+			}))
+		}
+	}
+	set(0, 100)
+	db.flushMemTable().Wait()
+	tables := db.Tables()
+	require.Len(t, tables, 1)
+	corruptID := tables[0].ID
+	set(100, 200)
+	vlogPath := vlogFilePath(dir, db.vlog.maxFid())
+	vlogEnd := int64(db.vlog.writableOffset())
+	require.NoError(t, db.Close())
+
+	// Corrupt a block of the first table and write a partial entry at the end of the value log.
+	f, err := os.OpenFile(sstable.NewFilename(corruptID, dir), os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff}, 10)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	f, err = os.OpenFile(vlogPath, os.O_RDWR, 0666)
+	require.NoError(t, err)
+	entry := make([]byte, 20)
+	_, err = f.ReadAt(entry, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(entry, vlogEnd)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	fi, err := os.Stat(vlogPath)
+	require.NoError(t, err)
+	// A table partially written by a crash is newer than the tables in the manifest.
+	partialID := corruptID + 100
+	require.NoError(t, ioutil.WriteFile(sstable.NewFilename(partialID, dir), []byte("partial"), 0666))
+
+	report, err := Repair(opts)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{partialID}, report.RemovedTables)
+	require.Equal(t, []uint64{corruptID}, report.QuarantinedTables)
+	_, err = os.Stat(sstable.NewFilename(partialID, dir))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, quarantineDir, sstable.IDToFilename(corruptID)))
+	require.NoError(t, err)
+	require.Equal(t, vlogPath, report.TruncatedValueLog)
+	require.Equal(t, fi.Size()-vlogEnd, report.TruncatedBytes)
+	fi, err = os.Stat(vlogPath)
+	require.NoError(t, err)
+	require.Equal(t, vlogEnd, fi.Size())
+
+	// The repaired DB is intact.
+	report, err = Repair(opts)
+	require.NoError(t, err)
+	require.Equal(t, &RepairReport{}, report)
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte("key050"))
+		require.Equal(t, ErrKeyNotFound, err)
+		item, err := txn.Get([]byte("key150"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val150"), getItemValue(t, item))
+		return nil
+	}))
+}
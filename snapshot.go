@@ -0,0 +1,97 @@
+package badger
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/pingcap/badger/epoch"
+	"github.com/pingcap/badger/table"
+)
+
+// Snapshot is a read-only view of the DB at a read timestamp. Unlike a read-only Txn, a Snapshot
+// can be used by many goroutines concurrently, it pins the memtables and the tables visible at the
+// read timestamp until it is closed, and it doesn't track the keys read.
+//
+// The items and iterators returned by a Snapshot follow the same rules as the items and iterators
+// of a Txn, each of them must be used by one goroutine at a time.
+type Snapshot struct {
+	db     *DB
+	readTs uint64
+	guard  *epoch.Guard
+	closed int32
+}
+
+// NewSnapshot returns a snapshot of the DB at the latest read timestamp, or at math.MaxUint64 if the
+// DB is managed. The snapshot must be closed once it is no longer used.
+func (db *DB) NewSnapshot() *Snapshot {
+	if db.IsManaged() {
+		return db.newSnapshot(math.MaxUint64)
+	}
+	return db.newSnapshot(db.orc.readTs())
+}
+
+// NewSnapshotAt follows the same logic as DB.NewSnapshot(), but uses the provided read timestamp.
+func (db *ManagedDB) NewSnapshotAt(readTs uint64) *Snapshot {
+	return db.newSnapshot(readTs)
+}
+
+func (db *DB) newSnapshot(readTs uint64) *Snapshot {
+	s := &Snapshot{db: db, readTs: readTs}
+	if !db.IsManaged() {
+		s.guard = db.resourceMgr.AcquireWithPayload(newGuardPayload(readTs))
+	} else {
+		s.guard = db.resourceMgr.Acquire()
+	}
+	return s
+}
+
+// newTxn returns a read-only txn sharing the read timestamp and the guard of the snapshot, it is
+// never discarded as the guard is released by Close.
+func (s *Snapshot) newTxn() (*Txn, error) {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return nil, ErrSnapshotClosed
+	}
+	return &Txn{db: s.db, readTs: s.readTs}, nil
+}
+
+// ReadTs returns the read timestamp of the snapshot.
+func (s *Snapshot) ReadTs() uint64 {
+	return s.readTs
+}
+
+// Get looks for key and returns corresponding Item.
+// If key is not found, ErrKeyNotFound is returned.
+func (s *Snapshot) Get(key []byte) (*Item, error) {
+	txn, err := s.newTxn()
+	if err != nil {
+		return nil, err
+	}
+	return txn.Get(key)
+}
+
+// MultiGet gets items for keys, if not found, the corresponding item will be nil.
+func (s *Snapshot) MultiGet(keys [][]byte) ([]*Item, error) {
+	txn, err := s.newTxn()
+	if err != nil {
+		return nil, err
+	}
+	return txn.MultiGet(keys)
+}
+
+// NewIterator returns a new iterator over the snapshot, it must be closed before the snapshot is
+// closed.
+func (s *Snapshot) NewIterator(opt IteratorOptions) *Iterator {
+	txn, err := s.newTxn()
+	if err != nil {
+		return &Iterator{iitr: &table.EmptyIterator{}, txn: &Txn{db: s.db}, opt: opt, err: err}
+	}
+	return txn.NewIterator(opt)
+}
+
+// Close releases the memtables and the tables pinned by the snapshot. Calling it multiple times
+// doesn't cause any issues.
+func (s *Snapshot) Close() {
+	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		s.guard.Done()
+	}
+}
@@ -0,0 +1,76 @@
+package badger
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := func(i int) []byte {
+			return []byte(fmt.Sprintf("key%03d", i))
+		}
+		n := 100
+		write := func(val string) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for i := 0; i < n; i++ {
+					require.NoError(t, txn.Set(key(i), []byte(val)))
+				}
+				return nil
+			}))
+		}
+		write("old")
+		snap := db.NewSnapshot()
+		write("new")
+		db.flushMemTable().Wait()
+
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var keys [][]byte
+				for i := 0; i < n; i++ {
+					item, err := snap.Get(key(i))
+					require.NoError(t, err)
+					require.Equal(t, []byte("old"), getItemValue(t, item))
+					keys = append(keys, key(i))
+				}
+				items, err := snap.MultiGet(keys)
+				require.NoError(t, err)
+				for _, item := range items {
+					require.Equal(t, []byte("old"), getItemValue(t, item))
+				}
+				it := snap.NewIterator(DefaultIteratorOptions)
+				var cnt int
+				for it.Rewind(); it.Valid(); it.Next() {
+					require.Equal(t, key(cnt), it.Item().Key())
+					require.Equal(t, []byte("old"), getItemValue(t, it.Item()))
+					cnt++
+				}
+				it.Close()
+				require.Equal(t, n, cnt)
+			}()
+		}
+		wg.Wait()
+
+		snap.Close()
+		snap.Close()
+		_, err := snap.Get(key(0))
+		require.Equal(t, ErrSnapshotClosed, err)
+		it := snap.NewIterator(DefaultIteratorOptions)
+		it.Rewind()
+		require.False(t, it.Valid())
+		require.Equal(t, ErrSnapshotClosed, it.Err())
+		it.Close()
+
+		snap = db.NewSnapshot()
+		defer snap.Close()
+		item, err := snap.Get(key(0))
+		require.NoError(t, err)
+		require.Equal(t, []byte("new"), getItemValue(t, item))
+	})
+}
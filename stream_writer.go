@@ -0,0 +1,257 @@
+package badger
+
+import (
+	"os"
+
+	"github.com/ncw/directio"
+	"github.com/pingcap/badger/protos"
+	"github.com/pingcap/badger/table"
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrUnsortedKey is returned by StreamWriter.Write if the entries are not in ascending key order.
+	ErrUnsortedKey = errors.New("Keys written to StreamWriter are not sorted")
+
+	// ErrStreamWriterNotEmpty is returned by StreamWriter.Prepare if the DB has any data.
+	ErrStreamWriterNotEmpty = errors.New("StreamWriter requires an empty DB")
+
+	// ErrStreamWriterNotPrepared is returned by StreamWriter.Write if Prepare has not succeeded.
+	ErrStreamWriterNotPrepared = errors.New("StreamWriter is not prepared")
+)
+
+// StreamWriter bulk loads pre-sorted entries into an empty DB. The entries are written into
+// tables directly with the table builder and the tables are installed into the bottom level,
+// so the memtable, the value log and the compactions are all bypassed.
+//
+// The entries must be written in ascending order of (key, descending version) and no other write
+// can be issued while the StreamWriter is in use.
+type StreamWriter struct {
+	db       *DB
+	level    int
+	prepared bool
+	builder  *sstable.Builder
+	fd       *os.File
+	bb       *blobFileBuilder
+
+	lastKey    y.Key
+	maxVersion uint64
+	results    []*sstable.BuildResult
+	blobs      []*blobFile
+}
+
+// NewStreamWriter creates a StreamWriter, Prepare must be called before writing any entries.
+func (db *DB) NewStreamWriter() *StreamWriter {
+	return &StreamWriter{
+		db:    db,
+		level: db.opt.TableBuilderOptions.MaxLevels - 1,
+	}
+}
+
+// Prepare checks the DB is empty, so the streamed entries are the only data in the DB. It returns
+// ErrStreamWriterNotEmpty if the DB has any data, DropAll can be called to drop it first.
+func (sw *StreamWriter) Prepare() error {
+	if sw.db.opt.ReadOnly || sw.db.volatileMode {
+		return ErrInvalidRequest
+	}
+	if len(sw.db.Tables()) > 0 {
+		return ErrStreamWriterNotEmpty
+	}
+	for _, mt := range sw.db.getMemTables() {
+		if !mt.Empty() {
+			return ErrStreamWriterNotEmpty
+		}
+	}
+	sw.prepared = true
+	return nil
+}
+
+// Write adds the entries to the tables being built. The entries must be sorted and come after
+// all the entries written before.
+func (sw *StreamWriter) Write(entries []*Entry) error {
+	if !sw.prepared {
+		return ErrStreamWriterNotPrepared
+	}
+	for _, e := range entries {
+		if len(e.Key.UserKey) == 0 {
+			return ErrEmptyKey
+		}
+		if len(e.Key.UserKey) > maxKeySize {
+			return exceedsMaxKeySizeError(e.Key.UserKey)
+		}
+		if !sw.lastKey.IsEmpty() && e.Key.Compare(sw.lastKey) <= 0 {
+			return ErrUnsortedKey
+		}
+		if err := sw.add(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sw *StreamWriter) add(e *Entry) error {
+	opt := sw.db.opt
+	value := newEntry(e).Value
+	kvSize := int64(e.Key.Len()) + int64(value.EncodedSize())
+	// All the versions of a key are kept in the same table.
+	if sw.builder != nil && !e.Key.SameUserKey(sw.lastKey) &&
+		int64(sw.builder.EstimateSize())+kvSize > opt.TableBuilderOptions.MaxTableSize {
+		if err := sw.finishTable(); err != nil {
+			return err
+		}
+	}
+	if sw.fd == nil {
+		if err := sw.newTable(); err != nil {
+			return err
+		}
+	}
+	isBlob := sw.db.isBlobValue(value, sw.db.getValueThreshold())
+	value.Meta &^= bitValuePlacement
+	if isBlob {
+		if sw.bb == nil {
+			bb, err := sw.db.newBlobFileBuilder()
+			if err != nil {
+				return y.Wrap(err)
+			}
+			sw.bb = bb
+		}
+		bp, err := sw.bb.append(value.Value)
+		if err != nil {
+			return err
+		}
+		value.Meta |= bitValuePointer
+		value.Value = bp
+	}
+	if err := sw.builder.Add(e.Key, value); err != nil {
+		return err
+	}
+	sw.lastKey.Copy(e.Key)
+	if e.Key.Version > sw.maxVersion {
+		sw.maxVersion = e.Key.Version
+	}
+	return nil
+}
+
+func (sw *StreamWriter) newTable() error {
+	filename := sstable.NewFilename(sw.db.lc.reserveFileID(), sw.db.opt.Dir)
+	fd, err := directio.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	if sw.builder == nil {
+		sw.builder = sstable.NewTableBuilder(fd, sw.db.lc.limiters[sw.level], sw.level, sw.db.opt.TableBuilderOptions)
+	} else {
+		sw.builder.Reset(fd)
+	}
+	sw.fd = fd
+	return nil
+}
+
+func (sw *StreamWriter) finishTable() error {
+	result, err := sw.builder.Finish()
+	if err != nil {
+		return y.Wrap(err)
+	}
+	sw.fd.Close()
+	sw.fd = nil
+	sw.results = append(sw.results, result)
+	if sw.bb != nil {
+		bf, err := sw.bb.finish()
+		if err != nil {
+			return err
+		}
+		sw.bb = nil
+		sw.blobs = append(sw.blobs, bf)
+	}
+	return nil
+}
+
+// Flush finishes the tables and installs them into the bottom level of the DB. The StreamWriter
+// can not be used after Flush.
+func (sw *StreamWriter) Flush() error {
+	if sw.fd != nil {
+		if err := sw.finishTable(); err != nil {
+			return err
+		}
+	}
+	db := sw.db
+	for _, bf := range sw.blobs {
+		if err := db.blobManger.addFile(bf); err != nil {
+			return err
+		}
+	}
+	tbls, err := db.lc.openTables(sw.results)
+	if err != nil {
+		return err
+	}
+	if err = sw.installTables(tbls); err != nil {
+		deleteTables(tbls)
+		return err
+	}
+
+	orc := db.orc
+	orc.Lock()
+	if sw.maxVersion >= orc.nextCommit {
+		orc.nextCommit = sw.maxVersion + 1
+	}
+	orc.curRead = orc.nextCommit - 1
+	orc.Unlock()
+	log.Info("stream writer flushed", zap.Int("tables", len(tbls)), zap.Int("blobs", len(sw.blobs)))
+	return nil
+}
+
+// installTables adds the tables to the bottom level, the version in the manifest head is moved to
+// the max version of the entries so the read ts will not fall behind them after the DB is reopened.
+func (sw *StreamWriter) installTables(tbls []table.Table) error {
+	db := sw.db
+	changes := make([]*protos.ManifestChange, 0, len(tbls))
+	for _, t := range tbls {
+		changes = append(changes, newCreateChange(t.ID(), sw.level))
+	}
+	mf := db.manifest
+	mf.appendLock.Lock()
+	var head *protos.HeadInfo
+	if oldHead := mf.manifest.Head; oldHead == nil || oldHead.Version < sw.maxVersion {
+		head = &protos.HeadInfo{Version: sw.maxVersion}
+		if oldHead != nil {
+			head.LogID = oldHead.LogID
+			head.LogOffset = oldHead.LogOffset
+		}
+	}
+	mf.appendLock.Unlock()
+	if err := mf.addChanges(changes, head); err != nil {
+		return err
+	}
+	for _, t := range tbls {
+		db.lc.levels[sw.level].addTable(t)
+	}
+	return nil
+}
+
+// Cancel removes the files built so far, it must be called if Flush is not called.
+func (sw *StreamWriter) Cancel() {
+	if sw.fd != nil {
+		filename := sw.fd.Name()
+		sw.fd.Close()
+		os.Remove(filename)
+		sw.fd = nil
+	}
+	for _, result := range sw.results {
+		os.Remove(result.FileName)
+		os.Remove(sstable.IndexFilename(result.FileName))
+	}
+	sw.results = nil
+	if sw.bb != nil {
+		sw.bb.file.Close()
+		os.Remove(sw.bb.file.Name())
+		sw.bb = nil
+	}
+	for _, bf := range sw.blobs {
+		bf.Delete()
+	}
+	sw.blobs = nil
+}
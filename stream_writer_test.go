@@ -0,0 +1,83 @@
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pingcap/badger/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	val := func(i int, version uint64) []byte { return []byte(fmt.Sprintf("value-%05d-%d-%064d", i, version, i)) }
+	// The StreamWriter requires an empty DB.
+	txnSet(t, db, []byte("old"), []byte("old"), 0)
+	sw := db.NewStreamWriter()
+	require.Equal(t, ErrStreamWriterNotPrepared, sw.Write([]*Entry{{Key: y.KeyWithTs(key(0), 100)}}))
+	require.Equal(t, ErrStreamWriterNotEmpty, sw.Prepare())
+	require.Equal(t, ErrStreamWriterNotPrepared, sw.Write([]*Entry{{Key: y.KeyWithTs(key(0), 100)}}))
+	require.NoError(t, db.DropAll())
+	require.NoError(t, sw.Prepare())
+	n := 5000
+	for i := 0; i < n; i++ {
+		entries := []*Entry{
+			{Key: y.KeyWithTs(key(i), 200), Value: val(i, 200)},
+			{Key: y.KeyWithTs(key(i), 100), Value: val(i, 100)},
+		}
+		if i%10 == 0 {
+			entries[0].SetDelete()
+			entries[0].Value = nil
+		}
+		require.NoError(t, sw.Write(entries))
+	}
+	require.Equal(t, ErrUnsortedKey, sw.Write([]*Entry{{Key: y.KeyWithTs(key(0), 300)}}))
+	require.NoError(t, sw.Flush())
+
+	verify := func(db *DB) {
+		tbls := db.Tables()
+		require.True(t, len(tbls) > 1)
+		for _, tbl := range tbls {
+			require.Equal(t, db.opt.TableBuilderOptions.MaxLevels-1, tbl.Level)
+		}
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("old"))
+			require.Equal(t, ErrKeyNotFound, err)
+			for i := 0; i < n; i++ {
+				item, err := txn.Get(key(i))
+				if i%10 == 0 {
+					require.Equal(t, ErrKeyNotFound, err)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, uint64(200), item.Version())
+				require.Equal(t, val(i, 200), getItemValue(t, item))
+			}
+			return nil
+		}))
+	}
+	verify(db)
+	require.NoError(t, db.Close())
+
+	db, err = Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+	verify(db)
+	// The new commits are newer than the streamed entries.
+	txnSet(t, db, key(1), []byte("new"), 0)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get(key(1))
+		require.NoError(t, err)
+		require.True(t, item.Version() > 200)
+		require.Equal(t, []byte("new"), getItemValue(t, item))
+		return nil
+	}))
+}
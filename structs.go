@@ -2,9 +2,11 @@ package badger
 
 import (
 	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
+	"time"
 
 	"github.com/pingcap/badger/y"
 )
@@ -23,6 +25,8 @@ type header struct {
 const (
 	headerBufSize       = 18
 	metaNotEntryEncoded = 0
+	// The expiresAt follows the header if bitExpiresAt is set in meta.
+	expiresAtSize = 8
 )
 
 func (h header) Encode(out []byte) {
@@ -55,7 +59,8 @@ func isEncodedHeader(data []byte) bool {
 type Entry struct {
 	Key       y.Key
 	Value     []byte
-	UserMeta  []byte
+	UserMeta  []byte // Up to 255 bytes stored along with the value, returned by Item.UserMeta.
+	ExpiresAt uint64 // The unix time in seconds when the entry expires, 0 means it never expires.
 	meta      byte
 	logOffset logOffset
 
@@ -67,12 +72,58 @@ func (e *Entry) SetDelete() {
 	e.meta |= bitDelete
 }
 
+// IsDeleted returns true if the entry is a delete tombstone.
+func (e *Entry) IsDeleted() bool {
+	return e.meta&bitDelete != 0
+}
+
+// WithTTL sets the entry to expire after dur, an expired entry is treated as deleted and
+// dropped by compaction.
+func (e *Entry) WithTTL(dur time.Duration) *Entry {
+	e.ExpiresAt = uint64(time.Now().Add(dur).Unix())
+	return e
+}
+
+// WithAppMeta sets the application bits of the entry meta to the bits of meta in AppMetaMask, the
+// other bits of meta are ignored.
+func (e *Entry) WithAppMeta(meta byte) *Entry {
+	e.meta = e.meta&^AppMetaMask | meta&AppMetaMask
+	return e
+}
+
+// WithValueInline stores the value in the LSM tree regardless of the value threshold.
+func (e *Entry) WithValueInline() *Entry {
+	e.meta = e.meta&^bitValuePlacement | bitValueInline
+	return e
+}
+
+// WithValueInBlob stores the value in a blob file regardless of the value threshold, unless
+// DisableValueLog is set.
+func (e *Entry) WithValueInBlob() *Entry {
+	e.meta = e.meta&^bitValuePlacement | bitValueInBlob
+	return e
+}
+
 func (e *Entry) estimateSize() int {
-	return e.Key.Len() + len(e.Value) + len(e.UserMeta) + 2 // Meta, UserMeta
+	sz := e.Key.Len() + len(e.Value) + len(e.UserMeta) + 2 // Meta, UserMeta
+	if e.ExpiresAt != 0 {
+		sz += expiresAtSize
+	}
+	return sz
+}
+
+// encodedSize returns the size of the entry encoded in the value log.
+func (e *Entry) encodedSize() int {
+	sz := headerBufSize + len(e.UserMeta) + len(e.Key.UserKey) + len(e.Value) + 4 // len(crcBuf)
+	if e.meta&bitExpiresAt != 0 {
+		sz += expiresAtSize
+	}
+	return sz
 }
 
 // Encodes e to buf. Returns number of bytes written.
-func encodeEntry(e *Entry, buf *bytes.Buffer) (int, error) {
+// If stream is not nil, the UserMeta, key and value are encrypted by it.
+func encodeEntry(e *Entry, buf *bytes.Buffer, stream cipher.Stream) (int, error) {
 	h := header{
 		klen:  uint32(len(e.Key.UserKey)),
 		vlen:  uint32(len(e.Value)),
@@ -89,20 +140,28 @@ func encodeEntry(e *Entry, buf *bytes.Buffer) (int, error) {
 	buf.Write(headerEnc[:])
 	hash.Write(headerEnc[:])
 
-	buf.Write(e.UserMeta)
-	hash.Write(e.UserMeta)
+	if e.meta&bitExpiresAt != 0 {
+		var expiresAtBuf [expiresAtSize]byte
+		binary.BigEndian.PutUint64(expiresAtBuf[:], e.ExpiresAt)
+		buf.Write(expiresAtBuf[:])
+		hash.Write(expiresAtBuf[:])
+	}
 
+	bodyStart := buf.Len()
+	buf.Write(e.UserMeta)
 	buf.Write(e.Key.UserKey)
-	hash.Write(e.Key.UserKey)
-
 	buf.Write(e.Value)
-	hash.Write(e.Value)
+	body := buf.Bytes()[bodyStart:]
+	if stream != nil {
+		stream.XORKeyStream(body, body)
+	}
+	hash.Write(body)
 
 	var crcBuf [4]byte
 	binary.BigEndian.PutUint32(crcBuf[:], hash.Sum32())
 	buf.Write(crcBuf[:])
 
-	return len(headerEnc) + len(e.UserMeta) + len(e.Key.UserKey) + len(e.Value) + len(crcBuf), nil
+	return e.encodedSize(), nil
 }
 
 func (e Entry) print(prefix string) {
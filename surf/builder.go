@@ -32,6 +32,20 @@ type Builder struct {
 
 	nodeCounts           []uint32
 	isLastItemTerminator []bool
+
+	// The added keys are truncated to the shortest prefixes which distinguish them from their
+	// neighbors, the truncated bytes are encoded into the suffixes when the next key is added.
+	keyData     []byte
+	keyEnds     []uint32
+	keyValues   []byte
+	keySuffixes []uint64
+
+	// The last added key is pending until the next key is added, pendingLCP is the length of the
+	// common prefix of the pending key and its previous key.
+	pendingKey   []byte
+	pendingValue []byte
+	pendingLCP   int
+	hasPending   bool
 }
 
 // NewBuilder returns a new SuRF builder.
@@ -43,12 +57,37 @@ func NewBuilder(valueSize uint32, hashSuffixLen, realSuffixLen uint32) *Builder
 	}
 }
 
-// Build returns the SuRF for added kv pairs.
+// Build returns the SuRF for the kv pairs, the keys must be sorted and unique.
 // The bitsPerKeyHint is a size hint used when determine how many levels can use the dense-loudes format.
 // The dense-loudes format is faster than sparse-loudes format, but may consume more space.
 func (b *Builder) Build(keys, vals [][]byte, bitsPerKeyHint int) *SuRF {
-	b.totalCount = len(keys)
-	b.buildNodes(keys, vals, 0, 0, 0)
+	for i := range keys {
+		b.Add(keys[i], vals[i])
+	}
+	return b.Finish(bitsPerKeyHint)
+}
+
+// Add adds a kv pair to the builder, the keys must be added in ascending order and unique.
+// The builder only keeps the prefix of the key which is needed to build the trie and the suffix,
+// so the memory used by the builder is bounded by the truncated keys instead of the whole keys.
+func (b *Builder) Add(key, value []byte) {
+	if b.hasPending {
+		lcp := commonPrefixLen(b.pendingKey, key)
+		depth := b.pendingLCP
+		if lcp > depth {
+			depth = lcp
+		}
+		b.appendKey(b.pendingKey, b.pendingValue, depth)
+		b.pendingLCP = lcp
+	}
+	b.pendingKey = append(b.pendingKey[:0], key...)
+	b.pendingValue = append(b.pendingValue[:0], value[:b.valueSize]...)
+	b.hasPending = true
+}
+
+// Finish returns the SuRF for the added kv pairs.
+func (b *Builder) Finish(bitsPerKeyHint int) *SuRF {
+	b.buildTrie()
 	b.determineCutoffLevel(bitsPerKeyHint)
 	b.buildDense()
 
@@ -58,6 +97,54 @@ func (b *Builder) Build(keys, vals [][]byte, bitsPerKeyHint int) *SuRF {
 	return surf
 }
 
+// appendKey appends the key truncated after depth, which is the depth of the key's leaf node.
+func (b *Builder) appendKey(key, value []byte, depth int) {
+	suffix := constructSuffix(key, uint32(depth)+1, b.realSuffixLen, b.hashSuffixLen)
+	if depth+1 < len(key) {
+		key = key[:depth+1]
+	}
+	b.keyData = append(b.keyData, key...)
+	b.keyEnds = append(b.keyEnds, uint32(len(b.keyData)))
+	b.keyValues = append(b.keyValues, value...)
+	b.keySuffixes = append(b.keySuffixes, suffix)
+}
+
+func (b *Builder) buildTrie() {
+	if b.hasPending {
+		b.appendKey(b.pendingKey, b.pendingValue, b.pendingLCP)
+		b.hasPending = false
+	}
+	b.totalCount = len(b.keyEnds)
+	if b.totalCount > 0 {
+		b.buildNodes(0, b.totalCount, 0, 0, 0)
+	}
+}
+
+func (b *Builder) key(i int) []byte {
+	var start uint32
+	if i > 0 {
+		start = b.keyEnds[i-1]
+	}
+	return b.keyData[start:b.keyEnds[i]]
+}
+
+func (b *Builder) value(i int) []byte {
+	return b.keyValues[i*int(b.valueSize) : (i+1)*int(b.valueSize)]
+}
+
+func commonPrefixLen(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
 // buildNodes is recursive algorithm to bulk building SuRF nodes.
 //	* We divide keys into groups by the `key[depth]`, so keys in each group shares the same prefix
 //	* If depth larger than the length if the first key in group, the key is prefix of others in group
@@ -65,39 +152,39 @@ func (b *Builder) Build(keys, vals [][]byte, bitsPerKeyHint int) *SuRF {
 //	* Scan over keys in current group when meets different label, use the new sub group call buildNodes with level+1 recursively
 //	* If all keys in current group have the same label, this node can be compressed, use this group call buildNodes with level recursively.
 //	* If current group contains only one key constract suffix of this key and return.
-func (b *Builder) buildNodes(keys, vals [][]byte, prefixDepth, depth, level int) {
+func (b *Builder) buildNodes(start, end int, prefixDepth, depth, level int) {
 	b.ensureLevel(level)
 	nodeStartPos := b.numItems(level)
 
-	groupStart := 0
-	if depth >= len(keys[groupStart]) {
+	groupStart := start
+	if depth >= len(b.key(groupStart)) {
 		b.lsLabels[level] = append(b.lsLabels[level], labelTerminator)
 		b.isLastItemTerminator[level] = true
-		b.insertSuffix(keys[groupStart], level, depth)
-		b.insertValue(vals[groupStart], level)
+		b.insertSuffix(groupStart, level)
+		b.insertValue(b.value(groupStart), level)
 		b.moveToNextItemSlot(level)
 		groupStart++
 	}
 
-	for groupEnd := groupStart; groupEnd <= len(keys); groupEnd++ {
-		if groupEnd < len(keys) && keys[groupStart][depth] == keys[groupEnd][depth] {
+	for groupEnd := groupStart; groupEnd <= end; groupEnd++ {
+		if groupEnd < end && b.key(groupStart)[depth] == b.key(groupEnd)[depth] {
 			continue
 		}
 
-		if groupEnd == len(keys) && groupStart == 0 && groupEnd-groupStart != 1 {
+		if groupEnd == end && groupStart == start && groupEnd-groupStart != 1 {
 			// node at this level is one-way node, compress it to next node
-			b.buildNodes(keys, vals, prefixDepth, depth+1, level)
+			b.buildNodes(start, end, prefixDepth, depth+1, level)
 			return
 		}
 
-		b.lsLabels[level] = append(b.lsLabels[level], keys[groupStart][depth])
+		b.lsLabels[level] = append(b.lsLabels[level], b.key(groupStart)[depth])
 		b.moveToNextItemSlot(level)
 		if groupEnd-groupStart == 1 {
-			b.insertSuffix(keys[groupStart], level, depth)
-			b.insertValue(vals[groupStart], level)
+			b.insertSuffix(groupStart, level)
+			b.insertValue(b.value(groupStart), level)
 		} else {
 			setBit(b.lsHasChild[level], b.numItems(level)-1)
-			b.buildNodes(keys[groupStart:groupEnd], vals[groupStart:groupEnd], depth+1, depth+1, level+1)
+			b.buildNodes(groupStart, groupEnd, depth+1, depth+1, level+1)
 		}
 
 		groupStart = groupEnd
@@ -105,7 +192,7 @@ func (b *Builder) buildNodes(keys, vals [][]byte, prefixDepth, depth, level int)
 
 	// check if current node contains compressed path.
 	if depth-prefixDepth > 0 {
-		prefix := keys[0][prefixDepth:depth]
+		prefix := b.key(start)[prefixDepth:depth]
 		setBit(b.hasPrefix[level], b.nodeCounts[level])
 		b.insertPrefix(prefix, level)
 	}
@@ -192,11 +279,11 @@ func (b *Builder) moveToNextItemSlot(level int) {
 	}
 }
 
-func (b *Builder) insertSuffix(key []byte, level, depth int) {
+func (b *Builder) insertSuffix(i int, level int) {
 	if level >= b.treeHeight() {
 		b.addLevel()
 	}
-	suffix := constructSuffix(key, uint32(depth)+1, b.realSuffixLen, b.hashSuffixLen)
+	suffix := b.keySuffixes[i]
 
 	suffixLen := b.suffixLen()
 	pos := b.suffixCounts[level] * suffixLen
@@ -0,0 +1,149 @@
+package surf
+
+import (
+	"math"
+	"unsafe"
+)
+
+// Stats describes the size and the shape of a SuRF.
+type Stats struct {
+	// MarshalSize is the size of the serialized SuRF.
+	MarshalSize int64
+	// MemSize is the size of the SuRF in memory.
+	MemSize int64
+	// NumKeys is the number of keys in the SuRF.
+	NumKeys int
+	// DenseLevels is the number of levels encoded by LOUDS-Dense.
+	DenseLevels int
+	// NodeCounts is the number of trie nodes in every level.
+	NodeCounts []int
+	// EstimatedFPR is the estimated false positive rate of point lookups.
+	EstimatedFPR float64
+}
+
+// Stats returns the stats of the SuRF.
+func (s *SuRF) Stats() *Stats {
+	return &Stats{
+		MarshalSize:  s.MarshalSize(),
+		MemSize:      s.MemSize(),
+		NumKeys:      s.NumKeys(),
+		DenseLevels:  int(s.ld.height),
+		NodeCounts:   s.NodeCounts(),
+		EstimatedFPR: s.EstimatedFPR(),
+	}
+}
+
+// MemSize returns the size of the SuRF in memory.
+func (s *SuRF) MemSize() int64 {
+	ld, ls := &s.ld, &s.ls
+	size := int64(unsafe.Sizeof(*s))
+	size += ld.labelVec.memSize() + ld.hasChildVec.memSize() + ld.isPrefixVec.memSize()
+	size += ld.suffixes.memSize() + ld.values.memSize() + ld.prefixVec.memSize()
+	size += ls.labelVec.memSize() + ls.hasChildVec.memSize() + ls.loudsVec.memSize()
+	size += ls.suffixes.memSize() + ls.values.memSize() + ls.prefixVec.memSize()
+	return size
+}
+
+// NumKeys returns the number of keys in the SuRF, every key has a value.
+func (s *SuRF) NumKeys() int {
+	ld, ls := &s.ld, &s.ls
+	if ld.values.valueSize == 0 {
+		// Without values, the keys are estimated by the leaves of the trie.
+		numKeys := ld.labelVec.numOnes() - ld.hasChildVec.numOnes() + ld.isPrefixVec.numOnes()
+		numKeys += ls.loudsVec.numBits - ls.hasChildVec.numOnes()
+		return int(numKeys)
+	}
+	return (len(ld.values.bytes) + len(ls.values.bytes)) / int(ld.values.valueSize)
+}
+
+// NodeCounts returns the number of trie nodes in every level.
+func (s *SuRF) NodeCounts() []int {
+	ld, ls := &s.ld, &s.ls
+	counts := make([]int, 0, ls.height)
+	if ls.height == 0 {
+		return counts
+	}
+
+	// The nodes are numbered in level order, so the nodes of a level are the children of the
+	// nodes in the upper level.
+	var start, n uint32 = 0, 1
+	for level := uint32(0); level < ld.height; level++ {
+		counts = append(counts, int(n))
+		begin, end := start*denseFanout, (start+n)*denseFanout
+		n = rankRange(&ld.hasChildVec.rankVector, begin, end)
+		start = ld.hasChildVec.rankVector.rank(begin) + 1
+	}
+	for level := ls.startLevel; level < ls.height; level++ {
+		counts = append(counts, int(n))
+		begin := ls.firstLabelPos(start)
+		end := ls.loudsVec.numBits
+		if start+n-ls.denseNodeCount < ls.loudsVec.numOnes {
+			end = ls.firstLabelPos(start + n)
+		}
+		start += n
+		n = rankRange(&ls.hasChildVec.rankVector, begin, end)
+	}
+	return counts
+}
+
+// EstimatedFPR returns the estimated false positive rate of point lookups. A key which shares the
+// prefix stored in the trie with a stored key is only rejected by the suffix, so the rate is
+// estimated from the suffix length, the real suffix is estimated as if it is a hash suffix.
+func (s *SuRF) EstimatedFPR() float64 {
+	suffixes := &s.ls.suffixes
+	if s.ld.height > 0 {
+		suffixes = &s.ld.suffixes
+	}
+	return math.Pow(2, -float64(suffixes.suffixLen()))
+}
+
+// rankRange returns the number of set bits in [begin, end).
+func rankRange(v *rankVector, begin, end uint32) uint32 {
+	if begin >= end {
+		return 0
+	}
+	return v.rank(end) - v.rank(begin)
+}
+
+func (v *bitVector) memSize() int64 {
+	return int64(len(v.bits) * 8)
+}
+
+func (v *rankVector) memSize() int64 {
+	return v.bitVector.memSize() + int64(len(v.rankLut)*4)
+}
+
+// numOnes returns the number of set bits, the last entry of the lut is the total rank.
+func (v *rankVector) numOnes() uint32 {
+	if len(v.rankLut) == 0 {
+		return 0
+	}
+	return v.rankLut[len(v.rankLut)-1]
+}
+
+// rank returns the number of set bits in [0, pos), unlike Rank it doesn't count the bit at pos.
+func (v *rankVector) rank(pos uint32) uint32 {
+	if pos == 0 {
+		return 0
+	}
+	wordPerBlk := v.blockSize / wordSize
+	blockOff := (pos - 1) / v.blockSize
+	bitsOff := (pos - 1) % v.blockSize
+	return v.rankLut[blockOff] + popcountBlock(v.bits, blockOff*wordPerBlk, bitsOff+1)
+}
+
+func (v *selectVector) memSize() int64 {
+	return v.bitVector.memSize() + int64(len(v.selectLut)*4)
+}
+
+func (v *labelVector) memSize() int64 {
+	return int64(len(v.labels))
+}
+
+func (v *valueVector) memSize() int64 {
+	return int64(len(v.bytes))
+}
+
+func (v *prefixVector) memSize() int64 {
+	return v.hasPrefixVec.memSize() + int64(len(v.prefixOffsets)*4+len(v.prefixData))
+}
@@ -3,6 +3,23 @@ package surf
 import (
 	"bytes"
 	"io"
+
+	"github.com/pingcap/errors"
+)
+
+const (
+	// magic is the first 4 bytes of a serialized SuRF, the data serialized before the header was
+	// added starts with the height of the dense levels which never equals to it.
+	magic uint32 = 0x46527553 // "SuRF" in little endian.
+	// formatVersion must be bumped whenever the serialized layout is changed.
+	formatVersion uint32 = 1
+	// headerSize is the size of magic and version, it keeps the following data 8 bytes aligned.
+	headerSize = 8
+)
+
+var (
+	// ErrUnsupportedVersion is returned by Unmarshal if the data is serialized in an unknown format version.
+	ErrUnsupportedVersion = errors.New("unsupported SuRF format version")
 )
 
 type SuRF struct {
@@ -42,7 +59,7 @@ func (s *SuRF) HasOverlap(start, end []byte, includeEnd bool) bool {
 
 // MarshalSize returns the size of SuRF after serialization.
 func (s *SuRF) MarshalSize() int64 {
-	return s.ld.MarshalSize() + s.ls.MarshalSize() + s.ld.values.MarshalSize() + s.ls.values.MarshalSize()
+	return headerSize + s.ld.MarshalSize() + s.ls.MarshalSize() + s.ld.values.MarshalSize() + s.ls.values.MarshalSize()
 }
 
 // Marshal returns the serialized SuRF.
@@ -54,6 +71,12 @@ func (s *SuRF) Marshal() []byte {
 
 // WriteTo serialize SuRF to writer.
 func (s *SuRF) WriteTo(w io.Writer) error {
+	var header [headerSize]byte
+	endian.PutUint32(header[:], magic)
+	endian.PutUint32(header[4:], formatVersion)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
 	if err := s.ld.WriteTo(w); err != nil {
 		return err
 	}
@@ -69,12 +92,20 @@ func (s *SuRF) WriteTo(w io.Writer) error {
 	return nil
 }
 
-// Unmarshal deserialize SuRF from bytes.
-func (s *SuRF) Unmarshal(b []byte) {
+// Unmarshal deserialize SuRF from bytes, it returns an error if the bytes are serialized in an
+// unknown format version. The bytes serialized without the header are read in the old layout.
+func (s *SuRF) Unmarshal(b []byte) error {
+	if len(b) >= headerSize && endian.Uint32(b) == magic {
+		if v := endian.Uint32(b[4:]); v != formatVersion {
+			return errors.Wrapf(ErrUnsupportedVersion, "version %d", v)
+		}
+		b = b[headerSize:]
+	}
 	b = s.ld.Unmarshal(b)
 	b = s.ls.Unmarshal(b)
 	b = s.ld.values.Unmarshal(b)
 	s.ls.values.Unmarshal(b)
+	return nil
 }
 
 // Iterator is iterator of SuRF.
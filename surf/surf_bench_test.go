@@ -92,8 +92,10 @@ func buildAndBenchSuRF(b *testing.B, keys, vals [][]byte, run func(t *testing.B,
 	for _, sl := range suffixLens {
 		builder := NewBuilder(4, sl[0], sl[1])
 
-		builder.totalCount = len(keys)
-		builder.buildNodes(keys, vals, 0, 0, 0)
+		for i := range keys {
+			builder.Add(keys[i], vals[i])
+		}
+		builder.buildTrie()
 		for i := 0; i < builder.treeHeight(); i++ {
 			builder.sparseStartLevel = uint32(i)
 			builder.ldLabels = builder.ldLabels[:0]
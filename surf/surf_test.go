@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -96,9 +97,57 @@ func TestMarshal(t *testing.T) {
 	s1 := b.Build(keys, vals, 60)
 	var s2 SuRF
 	buf := s1.Marshal()
-	s2.Unmarshal(buf)
+	require.EqualValues(t, s1.MarshalSize(), len(buf))
+	require.NoError(t, s2.Unmarshal(buf))
 	s1.checkEquals(t, &s2)
 	newFullSuRFChecker(keys, vals)(t, &s2)
+
+	// The data serialized without the header is still readable.
+	var s3 SuRF
+	require.NoError(t, s3.Unmarshal(buf[headerSize:]))
+	s1.checkEquals(t, &s3)
+	endian.PutUint32(buf[4:], formatVersion+1)
+	require.Equal(t, ErrUnsupportedVersion, errors.Cause(s3.Unmarshal(buf)))
+}
+
+func TestStats(t *testing.T) {
+	keys := genRandomKeys(30, 20, 300)
+	vals := make([][]byte, len(keys))
+	for i := range keys {
+		vals[i] = make([]byte, 4)
+		endian.PutUint32(vals[i], uint32(i))
+	}
+	b := NewBuilder(4, 8, 8)
+	for i := range keys {
+		b.Add(keys[i], vals[i])
+	}
+	b.buildTrie()
+	nodeCounts := make([]int, b.treeHeight())
+	for i, n := range b.nodeCounts {
+		nodeCounts[i] = int(n)
+	}
+	for i := 0; i < b.treeHeight(); i++ {
+		b.sparseStartLevel = uint32(i)
+		b.ldLabels = b.ldLabels[:0]
+		b.ldHasChild = b.ldHasChild[:0]
+		b.ldIsPrefix = b.ldIsPrefix[:0]
+		b.buildDense()
+
+		s1 := new(SuRF)
+		s1.ld.Init(b)
+		s1.ls.Init(b)
+		var s2 SuRF
+		require.NoError(t, s2.Unmarshal(s1.Marshal()))
+		for _, s := range []*SuRF{s1, &s2} {
+			stats := s.Stats()
+			require.Equal(t, len(keys), stats.NumKeys)
+			require.Equal(t, i, stats.DenseLevels)
+			require.Equal(t, nodeCounts, stats.NodeCounts)
+			require.Equal(t, s1.MarshalSize(), stats.MarshalSize)
+			require.True(t, stats.MemSize > 0)
+			require.Equal(t, 1.0/(1<<16), stats.EstimatedFPR)
+		}
+	}
 }
 
 func splitKeys(keys [][]byte) (a, aIdx, b [][]byte) {
@@ -183,8 +232,10 @@ func buildAndCheckSuRF(t *testing.T, keys, vals [][]byte, checker func(t *testin
 	for _, sl := range suffixLens {
 		b := NewBuilder(4, sl[0], sl[1])
 
-		b.totalCount = len(keys)
-		b.buildNodes(keys, vals, 0, 0, 0)
+		for i := range keys {
+			b.Add(keys[i], vals[i])
+		}
+		b.buildTrie()
 		for i := 0; i < b.treeHeight(); i++ {
 			b.sparseStartLevel = uint32(i)
 			b.ldLabels = b.ldLabels[:0]
@@ -15,6 +15,13 @@ type ConcatIterator struct {
 	iters    []y.Iterator // Corresponds to tables.
 	tables   []Table      // Disregarding reversed, this is in ascending order.
 	reversed bool
+	// readahead is the number of blocks prefetched by the table iterators, see SetReadahead.
+	readahead int
+	// directIO makes the table iterators read with O_DIRECT, see SetDirectIO.
+	directIO bool
+	// spare is the closed iterator of a passed table reused for the next table, see
+	// ReusableIterator.
+	spare ReusableIterator
 }
 
 // NewConcatIterator creates a new concatenated iterator
@@ -27,20 +34,59 @@ func NewConcatIterator(tbls []Table, reversed bool) *ConcatIterator {
 	}
 }
 
+// setIdx makes the table at idx the active one. The table iterator is created on the first use,
+// so the index of a table is not loaded until the table is positioned on, the caller must
+// position the iterator after setIdx.
 func (s *ConcatIterator) setIdx(idx int) {
 	s.idx = idx
 	if idx < 0 || idx >= len(s.iters) {
 		s.cur = nil
 	} else {
 		if s.iters[s.idx] == nil {
-			ti := s.tables[s.idx].NewIterator(s.reversed)
-			ti.Rewind()
+			var ti y.Iterator
+			if s.spare != nil && s.spare.ResetTable(s.tables[s.idx], s.reversed) {
+				ti = s.spare
+			} else {
+				ti = s.tables[s.idx].NewIterator(s.reversed)
+			}
+			s.spare = nil
+			if ra, ok := ti.(ReadaheadIterator); ok && s.readahead > 0 {
+				ra.SetReadahead(s.readahead)
+			}
+			if dio, ok := ti.(DirectIOIterator); ok && s.directIO {
+				dio.SetDirectIO()
+			}
 			s.iters[s.idx] = ti
 		}
 		s.cur = s.iters[s.idx]
 	}
 }
 
+// release closes the iterator of the table at idx which has been passed, so its index and block
+// can be evicted from the cache. The closed iterator is kept to be reused for the next table if it
+// is reusable.
+func (s *ConcatIterator) release(idx int) {
+	if it := s.iters[idx]; it != nil {
+		it.Close()
+		if r, ok := it.(ReusableIterator); ok {
+			s.spare = r
+		}
+		s.iters[idx] = nil
+	}
+}
+
+// SetReadahead sets the number of blocks prefetched by the table iterators, it must be called
+// before the iterator is positioned.
+func (s *ConcatIterator) SetReadahead(n int) {
+	s.readahead = n
+}
+
+// SetDirectIO makes the table iterators read the blocks with O_DIRECT, it must be called before
+// the iterator is positioned.
+func (s *ConcatIterator) SetDirectIO() {
+	s.directIO = true
+}
+
 // Rewind implements y.Interface
 func (s *ConcatIterator) Rewind() {
 	if len(s.iters) == 0 {
@@ -96,6 +142,21 @@ func (s *ConcatIterator) Seek(key []byte) {
 	s.cur.Seek(key)
 }
 
+// SeekWithHint implements HintSeekIterator, the key is sought with a hint in the current table if
+// it is not greater than the biggest key of the table.
+func (s *ConcatIterator) SeekWithHint(key []byte) {
+	if s.reversed || !s.Valid() || bytes.Compare(key, s.cur.Key().UserKey) < 0 ||
+		bytes.Compare(key, s.tables[s.idx].Biggest().UserKey) > 0 {
+		s.Seek(key)
+		return
+	}
+	if hs, ok := s.cur.(HintSeekIterator); ok {
+		hs.SeekWithHint(key)
+	} else {
+		s.cur.Seek(key)
+	}
+}
+
 // Next advances our concat iterator.
 func (s *ConcatIterator) Next() {
 	s.cur.Next()
@@ -104,6 +165,7 @@ func (s *ConcatIterator) Next() {
 		return
 	}
 	for { // In case there are empty tables.
+		s.release(s.idx)
 		if !s.reversed {
 			s.setIdx(s.idx + 1)
 		} else {
@@ -0,0 +1,126 @@
+package table
+
+import (
+	"testing"
+
+	"github.com/pingcap/badger/y"
+	"github.com/stretchr/testify/require"
+)
+
+// simpleTable only implements NewIterator, the other methods of Table are not used by the test.
+type simpleTable struct {
+	Table
+	keys      []string
+	created   int
+	iterators []*closeCountIterator
+}
+
+type closeCountIterator struct {
+	*SimpleIterator
+	closed int
+}
+
+func (it *closeCountIterator) Close() error {
+	it.closed++
+	return nil
+}
+
+func (t *simpleTable) NewIterator(reversed bool) y.Iterator {
+	t.created++
+	it := &closeCountIterator{SimpleIterator: newSimpleIterator(t.keys, t.keys, reversed)}
+	t.iterators = append(t.iterators, it)
+	return it
+}
+
+// reusableTable returns the iterators which can be reset to iterate another reusableTable.
+type reusableTable struct {
+	simpleTable
+}
+
+type reusableIterator struct {
+	*closeCountIterator
+	resets int
+}
+
+func (t *reusableTable) NewIterator(reversed bool) y.Iterator {
+	return &reusableIterator{closeCountIterator: t.simpleTable.NewIterator(reversed).(*closeCountIterator)}
+}
+
+func (it *reusableIterator) ResetTable(t Table, reversed bool) bool {
+	rt, ok := t.(*reusableTable)
+	if !ok {
+		return false
+	}
+	it.resets++
+	it.SimpleIterator = newSimpleIterator(rt.keys, rt.keys, reversed)
+	return true
+}
+
+func TestConcatIteratorLazyTables(t *testing.T) {
+	for _, reversed := range []bool{false, true} {
+		tables := []*simpleTable{
+			{keys: []string{"a", "b"}},
+			{keys: []string{"c", "d"}},
+			{keys: []string{"e", "f"}},
+		}
+		tbls := make([]Table, len(tables))
+		for i, tbl := range tables {
+			tbls[i] = tbl
+		}
+		it := NewConcatIterator(tbls, reversed)
+		for _, tbl := range tables {
+			require.Equal(t, 0, tbl.created)
+		}
+		it.Rewind()
+		first, last := tables[0], tables[2]
+		if reversed {
+			first, last = last, first
+		}
+		require.Equal(t, 1, first.created)
+		require.Equal(t, 0, tables[1].created)
+		require.Equal(t, 0, last.created)
+
+		var keys []string
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key().UserKey))
+		}
+		expected := []string{"a", "b", "c", "d", "e", "f"}
+		if reversed {
+			expected = []string{"f", "e", "d", "c", "b", "a"}
+		}
+		require.Equal(t, expected, keys)
+		// The iterators of the passed tables are closed.
+		for _, tbl := range tables {
+			require.Equal(t, 1, tbl.created)
+			require.Equal(t, 1, tbl.iterators[0].closed)
+		}
+		require.NoError(t, it.Close())
+		for _, tbl := range tables {
+			require.Equal(t, 1, tbl.iterators[0].closed)
+		}
+	}
+}
+
+func TestConcatIteratorReuse(t *testing.T) {
+	tables := []*reusableTable{
+		{simpleTable{keys: []string{"a", "b"}}},
+		{simpleTable{keys: []string{"c", "d"}}},
+		{simpleTable{keys: []string{"e", "f"}}},
+	}
+	tbls := make([]Table, len(tables))
+	for i, tbl := range tables {
+		tbls[i] = tbl
+	}
+	it := NewConcatIterator(tbls, false)
+	var keys []string
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key().UserKey))
+	}
+	require.Equal(t, []string{"a", "b", "c", "d", "e", "f"}, keys)
+	// The iterator of the first table is reused for the others.
+	require.Equal(t, 1, tables[0].created)
+	require.Equal(t, 0, tables[1].created)
+	require.Equal(t, 0, tables[2].created)
+	require.Equal(t, 2, it.spare.(*reusableIterator).resets)
+	require.NoError(t, it.Close())
+}
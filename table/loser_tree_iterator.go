@@ -0,0 +1,202 @@
+package table
+
+import (
+	"bytes"
+
+	"github.com/pingcap/badger/y"
+)
+
+// LoserTreeIterator merges many iterators with a loser tree (tournament tree). Every internal node
+// remembers the loser of the match played at it, so moving the winner only replays the matches on
+// the path from its leaf to the root, which takes log(n) key comparisons instead of the 2*log(n)
+// of a binary tree of MergeIterators. The tree nodes are reused between seeks.
+//
+// The iterators in front take precedence when they have the same key, the versions of the same
+// key are returned by NextVersion in descending order across the iterators.
+type LoserTreeIterator struct {
+	leaves []mergeIteratorChild
+	// losers[0] is the winner leaf, losers[i] is the loser leaf of the match at the internal node i,
+	// whose children are the nodes 2i and 2i+1. The node len(leaves)+i is the leaf i.
+	losers  []int
+	reverse bool
+	curKey  []byte
+}
+
+func newLoserTreeIterator(iters []y.Iterator, reverse bool) *LoserTreeIterator {
+	lt := &LoserTreeIterator{
+		leaves:  make([]mergeIteratorChild, len(iters)),
+		losers:  make([]int, len(iters)),
+		reverse: reverse,
+	}
+	for i, iter := range iters {
+		lt.leaves[i].setIterator(iter)
+	}
+	return lt
+}
+
+// beats returns true if leaf a wins the match against leaf b. An invalid leaf loses to a valid
+// leaf, the leaf in front wins if both leaves have the same key.
+func (lt *LoserTreeIterator) beats(a, b int) bool {
+	la, lb := &lt.leaves[a], &lt.leaves[b]
+	if !la.valid || !lb.valid {
+		if la.valid != lb.valid {
+			return la.valid
+		}
+		return a < b
+	}
+	cmp := bytes.Compare(la.key.UserKey, lb.key.UserKey)
+	if cmp == 0 {
+		return a < b
+	}
+	if lt.reverse {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// build plays all the matches after every leaf is repositioned.
+func (lt *LoserTreeIterator) build() {
+	for i := range lt.leaves {
+		lt.leaves[i].reset()
+	}
+	lt.losers[0] = lt.play(1)
+}
+
+// play plays the matches in the subtree of node and returns the winner leaf.
+func (lt *LoserTreeIterator) play(node int) int {
+	n := len(lt.leaves)
+	if node >= n {
+		return node - n
+	}
+	left, right := lt.play(2*node), lt.play(2*node+1)
+	if lt.beats(left, right) {
+		lt.losers[node] = right
+		return left
+	}
+	lt.losers[node] = left
+	return right
+}
+
+// replay replays the matches from the winner leaf to the root after the winner is moved.
+func (lt *LoserTreeIterator) replay() {
+	winner := lt.losers[0]
+	for node := (len(lt.leaves) + winner) / 2; node > 0; node /= 2 {
+		if lt.beats(lt.losers[node], winner) {
+			lt.losers[node], winner = winner, lt.losers[node]
+		}
+	}
+	lt.losers[0] = winner
+}
+
+// runnerUp returns the leaf which becomes the winner if the winner is removed, it is the best of
+// the leaves lost to the winner.
+func (lt *LoserTreeIterator) runnerUp() int {
+	winner := lt.losers[0]
+	runnerUp := -1
+	for node := (len(lt.leaves) + winner) / 2; node > 0; node /= 2 {
+		if runnerUp == -1 || lt.beats(lt.losers[node], runnerUp) {
+			runnerUp = lt.losers[node]
+		}
+	}
+	return runnerUp
+}
+
+func (lt *LoserTreeIterator) winner() *mergeIteratorChild {
+	return &lt.leaves[lt.losers[0]]
+}
+
+// Next moves all the iterators at the current key to the next key.
+func (lt *LoserTreeIterator) Next() {
+	w := lt.winner()
+	if !w.valid {
+		return
+	}
+	lt.curKey = append(lt.curKey[:0], w.key.UserKey...)
+	for {
+		w.next()
+		w.reset()
+		lt.replay()
+		w = lt.winner()
+		if !w.valid || !bytes.Equal(w.key.UserKey, lt.curKey) {
+			return
+		}
+	}
+}
+
+// NextVersion moves to the next older version of the current key. Once the winner runs out of
+// versions, it continues with the following iterators at the same key, skipping the versions not
+// older than the current version.
+func (lt *LoserTreeIterator) NextVersion() bool {
+	w := lt.winner()
+	if w.iter.NextVersion() {
+		w.reset()
+		return true
+	}
+	version := w.key.Version
+	for {
+		r := &lt.leaves[lt.runnerUp()]
+		if !r.valid || !bytes.Equal(r.key.UserKey, w.key.UserKey) {
+			return false
+		}
+		w.next()
+		w.reset()
+		lt.replay()
+		w = lt.winner()
+		for w.key.Version >= version && w.iter.NextVersion() {
+			w.reset()
+		}
+		if w.key.Version < version {
+			return true
+		}
+	}
+}
+
+// Rewind seeks to first element (or last element for reverse iterator).
+func (lt *LoserTreeIterator) Rewind() {
+	for i := range lt.leaves {
+		lt.leaves[i].iter.Rewind()
+	}
+	lt.build()
+}
+
+// Seek brings us to element with key >= given key (or <= given key for reverse iterator).
+func (lt *LoserTreeIterator) Seek(key []byte) {
+	for i := range lt.leaves {
+		lt.leaves[i].iter.Seek(key)
+	}
+	lt.build()
+}
+
+// Valid returns whether the LoserTreeIterator is at a valid element.
+func (lt *LoserTreeIterator) Valid() bool {
+	return lt.winner().valid
+}
+
+// Key returns the key associated with the current iterator.
+func (lt *LoserTreeIterator) Key() y.Key {
+	return lt.winner().key
+}
+
+// Value returns the value associated with the iterator.
+func (lt *LoserTreeIterator) Value() (vs y.ValueStruct) {
+	lt.winner().fillValue(&vs)
+	return
+}
+
+func (lt *LoserTreeIterator) FillValue(vs *y.ValueStruct) {
+	lt.winner().fillValue(vs)
+}
+
+// Close implements y.Iterator.
+func (lt *LoserTreeIterator) Close() error {
+	var firstErr error
+	for i := range lt.leaves {
+		if err := lt.leaves[i].iter.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return y.Wrapf(firstErr, "LoserTreeIterator")
+	}
+	return nil
+}
@@ -0,0 +1,761 @@
+package memtable
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pingcap/badger/y"
+)
+
+type artKind uint8
+
+const (
+	artLeafKind artKind = iota
+	art4Kind
+	art16Kind
+	art48Kind
+	art256Kind
+)
+
+const (
+	// The estimated memory sizes of the leaves and the inner nodes.
+	artLeafSize   = 80
+	art4Size      = 96
+	art16Size     = 224
+	art48Size     = 720
+	art256Size    = 2104
+	artValueSize  = 40
+	art48MaxSlots = 48
+)
+
+// artLeaf keeps the versions of a key from the newest to the oldest. The versions slice is never
+// modified in place, so a reader can keep using the slice it has loaded.
+type artLeaf struct {
+	key      []byte
+	versions []y.ValueStruct
+}
+
+// artNode is a leaf node or an inner node of the adaptive radix tree. An inner node stores the
+// whole compressed path in prefix, leaf is the key ending at the inner node if there is one.
+type artNode struct {
+	kind        artKind
+	prefix      []byte
+	leaf        *artLeaf
+	numChildren int
+	// keys are the sorted child key bytes of art4 and art16 nodes.
+	keys []byte
+	// index maps a key byte to the child slot plus one of art48 nodes.
+	index *[256]uint8
+	// children are aligned to keys for art4 and art16 nodes, are the slots of art48 nodes and are
+	// indexed by the key byte for art256 nodes.
+	children []*artNode
+}
+
+// artTree is an adaptive radix tree of the memtable keys. The writes are serialized by the write
+// lock while the reads hold the read lock. The iterators keep the path to their current leaf and
+// look up the tree by their current key again only if the tree has been modified since the path
+// was built.
+type artTree struct {
+	mu   sync.RWMutex
+	root *artNode
+	// changes counts the modifications of the tree structure, the inner nodes are modified in
+	// place so the paths kept by the iterators are only valid while it is unchanged.
+	changes uint64
+	memSize int64
+}
+
+func newARTTree() *artTree {
+	return &artTree{}
+}
+
+func newARTLeafNode(key []byte, v y.ValueStruct) *artNode {
+	return &artNode{kind: artLeafKind, leaf: &artLeaf{key: key, versions: []y.ValueStruct{v}}}
+}
+
+// copyEntry copies the key and the value into one buffer.
+func copyEntry(key []byte, v y.ValueStruct) ([]byte, y.ValueStruct) {
+	buf := make([]byte, len(key)+len(v.Value)+len(v.UserMeta))
+	n := copy(buf, key)
+	key = buf[:n:n]
+	m := copy(buf[n:], v.Value)
+	v.Value = buf[n : n+m : n+m]
+	copy(buf[n+m:], v.UserMeta)
+	v.UserMeta = buf[n+m:]
+	return key, v
+}
+
+func (t *artTree) Put(key []byte, v y.ValueStruct) {
+	key, v = copyEntry(key, v)
+	t.mu.Lock()
+	size := t.insert(&t.root, key, v, 0)
+	t.mu.Unlock()
+	atomic.AddInt64(&t.memSize, size)
+}
+
+// putEntries puts the entries under a single write lock, the entries are copied before it is
+// taken to keep it short.
+func (t *artTree) putEntries(entries []Entry) {
+	copied := make([]Entry, len(entries))
+	for i := range entries {
+		copied[i].Key, copied[i].Value = copyEntry(entries[i].Key, entries[i].Value)
+	}
+	var size int64
+	t.mu.Lock()
+	for i := range copied {
+		size += t.insert(&t.root, copied[i].Key, copied[i].Value, 0)
+	}
+	t.mu.Unlock()
+	atomic.AddInt64(&t.memSize, size)
+}
+
+// insert inserts the key into the subtree *np, the key starts at depth in the subtree. It returns
+// the estimated size of the memory allocated.
+func (t *artTree) insert(np **artNode, key []byte, v y.ValueStruct, depth int) int64 {
+	n := *np
+	entrySize := int64(len(key)) + int64(v.EncodedSize())
+	if n == nil {
+		t.changes++
+		*np = newARTLeafNode(key, v)
+		return entrySize + artLeafSize
+	}
+	if n.kind == artLeafKind {
+		if bytes.Equal(n.leaf.key, key) {
+			return n.leaf.addVersion(v)
+		}
+		t.changes++
+		// Split the leaf by the common prefix.
+		p := commonPrefixLen(n.leaf.key[depth:], key[depth:])
+		inner := &artNode{kind: art4Kind, prefix: key[depth : depth+p]}
+		inner.addLeaf(n, depth+p)
+		inner.addLeaf(newARTLeafNode(key, v), depth+p)
+		*np = inner
+		return entrySize + artLeafSize + art4Size
+	}
+	p := commonPrefixLen(n.prefix, key[depth:])
+	if p < len(n.prefix) {
+		t.changes++
+		// Split the prefix of the inner node.
+		inner := &artNode{kind: art4Kind, prefix: n.prefix[:p]}
+		b := n.prefix[p]
+		n.prefix = n.prefix[p+1:]
+		inner.addChild(b, n)
+		inner.addLeaf(newARTLeafNode(key, v), depth+p)
+		*np = inner
+		return entrySize + artLeafSize + art4Size
+	}
+	depth += len(n.prefix)
+	if depth == len(key) {
+		if n.leaf != nil {
+			return n.leaf.addVersion(v)
+		}
+		t.changes++
+		n.leaf = &artLeaf{key: key, versions: []y.ValueStruct{v}}
+		return entrySize + artLeafSize
+	}
+	if child := n.findChild(key[depth]); child != nil {
+		return t.insert(child, key, v, depth+1)
+	}
+	t.changes++
+	grown := n.addChild(key[depth], newARTLeafNode(key, v))
+	return entrySize + artLeafSize + grown
+}
+
+// addVersion adds a newer version of the key, an older version is ignored like the skiplist.
+func (l *artLeaf) addVersion(v y.ValueStruct) int64 {
+	if v.Version <= l.versions[0].Version {
+		return 0
+	}
+	versions := make([]y.ValueStruct, len(l.versions)+1)
+	versions[0] = v
+	copy(versions[1:], l.versions)
+	l.versions = versions
+	return int64(v.EncodedSize()) + artValueSize
+}
+
+func commonPrefixLen(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// addLeaf adds the leaf node to the inner node whose keys start at depth.
+func (n *artNode) addLeaf(leafNode *artNode, depth int) {
+	key := leafNode.leaf.key
+	if depth == len(key) {
+		n.leaf = leafNode.leaf
+		return
+	}
+	n.addChild(key[depth], leafNode)
+}
+
+// findChild returns the address of the child of the key byte, it returns nil if there is none.
+func (n *artNode) findChild(b byte) **artNode {
+	switch n.kind {
+	case art4Kind, art16Kind:
+		for i := 0; i < n.numChildren; i++ {
+			if n.keys[i] == b {
+				return &n.children[i]
+			}
+		}
+	case art48Kind:
+		if slot := n.index[b]; slot != 0 {
+			return &n.children[slot-1]
+		}
+	case art256Kind:
+		if n.children[b] != nil {
+			return &n.children[b]
+		}
+	}
+	return nil
+}
+
+// addChild adds a child of the key byte and grows the node if it is full. It returns the estimated
+// size of the memory allocated by growing.
+func (n *artNode) addChild(b byte, child *artNode) int64 {
+	var grown int64
+	switch n.kind {
+	case art4Kind:
+		if n.numChildren == 4 {
+			n.grow(art16Kind, 16)
+			grown = art16Size
+			break
+		}
+		if n.keys == nil {
+			n.keys = make([]byte, 0, 4)
+			n.children = make([]*artNode, 0, 4)
+		}
+	case art16Kind:
+		if n.numChildren == 16 {
+			n.grow48()
+			grown = art48Size
+		}
+	case art48Kind:
+		if n.numChildren == art48MaxSlots {
+			n.grow256()
+			grown = art256Size
+		}
+	}
+	switch n.kind {
+	case art4Kind, art16Kind:
+		i := 0
+		for i < n.numChildren && n.keys[i] < b {
+			i++
+		}
+		n.keys = append(n.keys, 0)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = b
+		n.children = append(n.children, nil)
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = child
+	case art48Kind:
+		n.children[n.numChildren] = child
+		n.index[b] = uint8(n.numChildren + 1)
+	case art256Kind:
+		n.children[b] = child
+	}
+	n.numChildren++
+	return grown
+}
+
+func (n *artNode) grow(kind artKind, capacity int) {
+	keys := make([]byte, n.numChildren, capacity)
+	copy(keys, n.keys)
+	children := make([]*artNode, n.numChildren, capacity)
+	copy(children, n.children)
+	n.kind, n.keys, n.children = kind, keys, children
+}
+
+func (n *artNode) grow48() {
+	index := new([256]uint8)
+	children := make([]*artNode, art48MaxSlots)
+	for i := 0; i < n.numChildren; i++ {
+		index[n.keys[i]] = uint8(i + 1)
+		children[i] = n.children[i]
+	}
+	n.kind, n.keys, n.index, n.children = art48Kind, nil, index, children
+}
+
+func (n *artNode) grow256() {
+	children := make([]*artNode, 256)
+	for b, slot := range n.index {
+		if slot != 0 {
+			children[b] = n.children[slot-1]
+		}
+	}
+	n.kind, n.index, n.children = art256Kind, nil, children
+}
+
+// The positions of the children are the slots of art4 and art16 nodes and the key bytes of art48
+// and art256 nodes, -1 is the position of the key ending at the inner node.
+
+// childPos returns the position of the child of the key byte, the child must exist.
+func (n *artNode) childPos(b byte) int {
+	if n.kind == art4Kind || n.kind == art16Kind {
+		for i := 0; i < n.numChildren; i++ {
+			if n.keys[i] == b {
+				return i
+			}
+		}
+	}
+	return int(b)
+}
+
+func (n *artNode) childAt(pos int) *artNode {
+	switch n.kind {
+	case art48Kind:
+		if slot := n.index[pos]; slot != 0 {
+			return n.children[slot-1]
+		}
+		return nil
+	default:
+		return n.children[pos]
+	}
+}
+
+// nextPos returns the position of the first child after pos, it returns -1 if there is none.
+func (n *artNode) nextPos(pos int) int {
+	end := 256
+	if n.kind == art4Kind || n.kind == art16Kind {
+		end = n.numChildren
+	}
+	for pos++; pos < end; pos++ {
+		if n.childAt(pos) != nil {
+			return pos
+		}
+	}
+	return -1
+}
+
+// prevPos returns the position of the last child before pos, it returns -1 if there is none.
+func (n *artNode) prevPos(pos int) int {
+	for pos--; pos >= 0; pos-- {
+		if n.childAt(pos) != nil {
+			return pos
+		}
+	}
+	return -1
+}
+
+// endPos is the position after the last child.
+func (n *artNode) endPos() int {
+	if n.kind == art4Kind || n.kind == art16Kind {
+		return n.numChildren
+	}
+	return 256
+}
+
+// forEachChild calls fn with the children in the order of the key bytes until fn returns false.
+func (n *artNode) forEachChild(reverse bool, fn func(b byte, child *artNode) bool) {
+	switch n.kind {
+	case art4Kind, art16Kind:
+		for j := 0; j < n.numChildren; j++ {
+			i := j
+			if reverse {
+				i = n.numChildren - 1 - j
+			}
+			if !fn(n.keys[i], n.children[i]) {
+				return
+			}
+		}
+	case art48Kind, art256Kind:
+		for j := 0; j < 256; j++ {
+			b := j
+			if reverse {
+				b = 255 - j
+			}
+			var child *artNode
+			if n.kind == art48Kind {
+				if slot := n.index[b]; slot != 0 {
+					child = n.children[slot-1]
+				}
+			} else {
+				child = n.children[b]
+			}
+			if child != nil && !fn(byte(b), child) {
+				return
+			}
+		}
+	}
+}
+
+// min returns the leaf of the smallest key in the subtree.
+func (n *artNode) min() *artLeaf {
+	if n.kind == artLeafKind || n.leaf != nil {
+		return n.leaf
+	}
+	var leaf *artLeaf
+	n.forEachChild(false, func(b byte, child *artNode) bool {
+		leaf = child.min()
+		return false
+	})
+	return leaf
+}
+
+// max returns the leaf of the biggest key in the subtree.
+func (n *artNode) max() *artLeaf {
+	if n.kind == artLeafKind {
+		return n.leaf
+	}
+	leaf := n.leaf
+	n.forEachChild(true, func(b byte, child *artNode) bool {
+		leaf = child.max()
+		return false
+	})
+	return leaf
+}
+
+// seekGE returns the leaf of the smallest key >= target in the subtree, or > target if not
+// inclusive. The keys of the subtree start at depth.
+func (n *artNode) seekGE(target []byte, depth int, inclusive bool) *artLeaf {
+	if n.kind == artLeafKind {
+		cmp := bytes.Compare(n.leaf.key, target)
+		if cmp > 0 || (cmp == 0 && inclusive) {
+			return n.leaf
+		}
+		return nil
+	}
+	rest := target[depth:]
+	if len(rest) < len(n.prefix) {
+		if bytes.Compare(n.prefix[:len(rest)], rest) >= 0 {
+			// All the keys in the subtree are longer than the target.
+			return n.min()
+		}
+		return nil
+	}
+	if cmp := bytes.Compare(n.prefix, rest[:len(n.prefix)]); cmp != 0 {
+		if cmp > 0 {
+			return n.min()
+		}
+		return nil
+	}
+	depth += len(n.prefix)
+	if depth == len(target) {
+		if inclusive && n.leaf != nil {
+			return n.leaf
+		}
+		var leaf *artLeaf
+		n.forEachChild(false, func(b byte, child *artNode) bool {
+			leaf = child.min()
+			return false
+		})
+		return leaf
+	}
+	// The key ending at this node is a prefix of the target.
+	var leaf *artLeaf
+	c := target[depth]
+	n.forEachChild(false, func(b byte, child *artNode) bool {
+		if b < c {
+			return true
+		}
+		if b == c {
+			leaf = child.seekGE(target, depth+1, inclusive)
+			return leaf == nil
+		}
+		leaf = child.min()
+		return false
+	})
+	return leaf
+}
+
+// seekLE returns the leaf of the biggest key <= target in the subtree, or < target if not
+// inclusive. The keys of the subtree start at depth.
+func (n *artNode) seekLE(target []byte, depth int, inclusive bool) *artLeaf {
+	if n.kind == artLeafKind {
+		cmp := bytes.Compare(n.leaf.key, target)
+		if cmp < 0 || (cmp == 0 && inclusive) {
+			return n.leaf
+		}
+		return nil
+	}
+	rest := target[depth:]
+	if len(rest) < len(n.prefix) {
+		if bytes.Compare(n.prefix[:len(rest)], rest) < 0 {
+			return n.max()
+		}
+		// All the keys in the subtree are bigger than the target.
+		return nil
+	}
+	if cmp := bytes.Compare(n.prefix, rest[:len(n.prefix)]); cmp != 0 {
+		if cmp < 0 {
+			return n.max()
+		}
+		return nil
+	}
+	depth += len(n.prefix)
+	if depth == len(target) {
+		if inclusive {
+			return n.leaf
+		}
+		return nil
+	}
+	var leaf *artLeaf
+	c := target[depth]
+	n.forEachChild(true, func(b byte, child *artNode) bool {
+		if b > c {
+			return true
+		}
+		if b == c {
+			leaf = child.seekLE(target, depth+1, inclusive)
+			return leaf == nil
+		}
+		leaf = child.max()
+		return false
+	})
+	if leaf == nil {
+		// The key ending at this node is smaller than the keys of the children.
+		leaf = n.leaf
+	}
+	return leaf
+}
+
+// find returns the leaf of the key, it returns nil if the key doesn't exist.
+func (t *artTree) find(key []byte) *artLeaf {
+	n := t.root
+	depth := 0
+	for n != nil {
+		if n.kind == artLeafKind {
+			if bytes.Equal(n.leaf.key, key) {
+				return n.leaf
+			}
+			return nil
+		}
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			return n.leaf
+		}
+		child := n.findChild(key[depth])
+		if child == nil {
+			return nil
+		}
+		n = *child
+		depth++
+	}
+	return nil
+}
+
+func (t *artTree) Get(key []byte, version uint64) y.ValueStruct {
+	t.mu.RLock()
+	leaf := t.find(key)
+	var versions []y.ValueStruct
+	if leaf != nil {
+		versions = leaf.versions
+	}
+	t.mu.RUnlock()
+	for _, v := range versions {
+		if version >= v.Version {
+			return v
+		}
+	}
+	return y.ValueStruct{}
+}
+
+func (t *artTree) Empty() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.root == nil
+}
+
+func (t *artTree) MemSize() int64 {
+	return atomic.LoadInt64(&t.memSize)
+}
+
+func (t *artTree) Delete() {
+	t.mu.Lock()
+	t.root = nil
+	t.changes++
+	t.mu.Unlock()
+}
+
+func (t *artTree) newUniIterator(reversed bool) y.Iterator {
+	return &artIterator{tree: t, reversed: reversed}
+}
+
+// artIterator is a unidirectional iterator of artTree like UniIterator.
+type artIterator struct {
+	tree     *artTree
+	reversed bool
+	key      []byte
+	versions []y.ValueStruct
+	verIdx   int
+	// path is the inner nodes from the root to the current leaf, it is valid while the changes of
+	// the tree is equal to changes.
+	path    []artPathNode
+	changes uint64
+}
+
+// artPathNode is an inner node on the path of an iterator and the position of the next node.
+type artPathNode struct {
+	node *artNode
+	pos  int
+}
+
+func (it *artIterator) load(leaf *artLeaf) {
+	it.verIdx = 0
+	it.changes = it.tree.changes
+	if leaf == nil {
+		it.key, it.versions = nil, nil
+		return
+	}
+	it.key, it.versions = leaf.key, leaf.versions
+}
+
+// seek positions the iterator at the first key from target in the direction of the iterator. The
+// read lock must be held.
+func (it *artIterator) seek(target []byte, inclusive bool) {
+	t := it.tree
+	var leaf *artLeaf
+	if t.root != nil {
+		if !it.reversed {
+			leaf = t.root.seekGE(target, 0, inclusive)
+		} else {
+			leaf = t.root.seekLE(target, 0, inclusive)
+		}
+	}
+	if leaf != nil {
+		it.buildPath(leaf.key)
+	}
+	it.load(leaf)
+}
+
+// buildPath builds the path from the root to the leaf of the key, the key must exist.
+func (it *artIterator) buildPath(key []byte) {
+	it.path = it.path[:0]
+	n := it.tree.root
+	depth := 0
+	for n.kind != artLeafKind {
+		depth += len(n.prefix)
+		if depth == len(key) {
+			it.path = append(it.path, artPathNode{node: n, pos: -1})
+			return
+		}
+		pos := n.childPos(key[depth])
+		it.path = append(it.path, artPathNode{node: n, pos: pos})
+		n = n.childAt(pos)
+		depth++
+	}
+}
+
+// first appends the path to the smallest key of the subtree and returns its leaf.
+func (it *artIterator) first(n *artNode) *artLeaf {
+	for n.kind != artLeafKind {
+		if n.leaf != nil {
+			it.path = append(it.path, artPathNode{node: n, pos: -1})
+			return n.leaf
+		}
+		pos := n.nextPos(-1)
+		it.path = append(it.path, artPathNode{node: n, pos: pos})
+		n = n.childAt(pos)
+	}
+	return n.leaf
+}
+
+// last appends the path to the biggest key of the subtree and returns its leaf.
+func (it *artIterator) last(n *artNode) *artLeaf {
+	for n.kind != artLeafKind {
+		pos := n.prevPos(n.endPos())
+		it.path = append(it.path, artPathNode{node: n, pos: pos})
+		if pos == -1 {
+			return n.leaf
+		}
+		n = n.childAt(pos)
+	}
+	return n.leaf
+}
+
+// next moves the path to the next leaf in the direction of the iterator.
+func (it *artIterator) next() *artLeaf {
+	for len(it.path) > 0 {
+		top := &it.path[len(it.path)-1]
+		n := top.node
+		if !it.reversed {
+			if pos := n.nextPos(top.pos); pos != -1 {
+				top.pos = pos
+				return it.first(n.childAt(pos))
+			}
+		} else if top.pos != -1 {
+			if pos := n.prevPos(top.pos); pos != -1 {
+				top.pos = pos
+				return it.last(n.childAt(pos))
+			}
+			if n.leaf != nil {
+				top.pos = -1
+				return n.leaf
+			}
+		}
+		it.path = it.path[:len(it.path)-1]
+	}
+	return nil
+}
+
+func (it *artIterator) Next() {
+	t := it.tree
+	t.mu.RLock()
+	if it.changes != t.changes {
+		it.seek(it.key, false)
+	} else {
+		it.load(it.next())
+	}
+	t.mu.RUnlock()
+}
+
+func (it *artIterator) NextVersion() bool {
+	if it.verIdx+1 < len(it.versions) {
+		it.verIdx++
+		return true
+	}
+	return false
+}
+
+func (it *artIterator) Rewind() {
+	t := it.tree
+	t.mu.RLock()
+	it.path = it.path[:0]
+	var leaf *artLeaf
+	if t.root != nil {
+		if !it.reversed {
+			leaf = it.first(t.root)
+		} else {
+			leaf = it.last(t.root)
+		}
+	}
+	it.load(leaf)
+	t.mu.RUnlock()
+}
+
+func (it *artIterator) Seek(key []byte) {
+	t := it.tree
+	t.mu.RLock()
+	it.seek(key, true)
+	t.mu.RUnlock()
+}
+
+func (it *artIterator) Key() y.Key {
+	return y.KeyWithTs(it.key, it.versions[it.verIdx].Version)
+}
+
+func (it *artIterator) Value() y.ValueStruct {
+	return it.versions[it.verIdx]
+}
+
+func (it *artIterator) FillValue(vs *y.ValueStruct) {
+	*vs = it.versions[it.verIdx]
+}
+
+func (it *artIterator) Valid() bool {
+	return it.versions != nil
+}
+
+func (it *artIterator) Close() error {
+	return nil
+}
@@ -0,0 +1,187 @@
+package memtable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/pingcap/badger/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestARTTree(t *testing.T) {
+	tree := newARTTree()
+	require.True(t, tree.Empty())
+	it := tree.newUniIterator(false)
+	it.Rewind()
+	require.False(t, it.Valid())
+
+	// Short keys from a small alphabet, so the keys are often prefixes of each other and the
+	// nodes of all the sizes are created.
+	rnd := rand.New(rand.NewSource(0))
+	randKey := func() []byte {
+		key := make([]byte, 1+rnd.Intn(4))
+		for i := range key {
+			key[i] = byte(rnd.Intn(64))
+		}
+		return key
+	}
+	versions := map[string]int{}
+	for i := 0; i < 20000; i++ {
+		key := randKey()
+		ver := versions[string(key)] + 1
+		versions[string(key)] = ver
+		tree.Put(key, y.ValueStruct{Value: key, Version: uint64(ver)})
+	}
+	// An older version is ignored.
+	tree.Put([]byte{0}, y.ValueStruct{Value: []byte("old"), Version: 0})
+	require.True(t, tree.MemSize() > 0)
+
+	keys := make([]string, 0, len(versions))
+	for key := range versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ver := versions[key]
+		v := tree.Get([]byte(key), uint64(ver))
+		require.EqualValues(t, ver, v.Version)
+		require.EqualValues(t, key, v.Value)
+		require.EqualValues(t, 1, tree.Get([]byte(key), 1).Version)
+		require.EqualValues(t, 0, tree.Get([]byte(key), 0).Version)
+	}
+	require.Nil(t, tree.Get([]byte{255}, 1).Value)
+
+	for _, reversed := range []bool{false, true} {
+		it := tree.newUniIterator(reversed)
+		i := 0
+		if reversed {
+			i = len(keys) - 1
+		}
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := keys[i]
+			require.EqualValues(t, key, it.Key().UserKey)
+			for ver := versions[key]; ver > 1; ver-- {
+				require.EqualValues(t, ver, it.Key().Version)
+				require.True(t, it.NextVersion())
+			}
+			require.EqualValues(t, 1, it.Key().Version)
+			require.False(t, it.NextVersion())
+			if reversed {
+				i--
+			} else {
+				i++
+			}
+		}
+		if reversed {
+			require.Equal(t, -1, i)
+		} else {
+			require.Equal(t, len(keys), i)
+		}
+	}
+
+	for i := 0; i < 2000; i++ {
+		target := randKey()
+		idx := sort.SearchStrings(keys, string(target))
+		it := tree.newUniIterator(false)
+		it.Seek(target)
+		if idx == len(keys) {
+			require.False(t, it.Valid())
+		} else {
+			require.EqualValues(t, keys[idx], it.Key().UserKey)
+		}
+		it = tree.newUniIterator(true)
+		it.Seek(target)
+		if idx < len(keys) && keys[idx] == string(target) {
+			require.EqualValues(t, target, it.Key().UserKey)
+		} else if idx == 0 {
+			require.False(t, it.Valid())
+		} else {
+			require.EqualValues(t, keys[idx-1], it.Key().UserKey)
+			require.True(t, bytes.Compare(it.Key().UserKey, target) < 0)
+		}
+	}
+}
+
+func TestARTIteratorModified(t *testing.T) {
+	tree := newARTTree()
+	for i := 0; i < 1000; i += 2 {
+		tree.Put(newValue(i), y.ValueStruct{Value: newValue(i), Version: 1})
+	}
+	for _, reversed := range []bool{false, true} {
+		it := tree.newUniIterator(reversed)
+		var keys []string
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key().UserKey))
+			// The tree is modified between the moves, the iterator sees the new keys after it.
+			i := rand.Intn(1000)
+			tree.Put(newValue(i), y.ValueStruct{Value: newValue(i), Version: 1})
+		}
+		for i := 1; i < len(keys); i++ {
+			if reversed {
+				require.True(t, keys[i-1] > keys[i])
+			} else {
+				require.True(t, keys[i-1] < keys[i])
+			}
+		}
+		it.Rewind()
+		n := 0
+		for ; it.Valid(); it.Next() {
+			n++
+		}
+		require.True(t, n >= len(keys))
+	}
+}
+
+func BenchmarkARTvsSkiplist(b *testing.B) {
+	const numKeys = 100000
+	keys := make([][]byte, numKeys)
+	rnd := rand.New(rand.NewSource(0))
+	for i := range keys {
+		keys[i] = make([]byte, 8)
+		binary.BigEndian.PutUint64(keys[i], rnd.Uint64())
+	}
+	value := newValue(123)
+	newIndex := func(art bool) memIndex {
+		if art {
+			return newARTTree()
+		}
+		return newSkiplist(int64(numKeys * (MaxNodeSize + 64)))
+	}
+	fill := func(idx memIndex) {
+		for _, key := range keys {
+			idx.Put(key, y.ValueStruct{Value: value, Version: 1})
+		}
+	}
+	for _, art := range []bool{false, true} {
+		name := "skiplist"
+		if art {
+			name = "art"
+		}
+		b.Run(name+"/put", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				fill(newIndex(art))
+			}
+		})
+		b.Run(name+"/get", func(b *testing.B) {
+			idx := newIndex(art)
+			fill(idx)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				idx.Get(keys[i%numKeys], 1)
+			}
+		})
+		b.Run(name+"/iterate", func(b *testing.B) {
+			idx := newIndex(art)
+			fill(idx)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				it := idx.newUniIterator(false)
+				for it.Rewind(); it.Valid(); it.Next() {
+				}
+			}
+		})
+	}
+}
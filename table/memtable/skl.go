@@ -545,6 +545,17 @@ func (s *skiplist) NewIterator() *Iterator {
 // arena.
 func (s *skiplist) MemSize() int64 { return s.arena.size() }
 
+func (s *skiplist) putEntries(entries []Entry) {
+	var h hint
+	for _, e := range entries {
+		s.PutWithHint(e.Key, e.Value, &h)
+	}
+}
+
+func (s *skiplist) newUniIterator(reversed bool) y.Iterator {
+	return s.NewUniIterator(reversed)
+}
+
 // Iterator is an iterator over skiplist object. For new objects, you just
 // need to initialize Iterator.list.
 type Iterator struct {
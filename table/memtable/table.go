@@ -3,9 +3,12 @@ package memtable
 import (
 	"bytes"
 	"sort"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
+	"github.com/dgryski/go-farm"
+	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/table"
 	"github.com/pingcap/badger/y"
 )
@@ -19,26 +22,78 @@ func (e *Entry) EstimateSize() int64 {
 	return int64(len(e.Key) + int(e.Value.EncodedSize()) + EstimateNodeSize)
 }
 
+// memIndex is the sorted index of the entries merged from the pending list, it is implemented by
+// the skiplist and the adaptive radix tree.
+type memIndex interface {
+	Put(key []byte, v y.ValueStruct)
+	// putEntries puts the entries of a list node.
+	putEntries(entries []Entry)
+	// Get returns the newest version of the key not newer than version.
+	Get(key []byte, version uint64) y.ValueStruct
+	// newUniIterator returns an iterator which follows the contract of UniIterator.
+	newUniIterator(reversed bool) y.Iterator
+	MemSize() int64
+	Empty() bool
+	Delete()
+}
+
 type Table struct {
-	skl         *skiplist
+	// skls are the shards of the table, a key is stored in the shard selected by its hash.
+	skls []memIndex
+	// shardSize is the number of bytes a shard can hold.
+	shardSize   int64
 	id          uint64
 	pendingList unsafe.Pointer // *listNode
 	compacting  int32
 }
 
 func New(arenaSize int64, id uint64) *Table {
+	return NewSharded(arenaSize, 1, options.SkipList, id)
+}
+
+// NewSharded creates a table with numShards indexes of memTableType, the pending list is merged
+// into the shards in parallel. A shard holds its share of arenaSize plus a half of it as the
+// headroom for the keys not evenly distributed, so the skiplist arenas of all the shards take 1.5
+// times arenaSize. The table must be flushed once a shard is full, see ShardFree.
+func NewSharded(arenaSize int64, numShards int, memTableType options.MemTableType, id uint64) *Table {
+	if numShards < 1 {
+		numShards = 1
+	}
+	shardSize := arenaSize
+	if numShards > 1 {
+		shardSize = arenaSize/int64(numShards) + arenaSize/int64(2*numShards)
+	}
+	skls := make([]memIndex, numShards)
+	for i := range skls {
+		if memTableType == options.ART {
+			skls[i] = newARTTree()
+		} else {
+			skls[i] = newSkiplist(shardSize)
+		}
+	}
 	return &Table{
-		skl: newSkiplist(arenaSize),
-		id:  id,
+		skls:      skls,
+		shardSize: shardSize,
+		id:        id,
 	}
 }
 
+// shard returns the index of the shard storing key.
+func (t *Table) shard(key []byte) int {
+	if len(t.skls) == 1 {
+		return 0
+	}
+	return int(farm.Fingerprint64(key) % uint64(len(t.skls)))
+}
+
 func (t *Table) ID() uint64 {
 	return t.id
 }
 
 func (t *Table) Delete() error {
-	t.skl.Delete()
+	for _, skl := range t.skls {
+		skl.Delete()
+	}
 	return nil
 }
 
@@ -47,7 +102,15 @@ func (t *Table) Close() error {
 }
 
 func (t *Table) Empty() bool {
-	return atomic.LoadPointer(&t.pendingList) == nil && t.skl.Empty()
+	if atomic.LoadPointer(&t.pendingList) != nil {
+		return false
+	}
+	for _, skl := range t.skls {
+		if !skl.Empty() {
+			return false
+		}
+	}
+	return true
 }
 
 func (t *Table) Get(key y.Key, keyHash uint64) (y.ValueStruct, error) {
@@ -58,24 +121,23 @@ func (t *Table) Get(key y.Key, keyHash uint64) (y.ValueStruct, error) {
 		}
 		curr = (*listNode)(atomic.LoadPointer(&curr.next))
 	}
-	return t.skl.Get(key.UserKey, key.Version), nil
+	return t.skls[t.shard(key.UserKey)].Get(key.UserKey, key.Version), nil
 }
 
 func (t *Table) NewIterator(reverse bool) y.Iterator {
-	var (
-		sklItr = t.skl.NewUniIterator(reverse)
-		its    []y.Iterator
-	)
+	var its []y.Iterator
 	curr := (*listNode)(atomic.LoadPointer(&t.pendingList))
 	for curr != nil {
 		its = append(its, curr.newIterator(reverse))
 		curr = (*listNode)(atomic.LoadPointer(&curr.next))
 	}
 
-	if len(its) == 0 {
-		return sklItr
+	if len(its) == 0 && len(t.skls) == 1 {
+		return t.skls[0].newUniIterator(reverse)
+	}
+	for _, skl := range t.skls {
+		its = append(its, skl.newUniIterator(reverse))
 	}
-	its = append(its, sklItr)
 	return table.NewMergeIterator(its, reverse)
 }
 
@@ -86,7 +148,28 @@ func (t *Table) Size() int64 {
 		sz += curr.memSize
 		curr = (*listNode)(atomic.LoadPointer(&curr.next))
 	}
-	return t.skl.MemSize() + sz
+	for _, skl := range t.skls {
+		sz += skl.MemSize()
+	}
+	return sz
+}
+
+// ShardFree returns the number of bytes which can still be put into the fullest shard. The entries
+// in the pending list are counted against it as their shards are not known before the merge.
+func (t *Table) ShardFree() int64 {
+	free := t.shardSize
+	curr := (*listNode)(atomic.LoadPointer(&t.pendingList))
+	for curr != nil {
+		free -= curr.memSize
+		curr = (*listNode)(atomic.LoadPointer(&curr.next))
+	}
+	var maxSize int64
+	for _, skl := range t.skls {
+		if sz := skl.MemSize(); sz > maxSize {
+			maxSize = sz
+		}
+	}
+	return free - maxSize
 }
 
 func (t *Table) Smallest() y.Key {
@@ -128,7 +211,7 @@ func (t *Table) IsCompacting() bool {
 
 // PutToSkl directly insert entry into SkipList.
 func (t *Table) PutToSkl(key []byte, v y.ValueStruct) {
-	t.skl.Put(key, v)
+	t.skls[t.shard(key)].Put(key, v)
 }
 
 // PutToPendingList put entries to pending list, and you can call MergeListToSkl to merge them to SkipList later.
@@ -143,7 +226,11 @@ func (t *Table) MergeListToSkl() {
 		return
 	}
 
-	head.mergeToSkl(t.skl)
+	if len(t.skls) == 1 {
+		head.mergeToSkl(t.skls[0])
+	} else {
+		t.mergeToShards(head)
+	}
 	// No new node inserted, just update head of list.
 	if atomic.CompareAndSwapPointer(&t.pendingList, unsafe.Pointer(head), nil) {
 		return
@@ -160,6 +247,36 @@ func (t *Table) MergeListToSkl() {
 	}
 }
 
+// mergeToShards merges the entries of the list from head into the shards in parallel.
+func (t *Table) mergeToShards(head *listNode) {
+	var nodes []*listNode
+	for n := head; n != nil; n = (*listNode)(atomic.LoadPointer(&n.next)) {
+		nodes = append(nodes, n)
+	}
+	// The entries of every node by shard, from the oldest node to the newest.
+	shardEntries := make([][][]Entry, len(nodes))
+	for i, n := range nodes {
+		entries := make([][]Entry, len(t.skls))
+		for _, e := range n.entries {
+			shard := t.shard(e.Key)
+			entries[shard] = append(entries[shard], e)
+		}
+		shardEntries[len(nodes)-1-i] = entries
+	}
+	var wg sync.WaitGroup
+	for shard, skl := range t.skls {
+		wg.Add(1)
+		go func(shard int, skl memIndex) {
+			defer wg.Done()
+			for _, entries := range shardEntries {
+				skl.putEntries(entries[shard])
+			}
+		}(shard, skl)
+	}
+	wg.Wait()
+	atomic.StorePointer(&head.next, nil)
+}
+
 func (t *Table) putToList(entries []Entry) {
 	n := newListNode(entries)
 	for {
@@ -192,20 +309,13 @@ func newListNode(entries []Entry) *listNode {
 	return n
 }
 
-func (n *listNode) putToSkl(s *skiplist, entries []Entry) {
-	var h hint
-	for _, e := range entries {
-		s.PutWithHint(e.Key, e.Value, &h)
-	}
-}
-
-func (n *listNode) mergeToSkl(skl *skiplist) {
+func (n *listNode) mergeToSkl(skl memIndex) {
 	next := (*listNode)(atomic.LoadPointer(&n.next))
 	if next != nil {
 		next.mergeToSkl(skl)
 	}
 	atomic.StorePointer(&n.next, nil)
-	n.putToSkl(skl, n.entries)
+	skl.putEntries(n.entries)
 }
 
 func (n *listNode) get(key y.Key) (y.ValueStruct, bool) {
@@ -286,7 +396,7 @@ func (it *listNodeIterator) Key() y.Key {
 
 func (it *listNodeIterator) Value() y.ValueStruct { return it.n.entries[it.idx].Value }
 
-func (it *listNodeIterator) FillValue(vs *y.ValueStruct) { *vs = it.Value() }
+func (it *listNodeIterator) FillValue(vs *y.ValueStruct) { *vs = it.n.entries[it.idx].Value }
 
 func (it *listNodeIterator) Valid() bool { return it.idx >= 0 && it.idx < len(it.n.latestOffs) }
 
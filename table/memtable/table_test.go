@@ -2,6 +2,7 @@ package memtable
 
 import (
 	"fmt"
+	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/y"
 	"github.com/stretchr/testify/require"
 	"testing"
@@ -58,3 +59,67 @@ func newTestEntry(key []byte, version int) Entry {
 		},
 	}
 }
+
+func TestShardedTable(t *testing.T) {
+	for _, typ := range []options.MemTableType{options.SkipList, options.ART} {
+		tbl := NewSharded(1<<20, 4, typ, 1)
+		// Every shard holds its share plus a half of it.
+		require.EqualValues(t, 3<<20/8, tbl.shardSize)
+		testShardedTable(t, tbl)
+	}
+}
+
+func testShardedTable(t *testing.T, tbl *Table) {
+	require.True(t, tbl.Empty())
+	free, emptySize := tbl.ShardFree(), tbl.Size()
+	// The versions are written in order.
+	for ver := 1; ver <= 2; ver++ {
+		for i := 0; i < 100; i += 10 {
+			var entries []Entry
+			for j := i; j < i+10; j++ {
+				entries = append(entries, newTestEntry(newKey(j), ver))
+			}
+			tbl.PutToPendingList(entries)
+		}
+	}
+	require.False(t, tbl.Empty())
+	// The pending entries are counted against every shard.
+	require.Equal(t, free-(tbl.Size()-emptySize), tbl.ShardFree())
+
+	check := func() {
+		for i := 0; i < 100; i++ {
+			v, err := tbl.Get(y.KeyWithTs(newKey(i), 2), 0)
+			require.NoError(t, err)
+			require.EqualValues(t, 2, v.Version)
+			require.EqualValues(t, newKey(i), v.Value)
+		}
+		it := tbl.NewIterator(false)
+		var n int
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.EqualValues(t, newKey(n), it.Key().UserKey)
+			require.True(t, it.NextVersion())
+			require.EqualValues(t, 1, it.Key().Version)
+			n++
+		}
+		require.Equal(t, 100, n)
+		it = tbl.NewIterator(true)
+		it.Seek(newKey(50))
+		require.EqualValues(t, newKey(50), it.Key().UserKey)
+		it.Next()
+		require.EqualValues(t, newKey(49), it.Key().UserKey)
+	}
+	check()
+	tbl.MergeListToSkl()
+	require.True(t, tbl.pendingList == nil)
+	var maxSize int64
+	for _, skl := range tbl.skls {
+		require.False(t, skl.Empty())
+		if skl.MemSize() > maxSize {
+			maxSize = skl.MemSize()
+		}
+	}
+	require.Equal(t, tbl.shardSize-maxSize, tbl.ShardFree())
+	check()
+	require.EqualValues(t, newKey(0), tbl.Smallest().UserKey)
+	require.EqualValues(t, newKey(99), tbl.Biggest().UserKey)
+}
@@ -53,6 +53,26 @@ func (child *mergeIteratorChild) reset() {
 	}
 }
 
+func (child *mergeIteratorChild) next() {
+	if child.merge != nil {
+		child.merge.Next()
+	} else if child.concat != nil {
+		child.concat.Next()
+	} else {
+		child.iter.Next()
+	}
+}
+
+func (child *mergeIteratorChild) fillValue(vs *y.ValueStruct) {
+	if child.merge != nil {
+		child.merge.FillValue(vs)
+	} else if child.concat != nil {
+		child.concat.FillValue(vs)
+	} else {
+		child.iter.FillValue(vs)
+	}
+}
+
 func (mt *MergeIterator) fix() {
 	if !mt.bigger.valid {
 		return
@@ -87,22 +107,10 @@ func (mt *MergeIterator) swap() {
 
 // Next returns the next element. If it is the same as the current key, ignore it.
 func (mt *MergeIterator) Next() {
-	if mt.smaller.merge != nil {
-		mt.smaller.merge.Next()
-	} else if mt.smaller.concat != nil {
-		mt.smaller.concat.Next()
-	} else {
-		mt.smaller.iter.Next()
-	}
+	mt.smaller.next()
 	mt.smaller.reset()
 	if mt.sameKey && mt.bigger.valid {
-		if mt.bigger.merge != nil {
-			mt.bigger.merge.Next()
-		} else if mt.bigger.concat != nil {
-			mt.bigger.concat.Next()
-		} else {
-			mt.bigger.iter.Next()
-		}
+		mt.bigger.next()
 		mt.bigger.reset()
 	}
 	mt.fix()
@@ -166,18 +174,13 @@ func (mt *MergeIterator) Key() y.Key {
 }
 
 // Value returns the value associated with the iterator.
-func (mt *MergeIterator) Value() y.ValueStruct {
-	return mt.smaller.iter.Value()
+func (mt *MergeIterator) Value() (vs y.ValueStruct) {
+	mt.smaller.fillValue(&vs)
+	return
 }
 
 func (mt *MergeIterator) FillValue(vs *y.ValueStruct) {
-	if mt.smaller.merge != nil {
-		mt.smaller.merge.FillValue(vs)
-	} else if mt.smaller.concat != nil {
-		mt.smaller.concat.FillValue(vs)
-	} else {
-		mt.smaller.iter.FillValue(vs)
-	}
+	mt.smaller.fillValue(vs)
 }
 
 // Close implements y.Iterator.
@@ -193,7 +196,9 @@ func (mt *MergeIterator) Close() error {
 	return nil
 }
 
-// NewMergeIterator creates a merge iterator
+// NewMergeIterator creates a merge iterator. The iterators in front take precedence when they
+// have the same key, two iterators are merged by a MergeIterator, more iterators are merged by
+// a LoserTreeIterator.
 func NewMergeIterator(iters []y.Iterator, reverse bool) y.Iterator {
 	if len(iters) == 0 {
 		return &EmptyIterator{}
@@ -210,8 +215,7 @@ func NewMergeIterator(iters []y.Iterator, reverse bool) y.Iterator {
 		mi.bigger.setIterator(iters[1])
 		return mi
 	}
-	mid := len(iters) / 2
-	return NewMergeIterator([]y.Iterator{NewMergeIterator(iters[:mid], reverse), NewMergeIterator(iters[mid:], reverse)}, reverse)
+	return newLoserTreeIterator(iters, reverse)
 }
 
 type EmptyIterator struct{}
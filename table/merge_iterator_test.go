@@ -339,26 +339,84 @@ func TestMultiVersionMergeIterator(t *testing.T) {
 	}
 }
 
-func BenchmarkMergeIterator(b *testing.B) {
-	num := 2
-	simpleIters := make([]y.Iterator, num)
-	for i := 0; i < num; i++ {
-		simpleIters[i] = new(SimpleIterator)
-	}
-	for i := 0; i < num*100; i += num {
-		for j := 0; j < num; j++ {
-			iter := simpleIters[j].(*SimpleIterator)
-			iter.keys = append(iter.keys, y.KeyWithTs([]byte(fmt.Sprintf("key%08d", i+j)), 0))
+func TestLoserTreeIterator(t *testing.T) {
+	for _, reverse := range []bool{false, true} {
+		// expected maps the key to the value of the first iterator that has the key.
+		expected := map[string]string{}
+		var iters []y.Iterator
+		for i := 0; i < 33; i++ {
+			var keys, vals []string
+			for j := 0; j < 300; j++ {
+				if z.FastRand()%5 != 0 {
+					continue
+				}
+				k := fmt.Sprintf("%03d", j)
+				v := fmt.Sprintf("%d-%s", i, k)
+				if _, ok := expected[k]; !ok {
+					expected[k] = v
+				}
+				keys = append(keys, k)
+				vals = append(vals, v)
+			}
+			iters = append(iters, newSimpleIterator(keys, vals, reverse))
 		}
-	}
-	mergeIter := NewMergeIterator(simpleIters, false)
-	defer mergeIter.Close()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		mergeIter.Rewind()
-		for mergeIter.Valid() {
-			mergeIter.Key()
-			mergeIter.Next()
+		expectedKeys := make([]string, 0, len(expected))
+		for k := range expected {
+			expectedKeys = append(expectedKeys, k)
+		}
+		sort.Strings(expectedKeys)
+		if reverse {
+			expectedKeys = reversed(expectedKeys)
+		}
+		expectedVals := make([]string, len(expectedKeys))
+		for i, k := range expectedKeys {
+			expectedVals[i] = expected[k]
+		}
+
+		it := NewMergeIterator(iters, reverse)
+		_, ok := it.(*LoserTreeIterator)
+		require.True(t, ok)
+		it.Rewind()
+		k, v := getAll(it)
+		require.EqualValues(t, expectedKeys, k)
+		require.EqualValues(t, expectedVals, v)
+
+		// The tree is rebuilt in place by every seek.
+		for i := 0; i < 100; i++ {
+			idx := int(z.FastRand() % uint32(len(expectedKeys)))
+			it.Seek([]byte(expectedKeys[idx]))
+			k, v = getAll(it)
+			require.EqualValues(t, expectedKeys[idx:], k)
+			require.EqualValues(t, expectedVals[idx:], v)
 		}
+		require.NoError(t, it.Close())
+	}
+}
+
+func BenchmarkMergeIterator(b *testing.B) {
+	for _, num := range []int{2, 32} {
+		b.Run(fmt.Sprintf("iters=%d", num), func(b *testing.B) {
+			simpleIters := make([]y.Iterator, num)
+			for i := 0; i < num; i++ {
+				simpleIters[i] = new(SimpleIterator)
+			}
+			for i := 0; i < num*100; i += num {
+				for j := 0; j < num; j++ {
+					iter := simpleIters[j].(*SimpleIterator)
+					iter.latestOffs = append(iter.latestOffs, len(iter.keys))
+					iter.keys = append(iter.keys, y.KeyWithTs([]byte(fmt.Sprintf("key%08d", i+j)), 0))
+				}
+			}
+			mergeIter := NewMergeIterator(simpleIters, false)
+			defer mergeIter.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mergeIter.Rewind()
+				for mergeIter.Valid() {
+					mergeIter.Key()
+					mergeIter.Next()
+				}
+			}
+		})
 	}
 }
@@ -0,0 +1,270 @@
+package rocksdb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+)
+
+const (
+	blockBasedTableMagic       uint64 = 0x88e241b785f4cff7
+	legacyBlockBasedTableMagic uint64 = 0xdb4775248b80fb57
+
+	// The legacy footer is the two block handles padded to 40 bytes and the magic, the footer of
+	// the format version 1 to 5 starts with the checksum type and ends with the format version
+	// and the magic.
+	legacyFooterSize = 48
+	footerSize       = 53
+	handlesSize      = 40
+
+	// A block is followed by the compression type and the checksum.
+	blockTrailerSize = 5
+
+	// The number of restarts of a block smaller than this size has the data block index type in
+	// its highest bit.
+	maxBlockSizeSupportedByHashIndex = 1 << 16
+
+	maxFormatVersion = 5
+
+	// An internal key is the user key followed by the sequence number and the value type.
+	internalKeyFooterSize = 8
+
+	maxDecompressedBlockSize = 1 << 30
+
+	crc32cMaskDelta = 0xa282ead8
+)
+
+// The checksum types of the blocks.
+const (
+	noChecksum     = 0
+	crc32cChecksum = 1
+)
+
+// The compression types of the blocks.
+const (
+	noCompression     = 0
+	snappyCompression = 1
+	lz4Compression    = 4
+	lz4hcCompression  = 5
+	zstdCompression   = 7
+)
+
+// The index types of the property "rocksdb.block.based.table.index.type".
+const (
+	binarySearchIndex             = 0
+	hashSearchIndex               = 1
+	twoLevelIndexSearch           = 2
+	binarySearchWithFirstKeyIndex = 3
+)
+
+// The names of the properties used by the reader.
+const (
+	propertiesBlockName   = "rocksdb.properties"
+	propIndexType         = "rocksdb.block.based.table.index.type"
+	propIndexValueIsDelta = "rocksdb.index.value.is.delta.encoded"
+	propNumRangeDeletions = "rocksdb.num.range-deletions"
+)
+
+// ErrCorrupted is returned when the file is not a valid RocksDB BlockBasedTable file.
+var ErrCorrupted = errors.New("corrupted RocksDB table")
+
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+func decodeBlockHandle(data []byte) (blockHandle, int, error) {
+	offset, n := binary.Uvarint(data)
+	if n <= 0 {
+		return blockHandle{}, 0, ErrCorrupted
+	}
+	size, m := binary.Uvarint(data[n:])
+	if m <= 0 {
+		return blockHandle{}, 0, ErrCorrupted
+	}
+	return blockHandle{offset: offset, size: size}, n + m, nil
+}
+
+type footer struct {
+	checksumType  byte
+	formatVersion uint32
+	metaIndex     blockHandle
+	index         blockHandle
+}
+
+// decodeFooter decodes the footer at the end of data, data must contain at least the last
+// footerSize bytes of the file unless the file is smaller.
+func decodeFooter(data []byte) (*footer, error) {
+	if len(data) < legacyFooterSize {
+		return nil, ErrCorrupted
+	}
+	f := &footer{checksumType: crc32cChecksum}
+	var handles []byte
+	switch binary.LittleEndian.Uint64(data[len(data)-8:]) {
+	case legacyBlockBasedTableMagic:
+		handles = data[len(data)-legacyFooterSize:]
+	case blockBasedTableMagic:
+		if len(data) < footerSize {
+			return nil, ErrCorrupted
+		}
+		data = data[len(data)-footerSize:]
+		f.checksumType = data[0]
+		f.formatVersion = binary.LittleEndian.Uint32(data[footerSize-12:])
+		handles = data[1:]
+	default:
+		return nil, errors.WithMessage(ErrCorrupted, "bad magic number")
+	}
+	if f.formatVersion > maxFormatVersion {
+		return nil, errors.Errorf("unsupported RocksDB table format version %d", f.formatVersion)
+	}
+	handles = handles[:handlesSize]
+	var n int
+	var err error
+	if f.metaIndex, n, err = decodeBlockHandle(handles); err != nil {
+		return nil, err
+	}
+	if f.index, _, err = decodeBlockHandle(handles[n:]); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// unmaskCRC reverses the masking of the checksums stored by RocksDB.
+func unmaskCRC(masked uint32) uint32 {
+	rot := masked - crc32cMaskDelta
+	return rot>>17 | rot<<15
+}
+
+// decodeBlock verifies the checksum of the block read with its trailer and decompresses it.
+func decodeBlock(data []byte, f *footer) ([]byte, error) {
+	if len(data) < blockTrailerSize {
+		return nil, ErrCorrupted
+	}
+	contents := data[:len(data)-blockTrailerSize]
+	compression := data[len(contents)]
+	if f.checksumType == crc32cChecksum {
+		expected := unmaskCRC(binary.LittleEndian.Uint32(data[len(contents)+1:]))
+		if crc32.Checksum(data[:len(contents)+1], y.CastagnoliCrcTable) != expected {
+			return nil, errors.WithMessage(ErrCorrupted, "block checksum mismatch")
+		}
+	}
+	switch compression {
+	case noCompression:
+		return contents, nil
+	case snappyCompression:
+		return snappy.Decode(nil, contents)
+	case lz4Compression, lz4hcCompression, zstdCompression:
+		if f.formatVersion < 2 {
+			return nil, errors.Errorf("unsupported compression %d of format version %d", compression, f.formatVersion)
+		}
+		// The format version 2 prefixes the compressed data with the decompressed size.
+		size, n := binary.Uvarint(contents)
+		if n <= 0 || size > maxDecompressedBlockSize {
+			return nil, ErrCorrupted
+		}
+		if compression == zstdCompression {
+			d, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			defer d.Close()
+			return d.DecodeAll(contents[n:], make([]byte, 0, size))
+		}
+		dst := make([]byte, size)
+		m, err := lz4.UncompressBlock(contents[n:], dst)
+		if err != nil {
+			return nil, err
+		}
+		return dst[:m], nil
+	default:
+		return nil, errors.Errorf("unsupported compression %d", compression)
+	}
+}
+
+// blockEntries returns the entries of the block without the restart points and the hash index.
+func blockEntries(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, ErrCorrupted
+	}
+	end := len(data) - 4
+	numRestarts := binary.LittleEndian.Uint32(data[end:])
+	if len(data) <= maxBlockSizeSupportedByHashIndex {
+		hasHashIndex := numRestarts>>31 == 1
+		numRestarts &= 1<<31 - 1
+		if hasHashIndex {
+			// The hash index is the buckets followed by the number of buckets.
+			if end < 2 {
+				return nil, ErrCorrupted
+			}
+			end -= 2 + int(binary.LittleEndian.Uint16(data[end-2:]))
+		}
+	}
+	end -= 4 * int(numRestarts)
+	if end < 0 {
+		return nil, ErrCorrupted
+	}
+	return data[:end], nil
+}
+
+// blockIterator decodes the entries of a block in order.
+type blockIterator struct {
+	data []byte
+	key  []byte
+	val  []byte
+	// shared is the length of the key shared with the previous key.
+	shared int
+	err    error
+}
+
+// next decodes the next entry, the value length is not encoded if valueEncoded is false. It
+// returns false at the end of the block or on error.
+func (it *blockIterator) next(valueEncoded bool) bool {
+	if len(it.data) == 0 || it.err != nil {
+		return false
+	}
+	shared, n1 := binary.Uvarint(it.data)
+	nonShared, n2 := uvarint(it.data, n1)
+	var valueLen uint64
+	n3 := 0
+	if valueEncoded {
+		valueLen, n3 = uvarint(it.data, n1+n2)
+	}
+	pos := n1 + n2 + n3
+	if n1 <= 0 || n2 <= 0 || n3 < 0 || int(shared) > len(it.key) ||
+		uint64(len(it.data)-pos) < nonShared+valueLen {
+		it.err = ErrCorrupted
+		return false
+	}
+	it.shared = int(shared)
+	it.key = append(it.key[:shared], it.data[pos:pos+int(nonShared)]...)
+	pos += int(nonShared)
+	if valueEncoded {
+		it.val = it.data[pos : pos+int(valueLen)]
+		pos += int(valueLen)
+	} else {
+		it.val = it.data[pos:]
+	}
+	it.data = it.data[pos:]
+	return true
+}
+
+// skip consumes n bytes of the value not encoded with its length.
+func (it *blockIterator) skip(n int) {
+	it.data = it.data[n:]
+}
+
+func uvarint(data []byte, pos int) (uint64, int) {
+	if pos <= 0 || pos > len(data) {
+		return 0, -1
+	}
+	v, n := binary.Uvarint(data[pos:])
+	if n <= 0 {
+		return 0, -1
+	}
+	return v, n
+}
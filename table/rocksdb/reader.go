@@ -0,0 +1,326 @@
+// Package rocksdb reads the SST files written in the BlockBasedTable format of RocksDB, so the data
+// of a RocksDB instance can be migrated to badger without a logical dump and restore.
+//
+// The format versions 0 to 5 are supported with the snappy, LZ4 and ZSTD compressions, the binary
+// search, hash search and partitioned indexes. The range deletions are not read.
+package rocksdb
+
+import (
+	"encoding/binary"
+	"os"
+
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+)
+
+// ValueType is the type of an entry in a RocksDB table.
+type ValueType byte
+
+// The value types of the entries.
+const (
+	TypeDeletion       ValueType = 0x0
+	TypeValue          ValueType = 0x1
+	TypeMerge          ValueType = 0x2
+	TypeSingleDeletion ValueType = 0x7
+)
+
+// Reader reads a RocksDB table file.
+type Reader struct {
+	f      *os.File
+	footer *footer
+	props  map[string][]byte
+	// handles are the handles of the data blocks in key order.
+	handles []blockHandle
+}
+
+// Open opens the RocksDB table file and loads its properties and index.
+func Open(filename string) (*Reader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{f: f}
+	if err = r.init(); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "open RocksDB table %q", filename)
+	}
+	return r, nil
+}
+
+func (r *Reader) init() error {
+	fi, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	tail := int64(footerSize)
+	if fi.Size() < tail {
+		tail = fi.Size()
+	}
+	buf := make([]byte, tail)
+	if _, err = r.f.ReadAt(buf, fi.Size()-tail); err != nil {
+		return err
+	}
+	if r.footer, err = decodeFooter(buf); err != nil {
+		return err
+	}
+	if err = r.readProperties(); err != nil {
+		return err
+	}
+	return r.readIndex()
+}
+
+func (r *Reader) readBlock(h blockHandle) ([]byte, error) {
+	buf := make([]byte, h.size+blockTrailerSize)
+	if _, err := r.f.ReadAt(buf, int64(h.offset)); err != nil {
+		return nil, err
+	}
+	data, err := decodeBlock(buf, r.footer)
+	if err != nil {
+		return nil, err
+	}
+	return blockEntries(data)
+}
+
+func (r *Reader) readProperties() error {
+	metaIndex, err := r.readBlock(r.footer.metaIndex)
+	if err != nil {
+		return err
+	}
+	r.props = make(map[string][]byte)
+	it := &blockIterator{data: metaIndex}
+	for it.next(true) {
+		if string(it.key) != propertiesBlockName {
+			continue
+		}
+		h, _, err := decodeBlockHandle(it.val)
+		if err != nil {
+			return err
+		}
+		props, err := r.readBlock(h)
+		if err != nil {
+			return err
+		}
+		pit := &blockIterator{data: props}
+		for pit.next(true) {
+			r.props[string(pit.key)] = append([]byte{}, pit.val...)
+		}
+		return pit.err
+	}
+	return it.err
+}
+
+func (r *Reader) readIndex() error {
+	index, err := r.readBlock(r.footer.index)
+	if err != nil {
+		return err
+	}
+	indexType := uint32(binarySearchIndex)
+	if v, ok := r.props[propIndexType]; ok && len(v) == 4 {
+		indexType = binary.LittleEndian.Uint32(v)
+	}
+	if indexType != twoLevelIndexSearch {
+		r.handles, err = r.decodeIndex(index, indexType)
+		return err
+	}
+	// The top-level index of a partitioned index points to the index partitions.
+	partitions, err := r.decodeIndex(index, binarySearchIndex)
+	if err != nil {
+		return err
+	}
+	for _, h := range partitions {
+		partition, err := r.readBlock(h)
+		if err != nil {
+			return err
+		}
+		handles, err := r.decodeIndex(partition, binarySearchIndex)
+		if err != nil {
+			return err
+		}
+		r.handles = append(r.handles, handles...)
+	}
+	return nil
+}
+
+// decodeIndex decodes the block handles in an index block, the keys are not needed as the data
+// blocks are read in order.
+func (r *Reader) decodeIndex(data []byte, indexType uint32) ([]blockHandle, error) {
+	deltaEncoded := r.uint64Property(propIndexValueIsDelta) != 0
+	var handles []blockHandle
+	it := &blockIterator{data: data}
+	for it.next(!deltaEncoded) {
+		var h blockHandle
+		var n int
+		if deltaEncoded && it.shared != 0 && len(handles) > 0 {
+			// The size is the delta to the previous size, the block follows the previous one.
+			delta, m := binary.Varint(it.val)
+			if m <= 0 {
+				return nil, ErrCorrupted
+			}
+			prev := handles[len(handles)-1]
+			h = blockHandle{offset: prev.offset + prev.size + blockTrailerSize, size: uint64(int64(prev.size) + delta)}
+			n = m
+		} else {
+			var err error
+			if h, n, err = decodeBlockHandle(it.val); err != nil {
+				return nil, err
+			}
+		}
+		if indexType == binarySearchWithFirstKeyIndex {
+			// The handle is followed by the length prefixed first key of the block.
+			keyLen, m := binary.Uvarint(it.val[n:])
+			if m <= 0 || uint64(len(it.val)-n-m) < keyLen {
+				return nil, ErrCorrupted
+			}
+			n += m + int(keyLen)
+		}
+		if deltaEncoded {
+			it.skip(n)
+		}
+		handles = append(handles, h)
+	}
+	return handles, it.err
+}
+
+func (r *Reader) uint64Property(name string) uint64 {
+	v, _ := binary.Uvarint(r.props[name])
+	return v
+}
+
+// Properties returns the table properties, the integer properties are encoded as varints.
+func (r *Reader) Properties() map[string][]byte {
+	return r.props
+}
+
+// NumRangeDeletions returns the number of the range deletions in the table which are not read.
+func (r *Reader) NumRangeDeletions() uint64 {
+	return r.uint64Property(propNumRangeDeletions)
+}
+
+// Close closes the table file.
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
+
+// NewIterator returns an iterator over all the entries of the table in the order of RocksDB
+// internal keys, which is the user key order with the newer versions first.
+func (r *Reader) NewIterator() *Iterator {
+	return &Iterator{r: r, blockIdx: -1}
+}
+
+// Iterator iterates the entries of a RocksDB table.
+type Iterator struct {
+	r        *Reader
+	blockIdx int
+	bi       blockIterator
+	seqNum   uint64
+	valType  ValueType
+	valid    bool
+	err      error
+}
+
+// Rewind seeks to the first entry.
+func (it *Iterator) Rewind() {
+	it.blockIdx = -1
+	it.bi = blockIterator{}
+	it.err = nil
+	it.Next()
+}
+
+// Next moves to the next entry.
+func (it *Iterator) Next() {
+	it.valid = false
+	for it.err == nil && !it.bi.next(true) {
+		if it.bi.err != nil {
+			it.err = it.bi.err
+			return
+		}
+		it.blockIdx++
+		if it.blockIdx >= len(it.r.handles) {
+			return
+		}
+		data, err := it.r.readBlock(it.r.handles[it.blockIdx])
+		if err != nil {
+			it.err = err
+			return
+		}
+		it.bi = blockIterator{data: data, key: it.bi.key[:0]}
+	}
+	if it.err != nil {
+		return
+	}
+	if len(it.bi.key) < internalKeyFooterSize {
+		it.err = ErrCorrupted
+		return
+	}
+	trailer := binary.LittleEndian.Uint64(it.bi.key[len(it.bi.key)-internalKeyFooterSize:])
+	it.seqNum = trailer >> 8
+	it.valType = ValueType(trailer)
+	it.valid = true
+}
+
+// Valid returns true if the iterator is at an entry.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Error returns the error which stopped the iteration.
+func (it *Iterator) Error() error {
+	return it.err
+}
+
+// Key returns the user key of the entry, it is valid until Next is called.
+func (it *Iterator) Key() []byte {
+	return it.bi.key[:len(it.bi.key)-internalKeyFooterSize]
+}
+
+// SeqNum returns the sequence number of the entry.
+func (it *Iterator) SeqNum() uint64 {
+	return it.seqNum
+}
+
+// Type returns the value type of the entry.
+func (it *Iterator) Type() ValueType {
+	return it.valType
+}
+
+// Value returns the value of the entry, it is valid until Next is called.
+func (it *Iterator) Value() []byte {
+	return it.bi.val
+}
+
+// Convert adds the latest version of every key in the table to the builder with the version, the
+// builder can be created by DB.NewExternalTableBuilder so the result can be ingested. The deleted
+// keys are skipped. An error is returned if the table has merge operands or range deletions as
+// they can't be resolved without the rest of the RocksDB data. It returns the number of keys added.
+func (r *Reader) Convert(b *sstable.Builder, version uint64) (int, error) {
+	if r.NumRangeDeletions() > 0 {
+		return 0, errors.New("RocksDB table has range deletions")
+	}
+	var lastKey []byte
+	var count int
+	first := true
+	it := r.NewIterator()
+	for it.Rewind(); it.Valid(); it.Next() {
+		if !first && string(it.Key()) == string(lastKey) {
+			// The older versions follow the latest one.
+			continue
+		}
+		first = false
+		lastKey = append(lastKey[:0], it.Key()...)
+		switch it.Type() {
+		case TypeValue:
+		case TypeDeletion, TypeSingleDeletion:
+			continue
+		case TypeMerge:
+			return count, errors.Errorf("RocksDB table has merge operand for key %q", it.Key())
+		default:
+			return count, errors.Errorf("unsupported RocksDB value type %d", it.Type())
+		}
+		if err := b.Add(y.KeyWithTs(it.Key(), version), y.ValueStruct{Value: it.Value()}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, it.Error()
+}
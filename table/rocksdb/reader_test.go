@@ -0,0 +1,257 @@
+package rocksdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/pingcap/badger/options"
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/badger/y"
+	"github.com/stretchr/testify/require"
+)
+
+type testEntry struct {
+	key     string
+	seq     uint64
+	valType ValueType
+	val     string
+}
+
+// blockBuilder builds a block with a restart point every 4 entries.
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	lastKey  []byte
+	count    int
+}
+
+func (b *blockBuilder) add(key, val []byte, valueEncoded bool) (shared int) {
+	if b.count%4 == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+	} else {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	}
+	b.buf = appendUvarint(b.buf, uint64(shared))
+	b.buf = appendUvarint(b.buf, uint64(len(key)-shared))
+	if valueEncoded {
+		b.buf = appendUvarint(b.buf, uint64(len(val)))
+	}
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, val...)
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.count++
+	return shared
+}
+
+func (b *blockBuilder) finish() []byte {
+	if len(b.restarts) == 0 {
+		b.restarts = append(b.restarts, 0)
+	}
+	for _, r := range b.restarts {
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, r)
+	}
+	return binary.LittleEndian.AppendUint32(b.buf, uint32(len(b.restarts)))
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendHandle(buf []byte, h blockHandle) []byte {
+	return appendUvarint(appendUvarint(buf, h.offset), h.size)
+}
+
+type fileBuilder struct {
+	buf []byte
+}
+
+func (f *fileBuilder) writeBlock(data []byte, compression byte) blockHandle {
+	if compression == snappyCompression {
+		data = snappy.Encode(nil, data)
+	}
+	h := blockHandle{offset: uint64(len(f.buf)), size: uint64(len(data))}
+	f.buf = append(f.buf, data...)
+	f.buf = append(f.buf, compression)
+	crc := crc32.Checksum(f.buf[h.offset:], y.CastagnoliCrcTable)
+	f.buf = binary.LittleEndian.AppendUint32(f.buf, (crc>>15|crc<<17)+crc32cMaskDelta)
+	return h
+}
+
+func buildTable(t *testing.T, path string, entries []testEntry, formatVersion uint32, compression byte, deltaIndex bool) {
+	f := new(fileBuilder)
+	var handles []blockHandle
+	var lastKeys [][]byte
+	for i := 0; i < len(entries); i += 10 {
+		b := new(blockBuilder)
+		var key []byte
+		for _, e := range entries[i:minInt(i+10, len(entries))] {
+			key = append([]byte(e.key), make([]byte, 8)...)
+			binary.LittleEndian.PutUint64(key[len(e.key):], e.seq<<8|uint64(e.valType))
+			b.add(key, []byte(e.val), true)
+		}
+		handles = append(handles, f.writeBlock(b.finish(), compression))
+		lastKeys = append(lastKeys, key)
+	}
+	index := new(blockBuilder)
+	for i, h := range handles {
+		if !deltaIndex {
+			index.add(lastKeys[i], appendHandle(nil, h), true)
+			continue
+		}
+		// The keys share a prefix, so only the restart points have the full handles.
+		var val []byte
+		if index.count%4 == 0 {
+			val = appendHandle(nil, h)
+		} else {
+			var tmp [binary.MaxVarintLen64]byte
+			val = tmp[:binary.PutVarint(tmp[:], int64(h.size)-int64(handles[i-1].size))]
+		}
+		index.add(lastKeys[i], val, false)
+	}
+	props := new(blockBuilder)
+	if deltaIndex {
+		props.add([]byte(propIndexValueIsDelta), appendUvarint(nil, 1), true)
+	}
+	props.add([]byte("rocksdb.num.entries"), appendUvarint(nil, uint64(len(entries))), true)
+	propsHandle := f.writeBlock(props.finish(), noCompression)
+	metaIndex := new(blockBuilder)
+	metaIndex.add([]byte(propertiesBlockName), appendHandle(nil, propsHandle), true)
+	metaIndexHandle := f.writeBlock(metaIndex.finish(), noCompression)
+	indexHandle := f.writeBlock(index.finish(), noCompression)
+
+	handlesBuf := appendHandle(appendHandle(nil, metaIndexHandle), indexHandle)
+	handlesBuf = append(handlesBuf, make([]byte, handlesSize-len(handlesBuf))...)
+	if formatVersion == 0 {
+		f.buf = append(f.buf, handlesBuf...)
+		f.buf = binary.LittleEndian.AppendUint64(f.buf, legacyBlockBasedTableMagic)
+	} else {
+		f.buf = append(f.buf, crc32cChecksum)
+		f.buf = append(f.buf, handlesBuf...)
+		f.buf = binary.LittleEndian.AppendUint32(f.buf, formatVersion)
+		f.buf = binary.LittleEndian.AppendUint64(f.buf, blockBasedTableMagic)
+	}
+	require.NoError(t, ioutil.WriteFile(path, f.buf, 0666))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func testEntries(n int) []testEntry {
+	var entries []testEntry
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		switch i % 10 {
+		case 3:
+			entries = append(entries, testEntry{key, 20, TypeDeletion, ""})
+			entries = append(entries, testEntry{key, 10, TypeValue, "old"})
+		case 7:
+			entries = append(entries, testEntry{key, 20, TypeValue, "new" + key})
+			entries = append(entries, testEntry{key, 10, TypeValue, "old"})
+		default:
+			entries = append(entries, testEntry{key, uint64(i), TypeValue, "val" + key})
+		}
+	}
+	return entries
+}
+
+func TestReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocksdb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	entries := testEntries(100)
+	cases := []struct {
+		formatVersion uint32
+		compression   byte
+		deltaIndex    bool
+	}{
+		{0, noCompression, false},
+		{2, snappyCompression, false},
+		{4, snappyCompression, true},
+	}
+	for i, c := range cases {
+		path := filepath.Join(dir, fmt.Sprintf("%06d.sst", i))
+		buildTable(t, path, entries, c.formatVersion, c.compression, c.deltaIndex)
+		r, err := Open(path)
+		require.NoError(t, err)
+		require.Equal(t, appendUvarint(nil, uint64(len(entries))), r.Properties()["rocksdb.num.entries"])
+		it := r.NewIterator()
+		var j int
+		for it.Rewind(); it.Valid(); it.Next() {
+			e := entries[j]
+			require.Equal(t, e.key, string(it.Key()))
+			require.Equal(t, e.seq, it.SeqNum())
+			require.Equal(t, e.valType, it.Type())
+			require.Equal(t, e.val, string(it.Value()))
+			j++
+		}
+		require.NoError(t, it.Error())
+		require.Equal(t, len(entries), j)
+
+		filename := sstable.NewFilename(uint64(i+1), dir)
+		f, err := os.Create(filename)
+		require.NoError(t, err)
+		b := sstable.NewExternalTableBuilder(f, nil, options.TableBuilderOptions{
+			BlockSize: 4 << 10, MaxTableSize: 1 << 20, WriteBufferSize: 1 << 20, LogicalBloomFPR: 0.01, HashUtilRatio: 0.75,
+		}, options.None)
+		n, err := r.Convert(b, 1)
+		require.NoError(t, err)
+		require.Equal(t, 90, n)
+		_, err = b.Finish()
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		require.NoError(t, r.Close())
+
+		// The deleted keys are skipped and the latest versions are kept.
+		tbl, err := sstable.OpenTable(filename, options.FileIO, nil, nil, nil)
+		require.NoError(t, err)
+		bit := tbl.NewIterator(false)
+		var keys int
+		for bit.Rewind(); bit.Valid(); bit.Next() {
+			key := string(bit.Key().UserKey)
+			require.NotEqual(t, "3", key[len(key)-1:])
+			if key[len(key)-1:] == "7" {
+				require.Equal(t, "new"+key, string(bit.Value().Value))
+			}
+			keys++
+		}
+		require.Equal(t, 90, keys)
+		require.NoError(t, bit.Close())
+		require.NoError(t, tbl.Close())
+	}
+}
+
+func TestReaderCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocksdb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "000001.sst")
+	buildTable(t, path, testEntries(20), 2, noCompression, false)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[5] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0666))
+	r, err := Open(path)
+	require.NoError(t, err)
+	defer r.Close()
+	it := r.NewIterator()
+	for it.Rewind(); it.Valid(); it.Next() {
+	}
+	require.Error(t, it.Error())
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("not a table"), 0666))
+	_, err = Open(path)
+	require.Error(t, err)
+}
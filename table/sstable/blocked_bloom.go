@@ -0,0 +1,82 @@
+package sstable
+
+import (
+	"math"
+)
+
+const (
+	// bloomBlockBits is the size of a cache line in bits, all the probes of a key are in one block.
+	bloomBlockBits  = 512
+	bloomBlockBytes = bloomBlockBits / 8
+	maxBloomProbes  = 30
+)
+
+// blockedBloom is a cache line blocked bloom filter. The high 32 bits of the key hash select the
+// block and the low 32 bits generate the probes inside the block, so a lookup touches only one
+// cache line.
+//
+// format: blocks | numProbes(1)
+type blockedBloom struct {
+	data      []byte
+	numBlocks uint32
+	numProbes uint32
+}
+
+func buildBlockedBloom(hashEntries []hashEntry, fpr float64) []byte {
+	if len(hashEntries) == 0 {
+		return nil
+	}
+	bitsPerKey := -math.Log(fpr) / (math.Ln2 * math.Ln2)
+	numProbes := int(math.Round(bitsPerKey * math.Ln2))
+	if numProbes < 1 {
+		numProbes = 1
+	} else if numProbes > maxBloomProbes {
+		numProbes = maxBloomProbes
+	}
+	numBlocks := int(math.Ceil(bitsPerKey * float64(len(hashEntries)) / bloomBlockBits))
+	bf := &blockedBloom{
+		data:      make([]byte, numBlocks*bloomBlockBytes+1),
+		numBlocks: uint32(numBlocks),
+		numProbes: uint32(numProbes),
+	}
+	for _, he := range hashEntries {
+		bf.add(he.hash)
+	}
+	bf.data[len(bf.data)-1] = byte(numProbes)
+	return bf.data
+}
+
+func (bf *blockedBloom) readFilter(data []byte) {
+	bf.data = data
+	bf.numBlocks = uint32((len(data) - 1) / bloomBlockBytes)
+	bf.numProbes = uint32(data[len(data)-1])
+}
+
+func (bf *blockedBloom) blockOffset(keyHash uint64) uint32 {
+	// Map the high 32 bits to [0, numBlocks) without the modulo.
+	blk := uint32((keyHash >> 32) * uint64(bf.numBlocks) >> 32)
+	return blk * bloomBlockBytes
+}
+
+func (bf *blockedBloom) add(keyHash uint64) {
+	off := bf.blockOffset(keyHash)
+	h, delta := uint32(keyHash), uint32(keyHash)>>17|uint32(keyHash)<<15
+	for i := uint32(0); i < bf.numProbes; i++ {
+		pos := h % bloomBlockBits
+		bf.data[off+pos/8] |= 1 << (pos % 8)
+		h += delta
+	}
+}
+
+func (bf *blockedBloom) has(keyHash uint64) bool {
+	off := bf.blockOffset(keyHash)
+	h, delta := uint32(keyHash), uint32(keyHash)>>17|uint32(keyHash)<<15
+	for i := uint32(0); i < bf.numProbes; i++ {
+		pos := h % bloomBlockBits
+		if bf.data[off+pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
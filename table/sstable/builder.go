@@ -19,17 +19,24 @@ package sstable
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"math"
 	"os"
 	"reflect"
+	"sort"
 	"unsafe"
 
 	"github.com/coocood/bbloom"
 	"github.com/dgryski/go-farm"
+	"github.com/ncw/directio"
+	"github.com/pingcap/badger/buffer"
 	"github.com/pingcap/badger/fileutil"
 	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/surf"
+	"github.com/pingcap/badger/table"
 	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
 	"golang.org/x/time/rate"
 )
 
@@ -43,8 +50,12 @@ func (es *entrySlice) append(entry []byte) {
 	es.endOffs = append(es.endOffs, uint32(len(es.data)))
 }
 
-func (es *entrySlice) appendVal(val *y.ValueStruct) {
-	es.data = val.EncodeTo(es.data)
+func (es *entrySlice) appendVal(val *y.ValueStruct, varint bool) {
+	if varint {
+		es.data = val.EncodeVarintTo(es.data)
+	} else {
+		es.data = val.EncodeTo(es.data)
+	}
 	es.endOffs = append(es.endOffs, uint32(len(es.data)))
 }
 
@@ -104,8 +115,8 @@ type Builder struct {
 	opt         options.TableBuilderOptions
 	useSuRF     bool
 
-	surfKeys [][]byte
-	surfVals [][]byte
+	// surfBuilder consumes the keys as they are added, it is nil until the first key is added.
+	surfBuilder *surf.Builder
 
 	tmpKeys    entrySlice
 	tmpVals    entrySlice
@@ -113,6 +124,23 @@ type Builder struct {
 
 	singleKeyOldVers entrySlice
 	oldBlock         []byte
+
+	// compressBuf holds the compressed block before we decide whether to store it compressed.
+	compressBuf bytes.Buffer
+	// blockCompression records the compression type of every block, it is needed because
+	// incompressible blocks are stored raw.
+	blockCompression []byte
+	hasRawBlock      bool
+	// blockChecksums has the crc32c of every block as written to the file, followed by the
+	// checksum of the old block if there is one.
+	blockChecksums []uint32
+
+	// dataKey encrypts the blocks and the index, it is nil if encryption is disabled.
+	dataKey    *options.DataKey
+	encryptBuf []byte
+
+	propsCollector options.TablePropertiesCollector
+	entryStats     table.EntryStats
 }
 
 type tableWriter interface {
@@ -155,7 +183,9 @@ func NewTableBuilder(f *os.File, limiter *rate.Limiter, level int, opt options.T
 		useSuRF:     level >= opt.SuRFStartLevel,
 		// add one byte so the offset would never be 0, so oldOffset is 0 means no old version.
 		oldBlock: []byte{0},
+		dataKey:  latestDataKey(opt),
 	}
+	b.resetPropsCollector()
 	if f != nil {
 		b.w = fileutil.NewDirectWriter(f, opt.WriteBufferSize, limiter)
 	} else {
@@ -165,7 +195,7 @@ func NewTableBuilder(f *os.File, limiter *rate.Limiter, level int, opt options.T
 }
 
 func NewExternalTableBuilder(f *os.File, limiter *rate.Limiter, opt options.TableBuilderOptions, compression options.CompressionType) *Builder {
-	return &Builder{
+	b := &Builder{
 		file:        f,
 		w:           fileutil.NewDirectWriter(f, opt.WriteBufferSize, limiter),
 		buf:         make([]byte, 0, 4*1024),
@@ -174,12 +204,104 @@ func NewExternalTableBuilder(f *os.File, limiter *rate.Limiter, opt options.Tabl
 		useGlobalTS: true,
 		compression: compression,
 		opt:         opt,
+		dataKey:     latestDataKey(opt),
+	}
+	b.resetPropsCollector()
+	return b
+}
+
+// SplitBuilder builds external tables and rolls over to a new file once the current table
+// reaches maxTableSize, all the versions of a key are kept in the same table.
+type SplitBuilder struct {
+	builder      *Builder
+	newFile      func() (*os.File, error)
+	maxTableSize int64
+	limiter      *rate.Limiter
+	opt          options.TableBuilderOptions
+	compression  options.CompressionType
+	lastKey      y.Key
+	results      []*BuildResult
+	isManaged    bool
+}
+
+// NewSplitExternalTableBuilder makes a new SplitBuilder, newFile is called to create the file of
+// every output table.
+func NewSplitExternalTableBuilder(newFile func() (*os.File, error), maxTableSize int64, limiter *rate.Limiter,
+	opt options.TableBuilderOptions, compression options.CompressionType) *SplitBuilder {
+	return &SplitBuilder{
+		newFile:      newFile,
+		maxTableSize: maxTableSize,
+		limiter:      limiter,
+		opt:          opt,
+		compression:  compression,
+	}
+}
+
+// Add adds a key-value pair to the current table, the keys must be added in ascending order.
+func (sb *SplitBuilder) Add(key y.Key, value y.ValueStruct) error {
+	if sb.builder != nil && !sb.builder.Empty() && !key.SameUserKey(sb.lastKey) &&
+		sb.builder.ReachedCapacity(sb.maxTableSize) {
+		if err := sb.finishTable(); err != nil {
+			return err
+		}
+	}
+	if sb.builder == nil || sb.builder.file == nil {
+		f, err := sb.newFile()
+		if err != nil {
+			return err
+		}
+		if sb.builder == nil {
+			sb.builder = NewExternalTableBuilder(f, sb.limiter, sb.opt, sb.compression)
+			if sb.isManaged {
+				sb.builder.SetIsManaged()
+			}
+		} else {
+			sb.builder.Reset(f)
+		}
 	}
+	sb.lastKey.Copy(key)
+	return sb.builder.Add(key, value)
+}
+
+// SetIsManaged should be called before any key is added when the tables are ingested into a managed DB.
+func (sb *SplitBuilder) SetIsManaged() {
+	sb.isManaged = true
+}
+
+func (sb *SplitBuilder) finishTable() error {
+	result, err := sb.builder.Finish()
+	if err != nil {
+		return err
+	}
+	if err = sb.builder.file.Close(); err != nil {
+		return err
+	}
+	sb.builder.file = nil
+	sb.results = append(sb.results, result)
+	return nil
+}
+
+// Finish finishes the last table and returns the build results of all the tables.
+func (sb *SplitBuilder) Finish() ([]*BuildResult, error) {
+	if sb.builder != nil && sb.builder.file != nil {
+		if err := sb.finishTable(); err != nil {
+			return nil, err
+		}
+	}
+	return sb.results, nil
+}
+
+func latestDataKey(opt options.TableBuilderOptions) *options.DataKey {
+	if opt.KeyRegistry == nil {
+		return nil
+	}
+	return opt.KeyRegistry.LatestDataKey()
 }
 
 // Reset this builder with new file.
 func (b *Builder) Reset(f *os.File) {
 	b.file = f
+	b.dataKey = latestDataKey(b.opt)
 	b.resetBuffers()
 	b.w.Reset(f)
 }
@@ -198,11 +320,21 @@ func (b *Builder) resetBuffers() {
 	b.blockEndOffsets = b.blockEndOffsets[:0]
 	b.entryEndOffsets = b.entryEndOffsets[:0]
 	b.hashEntries = b.hashEntries[:0]
-	b.surfKeys = nil
-	b.surfVals = nil
+	b.surfBuilder = nil
 	b.smallest.UserKey = b.smallest.UserKey[:0]
 	b.biggest.UserKey = b.biggest.UserKey[:0]
 	b.oldBlock = b.oldBlock[:0]
+	b.blockCompression = b.blockCompression[:0]
+	b.blockChecksums = b.blockChecksums[:0]
+	b.hasRawBlock = false
+	b.entryStats = table.EntryStats{}
+	b.resetPropsCollector()
+}
+
+func (b *Builder) resetPropsCollector() {
+	if b.opt.TablePropertiesCollectorFactory != nil {
+		b.propsCollector = b.opt.TablePropertiesCollectorFactory()
+	}
 }
 
 // Close closes the TableBuilder.
@@ -237,31 +369,55 @@ func (b *Builder) addIndex(key y.Key) {
 
 	pos := entryPosition{uint16(b.baseKeys.length()), uint8(b.counter)}
 	if b.useSuRF {
-		b.surfKeys = append(b.surfKeys, y.SafeCopy(nil, key.UserKey))
-		b.surfVals = append(b.surfVals, pos.encode())
+		if b.surfBuilder == nil {
+			hl := uint32(b.opt.SuRFOptions.HashSuffixLen)
+			rl := uint32(b.opt.SuRFOptions.RealSuffixLen)
+			b.surfBuilder = surf.NewBuilder(3, hl, rl)
+		}
+		b.surfBuilder.Add(key.UserKey, pos.encode())
 	} else {
 		b.hashEntries = append(b.hashEntries, hashEntry{pos, keyHash})
 	}
 }
 
 func (b *Builder) addHelper(key y.Key, v y.ValueStruct) {
+	b.entryStats.NumKeys++
+	b.collectProps(key, &v)
 	// Add key to bloom filter.
 	if len(key.UserKey) > 0 {
 		b.addIndex(key)
 	}
 	b.tmpKeys.append(key.UserKey)
 	v.Version = key.Version
-	b.tmpVals.appendVal(&v)
+	b.tmpVals.appendVal(&v, b.opt.VarintValue)
 	b.tmpOldOffs = append(b.tmpOldOffs, 0)
 	b.counter++
 }
 
+func (b *Builder) collectProps(key y.Key, v *y.ValueStruct) {
+	stats := &b.entryStats
+	if stats.NumEntries == 0 || key.Version < stats.MinVersion {
+		stats.MinVersion = key.Version
+	}
+	if key.Version > stats.MaxVersion {
+		stats.MaxVersion = key.Version
+	}
+	stats.NumEntries++
+	if v.Meta&y.BitDelete != 0 {
+		stats.NumDeletes++
+	}
+	if b.propsCollector != nil {
+		b.propsCollector.Add(key.UserKey, key.Version, v.Meta, v.UserMeta, v.Value)
+	}
+}
+
 // oldEntry format:
 //   numEntries(4) | endOffsets(4 * numEntries) | entries
 //
 // entry format:
 //   version(8) | value
 func (b *Builder) addOld(key y.Key, v y.ValueStruct) {
+	b.collectProps(key, &v)
 	v.Version = key.Version
 	keyIdx := b.tmpKeys.length() - 1
 	startOff := b.tmpOldOffs[keyIdx]
@@ -269,7 +425,7 @@ func (b *Builder) addOld(key y.Key, v y.ValueStruct) {
 		startOff = uint32(len(b.oldBlock))
 		b.tmpOldOffs[keyIdx] = startOff
 	}
-	b.singleKeyOldVers.appendVal(&v)
+	b.singleKeyOldVers.appendVal(&v, b.opt.VarintValue)
 }
 
 // entryFormat
@@ -277,6 +433,13 @@ func (b *Builder) addOld(key y.Key, v y.ValueStruct) {
 //  diffKeyLen(2) | diffKey | 0 | version(8) | value
 // has old entry:
 //  diffKeyLen(2) | diffKey | 1 | oldOffset(4) | version(8) | value
+//
+// The version is a uvarint if the table is built with VarintValue, see y.ValueStruct.EncodeVarintTo.
+//
+// If the restart interval is larger than 1, the entry starts with the length of the diff key
+// shared with the previous key, which is 0 at the restart points:
+//
+//	sharedLen(2) | diffKeyLen(2) | diffKey | ...
 func (b *Builder) finishBlock() error {
 	if b.tmpKeys.length() == 0 {
 		return nil
@@ -287,10 +450,20 @@ func (b *Builder) finishBlock() error {
 	firstKey := b.tmpKeys.getEntry(0)
 	lastKey := b.tmpKeys.getLast()
 	blockCommonLen := keyDiffIdx(firstKey, lastKey)
+	var prevDiffKey []byte
 	for i := 0; i < b.tmpKeys.length(); i++ {
-		key := b.tmpKeys.getEntry(i)
-		b.buf = appendU16(b.buf, uint16(len(key)-blockCommonLen))
-		b.buf = append(b.buf, key[blockCommonLen:]...)
+		diffKey := b.tmpKeys.getEntry(i)[blockCommonLen:]
+		if b.opt.RestartInterval > 1 {
+			var shared int
+			if i%b.opt.RestartInterval != 0 {
+				shared = keyDiffIdx(prevDiffKey, diffKey)
+			}
+			prevDiffKey = diffKey
+			b.buf = appendU16(b.buf, uint16(shared))
+			diffKey = diffKey[shared:]
+		}
+		b.buf = appendU16(b.buf, uint16(len(diffKey)))
+		b.buf = append(b.buf, diffKey...)
 		if b.tmpOldOffs[i] == 0 {
 			b.buf = append(b.buf, 0)
 		} else {
@@ -307,14 +480,9 @@ func (b *Builder) finishBlock() error {
 	// Add base key.
 	b.baseKeys.append(firstKey)
 
-	before := b.w.Offset()
-	if err := b.compression.Compress(b.w, b.buf); err != nil {
+	if err := b.writeBlock(); err != nil {
 		return err
 	}
-	size := b.w.Offset() - before
-	b.blockEndOffsets = append(b.blockEndOffsets, uint32(b.writtenLen+int(size)))
-	b.writtenLen += int(size)
-	b.rawWrittenLen += len(b.buf)
 
 	// Reset the block for the next build.
 	b.entryEndOffsets = b.entryEndOffsets[:0]
@@ -326,6 +494,45 @@ func (b *Builder) finishBlock() error {
 	return nil
 }
 
+// minCompressionGain is the minimum fraction of size a compressed block must save, otherwise the
+// block is considered incompressible and stored raw to save the decompression cost on read.
+const minCompressionGain = 8
+
+// writeBlock compresses the block in b.buf and writes it out. Blocks that don't compress well are
+// written without compression.
+func (b *Builder) writeBlock() error {
+	data := b.buf
+	compression := b.compression
+	if compression != options.None {
+		b.compressBuf.Reset()
+		if err := compression.Compress(&b.compressBuf, b.buf); err != nil {
+			return err
+		}
+		if b.compressBuf.Len() <= len(b.buf)-len(b.buf)/minCompressionGain {
+			data = b.compressBuf.Bytes()
+		} else {
+			compression = options.None
+			b.hasRawBlock = true
+		}
+	}
+	if b.dataKey != nil {
+		var err error
+		if b.encryptBuf, err = encryptBlock(b.encryptBuf, data, b.dataKey); err != nil {
+			return err
+		}
+		data = b.encryptBuf
+	}
+	if _, err := b.w.Write(data); err != nil {
+		return err
+	}
+	b.blockCompression = append(b.blockCompression, byte(compression))
+	b.blockChecksums = append(b.blockChecksums, crc32.Checksum(data, y.CastagnoliCrcTable))
+	b.blockEndOffsets = append(b.blockEndOffsets, uint32(b.writtenLen+len(data)))
+	b.writtenLen += len(data)
+	b.rawWrittenLen += len(b.buf)
+	return nil
+}
+
 // Add adds a key-value pair to the block.
 // If doNotRestart is true, we will not restart even if b.counter >= restartInterval.
 func (b *Builder) Add(key y.Key, value y.ValueStruct) error {
@@ -393,8 +600,23 @@ const (
 	idHashIndex
 	idSuRFIndex
 	idOldBlockLen
+	idBlockCompression
+	idProperties
+	idBlockedBloomFilter
+	idPartitionBaseKeysEndOffs
+	idPartitionBaseKeys
+	idPartitionBlocks
+	idPartitionOffsets
+	idEntryStats
+	idBlockChecksums
+	idRestartInterval
+	idValueFormat
 )
 
+// valueFormatVarint is recorded by idValueFormat if the values are encoded by
+// y.ValueStruct.EncodeVarintTo, the values of the tables without it are encoded by EncodeTo.
+const valueFormatVarint uint32 = 2
+
 // BuildResult contains the build result info, if it's file based compaction, fileName should be used to open Table.
 // If it's in memory compaction, FileData and IndexData contains the data.
 type BuildResult struct {
@@ -409,8 +631,24 @@ func (b *Builder) Finish() (*BuildResult, error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(b.oldBlock) > 1 {
-		_, err = b.w.Write(b.oldBlock)
+	var parts *partitionsBuilder
+	if b.opt.IndexPartitionSize > 0 && 8*len(b.blockEndOffsets)+len(b.baseKeys.data) > b.opt.IndexPartitionSize {
+		if parts, err = b.writeIndexPartitions(); err != nil {
+			return nil, err
+		}
+	}
+	oldBlockLen := len(b.oldBlock)
+	if oldBlockLen > 1 {
+		oldBlock := b.oldBlock
+		if b.dataKey != nil {
+			if b.encryptBuf, err = encryptBlock(b.encryptBuf, oldBlock, b.dataKey); err != nil {
+				return nil, err
+			}
+			oldBlock = b.encryptBuf
+			oldBlockLen = len(oldBlock)
+		}
+		b.blockChecksums = append(b.blockChecksums, crc32.Checksum(oldBlock, y.CastagnoliCrcTable))
+		_, err = b.w.Write(oldBlock)
 		if err != nil {
 			return nil, err
 		}
@@ -420,7 +658,12 @@ func (b *Builder) Finish() (*BuildResult, error) {
 	}
 	result := new(BuildResult)
 	if b.file != nil {
-		idxFile, err := y.OpenTruncFile(IndexFilename(b.file.Name()), false)
+		var idxFile *os.File
+		if b.opt.DirectIO {
+			idxFile, err = directio.OpenFile(IndexFilename(b.file.Name()), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+		} else {
+			idxFile, err = y.OpenTruncFile(IndexFilename(b.file.Name()), false)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -438,18 +681,41 @@ func (b *Builder) Finish() (*BuildResult, error) {
 		ts = 1
 	}
 
-	encoder := newMetaEncoder(b.buf, b.compression, ts)
+	encoder := newMetaEncoder(b.buf, b.compression, ts, b.dataKey)
 	encoder.append(b.smallest.UserKey, idSmallest)
 	encoder.append(b.biggest.UserKey, idBiggest)
-	encoder.append(u32SliceToBytes(b.baseKeys.endOffs), idBaseKeysEndOffs)
-	encoder.append(b.baseKeys.data, idBaseKeys)
-	encoder.append(u32SliceToBytes(b.blockEndOffsets), idBlockEndOffsets)
+	if parts != nil {
+		encoder.append(u32SliceToBytes(parts.baseKeys.endOffs), idPartitionBaseKeysEndOffs)
+		encoder.append(parts.baseKeys.data, idPartitionBaseKeys)
+		encoder.append(u32SliceToBytes(parts.firstBlocks), idPartitionBlocks)
+		encoder.append(u32SliceToBytes(parts.offsets), idPartitionOffsets)
+	} else {
+		encoder.append(u32SliceToBytes(b.baseKeys.endOffs), idBaseKeysEndOffs)
+		encoder.append(b.baseKeys.data, idBaseKeys)
+		encoder.append(u32SliceToBytes(b.blockEndOffsets), idBlockEndOffsets)
+	}
 	if len(b.oldBlock) > 1 {
-		encoder.append(u32ToBytes(uint32(len(b.oldBlock))), idOldBlockLen)
+		encoder.append(u32ToBytes(uint32(oldBlockLen)), idOldBlockLen)
+	}
+	if b.hasRawBlock && parts == nil {
+		encoder.append(b.blockCompression, idBlockCompression)
+	}
+	if b.propsCollector != nil {
+		encoder.append(encodeProperties(b.propsCollector.Finish()), idProperties)
+	}
+	encoder.append(encodeEntryStats(&b.entryStats), idEntryStats)
+	encoder.append(u32SliceToBytes(b.blockChecksums), idBlockChecksums)
+	if b.opt.RestartInterval > 1 {
+		encoder.append(u32ToBytes(uint32(b.opt.RestartInterval)), idRestartInterval)
+	}
+	if b.opt.VarintValue {
+		encoder.append(u32ToBytes(valueFormatVarint), idValueFormat)
 	}
 
 	var bloomFilter []byte
-	if !b.useSuRF {
+	if !b.useSuRF && b.opt.FilterPolicy == options.BlockedBloomFilter {
+		encoder.append(buildBlockedBloom(b.hashEntries, b.bloomFpr), idBlockedBloomFilter)
+	} else if !b.useSuRF {
 		bf := bbloom.New(float64(len(b.hashEntries)), b.bloomFpr)
 		for _, he := range b.hashEntries {
 			bf.Add(he.hash)
@@ -465,11 +731,8 @@ func (b *Builder) Finish() (*BuildResult, error) {
 	encoder.append(hashIndex, idHashIndex)
 
 	var surfIndex []byte
-	if b.useSuRF && len(b.surfKeys) > 0 {
-		hl := uint32(b.opt.SuRFOptions.HashSuffixLen)
-		rl := uint32(b.opt.SuRFOptions.RealSuffixLen)
-		sb := surf.NewBuilder(3, hl, rl)
-		sf := sb.Build(b.surfKeys, b.surfVals, b.opt.SuRFOptions.BitsPerKeyHint)
+	if b.useSuRF && b.surfBuilder != nil {
+		sf := b.surfBuilder.Finish(b.opt.SuRFOptions.BitsPerKeyHint)
 		surfIndex = sf.Marshal()
 	}
 	encoder.append(surfIndex, idSuRFIndex)
@@ -487,6 +750,143 @@ func (b *Builder) Finish() (*BuildResult, error) {
 	return result, nil
 }
 
+// partitionsBuilder is the top-level index of the partitions written by writeIndexPartitions.
+type partitionsBuilder struct {
+	baseKeys    entrySlice
+	firstBlocks []uint32
+	offsets     []uint32
+}
+
+// writeIndexPartitions splits the block index into partitions of about IndexPartitionSize and
+// writes them after the blocks, so a large table doesn't need to load the whole block index.
+//
+// partition format, encoded like the meta entries:
+//
+//	idBlockEndOffsets: startOffset | blockEndOffsets
+//	idBaseKeysEndOffs | idBaseKeys | idBlockCompression (if the table has raw blocks)
+func (b *Builder) writeIndexPartitions() (*partitionsBuilder, error) {
+	parts := &partitionsBuilder{
+		firstBlocks: []uint32{0},
+		offsets:     []uint32{uint32(b.writtenLen)},
+	}
+	numBlocks := len(b.blockEndOffsets)
+	var partBuf []byte
+	for first := 0; first < numBlocks; {
+		end, size := first, 0
+		for end < numBlocks && size < b.opt.IndexPartitionSize {
+			size += 8 + len(b.baseKeys.getEntry(end))
+			end++
+		}
+		var startOffset uint32
+		if first > 0 {
+			startOffset = b.blockEndOffsets[first-1]
+		}
+		var baseKeys entrySlice
+		for i := first; i < end; i++ {
+			baseKeys.append(b.baseKeys.getEntry(i))
+		}
+		e := &metaEncoder{buf: partBuf[:0]}
+		e.append(u32SliceToBytes(append([]uint32{startOffset}, b.blockEndOffsets[first:end]...)), idBlockEndOffsets)
+		e.append(u32SliceToBytes(baseKeys.endOffs), idBaseKeysEndOffs)
+		e.append(baseKeys.data, idBaseKeys)
+		if b.hasRawBlock {
+			e.append(b.blockCompression[first:end], idBlockCompression)
+		}
+		partBuf = e.buf
+		data := partBuf
+		if b.dataKey != nil {
+			var err error
+			if b.encryptBuf, err = encryptBlock(b.encryptBuf, data, b.dataKey); err != nil {
+				return nil, err
+			}
+			data = b.encryptBuf
+		}
+		if _, err := b.w.Write(data); err != nil {
+			return nil, err
+		}
+		b.writtenLen += len(data)
+		parts.baseKeys.append(b.baseKeys.getEntry(first))
+		parts.firstBlocks = append(parts.firstBlocks, uint32(end))
+		parts.offsets = append(parts.offsets, uint32(b.writtenLen))
+		first = end
+	}
+	return parts, nil
+}
+
+// properties format, sorted by name:
+//
+//	nameLen(2) | name | valueLen(4) | value
+func encodeProperties(props map[string][]byte) []byte {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf []byte
+	for _, name := range names {
+		buf = appendU16(buf, uint16(len(name)))
+		buf = append(buf, name...)
+		buf = append(buf, u32ToBytes(uint32(len(props[name])))...)
+		buf = append(buf, props[name]...)
+	}
+	return buf
+}
+
+// entryStats format:
+//
+//	numEntries(8) | numDeletes(8) | minVersion(8) | maxVersion(8) | numKeys(8)
+func encodeEntryStats(stats *table.EntryStats) []byte {
+	buf := make([]byte, 0, 40)
+	buf = append(buf, u64ToBytes(stats.NumEntries)...)
+	buf = append(buf, u64ToBytes(stats.NumDeletes)...)
+	buf = append(buf, u64ToBytes(stats.MinVersion)...)
+	buf = append(buf, u64ToBytes(stats.MaxVersion)...)
+	return append(buf, u64ToBytes(stats.NumKeys)...)
+}
+
+func decodeEntryStats(buf []byte) (table.EntryStats, error) {
+	if len(buf) < 32 {
+		return table.EntryStats{}, errors.Errorf("entry stats length %d is less than 32", len(buf))
+	}
+	stats := table.EntryStats{
+		NumEntries: bytesToU64(buf),
+		NumDeletes: bytesToU64(buf[8:]),
+		MinVersion: bytesToU64(buf[16:]),
+		MaxVersion: bytesToU64(buf[24:]),
+	}
+	// The stats written before numKeys was recorded have no numKeys.
+	stats.NumKeys = stats.NumEntries
+	if len(buf) >= 40 {
+		stats.NumKeys = bytesToU64(buf[32:])
+	}
+	return stats, nil
+}
+
+// errCorruptProperties is returned by decodeProperties if a length exceeds the properties.
+var errCorruptProperties = errors.New("corrupt table properties")
+
+func decodeProperties(buf []byte) (map[string][]byte, error) {
+	props := make(map[string][]byte)
+	for len(buf) > 0 {
+		if len(buf) < 2 {
+			return nil, errCorruptProperties
+		}
+		nameLen := int(binary.LittleEndian.Uint16(buf))
+		if len(buf) < 2+nameLen+4 {
+			return nil, errCorruptProperties
+		}
+		name := string(buf[2 : 2+nameLen])
+		buf = buf[2+nameLen:]
+		valLen := uint64(bytesToU32(buf))
+		if uint64(len(buf)-4) < valLen {
+			return nil, errCorruptProperties
+		}
+		props[name] = y.Copy(buf[4 : 4+valLen])
+		buf = buf[4+valLen:]
+	}
+	return props, nil
+}
+
 func appendU16(buf []byte, v uint16) []byte {
 	return append(buf, byte(v), byte(v>>8))
 }
@@ -535,17 +935,81 @@ func bytesToU64(b []byte) uint64 {
 	return binary.LittleEndian.Uint64(b)
 }
 
+// encryptBlock encrypts data with the data key into buf, the random IV is appended to the result.
+func encryptBlock(buf, data []byte, key *options.DataKey) ([]byte, error) {
+	iv, err := y.GenerateIV()
+	if err != nil {
+		return nil, err
+	}
+	buf = y.SafeCopy(buf, data)
+	if err = y.XORBlock(buf, buf, key.Key, iv); err != nil {
+		return nil, err
+	}
+	return append(buf, iv...), nil
+}
+
+// decryptBlock decrypts the data encrypted by encryptBlock, the result is allocated from the
+// buffer pool.
+func decryptBlock(data []byte, key *options.DataKey) ([]byte, error) {
+	if len(data) < y.IVSize {
+		return nil, errors.New("encrypted block is too short")
+	}
+	n := len(data) - y.IVSize
+	buf := buffer.GetBuffer(n)
+	if err := y.XORBlock(buf, data[:n], key.Key, data[n:]); err != nil {
+		buffer.PutBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
+
+// metaEncrypted is set in the compression byte of the index header if the index is encrypted.
+// The encrypted index format is:
+//
+//	globalTS(8) | compression(1) | keyID(8) | encrypted meta | iv(16)
+const metaEncrypted byte = 1 << 7
+
+// The index is followed by a footer since the format version 1:
+//
+//	checksum(4) | version(4) | magic(8)
+//
+// The checksum is the crc32c of the index after the global ts, because the global ts is updated in
+// place on ingest. The index written before the footer was added is read without the checks.
+const (
+	metaHeaderSize    = 9
+	metaFooterSize    = 16
+	metaFooterVersion = 1
+	metaFooterMagic   = 0x6261646765725453
+)
+
+// InvalidTableError is returned by OpenTable when the table is not a valid table written by
+// badger, it is usually caused by a truncated, corrupted or foreign file.
+type InvalidTableError struct {
+	Filename string
+	Reason   string
+}
+
+func (e *InvalidTableError) Error() string {
+	return fmt.Sprintf("invalid table %s: %s", e.Filename, e.Reason)
+}
+
 type metaEncoder struct {
 	buf         []byte
 	compression options.CompressionType
+	dataKey     *options.DataKey
 }
 
-func newMetaEncoder(buf []byte, compression options.CompressionType, globalTS uint64) *metaEncoder {
+func newMetaEncoder(buf []byte, compression options.CompressionType, globalTS uint64, dataKey *options.DataKey) *metaEncoder {
 	buf = append(buf, u64ToBytes(globalTS)...)
-	buf = append(buf, byte(compression))
+	flag := byte(compression)
+	if dataKey != nil {
+		flag |= metaEncrypted
+	}
+	buf = append(buf, flag)
 	return &metaEncoder{
 		buf:         buf,
 		compression: compression,
+		dataKey:     dataKey,
 	}
 }
 
@@ -556,41 +1020,135 @@ func (e *metaEncoder) append(d []byte, id byte) {
 }
 
 func (e *metaEncoder) finish(w tableWriter) error {
-	if e.compression == options.None {
-		_, err := w.Write(e.buf)
-		return err
+	data := e.buf
+	if e.compression != options.None || e.dataKey != nil {
+		var err error
+		if data, err = e.encode(); err != nil {
+			return err
+		}
 	}
+	_, err := w.Write(appendMetaFooter(data))
+	return err
+}
 
-	if _, err := w.Write(e.buf[:9]); err != nil {
-		return err
+// encode compresses and encrypts the meta after the header.
+func (e *metaEncoder) encode() ([]byte, error) {
+	data := append([]byte{}, e.buf[:metaHeaderSize]...)
+	meta := e.buf[metaHeaderSize:]
+	if e.compression != options.None {
+		compressed := new(bytes.Buffer)
+		if err := e.compression.Compress(compressed, meta); err != nil {
+			return nil, err
+		}
+		meta = compressed.Bytes()
+	}
+	if e.dataKey == nil {
+		return append(data, meta...), nil
+	}
+	data = append(data, u64ToBytes(e.dataKey.ID)...)
+	encrypted, err := encryptBlock(nil, meta, e.dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, encrypted...), nil
+}
+
+func appendMetaFooter(buf []byte) []byte {
+	buf = append(buf, u32ToBytes(crc32.Checksum(buf[8:], y.CastagnoliCrcTable))...)
+	buf = append(buf, u32ToBytes(metaFooterVersion)...)
+	return append(buf, u64ToBytes(metaFooterMagic)...)
+}
+
+// checkMetaFooter verifies the footer of the index and returns the index without the footer.
+func checkMetaFooter(buf []byte) ([]byte, error) {
+	if len(buf) < metaHeaderSize {
+		return nil, &InvalidTableError{Reason: fmt.Sprintf("index size %d is too small", len(buf))}
+	}
+	if len(buf) < metaHeaderSize+metaFooterSize || bytesToU64(buf[len(buf)-8:]) != metaFooterMagic {
+		// The index is written before the footer was added.
+		return buf, nil
 	}
-	return e.compression.Compress(w, e.buf[9:])
+	footer := buf[len(buf)-metaFooterSize:]
+	buf = buf[:len(buf)-metaFooterSize]
+	if version := bytesToU32(footer[4:]); version > metaFooterVersion {
+		return nil, &InvalidTableError{Reason: fmt.Sprintf("format version %d is newer than supported version %d",
+			version, metaFooterVersion)}
+	}
+	if crc32.Checksum(buf[8:], y.CastagnoliCrcTable) != bytesToU32(footer) {
+		return nil, &InvalidTableError{Reason: "index checksum mismatch"}
+	}
+	return buf, nil
 }
 
 type metaDecoder struct {
 	buf         []byte
 	globalTS    uint64
 	compression options.CompressionType
+	dataKey     *options.DataKey
 
 	cursor int
 }
 
-func newMetaDecoder(buf []byte) (*metaDecoder, error) {
+func newMetaDecoder(buf []byte, registry options.KeyRegistry) (*metaDecoder, error) {
+	buf, err := checkMetaFooter(buf)
+	if err != nil {
+		return nil, err
+	}
 	globalTS := bytesToU64(buf[:8])
-	compression := options.CompressionType(buf[8])
-	buf = buf[9:]
+	flag := buf[8]
+	compression := options.CompressionType(flag &^ metaEncrypted)
+	if compression > options.LZ4 {
+		return nil, &InvalidTableError{Reason: fmt.Sprintf("unknown index compression %d", compression)}
+	}
+	buf = buf[metaHeaderSize:]
+	var dataKey *options.DataKey
+	if flag&metaEncrypted != 0 {
+		if registry == nil {
+			return nil, errors.New("table is encrypted but no key registry is provided")
+		}
+		if len(buf) < 8 {
+			return nil, &InvalidTableError{Reason: "encrypted index is too short"}
+		}
+		if dataKey, err = registry.DataKey(bytesToU64(buf)); err != nil {
+			return nil, err
+		}
+		if buf, err = decryptBlock(buf[8:], dataKey); err != nil {
+			return nil, err
+		}
+	}
 	if compression != options.None {
 		buf1, err := compression.Decompress(buf)
 		if err != nil {
-			return nil, err
+			return nil, &InvalidTableError{Reason: fmt.Sprintf("failed to decompress index: %v", err)}
 		}
 		buf = buf1
 	}
-	return &metaDecoder{
+	d := &metaDecoder{
 		buf:         buf,
 		globalTS:    globalTS,
 		compression: compression,
-	}, nil
+		dataKey:     dataKey,
+	}
+	if err = d.check(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// check verifies the entries are in the bounds of the buffer, so a corrupted index without the
+// footer doesn't cause a panic.
+func (e *metaDecoder) check() error {
+	for cursor := 0; cursor < len(e.buf); {
+		if len(e.buf)-cursor < 5 {
+			return &InvalidTableError{Reason: fmt.Sprintf("truncated index entry at %d", cursor)}
+		}
+		l := int64(bytesToU32(e.buf[cursor+1:]))
+		if int64(len(e.buf)-cursor-5) < l {
+			return &InvalidTableError{Reason: fmt.Sprintf("index entry at %d with length %d is out of bounds", cursor, l)}
+		}
+		cursor += 5 + int(l)
+	}
+	return nil
 }
 
 func (e *metaDecoder) valid() bool {
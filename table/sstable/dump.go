@@ -0,0 +1,143 @@
+/*
+ * Copyright 2017 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package sstable
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Dump opens the table of the config and prints its file layout, its index, the key range, the
+// versions and the compression ratio of every block and the key statistics to w. The table owns
+// the files of the config and is closed before Dump returns. A block which fails the checksum or
+// can't be read is reported in its line and skipped, so a corrupted table is dumped entirely.
+func Dump(w io.Writer, cfg *OpenTableConfig) error {
+	t, err := OpenTableWithConfig(*cfg)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	idx, err := t.getIndex()
+	if err != nil {
+		return err
+	}
+	indexSize, err := t.indexFd.Size()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Table %s\n", t.fd.Name())
+	fmt.Fprintf(w, "  ID:          %d\n", t.id)
+	fmt.Fprintf(w, "  Size:        %d\n", t.tableSize)
+	fmt.Fprintf(w, "  Old block:   %d\n", t.oldBlockLen)
+	fmt.Fprintf(w, "  Compression: %s\n", t.compression)
+	fmt.Fprintf(w, "  Global ts:   %d\n", t.globalTs)
+	fmt.Fprintf(w, "  Smallest:    %q\n", t.smallest.UserKey)
+	fmt.Fprintf(w, "  Biggest:     %q\n", t.biggest.UserKey)
+	names := make([]string, 0, len(t.properties))
+	for name := range t.properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  Property %q: %q\n", name, t.properties[name])
+	}
+	fmt.Fprintf(w, "Index %s\n", t.indexFd.Name())
+	fmt.Fprintf(w, "  Size:        %d\n", indexSize)
+	fmt.Fprintf(w, "  Blocks:      %d\n", idx.numBlocks())
+	fmt.Fprintf(w, "  Bloom:       %v\n", idx.bf != nil || idx.bbf != nil)
+	fmt.Fprintf(w, "  Hash index:  %v\n", idx.hIdx != nil)
+	if idx.surf != nil {
+		fmt.Fprintf(w, "  SuRF:        %d bytes\n", idx.surf.MarshalSize())
+	} else {
+		fmt.Fprintf(w, "  SuRF:        false\n")
+	}
+	if idx.partitions != nil {
+		fmt.Fprintf(w, "  Partitions:  %d\n", len(idx.partitions.loaded))
+	}
+
+	var dataSize, rawSize, keys, versions, badBlocks int
+	// The old versions are not counted if the old block is corrupted.
+	oldBlockValid := true
+	if t.oldBlockLen > 0 && len(t.blockChecksums) > idx.numBlocks() {
+		err = t.verifyBlockChecksum(int(t.tableSize-t.oldBlockLen), int(t.oldBlockLen), t.blockChecksums[idx.numBlocks()])
+		if err != nil {
+			fmt.Fprintf(w, "Old block error: %v\n", err)
+			oldBlockValid = false
+			badBlocks++
+		}
+	}
+	minVersion, maxVersion := uint64(math.MaxUint64), uint64(0)
+	it := t.newIteratorWithIdx(false, idx)
+	defer it.Close()
+	for i := 0; i < idx.numBlocks(); i++ {
+		part, j, err := t.blockPartition(i, idx)
+		if err != nil {
+			fmt.Fprintf(w, "Block %d error: %v\n", i, err)
+			badBlocks++
+			continue
+		}
+		startOffset, endOffset := part.blockOffsets(j)
+		size := int(endOffset - startOffset)
+		if t.blockChecksums != nil {
+			err = t.verifyBlockChecksum(int(startOffset), size, t.blockChecksums[i])
+		}
+		var blk *block
+		if err == nil {
+			blk, err = t.block(i, idx)
+		}
+		if err != nil {
+			fmt.Fprintf(w, "Block %d offset %d size %d error: %v\n", i, startOffset, size, err)
+			badBlocks++
+			continue
+		}
+		dataSize += size
+		rawSize += len(blk.data)
+		compression := part.blockCompressionType(j, t.compression)
+		it.bi.setBlock(blk)
+		var blockVersions int
+		for it.bi.seekToFirst(); it.bi.valid(); it.bi.next() {
+			keys++
+			for {
+				blockVersions++
+				version := it.Key().Version
+				if version < minVersion {
+					minVersion = version
+				}
+				if version > maxVersion {
+					maxVersion = version
+				}
+				if !oldBlockValid || !it.NextVersion() {
+					break
+				}
+			}
+		}
+		versions += blockVersions
+		fmt.Fprintf(w, "Block %d offset %d size %d raw %d ratio %.3f %s entries %d versions %d [%q, %q]\n",
+			i, startOffset, size, len(blk.data), float64(size)/float64(len(blk.data)), compression,
+			blk.entries.length(), blockVersions, blk.baseKey, it.Key().UserKey)
+	}
+	fmt.Fprintf(w, "Blocks raw size %d, compression ratio %.3f, bad blocks %d\n",
+		rawSize, float64(dataSize)/float64(rawSize), badBlocks)
+	if keys == 0 {
+		minVersion = 0
+	}
+	fmt.Fprintf(w, "Keys %d, versions %d, version range [%d, %d]\n", keys, versions, minVersion, maxVersion)
+	return nil
+}
@@ -0,0 +1,140 @@
+package sstable
+
+import (
+	"io"
+	"os"
+
+	"github.com/pingcap/badger/fileutil"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+)
+
+// TableFile is the storage of the data file or the index file of a table, so the tables can be
+// served from other storages than the local file system.
+type TableFile interface {
+	io.ReaderAt
+	// Name returns the name of the file used in the errors.
+	Name() string
+	// Size returns the size of the file.
+	Size() (int64, error)
+	// Sync makes the data written to the file durable.
+	Sync() error
+	// Close releases the file, the data is kept in the storage.
+	Close() error
+	// Delete closes the file and removes the data from the storage.
+	Delete() error
+}
+
+// LocalFile is a TableFile in the local file system, it is the storage of the tables opened by
+// OpenTable. The local files are mapped into memory instead of read if the table loading mode
+// needs the data in memory.
+type LocalFile struct {
+	*os.File
+}
+
+// OpenLocalFile opens the existing file as a TableFile.
+func OpenLocalFile(filename string) (*LocalFile, error) {
+	fd, err := y.OpenExistingFile(filename, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalFile{File: fd}, nil
+}
+
+// Size implements TableFile.
+func (f *LocalFile) Size() (int64, error) {
+	fstat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fstat.Size(), nil
+}
+
+// Sync implements TableFile, only the data is synced as the tables are not resized in place.
+func (f *LocalFile) Sync() error {
+	return fileutil.Fdatasync(f.File)
+}
+
+// Delete implements TableFile.
+func (f *LocalFile) Delete() error {
+	if err := f.Truncate(0); err != nil {
+		// This is very important to let the FS know that the file is deleted.
+		return err
+	}
+	filename := f.Name()
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// MemFile is a TableFile in memory, it can be used to open the tables of test fixtures.
+type MemFile struct {
+	name string
+	data []byte
+}
+
+// NewMemFile returns a MemFile of data, the data is written in place by Table.SetGlobalTs.
+func NewMemFile(name string, data []byte) *MemFile {
+	return &MemFile{name: name, data: data}
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *MemFile) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.Errorf("negative offset %d", off)
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt implements io.WriterAt, the file is not extended.
+func (f *MemFile) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > int64(len(f.data)) {
+		return 0, errors.Errorf("write of %d bytes at offset %d is out of file %s", len(b), off, f.name)
+	}
+	return copy(f.data[off:], b), nil
+}
+
+// Name implements TableFile.
+func (f *MemFile) Name() string { return f.name }
+
+// Size implements TableFile.
+func (f *MemFile) Size() (int64, error) { return int64(len(f.data)), nil }
+
+// Sync implements TableFile.
+func (f *MemFile) Sync() error { return nil }
+
+// Close implements TableFile.
+func (f *MemFile) Close() error { return nil }
+
+// Delete implements TableFile.
+func (f *MemFile) Delete() error {
+	f.data = nil
+	return nil
+}
+
+// mapFile maps the local file into memory, the other files are read into memory.
+func mapFile(f TableFile, size int64) ([]byte, error) {
+	if lf, ok := f.(*LocalFile); ok {
+		return y.Mmap(lf.File, false, size)
+	}
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// unmapFile releases the data returned by mapFile.
+func unmapFile(f TableFile, data []byte) {
+	if _, ok := f.(*LocalFile); ok {
+		y.Munmap(data)
+	}
+}
@@ -18,12 +18,18 @@ package sstable
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
 	"math"
+	"os"
 	"sort"
+	"sync"
 
+	"github.com/ncw/directio"
+	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/surf"
+	"github.com/pingcap/badger/table"
 	"github.com/pingcap/badger/y"
 )
 
@@ -78,6 +84,13 @@ type blockIterator struct {
 	baseLen uint16
 	ski     singleKeyIterator
 
+	// restartInterval is larger than 1 if the keys are stored after the prefix shared with the
+	// previous key, keyIdx is the index of the entry whose key is decoded in key.
+	restartInterval int
+	keyIdx          int
+	// varintValue is true if the values are encoded by y.ValueStruct.EncodeVarintTo.
+	varintValue bool
+
 	block *block
 }
 
@@ -88,8 +101,19 @@ func (itr *blockIterator) setBlock(b *block) {
 	itr.idx = 0
 	itr.key.Reset()
 	itr.val = itr.val[:0]
-	itr.loadEntries(b.data)
+	itr.entries = b.entries
+	itr.baseLen = b.baseLen
 	itr.key.UserKey = append(itr.key.UserKey[:0], b.baseKey[:itr.baseLen]...)
+	itr.restartInterval = b.restartInterval
+	itr.varintValue = b.varintValue
+	itr.keyIdx = -1
+}
+
+// resetBlock rewinds the iterator within the block it currently holds.
+func (itr *blockIterator) resetBlock() {
+	itr.err = nil
+	itr.idx = 0
+	itr.entries = itr.block.entries
 }
 
 func (itr *blockIterator) valid() bool {
@@ -100,28 +124,108 @@ func (itr *blockIterator) Error() error {
 	return itr.err
 }
 
-// loadEntries loads the entryEndOffsets for binary searching for a key.
-func (itr *blockIterator) loadEntries(data []byte) {
-	// Get the number of entries from the end of `data` (and remove it).
-	dataLen := len(data)
-	itr.baseLen = binary.LittleEndian.Uint16(data[dataLen-2:])
-	entriesNum := int(bytesToU32(data[dataLen-6:]))
-	entriesEnd := dataLen - 6
-	entriesStart := entriesEnd - entriesNum*4
-	itr.entries.endOffs = bytesToU32Slice(data[entriesStart:entriesEnd])
-	itr.entries.data = data[:entriesStart]
-}
-
 // Seek brings us to the first block element that is >= input key.
-// The binary search will begin at `start`, you can use it to skip some items.
+// All the keys in a block share the same prefix of baseLen bytes, so the prefix is compared
+// only once and the binary search compares the diff keys in place without building the full key.
 func (itr *blockIterator) seek(key []byte) {
+	prefix := itr.block.baseKey[:itr.baseLen]
+	if len(key) < len(prefix) || !bytes.Equal(key[:len(prefix)], prefix) {
+		if bytes.Compare(key, prefix) < 0 {
+			itr.setIdx(0)
+		} else {
+			itr.setIdx(itr.entries.length())
+		}
+		return
+	}
+	diffKey := key[len(prefix):]
+	if itr.restartInterval > 1 {
+		itr.setIdx(itr.searchRestarts(diffKey, 0))
+		return
+	}
 	foundEntryIdx := sort.Search(itr.entries.length(), func(idx int) bool {
-		itr.setIdx(idx)
-		return bytes.Compare(itr.key.UserKey, key) >= 0
+		return bytes.Compare(itr.diffKey(idx), diffKey) >= 0
+	})
+	itr.setIdx(foundEntryIdx)
+}
+
+// seekForward brings us to the first block element that is >= input key, only the elements from the
+// current one are searched as the key is not less than the current key.
+func (itr *blockIterator) seekForward(key []byte) {
+	if itr.restartInterval > 1 {
+		itr.seek(key)
+		return
+	}
+	prefix := itr.block.baseKey[:itr.baseLen]
+	if !bytes.HasPrefix(key, prefix) {
+		// The key is greater than the current key, so it is greater than all the keys with the prefix.
+		itr.setIdx(itr.entries.length())
+		return
+	}
+	diffKey := key[len(prefix):]
+	start := itr.idx
+	foundEntryIdx := start + sort.Search(itr.entries.length()-start, func(i int) bool {
+		return bytes.Compare(itr.diffKey(start+i), diffKey) >= 0
 	})
 	itr.setIdx(foundEntryIdx)
 }
 
+// seekForPrev brings us to the last block element that is <= input key.
+func (itr *blockIterator) seekForPrev(key []byte) {
+	prefix := itr.block.baseKey[:itr.baseLen]
+	if len(key) < len(prefix) || !bytes.Equal(key[:len(prefix)], prefix) {
+		if bytes.Compare(key, prefix) < 0 {
+			itr.setIdx(-1)
+		} else {
+			itr.setIdx(itr.entries.length() - 1)
+		}
+		return
+	}
+	diffKey := key[len(prefix):]
+	if itr.restartInterval > 1 {
+		itr.setIdx(itr.searchRestarts(diffKey, 1) - 1)
+		return
+	}
+	foundEntryIdx := sort.Search(itr.entries.length(), func(idx int) bool {
+		return bytes.Compare(itr.diffKey(idx), diffKey) > 0
+	})
+	itr.setIdx(foundEntryIdx - 1)
+}
+
+// searchRestarts returns the index of the first entry whose diff key compares to diffKey greater
+// than or equal to cmp. The restart points are binary searched, then the keys between two restart
+// points are decoded one by one.
+func (itr *blockIterator) searchRestarts(diffKey []byte, cmp int) int {
+	numEntries := itr.entries.length()
+	numRestarts := (numEntries + itr.restartInterval - 1) / itr.restartInterval
+	r := sort.Search(numRestarts, func(r int) bool {
+		entryData := itr.entries.getEntry(r * itr.restartInterval)
+		diffKeyLen := binary.LittleEndian.Uint16(entryData[2:])
+		return bytes.Compare(entryData[4:4+diffKeyLen], diffKey) >= cmp
+	})
+	if r == 0 {
+		return 0
+	}
+	end := r * itr.restartInterval
+	if end > numEntries {
+		end = numEntries
+	}
+	i := (r - 1) * itr.restartInterval
+	for ; i < end; i++ {
+		itr.decodeKey(i)
+		if bytes.Compare(itr.key.UserKey[itr.baseLen:], diffKey) >= cmp {
+			break
+		}
+	}
+	return i
+}
+
+// diffKey returns the part of the i-th entry key after the common prefix of the block.
+func (itr *blockIterator) diffKey(i int) []byte {
+	entryData := itr.entries.getEntry(i)
+	diffKeyLen := binary.LittleEndian.Uint16(entryData)
+	return entryData[2 : 2+diffKeyLen]
+}
+
 // seekToFirst brings us to the first element. Valid should return true.
 func (itr *blockIterator) seekToFirst() {
 	itr.setIdx(0)
@@ -140,11 +244,16 @@ func (itr *blockIterator) setIdx(i int) {
 		return
 	}
 	itr.err = nil
-	entryData := itr.entries.getEntry(i)
-	diffKeyLen := binary.LittleEndian.Uint16(entryData)
-	entryData = entryData[2:]
-	itr.key.UserKey = append(itr.key.UserKey[:itr.baseLen], entryData[:diffKeyLen]...)
-	entryData = entryData[diffKeyLen:]
+	var entryData []byte
+	if itr.restartInterval > 1 {
+		entryData = itr.decodeKey(i)
+	} else {
+		entryData = itr.entries.getEntry(i)
+		diffKeyLen := binary.LittleEndian.Uint16(entryData)
+		entryData = entryData[2:]
+		itr.key.UserKey = append(itr.key.UserKey[:itr.baseLen], entryData[:diffKeyLen]...)
+		entryData = entryData[diffKeyLen:]
+	}
 	hasOld := entryData[0] != 0
 	entryData = entryData[1:]
 	var oldOffset uint32
@@ -155,12 +264,50 @@ func (itr *blockIterator) setIdx(i int) {
 	if itr.globalTs != 0 {
 		itr.key.Version = itr.globalTs
 	} else {
-		itr.key.Version = bytesToU64(entryData)
+		itr.key.Version = itr.decodeVersion(entryData)
 	}
 	itr.val = entryData
 	itr.ski.set(oldOffset, itr.val)
 }
 
+// decodeKey decodes the key of the i-th entry from the nearest restart point, or from the decoded
+// key if it is between the restart point and the entry, and returns the rest of the entry.
+func (itr *blockIterator) decodeKey(i int) []byte {
+	start := i - i%itr.restartInterval
+	if itr.keyIdx > start && itr.keyIdx <= i {
+		start = itr.keyIdx
+	}
+	var entryData []byte
+	for j := start; j <= i; j++ {
+		entryData = itr.entries.getEntry(j)
+		sharedLen := binary.LittleEndian.Uint16(entryData)
+		diffKeyLen := binary.LittleEndian.Uint16(entryData[2:])
+		entryData = entryData[4:]
+		itr.key.UserKey = append(itr.key.UserKey[:int(itr.baseLen)+int(sharedLen)], entryData[:diffKeyLen]...)
+		entryData = entryData[diffKeyLen:]
+	}
+	itr.keyIdx = i
+	return entryData
+}
+
+// decodeVersion decodes the version at the beginning of the encoded value.
+func (itr *blockIterator) decodeVersion(val []byte) uint64 {
+	if itr.varintValue {
+		version, _ := binary.Uvarint(val)
+		return version
+	}
+	return bytesToU64(val)
+}
+
+// decodeValue decodes the encoded value into vs.
+func (itr *blockIterator) decodeValue(val []byte, vs *y.ValueStruct) {
+	if itr.varintValue {
+		vs.DecodeVarint(val)
+	} else {
+		vs.Decode(val)
+	}
+}
+
 func (itr *blockIterator) hasOldVersion() bool {
 	return itr.ski.oldOffset != 0
 }
@@ -175,6 +322,7 @@ func (itr *blockIterator) prev() {
 
 func (itr *blockIterator) close() {
 	itr.block.done()
+	itr.block = nil
 }
 
 // Iterator is an iterator for a Table.
@@ -189,6 +337,77 @@ type Iterator struct {
 	// Internally, Iterator is bidirectional. However, we only expose the
 	// unidirectional functionality for now.
 	reversed bool
+
+	// readahead is the number of blocks prefetched into the block cache when the iteration
+	// crosses a block boundary, raNext is the next block to prefetch in the iteration direction.
+	readahead int
+	raNext    int
+	raWg      sync.WaitGroup
+
+	// dio reads the blocks with O_DIRECT bypassing the block cache, it is nil if direct IO is not
+	// enabled.
+	dio *directReader
+
+	// tracer traces the block loads as the children of the span in ctx, it is nil if tracing is
+	// disabled.
+	ctx    context.Context
+	tracer options.Tracer
+}
+
+// directReader reads the blocks of a table with O_DIRECT, so the reads don't pollute the OS page
+// cache.
+type directReader struct {
+	fd *os.File
+}
+
+func (r *directReader) read(off, sz int) ([]byte, error) {
+	start := off &^ (directio.AlignSize - 1)
+	end := (off + sz + directio.AlignSize - 1) &^ (directio.AlignSize - 1)
+	buf := directio.AlignedBlock(end - start)
+	n, err := r.fd.ReadAt(buf, int64(start))
+	if n < off+sz-start {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf[off-start : off+sz-start], nil
+}
+
+// SetDirectIO implements table.DirectIOIterator. The blocks are read with O_DIRECT and are not
+// added to the block cache, the iterator keeps reading through the table if the file can't be
+// opened with O_DIRECT.
+func (itr *Iterator) SetDirectIO() {
+	t := itr.t
+	if itr.dio != nil || t == nil {
+		return
+	}
+	lf, ok := t.fd.(*LocalFile)
+	if !ok {
+		return
+	}
+	fd, err := directio.OpenFile(lf.Name(), os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	itr.dio = &directReader{fd: fd}
+}
+
+// block returns the block at idx.
+func (itr *Iterator) block(idx int) (*block, error) {
+	if itr.tracer != nil {
+		_, span := itr.tracer.Start(itr.ctx, "badger.block_load")
+		span.SetAttribute("table", itr.t.id)
+		span.SetAttribute("block", idx)
+		defer span.End()
+	}
+	if itr.dio == nil {
+		return itr.t.block(idx, itr.tIdx)
+	}
+	if idx >= itr.tIdx.numBlocks() {
+		return &block{}, io.EOF
+	}
+	return itr.t.loadBlockFrom(idx, itr.tIdx, itr.dio.read)
 }
 
 // NewIterator returns a new iterator of the Table
@@ -201,17 +420,129 @@ func (t *Table) newIterator(reversed bool) *Iterator {
 }
 
 func (t *Table) newIteratorWithIdx(reversed bool, index *tableIndex) *Iterator {
-	it := &Iterator{t: t, reversed: reversed, tIdx: index}
-	it.bi.globalTs = t.globalTs
+	it := new(Iterator)
+	it.init(t, reversed, index)
+	return it
+}
+
+func (itr *Iterator) init(t *Table, reversed bool, index *tableIndex) {
+	itr.t = t
+	itr.reversed = reversed
+	itr.tIdx = index
+	itr.bi.globalTs = t.globalTs
 	if t.oldBlockLen > 0 {
 		y.Assert(len(t.oldBlock) > 0)
 	}
-	it.bi.ski.oldBlock = t.oldBlock
-	binary.BigEndian.PutUint64(it.bi.globalTsBytes[:], math.MaxUint64-t.globalTs)
+	itr.bi.ski.oldBlock = t.oldBlock
+	binary.BigEndian.PutUint64(itr.bi.globalTsBytes[:], math.MaxUint64-t.globalTs)
 	if index.surf != nil {
-		it.surf = index.surf.NewIterator()
+		itr.surf = index.surf.NewIterator()
 	}
-	return it
+}
+
+// Reset closes the iterator and makes it an iterator of the table t as if it were returned by
+// t.NewIterator, so an iterator and its key buffer can be reused across many tables instead of
+// allocating one per table. The readahead, the direct IO and the tracing are disabled.
+func (itr *Iterator) Reset(t *Table, reversed bool) {
+	itr.Close()
+	keyBuf := itr.bi.key.UserKey[:0]
+	itr.bi = blockIterator{}
+	itr.bi.key.UserKey = keyBuf
+	itr.t, itr.tIdx, itr.surf = nil, nil, nil
+	itr.bpos = 0
+	itr.err = nil
+	itr.readahead, itr.raNext = 0, 0
+	itr.dio = nil
+	itr.ctx, itr.tracer = nil, nil
+	index, err := t.getIndex()
+	if err != nil {
+		itr.err = err
+		return
+	}
+	itr.init(t, reversed, index)
+}
+
+// ResetTable implements table.ReusableIterator.
+func (itr *Iterator) ResetTable(t table.Table, reversed bool) bool {
+	sst, ok := t.(*Table)
+	if !ok {
+		return false
+	}
+	itr.Reset(sst, reversed)
+	return true
+}
+
+// SetReadahead implements table.ReadaheadIterator. The following n blocks are loaded into the
+// block cache on a background goroutine when the iteration crosses a block boundary.
+func (itr *Iterator) SetReadahead(n int) {
+	itr.readahead = n
+	itr.raNext = 0
+	if itr.reversed && itr.tIdx != nil {
+		itr.raNext = itr.tIdx.numBlocks() - 1
+	}
+}
+
+// prefetch loads the blocks following the current block into the block cache. A new batch is only
+// issued after half of the prefetched blocks have been consumed.
+func (itr *Iterator) prefetch() {
+	t := itr.t
+	if itr.readahead <= 0 || t.blockCache == nil || t.fd == nil || itr.dio != nil {
+		return
+	}
+	var from, to int
+	if !itr.reversed {
+		if itr.raNext > itr.bpos+itr.readahead/2 {
+			return
+		}
+		from = itr.bpos + 1
+		if from < itr.raNext {
+			from = itr.raNext
+		}
+		to = itr.bpos + itr.readahead
+		if numBlocks := itr.tIdx.numBlocks(); to >= numBlocks {
+			to = numBlocks - 1
+		}
+		if from > to {
+			return
+		}
+		itr.raNext = to + 1
+	} else {
+		if itr.raNext < itr.bpos-itr.readahead/2 {
+			return
+		}
+		from = itr.bpos - 1
+		if from > itr.raNext {
+			from = itr.raNext
+		}
+		to = itr.bpos - itr.readahead
+		if to < 0 {
+			to = 0
+		}
+		if from < to {
+			return
+		}
+		itr.raNext = to - 1
+	}
+	tIdx := itr.tIdx
+	itr.raWg.Add(1)
+	go func() {
+		defer itr.raWg.Done()
+		for idx := from; ; {
+			b, err := t.block(idx, tIdx)
+			if err != nil {
+				return
+			}
+			b.done()
+			if idx == to {
+				return
+			}
+			if from < to {
+				idx++
+			} else {
+				idx--
+			}
+		}
+	}()
 }
 
 func (itr *Iterator) reset() {
@@ -232,13 +563,13 @@ func (itr *Iterator) Error() error {
 }
 
 func (itr *Iterator) seekToFirst() {
-	numBlocks := len(itr.tIdx.blockEndOffsets)
+	numBlocks := itr.tIdx.numBlocks()
 	if numBlocks == 0 {
 		itr.err = io.EOF
 		return
 	}
 	itr.bpos = 0
-	block, err := itr.t.block(itr.bpos, itr.tIdx)
+	block, err := itr.block(itr.bpos)
 	if err != nil {
 		itr.err = err
 		return
@@ -249,13 +580,13 @@ func (itr *Iterator) seekToFirst() {
 }
 
 func (itr *Iterator) seekToLast() {
-	numBlocks := len(itr.tIdx.blockEndOffsets)
+	numBlocks := itr.tIdx.numBlocks()
 	if numBlocks == 0 {
 		itr.err = io.EOF
 		return
 	}
 	itr.bpos = numBlocks - 1
-	block, err := itr.t.block(itr.bpos, itr.tIdx)
+	block, err := itr.block(itr.bpos)
 	if err != nil {
 		itr.err = err
 		return
@@ -265,26 +596,36 @@ func (itr *Iterator) seekToLast() {
 	itr.err = itr.bi.Error()
 }
 
-func (itr *Iterator) seekInBlock(blockIdx int, key []byte) {
+// loadBlock makes the block iterator point to the block at blockIdx. If the
+// iterator already holds that block, it is reused without touching the block cache.
+func (itr *Iterator) loadBlock(blockIdx int) error {
 	itr.bpos = blockIdx
-	block, err := itr.t.block(blockIdx, itr.tIdx)
+	if b := itr.bi.block; b != nil && b.data != nil && b.idx == blockIdx {
+		itr.bi.resetBlock()
+		return nil
+	}
+	block, err := itr.block(blockIdx)
 	if err != nil {
+		return err
+	}
+	itr.bi.setBlock(block)
+	return nil
+}
+
+func (itr *Iterator) seekInBlock(blockIdx int, key []byte) {
+	if err := itr.loadBlock(blockIdx); err != nil {
 		itr.err = err
 		return
 	}
-	itr.bi.setBlock(block)
 	itr.bi.seek(key)
 	itr.err = itr.bi.Error()
 }
 
 func (itr *Iterator) seekFromOffset(blockIdx int, offset int, key []byte) {
-	itr.bpos = blockIdx
-	block, err := itr.t.block(blockIdx, itr.tIdx)
-	if err != nil {
+	if err := itr.loadBlock(blockIdx); err != nil {
 		itr.err = err
 		return
 	}
-	itr.bi.setBlock(block)
 	itr.bi.setIdx(offset)
 	if bytes.Compare(itr.bi.key.UserKey, key) >= 0 {
 		return
@@ -294,10 +635,11 @@ func (itr *Iterator) seekFromOffset(blockIdx int, offset int, key []byte) {
 }
 
 func (itr *Iterator) seekBlock(key []byte) int {
-	return sort.Search(len(itr.tIdx.blockEndOffsets), func(idx int) bool {
-		blockBaseKey := itr.tIdx.baseKeys.getEntry(idx)
-		return bytes.Compare(blockBaseKey, key) > 0
-	})
+	idx, err := itr.t.seekBlock(key, itr.tIdx)
+	if err != nil {
+		itr.err = err
+	}
+	return idx
 }
 
 // seekFrom brings us to a key that is >= input key.
@@ -325,7 +667,7 @@ func (itr *Iterator) seekFrom(key []byte) {
 	itr.seekInBlock(idx-1, key)
 	if itr.err == io.EOF {
 		// Case 1. Need to visit block[idx].
-		if idx == len(itr.tIdx.blockEndOffsets) {
+		if idx == itr.tIdx.numBlocks() {
 			// If idx == len(itr.t.blockEndOffsets), then input key is greater than ANY element of table.
 			// There's nothing we can do. Valid() should return false as we seek to end of table.
 			return
@@ -360,27 +702,43 @@ func (itr *Iterator) seek(key []byte) {
 
 // seekForPrev will reset iterator and seek to <= key.
 func (itr *Iterator) seekForPrev(key []byte) {
-	// TODO: Optimize this. We shouldn't have to take a Prev step.
-	itr.seekFrom(key)
-	if !bytes.Equal(itr.Key().UserKey, key) {
-		itr.prev()
+	itr.err = nil
+	itr.reset()
+
+	idx := itr.seekBlock(key)
+	if itr.err != nil {
+		return
+	}
+	if idx == 0 {
+		// The smallest key in our table is already strictly > key.
+		itr.bpos = -1
+		itr.err = io.EOF
+		return
+	}
+	// block[idx-1].smallest is <= key, so the block always has an element <= key.
+	if err := itr.loadBlock(idx - 1); err != nil {
+		itr.err = err
+		return
 	}
+	itr.bi.seekForPrev(key)
+	itr.err = itr.bi.Error()
 }
 
 func (itr *Iterator) next() {
 	itr.err = nil
 
-	if itr.bpos >= len(itr.tIdx.blockEndOffsets) {
+	if itr.bpos >= itr.tIdx.numBlocks() {
 		itr.err = io.EOF
 		return
 	}
 
 	if itr.bi.entries.length() == 0 {
-		block, err := itr.t.block(itr.bpos, itr.tIdx)
+		block, err := itr.block(itr.bpos)
 		if err != nil {
 			itr.err = err
 			return
 		}
+		itr.prefetch()
 		itr.bi.setBlock(block)
 		itr.bi.seekToFirst()
 		itr.err = itr.bi.Error()
@@ -404,11 +762,12 @@ func (itr *Iterator) prev() {
 	}
 
 	if itr.bi.entries.length() == 0 {
-		block, err := itr.t.block(itr.bpos, itr.tIdx)
+		block, err := itr.block(itr.bpos)
 		if err != nil {
 			itr.err = err
 			return
 		}
+		itr.prefetch()
 		itr.bi.setBlock(block)
 		itr.bi.seekToLast()
 		itr.err = itr.bi.Error()
@@ -431,13 +790,13 @@ func (itr *Iterator) Key() y.Key {
 
 // Value follows the y.Iterator interface
 func (itr *Iterator) Value() (ret y.ValueStruct) {
-	ret.Decode(itr.bi.val)
+	itr.bi.decodeValue(itr.bi.val, &ret)
 	return
 }
 
 // FillValue fill the value struct.
 func (itr *Iterator) FillValue(vs *y.ValueStruct) {
-	vs.Decode(itr.bi.val)
+	itr.bi.decodeValue(itr.bi.val, vs)
 }
 
 // Next follows the y.Iterator interface
@@ -459,7 +818,7 @@ func (itr *Iterator) NextVersion() bool {
 	if itr.bi.ski.idx+1 < itr.bi.ski.length() {
 		itr.bi.ski.idx++
 		itr.bi.val = itr.bi.ski.getVal()
-		itr.bi.key.Version = bytesToU64(itr.bi.val)
+		itr.bi.key.Version = itr.bi.decodeVersion(itr.bi.val)
 		return true
 	}
 	return false
@@ -483,8 +842,59 @@ func (itr *Iterator) Seek(key []byte) {
 	}
 }
 
+// SeekWithHint implements table.HintSeekIterator. If the key is not less than the current key, it is
+// searched in the current block from the current position when it is less than the base key of the
+// next block, and in the next block when it is less than the base key of the block after it, the
+// table index is only searched if the key is further.
+func (itr *Iterator) SeekWithHint(key []byte) {
+	if itr.reversed || !itr.Valid() || itr.bi.entries.length() == 0 || bytes.Compare(key, itr.bi.key.UserKey) < 0 {
+		itr.Seek(key)
+		return
+	}
+	numBlocks := itr.tIdx.numBlocks()
+	for blockIdx := itr.bpos; blockIdx < itr.bpos+2; blockIdx++ {
+		if blockIdx+1 < numBlocks {
+			baseKey, err := itr.blockBaseKey(blockIdx + 1)
+			if err != nil {
+				itr.err = err
+				return
+			}
+			if bytes.Compare(key, baseKey) >= 0 {
+				continue
+			}
+		}
+		if blockIdx == itr.bpos {
+			itr.bi.seekForward(key)
+			itr.err = itr.bi.Error()
+		} else {
+			itr.seekInBlock(blockIdx, key)
+		}
+		if itr.err == io.EOF && blockIdx+1 < numBlocks {
+			// All the keys in the block are less than the key, the base key of the next block is
+			// greater than it.
+			itr.err = nil
+			itr.seekFromOffset(blockIdx+1, 0, key)
+		}
+		return
+	}
+	itr.seek(key)
+}
+
+// blockBaseKey returns the first key of the block.
+func (itr *Iterator) blockBaseKey(blockIdx int) ([]byte, error) {
+	part, i, err := itr.t.blockPartition(blockIdx, itr.tIdx)
+	if err != nil {
+		return nil, err
+	}
+	return part.baseKeys.getEntry(i), nil
+}
+
 // Close closes the iterator (and it must be called).
 func (itr *Iterator) Close() error {
+	itr.raWg.Wait()
 	itr.bi.close()
+	if itr.dio != nil {
+		return itr.dio.fd.Close()
+	}
 	return nil
 }
@@ -17,12 +17,16 @@
 package sstable
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math"
-	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,9 +36,9 @@ import (
 	"github.com/coocood/bbloom"
 	"github.com/pingcap/badger/buffer"
 	"github.com/pingcap/badger/cache"
-	"github.com/pingcap/badger/fileutil"
 	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/surf"
+	"github.com/pingcap/badger/table"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
 )
@@ -49,19 +53,90 @@ const (
 func IndexFilename(tableFilename string) string { return tableFilename + idxFileSuffix }
 
 type tableIndex struct {
+	// indexPartition holds the index of all the blocks if the index is not partitioned.
+	indexPartition
+	// partitions is the top-level index if the index is partitioned.
+	partitions *indexPartitions
+	bf         *bbloom.Bloom
+	bbf        *blockedBloom
+	hIdx       *hashIndex
+	surf       *surf.SuRF
+}
+
+// indexPartition is the index of a range of blocks.
+type indexPartition struct {
+	// startOffset is the offset of the first block.
+	startOffset     uint32
 	blockEndOffsets []uint32
 	baseKeys        entrySlice
-	bf              *bbloom.Bloom
-	hIdx            *hashIndex
-	surf            *surf.SuRF
+	// blockCompression is nil if all the blocks are compressed by the table compression type.
+	blockCompression []byte
+}
+
+// indexPartitions is the top-level index of a partitioned index. The partitions are stored in the
+// table file between the blocks and the old block, they are loaded on demand and cached in the
+// block cache.
+type indexPartitions struct {
+	// baseKeys is the base key of the first block of every partition.
+	baseKeys entrySlice
+	// firstBlocks and offsets have one more element than the partitions, the partition i has the
+	// blocks [firstBlocks[i], firstBlocks[i+1]) and is stored at [offsets[i], offsets[i+1]).
+	firstBlocks []uint32
+	offsets     []uint32
+
+	// loaded holds the loaded partitions if the table has no block cache.
+	mu     sync.Mutex
+	loaded []*indexPartition
+}
+
+func (idx *tableIndex) numBlocks() int {
+	if idx.partitions != nil {
+		return int(idx.partitions.firstBlocks[len(idx.partitions.firstBlocks)-1])
+	}
+	return len(idx.blockEndOffsets)
+}
+
+func (p *indexPartition) blockOffsets(i int) (start, end uint32) {
+	start = p.startOffset
+	if i > 0 {
+		start = p.blockEndOffsets[i-1]
+	}
+	return start, p.blockEndOffsets[i]
+}
+
+func (p *indexPartition) blockCompressionType(i int, tableCompression options.CompressionType) options.CompressionType {
+	if p.blockCompression != nil {
+		return options.CompressionType(p.blockCompression[i])
+	}
+	return tableCompression
+}
+
+// seekBlock returns the index of the first block whose base key is greater than the key.
+func (p *indexPartition) seekBlock(key []byte) int {
+	return sort.Search(len(p.blockEndOffsets), func(i int) bool {
+		return bytes.Compare(p.baseKeys.getEntry(i), key) > 0
+	})
+}
+
+func (p *indexPartition) readIndex(d *metaDecoder) {
+	switch d.currentId() {
+	case idBaseKeysEndOffs:
+		p.baseKeys.endOffs = bytesToU32Slice(d.decode())
+	case idBaseKeys:
+		p.baseKeys.data = d.decode()
+	case idBlockEndOffsets:
+		p.blockEndOffsets = bytesToU32Slice(d.decode())
+	case idBlockCompression:
+		p.blockCompression = d.decode()
+	}
 }
 
 // Table represents a loaded table file with the info we have about it
 type Table struct {
 	sync.Mutex
 
-	fd      *os.File // Own fd.
-	indexFd *os.File
+	fd      TableFile // Own fd.
+	indexFd TableFile
 
 	globalTs          uint64
 	tableSize         int64
@@ -69,8 +144,13 @@ type Table struct {
 	smallest, biggest y.Key
 	id                uint64
 
-	blockCache *cache.Cache
-	blocksData []byte
+	loadingMode options.TableLoadingMode
+	blockCache  *cache.Cache
+	blocksData  []byte
+
+	// compressedCache is the second tier of the block cache which caches the compressed blocks,
+	// a block evicted from blockCache is decompressed from it instead of read from the file.
+	compressedCache *cache.Cache
 
 	indexCache *cache.Cache
 	index      *tableIndex
@@ -81,8 +161,41 @@ type Table struct {
 
 	compression options.CompressionType
 
+	// dataKey decrypts the blocks, it is nil if the table is not encrypted.
+	keyRegistry options.KeyRegistry
+	dataKey     *options.DataKey
+
 	oldBlockLen int64
 	oldBlock    []byte
+
+	properties map[string][]byte
+	entryStats table.EntryStats
+	indexSize  int64
+	hasSuRF    bool
+
+	// blockChecksums is nil if the table was built before the block checksums were recorded.
+	blockChecksums []uint32
+	// restartInterval is 0 if every key is stored after the common prefix of the block.
+	restartInterval int
+	// varintValue is true if the values are encoded by y.ValueStruct.EncodeVarintTo.
+	varintValue bool
+	// verifyChecksum is true if the block checksums are verified when the blocks are loaded.
+	verifyChecksum bool
+}
+
+// SetVerifyBlockChecksum makes the table verify the checksum of every block loaded from the file
+// before it is decoded and cached, a corrupted block is returned as a *CorruptBlockError. The
+// tables built before the block checksums were recorded are not verified. It must be called before
+// the table is read.
+func (t *Table) SetVerifyBlockChecksum(verify bool) {
+	t.verifyChecksum = verify
+}
+
+// SetCompressedBlockCache sets the second tier of the block cache which caches the compressed
+// blocks, so a block evicted from the block cache is decompressed from memory instead of read from
+// the file. It must be called before the table is read.
+func (t *Table) SetCompressedBlockCache(c *cache.Cache) {
+	t.compressedCache = c
 }
 
 // CompressionType returns the compression algorithm used for block compression.
@@ -90,6 +203,73 @@ func (t *Table) CompressionType() options.CompressionType {
 	return t.compression
 }
 
+// Properties returns the properties collected by the TablePropertiesCollector when the table was
+// built, it returns nil if there was no collector.
+func (t *Table) Properties() map[string][]byte {
+	return t.properties
+}
+
+// IndexSize returns the size of the index file.
+func (t *Table) IndexSize() int64 {
+	return t.indexSize
+}
+
+// HasSuRF returns true if the table is indexed by a SuRF instead of a hash index.
+func (t *Table) HasSuRF() bool {
+	return t.hasSuRF
+}
+
+// EntryStats returns the stats of the entries in the table, the versions are the global ts if the
+// table has one.
+func (t *Table) EntryStats() table.EntryStats {
+	stats := t.entryStats
+	if t.globalTs != 0 && stats.NumEntries != 0 {
+		stats.MinVersion, stats.MaxVersion = t.globalTs, t.globalTs
+	}
+	return stats
+}
+
+// SuRFStats returns the stats of the SuRF index, it returns nil if the table doesn't have a SuRF index.
+func (t *Table) SuRFStats() (*surf.Stats, error) {
+	idx, err := t.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	if idx.surf == nil {
+		return nil, nil
+	}
+	return idx.surf.Stats(), nil
+}
+
+// BlockSample is the first user key of a block and the size of the block.
+type BlockSample struct {
+	Key  []byte
+	Size int64
+}
+
+// BlockSamples returns a sample for every block in the table, the samples are in key order and
+// their sizes sum up to the size of the blocks. The keys are copied from the index.
+func (t *Table) BlockSamples() ([]BlockSample, error) {
+	idx, err := t.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	numBlocks := idx.numBlocks()
+	samples := make([]BlockSample, 0, numBlocks)
+	for i := 0; i < numBlocks; i++ {
+		part, j, err := t.blockPartition(i, idx)
+		if err != nil {
+			return nil, err
+		}
+		start, end := part.blockOffsets(j)
+		samples = append(samples, BlockSample{
+			Key:  append([]byte{}, part.baseKeys.getEntry(j)...),
+			Size: int64(end - start),
+		})
+	}
+	return samples, nil
+}
+
 // Delete delete table's file from disk.
 func (t *Table) Delete() error {
 	if t.fd == nil {
@@ -108,88 +288,155 @@ func (t *Table) Delete() error {
 			}
 		}
 	}
+	if t.compressedCache != nil {
+		for blk := 0; blk < t.numBlocks; blk++ {
+			t.compressedCache.Del(t.blockCacheKey(blk))
+		}
+	}
 	if t.indexCache != nil {
 		t.indexCache.Del(t.id)
 	}
 	if len(t.blocksData) != 0 {
-		y.Munmap(t.blocksData)
+		unmapFile(t.fd, t.blocksData)
 	}
 	t.index = nil
 	if len(t.indexData) != 0 {
-		y.Munmap(t.indexData)
-	}
-	if err := t.fd.Truncate(0); err != nil {
-		// This is very important to let the FS know that the file is deleted.
-		return err
-	}
-	filename := t.fd.Name()
-	if err := t.fd.Close(); err != nil {
-		return err
+		unmapFile(t.indexFd, t.indexData)
 	}
-	if err := os.Remove(filename); err != nil {
+	if err := t.fd.Delete(); err != nil {
 		return err
 	}
-	return os.Remove(filename + idxFileSuffix)
+	return t.indexFd.Delete()
 }
 
 // OpenTable assumes file has only one table and opens it.  Takes ownership of fd upon function
 // entry.  Returns a table with one reference count on it (decrementing which may delete the file!
 // -- consider t.Close() instead).  The fd has to writeable because we call Truncate on it before
-// deleting.
-func OpenTable(filename string, blockCache *cache.Cache, indexCache *cache.Cache) (*Table, error) {
+// deleting. The keyRegistry is used to decrypt encrypted tables, it can be nil if the table is
+// not encrypted.
+func OpenTable(filename string, mode options.TableLoadingMode, blockCache *cache.Cache, indexCache *cache.Cache,
+	keyRegistry options.KeyRegistry) (*Table, error) {
 	id, ok := ParseFileID(filename)
 	if !ok {
 		return nil, errors.Errorf("Invalid filename: %s", filename)
 	}
 
 	// TODO: after we support cache of L2 storage, we will open block data file in cache manager.
-	fd, err := y.OpenExistingFile(filename, 0)
+	fd, err := OpenLocalFile(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	indexFd, err := y.OpenExistingFile(filename+idxFileSuffix, 0)
+	indexFd, err := OpenLocalFile(filename + idxFileSuffix)
 	if err != nil {
+		fd.Close()
 		return nil, err
 	}
 
+	return OpenTableWithConfig(OpenTableConfig{
+		File:        fd,
+		IndexFile:   indexFd,
+		ID:          id,
+		LoadingMode: mode,
+		BlockCache:  blockCache,
+		IndexCache:  indexCache,
+		KeyRegistry: keyRegistry,
+	})
+}
+
+// OpenTableConfig contains the files and the options to open a table.
+type OpenTableConfig struct {
+	// File and IndexFile are the data file and the index file of the table, they are owned by the
+	// table after OpenTableWithConfig is called.
+	File      TableFile
+	IndexFile TableFile
+	ID        uint64
+
+	LoadingMode options.TableLoadingMode
+	BlockCache  *cache.Cache
+	IndexCache  *cache.Cache
+	// KeyRegistry is used to decrypt encrypted tables, it can be nil if the table is not encrypted.
+	KeyRegistry options.KeyRegistry
+}
+
+// OpenTableWithConfig opens a table stored in the files of the config, so the table can be read
+// from other storages than the local file system. The files are closed if the table can't be
+// opened. The data which has to be in memory is read from the files unless they are LocalFiles,
+// which are mapped into memory.
+func OpenTableWithConfig(cfg OpenTableConfig) (*Table, error) {
 	t := &Table{
-		fd:         fd,
-		indexFd:    indexFd,
-		id:         id,
-		blockCache: blockCache,
-		indexCache: indexCache,
+		fd:          cfg.File,
+		indexFd:     cfg.IndexFile,
+		id:          cfg.ID,
+		loadingMode: cfg.LoadingMode,
+		blockCache:  cfg.BlockCache,
+		indexCache:  cfg.IndexCache,
+		keyRegistry: cfg.KeyRegistry,
 	}
 
 	if err := t.initTableInfo(); err != nil {
 		t.Close()
 		return nil, err
 	}
-	if blockCache == nil || t.oldBlockLen > 0 {
-		t.blocksData, err = y.Mmap(fd, false, t.Size())
+	fileSize, err := t.fd.Size()
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	if fileSize < t.Size() {
+		t.Close()
+		return nil, &InvalidTableError{Filename: t.fd.Name(),
+			Reason: fmt.Sprintf("file size %d is smaller than table size %d", fileSize, t.Size())}
+	}
+	_, local := t.fd.(*LocalFile)
+	if t.blockCache == nil || (t.oldBlockLen > 0 && local) || t.loadingMode == options.MemoryMap {
+		t.blocksData, err = mapFile(t.fd, t.Size())
 		if err != nil {
 			t.Close()
 			return nil, y.Wrapf(err, "Unable to map file")
 		}
-		t.setOldBlock()
+		if err = t.setOldBlock(t.blocksData[t.tableSize-t.oldBlockLen : t.tableSize]); err != nil {
+			t.Close()
+			return nil, err
+		}
+	} else if t.oldBlockLen > 0 {
+		// Only the old block is read into memory from the other storages.
+		oldBlock := make([]byte, t.oldBlockLen)
+		if _, err = t.fd.ReadAt(oldBlock, t.tableSize-t.oldBlockLen); err != nil {
+			t.Close()
+			return nil, err
+		}
+		if err = t.setOldBlock(oldBlock); err != nil {
+			t.Close()
+			return nil, err
+		}
 	}
 	return t, nil
 }
 
-func (t *Table) setOldBlock() {
-	t.oldBlock = t.blocksData[t.tableSize-t.oldBlockLen : t.tableSize]
+func (t *Table) setOldBlock(oldBlock []byte) error {
+	t.oldBlock = oldBlock
+	if t.dataKey != nil && t.oldBlockLen > 0 {
+		var err error
+		t.oldBlock, err = decryptBlock(t.oldBlock, t.dataKey)
+		return err
+	}
+	return nil
 }
 
 // OpenInMemoryTable opens a table that has data in memory.
-func OpenInMemoryTable(blockData, indexData []byte) (*Table, error) {
+func OpenInMemoryTable(blockData, indexData []byte, keyRegistry options.KeyRegistry) (*Table, error) {
 	t := &Table{
-		blocksData: blockData,
-		indexData:  indexData,
+		blocksData:  blockData,
+		indexData:   indexData,
+		keyRegistry: keyRegistry,
 	}
 	if err := t.initTableInfo(); err != nil {
 		return nil, err
 	}
-	t.setOldBlock()
+	if err := t.setOldBlock(t.blocksData[t.tableSize-t.oldBlockLen : t.tableSize]); err != nil {
+		return nil, err
+	}
 	return t, nil
 }
 
@@ -200,7 +447,7 @@ func (t *Table) Close() error {
 	}
 	if t.indexFd != nil {
 		if len(t.indexData) != 0 {
-			y.Munmap(t.indexData)
+			unmapFile(t.indexFd, t.indexData)
 		}
 		t.indexFd.Close()
 	}
@@ -212,12 +459,18 @@ func (t *Table) NewIterator(reversed bool) y.Iterator {
 }
 
 func (t *Table) Get(key y.Key, keyHash uint64) (y.ValueStruct, error) {
-	resultKey, resultVs, ok, err := t.pointGet(key, keyHash)
+	return t.GetTraced(context.Background(), nil, key, keyHash)
+}
+
+// GetTraced implements table.TracedGetter, it is Get with the block loads traced by the tracer.
+func (t *Table) GetTraced(ctx context.Context, tracer options.Tracer, key y.Key, keyHash uint64) (y.ValueStruct, error) {
+	resultKey, resultVs, ok, err := t.pointGet(ctx, tracer, key, keyHash)
 	if err != nil {
 		return y.ValueStruct{}, err
 	}
 	if !ok {
-		it := t.NewIterator(false)
+		it := t.newIterator(false)
+		it.ctx, it.tracer = ctx, tracer
 		defer it.Close()
 		it.Seek(key.UserKey)
 		if !it.Valid() {
@@ -235,32 +488,26 @@ func (t *Table) Get(key y.Key, keyHash uint64) (y.ValueStruct, error) {
 	return result, nil
 }
 
+// MayContainKey implements table.KeyFilter, it returns true if the index can't be read.
+func (t *Table) MayContainKey(key []byte, keyHash uint64) bool {
+	idx, err := t.getIndex()
+	if err != nil {
+		return true
+	}
+	blkIdx, _ := idx.lookup(key, keyHash)
+	return blkIdx != resultNoEntry
+}
+
 // pointGet try to lookup a key and its value by table's hash index.
 // If it find an hash collision the last return value will be false,
 // which means caller should fallback to seek search. Otherwise it value will be true.
 // If the hash index does not contain such an element the returned key will be nil.
-func (t *Table) pointGet(key y.Key, keyHash uint64) (y.Key, y.ValueStruct, bool, error) {
+func (t *Table) pointGet(ctx context.Context, tracer options.Tracer, key y.Key, keyHash uint64) (y.Key, y.ValueStruct, bool, error) {
 	idx, err := t.getIndex()
 	if err != nil {
 		return y.Key{}, y.ValueStruct{}, false, err
 	}
-	if idx.bf != nil && !idx.bf.Has(keyHash) {
-		return y.Key{}, y.ValueStruct{}, true, err
-	}
-
-	blkIdx, offset := uint32(resultFallback), uint8(0)
-	if idx.hIdx != nil {
-		blkIdx, offset = idx.hIdx.lookup(keyHash)
-	} else if idx.surf != nil {
-		v, ok := idx.surf.Get(key.UserKey)
-		if !ok {
-			blkIdx = resultNoEntry
-		} else {
-			var pos entryPosition
-			pos.decode(v)
-			blkIdx, offset = uint32(pos.blockIdx), pos.offset
-		}
-	}
+	blkIdx, offset := idx.lookup(key.UserKey, keyHash)
 	if blkIdx == resultFallback {
 		return y.Key{}, y.ValueStruct{}, false, nil
 	}
@@ -269,6 +516,7 @@ func (t *Table) pointGet(key y.Key, keyHash uint64) (y.Key, y.ValueStruct, bool,
 	}
 
 	it := t.newIterator(false)
+	it.ctx, it.tracer = ctx, tracer
 	defer it.Close()
 	it.seekFromOffset(int(blkIdx), int(offset), key.UserKey)
 
@@ -281,6 +529,65 @@ func (t *Table) pointGet(key y.Key, keyHash uint64) (y.Key, y.ValueStruct, bool,
 	return it.Key(), it.Value(), true, nil
 }
 
+// lookup finds the position of the key by the bloom filter and the hash index or the SuRF.
+// resultNoEntry is returned if the key doesn't exist, resultFallback is returned if the caller
+// should fallback to seek search.
+func (idx *tableIndex) lookup(key []byte, keyHash uint64) (blkIdx uint32, offset uint8) {
+	if idx.bf != nil && !idx.bf.Has(keyHash) {
+		return resultNoEntry, 0
+	}
+	if idx.bbf != nil && !idx.bbf.has(keyHash) {
+		return resultNoEntry, 0
+	}
+	blkIdx = resultFallback
+	if idx.hIdx != nil {
+		blkIdx, offset = idx.hIdx.lookup(keyHash)
+	} else if idx.surf != nil {
+		v, ok := idx.surf.Get(key)
+		if !ok {
+			blkIdx = resultNoEntry
+		} else {
+			var pos entryPosition
+			pos.decode(v)
+			blkIdx, offset = uint32(pos.blockIdx), pos.offset
+		}
+	}
+	return
+}
+
+// MultiGet looks up the keys sorted in ascending order, the value of keys[i] is stored in vals[i].
+// The keys share one iterator, so the block is loaded only once for the keys in the same block.
+func (t *Table) MultiGet(keys []y.Key, keyHashes []uint64, vals []y.ValueStruct) error {
+	idx, err := t.getIndex()
+	if err != nil {
+		return err
+	}
+	it := t.newIteratorWithIdx(false, idx)
+	defer it.Close()
+	for i, key := range keys {
+		vals[i] = y.ValueStruct{}
+		blkIdx, offset := idx.lookup(key.UserKey, keyHashes[i])
+		switch blkIdx {
+		case resultNoEntry:
+			continue
+		case resultFallback:
+			it.seek(key.UserKey)
+		default:
+			it.reset()
+			it.seekFromOffset(int(blkIdx), int(offset), key.UserKey)
+		}
+		if !it.Valid() || !key.SameUserKey(it.Key()) || !y.SeekToVersion(it, key.Version) {
+			if err = it.Error(); err != nil {
+				return err
+			}
+			continue
+		}
+		vals[i] = it.Value()
+		vals[i].Version = it.Key().Version
+	}
+	return nil
+}
+
 func (t *Table) read(off int, sz int) ([]byte, error) {
 	if len(t.blocksData) > 0 {
 		if len(t.blocksData[off:]) < sz {
@@ -298,9 +605,16 @@ func (t *Table) initTableInfo() error {
 	if err != nil {
 		return err
 	}
+	t.indexSize = int64(len(t.indexData))
+	if t.indexFd != nil {
+		if t.indexSize, err = t.indexFd.Size(); err != nil {
+			return err
+		}
+	}
 
 	t.compression = d.compression
 	t.globalTs = d.globalTS
+	t.dataKey = d.dataKey
 
 	for ; d.valid(); d.next() {
 		switch d.currentId() {
@@ -316,29 +630,62 @@ func (t *Table) initTableInfo() error {
 			offsets := bytesToU32Slice(d.decode())
 			t.tableSize = int64(offsets[len(offsets)-1])
 			t.numBlocks = len(offsets)
+		case idPartitionBlocks:
+			firstBlocks := bytesToU32Slice(d.decode())
+			t.numBlocks = int(firstBlocks[len(firstBlocks)-1])
+		case idPartitionOffsets:
+			offsets := bytesToU32Slice(d.decode())
+			t.tableSize = int64(offsets[len(offsets)-1])
 		case idOldBlockLen:
 			t.oldBlockLen = int64(bytesToU32(d.decode()))
 			t.tableSize += t.oldBlockLen
+		case idProperties:
+			if t.properties, err = decodeProperties(d.decode()); err != nil {
+				return errors.Wrapf(err, "table %d", t.id)
+			}
+		case idEntryStats:
+			if t.entryStats, err = decodeEntryStats(d.decode()); err != nil {
+				return errors.Wrapf(err, "table %d", t.id)
+			}
+		case idBlockChecksums:
+			t.blockChecksums = append([]uint32(nil), bytesToU32Slice(d.decode())...)
+		case idSuRFIndex:
+			t.hasSuRF = len(d.decode()) != 0
+		case idRestartInterval:
+			t.restartInterval = int(bytesToU32(d.decode()))
+		case idValueFormat:
+			t.varintValue = bytesToU32(d.decode()) == valueFormatVarint
 		}
 	}
 	return nil
 }
 
-func (t *Table) readTableIndex(d *metaDecoder) *tableIndex {
+func (t *Table) readTableIndex(d *metaDecoder) (*tableIndex, error) {
 	idx := new(tableIndex)
 	for ; d.valid(); d.next() {
 		switch d.currentId() {
-		case idBaseKeysEndOffs:
-			idx.baseKeys.endOffs = bytesToU32Slice(d.decode())
-		case idBaseKeys:
-			idx.baseKeys.data = d.decode()
-		case idBlockEndOffsets:
-			idx.blockEndOffsets = bytesToU32Slice(d.decode())
+		case idBaseKeysEndOffs, idBaseKeys, idBlockEndOffsets, idBlockCompression:
+			idx.indexPartition.readIndex(d)
+		case idPartitionBaseKeysEndOffs:
+			idx.initPartitions().baseKeys.endOffs = bytesToU32Slice(d.decode())
+		case idPartitionBaseKeys:
+			idx.initPartitions().baseKeys.data = d.decode()
+		case idPartitionBlocks:
+			idx.initPartitions().firstBlocks = bytesToU32Slice(d.decode())
+		case idPartitionOffsets:
+			parts := idx.initPartitions()
+			parts.offsets = bytesToU32Slice(d.decode())
+			parts.loaded = make([]*indexPartition, len(parts.offsets)-1)
 		case idBloomFilter:
 			if d := d.decode(); len(d) != 0 {
 				idx.bf = new(bbloom.Bloom)
 				idx.bf.BinaryUnmarshal(d)
 			}
+		case idBlockedBloomFilter:
+			if d := d.decode(); len(d) != 0 {
+				idx.bbf = new(blockedBloom)
+				idx.bbf.readFilter(d)
+			}
 		case idHashIndex:
 			if d := d.decode(); len(d) != 0 {
 				idx.hIdx = new(hashIndex)
@@ -347,11 +694,128 @@ func (t *Table) readTableIndex(d *metaDecoder) *tableIndex {
 		case idSuRFIndex:
 			if d := d.decode(); len(d) != 0 {
 				idx.surf = new(surf.SuRF)
-				idx.surf.Unmarshal(d)
+				if err := idx.surf.Unmarshal(d); err != nil {
+					return nil, errors.Wrapf(err, "table %d", t.id)
+				}
 			}
 		}
 	}
-	return idx
+	return idx, nil
+}
+
+// memSize returns the memory used by the index. The decoded structures reference the index data
+// instead of copying it, so the data is only counted once.
+func (idx *tableIndex) memSize(dataSize int) int64 {
+	size := int64(unsafe.Sizeof(*idx)) + int64(dataSize)
+	if idx.partitions != nil {
+		size += int64(unsafe.Sizeof(*idx.partitions)) + int64(len(idx.partitions.loaded))*int64(unsafe.Sizeof(uintptr(0)))
+	}
+	if idx.bf != nil {
+		size += int64(unsafe.Sizeof(*idx.bf))
+	}
+	if idx.bbf != nil {
+		size += int64(unsafe.Sizeof(*idx.bbf))
+	}
+	if idx.hIdx != nil {
+		size += int64(unsafe.Sizeof(*idx.hIdx))
+	}
+	if idx.surf != nil {
+		size += int64(unsafe.Sizeof(*idx.surf))
+	}
+	return size
+}
+
+func (idx *tableIndex) initPartitions() *indexPartitions {
+	if idx.partitions == nil {
+		idx.partitions = new(indexPartitions)
+	}
+	return idx.partitions
+}
+
+// blockPartition returns the index partition of the block and the index of the block in it.
+func (t *Table) blockPartition(idx int, index *tableIndex) (*indexPartition, int, error) {
+	parts := index.partitions
+	if parts == nil {
+		return &index.indexPartition, idx, nil
+	}
+	p := sort.Search(len(parts.loaded), func(i int) bool {
+		return int(parts.firstBlocks[i+1]) > idx
+	})
+	part, err := t.loadPartition(p, parts)
+	if err != nil {
+		return nil, 0, err
+	}
+	return part, idx - int(parts.firstBlocks[p]), nil
+}
+
+// seekBlock returns the index of the first block whose base key is greater than the key.
+func (t *Table) seekBlock(key []byte, index *tableIndex) (int, error) {
+	parts := index.partitions
+	if parts == nil {
+		return index.seekBlock(key), nil
+	}
+	p := sort.Search(parts.baseKeys.length(), func(i int) bool {
+		return bytes.Compare(parts.baseKeys.getEntry(i), key) > 0
+	})
+	if p == 0 {
+		return 0, nil
+	}
+	part, err := t.loadPartition(p-1, parts)
+	if err != nil {
+		return 0, err
+	}
+	return int(parts.firstBlocks[p-1]) + part.seekBlock(key), nil
+}
+
+func (t *Table) loadPartition(p int, parts *indexPartitions) (*indexPartition, error) {
+	if t.blockCache == nil {
+		parts.mu.Lock()
+		defer parts.mu.Unlock()
+		if parts.loaded[p] == nil {
+			part, err := t.readPartition(p, parts)
+			if err != nil {
+				return nil, err
+			}
+			parts.loaded[p] = part
+		}
+		return parts.loaded[p], nil
+	}
+	part, err := t.blockCache.GetOrCompute(t.partitionCacheKey(p), func() (interface{}, int64, error) {
+		part, err := t.readPartition(p, parts)
+		if err != nil {
+			return nil, 0, err
+		}
+		return part, int64(parts.offsets[p+1] - parts.offsets[p]), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return part.(*indexPartition), nil
+}
+
+func (t *Table) readPartition(p int, parts *indexPartitions) (*indexPartition, error) {
+	offset, dataLen := int(parts.offsets[p]), int(parts.offsets[p+1]-parts.offsets[p])
+	data, err := t.read(offset, dataLen)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to read index partition from file: %s at offset: %d, len: %d", t.fd.Name(), offset, dataLen)
+	}
+	if t.dataKey != nil {
+		decrypted, err := decryptBlock(data, t.dataKey)
+		if len(t.blocksData) == 0 {
+			buffer.PutBuffer(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = decrypted
+	}
+	part := new(indexPartition)
+	for d := (&metaDecoder{buf: data}); d.valid(); d.next() {
+		part.readIndex(d)
+	}
+	part.startOffset, part.blockEndOffsets = part.blockEndOffsets[0], part.blockEndOffsets[1:]
+	return part, nil
 }
 
 func (t *Table) getIndex() (*tableIndex, error) {
@@ -363,9 +827,9 @@ func (t *Table) getIndex() (*tableIndex, error) {
 			if err != nil {
 				return
 			}
-			t.index = t.readTableIndex(d)
+			t.index, err = t.readTableIndex(d)
 		})
-		return t.index, nil
+		return t.index, err
 	}
 
 	index, err := t.indexCache.GetOrCompute(t.id, func() (interface{}, int64, error) {
@@ -373,7 +837,11 @@ func (t *Table) getIndex() (*tableIndex, error) {
 		if err != nil {
 			return nil, 0, err
 		}
-		return t.readTableIndex(d), int64(len(d.buf)), nil
+		idx, err := t.readTableIndex(d)
+		if err != nil {
+			return nil, 0, err
+		}
+		return idx, idx.memSize(len(d.buf)), nil
 	})
 	if err != nil {
 		return nil, err
@@ -383,43 +851,60 @@ func (t *Table) getIndex() (*tableIndex, error) {
 
 func (t *Table) loadIndexData(useMmap bool) (*metaDecoder, error) {
 	if t.indexFd == nil {
-		return newMetaDecoder(t.indexData)
+		return newMetaDecoder(t.indexData, t.keyRegistry)
 	}
-	fstat, err := t.indexFd.Stat()
+	size, err := t.indexFd.Size()
 	if err != nil {
 		return nil, err
 	}
 	var idxData []byte
 
 	if useMmap {
-		idxData, err = y.Mmap(t.indexFd, false, fstat.Size())
+		idxData, err = mapFile(t.indexFd, size)
 		if err != nil {
 			return nil, err
 		}
 		t.indexData = idxData
 	} else {
-		idxData = buffer.GetBuffer(int(fstat.Size()))
+		idxData = buffer.GetBuffer(int(size))
 		if _, err = t.indexFd.ReadAt(idxData, 0); err != nil {
 			return nil, err
 		}
 	}
 
-	decoder, err := newMetaDecoder(idxData)
+	decoder, err := newMetaDecoder(idxData, t.keyRegistry)
 	if err != nil {
+		if useMmap {
+			unmapFile(t.indexFd, idxData)
+			t.indexData = nil
+		}
+		if e, ok := err.(*InvalidTableError); ok {
+			e.Filename = t.indexFd.Name()
+		}
 		return nil, err
 	}
-	if decoder.compression != options.None && useMmap {
-		y.Munmap(idxData)
+	if (decoder.compression != options.None || decoder.dataKey != nil) && useMmap {
+		unmapFile(t.indexFd, idxData)
 		t.indexData = nil
 	}
 	return decoder, nil
 }
 
 type block struct {
+	idx     int
 	offset  int
 	data    []byte
 	baseKey []byte
 
+	// entries and baseLen are parsed from data once when the block is loaded,
+	// so iterators seeking into a cached block don't need to decode them again.
+	entries entrySlice
+	baseLen uint16
+	// restartInterval and varintValue are copied from the table as the blocks are decoded by
+	// blockIterator.
+	restartInterval int
+	varintValue     bool
+
 	reference int32
 }
 
@@ -456,17 +941,17 @@ func (b *block) size() int64 {
 func (t *Table) block(idx int, index *tableIndex) (*block, error) {
 	y.Assert(idx >= 0)
 
-	if idx >= len(index.blockEndOffsets) {
+	if idx >= index.numBlocks() {
 		return &block{}, io.EOF
 	}
 
-	if t.blockCache == nil {
+	if t.blockCache == nil || t.isMappedBlock(idx, index) {
 		return t.loadBlock(idx, index)
 	}
 
 	key := t.blockCacheKey(idx)
 	blk, err := t.blockCache.GetOrCompute(key, func() (interface{}, int64, error) {
-		b, e := t.loadBlock(idx, index)
+		b, e := t.loadCompressedCachedBlock(idx, index)
 		if e != nil {
 			return nil, 0, e
 		}
@@ -483,43 +968,162 @@ func (t *Table) block(idx int, index *tableIndex) (*block, error) {
 	return b, nil
 }
 
+// isMappedBlock returns true if the block is served from the mapped file directly, the block
+// data is a slice of the mapped region so it doesn't need to be cached.
+func (t *Table) isMappedBlock(idx int, index *tableIndex) bool {
+	if t.loadingMode != options.MemoryMap || t.dataKey != nil || len(t.blocksData) == 0 {
+		return false
+	}
+	part, i, err := t.blockPartition(idx, index)
+	return err == nil && part.blockCompressionType(i, t.compression) == options.None
+}
+
 func (t *Table) loadBlock(idx int, index *tableIndex) (*block, error) {
-	var startOffset int
-	if idx > 0 {
-		startOffset = int(index.blockEndOffsets[idx-1])
+	return t.loadBlockFrom(idx, index, t.read)
+}
+
+// loadCompressedCachedBlock loads the block through the compressed block cache if it is set. The
+// blocks which are not compressed are loaded from the file directly.
+func (t *Table) loadCompressedCachedBlock(idx int, index *tableIndex) (*block, error) {
+	if t.compressedCache == nil {
+		return t.loadBlock(idx, index)
+	}
+	part, i, err := t.blockPartition(idx, index)
+	if err != nil {
+		return &block{}, err
+	}
+	if part.blockCompressionType(i, t.compression) == options.None {
+		return t.loadBlock(idx, index)
+	}
+	startOffset, _ := part.blockOffsets(i)
+	v, err := t.compressedCache.GetOrCompute(t.blockCacheKey(idx), func() (interface{}, int64, error) {
+		data, err := t.readBlockData(idx, part, i, t.read)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(t.blocksData) > 0 && t.dataKey == nil {
+			// The data is a slice of the mapped file.
+			data = y.Copy(data)
+		}
+		return data, int64(len(data)), nil
+	})
+	if err != nil {
+		return &block{}, err
 	}
+	// Decompress recycles its input, so it decompresses a copy of the cached data.
+	compressed := v.([]byte)
+	data := buffer.GetBuffer(len(compressed))
+	copy(data, compressed)
 	blk := &block{
-		offset: startOffset,
+		idx:    idx,
+		offset: int(startOffset),
+		data:   data,
 	}
-	endOffset := int(index.blockEndOffsets[idx])
-	dataLen := endOffset - startOffset
-	var err error
-	if blk.data, err = t.read(blk.offset, dataLen); err != nil {
-		return &block{}, errors.Wrapf(err,
-			"failed to read from file: %s at offset: %d, len: %d", t.fd.Name(), blk.offset, dataLen)
+	return t.decodeBlock(blk, part, i)
+}
+
+// loadBlockFrom loads the block with the read function, so the iterators can read the blocks in
+// other ways than the table does.
+func (t *Table) loadBlockFrom(idx int, index *tableIndex, read func(off, sz int) ([]byte, error)) (*block, error) {
+	part, i, err := t.blockPartition(idx, index)
+	if err != nil {
+		return &block{}, err
+	}
+	startOffset, _ := part.blockOffsets(i)
+	blk := &block{
+		idx:    idx,
+		offset: int(startOffset),
+	}
+	if blk.data, err = t.readBlockData(idx, part, i, read); err != nil {
+		return &block{}, err
+	}
+	return t.decodeBlock(blk, part, i)
+}
+
+// readBlockData reads the i-th block of the partition, which is the idx-th block of the table, with
+// the read function, verifies its checksum if verifyChecksum is set and decrypts it, the returned
+// data is still compressed.
+func (t *Table) readBlockData(idx int, part *indexPartition, i int, read func(off, sz int) ([]byte, error)) ([]byte, error) {
+	startOffset, endOffset := part.blockOffsets(i)
+	offset, dataLen := int(startOffset), int(endOffset-startOffset)
+	data, err := read(offset, dataLen)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to read from file: %s at offset: %d, len: %d", t.fd.Name(), offset, dataLen)
+	}
+	if t.verifyChecksum && t.blockChecksums != nil &&
+		crc32.Checksum(data, y.CastagnoliCrcTable) != t.blockChecksums[idx] {
+		if len(t.blocksData) == 0 {
+			buffer.PutBuffer(data)
+		}
+		return nil, &CorruptBlockError{Offset: int64(offset), Len: dataLen}
+	}
+	if t.dataKey != nil {
+		decrypted, err := decryptBlock(data, t.dataKey)
+		if len(t.blocksData) == 0 {
+			buffer.PutBuffer(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = decrypted
 	}
+	return data, nil
+}
 
-	blk.data, err = t.compression.Decompress(blk.data)
+// decodeBlock decompresses the data of the i-th block of the partition and loads its entries.
+func (t *Table) decodeBlock(blk *block, part *indexPartition, i int) (*block, error) {
+	dataLen := len(blk.data)
+	compression := part.blockCompressionType(i, t.compression)
+	var err error
+	blk.data, err = compression.Decompress(blk.data)
 	if err != nil {
 		return &block{}, errors.Wrapf(err,
 			"failed to decode compressed data in file: %s at offset: %d, len: %d",
 			t.fd.Name(), blk.offset, dataLen)
 	}
-	blk.baseKey = index.baseKeys.getEntry(idx)
+	blk.baseKey = part.baseKeys.getEntry(i)
+	blk.restartInterval = t.restartInterval
+	blk.varintValue = t.varintValue
+	blk.loadEntries()
 	return blk, nil
 }
 
+// loadEntries loads the entryEndOffsets for binary searching for a key.
+func (b *block) loadEntries() {
+	// Get the number of entries from the end of `data` (and remove it).
+	dataLen := len(b.data)
+	b.baseLen = binary.LittleEndian.Uint16(b.data[dataLen-2:])
+	entriesNum := int(bytesToU32(b.data[dataLen-6:]))
+	entriesEnd := dataLen - 6
+	entriesStart := entriesEnd - entriesNum*4
+	b.entries.endOffs = bytesToU32Slice(b.data[entriesStart:entriesEnd])
+	b.entries.data = b.data[:entriesStart]
+}
+
 // HasGlobalTs returns table does set global ts.
 func (t *Table) HasGlobalTs() bool {
 	return t.globalTs != 0
 }
 
 // SetGlobalTs update the global ts of external ingested tables.
+// The ts is overwritten in place at the head of the index file and only the data is synced, as the
+// size of the file doesn't change. The write of 8 aligned bytes never crosses a sector so it is
+// atomic, and the footer checksum doesn't cover the ts, so the index is valid with either ts after a
+// crash. The ts is durable when it returns, before the table is added to the manifest. The index
+// file must implement io.WriterAt.
 func (t *Table) SetGlobalTs(ts uint64) error {
-	if _, err := t.indexFd.WriteAt(u64ToBytes(ts), 0); err != nil {
+	if ts == t.globalTs {
+		return nil
+	}
+	w, ok := t.indexFd.(io.WriterAt)
+	if !ok {
+		return errors.Errorf("index file %s is not writable", t.indexFd.Name())
+	}
+	if _, err := w.WriteAt(u64ToBytes(ts), 0); err != nil {
 		return err
 	}
-	if err := fileutil.Fsync(t.indexFd); err != nil {
+	if err := t.indexFd.Sync(); err != nil {
 		return err
 	}
 	t.globalTs = ts
@@ -543,6 +1147,12 @@ func (t *Table) blockCacheKey(idx int) uint64 {
 	return (t.ID() << 32) | uint64(idx)
 }
 
+// partitionCacheKey returns the block cache key of the index partition, the keys are allocated
+// from the top of the block index space.
+func (t *Table) partitionCacheKey(p int) uint64 {
+	return t.blockCacheKey(math.MaxUint32 - 1 - p)
+}
+
 // Size is its file size in bytes
 func (t *Table) Size() int64 { return t.tableSize }
 
@@ -18,6 +18,7 @@ package sstable
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -153,7 +154,7 @@ func TestTableIterator(t *testing.T) {
 	for _, n := range []int{99, 100, 101} {
 		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
 			f := buildTestTable(t, "key", n)
-			table, err := OpenTable(f.Name(), testCache(), testCache())
+			table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 			require.NoError(t, err)
 			defer table.Delete()
 			it := table.newIterator(false)
@@ -193,20 +194,20 @@ func TestHashIndexTS(t *testing.T) {
 	_, err = b.Finish()
 	y.Check(err)
 	f.Close()
-	table, err := OpenTable(filename, testCache(), testCache())
+	table, err := OpenTable(filename, options.FileIO, testCache(), testCache(), nil)
 	keyHash := farm.Fingerprint64([]byte("key"))
 
-	rk, _, ok, err := table.pointGet(y.KeyWithTs([]byte("key"), 10), keyHash)
+	rk, _, ok, err := table.pointGet(context.Background(), nil, y.KeyWithTs([]byte("key"), 10), keyHash)
 	require.NoError(t, err)
 	require.True(t, ok)
 	require.True(t, rk.Equal(keys[0]), "%s", string(rk.UserKey))
 
-	rk, _, ok, err = table.pointGet(y.KeyWithTs([]byte("key"), 6), keyHash)
+	rk, _, ok, err = table.pointGet(context.Background(), nil, y.KeyWithTs([]byte("key"), 6), keyHash)
 	require.NoError(t, err)
 	require.True(t, ok)
 	require.True(t, rk.Equal(keys[2]))
 
-	rk, _, ok, err = table.pointGet(y.KeyWithTs([]byte("key"), 2), keyHash)
+	rk, _, ok, err = table.pointGet(context.Background(), nil, y.KeyWithTs([]byte("key"), 2), keyHash)
 	require.NoError(t, err)
 	require.True(t, ok)
 	require.True(t, rk.Equal(keys[4]))
@@ -214,14 +215,14 @@ func TestHashIndexTS(t *testing.T) {
 
 func TestPointGet(t *testing.T) {
 	f := buildTestTable(t, "key", 8000)
-	table, err := OpenTable(f.Name(), testCache(), testCache())
+	table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 	require.NoError(t, err)
 	defer table.Delete()
 
 	for i := 0; i < 8000; i++ {
 		k := y.KeyWithTs([]byte(key("key", i)), math.MaxUint64)
 		keyHash := farm.Fingerprint64(k.UserKey)
-		k1, _, ok, err := table.pointGet(k, keyHash)
+		k1, _, ok, err := table.pointGet(context.Background(), nil, k, keyHash)
 		require.NoError(t, err)
 		if !ok {
 			// will fallback to seek
@@ -233,7 +234,7 @@ func TestPointGet(t *testing.T) {
 	for i := 8000; i < 10000; i++ {
 		k := y.KeyWithTs([]byte(key("key", i)), math.MaxUint64)
 		keyHash := farm.Fingerprint64(k.UserKey)
-		rk, _, ok, err := table.pointGet(k, keyHash)
+		rk, _, ok, err := table.pointGet(context.Background(), nil, k, keyHash)
 		require.NoError(t, err)
 		if !ok {
 			// will fallback to seek
@@ -247,6 +248,75 @@ func TestPointGet(t *testing.T) {
 	}
 }
 
+func TestBlockedBloomFilter(t *testing.T) {
+	filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), z.FastRand())
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	opt := defaultBuilderOpt
+	opt.SuRFStartLevel = 8
+	opt.FilterPolicy = options.BlockedBloomFilter
+	b := NewTableBuilder(f, nil, 0, opt)
+	n := 8000
+	for _, kv := range generateKeyValues("key", n) {
+		require.NoError(t, b.Add(y.KeyWithTs([]byte(kv[0]), 0), y.ValueStruct{Value: []byte(kv[1]), Meta: 'A', UserMeta: []byte{0}}))
+	}
+	_, err = b.Finish()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	table, err := OpenTable(filename, options.FileIO, testCache(), testCache(), nil)
+	require.NoError(t, err)
+	defer table.Delete()
+	idx, err := table.getIndex()
+	require.NoError(t, err)
+	require.Nil(t, idx.bf)
+	require.NotNil(t, idx.bbf)
+
+	for i := 0; i < n; i++ {
+		k := y.KeyWithTs([]byte(key("key", i)), math.MaxUint64)
+		v, err := table.Get(k, farm.Fingerprint64(k.UserKey))
+		require.NoError(t, err)
+		require.EqualValues(t, fmt.Sprintf("%d", i), string(v.Value))
+	}
+	var falsePositives int
+	for i := n; i < 2*n; i++ {
+		k := []byte(key("key", i))
+		if idx.bbf.has(farm.Fingerprint64(k)) {
+			falsePositives++
+		}
+	}
+	require.True(t, falsePositives < n/20, "false positives %d", falsePositives)
+}
+
+func TestTableMultiGet(t *testing.T) {
+	f := buildTestTable(t, "key", 8000)
+	table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
+	require.NoError(t, err)
+	defer table.Delete()
+
+	var keys []y.Key
+	var hashes []uint64
+	for i := 0; i < 10000; i += 7 {
+		k := y.KeyWithTs([]byte(key("key", i)), math.MaxUint64)
+		keys = append(keys, k)
+		hashes = append(hashes, farm.Fingerprint64(k.UserKey))
+		// A key between two keys of the table.
+		k = y.KeyWithTs([]byte(key("key", i)+"a"), math.MaxUint64)
+		keys = append(keys, k)
+		hashes = append(hashes, farm.Fingerprint64(k.UserKey))
+	}
+	vals := make([]y.ValueStruct, len(keys))
+	require.NoError(t, table.MultiGet(keys, hashes, vals))
+	for i, k := range keys {
+		if i%2 == 1 || i/2*7 >= 8000 {
+			require.False(t, vals[i].Valid(), "%s", k.UserKey)
+			continue
+		}
+		require.True(t, vals[i].Valid(), "%s", k.UserKey)
+		require.EqualValues(t, fmt.Sprintf("%d", i/2*7), string(vals[i].Value))
+	}
+}
+
 func TestExternalTable(t *testing.T) {
 	filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), rand.Uint32())
 	f, err := y.OpenSyncedFile(filename, true)
@@ -271,12 +341,12 @@ func TestExternalTable(t *testing.T) {
 	_, err = b.Finish()
 	y.Check(err)
 	f.Close()
-	table, err := OpenTable(filename, testCache(), testCache())
+	table, err := OpenTable(filename, options.FileIO, testCache(), testCache(), nil)
 	require.NoError(t, err)
 	require.NoError(t, table.SetGlobalTs(10))
 
 	require.NoError(t, table.Close())
-	table, err = OpenTable(filename, testCache(), testCache())
+	table, err = OpenTable(filename, options.FileIO, testCache(), testCache(), nil)
 	require.NoError(t, err)
 	defer table.Delete()
 
@@ -293,11 +363,851 @@ func TestExternalTable(t *testing.T) {
 	require.Equal(t, count, n)
 }
 
+func TestSplitExternalTable(t *testing.T) {
+	newFile := func() (*os.File, error) {
+		filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), rand.Uint32())
+		return y.OpenSyncedFile(filename, true)
+	}
+	n := 5000
+	b := NewSplitExternalTableBuilder(newFile, 16*1024, nil, defaultBuilderOpt, compressionType)
+	for _, kv := range generateKeyValues("key", n) {
+		require.NoError(t, b.Add(y.KeyWithTs([]byte(kv[0]), 0), y.ValueStruct{Value: []byte(kv[1]), Meta: 'A', UserMeta: []byte{0}}))
+	}
+	results, err := b.Finish()
+	require.NoError(t, err)
+	require.True(t, len(results) > 1)
+
+	var count int
+	for _, result := range results {
+		table, err := OpenTable(result.FileName, options.FileIO, testCache(), testCache(), nil)
+		require.NoError(t, err)
+		require.NoError(t, table.SetGlobalTs(10))
+		require.EqualValues(t, key("key", count), table.Smallest().UserKey)
+		it := table.newIterator(false)
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.EqualValues(t, key("key", count), it.Key().UserKey)
+			require.EqualValues(t, fmt.Sprintf("%d", count), string(it.Value().Value))
+			count++
+		}
+		it.Close()
+		require.EqualValues(t, key("key", count-1), table.Biggest().UserKey)
+		require.NoError(t, table.Delete())
+	}
+	require.Equal(t, n, count)
+}
+
+func TestTableCompression(t *testing.T) {
+	for _, tp := range []options.CompressionType{options.None, options.Snappy, options.ZSTD, options.LZ4} {
+		filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), z.FastRand())
+		f, err := y.OpenSyncedFile(filename, true)
+		require.NoError(t, err)
+		opt := defaultBuilderOpt
+		opt.CompressionPerLevel = []options.CompressionType{tp}
+		b := NewTableBuilder(f, nil, 0, opt)
+		n := 1000
+		for _, kv := range generateKeyValues("key", n) {
+			require.NoError(t, b.Add(y.KeyWithTs([]byte(kv[0]), 0), y.ValueStruct{Value: []byte(kv[1]), Meta: 'A', UserMeta: []byte{0}}))
+		}
+		_, err = b.Finish()
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		blkCache, err := cache.NewCache(&cache.Config{NumCounters: 1000, MaxCost: 1 << 20, BufferItems: 64})
+		require.NoError(t, err)
+		table, err := OpenTable(filename, options.FileIO, blkCache, nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, tp, table.CompressionType())
+		it := table.newIterator(false)
+		count := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.EqualValues(t, key("key", count), string(it.Key().UserKey))
+			require.EqualValues(t, fmt.Sprintf("%d", count), string(it.Value().Value))
+			count++
+		}
+		require.Equal(t, n, count)
+		it.Close()
+		require.NoError(t, table.Delete())
+	}
+}
+
+func TestCompressedBlockCache(t *testing.T) {
+	for _, mode := range []options.TableLoadingMode{options.FileIO, options.MemoryMap} {
+		f := buildTestTable(t, "key", 1000)
+		blkCache, compressedCache := testCache(), testCache()
+		table, err := OpenTable(f.Name(), mode, blkCache, nil, nil)
+		require.NoError(t, err)
+		table.SetCompressedBlockCache(compressedCache)
+		checkTable := func() {
+			it := table.newIterator(false)
+			defer it.Close()
+			count := 0
+			for it.Rewind(); it.Valid(); it.Next() {
+				require.EqualValues(t, key("key", count), string(it.Key().UserKey))
+				require.EqualValues(t, fmt.Sprintf("%d", count), string(it.Value().Value))
+				count++
+			}
+			require.Equal(t, 1000, count)
+		}
+		checkTable()
+		// The blocks which are not compressed are not cached in the compressed block cache.
+		misses := compressedCache.Metrics.Misses()
+		require.True(t, misses > 0)
+
+		// The blocks evicted from the block cache are decompressed from the compressed block cache.
+		for blk := 0; blk < table.numBlocks; blk++ {
+			key := table.blockCacheKey(blk)
+			if v, ok := blkCache.Get(key); ok {
+				v.(*block).done()
+				blkCache.Del(key)
+			}
+		}
+		checkTable()
+		require.Equal(t, misses, compressedCache.Metrics.Misses())
+		require.Equal(t, misses, compressedCache.Metrics.Hits())
+		require.NoError(t, table.Delete())
+		_, ok := compressedCache.Get(table.blockCacheKey(0))
+		require.False(t, ok)
+	}
+}
+
+func TestMemoryMapLoadingMode(t *testing.T) {
+	for _, tp := range []options.CompressionType{options.None, options.Snappy} {
+		filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), z.FastRand())
+		f, err := y.OpenSyncedFile(filename, true)
+		require.NoError(t, err)
+		opt := defaultBuilderOpt
+		opt.CompressionPerLevel = []options.CompressionType{tp}
+		b := NewTableBuilder(f, nil, 0, opt)
+		n := 1000
+		for _, kv := range generateKeyValues("key", n) {
+			require.NoError(t, b.Add(y.KeyWithTs([]byte(kv[0]), 0), y.ValueStruct{Value: []byte(kv[1]), Meta: 'A', UserMeta: []byte{0}}))
+		}
+		_, err = b.Finish()
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		table, err := OpenTable(filename, options.MemoryMap, testCache(), testCache(), nil)
+		require.NoError(t, err)
+		require.NotEmpty(t, table.blocksData)
+		idx, err := table.getIndex()
+		require.NoError(t, err)
+		blk, err := table.block(0, idx)
+		require.NoError(t, err)
+		mapped := tp == options.None
+		require.Equal(t, mapped, table.isMappedBlock(0, idx))
+		require.Equal(t, mapped, &blk.data[0] == &table.blocksData[0])
+		blk.done()
+
+		it := table.newIterator(false)
+		count := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.EqualValues(t, key("key", count), string(it.Key().UserKey))
+			require.EqualValues(t, fmt.Sprintf("%d", count), string(it.Value().Value))
+			count++
+		}
+		require.Equal(t, n, count)
+		it.Close()
+		require.NoError(t, table.Delete())
+	}
+}
+
+func TestDirectIOIterator(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "sst")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := NewFilename(1, dir)
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	opt := defaultBuilderOpt
+	opt.DirectIO = true
+	b := NewTableBuilder(f, nil, 0, opt)
+	n := 10000
+	for _, kv := range generateKeyValues("key", n) {
+		require.NoError(t, b.Add(y.KeyWithTs([]byte(kv[0]), 0), y.ValueStruct{Value: []byte(kv[1]), Meta: 'A', UserMeta: []byte{0}}))
+	}
+	_, err = b.Finish()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	blkCache := testCache()
+	table, err := OpenTable(filename, options.FileIO, blkCache, testCache(), nil)
+	require.NoError(t, err)
+	defer table.Delete()
+	it := table.newIterator(false)
+	it.SetDirectIO()
+	if it.dio == nil {
+		t.Log("direct io is not supported by the file system")
+	}
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.EqualValues(t, key("key", count), string(it.Key().UserKey))
+		require.EqualValues(t, fmt.Sprintf("%d", count), string(it.Value().Value))
+		count++
+	}
+	require.Equal(t, n, count)
+	it.Seek([]byte(key("key", 5000)))
+	require.True(t, it.Valid())
+	require.EqualValues(t, key("key", 5000), string(it.Key().UserKey))
+	if it.dio != nil {
+		_, ok := blkCache.Get(table.blockCacheKey(0))
+		require.False(t, ok)
+	}
+	require.NoError(t, it.Close())
+}
+
+func TestIncompressibleBlocks(t *testing.T) {
+	filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), z.FastRand())
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	opt := defaultBuilderOpt
+	opt.CompressionPerLevel = []options.CompressionType{options.Snappy}
+	b := NewTableBuilder(f, nil, 0, opt)
+	// The first half of the values are random bytes which can't be compressed.
+	n := 1000
+	vals := make([][]byte, n)
+	for i := range vals {
+		vals[i] = make([]byte, 100)
+		if i < n/2 {
+			rand.Read(vals[i])
+		}
+		require.NoError(t, b.Add(y.KeyWithTs([]byte(key("key", i)), 0), y.ValueStruct{Value: vals[i], Meta: 'A'}))
+	}
+	_, err = b.Finish()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	table, err := OpenTable(filename, options.FileIO, nil, nil, nil)
+	require.NoError(t, err)
+	defer table.Delete()
+	require.Equal(t, options.Snappy, table.CompressionType())
+	idx, err := table.getIndex()
+	require.NoError(t, err)
+	require.Len(t, idx.blockCompression, len(idx.blockEndOffsets))
+	require.Equal(t, byte(options.None), idx.blockCompression[0])
+	require.Equal(t, byte(options.Snappy), idx.blockCompression[len(idx.blockCompression)-1])
+
+	it := table.newIterator(false)
+	defer it.Close()
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		require.EqualValues(t, key("key", count), string(it.Key().UserKey))
+		require.Equal(t, vals[count], it.Value().Value)
+		count++
+	}
+	require.Equal(t, n, count)
+}
+
+func dumpTestConfig(t *testing.T, filename string) *OpenTableConfig {
+	id, ok := ParseFileID(filename)
+	require.True(t, ok)
+	fd, err := OpenLocalFile(filename)
+	require.NoError(t, err)
+	indexFd, err := OpenLocalFile(IndexFilename(filename))
+	require.NoError(t, err)
+	return &OpenTableConfig{File: fd, IndexFile: indexFd, ID: id, LoadingMode: options.FileIO}
+}
+
+func TestDump(t *testing.T) {
+	f := buildTestTable(t, "key", 1000)
+	defer os.Remove(f.Name())
+	defer os.Remove(IndexFilename(f.Name()))
+	buf := new(bytes.Buffer)
+	require.NoError(t, Dump(buf, dumpTestConfig(t, f.Name())))
+	out := buf.String()
+	require.Contains(t, out, "Compression: ZSTD")
+	require.Contains(t, out, fmt.Sprintf("Smallest:    %q", key("key", 0)))
+	require.Contains(t, out, fmt.Sprintf("Biggest:     %q", key("key", 999)))
+	require.Contains(t, out, "Block 0 offset 0 ")
+	require.Contains(t, out, "bad blocks 0")
+	require.Contains(t, out, "Keys 1000, versions 1000")
+
+	// A corrupted block is reported in its line and the other blocks are still dumped.
+	tbl, err := OpenTable(f.Name(), options.FileIO, nil, nil, nil)
+	require.NoError(t, err)
+	idx, err := tbl.getIndex()
+	require.NoError(t, err)
+	numBlocks := idx.numBlocks()
+	require.True(t, numBlocks > 2)
+	start, end := idx.blockOffsets(1)
+	require.NoError(t, tbl.Close())
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(start)+1)
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, Dump(buf, dumpTestConfig(t, f.Name())))
+	out = buf.String()
+	require.Contains(t, out, fmt.Sprintf("Block 1 offset %d size %d error: ", start, end-start))
+	require.Contains(t, out, "Block 2 offset ")
+	require.Contains(t, out, fmt.Sprintf("Block %d offset ", numBlocks-1))
+	require.Contains(t, out, "bad blocks 1")
+}
+
+func TestVerifyBlockChecksumOnLoad(t *testing.T) {
+	f := buildTestTable(t, "key", 1000)
+	defer os.Remove(f.Name())
+	defer os.Remove(IndexFilename(f.Name()))
+	for _, blockCache := range []*cache.Cache{nil, testCache()} {
+		tbl, err := OpenTable(f.Name(), options.FileIO, blockCache, testCache(), nil)
+		require.NoError(t, err)
+		tbl.SetVerifyBlockChecksum(true)
+		idx, err := tbl.getIndex()
+		require.NoError(t, err)
+		blk, err := tbl.block(1, idx)
+		require.NoError(t, err)
+		blk.done()
+
+		start, end := idx.blockOffsets(2)
+		orig := make([]byte, 1)
+		_, err = f.ReadAt(orig, int64(start)+1)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{orig[0] ^ 0xff}, int64(start)+1)
+		require.NoError(t, err)
+		_, err = tbl.block(2, idx)
+		require.Equal(t, &CorruptBlockError{Offset: int64(start), Len: int(end - start)}, err)
+		_, err = f.WriteAt(orig, int64(start)+1)
+		require.NoError(t, err)
+		require.NoError(t, tbl.Close())
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	f, _ := buildMultiVersionTable(generateKeyValues("key", 10000))
+	defer os.Remove(f.Name())
+	defer os.Remove(IndexFilename(f.Name()))
+	tbl, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
+	require.NoError(t, err)
+	require.True(t, tbl.oldBlockLen > 0)
+	require.Equal(t, tbl.numBlocks+1, len(tbl.blockChecksums))
+	limiter := rate.NewLimiter(rate.Inf, 1024)
+	require.NoError(t, tbl.VerifyChecksum(context.Background(), limiter))
+
+	idx, err := tbl.getIndex()
+	require.NoError(t, err)
+	start, end := idx.blockOffsets(1)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(start)+1)
+	require.NoError(t, err)
+	err = tbl.VerifyChecksum(context.Background(), limiter)
+	require.Equal(t, &CorruptBlockError{Offset: int64(start), Len: int(end - start)}, err)
+	require.NoError(t, tbl.Close())
+}
+
+func TestOpenInvalidTable(t *testing.T) {
+	f := buildTestTable(t, "key", 1000)
+	filename := f.Name()
+	f.Close()
+	defer os.Remove(filename)
+	defer os.Remove(IndexFilename(filename))
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	index, err := ioutil.ReadFile(IndexFilename(filename))
+	require.NoError(t, err)
+
+	open := func(data, index []byte) error {
+		require.NoError(t, ioutil.WriteFile(filename, data, 0666))
+		require.NoError(t, ioutil.WriteFile(IndexFilename(filename), index, 0666))
+		tbl, err := OpenTable(filename, options.FileIO, testCache(), testCache(), nil)
+		if err == nil {
+			require.NoError(t, tbl.Close())
+		}
+		return err
+	}
+	requireInvalid := func(err error, reason string) {
+		e, ok := err.(*InvalidTableError)
+		require.True(t, ok, "%v", err)
+		require.Contains(t, e.Reason, reason)
+		require.NotEmpty(t, e.Filename)
+	}
+	require.NoError(t, open(data, index))
+
+	corrupted := append([]byte{}, index...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	requireInvalid(open(data, corrupted), "checksum mismatch")
+	// The truncated index is read as an index without the footer.
+	requireInvalid(open(data, index[:len(index)-1]), "")
+	requireInvalid(open(data, index[:5]), "too small")
+	requireInvalid(open(data[:len(data)/2], index), "smaller than table size")
+	requireInvalid(open(data, []byte("not a badger table index")), "unknown index compression")
+
+	// The global ts is not covered by the checksum as it is updated on ingest.
+	withTs := append([]byte{}, index...)
+	copy(withTs, u64ToBytes(10))
+	require.NoError(t, open(data, withTs))
+	// The index written before the footer was added is still readable.
+	require.NoError(t, open(data, index[:len(index)-metaFooterSize]))
+}
+
+type countCollector struct {
+	keys, versions int
+}
+
+func (c *countCollector) Add(key []byte, version uint64, meta byte, userMeta, value []byte) {
+	if version == 9 {
+		c.keys++
+	}
+	c.versions++
+}
+
+func (c *countCollector) Finish() map[string][]byte {
+	return map[string][]byte{
+		"keys":     []byte(fmt.Sprintf("%d", c.keys)),
+		"versions": []byte(fmt.Sprintf("%d", c.versions)),
+	}
+}
+
+func TestTableProperties(t *testing.T) {
+	filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), z.FastRand())
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	opt := defaultBuilderOpt
+	opt.TablePropertiesCollectorFactory = func() options.TablePropertiesCollector {
+		return new(countCollector)
+	}
+	b := NewTableBuilder(f, nil, 0, opt)
+	n := 100
+	for i := 0; i < n; i++ {
+		k := []byte(key("key", i))
+		require.NoError(t, b.Add(y.KeyWithTs(k, 9), y.ValueStruct{Value: k}))
+		require.NoError(t, b.Add(y.KeyWithTs(k, 8), y.ValueStruct{Value: k}))
+	}
+	_, err = b.Finish()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	table, err := OpenTable(filename, options.FileIO, nil, nil, nil)
+	require.NoError(t, err)
+	defer table.Delete()
+	props := table.Properties()
+	require.Equal(t, "100", string(props["keys"]))
+	require.Equal(t, "200", string(props["versions"]))
+
+	// The table built without a collector has no properties.
+	f = buildTestTable(t, "key", n)
+	table2, err := OpenTable(f.Name(), options.FileIO, nil, nil, nil)
+	require.NoError(t, err)
+	defer table2.Delete()
+	require.Nil(t, table2.Properties())
+}
+
+func TestDecodeCorruptEntryStats(t *testing.T) {
+	buf := encodeEntryStats(&table.EntryStats{NumEntries: 3, NumDeletes: 1, MinVersion: 5, MaxVersion: 9, NumKeys: 2})
+	stats, err := decodeEntryStats(buf)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), stats.NumKeys)
+	// The stats written before numKeys was recorded.
+	stats, err = decodeEntryStats(buf[:32])
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), stats.NumKeys)
+	_, err = decodeEntryStats(buf[:31])
+	require.Error(t, err)
+}
+
+func TestDecodeCorruptProperties(t *testing.T) {
+	buf := encodeProperties(map[string][]byte{"keys": []byte("100"), "versions": []byte("200")})
+	props, err := decodeProperties(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("200"), props["versions"])
+	// The first property takes 13 bytes, the properties truncated at any other offset are corrupt.
+	for i := 1; i < len(buf); i++ {
+		_, err = decodeProperties(buf[:i])
+		if i == 13 {
+			require.NoError(t, err)
+		} else {
+			require.Equal(t, errCorruptProperties, err)
+		}
+	}
+}
+
+type testKeyRegistry struct {
+	key *options.DataKey
+}
+
+func (r *testKeyRegistry) LatestDataKey() *options.DataKey {
+	return r.key
+}
+
+func (r *testKeyRegistry) DataKey(id uint64) (*options.DataKey, error) {
+	if id != r.key.ID {
+		return nil, fmt.Errorf("data key %d not found", id)
+	}
+	return r.key, nil
+}
+
+func TestTableEncryption(t *testing.T) {
+	filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), z.FastRand())
+	f, err := y.OpenSyncedFile(filename, true)
+	require.NoError(t, err)
+	registry := &testKeyRegistry{key: &options.DataKey{ID: 3, Key: make([]byte, 32)}}
+	rand.Read(registry.key.Key)
+	opt := defaultBuilderOpt
+	opt.CompressionPerLevel = []options.CompressionType{options.Snappy}
+	opt.KeyRegistry = registry
+	b := NewTableBuilder(f, nil, 0, opt)
+	n := 1000
+	for i := 0; i < n; i++ {
+		k := []byte(key("key", i))
+		require.NoError(t, b.Add(y.KeyWithTs(k, 9), y.ValueStruct{Value: []byte(fmt.Sprintf("secret%d", i))}))
+		require.NoError(t, b.Add(y.KeyWithTs(k, 8), y.ValueStruct{Value: []byte(fmt.Sprintf("old secret%d", i))}))
+	}
+	_, err = b.Finish()
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	for _, name := range []string{filename, IndexFilename(filename)} {
+		data, err := ioutil.ReadFile(name)
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(data, []byte("secret")))
+		require.False(t, bytes.Contains(data, []byte("key")))
+	}
+
+	_, err = OpenTable(filename, options.FileIO, nil, nil, nil)
+	require.Error(t, err)
+	for _, blkCache := range []*cache.Cache{nil, testCache()} {
+		table, err := OpenTable(filename, options.FileIO, blkCache, nil, registry)
+		require.NoError(t, err)
+		require.Equal(t, options.Snappy, table.CompressionType())
+		it := table.newIterator(false)
+		count := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.EqualValues(t, key("key", count), string(it.Key().UserKey))
+			require.EqualValues(t, fmt.Sprintf("secret%d", count), string(it.Value().Value))
+			require.True(t, it.NextVersion())
+			require.EqualValues(t, fmt.Sprintf("old secret%d", count), string(it.Value().Value))
+			count++
+		}
+		it.Close()
+		require.Equal(t, n, count)
+
+		k := []byte(key("key", 500))
+		vs, err := table.Get(y.KeyWithTs(k, 8), farm.Fingerprint64(k))
+		require.NoError(t, err)
+		require.EqualValues(t, "old secret500", string(vs.Value))
+		require.NoError(t, table.Close())
+	}
+	os.Remove(filename)
+	os.Remove(IndexFilename(filename))
+}
+
+func TestPartitionedIndex(t *testing.T) {
+	for _, surfStartLevel := range []int{0, 8} {
+		filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), z.FastRand())
+		f, err := y.OpenSyncedFile(filename, true)
+		require.NoError(t, err)
+		opt := defaultBuilderOpt
+		opt.SuRFStartLevel = surfStartLevel
+		opt.BlockSize = 256
+		opt.IndexPartitionSize = 512
+		b := NewTableBuilder(f, nil, 0, opt)
+		n := 2000
+		for i := 0; i < n; i++ {
+			k := []byte(key("key", i*2))
+			require.NoError(t, b.Add(y.KeyWithTs(k, 9), y.ValueStruct{Value: []byte(fmt.Sprintf("%d", i))}))
+			require.NoError(t, b.Add(y.KeyWithTs(k, 8), y.ValueStruct{Value: []byte(fmt.Sprintf("old%d", i))}))
+		}
+		_, err = b.Finish()
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		for _, blkCache := range []*cache.Cache{nil, testCache()} {
+			table, err := OpenTable(filename, options.FileIO, blkCache, testCache(), nil)
+			require.NoError(t, err)
+			idx, err := table.getIndex()
+			require.NoError(t, err)
+			require.NotNil(t, idx.partitions)
+			require.True(t, len(idx.partitions.loaded) > 1)
+			require.Equal(t, table.numBlocks, idx.numBlocks())
+
+			it := table.newIterator(false)
+			count := 0
+			for it.Rewind(); it.Valid(); it.Next() {
+				require.EqualValues(t, key("key", count*2), string(it.Key().UserKey))
+				require.EqualValues(t, fmt.Sprintf("%d", count), string(it.Value().Value))
+				require.True(t, it.NextVersion())
+				require.EqualValues(t, fmt.Sprintf("old%d", count), string(it.Value().Value))
+				count++
+			}
+			require.Equal(t, n, count)
+			for i := 0; i < n; i++ {
+				it.Seek([]byte(key("key", i*2+1)))
+				if i == n-1 {
+					require.False(t, it.Valid())
+					continue
+				}
+				require.True(t, it.Valid())
+				require.EqualValues(t, key("key", i*2+2), string(it.Key().UserKey))
+			}
+			it.Close()
+
+			rit := table.newIterator(true)
+			for i := 0; i < n; i++ {
+				rit.Seek([]byte(key("key", i*2+1)))
+				require.True(t, rit.Valid())
+				require.EqualValues(t, key("key", i*2), string(rit.Key().UserKey))
+			}
+			rit.Close()
+
+			for i := 0; i < n; i++ {
+				k := []byte(key("key", i*2))
+				vs, err := table.Get(y.KeyWithTs(k, 9), farm.Fingerprint64(k))
+				require.NoError(t, err)
+				require.EqualValues(t, fmt.Sprintf("%d", i), string(vs.Value))
+			}
+			require.NoError(t, table.Close())
+		}
+		os.Remove(filename)
+		os.Remove(IndexFilename(filename))
+	}
+}
+
+func TestRestartInterval(t *testing.T) {
+	restartKey := func(i int) []byte {
+		return []byte(fmt.Sprintf("table_%05d/index_%03d/record_%08d", i/8, i%8/4, i*2))
+	}
+	n := 3000
+	var sizes []int64
+	for _, interval := range []int{0, 16} {
+		filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), z.FastRand())
+		f, err := y.OpenSyncedFile(filename, true)
+		require.NoError(t, err)
+		opt := defaultBuilderOpt
+		opt.SuRFStartLevel = 8
+		opt.BlockSize = 1024
+		opt.CompressionPerLevel = []options.CompressionType{options.None}
+		opt.RestartInterval = interval
+		b := NewTableBuilder(f, nil, 0, opt)
+		for i := 0; i < n; i++ {
+			k := restartKey(i)
+			require.NoError(t, b.Add(y.KeyWithTs(k, 9), y.ValueStruct{Value: []byte(fmt.Sprintf("%d", i))}))
+			if i%3 == 0 {
+				require.NoError(t, b.Add(y.KeyWithTs(k, 8), y.ValueStruct{Value: []byte(fmt.Sprintf("old%d", i))}))
+			}
+		}
+		_, err = b.Finish()
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		table, err := OpenTable(filename, options.FileIO, testCache(), testCache(), nil)
+		require.NoError(t, err)
+		sizes = append(sizes, table.Size())
+
+		it := table.newIterator(false)
+		count := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.EqualValues(t, restartKey(count), it.Key().UserKey)
+			require.EqualValues(t, fmt.Sprintf("%d", count), string(it.Value().Value))
+			if count%3 == 0 {
+				require.True(t, it.NextVersion())
+				require.EqualValues(t, fmt.Sprintf("old%d", count), string(it.Value().Value))
+			}
+			count++
+		}
+		require.Equal(t, n, count)
+		for i := 0; i < n; i++ {
+			it.Seek(restartKey(i))
+			require.True(t, it.Valid())
+			require.EqualValues(t, restartKey(i), it.Key().UserKey)
+			it.Seek(append(restartKey(i), 0))
+			if i == n-1 {
+				require.False(t, it.Valid())
+				continue
+			}
+			require.True(t, it.Valid())
+			require.EqualValues(t, restartKey(i+1), it.Key().UserKey)
+		}
+		it.Close()
+
+		rit := table.newIterator(true)
+		count = n
+		for rit.Rewind(); rit.Valid(); rit.Next() {
+			count--
+			require.EqualValues(t, restartKey(count), rit.Key().UserKey)
+		}
+		require.Equal(t, 0, count)
+		for i := 0; i < n; i++ {
+			rit.Seek(append(restartKey(i), 0))
+			require.True(t, rit.Valid())
+			require.EqualValues(t, restartKey(i), rit.Key().UserKey)
+			rit.Next()
+			if i == 0 {
+				require.False(t, rit.Valid())
+				continue
+			}
+			require.True(t, rit.Valid())
+			require.EqualValues(t, restartKey(i-1), rit.Key().UserKey)
+		}
+		rit.Close()
+
+		for i := 0; i < n; i++ {
+			k := restartKey(i)
+			vs, err := table.Get(y.KeyWithTs(k, 9), farm.Fingerprint64(k))
+			require.NoError(t, err)
+			require.EqualValues(t, fmt.Sprintf("%d", i), string(vs.Value))
+		}
+		require.NoError(t, table.Delete())
+	}
+	require.True(t, sizes[1] < sizes[0], "%v", sizes)
+}
+
+func TestVarintValue(t *testing.T) {
+	n := 3000
+	var sizes []int64
+	for _, varint := range []bool{false, true} {
+		filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), z.FastRand())
+		f, err := y.OpenSyncedFile(filename, true)
+		require.NoError(t, err)
+		opt := defaultBuilderOpt
+		opt.CompressionPerLevel = []options.CompressionType{options.None}
+		opt.VarintValue = varint
+		b := NewTableBuilder(f, nil, 0, opt)
+		for i := 0; i < n; i++ {
+			k := []byte(key("key", i))
+			vs := y.ValueStruct{Value: []byte(fmt.Sprintf("%020d", i)), UserMeta: []byte{byte(i)}}
+			if i%2 == 0 {
+				vs.Meta = y.BitExpiresAt
+				vs.ExpiresAt = uint64(i) << 20
+			}
+			require.NoError(t, b.Add(y.KeyWithTs(k, uint64(i)<<10+9), vs))
+			if i%3 == 0 {
+				require.NoError(t, b.Add(y.KeyWithTs(k, 8), y.ValueStruct{Meta: y.BitDelete}))
+			}
+		}
+		_, err = b.Finish()
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		table, err := OpenTable(filename, options.FileIO, testCache(), testCache(), nil)
+		require.NoError(t, err)
+		sizes = append(sizes, table.Size())
+
+		it := table.newIterator(false)
+		count := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.EqualValues(t, key("key", count), it.Key().UserKey)
+			require.EqualValues(t, uint64(count)<<10+9, it.Key().Version)
+			vs := it.Value()
+			require.EqualValues(t, fmt.Sprintf("%020d", count), string(vs.Value))
+			require.EqualValues(t, []byte{byte(count)}, vs.UserMeta)
+			if count%2 == 0 {
+				require.EqualValues(t, uint64(count)<<20, vs.ExpiresAt)
+			} else {
+				require.Zero(t, vs.ExpiresAt)
+			}
+			if count%3 == 0 {
+				require.True(t, it.NextVersion())
+				require.EqualValues(t, 8, it.Key().Version)
+				vs = it.Value()
+				require.Equal(t, y.BitDelete, vs.Meta)
+				require.Len(t, vs.Value, 0)
+			}
+			require.False(t, it.NextVersion())
+			count++
+		}
+		require.Equal(t, n, count)
+		it.Close()
+
+		for i := 0; i < n; i++ {
+			k := []byte(key("key", i))
+			vs, err := table.Get(y.KeyWithTs(k, math.MaxUint64), farm.Fingerprint64(k))
+			require.NoError(t, err)
+			require.EqualValues(t, fmt.Sprintf("%020d", i), string(vs.Value))
+		}
+		require.NoError(t, table.Delete())
+	}
+	require.True(t, sizes[1] < sizes[0], "%v", sizes)
+}
+
+func TestSeekWithHint(t *testing.T) {
+	n := 5000
+	for _, interval := range []int{0, 16} {
+		filename := fmt.Sprintf("%s%s%x.sst", os.TempDir(), string(os.PathSeparator), z.FastRand())
+		f, err := y.OpenSyncedFile(filename, true)
+		require.NoError(t, err)
+		opt := defaultBuilderOpt
+		opt.BlockSize = 1024
+		opt.RestartInterval = interval
+		b := NewTableBuilder(f, nil, 0, opt)
+		for i := 0; i < n; i++ {
+			k := []byte(key("key", i*2))
+			require.NoError(t, b.Add(y.KeyWithTs(k, 9), y.ValueStruct{Value: k}))
+			if i%3 == 0 {
+				require.NoError(t, b.Add(y.KeyWithTs(k, 8), y.ValueStruct{Value: []byte("old")}))
+			}
+		}
+		_, err = b.Finish()
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		table, err := OpenTable(filename, options.FileIO, testCache(), testCache(), nil)
+		require.NoError(t, err)
+
+		it := table.newIterator(false)
+		expected := table.newIterator(false)
+		check := func(k []byte) {
+			it.SeekWithHint(k)
+			expected.Seek(k)
+			require.Equal(t, expected.Valid(), it.Valid(), "%s", k)
+			if expected.Valid() {
+				require.Equal(t, expected.Key(), it.Key(), "%s", k)
+				require.Equal(t, expected.Value().Value, it.Value().Value, "%s", k)
+			}
+		}
+		var i int
+		for i < n*2+10 {
+			k := []byte(key("key", i))
+			check(k)
+			if i%6 == 0 && it.Valid() {
+				// The key is sought again from an older version.
+				require.True(t, it.NextVersion())
+				check(k)
+			}
+			// The steps cross the blocks sometimes.
+			i += int(z.FastRand() % 150)
+		}
+		// Seeking backward falls back to Seek.
+		check([]byte(key("key", 100)))
+		check([]byte(key("key", n*2+10)))
+		check([]byte(key("key", 100)))
+		it.Close()
+		expected.Close()
+		require.NoError(t, table.Delete())
+	}
+}
+
+func TestIteratorReset(t *testing.T) {
+	prefixes := []string{"a", "b", "c"}
+	var tables []*Table
+	for i, prefix := range prefixes {
+		f := buildTestTable(t, prefix, 1000*(i+1))
+		table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
+		require.NoError(t, err)
+		defer table.Delete()
+		tables = append(tables, table)
+	}
+	it := tables[0].newIterator(false)
+	defer it.Close()
+	for i, table := range tables {
+		for _, reversed := range []bool{false, true} {
+			it.Reset(table, reversed)
+			n := 1000 * (i + 1)
+			count := 0
+			for it.Rewind(); it.Valid(); it.Next() {
+				idx := count
+				if reversed {
+					idx = n - 1 - count
+				}
+				require.EqualValues(t, key(prefixes[i], idx), it.Key().UserKey)
+				count++
+			}
+			require.Equal(t, n, count)
+			it.Seek([]byte(key(prefixes[i], 10)))
+			require.True(t, it.Valid())
+			require.EqualValues(t, key(prefixes[i], 10), it.Key().UserKey)
+		}
+	}
+}
+
 func TestSeekToFirst(t *testing.T) {
 	for _, n := range []int{99, 100, 101, 199, 200, 250, 9999, 10000} {
 		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
 			f := buildTestTable(t, "key", n)
-			table, err := OpenTable(f.Name(), testCache(), testCache())
+			table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 			require.NoError(t, err)
 			defer table.Delete()
 			it := table.newIterator(false)
@@ -315,7 +1225,7 @@ func TestSeekToLast(t *testing.T) {
 	for _, n := range []int{99, 100, 101, 199, 200, 250, 9999, 10000} {
 		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
 			f := buildTestTable(t, "key", n)
-			table, err := OpenTable(f.Name(), testCache(), testCache())
+			table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 			require.NoError(t, err)
 			defer table.Delete()
 			it := table.newIterator(false)
@@ -336,7 +1246,7 @@ func TestSeekToLast(t *testing.T) {
 
 func TestSeekBasic(t *testing.T) {
 	f := buildTestTable(t, "k", 10000)
-	table, err := OpenTable(f.Name(), testCache(), testCache())
+	table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 	require.NoError(t, err)
 	defer table.Delete()
 
@@ -369,9 +1279,70 @@ func TestSeekBasic(t *testing.T) {
 	}
 }
 
+func TestSeekReuseBlock(t *testing.T) {
+	f := buildTestTable(t, "k", 10000)
+	table, err := OpenTable(f.Name(), options.FileIO, nil, nil, nil)
+	require.NoError(t, err)
+	defer table.Delete()
+
+	it := table.newIterator(false)
+	defer it.Close()
+
+	it.seek([]byte("k0100"))
+	require.True(t, it.Valid())
+	blk := it.bi.block
+	for _, k := range []string{"k0102", "k0100", "k0101"} {
+		it.seek([]byte(k))
+		require.True(t, it.Valid())
+		require.EqualValues(t, k, string(it.Key().UserKey))
+		require.True(t, blk == it.bi.block)
+	}
+	it.seek([]byte("k9999"))
+	require.True(t, it.Valid())
+	require.EqualValues(t, "k9999", string(it.Key().UserKey))
+	require.False(t, blk == it.bi.block)
+}
+
+func TestIteratorReadahead(t *testing.T) {
+	f := buildTestTable(t, "k", 10000)
+	table, err := OpenTable(f.Name(), options.FileIO, testCache(), nil, nil)
+	require.NoError(t, err)
+	defer table.Delete()
+	idx, err := table.getIndex()
+	require.NoError(t, err)
+	numBlocks := len(idx.blockEndOffsets)
+	require.True(t, numBlocks > 10)
+	cached := func(idx int) bool {
+		_, ok := table.blockCache.Get(table.blockCacheKey(idx))
+		return ok
+	}
+
+	it := table.newIterator(false)
+	it.SetReadahead(4)
+	for it.Rewind(); it.bpos < 1; it.Next() {
+		require.True(t, it.Valid())
+	}
+	it.Close()
+	for idx := 2; idx <= 5; idx++ {
+		require.True(t, cached(idx), idx)
+	}
+	require.False(t, cached(6))
+
+	it = table.newIterator(true)
+	it.SetReadahead(3)
+	for it.Rewind(); it.bpos > numBlocks-2; it.Next() {
+		require.True(t, it.Valid())
+	}
+	it.Close()
+	for idx := numBlocks - 3; idx >= numBlocks-5; idx-- {
+		require.True(t, cached(idx), idx)
+	}
+	require.False(t, cached(numBlocks-6))
+}
+
 func TestSeekForPrev(t *testing.T) {
 	f := buildTestTable(t, "k", 10000)
-	table, err := OpenTable(f.Name(), testCache(), testCache())
+	table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 	require.NoError(t, err)
 	defer table.Delete()
 
@@ -402,6 +1373,22 @@ func TestSeekForPrev(t *testing.T) {
 		k := it.Key()
 		require.EqualValues(t, tt.out, string(k.UserKey))
 	}
+
+	// Every key including the first and last keys of the blocks.
+	for i := 0; i < 10000; i++ {
+		for _, in := range []string{key("k", i), key("k", i) + "b"} {
+			it.seekForPrev([]byte(in))
+			require.True(t, it.Valid())
+			require.EqualValues(t, key("k", i), string(it.Key().UserKey))
+		}
+		it.prev()
+		if i == 0 {
+			require.False(t, it.Valid())
+			continue
+		}
+		require.True(t, it.Valid())
+		require.EqualValues(t, key("k", i-1), string(it.Key().UserKey))
+	}
 }
 
 func TestIterateFromStart(t *testing.T) {
@@ -409,7 +1396,7 @@ func TestIterateFromStart(t *testing.T) {
 	for _, n := range []int{99, 100, 101, 199, 200, 250, 9999, 10000} {
 		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
 			f := buildTestTable(t, "key", n)
-			table, err := OpenTable(f.Name(), testCache(), testCache())
+			table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 			require.NoError(t, err)
 			defer table.Delete()
 			ti := table.newIterator(false)
@@ -436,7 +1423,7 @@ func TestIterateFromEnd(t *testing.T) {
 	for _, n := range []int{99, 100, 101, 199, 200, 250, 9999, 10000} {
 		t.Run(fmt.Sprintf("n=%d", n), func(t *testing.T) {
 			f := buildTestTable(t, "key", n)
-			table, err := OpenTable(f.Name(), testCache(), testCache())
+			table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 			require.NoError(t, err)
 			defer table.Delete()
 			ti := table.newIterator(false)
@@ -460,7 +1447,7 @@ func TestIterateFromEnd(t *testing.T) {
 
 func TestTable(t *testing.T) {
 	f := buildTestTable(t, "key", 10000)
-	table, err := OpenTable(f.Name(), testCache(), testCache())
+	table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 	require.NoError(t, err)
 	defer table.Delete()
 	ti := table.newIterator(false)
@@ -487,7 +1474,7 @@ func TestTable(t *testing.T) {
 
 func TestIterateBackAndForth(t *testing.T) {
 	f := buildTestTable(t, "key", 10000)
-	table, err := OpenTable(f.Name(), testCache(), testCache())
+	table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 	require.NoError(t, err)
 	defer table.Delete()
 
@@ -528,7 +1515,7 @@ func TestIterateBackAndForth(t *testing.T) {
 
 func TestIterateMultiVersion(t *testing.T) {
 	f, allCnt := buildMultiVersionTable(generateKeyValues("key", 4000))
-	table, err := OpenTable(f.Name(), testCache(), testCache())
+	table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 	require.NoError(t, err)
 	defer table.Delete()
 	it := table.newIterator(false)
@@ -549,7 +1536,7 @@ func TestIterateMultiVersion(t *testing.T) {
 	for i := 0; i < 1000; i++ {
 		k := y.KeyWithTs([]byte(key("key", int(z.FastRand()%4000))), uint64(5+z.FastRand()%5))
 		kHash := farm.Fingerprint64(k.UserKey)
-		gotKey, _, ok, _ := table.pointGet(k, kHash)
+		gotKey, _, ok, _ := table.pointGet(context.Background(), nil, k, kHash)
 		if ok {
 			if !gotKey.IsEmpty() {
 				require.True(t, gotKey.SameUserKey(k))
@@ -589,7 +1576,7 @@ func TestIterateMultiVersion(t *testing.T) {
 
 func TestUniIterator(t *testing.T) {
 	f := buildTestTable(t, "key", 10000)
-	table, err := OpenTable(f.Name(), testCache(), testCache())
+	table, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 	require.NoError(t, err)
 	defer table.Delete()
 	{
@@ -625,7 +1612,7 @@ func TestConcatIteratorOneTable(t *testing.T) {
 		{"k2", "a2"},
 	})
 
-	tbl, err := OpenTable(f.Name(), testCache(), testCache())
+	tbl, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 	require.NoError(t, err)
 	defer tbl.Delete()
 
@@ -646,13 +1633,13 @@ func TestConcatIterator(t *testing.T) {
 	f2 := buildTestTable(t, "keyb", 10000)
 	f3 := buildTestTable(t, "keyc", 10000)
 	blkCache, idxCache := testCache(), testCache()
-	tbl, err := OpenTable(f.Name(), blkCache, idxCache)
+	tbl, err := OpenTable(f.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer tbl.Delete()
-	tbl2, err := OpenTable(f2.Name(), blkCache, idxCache)
+	tbl2, err := OpenTable(f2.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer tbl2.Delete()
-	tbl3, err := OpenTable(f3.Name(), blkCache, idxCache)
+	tbl3, err := OpenTable(f3.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer tbl3.Delete()
 
@@ -732,10 +1719,10 @@ func TestMergingIterator(t *testing.T) {
 		{"k2", "b2"},
 	})
 	blkCache, idxCache := testCache(), testCache()
-	tbl1, err := OpenTable(f1.Name(), blkCache, idxCache)
+	tbl1, err := OpenTable(f1.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer tbl1.Delete()
-	tbl2, err := OpenTable(f2.Name(), blkCache, idxCache)
+	tbl2, err := OpenTable(f2.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer tbl2.Delete()
 	it1 := tbl1.newIterator(false)
@@ -773,10 +1760,10 @@ func TestMergingIteratorReversed(t *testing.T) {
 		{"k2", "b2"},
 	})
 	blkCache, idxCache := testCache(), testCache()
-	tbl1, err := OpenTable(f1.Name(), blkCache, idxCache)
+	tbl1, err := OpenTable(f1.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer tbl1.Delete()
-	tbl2, err := OpenTable(f2.Name(), blkCache, idxCache)
+	tbl2, err := OpenTable(f2.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer tbl2.Delete()
 	it1 := tbl1.newIterator(true)
@@ -813,10 +1800,10 @@ func TestMergingIteratorTakeOne(t *testing.T) {
 	f2 := buildTable(t, [][]string{{"l1", "b1"}})
 
 	blkCache, idxCache := testCache(), testCache()
-	t1, err := OpenTable(f1.Name(), blkCache, idxCache)
+	t1, err := OpenTable(f1.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer t1.Delete()
-	t2, err := OpenTable(f2.Name(), blkCache, idxCache)
+	t2, err := OpenTable(f2.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer t2.Delete()
 
@@ -860,10 +1847,10 @@ func TestMergingIteratorTakeTwo(t *testing.T) {
 		{"k2", "a2"},
 	})
 	blkCache, idxCache := testCache(), testCache()
-	t1, err := OpenTable(f1.Name(), blkCache, idxCache)
+	t1, err := OpenTable(f1.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer t1.Delete()
-	t2, err := OpenTable(f2.Name(), blkCache, idxCache)
+	t2, err := OpenTable(f2.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(t, err)
 	defer t2.Delete()
 
@@ -922,7 +1909,7 @@ func TestSeekInvalidIssue(t *testing.T) {
 	y.Check(err)
 	y.Check(f.Close())
 	f, _ = y.OpenSyncedFile(f.Name(), true)
-	t1, err := OpenTable(f.Name(), nil, nil)
+	t1, err := OpenTable(f.Name(), options.FileIO, nil, nil, nil)
 
 	require.NoError(t, err)
 	defer t1.Delete()
@@ -946,9 +1933,9 @@ func TestOpenImMemoryTable(t *testing.T) {
 	require.Nil(t, err)
 	idxData, err := ioutil.ReadFile(IndexFilename(file.Name()))
 	require.Nil(t, err)
-	inMemTbl, err := OpenInMemoryTable(blockData, idxData)
+	inMemTbl, err := OpenInMemoryTable(blockData, idxData, nil)
 	require.Nil(t, err)
-	fileTable, err := OpenTable(file.Name(), nil, nil)
+	fileTable, err := OpenTable(file.Name(), options.FileIO, nil, nil, nil)
 	require.Nil(t, err)
 	inMemIt := inMemTbl.NewIterator(false)
 	defer inMemIt.Close()
@@ -966,6 +1953,80 @@ func TestOpenImMemoryTable(t *testing.T) {
 	}
 }
 
+func TestOpenTableWithConfig(t *testing.T) {
+	file := buildTestTable(t, "mem-file", 1000)
+	defer os.Remove(file.Name())
+	defer os.Remove(IndexFilename(file.Name()))
+	blockData, err := ioutil.ReadFile(file.Name())
+	require.NoError(t, err)
+	idxData, err := ioutil.ReadFile(IndexFilename(file.Name()))
+	require.NoError(t, err)
+
+	for _, mode := range []options.TableLoadingMode{options.FileIO, options.MemoryMap} {
+		idxFile := NewMemFile("mem.idx", append([]byte{}, idxData...))
+		tbl, err := OpenTableWithConfig(OpenTableConfig{
+			File:        NewMemFile("mem.sst", blockData),
+			IndexFile:   idxFile,
+			ID:          1,
+			LoadingMode: mode,
+			BlockCache:  testCache(),
+			IndexCache:  testCache(),
+		})
+		require.NoError(t, err)
+		require.Equal(t, "mem.sst", tbl.Filename())
+		require.NoError(t, tbl.SetGlobalTs(10))
+		require.Equal(t, uint64(10), bytesToU64(idxFile.data))
+
+		it := tbl.newIterator(false)
+		count := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.EqualValues(t, y.KeyWithTs([]byte(key("mem-file", count)), 10), it.Key())
+			require.EqualValues(t, fmt.Sprintf("%d", count), string(it.Value().Value))
+			count++
+		}
+		require.NoError(t, it.Error())
+		require.Equal(t, 1000, count)
+		it.Close()
+		require.NoError(t, tbl.Delete())
+		require.Nil(t, idxFile.data)
+	}
+
+	_, err = OpenTableWithConfig(OpenTableConfig{
+		File:      NewMemFile("mem.sst", blockData[:len(blockData)/2]),
+		IndexFile: NewMemFile("mem.idx", idxData),
+	})
+	require.IsType(t, &InvalidTableError{}, err)
+
+	// Only the old block is read into memory with the block cache.
+	file, allCnt := buildMultiVersionTable(generateKeyValues("key", 1000))
+	defer os.Remove(file.Name())
+	defer os.Remove(IndexFilename(file.Name()))
+	blockData, err = ioutil.ReadFile(file.Name())
+	require.NoError(t, err)
+	idxData, err = ioutil.ReadFile(IndexFilename(file.Name()))
+	require.NoError(t, err)
+	tbl, err := OpenTableWithConfig(OpenTableConfig{
+		File:       NewMemFile("mem.sst", blockData),
+		IndexFile:  NewMemFile("mem.idx", idxData),
+		BlockCache: testCache(),
+	})
+	require.NoError(t, err)
+	require.Empty(t, tbl.blocksData)
+	require.True(t, len(tbl.oldBlock) > 0)
+	it := tbl.newIterator(false)
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+		for it.NextVersion() {
+			count++
+		}
+	}
+	require.NoError(t, it.Error())
+	require.Equal(t, allCnt, count)
+	it.Close()
+	require.NoError(t, tbl.Close())
+}
+
 func TestBuildImMemoryTable(t *testing.T) {
 	b := NewTableBuilder(nil, nil, 0, defaultBuilderOpt)
 	keyValues := generateKeyValues("in-mem", 1000)
@@ -985,7 +2046,7 @@ func TestBuildImMemoryTable(t *testing.T) {
 	y.Check(err)
 	require.NotNil(t, result.FileData)
 	require.NotNil(t, result.IndexData)
-	tbl, err := OpenInMemoryTable(result.FileData, result.IndexData)
+	tbl, err := OpenInMemoryTable(result.FileData, result.IndexData, nil)
 	y.Check(err)
 	for _, kv := range keyValues {
 		key := y.KeyWithTs([]byte(kv[0]), 0)
@@ -1009,7 +2070,7 @@ func BenchmarkRead(b *testing.B) {
 	}
 	_, err = builder.Finish()
 	y.Check(err)
-	tbl, err := OpenTable(f.Name(), testCache(), testCache())
+	tbl, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 	y.Check(err)
 	defer tbl.Delete()
 
@@ -1097,7 +2158,7 @@ func BenchmarkPointGet(b *testing.B) {
 		}
 		_, err = builder.Finish()
 		y.Check(err)
-		tbl, err := OpenTable(filename, testCache(), testCache())
+		tbl, err := OpenTable(filename, options.FileIO, testCache(), testCache(), nil)
 		y.Check(err)
 		b.ResetTimer()
 
@@ -1135,7 +2196,7 @@ func BenchmarkPointGet(b *testing.B) {
 				for i := 0; i < n; i++ {
 					k := keys[rand.Intn(n)]
 					keyHash := farm.Fingerprint64(k.UserKey)
-					resultKey, resultVs, ok, _ = tbl.pointGet(k, keyHash)
+					resultKey, resultVs, ok, _ = tbl.pointGet(context.Background(), nil, k, keyHash)
 					if !ok {
 						it := tbl.newIterator(false)
 						defer it.Close()
@@ -1170,7 +2231,7 @@ func BenchmarkReadAndBuild(b *testing.B) {
 	}
 	_, err = builder.Finish()
 	y.Check(err)
-	tbl, err := OpenTable(f.Name(), testCache(), testCache())
+	tbl, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 	y.Check(err)
 	defer tbl.Delete()
 
@@ -1218,7 +2279,7 @@ func BenchmarkReadMerged(b *testing.B) {
 		}
 		_, err = builder.Finish()
 		y.Check(err)
-		tbl, err := OpenTable(f.Name(), testCache(), testCache())
+		tbl, err := OpenTable(f.Name(), options.FileIO, testCache(), testCache(), nil)
 		y.Check(err)
 		tables = append(tables, tbl)
 		defer tbl.Delete()
@@ -1240,6 +2301,38 @@ func BenchmarkReadMerged(b *testing.B) {
 	}
 }
 
+func BenchmarkBlockSeek(b *testing.B) {
+	f := buildTestTable(nil, "key", 10000)
+	tbl, err := OpenTable(f.Name(), options.FileIO, nil, nil, nil)
+	y.Check(err)
+	defer tbl.Delete()
+	it := tbl.newIterator(false)
+	defer it.Close()
+	it.Rewind()
+	blk := &it.bi
+	keys := make([][]byte, blk.entries.length())
+	for i := range keys {
+		blk.setIdx(i)
+		keys[i] = y.Copy(blk.key.UserKey)
+	}
+
+	b.Run("diff-key", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			blk.seek(keys[i%len(keys)])
+		}
+	})
+	b.Run("full-key", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := keys[i%len(keys)]
+			idx := sort.Search(blk.entries.length(), func(idx int) bool {
+				blk.setIdx(idx)
+				return bytes.Compare(blk.key.UserKey, key) >= 0
+			})
+			blk.setIdx(idx)
+		}
+	})
+}
+
 func BenchmarkRandomRead(b *testing.B) {
 	n := int(5 * 1e6)
 	tbl := getTableForBenchmarks(b, n, testCache(), testCache())
@@ -1280,7 +2373,7 @@ func getTableForBenchmarks(b *testing.B, count int, blkCache, idxCache *cache.Ca
 
 	_, err = builder.Finish()
 	require.NoError(b, err, "unable to write to file")
-	tbl, err := OpenTable(f.Name(), blkCache, idxCache)
+	tbl, err := OpenTable(f.Name(), options.FileIO, blkCache, idxCache, nil)
 	require.NoError(b, err, "unable to open table")
 	return tbl
 }
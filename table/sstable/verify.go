@@ -0,0 +1,91 @@
+package sstable
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/pingcap/badger/buffer"
+	"github.com/pingcap/badger/y"
+	"golang.org/x/time/rate"
+)
+
+// CorruptBlockError is returned by VerifyChecksum when a block of the table is corrupted, and by the
+// block reads if the table is set to verify the block checksums.
+type CorruptBlockError struct {
+	// Offset and Len locate the block in the table file.
+	Offset int64
+	Len    int
+	// Err is the error of decoding the block if the table has no block checksums.
+	Err error
+}
+
+func (e *CorruptBlockError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("corrupted block at offset %d, len %d: %v", e.Offset, e.Len, e.Err)
+	}
+	return fmt.Sprintf("checksum mismatch of the block at offset %d, len %d", e.Offset, e.Len)
+}
+
+// VerifyChecksum reads every block of the table and verifies its checksum, the blocks of a table
+// built before the checksums were recorded are decrypted and decompressed instead. The reads are
+// throttled by the limiter if it is not nil. It returns a *CorruptBlockError for the first
+// corrupted block.
+func (t *Table) VerifyChecksum(ctx context.Context, limiter *rate.Limiter) error {
+	idx, err := t.getIndex()
+	if err != nil {
+		return err
+	}
+	numBlocks := idx.numBlocks()
+	for i := 0; i < numBlocks; i++ {
+		part, j, err := t.blockPartition(i, idx)
+		if err != nil {
+			return err
+		}
+		startOffset, endOffset := part.blockOffsets(j)
+		if err = y.WaitRateLimiter(ctx, limiter, int(endOffset-startOffset)); err != nil {
+			return err
+		}
+		if t.blockChecksums != nil {
+			err = t.verifyBlockChecksum(int(startOffset), int(endOffset-startOffset), t.blockChecksums[i])
+		} else {
+			err = t.verifyBlockDecoding(i, part, j)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if t.oldBlockLen > 0 && len(t.blockChecksums) > numBlocks {
+		if err = y.WaitRateLimiter(ctx, limiter, int(t.oldBlockLen)); err != nil {
+			return err
+		}
+		return t.verifyBlockChecksum(int(t.tableSize-t.oldBlockLen), int(t.oldBlockLen), t.blockChecksums[numBlocks])
+	}
+	return nil
+}
+
+func (t *Table) verifyBlockChecksum(offset, dataLen int, checksum uint32) error {
+	data, err := t.read(offset, dataLen)
+	if err != nil {
+		return err
+	}
+	if len(t.blocksData) == 0 {
+		defer buffer.PutBuffer(data)
+	}
+	if crc32.Checksum(data, y.CastagnoliCrcTable) != checksum {
+		return &CorruptBlockError{Offset: int64(offset), Len: dataLen}
+	}
+	return nil
+}
+
+func (t *Table) verifyBlockDecoding(idx int, part *indexPartition, i int) error {
+	startOffset, endOffset := part.blockOffsets(i)
+	data, err := t.readBlockData(idx, part, i, t.read)
+	if err == nil {
+		_, err = part.blockCompressionType(i, t.compression).Decompress(data)
+	}
+	if err != nil {
+		return &CorruptBlockError{Offset: int64(startOffset), Len: int(endOffset - startOffset), Err: err}
+	}
+	return nil
+}
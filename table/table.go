@@ -1,7 +1,10 @@
 package table
 
 import (
+	"context"
+
 	"github.com/pingcap/badger/epoch"
+	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/y"
 )
 
@@ -18,3 +21,69 @@ type Table interface {
 	MarkCompacting(flag bool)
 	Close() error
 }
+
+// EntryStats describes the entries of a table, including the old versions of the keys.
+type EntryStats struct {
+	NumEntries uint64
+	// NumKeys is the number of distinct keys, the other entries are the old versions.
+	NumKeys    uint64
+	NumDeletes uint64
+	MinVersion uint64
+	MaxVersion uint64
+}
+
+// EntryStatsTable is implemented by the tables which record the stats of their entries. The stats
+// are zero if the table was built before the stats were recorded.
+type EntryStatsTable interface {
+	EntryStats() EntryStats
+}
+
+// TracedGetter is implemented by the tables which can trace the block loads of a Get as the
+// children of the span in ctx.
+type TracedGetter interface {
+	GetTraced(ctx context.Context, tracer options.Tracer, key y.Key, keyHash uint64) (y.ValueStruct, error)
+}
+
+// ReadaheadIterator is implemented by the table iterators which can prefetch the following blocks
+// into the block cache when the iteration crosses a block boundary.
+type ReadaheadIterator interface {
+	y.Iterator
+	SetReadahead(n int)
+}
+
+// DirectIOIterator is implemented by the table iterators which can read the blocks with O_DIRECT,
+// the blocks read are not added to the block cache or the OS page cache.
+type DirectIOIterator interface {
+	y.Iterator
+	SetDirectIO()
+}
+
+// HintSeekIterator is implemented by the table iterators which can seek forward from the current
+// position, so the monotonic seeks of the merges don't search the whole table every time.
+type HintSeekIterator interface {
+	y.Iterator
+	// SeekWithHint is the same as Seek, but if the key is not less than the current key of a
+	// forward iterator, only the entries after the current position are searched.
+	SeekWithHint(key []byte)
+}
+
+// ReusableIterator is implemented by the table iterators which can be reused to iterate another
+// table, so the iterators and their buffers are not allocated per table.
+type ReusableIterator interface {
+	y.Iterator
+	// ResetTable closes the iterator and makes it an iterator of t as if it were returned by
+	// t.NewIterator, it returns false if t is not supported.
+	ResetTable(t Table, reversed bool) bool
+}
+
+// KeyFilter is implemented by the tables which can tell that a key is not in the table by the
+// filters in the index, without reading the blocks.
+type KeyFilter interface {
+	MayContainKey(key []byte, keyHash uint64) bool
+}
+
+// MultiGetter is implemented by the tables which can look up a batch of keys sorted in ascending
+// order more efficiently than calling Get for each key.
+type MultiGetter interface {
+	MultiGet(keys []y.Key, keyHashes []uint64, vals []y.ValueStruct) error
+}
@@ -0,0 +1,21 @@
+package badger
+
+import (
+	"context"
+
+	"github.com/pingcap/badger/options"
+)
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+
+func (noopSpan) End() {}
+
+// startSpan starts a span as a child of the span in ctx if the tracer is configured.
+func (db *DB) startSpan(ctx context.Context, name string) (context.Context, options.Span) {
+	if db.opt.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return db.opt.Tracer.Start(ctx, name)
+}
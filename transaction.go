@@ -18,17 +18,19 @@ package badger
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math"
+	"math/rand"
 	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/dgryski/go-farm"
 	"github.com/pingcap/badger/epoch"
 	"github.com/pingcap/badger/y"
-	"github.com/pingcap/errors"
 )
 
 type oracle struct {
@@ -44,6 +46,8 @@ type oracle struct {
 	// commits stores a key fingerprint and latest commit counter for it.
 	// refCount is used to clear out commits map to avoid a memory blowup.
 	commits map[uint64]uint64
+	// commitsStartTs is the read ts when commits was cleared, commits has every commit after it.
+	commitsStartTs uint64
 }
 
 func (o *oracle) addRef() {
@@ -62,6 +66,7 @@ func (o *oracle) decrRef() {
 		}
 		if len(o.commits) >= 1000 { // If the map is still small, let it slide.
 			o.commits = make(map[uint64]uint64)
+			o.commitsStartTs = o.readTs()
 		}
 		o.Unlock()
 	}
@@ -80,11 +85,53 @@ func (o *oracle) commitTs() uint64 {
 	return o.nextCommit
 }
 
+// OracleStats describes the timestamps of the oracle and the running transactions.
+type OracleStats struct {
+	// ReadTs is the read ts of the new transactions, the transactions committed at or before it
+	// are done. It is zero if the DB is managed.
+	ReadTs uint64
+	// NextCommitTs is the commit ts of the next transaction if the DB is not managed.
+	NextCommitTs uint64
+	// SafeTs is the ts at or before which the compactions drop the old versions, it is held back
+	// by the oldest running transaction if the DB is not managed.
+	SafeTs uint64
+	// ActiveTxns is the number of the running transactions and snapshots, OldestReadTs and
+	// OldestTxnAge describe the oldest of them. They are collected every 100ms, and they are only
+	// tracked if the DB is not managed.
+	ActiveTxns   int
+	OldestReadTs uint64
+	OldestTxnAge time.Duration
+}
+
+// OracleStats returns the stats of the oracle, a long running transaction shows up as an old
+// OldestTxnAge and a SafeTs falling behind the ReadTs.
+func (db *DB) OracleStats() OracleStats {
+	stats := OracleStats{
+		SafeTs: db.getCompactSafeTs(),
+	}
+	if !db.IsManaged() {
+		stats.ReadTs = db.orc.readTs()
+		stats.NextCommitTs = db.orc.commitTs()
+	}
+	active := db.safeTsTracker.lastStats()
+	stats.ActiveTxns = active.num
+	if active.num > 0 {
+		stats.OldestReadTs = active.oldestReadTs
+		stats.OldestTxnAge = time.Since(active.oldestStart)
+	}
+	return stats
+}
+
 // hasConflict must be called while having a lock.
 func (o *oracle) hasConflict(txn *Txn) bool {
 	if len(txn.reads) == 0 {
 		return false
 	}
+	if txn.readTs < o.commitsStartTs {
+		// The commits after the read ts of a transaction created by DB.NewTransactionAt may have
+		// been cleared.
+		return true
+	}
 	for _, ro := range txn.reads {
 		if ts, has := o.commits[ro]; has && ts > txn.readTs {
 			return true
@@ -160,6 +207,27 @@ type Txn struct {
 	count        int64
 	numIterators int32
 	blobCache    map[uint32]*blobCache
+
+	// inUse is only maintained when Options.DetectConcurrentUse is set.
+	inUse int32
+}
+
+// acquire marks the txn as being used by the calling goroutine, it must be paired with release.
+// ErrConcurrentTxn is returned if another goroutine is using the txn.
+func (txn *Txn) acquire() error {
+	if !txn.db.opt.DetectConcurrentUse {
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&txn.inUse, 0, 1) {
+		return ErrConcurrentTxn
+	}
+	return nil
+}
+
+func (txn *Txn) release() {
+	if txn.db.opt.DetectConcurrentUse {
+		atomic.StoreInt32(&txn.inUse, 0)
+	}
 }
 
 type pendingWritesIterator struct {
@@ -202,10 +270,11 @@ func (pi *pendingWritesIterator) Value() y.ValueStruct {
 	y.Assert(pi.Valid())
 	entry := pi.entries[pi.nextIdx]
 	return y.ValueStruct{
-		Value:    entry.Value,
-		Meta:     entry.meta,
-		UserMeta: entry.UserMeta,
-		Version:  pi.readTs,
+		Value:     entry.Value,
+		Meta:      entry.meta,
+		UserMeta:  entry.UserMeta,
+		ExpiresAt: entry.ExpiresAt,
+		Version:   pi.readTs,
 	}
 }
 
@@ -214,6 +283,7 @@ func (pi *pendingWritesIterator) FillValue(vs *y.ValueStruct) {
 	vs.Value = entry.Value
 	vs.Meta = entry.meta
 	vs.UserMeta = entry.UserMeta
+	vs.ExpiresAt = entry.ExpiresAt
 	vs.Version = pi.readTs
 }
 
@@ -289,6 +359,8 @@ func (txn *Txn) SetWithMeta(key, val []byte, meta byte) error {
 	return txn.SetEntry(e)
 }
 
+// SetWithMetaSlice adds a key-value pair to the database, along with the metadata of up to 255
+// bytes, which is returned by Item.UserMeta.
 func (txn *Txn) SetWithMetaSlice(key, val, meta []byte) error {
 	if txn.db.IsManaged() {
 		return ErrManagedTxn
@@ -309,14 +381,28 @@ func (txn *Txn) modify(e *Entry) error {
 	} else if int64(len(e.Value)) > txn.db.opt.ValueLogFileSize {
 		return exceedsMaxValueSizeError(e.Value, txn.db.opt.ValueLogFileSize)
 	}
+	if err := txn.acquire(); err != nil {
+		return err
+	}
+	defer txn.release()
 	if err := txn.checkSize(e); err != nil {
 		return err
 	}
+	if err := txn.updateIndexes(e); err != nil {
+		return err
+	}
+	txn.addWrite(e)
+	return nil
+}
+
+func (txn *Txn) addWrite(e *Entry) {
+	if e.ExpiresAt != 0 {
+		e.meta |= bitExpiresAt
+	}
 
 	fp := farm.Fingerprint64(e.Key.UserKey) // Avoid dealing with byte arrays.
 	txn.writes = append(txn.writes, fp)
 	txn.pendingWrites[string(e.Key.UserKey)] = e
-	return nil
 }
 
 // SetEntry takes an Entry struct and adds the key-value pair in the struct, along
@@ -339,20 +425,34 @@ func (txn *Txn) Delete(key []byte) error {
 // Get looks for key and returns corresponding Item.
 // If key is not found, ErrKeyNotFound is returned.
 func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
+	return txn.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, the lookup and the value read of the returned Item are traced as the
+// children of the span in ctx if Options.Tracer is set.
+func (txn *Txn) GetContext(ctx context.Context, key []byte) (item *Item, rerr error) {
 	if len(key) == 0 {
 		return nil, ErrEmptyKey
 	} else if txn.discarded {
 		return nil, ErrDiscardedTxn
 	}
+	if err := txn.acquire(); err != nil {
+		return nil, err
+	}
+	defer txn.release()
+	return txn.get(ctx, key)
+}
 
-	item = new(Item)
+func (txn *Txn) get(ctx context.Context, key []byte) (*Item, error) {
+	item := new(Item)
 	if txn.update {
 		if e, has := txn.pendingWrites[string(key)]; has && bytes.Equal(key, e.Key.UserKey) {
-			if isDeleted(e.meta) {
+			if isDeletedOrExpired(e.meta, e.ExpiresAt) {
 				return nil, ErrKeyNotFound
 			}
 			// Fulfill from cache.
 			item.meta = e.meta
+			item.expiresAt = e.ExpiresAt
 			item.vptr = e.Value
 			item.userMeta = e.UserMeta
 			item.key.UserKey = key
@@ -369,11 +469,11 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	seek := y.KeyWithTs(key, txn.readTs)
 	var vs y.ValueStruct
 	for {
-		vs = txn.db.get(seek)
+		vs = txn.db.get(ctx, seek)
 		if !vs.Valid() {
 			return nil, ErrKeyNotFound
 		}
-		if isDeleted(vs.Meta) {
+		if isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
 			return nil, ErrKeyNotFound
 		}
 		break
@@ -383,9 +483,11 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	item.key.Version = vs.Version
 	item.meta = vs.Meta
 	item.userMeta = vs.UserMeta
+	item.expiresAt = vs.ExpiresAt
 	item.db = txn.db
 	item.vptr = vs.Value
 	item.txn = txn
+	item.ctx = ctx
 	return item, nil
 }
 
@@ -397,36 +499,66 @@ type keyValuePair struct {
 }
 
 // MultiGet gets items for keys, if not found, the corresponding item will be nil.
-// It only supports read-only transaction for simplicity.
+// The keys are looked up in key order, the keys in the same table are looked up in a batch that
+// loads each block only once, it is cheaper than calling Get for each key.
 func (txn *Txn) MultiGet(keys [][]byte) (items []*Item, err error) {
-	if txn.update {
-		return nil, errors.New("not supported")
-	}
 	if txn.discarded {
 		return nil, ErrDiscardedTxn
 	}
-	keyValuePairs := make([]keyValuePair, len(keys))
+	if err := txn.acquire(); err != nil {
+		return nil, err
+	}
+	defer txn.release()
+	items = make([]*Item, len(keys))
+	// order is the indexes of the keys to look up in the LSM tree, sorted by key.
+	order := make([]int, 0, len(keys))
 	for i, key := range keys {
 		if len(key) == 0 {
 			return nil, ErrEmptyKey
 		}
-		keyValuePairs[i].hash = farm.Fingerprint64(key)
-		keyValuePairs[i].key = y.KeyWithTs(key, txn.readTs)
+		if txn.update {
+			if e, has := txn.pendingWrites[string(key)]; has && bytes.Equal(key, e.Key.UserKey) {
+				if !isDeletedOrExpired(e.meta, e.ExpiresAt) {
+					items[i] = &Item{
+						key:       y.KeyWithTs(key, txn.readTs),
+						meta:      e.meta,
+						userMeta:  e.UserMeta,
+						expiresAt: e.ExpiresAt,
+						db:        txn.db,
+						vptr:      e.Value,
+						txn:       txn,
+					}
+				}
+				continue
+			}
+		}
+		order = append(order, i)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+	keyValuePairs := make([]keyValuePair, len(order))
+	for i, idx := range order {
+		keyValuePairs[i].hash = farm.Fingerprint64(keys[idx])
+		keyValuePairs[i].key = y.KeyWithTs(keys[idx], txn.readTs)
+		if txn.update {
+			txn.reads = append(txn.reads, keyValuePairs[i].hash)
+		}
 	}
 	txn.db.multiGet(keyValuePairs)
-	items = make([]*Item, len(keys))
 	for i, pair := range keyValuePairs {
-		if pair.found && !isDeleted(pair.val.Meta) {
-			items[i] = &Item{
+		if pair.found && !isDeletedOrExpired(pair.val.Meta, pair.val.ExpiresAt) {
+			items[order[i]] = &Item{
 				key: y.Key{
-					UserKey: keys[i],
+					UserKey: keys[order[i]],
 					Version: pair.val.Version,
 				},
-				meta:     pair.val.Meta,
-				userMeta: pair.val.UserMeta,
-				db:       txn.db,
-				vptr:     pair.val.Value,
-				txn:      txn,
+				meta:      pair.val.Meta,
+				userMeta:  pair.val.UserMeta,
+				expiresAt: pair.val.ExpiresAt,
+				db:        txn.db,
+				vptr:      pair.val.Value,
+				txn:       txn,
 			}
 		}
 	}
@@ -466,18 +598,94 @@ func (txn *Txn) Discard() {
 // If error is nil, the transaction is successfully committed. In case of a non-nil error, the LSM
 // tree won't be updated, so there's no need for any rollback.
 func (txn *Txn) Commit() error {
+	return txn.CommitContext(context.Background())
+}
+
+// CommitContext is like Commit, the commit and the wait for the writes are traced as the children
+// of the span in ctx if Options.Tracer is set.
+func (txn *Txn) CommitContext(ctx context.Context) error {
 	if txn.discarded {
 		return ErrDiscardedTxn
 	}
+	if err := txn.acquire(); err != nil {
+		return err
+	}
+	defer txn.release()
 	defer txn.Discard()
 	if len(txn.writes) == 0 {
 		return nil // Nothing to do.
 	}
+	ctx, span := txn.db.startSpan(ctx, "badger.commit")
+	defer span.End()
+	span.SetAttribute("writes", len(txn.writes))
+	commitTs, req, err := txn.commitAndSend()
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		return err
+	}
+	span.SetAttribute("commit_ts", commitTs)
+	_, waitSpan := txn.db.startSpan(ctx, "badger.commit_wait")
+	err = req.Wait()
+	waitSpan.End()
+	txn.db.orc.doneCommit(commitTs)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+	}
+	return err
+}
+
+// CommitWith commits the transaction like Commit, but it returns right after the writes are sent
+// to the write channel, so the commits can be pipelined. The callback is invoked on another
+// goroutine with the result of the commit once the writes are applied, they are durable when
+// Options.SyncWrites is set. The callback is called even if the commit fails before the writes are
+// sent, like on ErrConflict, but it's never called on the goroutine calling CommitWith.
+func (txn *Txn) CommitWith(cb func(error)) {
+	if cb == nil {
+		panic("nil callback provided to CommitWith")
+	}
+	if txn.discarded {
+		go cb(ErrDiscardedTxn)
+		return
+	}
+	if err := txn.acquire(); err != nil {
+		go cb(err)
+		return
+	}
+	defer txn.release()
+	defer txn.Discard()
+	if len(txn.writes) == 0 {
+		go cb(nil)
+		return
+	}
+	commitTs, req, err := txn.commitAndSend()
+	if err != nil {
+		go cb(err)
+		return
+	}
+	orc := txn.db.orc
+	go func() {
+		err := req.Wait()
+		orc.doneCommit(commitTs)
+		cb(err)
+	}()
+}
+
+// commitAndSend checks the conflicts, assigns the commit timestamp and sends the writes to the
+// write channel, the caller must wait for the request and call doneCommit with the commit ts.
+func (txn *Txn) commitAndSend() (uint64, *request, error) {
 	managed := txn.db.IsManaged()
+	var commitTs uint64
+	if managed {
+		// The commit ts is provided by CommitAt, keys without a version are committed at it.
+		commitTs = txn.commitTs
+	}
 	entries := make([]*Entry, 0, len(txn.pendingWrites)+1)
 	for _, e := range txn.pendingWrites {
 		if managed && e.Key.Version == 0 {
-			return fmt.Errorf("version of key %x not specified for managed db", e.Key.UserKey)
+			if commitTs == 0 {
+				return 0, nil, fmt.Errorf("version of key %x not specified for managed db", e.Key.UserKey)
+			}
+			e.Key.Version = commitTs
 		}
 		e.meta |= bitTxn
 		entries = append(entries, e)
@@ -485,14 +693,13 @@ func (txn *Txn) Commit() error {
 	sort.Slice(entries, func(i, j int) bool {
 		return entries[i].Key.Compare(entries[j].Key) < 0
 	})
-	var commitTs uint64
 	state := txn.db.orc
 	state.writeLock.Lock()
 	if !managed {
 		commitTs = state.newCommitTs(txn)
 		if commitTs == 0 {
 			state.writeLock.Unlock()
-			return ErrConflict
+			return 0, nil, ErrConflict
 		}
 		for _, e := range entries {
 			// Suffix the keys with commit ts, so the key versions are sorted in
@@ -511,13 +718,9 @@ func (txn *Txn) Commit() error {
 	req, err := txn.db.sendToWriteCh(entries)
 	state.writeLock.Unlock()
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
-
-	req.Wait()
-	state.doneCommit(commitTs)
-
-	return nil
+	return commitTs, req, nil
 }
 
 // NewTransaction creates a new transaction. Badger supports concurrent execution of transactions,
@@ -530,7 +733,9 @@ func (txn *Txn) Commit() error {
 //
 // Running transactions concurrently is OK. However, a transaction itself isn't thread safe, and
 // should only be run serially. It doesn't matter if a transaction is created by one goroutine and
-// passed down to other, as long as the Txn APIs are called serially.
+// passed down to other, as long as the Txn APIs are called serially. The same applies to the
+// iterators created by the transaction. Set Options.DetectConcurrentUse to get ErrConcurrentTxn
+// and ErrConcurrentIterator when this rule is violated.
 //
 // When you create a new transaction, it is absolutely essential to call
 // Discard(). This should be done irrespective of what the update param is set
@@ -541,11 +746,37 @@ func (txn *Txn) Commit() error {
 //  defer txn.Discard()
 //  // Call various APIs.
 func (db *DB) NewTransaction(update bool) *Txn {
+	return db.newTransaction(db.orc.readTs(), update)
+}
+
+// NewTransactionAt creates a new transaction reading the snapshot at readTs, which can be older
+// than the latest read ts, so the followers can serve the stale reads at the ts chosen by the
+// leader. It returns ErrInvalidRequest if readTs is greater than the latest read ts, and
+// ErrReadTsTooOld if the versions visible at readTs may have been discarded by the compaction. The
+// versions visible at readTs are retained until the transaction is discarded. If the update
+// transaction has read any key, it conflicts on commit if the commits after readTs are no longer
+// tracked. ManagedDB overrides it to use the read ts without the checks.
+func (db *DB) NewTransactionAt(readTs uint64, update bool) (*Txn, error) {
+	if db.IsManaged() {
+		return (&ManagedDB{db}).NewTransactionAt(readTs, update), nil
+	}
+	if readTs > db.orc.readTs() {
+		return nil, ErrInvalidRequest
+	}
+	// The safe ts is not advanced past readTs once the guard of the transaction is acquired.
+	db.safeTsTracker.mu.Lock()
+	defer db.safeTsTracker.mu.Unlock()
+	if readTs < db.getCompactSafeTs() {
+		return nil, ErrReadTsTooOld
+	}
+	return db.newTransaction(readTs, update), nil
+}
+
+func (db *DB) newTransaction(readTs uint64, update bool) *Txn {
 	if db.opt.ReadOnly {
 		// DB is read-only, force read-only transaction.
 		update = false
 	}
-	readTs := db.orc.readTs()
 	txn := &Txn{
 		update: update,
 		db:     db,
@@ -554,7 +785,7 @@ func (db *DB) NewTransaction(update bool) *Txn {
 		readTs: readTs,
 	}
 	if !db.IsManaged() {
-		txn.guard = db.resourceMgr.AcquireWithPayload(readTs)
+		txn.guard = db.resourceMgr.AcquireWithPayload(newGuardPayload(readTs))
 	} else {
 		txn.guard = db.resourceMgr.Acquire()
 	}
@@ -583,15 +814,41 @@ func (txn *Txn) SetReadTS(readTS uint64) {
 	txn.readTs = readTS
 }
 
+// maxUpdateRetryBackoff bounds the delay of the retries of DB.Update.
+const maxUpdateRetryBackoff = 100 * time.Millisecond
+
 // Update executes a function, creating and managing a read-write transaction
 // for the user. Error returned by the function is relayed by the Update method.
+//
+// If the commit returns ErrConflict, the function is called again with a new transaction up to
+// Options.UpdateRetries times after a jittered backoff, so the function must not depend on the
+// state changed by the previous calls. ErrConflict is returned if the retries are exhausted.
+// ErrConflict returned by the function itself is relayed without a retry.
 func (db *DB) Update(fn func(txn *Txn) error) error {
+	backoff := db.opt.UpdateRetryBackoff
+	for i := 0; ; i++ {
+		committing, err := db.update(fn)
+		if !committing || err != ErrConflict || i >= db.opt.UpdateRetries {
+			return err
+		}
+		if backoff > 0 {
+			// The jitter keeps the conflicting transactions from retrying at the same time.
+			time.Sleep(time.Duration(rand.Int63n(int64(backoff))) + 1)
+			if backoff < maxUpdateRetryBackoff {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+// update returns committing as true if the error is returned by the commit rather than fn.
+func (db *DB) update(fn func(txn *Txn) error) (committing bool, err error) {
 	txn := db.NewTransaction(true)
 	defer txn.Discard()
 
 	if err := fn(txn); err != nil {
-		return err
+		return false, err
 	}
 
-	return txn.Commit()
+	return true, txn.Commit()
 }
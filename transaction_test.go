@@ -17,6 +17,9 @@
 package badger
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"math"
@@ -28,6 +31,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/pingcap/badger/options"
+	"github.com/pingcap/badger/table"
 	"github.com/pingcap/badger/y"
 	"github.com/stretchr/testify/require"
 )
@@ -143,6 +148,52 @@ func TestTxnCommitAsync(t *testing.T) {
 	})
 }
 
+func TestTxnCommitWith(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := func(i int) []byte {
+			return []byte(fmt.Sprintf("key=%d", i))
+		}
+		var wg sync.WaitGroup
+		n := 100
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			txn := db.NewTransaction(true)
+			require.NoError(t, txn.Set(key(i), key(i)))
+			txn.CommitWith(func(err error) {
+				require.NoError(t, err)
+				wg.Done()
+			})
+		}
+		wg.Wait()
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < n; i++ {
+				item, err := txn.Get(key(i))
+				require.NoError(t, err)
+				require.Equal(t, key(i), getItemValue(t, item))
+			}
+			return nil
+		}))
+
+		// The conflict is passed to the callback.
+		txn1 := db.NewTransaction(true)
+		_, err := txn1.Get(key(0))
+		require.NoError(t, err)
+		require.NoError(t, txn1.Set(key(0), []byte("txn1")))
+		txn2 := db.NewTransaction(true)
+		require.NoError(t, txn2.Set(key(0), []byte("txn2")))
+		require.NoError(t, txn2.Commit())
+		errCh := make(chan error, 1)
+		txn1.CommitWith(func(err error) {
+			errCh <- err
+		})
+		require.Equal(t, ErrConflict, <-errCh)
+		txn1.CommitWith(func(err error) {
+			errCh <- err
+		})
+		require.Equal(t, ErrDiscardedTxn, <-errCh)
+	})
+}
+
 func TestTxnVersions(t *testing.T) {
 	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
 		k := []byte("key")
@@ -768,6 +819,403 @@ func TestManagedDB(t *testing.T) {
 	txn.Discard()
 }
 
+func TestManagedCommitAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kv, err := OpenManaged(getTestOptions(dir))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	txn := kv.NewTransactionAt(5, true)
+	require.NoError(t, txn.SetEntry(&Entry{Key: y.KeyWithTs([]byte("a"), 0), Value: []byte("a10")}))
+	require.NoError(t, txn.SetEntry(&Entry{Key: y.KeyWithTs([]byte("b"), 0), Value: []byte("b10"), UserMeta: []byte{1}}))
+	require.NoError(t, txn.SetEntry(&Entry{Key: y.KeyWithTs([]byte("c"), 8), Value: []byte("c8")}))
+	require.NoError(t, txn.CommitAt(10))
+
+	// Commit without a commit ts fails if a key has no version.
+	txn = kv.NewTransactionAt(10, true)
+	require.NoError(t, txn.Delete([]byte("a")))
+	require.Error(t, txn.Commit())
+
+	txn = kv.NewTransactionAt(10, true)
+	require.NoError(t, txn.Delete([]byte("a")))
+	require.NoError(t, txn.CommitAt(20))
+
+	txn = kv.NewTransactionAt(15, false)
+	item, err := txn.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), item.Version())
+	item, err = txn.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), item.Version())
+	require.Equal(t, []byte{1}, item.UserMeta())
+	item, err = txn.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), item.Version())
+	txn.Discard()
+
+	txn = kv.NewTransactionAt(20, false)
+	_, err = txn.Get([]byte("a"))
+	require.Equal(t, ErrKeyNotFound, err)
+	txn.Discard()
+}
+
+func TestTxnReadAt(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("a"), []byte("a1"))
+		}))
+		oldTs := db.orc.readTs()
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("a"), []byte("a2"))
+		}))
+
+		txn, err := db.NewTransactionAt(oldTs, false)
+		require.NoError(t, err)
+		item, err := txn.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("a1"), getItemValue(t, item))
+		require.Equal(t, oldTs, item.Version())
+		txn.Discard()
+
+		_, err = db.NewTransactionAt(db.orc.readTs()+1, false)
+		require.Equal(t, ErrInvalidRequest, err)
+
+		// The update transaction conflicts with the commits after its read ts.
+		txn, err = db.NewTransactionAt(oldTs, true)
+		require.NoError(t, err)
+		_, err = txn.Get([]byte("a"))
+		require.NoError(t, err)
+		require.NoError(t, txn.Set([]byte("b"), []byte("b1")))
+		require.Equal(t, ErrConflict, txn.Commit())
+
+		// The commits after its read ts are no longer tracked.
+		txn, err = db.NewTransactionAt(oldTs, true)
+		require.NoError(t, err)
+		_, err = txn.Get([]byte("c"))
+		require.Equal(t, ErrKeyNotFound, err)
+		require.NoError(t, txn.Set([]byte("b"), []byte("b1")))
+		db.orc.Lock()
+		db.orc.commitsStartTs = db.orc.readTs()
+		db.orc.Unlock()
+		require.Equal(t, ErrConflict, txn.Commit())
+
+		atomic.StoreUint64(&db.safeTsTracker.safeTs, oldTs+1)
+		_, err = db.NewTransactionAt(oldTs, false)
+		require.Equal(t, ErrReadTsTooOld, err)
+	})
+}
+
+func TestSetDiscardTs(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		var versions []uint64
+		for i := 0; i < 3; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte("a"), []byte(fmt.Sprintf("a%d", i)))
+			}))
+			versions = append(versions, db.orc.readTs())
+		}
+		db.SetDiscardTs(versions[1])
+		require.Eventually(t, func() bool {
+			return db.getCompactSafeTs() == versions[1]
+		}, 5*time.Second, 10*time.Millisecond)
+		db.flushMemTable().Wait()
+		require.NoError(t, db.CompactRange([]byte("a"), []byte("b"), CompactRangeOptions{BottomLevel: true}))
+
+		_, err := db.NewTransactionAt(versions[0], false)
+		require.Equal(t, ErrReadTsTooOld, err)
+		txn, err := db.NewTransactionAt(versions[1], false)
+		require.NoError(t, err)
+		defer txn.Discard()
+		item, err := txn.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("a1"), getItemValue(t, item))
+
+		opts := DefaultIteratorOptions
+		opts.AllVersions = true
+		latest := db.NewTransaction(false)
+		defer latest.Discard()
+		it := latest.NewIterator(opts)
+		defer it.Close()
+		var got []uint64
+		for it.Rewind(); it.Valid(); it.Next() {
+			got = append(got, it.Item().Version())
+		}
+		require.Equal(t, []uint64{versions[2], versions[1]}, got)
+	})
+}
+
+func TestUpdateRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.UpdateRetries = 2
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// conflict returns a function which commits a write of the key read by the transaction of
+	// Update on the first n calls.
+	var calls int
+	conflict := func(n int) func(txn *Txn) error {
+		calls = 0
+		return func(txn *Txn) error {
+			calls++
+			if _, err := txn.Get([]byte("a")); err != ErrKeyNotFound {
+				return err
+			}
+			if calls <= n {
+				require.NoError(t, db.Update(func(txn *Txn) error {
+					return txn.Delete([]byte("a"))
+				}))
+			}
+			return txn.Set([]byte("b"), []byte("b"))
+		}
+	}
+	require.NoError(t, db.Update(conflict(2)))
+	require.Equal(t, 3, calls)
+	require.Equal(t, ErrConflict, db.Update(conflict(3)))
+	require.Equal(t, 3, calls)
+
+	// ErrConflict returned by the function is not retried.
+	calls = 0
+	require.Equal(t, ErrConflict, db.Update(func(txn *Txn) error {
+		calls++
+		return ErrConflict
+	}))
+	require.Equal(t, 1, calls)
+}
+
+func TestKeyIterator(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		var (
+			versions []uint64
+			old      *Txn
+		)
+		for i := 0; i < 4; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				require.NoError(t, txn.Set([]byte("ke"), []byte("x")))
+				require.NoError(t, txn.Set([]byte("key1"), []byte("x")))
+				if i == 2 {
+					return txn.Delete([]byte("key"))
+				}
+				return txn.Set([]byte("key"), []byte(fmt.Sprintf("v%d", i)))
+			}))
+			versions = append(versions, db.orc.readTs())
+			if i == 1 {
+				old = db.NewTransaction(false)
+				defer old.Discard()
+			}
+			if i%2 == 1 {
+				// The versions are spread over the memtable and the tables.
+				db.flushMemTable().Wait()
+			}
+		}
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("other"), []byte("x"))
+		}))
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set([]byte("key"), []byte("pending")))
+		it := txn.NewKeyIterator([]byte("key"), DefaultIteratorOptions)
+		defer it.Close()
+		var vals []string
+		var got []uint64
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			require.Equal(t, []byte("key"), item.Key())
+			if item.IsDeleted() {
+				vals = append(vals, "deleted")
+			} else {
+				vals = append(vals, string(getItemValue(t, item)))
+			}
+			got = append(got, item.Version())
+		}
+		require.Equal(t, []string{"pending", "v3", "deleted", "v1", "v0"}, vals)
+		require.Equal(t, []uint64{txn.readTs, versions[3], versions[2], versions[1], versions[0]}, got)
+
+		it2 := old.NewKeyIterator([]byte("key"), DefaultIteratorOptions)
+		defer it2.Close()
+		got = got[:0]
+		for it2.Rewind(); it2.Valid(); it2.Next() {
+			got = append(got, it2.Item().Version())
+		}
+		require.Equal(t, []uint64{versions[1], versions[0]}, got)
+	})
+}
+
+func TestIteratorMaxVersions(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 5; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				require.NoError(t, txn.Set([]byte("a"), []byte(fmt.Sprintf("a%d", i))))
+				if i == 0 {
+					require.NoError(t, txn.Set([]byte("b"), []byte("b0")))
+				}
+				if i < 3 {
+					return txn.Set([]byte("c"), []byte(fmt.Sprintf("c%d", i)))
+				}
+				return nil
+			}))
+		}
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		opts := DefaultIteratorOptions
+		opts.AllVersions = true
+		opts.MaxVersions = 2
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		var vals []string
+		for it.Rewind(); it.Valid(); it.Next() {
+			vals = append(vals, string(getItemValue(t, it.Item())))
+		}
+		require.Equal(t, []string{"a4", "a3", "b0", "c2", "c1"}, vals)
+
+		opts.MaxVersions = 1
+		kit := txn.NewKeyIterator([]byte("a"), opts)
+		defer kit.Close()
+		vals = vals[:0]
+		for kit.Rewind(); kit.Valid(); kit.Next() {
+			vals = append(vals, string(getItemValue(t, kit.Item())))
+		}
+		require.Equal(t, []string{"a4"}, vals)
+	})
+}
+
+func TestIteratorSinceTs(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for _, key := range []string{"a", "b", "c"} {
+				require.NoError(t, txn.Set([]byte(key), []byte(key+"0")))
+			}
+			return nil
+		}))
+		db.flushMemTable().Wait()
+		sinceTs := db.orc.readTs()
+		for i := 1; i <= 2; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				require.NoError(t, txn.Set([]byte("b"), []byte(fmt.Sprintf("b%d", i))))
+				return txn.Set([]byte("d"), []byte(fmt.Sprintf("d%d", i)))
+			}))
+		}
+		db.flushMemTable().Wait()
+
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		scan := func(opts IteratorOptions) []string {
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			var vals []string
+			for it.Rewind(); it.Valid(); it.Next() {
+				vals = append(vals, string(getItemValue(t, it.Item())))
+			}
+			return vals
+		}
+		opts := DefaultIteratorOptions
+		opts.SinceTs = sinceTs
+		require.Equal(t, []string{"b2", "d2"}, scan(opts))
+		opts.AllVersions = true
+		require.Equal(t, []string{"b2", "b1", "d2", "d1"}, scan(opts))
+
+		// The table flushed before sinceTs is not read.
+		var tables []table.Table
+		for _, l := range db.lc.levels {
+			tables = append(tables, l.tables...)
+		}
+		require.Len(t, tables, 2)
+		require.Len(t, opts.OverlapTables(tables), 1)
+	})
+}
+
+func TestOracleStats(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txnSet(t, db, []byte("a"), []byte("a1"), 0)
+		old := db.NewTransaction(false)
+		for i := 0; i < 3; i++ {
+			txnSet(t, db, []byte("a"), []byte("a2"), 0)
+		}
+		var stats OracleStats
+		require.Eventually(t, func() bool {
+			stats = db.OracleStats()
+			return stats.ActiveTxns == 1
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Equal(t, old.readTs, stats.OldestReadTs)
+		require.True(t, stats.OldestTxnAge > 0)
+		require.Equal(t, old.readTs+3, stats.ReadTs)
+		require.Equal(t, stats.ReadTs+1, stats.NextCommitTs)
+		require.True(t, stats.SafeTs < old.readTs)
+
+		old.Discard()
+		require.Eventually(t, func() bool {
+			stats = db.OracleStats()
+			return stats.ActiveTxns == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Zero(t, stats.OldestTxnAge)
+		require.True(t, stats.SafeTs >= old.readTs)
+	})
+}
+
+func TestIteratorAllocs(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 20000; i += 1000 {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				for j := i; j < i+1000; j++ {
+					require.NoError(t, txn.Set([]byte(fmt.Sprintf("key%08d", j)), []byte(fmt.Sprintf("val%08d", j))))
+				}
+				return nil
+			}))
+			if i == 10000 {
+				db.flushMemTable().Wait()
+			}
+		}
+		txn := db.NewTransaction(false)
+		defer txn.Discard()
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		it.Rewind()
+		// The item, the key of the block iterator and the blocks are reused, so iterating over the
+		// cached blocks doesn't allocate.
+		allocs := testing.AllocsPerRun(1000, func() {
+			it.Next()
+			_, err := it.Item().Value()
+			require.NoError(t, err)
+		})
+		require.True(t, it.Valid())
+		require.Zero(t, allocs)
+
+		// The copies of the keys and values are allocated from the arena, which is reused by the
+		// following iterators after Reset.
+		arena := y.NewArena(64 << 10)
+		for round := 0; round < 2; round++ {
+			arena.Reset()
+			opt := DefaultIteratorOptions
+			opt.Arena = arena
+			it := txn.NewIterator(opt)
+			it.Rewind()
+			// AllocsPerRun calls the function once more to warm up.
+			keys, vals := make([][]byte, 0, 1001), make([][]byte, 0, 1001)
+			allocs = testing.AllocsPerRun(1000, func() {
+				item := it.Item()
+				keys = append(keys, item.KeyCopy(nil))
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				vals = append(vals, val)
+				it.Next()
+			})
+			it.Close()
+			require.Zero(t, allocs)
+			for i := range keys {
+				require.Equal(t, fmt.Sprintf("key%08d", i), string(keys[i]))
+				require.Equal(t, fmt.Sprintf("val%08d", i), string(vals[i]))
+			}
+		}
+	})
+}
+
 func TestArmV7Issue311Fix(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -857,6 +1305,49 @@ func TestTxnMultiGet(t *testing.T) {
 			}
 		}
 		txn.Discard()
+
+		// The keys in the tables are looked up in batches, the keys are not sorted.
+		n := 2000
+		key := func(i int) []byte {
+			return []byte(fmt.Sprintf("batch%05d", i))
+		}
+		for i := 0; i < n; i += 100 {
+			txn = db.NewTransaction(true)
+			for j := i; j < i+100; j++ {
+				require.NoError(t, txn.Set(key(j), key(j)))
+			}
+			require.NoError(t, txn.Commit())
+		}
+		db.flushMemTable().Wait()
+		var batchKeys [][]byte
+		for i := n + 11; i >= 0; i -= 3 {
+			batchKeys = append(batchKeys, key(i))
+		}
+		txn = db.NewTransaction(true)
+		require.NoError(t, txn.Set(key(1), []byte("pending")))
+		require.NoError(t, txn.Delete(key(4)))
+		items, err = txn.MultiGet(batchKeys)
+		require.NoError(t, err)
+		for i, item := range items {
+			k := batchKeys[i]
+			switch string(k) {
+			case string(key(1)):
+				require.Equal(t, []byte("pending"), getItemValue(t, item))
+				// The pending item is bound to the txn like the items read from the DB.
+				require.Equal(t, db, item.db)
+				require.Equal(t, txn, item.txn)
+			case string(key(4)):
+				require.Nil(t, item)
+			default:
+				if bytes.Compare(k, key(n)) >= 0 {
+					require.Nil(t, item)
+					continue
+				}
+				require.Equal(t, k, item.Key())
+				require.Equal(t, k, getItemValue(t, item))
+			}
+		}
+		txn.Discard()
 	})
 }
 
@@ -927,3 +1418,290 @@ func TestMangedDB(t *testing.T) {
 	})
 	require.Nil(t, err)
 }
+
+func TestTxnDetectConcurrentUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.DetectConcurrentUse = true
+	runBadgerTest(t, &opts, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set([]byte("key"), []byte("val")))
+
+		// Simulate another goroutine being in the middle of a txn call.
+		atomic.StoreInt32(&txn.inUse, 1)
+		require.Equal(t, ErrConcurrentTxn, txn.Set([]byte("key2"), []byte("val")))
+		_, err := txn.Get([]byte("key"))
+		require.Equal(t, ErrConcurrentTxn, err)
+		it := txn.NewIterator(DefaultIteratorOptions)
+		it.Rewind()
+		require.False(t, it.Valid())
+		require.Equal(t, ErrConcurrentTxn, it.Err())
+		it.Close()
+		atomic.StoreInt32(&txn.inUse, 0)
+
+		// Iterators can be handed off to another goroutine.
+		itCh := make(chan *Iterator)
+		go func() {
+			itCh <- txn.NewIterator(DefaultIteratorOptions)
+		}()
+		it = <-itCh
+		it.Rewind()
+		require.True(t, it.Valid())
+		require.Equal(t, "key", string(it.Item().Key()))
+		atomic.StoreInt32(&it.inUse, 1)
+		it.Next()
+		require.False(t, it.Valid())
+		require.Equal(t, ErrConcurrentIterator, it.Err())
+		it.Close()
+
+		// A txn.Set while the iterator is moving over the pending writes is detected by both sides.
+		it = txn.NewIterator(DefaultIteratorOptions)
+		it.Rewind()
+		require.True(t, it.Valid())
+		require.True(t, it.acquire())
+		require.Equal(t, ErrConcurrentTxn, txn.Set([]byte("key2"), []byte("val")))
+		it.release()
+		atomic.StoreInt32(&txn.inUse, 1)
+		it.Next()
+		require.False(t, it.Valid())
+		require.Equal(t, ErrConcurrentTxn, it.Err())
+		atomic.StoreInt32(&txn.inUse, 0)
+		it.Close()
+
+		// The read can't be tracked if the txn is in use, the loop ends with the error.
+		require.NoError(t, txn.Set([]byte("key3"), []byte("val")))
+		it = txn.NewIterator(DefaultIteratorOptions)
+		var keys []string
+		for it.Rewind(); it.Valid(); it.Next() {
+			atomic.StoreInt32(&txn.inUse, 1)
+			keys = append(keys, string(it.Item().Key()))
+			atomic.StoreInt32(&txn.inUse, 0)
+		}
+		require.Equal(t, []string{"key"}, keys)
+		require.Equal(t, ErrConcurrentTxn, it.Err())
+		it.Close()
+		require.NoError(t, txn.Commit())
+	})
+}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+	attrs  map[string]interface{}
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+func (s *testSpan) End() {
+	s.tracer.Lock()
+	s.tracer.ended = append(s.tracer.ended, s)
+	s.tracer.Unlock()
+}
+
+type testSpanKey struct{}
+
+type testTracer struct {
+	sync.Mutex
+	ended   []*testSpan
+	parents map[string]string
+}
+
+func (tr *testTracer) Start(ctx context.Context, name string) (context.Context, options.Span) {
+	tr.Lock()
+	if parent, ok := ctx.Value(testSpanKey{}).(*testSpan); ok {
+		tr.parents[name] = parent.name
+	}
+	tr.Unlock()
+	span := &testSpan{tracer: tr, name: name, attrs: map[string]interface{}{}}
+	return context.WithValue(ctx, testSpanKey{}, span), span
+}
+
+func (tr *testTracer) spanNames() map[string]int {
+	tr.Lock()
+	defer tr.Unlock()
+	names := map[string]int{}
+	for _, s := range tr.ended {
+		names[s.name]++
+	}
+	return names
+}
+
+func TestTracer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tracer := &testTracer{parents: map[string]string{}}
+	opts := getTestOptions(dir)
+	opts.Tracer = tracer
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	ctx, root := tracer.Start(context.Background(), "root")
+	key, val := []byte("key"), bytes.Repeat([]byte("v"), 1024)
+	txn := db.NewTransaction(true)
+	require.NoError(t, txn.Set(key, val))
+	require.NoError(t, txn.CommitContext(ctx))
+	names := tracer.spanNames()
+	require.Equal(t, 1, names["badger.commit"])
+	require.Equal(t, 1, names["badger.commit_wait"])
+	require.Equal(t, "root", tracer.parents["badger.commit"])
+	require.Equal(t, "badger.commit", tracer.parents["badger.commit_wait"])
+
+	// Reopen the DB so the key is read from the tables.
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	txn = db.NewTransaction(false)
+	defer txn.Discard()
+	item, err := txn.GetContext(ctx, key)
+	require.NoError(t, err)
+	got, err := item.Value()
+	require.NoError(t, err)
+	require.Equal(t, val, got)
+	root.End()
+
+	names = tracer.spanNames()
+	require.Equal(t, 1, names["badger.memtable_get"])
+	require.True(t, names["badger.level_get"] > 0)
+	require.Equal(t, 1, names["badger.value_read"])
+	require.True(t, names["badger.block_load"] > 0)
+	require.Equal(t, "root", tracer.parents["badger.memtable_get"])
+	require.Equal(t, "root", tracer.parents["badger.level_get"])
+	require.Equal(t, "badger.level_get", tracer.parents["badger.block_load"])
+	require.Equal(t, "root", tracer.parents["badger.value_read"])
+}
+
+func TestMultiByteUserMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	meta := func(i int) []byte {
+		m := make([]byte, 8)
+		binary.BigEndian.PutUint64(m, uint64(i)<<32|uint64(i))
+		return m
+	}
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key%03d", i))
+	}
+	validate := func() {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 100; i++ {
+				item, err := txn.Get(key(i))
+				require.NoError(t, err)
+				require.Equal(t, meta(i), item.UserMeta())
+			}
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			var cnt int
+			for it.Rewind(); it.Valid(); it.Next() {
+				require.Equal(t, meta(cnt), it.Item().UserMeta())
+				cnt++
+			}
+			require.Equal(t, 100, cnt)
+			return nil
+		}))
+	}
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 100; i++ {
+			val := make([]byte, 10+i*20)
+			if i%2 == 0 {
+				require.NoError(t, txn.SetEntry(&Entry{Key: y.KeyWithTs(key(i), 0), Value: val, UserMeta: meta(i)}))
+			} else {
+				require.NoError(t, txn.SetWithMetaSlice(key(i), val, meta(i)))
+			}
+		}
+		item, err := txn.Get(key(0))
+		require.NoError(t, err)
+		require.Equal(t, meta(0), item.UserMeta())
+		require.Equal(t, ErrUserMetaTooLarge, txn.SetWithMetaSlice(key(0), nil, make([]byte, 256)))
+		return nil
+	}))
+	validate()
+	db.flushMemTable().Wait()
+	validate()
+	require.NoError(t, db.Close())
+
+	db, err = Open(getTestOptions(dir))
+	require.NoError(t, err)
+	validate()
+	require.NoError(t, db.Close())
+}
+
+func TestIteratorMetaFilter(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		set := func(key, val string, tagged bool) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				e := &Entry{Key: y.KeyWithTs([]byte(key), 0), Value: []byte(val)}
+				if tagged {
+					e.WithAppMeta(AppMetaMask)
+				}
+				return txn.SetEntry(e)
+			}))
+		}
+		set("a", "a0", false)
+		set("a", "a1", true)
+		set("b", "b0", true)
+		set("c", "c0", true)
+		set("c", "c1", false)
+		collect := func(txn *Txn, opts IteratorOptions) []string {
+			it := txn.NewIterator(opts)
+			defer it.Close()
+			var vals []string
+			for it.Rewind(); it.Valid(); it.Next() {
+				require.Zero(t, it.Item().AppMeta())
+				vals = append(vals, string(getItemValue(t, it.Item())))
+			}
+			return vals
+		}
+		validate := func() {
+			txn := db.NewTransaction(true)
+			defer txn.Discard()
+			opts := DefaultIteratorOptions
+			opts.MetaFilter = func(meta byte) bool {
+				return meta&AppMetaMask == 0
+			}
+			require.Equal(t, []string{"c1"}, collect(txn, opts))
+			opts.AllVersions = true
+			require.Equal(t, []string{"a0", "c1"}, collect(txn, opts))
+
+			// The pending writes are filtered too.
+			require.NoError(t, txn.SetEntry((&Entry{Key: y.KeyWithTs([]byte("c"), 0), Value: []byte("c2")}).WithAppMeta(0xff)))
+			require.NoError(t, txn.Set([]byte("d"), []byte("d0")))
+			opts.AllVersions = false
+			require.Equal(t, []string{"d0"}, collect(txn, opts))
+
+			item, err := txn.Get([]byte("b"))
+			require.NoError(t, err)
+			require.Equal(t, AppMetaMask, item.AppMeta())
+		}
+		validate()
+		db.flushMemTable().Wait()
+		validate()
+	})
+}
+
+func TestPendingWritesIteratorExpiresAt(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		e := (&Entry{Key: y.KeyWithTs([]byte("a"), 0), Value: []byte("a")}).WithTTL(time.Hour)
+		require.NoError(t, txn.SetEntry(e))
+		require.NoError(t, txn.Set([]byte("b"), []byte("b")))
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		var expiresAts []uint64
+		for it.Rewind(); it.Valid(); it.Next() {
+			expiresAts = append(expiresAts, it.Item().ExpiresAt())
+		}
+		require.Equal(t, []uint64{e.ExpiresAt, 0}, expiresAts)
+	})
+}
@@ -19,6 +19,7 @@ package badger
 import (
 	"bufio"
 	"bytes"
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
@@ -32,15 +33,23 @@ import (
 	"sync/atomic"
 
 	"github.com/pingcap/badger/fileutil"
+	"github.com/pingcap/badger/options"
+	"github.com/pingcap/badger/protos"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
+	"go.uber.org/zap"
 )
 
 // Values have their first byte being byteData or byteDelete. This helps us distinguish between
 // a key that has never been seen and a key that has been explicitly deleted.
 const (
-	bitDelete       byte = 1 << 0 // Set if the key has been deleted.
-	bitValuePointer byte = 1 << 1 // Set if the value is NOT stored directly next to key.
+	bitDelete       byte = y.BitDelete    // Set if the key has been deleted.
+	bitValuePointer byte = 1 << 1         // Set if the value is NOT stored directly next to key.
+	bitExpiresAt    byte = y.BitExpiresAt // Set if the entry has an expiry time.
+	bitValueInline  byte = 1 << 3         // Set if the value must be stored in the LSM tree.
+	bitValueInBlob  byte = 1 << 4         // Set if the value must be stored in a blob file.
+
+	bitValuePlacement = bitValueInline | bitValueInBlob
 
 	// The MSB 2 bits are for transactions.
 	bitTxn    byte = 1 << 6 // Set if the entry is part of a txn.
@@ -49,11 +58,95 @@ const (
 	mi int64 = 1 << 20
 )
 
+// AppMetaMask is the bits of the entry meta reserved for the applications, the other bits are used
+// by badger. Only the bit 5 is free as the meta is a single byte. The application bits are set by
+// Entry.WithAppMeta and kept by the flushes, the compactions, the backups and the exports, they are
+// returned by Item.AppMeta and can be filtered by IteratorOptions.MetaFilter without reading the
+// values.
+const AppMetaMask byte = 1 << 5
+
 type logFile struct {
 	path string
 	fd   *os.File
 	fid  uint32
 	size uint32
+
+	// dataKey and baseIV are loaded from the header of an encrypted log file.
+	dataKey *options.DataKey
+	baseIV  []byte
+}
+
+/*
+An encrypted log file starts with a header, the first byte is 0 so it is never read as an entry:
+
+	/ vlogEncryptedMagic(8) / keyID(8) / baseIV(12) /
+
+The UserMeta, key and value of an entry are encrypted with the IV baseIV | entryOffset(4).
+*/
+const (
+	vlogEncryptedMagic = "\x00ENCVLOG"
+	vlogBaseIVSize     = 12
+	vlogHeaderSize     = len(vlogEncryptedMagic) + 8 + vlogBaseIVSize
+)
+
+// headerSize returns the size of the header before the entries.
+func (lf *logFile) headerSize() uint32 {
+	if lf.dataKey == nil {
+		return 0
+	}
+	return uint32(vlogHeaderSize)
+}
+
+// readHeader loads the data key if the file is encrypted.
+func (lf *logFile) readHeader(registry options.KeyRegistry) error {
+	var buf [vlogHeaderSize]byte
+	if _, err := lf.fd.ReadAt(buf[:], 0); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return errors.Wrapf(err, "Unable to read header of value log: %q", lf.path)
+	}
+	if string(buf[:len(vlogEncryptedMagic)]) != vlogEncryptedMagic {
+		return nil
+	}
+	keyID := binary.BigEndian.Uint64(buf[len(vlogEncryptedMagic):])
+	dataKey, err := registry.DataKey(keyID)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to get the data key of value log: %q", lf.path)
+	}
+	lf.dataKey = dataKey
+	lf.baseIV = y.Copy(buf[vlogHeaderSize-vlogBaseIVSize:])
+	return nil
+}
+
+// writeHeader encrypts the new log file with the data key.
+func (lf *logFile) writeHeader(dataKey *options.DataKey) error {
+	iv, err := y.GenerateIV()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, vlogHeaderSize)
+	copy(buf, vlogEncryptedMagic)
+	binary.BigEndian.PutUint64(buf[len(vlogEncryptedMagic):], dataKey.ID)
+	copy(buf[vlogHeaderSize-vlogBaseIVSize:], iv)
+	if _, err = lf.fd.Write(buf); err != nil {
+		return errors.Wrapf(err, "Unable to write header of value log: %q", lf.path)
+	}
+	lf.dataKey = dataKey
+	lf.baseIV = buf[vlogHeaderSize-vlogBaseIVSize:]
+	return nil
+}
+
+// entryStream returns the stream to encrypt or decrypt the entry at offset, it returns nil if
+// the file is not encrypted.
+func (lf *logFile) entryStream(offset uint32) (cipher.Stream, error) {
+	if lf.dataKey == nil {
+		return nil, nil
+	}
+	var iv [y.IVSize]byte
+	copy(iv[:], lf.baseIV)
+	binary.BigEndian.PutUint32(iv[vlogBaseIVSize:], offset)
+	return y.NewXORStream(lf.dataKey.Key, iv[:])
 }
 
 // openReadOnly assumes that we have a write lock on logFile.
@@ -100,6 +193,7 @@ type safeRead struct {
 	k  []byte
 	v  []byte
 	um []byte
+	lf *logFile
 
 	recordOffset uint32
 }
@@ -135,6 +229,16 @@ func (r *safeRead) Entry(reader *bufio.Reader) (*Entry, error) {
 
 	e := &Entry{}
 	e.offset = r.recordOffset
+	if h.meta&bitExpiresAt != 0 {
+		var expiresAtBuf [expiresAtSize]byte
+		if _, err = io.ReadFull(tee, expiresAtBuf[:]); err != nil {
+			if err == io.EOF {
+				err = errTruncate
+			}
+			return nil, err
+		}
+		e.ExpiresAt = binary.BigEndian.Uint64(expiresAtBuf[:])
+	}
 	e.Key.UserKey = r.k[:kl]
 	e.Key.Version = h.ver
 	e.Value = r.v[:vl]
@@ -174,13 +278,28 @@ func (r *safeRead) Entry(reader *bufio.Reader) (*Entry, error) {
 	if crc != hash.Sum32() {
 		return nil, errTruncate
 	}
+	if r.lf != nil {
+		stream, err := r.lf.entryStream(r.recordOffset)
+		if err != nil {
+			return nil, err
+		}
+		if stream != nil {
+			stream.XORKeyStream(e.UserMeta, e.UserMeta)
+			stream.XORKeyStream(e.Key.UserKey, e.Key.UserKey)
+			stream.XORKeyStream(e.Value, e.Value)
+		}
+	}
 	e.meta = h.meta
 	return e, nil
 }
 
 // iterate iterates over log file. It doesn't not allocate new memory for every kv pair.
 // Therefore, the kv pair is only valid for the duration of fn call.
+// It returns errTruncate with the end of the last valid entry if it stops at a corrupt entry.
 func (vlog *valueLog) iterate(lf *logFile, offset uint32, fn logEntry) (uint32, error) {
+	if offset < lf.headerSize() {
+		offset = lf.headerSize()
+	}
 	_, err := lf.fd.Seek(int64(offset), io.SeekStart)
 	if err != nil {
 		return 0, y.Wrap(err)
@@ -190,6 +309,7 @@ func (vlog *valueLog) iterate(lf *logFile, offset uint32, fn logEntry) (uint32,
 	read := &safeRead{
 		k:            make([]byte, 10),
 		v:            make([]byte, 10),
+		lf:           lf,
 		recordOffset: offset,
 	}
 
@@ -200,14 +320,14 @@ func (vlog *valueLog) iterate(lf *logFile, offset uint32, fn logEntry) (uint32,
 		if err == io.EOF {
 			break
 		} else if err == io.ErrUnexpectedEOF || err == errTruncate {
-			break
+			return validEndOffset, errTruncate
 		} else if err != nil {
 			return validEndOffset, err
 		} else if e == nil {
 			continue
 		}
 
-		read.recordOffset += uint32(headerBufSize + len(e.Key.UserKey) + len(e.Value) + len(e.UserMeta) + 4) // len(crcBuf)
+		read.recordOffset += uint32(e.encodedSize())
 
 		if e.meta&bitTxn > 0 {
 			if !vlog.kv.IsManaged() {
@@ -278,6 +398,8 @@ type valueLog struct {
 
 	kv     *DB
 	maxPtr uint64
+	// sealedSize is the total size of the files before the current file, it is accessed atomically.
+	sealedSize int64
 
 	numEntriesWritten uint32
 	opt               Options
@@ -352,6 +474,10 @@ func (vlog *valueLog) openOrCreateFiles(readOnly bool) error {
 			if err := lf.openReadOnly(); err != nil {
 				return err
 			}
+			vlog.sealedSize += int64(lf.size)
+		}
+		if err = lf.readHeader(vlog.kv.keyRegistry); err != nil {
+			return err
 		}
 	}
 
@@ -380,6 +506,12 @@ func (vlog *valueLog) createVlogFile(fid uint32) error {
 	if err = fileutil.Preallocate(lf.fd, vlog.opt.ValueLogFileSize); err != nil {
 		return errors.Wrap(err, "Unable to preallocate value log file")
 	}
+	if dataKey := vlog.kv.keyRegistry.LatestDataKey(); dataKey != nil {
+		if err = lf.writeHeader(dataKey); err != nil {
+			return err
+		}
+		atomic.StoreUint64(&vlog.maxPtr, uint64(fid)<<32|uint64(lf.headerSize()))
+	}
 	opt := &vlog.opt.ValueLogWriteOptions
 	if vlog.curWriter == nil {
 		vlog.curWriter = fileutil.NewBufferedWriter(lf.fd, opt.WriteBufferSize, nil)
@@ -397,6 +529,7 @@ func (vlog *valueLog) createVlogFile(fid uint32) error {
 		if deleteCandidate.fid < syncedFid {
 			os.Remove(deleteCandidate.path)
 			deleteCandidate.fd.Close()
+			atomic.AddInt64(&vlog.sealedSize, -int64(deleteCandidate.size))
 			vlog.files = vlog.files[1:]
 			continue
 		}
@@ -444,6 +577,18 @@ func (vlog *valueLog) Replay(off logOffset, fn logEntry) error {
 			of = 0
 		}
 		endAt, err := vlog.iterate(lf, of, fn)
+		if err == errTruncate {
+			if vlog.opt.RecoveryMode == options.Strict {
+				return errors.Errorf("value log %q has a corrupt entry after offset %d", lf.path, endAt)
+			}
+			vlog.opt.Logger.Warn("value log has a corrupt entry, the entries after the offset are lost",
+				zap.String("path", lf.path), zap.Uint32("offset", endAt))
+			err = nil
+			if lf.fid == vlog.maxFid() && !vlog.opt.ReadOnly {
+				// Truncate the corrupt tail so it isn't left after the entries written next.
+				err = lf.fd.Truncate(int64(endAt))
+			}
+		}
 		if err != nil {
 			return errors.Wrapf(err, "Unable to replay value log: %q", lf.path)
 		}
@@ -456,7 +601,7 @@ func (vlog *valueLog) Replay(off logOffset, fn logEntry) error {
 	var err error
 	last := vlog.files[len(vlog.files)-1]
 	_, err = last.fd.Seek(int64(lastOffset), io.SeekStart)
-	atomic.AddUint64(&vlog.maxPtr, uint64(lastOffset))
+	atomic.StoreUint64(&vlog.maxPtr, uint64(last.fid)<<32|uint64(lastOffset))
 	return errors.Wrapf(err, "Unable to seek to end of value log: %q", last.path)
 }
 
@@ -511,6 +656,11 @@ func (vlog *valueLog) writableOffset() uint32 {
 	return uint32(atomic.LoadUint64(&vlog.maxPtr))
 }
 
+// size returns the size of the live value log files.
+func (vlog *valueLog) size() int64 {
+	return atomic.LoadInt64(&vlog.sealedSize) + int64(vlog.writableOffset())
+}
+
 func (vlog *valueLog) flush() error {
 	curlf := vlog.currentLogFile()
 	if vlog.pendingLen == 0 {
@@ -531,6 +681,8 @@ func (vlog *valueLog) flush() error {
 		if err = curlf.doneWriting(vlog.writableOffset()); err != nil {
 			return err
 		}
+		curlf.size = vlog.writableOffset()
+		atomic.AddInt64(&vlog.sealedSize, int64(curlf.size))
 		err = vlog.createVlogFile(vlog.maxFid() + 1)
 		if err != nil {
 			return err
@@ -545,7 +697,11 @@ func (vlog *valueLog) write(reqs []*request) error {
 		b := reqs[i]
 		for j := range b.Entries {
 			e := b.Entries[j]
-			plen, err := encodeEntry(e, &vlog.buf) // Now encode the entry into buffer.
+			stream, err := vlog.currentLogFile().entryStream(vlog.writableOffset() + uint32(vlog.pendingLen))
+			if err != nil {
+				return err
+			}
+			plen, err := encodeEntry(e, &vlog.buf, stream) // Now encode the entry into buffer.
 			if err != nil {
 				return err
 			}
@@ -585,3 +741,42 @@ func (vlog *valueLog) getFile(fid uint32) (*logFile, error) {
 	// log file has gone away, will need to retry the operation.
 	return nil, ErrRetry
 }
+
+// hasValueLogFiles returns true if there is any value log file in dir.
+func hasValueLogFiles(dir string) (bool, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, errors.Wrapf(err, "Error while opening value log")
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".vlog") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeValueLog flushes the entries replayed from the value log and removes the value log files.
+// It's called by Open if DisableValueLog is set.
+func (db *DB) removeValueLog() error {
+	if !db.mtbls.Load().(*memTables).getMutable().Empty() {
+		db.flushMemTable().Wait()
+	}
+	// Reset the head, so the value log created after the option is turned off again is
+	// replayed from the start.
+	db.logOff = logOffset{}
+	if err := db.manifest.addChanges(nil, &protos.HeadInfo{Version: db.orc.commitTs()}); err != nil {
+		return err
+	}
+	vlog := &db.vlog
+	for _, lf := range vlog.files {
+		if err := vlog.deleteLogFile(lf); err != nil {
+			return err
+		}
+	}
+	vlog.files = nil
+	vlog.curWriter = nil
+	atomic.StoreUint64(&vlog.maxPtr, 0)
+	atomic.StoreInt64(&vlog.sealedSize, 0)
+	return syncDir(vlog.dirPath)
+}
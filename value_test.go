@@ -24,6 +24,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/pingcap/badger/options"
 	"github.com/pingcap/badger/y"
 	"github.com/stretchr/testify/require"
 )
@@ -288,6 +289,51 @@ func TestPartialAppendToValueLog(t *testing.T) {
 	require.NoError(t, kv.Close())
 }
 
+func TestRecoveryModeValueLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Create skeleton files.
+	opts := getTestOptions(dir)
+	kv, err := Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, kv.Close())
+
+	k0, v0 := []byte("k0"), []byte("value0-012345678901234567890123")
+	k1, v1 := []byte("k1"), []byte("value1-012345678901234567890123")
+	buf := createVlog(t, []*Entry{
+		{Key: y.KeyWithTs(k0, 0), Value: v0},
+		{Key: y.KeyWithTs(k1, 0), Value: v1},
+	})
+	vlogPath := vlogFilePath(dir, 0)
+	require.NoError(t, ioutil.WriteFile(vlogPath, buf[:len(buf)-6], 0777))
+
+	opts.RecoveryMode = options.Strict
+	_, err = Open(opts)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "corrupt entry")
+
+	// The corrupt tail is truncated.
+	opts.RecoveryMode = options.TolerateTail
+	kv, err = Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, kv.View(func(txn *Txn) error {
+		item, err := txn.Get(k0)
+		require.NoError(t, err)
+		require.Equal(t, v0, getItemValue(t, item))
+		_, err = txn.Get(k1)
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+	require.NoError(t, kv.Close())
+
+	opts.RecoveryMode = options.Strict
+	kv, err = Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, kv.Close())
+}
+
 func TestReadOnlyOpenWithPartialAppendToValueLog(t *testing.T) {
 	dir, err := ioutil.TempDir("", "badger")
 	require.NoError(t, err)
@@ -326,6 +372,30 @@ func TestReadOnlyOpenWithPartialAppendToValueLog(t *testing.T) {
 	require.Regexp(t, "Database was not properly closed, cannot open read-only|Read-only mode is not supported on Windows", err.Error())
 }
 
+func TestEntryExpiresAtEncoding(t *testing.T) {
+	e := &Entry{
+		Key:       y.KeyWithTs([]byte("key"), 10),
+		Value:     []byte("value"),
+		UserMeta:  []byte{1},
+		ExpiresAt: 12345,
+		meta:      bitTxn | bitExpiresAt,
+	}
+	var buf bytes.Buffer
+	n, err := encodeEntry(e, &buf, nil)
+	require.NoError(t, err)
+	require.Equal(t, buf.Len(), n)
+
+	read := &safeRead{}
+	got, err := read.Entry(bufio.NewReader(&buf))
+	require.NoError(t, err)
+	require.Equal(t, e.Key, got.Key)
+	require.Equal(t, e.Value, got.Value)
+	require.Equal(t, e.UserMeta, got.UserMeta)
+	require.Equal(t, e.ExpiresAt, got.ExpiresAt)
+	require.Equal(t, e.meta, got.meta)
+	require.Equal(t, n, got.encodedSize())
+}
+
 func createVlog(t *testing.T, entries []*Entry) []byte {
 	dir, err := ioutil.TempDir("", "badger")
 	require.NoError(t, err)
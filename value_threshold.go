@@ -0,0 +1,80 @@
+package badger
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// valueSizeBuckets is the number of the buckets of valueThreshold, the values are at most 64KB
+// after the blob pointers.
+const valueSizeBuckets = 18
+
+// valueThreshold adjusts the value threshold to the observed value sizes. The sizes are counted in
+// power of two buckets, the i-th bucket counts the sizes in [1<<(i-1), 1<<i). The threshold is
+// updated on every memtable flush to the smallest upper bound of the buckets which covers the
+// percentile of the sizes, then the counts are halved so the old sizes fade out.
+type valueThreshold struct {
+	threshold  int64
+	min, max   int
+	percentile float64
+	counts     [valueSizeBuckets]uint64
+}
+
+func newValueThreshold(opt Options) *valueThreshold {
+	if !opt.DynamicValueThreshold || opt.ValueThreshold == 0 {
+		return nil
+	}
+	return &valueThreshold{
+		threshold:  int64(opt.ValueThreshold),
+		min:        opt.ValueThreshold,
+		max:        opt.MaxValueThreshold,
+		percentile: opt.ValueSizePercentile,
+	}
+}
+
+// record counts the size of a written value.
+func (vt *valueThreshold) record(size int) {
+	if vt == nil {
+		return
+	}
+	idx := bits.Len(uint(size))
+	if idx >= valueSizeBuckets {
+		idx = valueSizeBuckets - 1
+	}
+	atomic.AddUint64(&vt.counts[idx], 1)
+}
+
+// update recomputes the threshold from the counted sizes and decays the counts.
+func (vt *valueThreshold) update() {
+	var counts [valueSizeBuckets]uint64
+	var total uint64
+	for i := range vt.counts {
+		counts[i] = atomic.LoadUint64(&vt.counts[i])
+		total += counts[i]
+		atomic.AddUint64(&vt.counts[i], ^(counts[i]/2 - 1))
+	}
+	if total == 0 {
+		return
+	}
+	target := uint64(vt.percentile * float64(total))
+	var covered uint64
+	threshold := vt.max
+	for i, count := range counts {
+		covered += count
+		if covered >= target {
+			threshold = 1<<uint(i) - 1
+			break
+		}
+	}
+	if threshold < vt.min {
+		threshold = vt.min
+	}
+	if threshold > vt.max {
+		threshold = vt.max
+	}
+	atomic.StoreInt64(&vt.threshold, int64(threshold))
+}
+
+func (vt *valueThreshold) get() int {
+	return int(atomic.LoadInt64(&vt.threshold))
+}
@@ -0,0 +1,81 @@
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueThreshold(t *testing.T) {
+	opt := DefaultOptions
+	opt.DynamicValueThreshold = true
+	opt.ValueThreshold = 32
+	opt.MaxValueThreshold = 4 << 10
+	opt.ValueSizePercentile = 0.9
+	vt := newValueThreshold(opt)
+	require.Equal(t, 32, vt.get())
+
+	// Nothing recorded keeps the threshold.
+	vt.update()
+	require.Equal(t, 32, vt.get())
+
+	for i := 0; i < 90; i++ {
+		vt.record(200)
+	}
+	for i := 0; i < 10; i++ {
+		vt.record(3000)
+	}
+	vt.update()
+	require.Equal(t, 255, vt.get())
+
+	// The old sizes fade out.
+	for i := 0; i < 1000; i++ {
+		vt.record(10)
+	}
+	vt.update()
+	require.Equal(t, 32, vt.get())
+
+	for i := 0; i < 10000; i++ {
+		vt.record(60000)
+	}
+	vt.update()
+	require.Equal(t, 4<<10, vt.get())
+
+	opt.DynamicValueThreshold = false
+	require.Nil(t, newValueThreshold(opt))
+}
+
+func TestDynamicValueThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opt := getTestOptions(dir)
+	opt.DynamicValueThreshold = true
+	opt.ValueThreshold = 32
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+
+	val := make([]byte, 500)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte(fmt.Sprintf("key%03d", i)), val)
+		}))
+	}
+	db.flushMemTable().Wait()
+	require.Equal(t, 511, db.getValueThreshold())
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte(fmt.Sprintf("key%03d", i)))
+			if err != nil {
+				return err
+			}
+			require.Equal(t, val, getItemValue(t, item))
+			return nil
+		}))
+	}
+}
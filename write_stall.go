@@ -0,0 +1,50 @@
+package badger
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/badger/options"
+)
+
+// WriteStallStats counts the write stalls by the reason.
+type WriteStallStats struct {
+	// Counts is the number of the stalls indexed by the reason.
+	Counts [options.NumWriteStallReasons]int64
+	// Durations is the total time the writes stalled indexed by the reason.
+	Durations [options.NumWriteStallReasons]time.Duration
+}
+
+type writeStallCounters struct {
+	counts [options.NumWriteStallReasons]int64
+	nanos  [options.NumWriteStallReasons]int64
+}
+
+// WriteStallStats returns the write stalls since the DB is opened.
+func (db *DB) WriteStallStats() WriteStallStats {
+	var stats WriteStallStats
+	for i := range stats.Counts {
+		stats.Counts[i] = atomic.LoadInt64(&db.writeStalls.counts[i])
+		stats.Durations[i] = time.Duration(atomic.LoadInt64(&db.writeStalls.nanos[i]))
+	}
+	return stats
+}
+
+// beginWriteStall counts a write stall and calls OnWriteStall, the returned function must be
+// called when the stall ends.
+func (db *DB) beginWriteStall(reason options.WriteStallReason) (end func()) {
+	atomic.AddInt64(&db.writeStalls.counts[reason], 1)
+	db.metrics.NumWriteStallsOf(reason.String()).Inc()
+	if db.opt.OnWriteStall != nil {
+		db.opt.OnWriteStall(true, reason)
+	}
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		atomic.AddInt64(&db.writeStalls.nanos[reason], int64(d))
+		db.metrics.WriteStallSeconds.Add(d.Seconds())
+		if db.opt.OnWriteStall != nil {
+			db.opt.OnWriteStall(false, reason)
+		}
+	}
+}
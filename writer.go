@@ -29,11 +29,16 @@ import (
 	"go.uber.org/zap"
 )
 
+// writeWorker writes the requests in a pipeline, so the requests in different stages overlap:
+// runWriteVLog appends the requests to the value log, runFlusher syncs the value log if SyncWrites
+// is true, runWriteLSM applies the requests to the memtable, runMergeLSM merges the applied
+// entries into the skiplist and runNotify publishes the requests and notifies the writers.
 type writeWorker struct {
 	*DB
 	writeLSMCh chan postLogTask
 	mergeLSMCh chan mergeLSMTask
 	flushCh    chan postLogTask
+	notifyCh   chan notifyTask
 }
 
 type mergeLSMTask struct {
@@ -46,27 +51,39 @@ type postLogTask struct {
 	reqs    []*request
 }
 
+type notifyTask struct {
+	reqs []*request
+	err  error
+}
+
 func startWriteWorker(db *DB) *y.Closer {
-	numWorkers := 3
-	if db.opt.SyncWrites {
-		numWorkers += 1
-	}
-	closer := y.NewCloser(numWorkers)
 	w := &writeWorker{
 		DB:         db,
 		writeLSMCh: make(chan postLogTask, 1),
 		mergeLSMCh: make(chan mergeLSMTask, 1),
 		flushCh:    make(chan postLogTask),
+		notifyCh:   make(chan notifyTask, 1),
+	}
+	numWorkers := 4
+	if w.syncValueLog() {
+		numWorkers += 1
 	}
-	if db.opt.SyncWrites {
+	closer := y.NewCloser(numWorkers)
+	if w.syncValueLog() {
 		go w.runFlusher(closer)
 	}
 	go w.runWriteVLog(closer)
 	go w.runWriteLSM(closer)
 	go w.runMergeLSM(closer)
+	go w.runNotify(closer)
 	return closer
 }
 
+// syncValueLog returns true if runFlusher syncs the value log before the requests are applied.
+func (w *writeWorker) syncValueLog() bool {
+	return w.opt.SyncWrites && !w.opt.DisableValueLog
+}
+
 func (w *writeWorker) runFlusher(lc *y.Closer) {
 	defer lc.Done()
 	for {
@@ -94,10 +111,12 @@ func (w *writeWorker) runWriteVLog(lc *y.Closer) {
 		select {
 		case task := <-w.ingestCh:
 			w.ingestTables(task)
+		case task := <-w.checkpointCh:
+			w.prepareCheckpoint(task)
+		case task := <-w.dropAllCh:
+			w.dropAll(task)
 		case r = <-w.writeCh:
-			reqs := make([]*request, len(w.writeCh)+1)
-			reqs[0] = r
-			w.pollWriteCh(reqs[1:])
+			reqs := w.collectWriteReqs(r)
 			if err := w.writeVLog(reqs); err != nil {
 				return
 			}
@@ -108,6 +127,33 @@ func (w *writeWorker) runWriteVLog(lc *y.Closer) {
 	}
 }
 
+// collectWriteReqs returns r with the requests to write in the same batch. The requests in writeCh
+// are taken, then it waits for more requests for at most MaxCommitDelay until the batch is full.
+func (w *writeWorker) collectWriteReqs(r *request) []*request {
+	maxSize := w.opt.MaxCommitBatchSize
+	n := len(w.writeCh) + 1
+	if maxSize > 0 && n > maxSize {
+		n = maxSize
+	}
+	reqs := make([]*request, n)
+	reqs[0] = r
+	w.pollWriteCh(reqs[1:])
+	if w.opt.MaxCommitDelay <= 0 || (maxSize > 0 && len(reqs) >= maxSize) {
+		return reqs
+	}
+	timer := time.NewTimer(w.opt.MaxCommitDelay)
+	defer timer.Stop()
+	for maxSize <= 0 || len(reqs) < maxSize {
+		select {
+		case r = <-w.writeCh:
+			reqs = append(reqs, r)
+		case <-timer.C:
+			return reqs
+		}
+	}
+	return reqs
+}
+
 func (w *writeWorker) pollWriteCh(buf []*request) []*request {
 	for i := 0; i < len(buf); i++ {
 		buf[i] = <-w.writeCh
@@ -116,6 +162,10 @@ func (w *writeWorker) pollWriteCh(buf []*request) []*request {
 }
 
 func (w *writeWorker) writeVLog(reqs []*request) error {
+	if w.opt.DisableValueLog {
+		w.writeLSMCh <- postLogTask{reqs: reqs}
+		return nil
+	}
 	if !w.volatileMode {
 		if err := w.vlog.write(reqs); err != nil {
 			w.done(reqs, err)
@@ -141,6 +191,7 @@ func (w *writeWorker) runWriteLSM(lc *y.Closer) {
 		t, ok := <-w.writeLSMCh
 		if !ok {
 			close(w.mergeLSMCh)
+			close(w.notifyCh)
 			return
 		}
 		start := time.Now()
@@ -157,12 +208,33 @@ func (w *writeWorker) runMergeLSM(lc *y.Closer) {
 	}
 }
 
+func (w *writeWorker) runNotify(lc *y.Closer) {
+	defer lc.Done()
+	for task := range w.notifyCh {
+		if task.err == nil {
+			w.publisher.publish(task.reqs)
+			if w.opt.CommitHook != nil {
+				callCommitHook(w.opt.CommitHook, task.reqs)
+			}
+		}
+		w.done(task.reqs, task.err)
+	}
+}
+
 func (w *writeWorker) closeWriteVLog() {
 	close(w.writeCh)
 	var reqs []*request
 	for r := range w.writeCh { // Flush the channel.
 		reqs = append(reqs, r)
 	}
+	if w.opt.DisableValueLog {
+		// The requests are applied to the memtable, which is flushed by Close.
+		if len(reqs) > 0 {
+			w.writeLSMCh <- postLogTask{reqs: reqs}
+		}
+		close(w.writeLSMCh)
+		return
+	}
 	var err error
 	if !w.volatileMode {
 		err = w.vlog.write(reqs)
@@ -174,7 +246,7 @@ func (w *writeWorker) closeWriteVLog() {
 		// The store is closed, we don't need to write LSM.
 		w.done(reqs, err)
 	}
-	if !w.opt.SyncWrites {
+	if !w.syncValueLog() {
 		close(w.writeLSMCh)
 	} else {
 		// The channel would be closed by the flusher.
@@ -193,12 +265,12 @@ func (w *writeWorker) writeLSM(reqs []*request) {
 		}
 		count += len(b.Entries)
 		if err := w.writeToLSM(b.Entries); err != nil {
-			w.done(reqs, err)
+			w.notifyCh <- notifyTask{reqs: reqs, err: err}
 			return
 		}
 	}
 
-	w.done(reqs, nil)
+	w.notifyCh <- notifyTask{reqs: reqs}
 	log.Debug("entries written", zap.Int("count", count))
 	return
 }
@@ -217,10 +289,11 @@ func newEntry(entry *Entry) memtable.Entry {
 	return memtable.Entry{
 		Key: entry.Key.UserKey,
 		Value: y.ValueStruct{
-			Value:    entry.Value,
-			Meta:     entry.meta,
-			UserMeta: entry.UserMeta,
-			Version:  entry.Key.Version,
+			Value:     entry.Value,
+			Meta:      entry.meta,
+			UserMeta:  entry.UserMeta,
+			ExpiresAt: entry.ExpiresAt,
+			Version:   entry.Key.Version,
 		},
 	}
 }
@@ -230,9 +303,7 @@ func (w *writeWorker) writeToLSM(entries []*Entry) error {
 	for len(entries) != 0 {
 		e := newEntry(entries[0])
 		free := w.ensureRoomForWrite(mTbls.getMutable(), e.EstimateSize())
-		if free == w.opt.MaxMemTableSize {
-			mTbls = w.mtbls.Load().(*memTables)
-		}
+		mTbls = w.mtbls.Load().(*memTables)
 
 		es := make([]memtable.Entry, 0, len(entries))
 		var i int
@@ -248,6 +319,7 @@ func (w *writeWorker) writeToLSM(entries []*Entry) error {
 			}
 			free -= e.EstimateSize()
 			es = append(es, e)
+			w.valueThreshold.record(len(entry.Value))
 		}
 		w.updateOffset(entries[i-1].logOffset)
 		entries = entries[i:]
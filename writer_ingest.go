@@ -1,6 +1,7 @@
 package badger
 
 import (
+	"bytes"
 	"sync"
 	"sync/atomic"
 
@@ -16,6 +17,10 @@ type ingestTask struct {
 	tbls []table.Table
 	cnt  int
 	err  error
+
+	// replace is set to delete the data in [start, end) with the tables ingested.
+	replace    bool
+	start, end []byte
 }
 
 func (w *writeWorker) ingestTables(task *ingestTask) {
@@ -32,13 +37,11 @@ func (w *writeWorker) ingestTables(task *ingestTask) {
 		defer task.Done()
 		defer w.orc.doneCommit(ts)
 
+		if task.err = setGlobalTs(task.tbls, ts); task.err != nil {
+			return
+		}
 		ends := make([]y.Key, 0, len(task.tbls))
-
 		for _, t := range task.tbls {
-			sst := t.(*sstable.Table)
-			if task.err = sst.SetGlobalTs(ts); task.err != nil {
-				return
-			}
 			ends = append(ends, t.Biggest())
 		}
 
@@ -46,6 +49,12 @@ func (w *writeWorker) ingestTables(task *ingestTask) {
 			wg.Wait()
 		}
 
+		if task.replace {
+			if task.err = w.lc.replaceRange(task.start, task.end, task.tbls); task.err == nil {
+				task.cnt = len(task.tbls)
+			}
+			return
+		}
 		for i, tbl := range task.tbls {
 			if task.err = w.ingestTable(tbl.(*sstable.Table), ends[i+1:]); task.err != nil {
 				return
@@ -55,6 +64,32 @@ func (w *writeWorker) ingestTables(task *ingestTask) {
 	}()
 }
 
+// setGlobalTsConcurrency is the number of tables whose global ts are written concurrently.
+const setGlobalTsConcurrency = 16
+
+// setGlobalTs writes the global ts of the tables concurrently, as each write waits for the disk.
+func setGlobalTs(tbls []table.Table, ts uint64) error {
+	errs := make([]error, len(tbls))
+	limiter := make(chan struct{}, setGlobalTsConcurrency)
+	var wg sync.WaitGroup
+	for i, t := range tbls {
+		wg.Add(1)
+		limiter <- struct{}{}
+		go func(i int, t *sstable.Table) {
+			defer wg.Done()
+			errs[i] = t.SetGlobalTs(ts)
+			<-limiter
+		}(i, t.(*sstable.Table))
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (w *writeWorker) prepareIngestTask(task *ingestTask) (ts uint64, wg *sync.WaitGroup, err error) {
 	w.orc.writeLock.Lock()
 	if !w.IsManaged() {
@@ -71,6 +106,20 @@ func (w *writeWorker) prepareIngestTask(task *ingestTask) (ts uint64, wg *sync.W
 	defer guard.Done()
 	mTbls := w.mtbls.Load().(*memTables)
 	y.Assert(mTbls.tables[0] != nil)
+	if task.replace {
+		// The data in the range is deleted from the levels, so all the memtables with keys in the
+		// range must be flushed. Flushing the mutable memtable waits for the older ones.
+		for _, mt := range mTbls.tables[:atomic.LoadUint32(&mTbls.length)] {
+			it := mt.NewIterator(false)
+			it.Seek(task.start)
+			inRange := it.Valid() && bytes.Compare(it.Key().UserKey, task.end) < 0
+			it.Close()
+			if inRange {
+				return ts, w.flushMemTable(), nil
+			}
+		}
+		return
+	}
 	it := mTbls.getMutable().NewIterator(false)
 	defer it.Close()
 	for _, t := range task.tbls {
@@ -0,0 +1,48 @@
+package y
+
+// Arena allocates the byte slices from large chunks, so many small copies cost few allocations.
+// The slices are released all at once by Reset, the chunks are kept for the following allocations.
+// It must not be used concurrently.
+type Arena struct {
+	chunkSize int
+	chunks    [][]byte
+	// used is the number of chunks allocated from, off is the offset in the last used chunk.
+	used int
+	off  int
+}
+
+// NewArena returns an Arena allocating chunks of chunkSize bytes.
+func NewArena(chunkSize int) *Arena {
+	return &Arena{chunkSize: chunkSize}
+}
+
+// Alloc returns a slice of n bytes, it is valid until Reset is called. The slices larger than the
+// chunk size are allocated individually.
+func (a *Arena) Alloc(n int) []byte {
+	if n > a.chunkSize {
+		return make([]byte, n)
+	}
+	if a.used == 0 || a.off+n > a.chunkSize {
+		if a.used == len(a.chunks) {
+			a.chunks = append(a.chunks, make([]byte, a.chunkSize))
+		}
+		a.used++
+		a.off = 0
+	}
+	b := a.chunks[a.used-1][a.off : a.off+n : a.off+n]
+	a.off += n
+	return b
+}
+
+// Copy returns a copy of src allocated from the arena.
+func (a *Arena) Copy(src []byte) []byte {
+	b := a.Alloc(len(src))
+	copy(b, src)
+	return b
+}
+
+// Reset releases all the slices allocated from the arena, they must not be used after it.
+func (a *Arena) Reset() {
+	a.used = 0
+	a.off = 0
+}
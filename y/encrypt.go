@@ -0,0 +1,37 @@
+package y
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+)
+
+// IVSize is the size of the initialization vector used by AES-CTR.
+const IVSize = aes.BlockSize
+
+// XORBlock encrypts or decrypts src to dst with AES-CTR, dst and src may be the same slice.
+func XORBlock(dst, src, key, iv []byte) error {
+	stream, err := NewXORStream(key, iv)
+	if err != nil {
+		return err
+	}
+	stream.XORKeyStream(dst, src)
+	return nil
+}
+
+// NewXORStream returns an AES-CTR stream, it is used when the data is encrypted or decrypted
+// in multiple pieces.
+func NewXORStream(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+// GenerateIV generates a random initialization vector.
+func GenerateIV() ([]byte, error) {
+	iv := make([]byte, IVSize)
+	_, err := rand.Read(iv)
+	return iv, err
+}
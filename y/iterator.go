@@ -20,19 +20,31 @@ import (
 	"encoding/binary"
 )
 
+// BitDelete is set in the Meta of a ValueStruct if the key has been deleted.
+const BitDelete byte = 1 << 0
+
+// BitExpiresAt is set in the Meta of a ValueStruct that has an ExpiresAt, the ExpiresAt is only
+// encoded if the bit is set.
+const BitExpiresAt byte = 1 << 2
+
 // ValueStruct represents the value info that can be associated with a key, but also the internal
 // Meta field.
 type ValueStruct struct {
-	Meta     byte
-	UserMeta []byte
-	Value    []byte
+	Meta      byte
+	UserMeta  []byte
+	Value     []byte
+	ExpiresAt uint64 // The unix time in seconds when the value expires, 0 means it never expires.
 
 	Version uint64 // This field is not serialized. Only for internal usage.
 }
 
 // EncodedSize is the size of the ValueStruct when encoded
 func (v *ValueStruct) EncodedSize() uint32 {
-	return uint32(len(v.Value) + len(v.UserMeta) + 2 + 8) // meta
+	sz := uint32(len(v.Value) + len(v.UserMeta) + 2 + 8) // meta
+	if v.Meta&BitExpiresAt != 0 {
+		sz += 8
+	}
+	return sz
 }
 
 // Decode uses the length of the slice to infer the length of the Value field.
@@ -41,11 +53,17 @@ func (v *ValueStruct) Decode(b []byte) {
 	b = b[8:]
 	v.Meta = b[0]
 	v.UserMeta = nil
-	userMetaEnd := 2 + b[1]
-	if b[1] != 0 {
-		v.UserMeta = b[2:userMetaEnd]
+	userMetaLen := b[1]
+	b = b[2:]
+	v.ExpiresAt = 0
+	if v.Meta&BitExpiresAt != 0 {
+		v.ExpiresAt = binary.LittleEndian.Uint64(b)
+		b = b[8:]
 	}
-	v.Value = b[userMetaEnd:]
+	if userMetaLen != 0 {
+		v.UserMeta = b[:userMetaLen]
+	}
+	v.Value = b[userMetaLen:]
 }
 
 // Encode expects a slice of length at least v.EncodedSize().
@@ -54,8 +72,13 @@ func (v *ValueStruct) Encode(b []byte) {
 	b = b[8:]
 	b[0] = v.Meta
 	b[1] = byte(len(v.UserMeta))
-	copy(b[2:], v.UserMeta)
-	copy(b[2+len(v.UserMeta):], v.Value)
+	b = b[2:]
+	if v.Meta&BitExpiresAt != 0 {
+		binary.LittleEndian.PutUint64(b, v.ExpiresAt)
+		b = b[8:]
+	}
+	copy(b, v.UserMeta)
+	copy(b[len(v.UserMeta):], v.Value)
 }
 
 // Valid checks if the ValueStruct is valid.
@@ -71,11 +94,64 @@ func (v *ValueStruct) EncodeTo(buf []byte) []byte {
 	binary.LittleEndian.PutUint64(tmp, v.Version)
 	buf = append(buf, tmp...)
 	buf = append(buf, v.Meta, byte(len(v.UserMeta)))
+	if v.Meta&BitExpiresAt != 0 {
+		binary.LittleEndian.PutUint64(tmp, v.ExpiresAt)
+		buf = append(buf, tmp...)
+	}
 	buf = append(buf, v.UserMeta...)
 	buf = append(buf, v.Value...)
 	return buf
 }
 
+// EncodedSizeVarint is the size of the ValueStruct when encoded by EncodeVarintTo.
+func (v *ValueStruct) EncodedSizeVarint() uint32 {
+	var tmp [binary.MaxVarintLen64]byte
+	sz := binary.PutUvarint(tmp[:], v.Version) + 1 + binary.PutUvarint(tmp[:], uint64(len(v.UserMeta)))
+	if v.Meta&BitExpiresAt != 0 {
+		sz += binary.PutUvarint(tmp[:], v.ExpiresAt)
+	}
+	return uint32(sz + len(v.UserMeta) + len(v.Value))
+}
+
+// EncodeVarintTo appends the ValueStruct to buf with the version, the UserMeta length and the
+// ExpiresAt encoded as uvarints, it saves most of the fixed overhead of EncodeTo for small values:
+//
+//	version(uvarint) | meta(1) | userMetaLen(uvarint) | [expiresAt(uvarint)] | userMeta | value
+func (v *ValueStruct) EncodeVarintTo(buf []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], v.Version)]...)
+	buf = append(buf, v.Meta)
+	buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(v.UserMeta)))]...)
+	if v.Meta&BitExpiresAt != 0 {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], v.ExpiresAt)]...)
+	}
+	buf = append(buf, v.UserMeta...)
+	buf = append(buf, v.Value...)
+	return buf
+}
+
+// DecodeVarint decodes the ValueStruct encoded by EncodeVarintTo, the length of the slice is used
+// to infer the length of the Value field.
+func (v *ValueStruct) DecodeVarint(b []byte) {
+	var n int
+	v.Version, n = binary.Uvarint(b)
+	b = b[n:]
+	v.Meta = b[0]
+	b = b[1:]
+	userMetaLen, n := binary.Uvarint(b)
+	b = b[n:]
+	v.ExpiresAt = 0
+	if v.Meta&BitExpiresAt != 0 {
+		v.ExpiresAt, n = binary.Uvarint(b)
+		b = b[n:]
+	}
+	v.UserMeta = nil
+	if userMetaLen != 0 {
+		v.UserMeta = b[:userMetaLen]
+	}
+	v.Value = b[userMetaLen:]
+}
+
 // Iterator is an interface for a basic iterator.
 type Iterator interface {
 	// Next returns the next entry with different key on the latest version.
@@ -90,6 +166,9 @@ type Iterator interface {
 	Seek(key []byte)
 	Key() Key
 	Value() ValueStruct
+	// FillValue fills vs with the current value, it is Value without returning the ValueStruct,
+	// so a caller-owned ValueStruct is filled in place by the leaf iterator through the merging
+	// iterators. The slices in vs are only valid until the iterator moves.
 	FillValue(vs *ValueStruct)
 	Valid() bool
 	Close() error
@@ -76,6 +76,22 @@ var (
 		Name:      "num_memtable_gets",
 	}, []string{labelPath})
 
+	// NumBlobGCFiles is number of blob files rewritten by GC
+	NumBlobGCFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "num_blob_gc_files",
+	}, []string{labelPath})
+	// NumBlobGCBytesReclaimed is the cumulative size of blob files reclaimed by GC
+	NumBlobGCBytesReclaimed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "num_blob_gc_bytes_reclaimed",
+	}, []string{labelPath})
+	// WriteStallSeconds is the cumulative time the writes are stalled by level 0
+	WriteStallSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "write_stall_seconds",
+	}, []string{labelPath})
+
 	// Level statistics
 
 	// NumCompactionBytesWrite has cumulative size of keys read during compaction.
@@ -144,6 +160,10 @@ var (
 		Name:      "lsm_multi_get_duration",
 		Buckets:   prometheus.ExponentialBuckets(0.0003, 1.5, 20),
 	}, []string{labelPath})
+	NumWriteStalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "num_write_stalls",
+	}, []string{labelPath, "reason"})
 )
 
 type MetricsSet struct {
@@ -157,6 +177,9 @@ type MetricsSet struct {
 	NumGets             prometheus.Counter
 	NumPuts             prometheus.Counter
 	NumMemtableGets     prometheus.Counter
+	NumBlobGCFiles      prometheus.Counter
+	NumBlobGCBytes      prometheus.Counter
+	WriteStallSeconds   prometheus.Counter
 	VlogSyncDuration    prometheus.Observer
 	WriteLSMDuration    prometheus.Observer
 	LSMGetDuration      prometheus.Observer
@@ -176,6 +199,9 @@ func NewMetricSet(path string) *MetricsSet {
 		NumGets:             NumGets.WithLabelValues(path),
 		NumPuts:             NumPuts.WithLabelValues(path),
 		NumMemtableGets:     NumMemtableGets.WithLabelValues(path),
+		NumBlobGCFiles:      NumBlobGCFiles.WithLabelValues(path),
+		NumBlobGCBytes:      NumBlobGCBytesReclaimed.WithLabelValues(path),
+		WriteStallSeconds:   WriteStallSeconds.WithLabelValues(path),
 		VlogSyncDuration:    VlogSyncDuration.WithLabelValues(path),
 		WriteLSMDuration:    WriteLSMDuration.WithLabelValues(path),
 		LSMGetDuration:      LSMGetDuration.WithLabelValues(path),
@@ -183,6 +209,11 @@ func NewMetricSet(path string) *MetricsSet {
 	}
 }
 
+// NumWriteStallsOf returns the counter of the write stalls caused by the reason.
+func (m *MetricsSet) NumWriteStallsOf(reason string) prometheus.Counter {
+	return NumWriteStalls.WithLabelValues(m.path, reason)
+}
+
 func (m *MetricsSet) NewLevelMetricsSet(levelLabel string) *LevelMetricsSet {
 	return &LevelMetricsSet{
 		MetricsSet:                m,
@@ -229,27 +260,58 @@ func (m *LevelMetricsSet) UpdateCompactionStats(stats *CompactionStats) {
 	m.NumCompactionBytesDiscard.Add(float64(stats.BytesDiscard))
 }
 
-// These variables are global and have cumulative values for all kv stores.
+// collectors are global and have cumulative values for all kv stores.
+var collectors = []prometheus.Collector{
+	LSMSize,
+	VlogSize,
+	NumReads,
+	NumWrites,
+	NumBytesRead,
+	NumVLogBytesWritten,
+	NumLSMGets,
+	NumLSMBloomFalsePositive,
+	NumGets,
+	NumPuts,
+	NumMemtableGets,
+	NumBlobGCFiles,
+	NumBlobGCBytesReclaimed,
+	WriteStallSeconds,
+	NumWriteStalls,
+	VlogSyncDuration,
+	WriteLSMDuration,
+	LSMGetDuration,
+	LSMMultiGetDuration,
+	NumCompactionBytesWrite,
+	NumCompactionBytesRead,
+	NumCompactionBytesDiscard,
+	NumCompactionKeysRead,
+	NumCompactionKeysWrite,
+	NumCompactionKeysDiscard,
+}
+
 func init() {
-	prometheus.MustRegister(LSMSize)
-	prometheus.MustRegister(VlogSize)
-	prometheus.MustRegister(NumReads)
-	prometheus.MustRegister(NumWrites)
-	prometheus.MustRegister(NumBytesRead)
-	prometheus.MustRegister(NumVLogBytesWritten)
-	prometheus.MustRegister(NumLSMGets)
-	prometheus.MustRegister(NumLSMBloomFalsePositive)
-	prometheus.MustRegister(NumGets)
-	prometheus.MustRegister(NumPuts)
-	prometheus.MustRegister(NumMemtableGets)
-	prometheus.MustRegister(VlogSyncDuration)
-	prometheus.MustRegister(WriteLSMDuration)
-	prometheus.MustRegister(LSMGetDuration)
-	prometheus.MustRegister(LSMMultiGetDuration)
-	prometheus.MustRegister(NumCompactionBytesWrite)
-	prometheus.MustRegister(NumCompactionBytesRead)
-	prometheus.MustRegister(NumCompactionBytesDiscard)
-	prometheus.MustRegister(NumCompactionKeysRead)
-	prometheus.MustRegister(NumCompactionKeysWrite)
-	prometheus.MustRegister(NumCompactionKeysDiscard)
+	for _, c := range collectors {
+		prometheus.MustRegister(c)
+	}
+}
+
+// RegisterMetrics registers the global metrics to the registerer, the metrics already registered
+// are skipped so it can be called by every kv store.
+func RegisterMetrics(r prometheus.Registerer) error {
+	for _, c := range collectors {
+		if err := RegisterCollector(r, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterCollector registers the collector to the registerer if it is not registered.
+func RegisterCollector(r prometheus.Registerer, c prometheus.Collector) error {
+	if err := r.Register(c); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			return err
+		}
+	}
+	return nil
 }
@@ -18,6 +18,7 @@ package y
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
@@ -27,6 +28,7 @@ import (
 	"sync"
 
 	"github.com/pingcap/errors"
+	"golang.org/x/time/rate"
 )
 
 // ErrEOF indicates an end of file when trying to read from a memory mapped file
@@ -121,6 +123,25 @@ func ParseKey(keyBytes []byte) Key {
 	}
 }
 
+// WaitRateLimiter waits for n bytes from the limiter, n may be larger than the burst of the
+// limiter. It only checks ctx if the limiter is nil.
+func WaitRateLimiter(ctx context.Context, limiter *rate.Limiter, n int) error {
+	if limiter == nil {
+		return ctx.Err()
+	}
+	for n > 0 {
+		m := n
+		if m > limiter.Burst() {
+			m = limiter.Burst()
+		}
+		if err := limiter.WaitN(ctx, m); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
+
 // Slice holds a reusable buf, will reallocate if you request a larger size than ever before.
 // One problem is with n distinct sizes in random order it'll reallocate log(n) times.
 type Slice struct {